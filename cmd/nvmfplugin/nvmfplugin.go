@@ -18,9 +18,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/nvmf"
@@ -40,6 +44,104 @@ func init() {
 	flag.StringVar(&conf.Region, "region", "test_region", "Region")
 	flag.StringVar(&conf.Version, "version", nvmf.DefaultDriverVersion, "Version")
 	flag.StringVar(&conf.NVMfVolumeMapDir, "nvmfVolumeMapDir", nvmf.DefaultVolumeMapPath, "Persistent volume")
+	flag.StringVar(&conf.Namespace, "namespace", nvmf.DefaultNamespace, "Namespace of the ConfigMaps read by the driver")
+	flag.StringVar(&conf.KubeAPIEndpoints, "kube-api-endpoints", "", "Comma-separated URLs of the API servers storing the driver records in etcd, the first one reachable at startup is used (defaults to the kubeconfig or in-cluster configuration)")
+	flag.StringVar(&conf.KubeAPICAFile, "kube-api-ca-file", "", "CA bundle verifying the certificate of the API server")
+	flag.StringVar(&conf.KubeAPICertFile, "kube-api-cert-file", "", "Client certificate authenticating the driver to the API server (requires kube-api-key-file)")
+	flag.StringVar(&conf.KubeAPIKeyFile, "kube-api-key-file", "", "Key of the client certificate")
+	flag.StringVar(&conf.KubeAPIUsername, "kube-api-username", "", "User authenticating the driver to the API server with basic authentication (requires kube-api-password-file)")
+	flag.StringVar(&conf.KubeAPIPasswordFile, "kube-api-password-file", "", "File holding the basic authentication password")
+	flag.StringVar(&conf.DeviceFilterConfigMap, "device-filter-configmap", "", "ConfigMap with allow/deny lists of device NQN or endpoint globs (disabled if empty)")
+	flag.StringVar(&conf.DeviceLabelsConfigMap, "device-labels-configmap", "", "ConfigMap with lines of a device NQN or endpoint glob and the name=value labels of the matching devices (disabled if empty)")
+	flag.StringVar(&conf.ExportDeviceLabels, "export-device-labels", "", "Comma-separated names of the device labels recorded in the volume context of new volumes (none if empty)")
+	flag.IntVar(&conf.ReserveHeadroomPercent, "reserve-headroom-percent", 0, "Default percentage of each device's capacity kept in reserve, requires --probe-device-capacity")
+	flag.StringVar(&conf.Backend, "backend", nvmf.BackendNone, "Target-side backend integration (none, hook)")
+	flag.StringVar(&conf.BackendHook, "backend-hook", "", "Executable invoked for backend operations when backend is hook")
+	flag.StringVar(&conf.BackendCapabilities, "backend-capabilities", "", "Comma-separated backend operations supported by the hook (e.g. snapshot)")
+	flag.StringVar(&conf.HealthChecker, "health-checker", nvmf.HealthCheckerSysfs, "Source of the volume condition reported by ControllerGetVolume and NodeGetVolumeStats: sysfs (controller state on the node, discovery state on the controller) or backend (admin state reported by the backend, then the sysfs checks; requires the health backend capability)")
+	flag.StringVar(&conf.Persistence, "persistence", nvmf.PersistenceKubernetes, "Store of the snapshot and quarantine records: kubernetes (ConfigMaps in etcd), file (local files) or bolt (a local BoltDB database); file and bolt require a single controller replica")
+	flag.StringVar(&conf.EtcdPrefix, "etcd-prefix", nvmf.DefaultEtcdPrefix, "Prefix of the keys of the records, starting and ending with /, so that driver deployments sharing a store do not see each other's records (empty uses the keys of versions without a prefix)")
+	flag.BoolVar(&conf.EtcdPrefixMigrate, "etcd-prefix-migrate", false, "Move the records stored without a key prefix, by versions before --etcd-prefix, under the configured prefix when the controller starts")
+	flag.StringVar(&conf.PersistencePath, "persistence-path", "", "Directory of the records when persistence is file, or file of the database when persistence is bolt, on storage that outlives the controller pod")
+	flag.StringVar(&conf.VolumeIDFormat, "volume-id-format", nvmf.VolumeIDFormatNQN, "Format of the IDs of new volumes: nqn (the subsystem NQN and NSID) or opaque (an encoding hiding the target naming), volumes of either format keep being served")
+	flag.BoolVar(&conf.ForceDeleteWithSnapshots, "force-delete-with-snapshots", false, "Allow DeleteVolume on volumes that still have snapshots")
+	flag.IntVar(&conf.DeleteRetries, "delete-retries", nvmf.DefaultDeleteRetries, "Retries of a DeleteVolume failing to persist the release of its device, before it fails with Unavailable")
+	flag.DurationVar(&conf.DeleteRetryInterval, "delete-retry-interval", nvmf.DefaultDeleteRetryInterval, "Initial backoff between delete retries, doubled after each retry")
+	flag.DurationVar(&conf.ShutdownGracePeriod, "shutdown-grace-period", nvmf.DefaultShutdownGracePeriod, "Time to wait for in-flight RPCs on SIGTERM")
+	flag.BoolVar(&conf.LeaderElection, "leader-election", false, "Elect, through a Lease in the driver namespace, the controller replica serving the controller RPCs, standbys reject them with Unavailable")
+	flag.DurationVar(&conf.LeaderElectionLeaseDuration, "leader-election-lease-duration", nvmf.DefaultLeaderElectionLeaseDuration, "Time a standby waits before taking over a lease the leader did not renew")
+	flag.DurationVar(&conf.LeaderElectionRenewDeadline, "leader-election-renew-deadline", nvmf.DefaultLeaderElectionRenewDeadline, "Time the leader retries renewing its lease before giving it up, shorter than the lease duration")
+	flag.DurationVar(&conf.LeaderElectionRetryPeriod, "leader-election-retry-period", nvmf.DefaultLeaderElectionRetryPeriod, "Interval between attempts to acquire or renew the lease")
+	flag.DurationVar(&conf.NvmeCliTimeout, "nvme-cli-timeout", nvmf.DefaultNvmeCliTimeout, "Timeout of each nvme discover, connect and disconnect (0 disables)")
+	flag.IntVar(&conf.ConnectRetries, "connect-retries", nvmf.DefaultConnectRetries, "Retries of an nvme connect failing with a transient error")
+	flag.DurationVar(&conf.ConnectRetryInterval, "connect-retry-interval", nvmf.DefaultConnectRetryInterval, "Initial backoff between connect retries, doubled after each retry")
+	flag.DurationVar(&conf.DeviceWaitTimeout, "device-wait-timeout", nvmf.DefaultDeviceWaitTimeout, "Time to wait, rescanning namespaces, for the device node of a namespace to appear after connect")
+	flag.StringVar(&conf.DeviceReadyStrategy, "device-ready-strategy", nvmf.DeviceReadySysfsPoll, "How to detect the device node of a namespace appeared after connect: sysfs-poll, udev-settle or inotify")
+	flag.DurationVar(&conf.GrantTimeout, "grant-timeout", nvmf.DefaultGrantTimeout, "Time ControllerPublishVolume and ControllerUnpublishVolume wait for the backend to grant or revoke the access of a node (requires the grant backend capability)")
+	flag.DurationVar(&conf.DeadlineMargin, "deadline-margin", nvmf.DefaultDeadlineMargin, "Time taken off the deadline of each RPC, at most a quarter of the remaining time, so that operations bounded by it fail with DeadlineExceeded before the caller gives up (0 disables)")
+	flag.BoolVar(&conf.ConnectionMonitor, "connection-monitor", false, "Watch the controllers of staged volumes and connect again those left dead or without a controller, e.g. once the kernel gave up reconnecting")
+	flag.DurationVar(&conf.ConnectionMonitorInterval, "connection-monitor-interval", nvmf.DefaultConnectionMonitorInterval, "Interval between checks of the connection monitor, also the initial backoff between reconnects of a failed connection")
+	flag.BoolVar(&conf.OrphanCleanup, "orphan-cleanup", true, "Disconnect NVMe-oF controllers left without a staging path at startup")
+	flag.BoolVar(&conf.FsckOnStage, "fsck-on-stage", false, "Check, and repair where safe, the existing ext4 or xfs filesystem of a volume before mounting it at stage, unless mounted read-only (overridden by the fsckOnStage parameter)")
+	flag.StringVar(&conf.VolumeContextKey, "volume-context-key", "", "Key source encrypting the endpoint and hostNqn fields of volume contexts with a per-volume data key: file:<path> of a 32-byte AES key (raw, hex or base64), or kms:<executable> run with wrap or unwrap and exchanging {\"key\": \"<base64>\"} on stdin and stdout; the controller and the nodes need the same key source (empty stores them in clear)")
+	flag.StringVar(&conf.HostNqnFile, "host-nqn-file", nvmf.DefaultHostNqnFile, "File holding the host NQN the node connects with")
+	flag.StringVar(&conf.HostNqnGeneration, "host-nqn-generation", nvmf.HostNqnGenerationNone, "Generation of the host NQN when host-nqn-file is missing, at node startup: none, uuid (from the machine ID, else random) or name (from the node ID); the generated NQN is written to host-nqn-file and reused across restarts")
+	flag.BoolVar(&conf.PublishHostNqn, "publish-host-nqn", false, "Publish the host NQN of the node in the nvmf.csi.k8s.io/host-nqn annotation of its Node at registration, so that backends granting access per node learn the host NQN to allow (the node ID must be the node name)")
+	flag.BoolVar(&conf.EphemeralVolumes, "ephemeral-volumes", false, "Serve CSI ephemeral inline volumes: nodes claim a free device through the record store at publish and release it at unpublish, and the controller does not allocate claimed devices (set on the controller and the nodes)")
+	flag.StringVar(&conf.EphemeralDir, "ephemeral-dir", nvmf.DefaultEphemeralDir, "Directory holding the staging entries and device claims of the ephemeral inline volumes of the node")
+	flag.StringVar(&conf.EphemeralNamespace, "ephemeral-namespace", nvmf.DefaultEphemeralNamespace, "Namespace of the ConfigMaps holding the device claims of ephemeral inline volumes, the only ConfigMaps the nodes write (set on the controller and the nodes)")
+	flag.StringVar(&conf.CordonFile, "cordon-file", nvmf.DefaultCordonFile, "Marker file recording that the node is cordoned through the admin server, rejecting new stages, so that it stays cordoned across restarts (empty keeps it in memory only)")
+	flag.StringVar(&conf.NodeStateFile, "node-state-file", nvmf.DefaultNodeStateFile, "File recording which staging paths share each NVMe-oF connection of the node, restored and reconciled against the connected controllers at startup so that unstaging after a restart keeps shared connections (empty keeps them in memory only)")
+	flag.BoolVar(&conf.EmitEvents, "emit-events", true, "Record Kubernetes events on PVCs when device discovery or allocation fails")
+	flag.BoolVar(&conf.SelfTest, "self-test", false, "Serve POST /selftest on the admin server, which allocates, grants, connects, writes and reads back, disconnects and releases the self-test-nqn device")
+	flag.StringVar(&conf.SelfTestNqn, "self-test-nqn", "", "Subsystem NQN, or <nqn>#<nsid> namespace, dedicated to the self-test, whose content it overwrites")
+	flag.StringVar(&conf.AdminAddress, "admin-address", "", "Address of the admin server exposing /devices, /volumes, /etcd-status, /metrics, /backup, /maintenance and, with self-test, /selftest on a controller, and /cordon, /drain and /queues on a node (disabled if empty)")
+	flag.StringVar(&conf.AdminTokenFile, "admin-token-file", "", "File holding the bearer token that admin requests other than GET must carry in their Authorization header (empty refuses them)")
+	flag.StringVar(&conf.DiscoveryAddress, "discovery-address", "", "Comma-separated addresses of the discovery service used when a StorageClass sets no targetTrAddr (disabled if empty)")
+	flag.StringVar(&conf.DiscoveryPort, "discovery-port", nvmf.DefaultDiscoveryPort, "Comma-separated ports of the default discovery service")
+	flag.StringVar(&conf.DiscoveryTransport, "discovery-transport", nvmf.DefaultDiscoveryTransport, "Transport of the default discovery service (tcp or rdma)")
+	flag.IntVar(&conf.MaxDiscoveryConcurrency, "max-discovery-concurrency", nvmf.DefaultMaxDiscoveryConcurrency, "Maximum number of discovery controllers queried at once during a discovery")
+	flag.DurationVar(&conf.DiscoveryCacheTTL, "discovery-cache-ttl", nvmf.DefaultDiscoveryCacheTTL, "Time the devices found by a discovery are reused by concurrent and later discoveries of the same targets, instead of probing them again (0 disables the cache)")
+	flag.BoolVar(&conf.AllocateRetry, "allocate-retry", true, "Discover the targets again, ignoring the discovery cache, and retry once before failing CreateVolume with ResourceExhausted when no discovered device can hold the volume")
+	flag.BoolVar(&conf.MDNSDiscovery, "mdns-discovery", false, "Query discovery controllers advertised over mDNS (_nvme-disc._tcp) in addition to the static configuration")
+	flag.DurationVar(&conf.MDNSInterval, "mdns-interval", nvmf.DefaultMDNSInterval, "Interval between mDNS queries for discovery controllers")
+	flag.DurationVar(&conf.VolumeLockTimeout, "volume-lock-timeout", nvmf.DefaultVolumeLockTimeout, "Time a request waits for a concurrent operation on the same volume before failing with Aborted (0 fails immediately)")
+	flag.DurationVar(&conf.ReclaimRetention, "reclaim-retention", 0, "Time the device of a deleted volume stays quarantined, so that the volume can be undeleted, before it is allocatable again (0 releases immediately)")
+	flag.DurationVar(&conf.RecordRetention, "record-retention", 0, "Age after which the allocation tombstones and the quarantine records of deleted volumes that no longer back a quarantined device are removed from the record store, so that they do not slow down the initial sync (0 removes allocation records on release and keeps quarantine records)")
+	flag.DurationVar(&conf.RecordGCInterval, "record-gc-interval", nvmf.DefaultRecordGCInterval, "Interval between removals of the old records of deleted volumes")
+	flag.BoolVar(&conf.WipeOnDelete, "wipe-on-delete", false, "Erase the namespace of a deleted volume through the backend before its device is allocatable again (requires the wipe backend capability)")
+	flag.Int64Var(&conf.MaxVolumesPerNode, "max-volumes-per-node", 0, "Maximum number of volumes staged on a node, reported to the scheduler (0 is unlimited)")
+	flag.IntVar(&conf.MaxIoQueues, "max-io-queues", 0, "Connect with one I/O queue per online CPU, capped at this count, unless the StorageClass sets nrIoQueues (0 uses the kernel default)")
+	flag.BoolVar(&conf.ProbeDeviceCapacity, "probe-device-capacity", false, "Read the size of newly discovered devices, connecting them from the controller if needed, so that allocation and GetCapacity are capacity-aware")
+	flag.BoolVar(&conf.VerifyDuplicateNqn, "verify-duplicate-nqn", false, "Connect each endpoint of a newly discovered NQN advertised on several endpoints from the controller, registering them as multipath endpoints of one device only if they report the same serial number and model, and refusing the endpoints of a conflicting subsystem")
+	flag.DurationVar(&conf.ReconcileInterval, "reconcile-interval", 0, "Interval between cross-checks of the device registry against PersistentVolumes, correcting drifted allocations (0 disables them, otherwise at least 1m)")
+	flag.DurationVar(&conf.HostAclInterval, "host-acl-interval", nvmf.DefaultHostAclInterval, "Interval between reconciliations of the host allowlists of subsystems whose volumes set allowedHostNqns, removing hosts added out-of-band (0 disables them, requires the host-acl backend capability)")
+	flag.IntVar(&conf.WarmPoolSize, "warm-pool-size", 0, "Free devices the controller keeps pre-formatted with --warm-pool-fs-type, at most half of the free devices, so that staging volumes of that filesystem skips mkfs (0 disables the warm pool)")
+	flag.StringVar(&conf.WarmPoolFsType, "warm-pool-fs-type", "ext4", "Filesystem the warm pool formats free devices with")
+	flag.DurationVar(&conf.WarmPoolInterval, "warm-pool-interval", nvmf.DefaultWarmPoolInterval, "Interval between refills of the warm pool")
+	flag.StringVar(&conf.FreeDeviceLowWatermark, "free-device-low-watermark", "", "Free devices, as a count or a percentage of the registered devices such as 10%, below which the controller warns, counts an alert and calls the alert webhook once until they recover (empty disables it)")
+	flag.StringVar(&conf.FreeDeviceAlertWebhook, "free-device-alert-webhook", "", "URL the controller posts a JSON alert to when the free devices cross below the low watermark or recover above it")
+	flag.IntVar(&conf.RegistryVerbosity, "v-registry", nvmf.FollowGlobalVerbosity, "Verbosity of the device discovery, allocation and reconciliation logs, overriding -v for them (-1 follows -v)")
+	flag.IntVar(&conf.NvmeVerbosity, "v-nvme", nvmf.FollowGlobalVerbosity, "Verbosity of the nvme-cli invocation and fabrics connection logs, overriding -v for them (-1 follows -v)")
+	flag.IntVar(&conf.EtcdVerbosity, "v-etcd", nvmf.FollowGlobalVerbosity, "Verbosity of the record store operation logs, overriding -v for them (-1 follows -v)")
+	flag.BoolVar(&conf.Tracing, "tracing", false, "Export OpenTelemetry traces of the RPCs to an OTLP/HTTP collector configured by the OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME environment variables (http/protobuf protocol only)")
+	flag.BoolVar(&conf.StrictParameters, "strict-parameters", false, "Reject StorageClass parameters and volume context keys the driver does not know with InvalidArgument instead of ignoring them with a warning")
+	flag.Func("default-parameter", "StorageClass parameter as key=value applied to CreateVolume requests that do not set it, may be repeated", addDefaultParameter)
+	flag.StringVar(&conf.ReadinessAddress, "readiness-address", "", "Address serving /readyz (defaults to the health service port)")
+}
+
+// addDefaultParameter records a --default-parameter key=value
+func addDefaultParameter(value string) error {
+	key, parameter, found := strings.Cut(value, "=")
+	if !found || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("default parameter must be key=value, got: %q", value)
+	}
+
+	if conf.DefaultParameters == nil {
+		conf.DefaultParameters = map[string]string{}
+	}
+	conf.DefaultParameters[strings.TrimSpace(key)] = parameter
+	return nil
 }
 
 func main() {
@@ -51,10 +153,10 @@ func main() {
 func runDriver() {
 	var wg sync.WaitGroup
 
+	driver := nvmf.NewDriver(&conf)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		driver := nvmf.NewDriver(&conf)
 		driver.Run(&conf)
 	}()
 
@@ -67,8 +169,49 @@ func runDriver() {
 	server := &http.Server{Addr: ":" + servicePort}
 	http.HandleFunc("/healthz", healthHandler)
 
-	if err := server.ListenAndServe(); err != nil {
-		klog.Fatalf("Service health port listen and serve err : %s", err.Error())
+	var readinessServer *http.Server
+	if conf.ReadinessAddress == "" {
+		http.HandleFunc("/readyz", driver.ReadinessHandler)
+	} else {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/readyz", driver.ReadinessHandler)
+		readinessServer = &http.Server{Addr: conf.ReadinessAddress, Handler: mux}
+		go func() {
+			if err := readinessServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				klog.Fatalf("Readiness listen and serve err : %s", err.Error())
+			}
+		}()
+	}
+
+	var adminServer *http.Server
+	if conf.AdminAddress != "" {
+		klog.Infof("Serving admin endpoints on %s", conf.AdminAddress)
+		adminServer = &http.Server{Addr: conf.AdminAddress, Handler: driver.AdminHandler()}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				klog.Fatalf("Admin listen and serve err : %s", err.Error())
+			}
+		}()
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Fatalf("Service health port listen and serve err : %s", err.Error())
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	klog.Infof("Received signal %v", sig)
+
+	driver.Shutdown(conf.ShutdownGracePeriod)
+	server.Close()
+	if readinessServer != nil {
+		readinessServer.Close()
+	}
+	if adminServer != nil {
+		adminServer.Close()
 	}
 	wg.Wait()
 	os.Exit(0)
@@ -0,0 +1,158 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// apiStatus is the body of the /etcd-status endpoint. The registry is synced
+// from PersistentVolumes, so etcd is reached through the Kubernetes API server.
+type apiStatus struct {
+	SyncStatus
+	APIServerReachable bool   `json:"apiServerReachable"`
+	APIServerError     string `json:"apiServerError,omitempty"`
+}
+
+// AdminHandler serves the admin endpoints used for troubleshooting and
+// maintenance. On a controller, /devices lists the device registry, /volumes
+// its volumes filtered by the query, /etcd-status the registry sync state and
+// /metrics the reconcile and etcd counters, all read-only. With the self-test
+// enabled, POST /selftest runs it. /backup exports the registry on GET and
+// restores an export on POST. /maintenance lists (GET), enters (POST) and
+// exits (DELETE) the maintenance of NQNs and endpoints. On a node, /cordon
+// reports, sets (POST) and clears (DELETE) the cordon, POST /drain drains the
+// node and POST /queues resizes the I/O queues of a connection. Requests
+// other than GET change state and must carry the admin token.
+func (d *driver) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", d.readOnly(d.devicesHandler))
+	mux.HandleFunc("/volumes", d.readOnly(d.volumesHandler))
+	mux.HandleFunc("/etcd-status", d.readOnly(d.syncStatusHandler))
+	mux.HandleFunc("/metrics", d.readOnly(d.metricsHandler))
+	if d.selfTestNqn != "" {
+		mux.HandleFunc("/selftest", d.authorized(d.selfTestHandler))
+	}
+	mux.HandleFunc("/backup", d.authorized(d.backupHandler))
+	mux.HandleFunc("/maintenance", d.authorized(d.maintenanceHandler))
+	mux.HandleFunc("/cordon", d.authorized(d.cordonHandler))
+	mux.HandleFunc("/drain", d.authorized(d.drainHandler))
+	mux.HandleFunc("/queues", d.authorized(d.queuesHandler))
+	return mux
+}
+
+// loadAdminToken reads the admin token of path, nil if path is empty
+func loadAdminToken(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+
+	return []byte(token), nil
+}
+
+// authorized rejects the requests other than GET that do not carry the admin
+// token as a bearer token, and all of them if no admin token is configured
+func (d *driver) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			handler(w, r)
+			return
+		}
+		if len(d.adminToken) == 0 {
+			http.Error(w, "admin requests changing state require an admin-token-file", http.StatusForbidden)
+			return
+		}
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), d.adminToken) != 1 {
+			klog.Warningf("Rejected unauthenticated admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// readOnly rejects every method but GET, so the admin server cannot change state
+func (d *driver) readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if d.controllerServer == nil {
+			http.Error(w, "not running as controller", http.StatusNotFound)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (d *driver) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.controllerServer.deviceRegistry.DeviceStatuses())
+}
+
+func (d *driver) syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := apiStatus{
+		SyncStatus:         d.controllerServer.deviceRegistry.SyncStatus(),
+		APIServerReachable: true,
+	}
+	if err := d.checkAPIServer(); err != nil {
+		status.APIServerReachable = false
+		status.APIServerError = err.Error()
+	}
+
+	writeJSON(w, status)
+}
+
+func (d *driver) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	d.controllerServer.deviceRegistry.writeMetrics(w)
+	if reconciler := d.controllerServer.reconciler; reconciler != nil {
+		reconciler.writeMetrics(w)
+	}
+	if store, ok := d.metadata.(*metadataStore); ok {
+		store.metrics.writeMetrics(w)
+	}
+	if d.freeDeviceWatermark != nil {
+		d.freeDeviceWatermark.writeMetrics(w)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		klog.Warningf("Failed to write admin response: %v", err)
+	}
+}
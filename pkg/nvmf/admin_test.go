@@ -0,0 +1,214 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdminAuthorization(t *testing.T) {
+	const token = "s3cr3t-admin-token"
+
+	tests := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		want          int
+		wantHandled   bool
+	}{
+		{name: "GET needs no token", token: token, method: http.MethodGet, want: http.StatusOK, wantHandled: true},
+		{name: "GET without a configured token", method: http.MethodGet, want: http.StatusOK, wantHandled: true},
+		{name: "POST with the token", token: token, method: http.MethodPost, authorization: "Bearer " + token, want: http.StatusOK, wantHandled: true},
+		{name: "DELETE with the token", token: token, method: http.MethodDelete, authorization: "Bearer " + token, want: http.StatusOK, wantHandled: true},
+		{name: "POST without a token", token: token, method: http.MethodPost, want: http.StatusUnauthorized},
+		{name: "POST with another token", token: token, method: http.MethodPost, authorization: "Bearer other", want: http.StatusUnauthorized},
+		{name: "POST with a basic authorization", token: token, method: http.MethodPost, authorization: "Basic " + token, want: http.StatusUnauthorized},
+		{name: "POST without a configured token", method: http.MethodPost, authorization: "Bearer " + token, want: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &driver{adminToken: []byte(test.token)}
+			handled := false
+			handler := d.authorized(func(w http.ResponseWriter, r *http.Request) { handled = true })
+
+			req := httptest.NewRequest(test.method, "/cordon", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != test.want {
+				t.Errorf("status = %d, want %d", rec.Code, test.want)
+			}
+			if handled != test.wantHandled {
+				t.Errorf("handled = %v, want %v", handled, test.wantHandled)
+			}
+		})
+	}
+}
+
+func TestAdminHandlerRequiresTokenToChangeState(t *testing.T) {
+	d := &driver{selfTestNqn: testVolumeNqn}
+	handler := d.AdminHandler()
+
+	for _, path := range []string{"/selftest", "/backup", "/maintenance", "/cordon", "/drain", "/queues"} {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("POST %s status = %d, want %d", path, rec.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "not configured"},
+		{name: "trailing newline", path: write("token", "s3cr3t\n"), want: "s3cr3t"},
+		{name: "empty file", path: write("empty", " \n"), wantErr: true},
+		{name: "missing file", path: filepath.Join(dir, "missing"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := loadAdminToken(test.path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("loadAdminToken error = %v, want error %v", err, test.wantErr)
+			}
+			if string(token) != test.want {
+				t.Errorf("token = %q, want %q", token, test.want)
+			}
+		})
+	}
+}
+
+// getAdminJSON serves a GET of path by the admin handler of d and decodes its
+// JSON body into body
+func getAdminJSON(t *testing.T, d *driver, path string, body interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	d.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s status = %d, want %d: %s", path, rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("GET %s content type = %q, want application/json", path, contentType)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), body); err != nil {
+		t.Fatalf("GET %s body %s: %v", path, rec.Body.String(), err)
+	}
+}
+
+func TestAdminDevicesEndpoint(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.controllerServer = c
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2, maintenanceNqn3)
+
+	// One device is allocated and published, one quarantined and one free
+	if _, err := c.CreateVolume(ctx, createRequest("pv-a", map[string]string{paramPinnedNqn: testVolumeNqn})); err != nil {
+		t.Fatalf("CreateVolume(pv-a): %v", err)
+	}
+	c.deviceRegistry.MarkPublished(testVolumeNqn, "node-1")
+	c.deviceRegistry.mutex.Lock()
+	quarantined := c.deviceRegistry.devices[maintenanceNqn2]
+	quarantined.VolName = "pv-deleted"
+	quarantined.QuarantinedUntil = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	c.deviceRegistry.mutex.Unlock()
+
+	// The fields are pinned as decoded, so that a renamed or retyped field of
+	// the JSON read by the troubleshooting tools fails the test
+	var got []map[string]interface{}
+	getAdminJSON(t, c.Driver, "/devices", &got)
+	want := []map[string]interface{}{
+		{
+			"nqn": testVolumeNqn, "state": deviceStateConnected,
+			"allocated": true, "excluded": false, "maintenance": false, "stale": false,
+			"volumeName": "pv-a", "capacityBytes": 0.0, "capacityKnown": false, "usedBytes": 0.0,
+			"transport": "tcp", "endpoints": []interface{}{"192.0.2.10:4420"}, "publishedNodes": []interface{}{"node-1"},
+		},
+		{
+			"nqn": maintenanceNqn2, "state": deviceStateQuarantined,
+			"allocated": false, "excluded": false, "maintenance": false, "stale": false,
+			"volumeName": "pv-deleted", "capacityBytes": 0.0, "capacityKnown": false, "usedBytes": 0.0,
+			"transport": "tcp", "endpoints": []interface{}{"192.0.2.10:4420"}, "publishedNodes": []interface{}{},
+			"quarantinedUntil": "2025-01-02T03:04:05Z",
+		},
+		{
+			"nqn": maintenanceNqn3, "state": deviceStateAdvertised,
+			"allocated": false, "excluded": false, "maintenance": false, "stale": false,
+			"capacityBytes": 0.0, "capacityKnown": false, "usedBytes": 0.0,
+			"transport": "tcp", "endpoints": []interface{}{"192.0.2.10:4420"}, "publishedNodes": []interface{}{},
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("GET /devices = %v, want %d devices", got, len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("GET /devices device %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	var sync map[string]interface{}
+	getAdminJSON(t, c.Driver, "/etcd-status", &sync)
+	lastSync, err := time.Parse(time.RFC3339Nano, sync["lastSyncTime"].(string))
+	if err != nil || time.Since(lastSync) > time.Minute {
+		t.Errorf("GET /etcd-status lastSyncTime = %v, want the time of the initial sync: %v", sync["lastSyncTime"], err)
+	}
+	delete(sync, "lastSyncTime")
+	if want := map[string]interface{}{"initialSyncDone": true, "apiServerReachable": true}; !reflect.DeepEqual(sync, want) {
+		t.Errorf("GET /etcd-status = %v, want %v", sync, want)
+	}
+
+	// Before the initial sync, no sync time is reported
+	c.deviceRegistry.mutex.Lock()
+	c.deviceRegistry.initialSyncDone, c.deviceRegistry.lastSyncTime = false, time.Time{}
+	c.deviceRegistry.mutex.Unlock()
+	sync = nil
+	getAdminJSON(t, c.Driver, "/etcd-status", &sync)
+	if want := map[string]interface{}{"initialSyncDone": false, "apiServerReachable": true}; !reflect.DeepEqual(sync, want) {
+		t.Errorf("GET /etcd-status before the initial sync = %v, want %v", sync, want)
+	}
+}
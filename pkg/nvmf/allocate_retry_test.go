@@ -0,0 +1,119 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const retryNqn = "nqn.2024-01.io.example:volume-2"
+
+// newRetryServer returns a controller whose single device is allocated to
+// pv-1, reusing its discovery of the target for an hour
+func newRetryServer(t *testing.T, retry bool) (*ControllerServer, *fakeNvmeClient) {
+	t.Helper()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.allocateRetry = retry
+	c.Driver.discoveryCacheTTL = time.Hour
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	if _, err := c.CreateVolume(context.Background(), createRequest("pv-1", nil)); err != nil {
+		t.Fatalf("CreateVolume(pv-1): %v", err)
+	}
+	return c, client
+}
+
+func TestAllocateRetry(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry bool
+		// added adds a device to the target after the cached discovery
+		added        bool
+		discoverErrs []error
+		// discoverDelay slows the rediscovery past the deadline of the request
+		discoverDelay time.Duration
+		want          codes.Code
+		wantDiscovers int
+	}{
+		{name: "device added since the discovery", retry: true, added: true, wantDiscovers: 1},
+		{name: "retry disabled", added: true, want: codes.ResourceExhausted},
+		{name: "genuine exhaustion", retry: true, want: codes.ResourceExhausted, wantDiscovers: 1},
+		{name: "failed rediscovery", retry: true, added: true, discoverErrs: []error{errors.New("connection refused")}, want: codes.ResourceExhausted, wantDiscovers: 1},
+		{name: "deadline during the rediscovery", retry: true, added: true, discoverDelay: time.Second, want: codes.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, client := newRetryServer(t, test.retry)
+			if test.added {
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, retryNqn)
+			}
+			client.discoverErrs = test.discoverErrs
+			client.discoverDelay = test.discoverDelay
+			discovers := client.discoverCount()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			resp, err := c.CreateVolume(ctx, createRequest("pv-2", nil))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume(pv-2) code = %v, want %v: %v", got, test.want, err)
+			}
+			if err == nil && resp.GetVolume().GetVolumeId() != retryNqn {
+				t.Errorf("CreateVolume(pv-2) = %s, want the added device %s", resp.GetVolume().GetVolumeId(), retryNqn)
+			}
+			if test.discoverDelay == 0 {
+				if got := client.discoverCount() - discovers; got != test.wantDiscovers {
+					t.Errorf("discoveries of CreateVolume(pv-2) = %d, want %d", got, test.wantDiscovers)
+				}
+			}
+			if _, allocated := c.deviceRegistry.volumeToNQN["pv-2"]; allocated != (err == nil) {
+				t.Errorf("pv-2 allocated = %v after CreateVolume error %v", allocated, err)
+			}
+		})
+	}
+}
+
+func TestAllocateRetryHoldsVolumeLock(t *testing.T) {
+	c, client := newRetryServer(t, true)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, retryNqn)
+	client.discoverDelay = 200 * time.Millisecond
+
+	done := make(chan error)
+	go func() {
+		_, err := c.CreateVolume(context.Background(), createRequest("pv-2", nil))
+		done <- err
+	}()
+
+	// The volume stays locked against concurrent operations until the retry ends
+	time.Sleep(50 * time.Millisecond)
+	if c.Driver.volumeLocks.TryAcquire("pv-2") {
+		c.Driver.volumeLocks.Release("pv-2")
+		t.Error("volume lock of pv-2 is free during the rediscovery")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("retried CreateVolume(pv-2): %v", err)
+	}
+	if c.deviceRegistry.volumeToNQN["pv-2"] != retryNqn {
+		t.Errorf("pv-2 allocated %q, want %s", c.deviceRegistry.volumeToNQN["pv-2"], retryNqn)
+	}
+}
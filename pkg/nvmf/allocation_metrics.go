@@ -0,0 +1,136 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// allocationMetrics records how allocations spread over the devices, to tell
+// whether placement balances the pool. Updated under the registry mutex.
+type allocationMetrics struct {
+	// Allocations of each device since the controller started, by volume ID
+	allocations map[string]uint64
+	// Share of each device consumed by its volume, by volume ID
+	utilization map[string]float64
+}
+
+func newAllocationMetrics() *allocationMetrics {
+	return &allocationMetrics{
+		allocations: map[string]uint64{},
+		utilization: map[string]float64{},
+	}
+}
+
+// utilization returns the share of the device consumed by its volume. A device
+// of unknown capacity is fully consumed by a volume.
+func (v *VolumeInfo) utilization() float64 {
+	switch {
+	case v.UsedBytes > 0 && v.Capacity > 0:
+		return math.Min(float64(v.UsedBytes)/float64(v.Capacity), 1)
+	case v.IsAllocated || v.UsedBytes > 0:
+		return 1
+	}
+	return 0
+}
+
+// recordAllocation counts an allocation of the device. Caller must hold the mutex.
+func (r *DeviceRegistry) recordAllocation(id string, device *VolumeInfo) {
+	r.fairness.allocations[id]++
+	r.fairness.utilization[id] = device.utilization()
+}
+
+// recordRelease records that the device was released. Caller must hold the mutex.
+func (r *DeviceRegistry) recordRelease(id string) {
+	r.fairness.utilization[id] = 0
+}
+
+// recordRemoval drops the metrics of a device removed from the registry, so
+// that they do not pile up as namespaces are provisioned and deleted. Caller
+// must hold the mutex.
+func (r *DeviceRegistry) recordRemoval(id string) {
+	delete(r.fairness.allocations, id)
+	delete(r.fairness.utilization, id)
+}
+
+// writeMetrics writes the per-device allocation counts and utilization of the
+// registered devices, and the coefficient of variation of their utilization,
+// in the Prometheus text format
+func (r *DeviceRegistry) writeMetrics(w io.Writer) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ids := make([]string, 0, len(r.devices))
+	for id := range r.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	utilization := make([]float64, len(ids))
+	for i, id := range ids {
+		if value, exists := r.fairness.utilization[id]; exists {
+			utilization[i] = value
+		} else {
+			// Allocations restored at startup were not recorded
+			utilization[i] = r.devices[id].utilization()
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP csi_nvmf_device_allocations_total Allocations of each device since the controller started\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_device_allocations_total counter\n")
+	for _, id := range ids {
+		device := r.devices[id]
+		fmt.Fprintf(w, "csi_nvmf_device_allocations_total{nqn=%q,nsid=\"%d\"} %d\n", device.Nqn, device.Nsid, r.fairness.allocations[id])
+	}
+	fmt.Fprintf(w, "# HELP csi_nvmf_device_utilization_ratio Share of each device consumed by its volume\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_device_utilization_ratio gauge\n")
+	for i, id := range ids {
+		device := r.devices[id]
+		fmt.Fprintf(w, "csi_nvmf_device_utilization_ratio{nqn=%q,nsid=\"%d\"} %g\n", device.Nqn, device.Nsid, utilization[i])
+	}
+	fmt.Fprintf(w, "# HELP csi_nvmf_device_utilization_imbalance Coefficient of variation of the device utilization, 0 when evenly spread\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_device_utilization_imbalance gauge\n")
+	fmt.Fprintf(w, "csi_nvmf_device_utilization_imbalance %g\n", coefficientOfVariation(utilization))
+}
+
+// coefficientOfVariation returns the standard deviation of values relative to
+// their mean, 0 if there are none or their mean is 0
+func coefficientOfVariation(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	mean := 0.0
+	for _, value := range values {
+		mean += value
+	}
+	mean /= float64(len(values))
+	if mean == 0 {
+		return 0
+	}
+
+	variance := 0.0
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+	variance /= float64(len(values))
+
+	return math.Sqrt(variance) / mean
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// metricsStep allocates a volume on device, or releases the volume of device
+type metricsStep struct {
+	device  string
+	release bool
+}
+
+func TestAllocationMetrics(t *testing.T) {
+	const (
+		deviceA = "nqn.2024-01.io.example:device-a"
+		deviceB = "nqn.2024-01.io.example:device-b"
+		deviceC = "nqn.2024-01.io.example:device-c"
+	)
+
+	tests := []struct {
+		name      string
+		steps     []metricsStep
+		wantLines []string
+	}{
+		{
+			name: "uneven allocations",
+			steps: []metricsStep{
+				{device: deviceA},
+				{device: deviceA, release: true},
+				{device: deviceA},
+				{device: deviceB},
+			},
+			wantLines: []string{
+				fmt.Sprintf(`csi_nvmf_device_allocations_total{nqn=%q,nsid="0"} 2`, deviceA),
+				fmt.Sprintf(`csi_nvmf_device_allocations_total{nqn=%q,nsid="0"} 1`, deviceB),
+				fmt.Sprintf(`csi_nvmf_device_allocations_total{nqn=%q,nsid="0"} 0`, deviceC),
+				fmt.Sprintf(`csi_nvmf_device_utilization_ratio{nqn=%q,nsid="0"} 1`, deviceA),
+				fmt.Sprintf(`csi_nvmf_device_utilization_ratio{nqn=%q,nsid="0"} 1`, deviceB),
+				fmt.Sprintf(`csi_nvmf_device_utilization_ratio{nqn=%q,nsid="0"} 0`, deviceC),
+				`csi_nvmf_device_utilization_imbalance 0.7071067811865476`,
+			},
+		},
+		{
+			name: "released devices",
+			steps: []metricsStep{
+				{device: deviceA},
+				{device: deviceA, release: true},
+			},
+			wantLines: []string{
+				fmt.Sprintf(`csi_nvmf_device_allocations_total{nqn=%q,nsid="0"} 1`, deviceA),
+				fmt.Sprintf(`csi_nvmf_device_utilization_ratio{nqn=%q,nsid="0"} 0`, deviceA),
+				`csi_nvmf_device_utilization_imbalance 0`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			r := c.deviceRegistry
+			for _, id := range []string{deviceA, deviceB, deviceC} {
+				r.devices[id] = &VolumeInfo{
+					nvmfDiskInfo: &nvmfDiskInfo{Nqn: id, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+					Capacity:     1 << 30,
+				}
+				r.availableNQNs[id] = struct{}{}
+			}
+
+			for i, step := range test.steps {
+				if step.release {
+					if err := r.ReleaseDevice(step.device); err != nil {
+						t.Fatalf("step %d: ReleaseDevice: %v", i, err)
+					}
+					continue
+				}
+				req := &AllocationRequest{VolumeName: fmt.Sprintf("pvc-%d", i), PinnedID: step.device}
+				if _, err := r.AllocateDevice(context.Background(), req); err != nil {
+					t.Fatalf("step %d: AllocateDevice: %v", i, err)
+				}
+			}
+
+			var out bytes.Buffer
+			r.writeMetrics(&out)
+			lines := strings.Split(out.String(), "\n")
+			for _, want := range test.wantLines {
+				if !containsLine(lines, want) {
+					t.Errorf("metrics miss %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestAllocationMetricsPrunedOnRemoval(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*VolumeInfo)
+		released bool // whether the released device stays registered
+	}{
+		{name: "pool device", released: true},
+		{name: "provisioned namespace", modify: func(v *VolumeInfo) { v.Dynamic = true }},
+		{name: "excluded device", modify: func(v *VolumeInfo) { v.IsExcluded = true }},
+		{name: "stale device", modify: func(v *VolumeInfo) { v.IsStale = true }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			r := c.deviceRegistry
+			r.devices[testVolumeNqn] = &VolumeInfo{
+				nvmfDiskInfo: &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+				Capacity:     1 << 30,
+			}
+			r.availableNQNs[testVolumeNqn] = struct{}{}
+			if _, err := r.AllocateDevice(context.Background(), &AllocationRequest{VolumeName: "pvc-1"}); err != nil {
+				t.Fatalf("AllocateDevice: %v", err)
+			}
+			if test.modify != nil {
+				test.modify(r.devices[testVolumeNqn])
+			}
+
+			if err := r.ReleaseDevice(testVolumeNqn); err != nil {
+				t.Fatalf("ReleaseDevice: %v", err)
+			}
+			_, registered := r.devices[testVolumeNqn]
+			_, counted := r.fairness.allocations[testVolumeNqn]
+			_, measured := r.fairness.utilization[testVolumeNqn]
+			if registered != test.released || counted != test.released || measured != test.released {
+				t.Errorf("registered %v, allocations kept %v, utilization kept %v, want all %v", registered, counted, measured, test.released)
+			}
+		})
+	}
+}
+
+// containsLine reports whether lines holds want
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// metadataKindAllocation records the allocations of volumes whose PV may not
+// exist yet. The provisioner creates the PV only once CreateVolume returned, so
+// without the record an allocation made before a restart would be lost and
+// its device handed out again.
+const metadataKindAllocation = "allocation"
+
+// allocationRecordTimeout bounds the removal of an allocation record on release
+const allocationRecordTimeout = 10 * time.Second
+
+// allocationRecord is the persisted state of an allocation, keyed by volume name
+type allocationRecord struct {
+	VolumeID        string            `json:"volumeId"`
+	VolumeName      string            `json:"volumeName"`
+	Transport       string            `json:"transport"`
+	Endpoints       []string          `json:"endpoints,omitempty"`
+	Capacity        int64             `json:"capacityBytes,omitempty"`
+	UsedBytes       int64             `json:"usedBytes,omitempty"`
+	VolumeBytes     int64             `json:"volumeBytes,omitempty"`
+	SkipWipe        bool              `json:"skipWipe,omitempty"`
+	AffinityKey     string            `json:"affinityKey,omitempty"`
+	AntiAffinityKey string            `json:"antiAffinityKey,omitempty"`
+	QoS             *BackendQoS       `json:"qos,omitempty"`
+	AllowedHosts    []string          `json:"allowedHostNqns,omitempty"`
+	Dynamic         bool              `json:"dynamic,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	// DeletedAt dates the tombstone left by the release of the volume, nil
+	// while the volume is allocated
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// allocationTombstone is the part of an allocation record telling a tombstone
+// apart, decoded before and instead of the whole record
+type allocationTombstone struct {
+	DeletedAt *time.Time `json:"deletedAt"`
+}
+
+// tombstoneDeletedAt returns when the volume of an allocation record was
+// released, and false if the record is not a tombstone
+func tombstoneDeletedAt(data []byte) (time.Time, bool) {
+	tombstone := allocationTombstone{}
+	if json.Unmarshal(data, &tombstone) != nil || tombstone.DeletedAt == nil {
+		return time.Time{}, false
+	}
+	return *tombstone.DeletedAt, true
+}
+
+// persistAllocation records the allocation of device to the request, with the
+// capacity the volume consumes, before the registry is updated, so that a
+// failed write leaves the device free. Caller must hold the mutex.
+func (r *DeviceRegistry) persistAllocation(ctx context.Context, device *VolumeInfo, req *AllocationRequest, usedBytes, volumeBytes int64) error {
+	record := &allocationRecord{
+		VolumeID:        device.volumeID(),
+		VolumeName:      req.VolumeName,
+		Transport:       device.Transport,
+		Endpoints:       device.Endpoints,
+		Capacity:        device.Capacity,
+		UsedBytes:       usedBytes,
+		VolumeBytes:     volumeBytes,
+		SkipWipe:        req.SkipWipe,
+		AffinityKey:     req.Placement.AffinityKey,
+		AntiAffinityKey: req.Placement.AntiAffinityKey,
+		QoS:             recordedQoS(req.QoS),
+		AllowedHosts:    req.AllowedHosts,
+		Dynamic:         device.Dynamic,
+		Labels:          device.Labels,
+	}
+	if err := r.Driver.metadata.Put(ctx, metadataKindAllocation, req.VolumeName, record); err != nil {
+		return fmt.Errorf("%w: failed to record allocation of volume %s: %v", ErrEtcdUnavailable, req.VolumeName, err)
+	}
+
+	return nil
+}
+
+// removeAllocation removes the allocation record of a volume whose device is
+// released or quarantined. While the record GC runs, the record is replaced by
+// a tombstone dated from the release instead, which the GC removes once older
+// than the record retention.
+func (r *DeviceRegistry) removeAllocation(ctx context.Context, volumeName string) error {
+	var err error
+	if r.Driver.recordRetention > 0 {
+		now := time.Now()
+		err = r.Driver.metadata.Put(ctx, metadataKindAllocation, volumeName, &allocationRecord{VolumeName: volumeName, DeletedAt: &now})
+	} else {
+		err = r.Driver.metadata.Delete(ctx, metadataKindAllocation, volumeName)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: failed to remove allocation record of volume %s: %v", ErrEtcdUnavailable, volumeName, err)
+	}
+
+	return nil
+}
+
+// forgetAllocation removes the allocation record of a volume on a best-effort
+// basis. A record left behind by a failure is removed by the reconciler or at
+// the next startup.
+func (r *DeviceRegistry) forgetAllocation(volumeName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), allocationRecordTimeout)
+	defer cancel()
+
+	if err := r.Driver.metadata.Delete(ctx, metadataKindAllocation, volumeName); err != nil {
+		klog.Warningf("Failed to remove allocation record of volume %s: %v", volumeName, err)
+	}
+}
+
+// restoreAllocations reloads the allocations of volumes that have no PV yet.
+// Records of volumes restored from their PV are no longer needed, tombstones
+// are skipped without decoding them whole. Caller must hold the mutex.
+func (r *DeviceRegistry) restoreAllocations(ctx context.Context) error {
+	records, err := r.Driver.metadata.List(ctx, metadataKindAllocation)
+	if err != nil {
+		return err
+	}
+
+	restored, tombstones := 0, 0
+	for name, data := range records {
+		if _, deleted := tombstoneDeletedAt(data); deleted {
+			tombstones++
+			continue
+		}
+		record := &allocationRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			klog.Warningf("Ignoring malformed allocation record of %s: %v", name, err)
+			continue
+		}
+		if id, exists := r.volumeToNQN[record.VolumeName]; exists {
+			if id != record.VolumeID {
+				klog.Warningf("Volume %s records device %s, ignoring allocation record of device %s", record.VolumeName, id, record.VolumeID)
+			}
+			r.forgetAllocation(name)
+			continue
+		}
+		if _, exists := r.devices[record.VolumeID]; exists {
+			klog.Warningf("Device %s of volume %s is registered again, ignoring allocation record", record.VolumeID, record.VolumeName)
+			r.forgetAllocation(name)
+			continue
+		}
+
+		r.devices[record.VolumeID] = record.volumeInfo()
+		r.volumeToNQN[record.VolumeName] = record.VolumeID
+		restored++
+	}
+
+	klog.Infof("Restored %d allocation(s) of volumes without a PV, skipped %d tombstone(s)", restored, tombstones)
+	return nil
+}
+
+// volumeInfo returns the allocation of the record, stale until discovery finds
+// its device again
+func (record *allocationRecord) volumeInfo() *VolumeInfo {
+	nqn, nsid := parseVolumeID(record.VolumeID)
+	return &VolumeInfo{
+		nvmfDiskInfo: &nvmfDiskInfo{
+			VolName:   record.VolumeName,
+			Nqn:       nqn,
+			Nsid:      nsid,
+			Transport: record.Transport,
+			Endpoints: record.Endpoints,
+		},
+		IsAllocated:     true,
+		IsStale:         true,
+		Capacity:        record.Capacity,
+		UsedBytes:       record.UsedBytes,
+		VolumeBytes:     record.VolumeBytes,
+		SkipWipe:        record.SkipWipe,
+		AffinityKey:     record.AffinityKey,
+		AntiAffinityKey: record.AntiAffinityKey,
+		QoS:             record.qos(),
+		AllowedHosts:    record.AllowedHosts,
+		Dynamic:         record.Dynamic,
+		Labels:          record.Labels,
+	}
+}
+
+// recordedQoS returns the QoS recorded for limits, nil if none is set
+func recordedQoS(qos BackendQoS) *BackendQoS {
+	if qos.isZero() {
+		return nil
+	}
+	return &qos
+}
+
+// qos returns the recorded limits, zero for records without any
+func (record *allocationRecord) qos() BackendQoS {
+	if record.QoS == nil {
+		return BackendQoS{}
+	}
+	return *record.QoS
+}
+
+// pruneAllocations removes the allocation records of volumes whose PV exists,
+// which records the allocation from then on
+func (r *DeviceRegistry) pruneAllocations(ctx context.Context, recorded map[string]*corev1.PersistentVolume) {
+	records, err := r.Driver.metadata.List(ctx, metadataKindAllocation)
+	if err != nil {
+		klog.Warningf("Reconcile: failed to list allocation records: %v", err)
+		return
+	}
+
+	for name, data := range records {
+		if _, deleted := tombstoneDeletedAt(data); deleted {
+			continue
+		}
+		if _, exists := recorded[name]; exists {
+			registryLog.V(4).Infof("Reconcile: volume %s has a PV, removing its allocation record", name)
+			r.forgetAllocation(name)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// slowStore is a record store whose writes take delay
+type slowStore struct {
+	recordStore
+	delay time.Duration
+}
+
+func (s slowStore) Put(ctx context.Context, kind, key string, record interface{}) error {
+	time.Sleep(s.delay)
+	return s.recordStore.Put(ctx, kind, key, record)
+}
+
+func TestFailedAllocationWrite(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	store := c.Driver.metadata
+	c.Driver.metadata = failingStore{store}
+	r := c.deviceRegistry
+
+	req := createRequest("pv-1", nil)
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+	_, err := c.CreateVolume(ctx, req)
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Fatalf("CreateVolume code = %v, want %v: %v", got, codes.Unavailable, err)
+	}
+
+	device := r.devices[testVolumeNqn]
+	if device == nil || device.IsAllocated || device.VolName != "" || device.UsedBytes != 0 || device.VolumeBytes != 0 {
+		t.Errorf("device after the failed write = %+v, want it free", device)
+	}
+	if _, free := r.availableNQNs[testVolumeNqn]; !free {
+		t.Error("device is not in the pool after the failed write")
+	}
+	if _, allocated := r.volumeToNQN["pv-1"]; allocated {
+		t.Error("pv-1 is allocated after the failed write")
+	}
+	if !c.Driver.volumeLocks.TryAcquire("pv-1") {
+		t.Error("the volume lock is held after the failed write")
+	} else {
+		c.Driver.volumeLocks.Release("pv-1")
+	}
+
+	// The sidecar retries once the store is back
+	c.Driver.metadata = store
+	resp, err := c.CreateVolume(ctx, req)
+	if err != nil || resp.GetVolume().GetVolumeId() != testVolumeNqn {
+		t.Fatalf("retried CreateVolume = %v, %v, want %s", resp.GetVolume().GetVolumeId(), err, testVolumeNqn)
+	}
+	found, err := store.Get(ctx, metadataKindAllocation, "pv-1", &allocationRecord{})
+	if err != nil || !found {
+		t.Errorf("allocation record of pv-1 found %t: %v, want it stored", found, err)
+	}
+}
+
+func TestConcurrentAllocationWrites(t *testing.T) {
+	const otherNqn = "nqn.2024-01.io.example:volume-2"
+
+	ctx := context.Background()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, otherNqn)
+	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Driver.metadata = slowStore{recordStore: c.Driver.metadata, delay: 100 * time.Millisecond}
+
+	// Both calls of the volume get the device the first one allocated
+	var wg sync.WaitGroup
+	volumeIDs := make([]string, 2)
+	for i := range volumeIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Errorf("CreateVolume %d: %v", i, err)
+				return
+			}
+			volumeIDs[i] = resp.GetVolume().GetVolumeId()
+		}(i)
+	}
+	wg.Wait()
+
+	if volumeIDs[0] != volumeIDs[1] {
+		t.Errorf("concurrent CreateVolume of pv-1 = %v, want the same device", volumeIDs)
+	}
+	allocated := 0
+	for _, device := range c.deviceRegistry.devices {
+		if device.IsAllocated {
+			allocated++
+		}
+	}
+	if allocated != 1 {
+		t.Errorf("%d device(s) allocated, want 1", allocated)
+	}
+}
+
+func TestRestoreAllocations(t *testing.T) {
+	const otherNqn = "nqn.2024-01.io.example:volume-2"
+
+	tests := []struct {
+		name string
+		// pvHandle is the handle of the PV of pv-1 at the restart, empty if
+		// the provisioner did not create it yet
+		pvHandle string
+		// wantDevice is the device of pv-1 after the restart
+		wantDevice string
+		wantRecord bool
+	}{
+		{name: "volume without a PV", wantDevice: testVolumeNqn, wantRecord: true},
+		{name: "volume with its PV", pvHandle: testVolumeNqn, wantDevice: testVolumeNqn},
+		{name: "PV of another device", pvHandle: otherNqn, wantDevice: otherNqn},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			newServer := func(exported []string, objects ...runtime.Object) *ControllerServer {
+				c, _ := newTestControllerServer(t, newFakeBackend(), objects...)
+				client := c.Driver.nvme.(*fakeNvmeClient)
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", exported...)
+				return c
+			}
+
+			// The other device is exported once pv-1 is allocated
+			c := newServer([]string{testVolumeNqn})
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil || resp.GetVolume().GetVolumeId() != testVolumeNqn {
+				t.Fatalf("CreateVolume = %v, want %s", err, testVolumeNqn)
+			}
+
+			objects := []runtime.Object{}
+			if test.pvHandle != "" {
+				objects = append(objects, driverPV("pv-1", test.pvHandle, resp.GetVolume().GetVolumeContext()))
+			}
+			restarted := newServer([]string{testVolumeNqn, otherNqn}, objects...)
+			restarted.Driver.metadata = c.Driver.metadata
+			r := restarted.deviceRegistry
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+
+			if got := r.volumeToNQN["pv-1"]; got != test.wantDevice {
+				t.Errorf("device of pv-1 after the restart = %s, want %s", got, test.wantDevice)
+			}
+			found, err := restarted.Driver.metadata.Get(ctx, metadataKindAllocation, "pv-1", &allocationRecord{})
+			if err != nil || found != test.wantRecord {
+				t.Errorf("allocation record of pv-1 found %t: %v, want %t", found, err, test.wantRecord)
+			}
+
+			// The retried CreateVolume gets the restored device, another
+			// volume does not
+			retried, err := restarted.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil || retried.GetVolume().GetVolumeId() != test.wantDevice {
+				t.Errorf("retried CreateVolume = %v, want %s", err, test.wantDevice)
+			}
+			other, err := restarted.CreateVolume(ctx, createRequest("pv-2", nil))
+			if err == nil && other.GetVolume().GetVolumeId() == test.wantDevice {
+				t.Errorf("pv-2 was allocated %s of pv-1", test.wantDevice)
+			}
+		})
+	}
+}
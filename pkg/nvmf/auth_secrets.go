@@ -0,0 +1,216 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Keys of the NVMe in-band authentication (DH-HMAC-CHAP) secrets, in the
+// stage and publish secrets of a volume
+const (
+	secretDhchapKey     = "dhchapSecret"     // Host key, e.g. "DHHC-1:00:..."
+	secretDhchapCtrlKey = "dhchapCtrlSecret" // Controller key for bidirectional authentication
+)
+
+// Fabrics connect options and controller sysfs attributes carrying the secrets
+const (
+	dhchapSecretOption     = "dhchap_secret"
+	dhchapCtrlSecretOption = "dhchap_ctrl_secret"
+)
+
+// controllerSysfsDir holds the sysfs attributes of the NVMe controllers, a
+// variable so that tests can mock sysfs
+var controllerSysfsDir = SYS_NVMF
+
+// redactedSecret replaces secrets in logged connect arguments
+const redactedSecret = "<redacted>"
+
+// authSecrets are the authentication secrets of a connection. They are kept in
+// memory only and never logged or persisted in the connector file.
+type authSecrets struct {
+	hostKey string
+	ctrlKey string
+}
+
+// String keeps the secrets out of logged values
+func (s authSecrets) String() string {
+	return fmt.Sprintf("{hostKey:%t ctrlKey:%t}", s.hostKey != "", s.ctrlKey != "")
+}
+
+func (s authSecrets) isSet() bool {
+	return s.hostKey != "" || s.ctrlKey != ""
+}
+
+// authSecretsFrom returns the authentication secrets of CSI request secrets
+func authSecretsFrom(secrets map[string]string) authSecrets {
+	return authSecrets{
+		hostKey: strings.TrimSpace(secrets[secretDhchapKey]),
+		ctrlKey: strings.TrimSpace(secrets[secretDhchapCtrlKey]),
+	}
+}
+
+// credentialSource is the request phase the secrets of a connection come from
+type credentialSource string
+
+const (
+	credentialsNone    credentialSource = "none"
+	credentialsStage   credentialSource = "stage"
+	credentialsPublish credentialSource = "publish"
+)
+
+// selectAuthSecrets chooses the secrets a connection authenticates with.
+// Publish secrets take precedence over stage secrets, so that a rotated secret
+// passed at publish replaces the one the volume was staged with without
+// restaging it. Publish secrets replace the stage secrets as a whole rather
+// than key by key, since a rotation replaces both keys.
+func selectAuthSecrets(stage, publish authSecrets) (authSecrets, credentialSource) {
+	switch {
+	case publish.isSet():
+		if stage.isSet() && stage != publish {
+			klog.V(5).Infof("Stage and publish secrets differ, authenticating with the publish secrets")
+		}
+		return publish, credentialsPublish
+	case stage.isSet():
+		return stage, credentialsStage
+	}
+
+	return authSecrets{}, credentialsNone
+}
+
+// applyTo sets the secrets the connector connects with
+func (s authSecrets) applyTo(connector *Connector) {
+	connector.DhchapSecret = s.hostKey
+	connector.DhchapCtrlSecret = s.ctrlKey
+}
+
+// redactConnectArgs returns connect arguments with the secret values replaced,
+// for logging
+func redactConnectArgs(argStr string) string {
+	args := strings.Split(argStr, ",")
+	for i, arg := range args {
+		name, _, found := strings.Cut(arg, "=")
+		if found && (name == dhchapSecretOption || name == dhchapCtrlSecretOption) {
+			args[i] = name + "=" + redactedSecret
+		}
+	}
+
+	return strings.Join(args, ",")
+}
+
+// stageSecrets returns the secrets to stage a volume of nqn with. A connection
+// of nqn whose secrets were rotated at publish keeps authenticating with them,
+// so that connecting again does not fall back to stale stage secrets.
+func (n *NodeServer) stageSecrets(nqn string, stage authSecrets) (authSecrets, credentialSource) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for _, conn := range n.connections {
+		if conn.nqn == nqn && conn.secretsSource == credentialsPublish {
+			return selectAuthSecrets(stage, conn.secrets)
+		}
+	}
+
+	return selectAuthSecrets(stage, authSecrets{})
+}
+
+// cacheSecrets records the secrets the connection of nqn with hostNqn was
+// established with
+func (n *NodeServer) cacheSecrets(nqn, hostNqn string, secrets authSecrets, source credentialSource) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if conn, exists := n.connections[connectionKey(nqn, hostNqn)]; exists {
+		conn.secrets = secrets
+		conn.secretsSource = source
+	}
+}
+
+// applyPublishSecrets rotates the secrets of the connection serving the volume
+// staged at stagingPath to the publish secrets, if they are set and differ
+// from the secrets in use, under the connection lock of nqn
+func (n *NodeServer) applyPublishSecrets(nqn, stagingPath string, publishSecrets map[string]string) error {
+	publish := authSecretsFrom(publishSecrets)
+	if !publish.isSet() {
+		return nil
+	}
+
+	n.nqnLocks.Acquire(connectionLockKey(nqn))
+	defer n.nqnLocks.Release(connectionLockKey(nqn))
+
+	n.mtx.Lock()
+	var conn *nodeConnection
+	for _, c := range n.connections {
+		if _, exists := c.stagingPaths[stagingPath]; exists && c.nqn == nqn {
+			conn = c
+			break
+		}
+	}
+	if conn == nil {
+		n.mtx.Unlock()
+		klog.V(4).Infof("No tracked connection of %s for %s, not applying publish secrets", nqn, stagingPath)
+		return nil
+	}
+	hostNqn, current := conn.hostNqn, conn.secrets
+	n.mtx.Unlock()
+
+	secrets, source := selectAuthSecrets(current, publish)
+	if secrets == current {
+		return nil
+	}
+
+	klog.Infof("Rotating the authentication secrets of %s to the publish secrets", nqn)
+	if err := rotateControllerSecrets(n.Driver.nvme, nqn, hostNqn, secrets); err != nil {
+		return err
+	}
+	n.cacheSecrets(nqn, hostNqn, secrets, source)
+
+	return nil
+}
+
+// rotateControllerSecrets writes secrets to the controllers of nqn connected
+// with hostNqn, which makes the kernel re-authenticate them
+func rotateControllerSecrets(client NvmeClient, nqn, hostNqn string, secrets authSecrets) error {
+	controllers, err := client.ListSubsystems()
+	if err != nil {
+		return fmt.Errorf("failed to list controllers of %s: %v", nqn, err)
+	}
+
+	for _, controller := range controllers {
+		if controller.SubsysNqn != nqn || controller.HostNqn != "" && controller.HostNqn != hostNqn {
+			continue
+		}
+		for attribute, value := range map[string]string{
+			dhchapSecretOption:     secrets.hostKey,
+			dhchapCtrlSecretOption: secrets.ctrlKey,
+		} {
+			if value == "" {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(controllerSysfsDir, controller.Name, attribute), []byte(value), 0); err != nil {
+				return fmt.Errorf("failed to write %s of controller %s: %v", attribute, controller.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
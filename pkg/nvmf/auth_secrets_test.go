@@ -0,0 +1,148 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testStageKey   = "DHHC-1:00:c3RhZ2Uta2V5LW9mLXRoZS12b2x1bWUtMDAwMDAwMDA=:"
+	testPublishKey = "DHHC-1:00:cHVibGlzaC1rZXktb2YtdGhlLXZvbHVtZS0wMDAwMDA=:"
+)
+
+// withFakeControllerSysfs points the controller attributes at a directory
+// holding the controllers with empty secret attributes, returning it
+func withFakeControllerSysfs(t *testing.T, controllers ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, controller := range controllers {
+		if err := os.Mkdir(filepath.Join(dir, controller), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, attribute := range []string{dhchapSecretOption, dhchapCtrlSecretOption} {
+			if err := os.WriteFile(filepath.Join(dir, controller, attribute), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	saved := controllerSysfsDir
+	controllerSysfsDir = dir
+	t.Cleanup(func() { controllerSysfsDir = saved })
+	return dir
+}
+
+func TestSelectAuthSecrets(t *testing.T) {
+	stage := authSecrets{hostKey: testStageKey}
+	publish := authSecrets{hostKey: testPublishKey}
+
+	tests := []struct {
+		name       string
+		stage      authSecrets
+		publish    authSecrets
+		want       authSecrets
+		wantSource credentialSource
+	}{
+		{name: "none", wantSource: credentialsNone},
+		{name: "stage only", stage: stage, want: stage, wantSource: credentialsStage},
+		{name: "publish only", publish: publish, want: publish, wantSource: credentialsPublish},
+		{name: "conflicting", stage: stage, publish: publish, want: publish, wantSource: credentialsPublish},
+		{name: "publish without controller key", stage: authSecrets{hostKey: testStageKey, ctrlKey: testStageKey}, publish: publish, want: publish, wantSource: credentialsPublish},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, source := selectAuthSecrets(test.stage, test.publish)
+			if got != test.want || source != test.wantSource {
+				t.Errorf("selectAuthSecrets = %v from %s, want %v from %s", got, source, test.want, test.wantSource)
+			}
+		})
+	}
+}
+
+func TestAuthSecretsNotLogged(t *testing.T) {
+	secrets := authSecrets{hostKey: testStageKey, ctrlKey: testPublishKey}
+	args := "nqn=" + testVolumeNqn + ",dhchap_secret=" + testStageKey + ",dhchap_ctrl_secret=" + testPublishKey
+
+	for _, logged := range []string{secrets.String(), redactConnectArgs(args)} {
+		if strings.Contains(logged, testStageKey) || strings.Contains(logged, testPublishKey) {
+			t.Errorf("logged value %q holds a secret", logged)
+		}
+	}
+}
+
+func TestPublishSecretsOnReconnect(t *testing.T) {
+	tests := []struct {
+		name           string
+		publishSecrets map[string]string
+		wantKey        string
+	}{
+		{name: "no publish secrets", wantKey: testStageKey},
+		{name: "same publish secrets", publishSecrets: map[string]string{secretDhchapKey: testStageKey}, wantKey: testStageKey},
+		{name: "rotated publish secrets", publishSecrets: map[string]string{secretDhchapKey: testPublishKey}, wantKey: testPublishKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sysfs := withFakeControllerSysfs(t, "nvme0")
+			client := newFakeNvmeClient()
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+			stageSecrets := authSecretsFrom(map[string]string{secretDhchapKey: testStageKey})
+
+			stage := func(nsid uint32) string {
+				volumeID := formatVolumeID(testVolumeNqn, nsid)
+				stagingPath := stagingVolumePath(t.TempDir(), volumeID)
+				connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+				connector.Nsid = nsid
+				if _, _, err := n.connectStage(volumeID, stagingPath, connector, false, stageSecrets); err != nil {
+					t.Fatalf("connectStage(%s): %v", volumeID, err)
+				}
+				return stagingPath
+			}
+
+			stagingPath := stage(1)
+			if key := client.connects[0].DhchapSecret; key != testStageKey {
+				t.Fatalf("staged with key %q, want the stage key", key)
+			}
+			if err := n.applyPublishSecrets(testVolumeNqn, stagingPath, test.publishSecrets); err != nil {
+				t.Fatalf("applyPublishSecrets: %v", err)
+			}
+			rotated, err := os.ReadFile(filepath.Join(sysfs, "nvme0", dhchapSecretOption))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantRotated := test.wantKey == testPublishKey; (string(rotated) == testPublishKey) != wantRotated || !wantRotated && len(rotated) > 0 {
+				t.Errorf("controller key = %q, want rotated %v", rotated, wantRotated)
+			}
+
+			// The target went away, the next stage of the subsystem connects it again
+			client.controllers = nil
+			stage(2)
+			if client.connectCount() != 2 {
+				t.Fatalf("connects = %d, want a reconnect", client.connectCount())
+			}
+			if key := client.connects[1].DhchapSecret; key != test.wantKey {
+				t.Errorf("reconnected with key %q, want %q", key, test.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Supported backend types
+const (
+	BackendNone = "none" // Plain NVMe-oF targets without a management API
+	BackendHook = "hook" // Target management delegated to an external executable
+)
+
+// BackendCapability names an optional target-side operation
+type BackendCapability string
+
+const (
+	BackendCapabilitySnapshot  BackendCapability = "snapshot"
+	BackendCapabilityClone     BackendCapability = "clone"
+	BackendCapabilityWipe      BackendCapability = "wipe"
+	BackendCapabilityGrant     BackendCapability = "grant"
+	BackendCapabilityHealth    BackendCapability = "health"
+	BackendCapabilityQoS       BackendCapability = "qos"
+	BackendCapabilityHostAcl   BackendCapability = "host-acl"
+	BackendCapabilityProvision BackendCapability = "provision"
+)
+
+// Backend is the target-side integration for operations that the fabric alone
+// cannot perform. Optional operations are provided by implementing the
+// corresponding interface (e.g. Snapshotter) and reporting the capability.
+type Backend interface {
+	Name() string
+	Supports(capability BackendCapability) bool
+}
+
+// BackendSnapshot describes a namespace snapshot taken on the target
+type BackendSnapshot struct {
+	SizeBytes  int64 `json:"sizeBytes"`
+	ReadyToUse bool  `json:"readyToUse"`
+}
+
+// Snapshotter takes and removes snapshots of backend namespaces. sourceNsid is
+// 0 for a volume of a whole subsystem.
+type Snapshotter interface {
+	CreateSnapshot(ctx context.Context, sourceNqn string, sourceNsid uint32, snapshotID string) (*BackendSnapshot, error)
+	// DeleteSnapshot must succeed if the snapshot no longer exists on the backend
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+}
+
+// Cloner populates a freshly allocated namespace from an existing volume or
+// snapshot. The NSIDs are 0 for volumes of whole subsystems.
+type Cloner interface {
+	CloneVolume(ctx context.Context, sourceNqn string, sourceNsid uint32, targetNqn string, targetNsid uint32) error
+	RestoreSnapshot(ctx context.Context, snapshotID, targetNqn string, targetNsid uint32) error
+}
+
+// Wiper erases the data of a namespace before it is reused for another volume.
+// nsid is 0 for a volume of a whole subsystem.
+type Wiper interface {
+	WipeVolume(ctx context.Context, targetNqn string, nsid uint32) error
+}
+
+// NodeGranter controls which nodes may connect to a volume, e.g. through the
+// host NQN allowlist of its subsystem. A backend granting access per subsystem
+// must keep it granted while other namespaces of the subsystem are granted.
+// hostNqn is the host NQN the node published, empty if it published none.
+type NodeGranter interface {
+	// GrantNodeAccess allows nodeID to connect to the namespace and returns the
+	// publish context the node needs, e.g. the host NQN it must connect with
+	GrantNodeAccess(ctx context.Context, targetNqn string, nsid uint32, nodeID, hostNqn string) (map[string]string, error)
+	// RevokeNodeAccess must succeed if nodeID has no access to the namespace
+	RevokeNodeAccess(ctx context.Context, targetNqn string, nsid uint32, nodeID, hostNqn string) error
+}
+
+// BackendVolumeHealth is the admin state of a namespace reported by the backend
+type BackendVolumeHealth struct {
+	Abnormal bool   `json:"abnormal"`
+	Message  string `json:"message,omitempty"` // The reason of an abnormal state, e.g. "array degraded"
+}
+
+// HealthReporter reports the admin state of namespaces, e.g. a degraded array,
+// which the fabric cannot observe
+type HealthReporter interface {
+	VolumeHealth(ctx context.Context, targetNqn string, nsid uint32) (*BackendVolumeHealth, error)
+}
+
+// BackendQoS are the I/O limits of a namespace, 0 for no limit
+type BackendQoS struct {
+	MaxIops          int64 `json:"maxIops,omitempty"`
+	MaxBandwidthMBps int64 `json:"maxBandwidthMBps,omitempty"`
+	BurstIops        int64 `json:"burstIops,omitempty"`
+}
+
+// QoSApplier sets the I/O limits of namespaces. Applying a zero BackendQoS
+// removes the limits, e.g. those of the previous volume of a reused namespace.
+type QoSApplier interface {
+	ApplyQoS(ctx context.Context, targetNqn string, nsid uint32, qos BackendQoS) error
+}
+
+// HostAclManager manages the host NQN allowlist of subsystems, for volumes
+// whose StorageClass declares the hosts allowed to connect
+type HostAclManager interface {
+	// AllowedHosts returns the host NQNs allowed to connect to the subsystem
+	AllowedHosts(ctx context.Context, targetNqn string) ([]string, error)
+	// AllowHost must succeed if hostNqn is already allowed
+	AllowHost(ctx context.Context, targetNqn, hostNqn string) error
+	// DisallowHost must succeed if hostNqn is not allowed
+	DisallowHost(ctx context.Context, targetNqn, hostNqn string) error
+}
+
+// BackendNamespace describes a namespace the backend created
+type BackendNamespace struct {
+	Nsid      uint32 `json:"nsid"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+// NamespaceProvisioner creates and deletes the namespaces of volumes of the
+// dynamic provisioning mode on existing subsystems
+type NamespaceProvisioner interface {
+	// CreateNamespace must return the namespace a previous call created for
+	// the same name, so that a retried CreateVolume does not leak namespaces
+	CreateNamespace(ctx context.Context, targetNqn, name string, sizeBytes int64) (*BackendNamespace, error)
+	// DeleteNamespace must succeed if the namespace no longer exists
+	DeleteNamespace(ctx context.Context, targetNqn string, nsid uint32) error
+}
+
+// newBackend creates the backend selected in the driver configuration
+func newBackend(conf *GlobalConfig) (Backend, error) {
+	switch conf.Backend {
+	case "", BackendNone:
+		return &noneBackend{}, nil
+	case BackendHook:
+		if conf.BackendHook == "" {
+			return nil, fmt.Errorf("backend %q requires a hook executable", BackendHook)
+		}
+		capabilities := make(map[BackendCapability]bool)
+		for _, c := range strings.Split(conf.BackendCapabilities, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				capabilities[BackendCapability(c)] = true
+			}
+		}
+		return &hookBackend{path: conf.BackendHook, capabilities: capabilities}, nil
+	default:
+		return nil, fmt.Errorf("unsupported backend: %s", conf.Backend)
+	}
+}
+
+// noneBackend supports no optional operations
+type noneBackend struct{}
+
+func (b *noneBackend) Name() string {
+	return BackendNone
+}
+
+func (b *noneBackend) Supports(capability BackendCapability) bool {
+	return false
+}
+
+// hookBackend runs "<path> <operation>" with a JSON request on stdin and
+// expects a JSON response on stdout. A non-zero exit status is an error.
+type hookBackend struct {
+	path         string
+	capabilities map[BackendCapability]bool
+}
+
+func (b *hookBackend) Name() string {
+	return BackendHook
+}
+
+func (b *hookBackend) Supports(capability BackendCapability) bool {
+	return b.capabilities[capability]
+}
+
+func (b *hookBackend) CreateSnapshot(ctx context.Context, sourceNqn string, sourceNsid uint32, snapshotID string) (*BackendSnapshot, error) {
+	request := map[string]string{
+		"sourceNqn":  sourceNqn,
+		"sourceNsid": strconv.FormatUint(uint64(sourceNsid), 10),
+		"snapshotId": snapshotID,
+	}
+
+	snapshot := &BackendSnapshot{}
+	if err := b.run(ctx, "create-snapshot", request, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (b *hookBackend) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	request := map[string]string{
+		"snapshotId": snapshotID,
+	}
+
+	return b.run(ctx, "delete-snapshot", request, nil)
+}
+
+func (b *hookBackend) CloneVolume(ctx context.Context, sourceNqn string, sourceNsid uint32, targetNqn string, targetNsid uint32) error {
+	request := map[string]string{
+		"sourceNqn":  sourceNqn,
+		"sourceNsid": strconv.FormatUint(uint64(sourceNsid), 10),
+		"targetNqn":  targetNqn,
+		"nsid":       strconv.FormatUint(uint64(targetNsid), 10),
+	}
+
+	return b.run(ctx, "clone-volume", request, nil)
+}
+
+func (b *hookBackend) RestoreSnapshot(ctx context.Context, snapshotID, targetNqn string, targetNsid uint32) error {
+	request := map[string]string{
+		"snapshotId": snapshotID,
+		"targetNqn":  targetNqn,
+		"nsid":       strconv.FormatUint(uint64(targetNsid), 10),
+	}
+
+	return b.run(ctx, "restore-snapshot", request, nil)
+}
+
+func (b *hookBackend) WipeVolume(ctx context.Context, targetNqn string, nsid uint32) error {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"nsid":      strconv.FormatUint(uint64(nsid), 10),
+	}
+
+	return b.run(ctx, "wipe-volume", request, nil)
+}
+
+func (b *hookBackend) GrantNodeAccess(ctx context.Context, targetNqn string, nsid uint32, nodeID, hostNqn string) (map[string]string, error) {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"nsid":      strconv.FormatUint(uint64(nsid), 10),
+		"nodeId":    nodeID,
+	}
+	if hostNqn != "" {
+		request["hostNqn"] = hostNqn
+	}
+
+	publishContext := map[string]string{}
+	if err := b.run(ctx, "grant-node-access", request, &publishContext); err != nil {
+		return nil, err
+	}
+
+	return publishContext, nil
+}
+
+func (b *hookBackend) RevokeNodeAccess(ctx context.Context, targetNqn string, nsid uint32, nodeID, hostNqn string) error {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"nsid":      strconv.FormatUint(uint64(nsid), 10),
+		"nodeId":    nodeID,
+	}
+	if hostNqn != "" {
+		request["hostNqn"] = hostNqn
+	}
+
+	return b.run(ctx, "revoke-node-access", request, nil)
+}
+
+func (b *hookBackend) VolumeHealth(ctx context.Context, targetNqn string, nsid uint32) (*BackendVolumeHealth, error) {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"nsid":      strconv.FormatUint(uint64(nsid), 10),
+	}
+
+	health := &BackendVolumeHealth{}
+	if err := b.run(ctx, "volume-health", request, health); err != nil {
+		return nil, err
+	}
+
+	return health, nil
+}
+
+func (b *hookBackend) ApplyQoS(ctx context.Context, targetNqn string, nsid uint32, qos BackendQoS) error {
+	request := map[string]string{
+		"targetNqn":        targetNqn,
+		"nsid":             strconv.FormatUint(uint64(nsid), 10),
+		"maxIops":          strconv.FormatInt(qos.MaxIops, 10),
+		"maxBandwidthMBps": strconv.FormatInt(qos.MaxBandwidthMBps, 10),
+		"burstIops":        strconv.FormatInt(qos.BurstIops, 10),
+	}
+
+	return b.run(ctx, "apply-qos", request, nil)
+}
+
+func (b *hookBackend) AllowedHosts(ctx context.Context, targetNqn string) ([]string, error) {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+	}
+
+	response := struct {
+		HostNqns []string `json:"hostNqns"`
+	}{}
+	if err := b.run(ctx, "list-allowed-hosts", request, &response); err != nil {
+		return nil, err
+	}
+
+	return response.HostNqns, nil
+}
+
+func (b *hookBackend) AllowHost(ctx context.Context, targetNqn, hostNqn string) error {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"hostNqn":   hostNqn,
+	}
+
+	return b.run(ctx, "allow-host", request, nil)
+}
+
+func (b *hookBackend) DisallowHost(ctx context.Context, targetNqn, hostNqn string) error {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"hostNqn":   hostNqn,
+	}
+
+	return b.run(ctx, "disallow-host", request, nil)
+}
+
+func (b *hookBackend) CreateNamespace(ctx context.Context, targetNqn, name string, sizeBytes int64) (*BackendNamespace, error) {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"name":      name,
+		"sizeBytes": strconv.FormatInt(sizeBytes, 10),
+	}
+
+	namespace := &BackendNamespace{}
+	if err := b.run(ctx, "create-namespace", request, namespace); err != nil {
+		return nil, err
+	}
+
+	return namespace, nil
+}
+
+func (b *hookBackend) DeleteNamespace(ctx context.Context, targetNqn string, nsid uint32) error {
+	request := map[string]string{
+		"targetNqn": targetNqn,
+		"nsid":      strconv.FormatUint(uint64(nsid), 10),
+	}
+
+	return b.run(ctx, "delete-namespace", request, nil)
+}
+
+// run executes a hook operation; response may be nil if no output is expected
+func (b *hookBackend) run(ctx context.Context, operation string, request, response interface{}) error {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s request: %v", operation, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.path, operation)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	klog.V(4).Infof("Running backend hook %s %s", b.path, operation)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("backend hook %s failed: %v: %s", operation, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if response == nil || stdout.Len() == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), response); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", operation, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout bounds the wait for the lock of a database another process holds
+const boltOpenTimeout = 10 * time.Second
+
+// boltDatabases are the databases opened by the process, by path, shared by
+// the bolt stores of each prefix since a database is opened once
+var boltDatabases = struct {
+	mutex  sync.Mutex
+	byPath map[string]*bolt.DB
+}{byPath: map[string]*bolt.DB{}}
+
+// openBoltDatabase returns the database at path, opening it on first use
+func openBoltDatabase(path string) (*bolt.DB, error) {
+	boltDatabases.mutex.Lock()
+	defer boltDatabases.mutex.Unlock()
+
+	path = filepath.Clean(path)
+	if db, exists := boltDatabases.byPath[path]; exists {
+		return db, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create persistence directory %s: %v", filepath.Dir(path), err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %v", path, err)
+	}
+	boltDatabases.byPath[path] = db
+
+	return db, nil
+}
+
+// boltStore persists driver records in an embedded BoltDB database, one
+// bucket per kind, for deployments without access to the API server for
+// them. The database is locked by the process that opens it and only visible
+// to the controller that writes it, so the controller must run as a single
+// replica on persistent storage. Record keys are prefixed as in the metadata
+// store.
+type boltStore struct {
+	db       *bolt.DB
+	prefix   string
+	watchers *recordWatchers
+}
+
+func newBoltStore(path, prefix string) (*boltStore, error) {
+	db, err := openBoltDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db: db, prefix: prefix, watchers: recordWatchersOf(path)}, nil
+}
+
+// Put creates or replaces the record stored under kind/key
+func (s *boltStore) Put(ctx context.Context, kind, key string, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s record %s: %v", kind, key, err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(s.prefix+key), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store %s record %s: %v", kind, key, err)
+	}
+	s.watchers.notify(kind, s.prefix+key, data)
+
+	return nil
+}
+
+// Get loads the record stored under kind/key into record and reports whether it exists
+func (s *boltStore) Get(ctx context.Context, kind, key string, record interface{}) (bool, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(kind)); bucket != nil {
+			// The value is only valid during the transaction
+			if value := bucket.Get([]byte(s.prefix + key)); value != nil {
+				data = append([]byte{}, value...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get %s record %s: %v", kind, key, err)
+	}
+	if data == nil {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(data, record); err != nil {
+		return false, fmt.Errorf("failed to decode %s record %s: %v", kind, key, err)
+	}
+
+	return true, nil
+}
+
+// Delete removes the record stored under kind/key. Deleting a missing record is not an error.
+func (s *boltStore) Delete(ctx context.Context, kind, key string) error {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil || bucket.Get([]byte(s.prefix+key)) == nil {
+			return nil
+		}
+		deleted = true
+		return bucket.Delete([]byte(s.prefix + key))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s record %s: %v", kind, key, err)
+	}
+	if deleted {
+		s.watchers.notify(kind, s.prefix+key, nil)
+	}
+
+	return nil
+}
+
+// List returns the raw JSON of every record of the given kind, indexed by key
+func (s *boltStore) List(ctx context.Context, kind string) (map[string][]byte, error) {
+	records := map[string][]byte{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		prefix := []byte(s.prefix)
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			records[string(key)] = append([]byte{}, value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s records: %v", kind, err)
+	}
+
+	return unprefixedRecords(s.prefix, records), nil
+}
+
+// Watch returns the changes of the records of the given kind made through the
+// stores of the database until ctx is done
+func (s *boltStore) Watch(ctx context.Context, kind string) (<-chan recordEvent, error) {
+	return s.watchers.watch(ctx, kind, s.prefix), nil
+}
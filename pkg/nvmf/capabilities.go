@@ -0,0 +1,127 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// conflictingMountFlags pairs mount flags with their opposite
+var conflictingMountFlags = map[string]string{
+	"ro":       "rw",
+	"sync":     "async",
+	"exec":     "noexec",
+	"suid":     "nosuid",
+	"dev":      "nodev",
+	"atime":    "noatime",
+	"diratime": "nodiratime",
+}
+
+// driverMountFlags change how the volume is mounted rather than the mount
+// itself, so the node server sets them and they cannot be requested
+var driverMountFlags = map[string]struct{}{
+	"bind":    {},
+	"rbind":   {},
+	"remount": {},
+	"move":    {},
+}
+
+// validateVolumeCapabilities checks that volume capabilities request one access
+// type each, a supported access mode and a consistent set of mount flags
+func (d *driver) validateVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
+	if len(volCaps) == 0 {
+		return fmt.Errorf("volume capabilities must be provided")
+	}
+
+	hasBlock, hasMount := false, false
+	for _, cap := range volCaps {
+		if cap.GetBlock() != nil && cap.GetMount() != nil {
+			return fmt.Errorf("cannot specify both block and mount access types")
+		}
+		if cap.GetBlock() == nil && cap.GetMount() == nil {
+			return fmt.Errorf("must specify either block or mount access type")
+		}
+		hasBlock = hasBlock || cap.GetBlock() != nil
+		hasMount = hasMount || cap.GetMount() != nil
+
+		if err := d.validateAccessMode(cap.GetAccessMode()); err != nil {
+			return err
+		}
+		if err := validateMountFlags(cap.GetMount().GetMountFlags()); err != nil {
+			return err
+		}
+	}
+
+	// A raw block volume is never formatted or mounted, so it cannot take a filesystem or mount options
+	if hasBlock && hasMount {
+		return fmt.Errorf("block volumes cannot also be requested with a filesystem or mount options")
+	}
+
+	return nil
+}
+
+// validateAccessMode checks that the access mode is one the driver advertises
+func (d *driver) validateAccessMode(accessMode *csi.VolumeCapability_AccessMode) error {
+	if accessMode == nil {
+		return fmt.Errorf("access mode must be provided")
+	}
+
+	supported := make([]string, 0, len(d.cap))
+	for _, cap := range d.cap {
+		if cap.GetMode() == accessMode.GetMode() {
+			return nil
+		}
+		supported = append(supported, cap.GetMode().String())
+	}
+
+	return fmt.Errorf("access mode %s is not supported, supported modes: %s", accessMode.GetMode(), strings.Join(supported, ", "))
+}
+
+// validateMountFlags rejects empty flags, flags reserved to the node server and
+// flags requested together with their opposite
+func validateMountFlags(flags []string) error {
+	requested := map[string]struct{}{}
+	for _, option := range flags {
+		for _, flag := range strings.Split(option, ",") {
+			flag = strings.TrimSpace(flag)
+			if flag == "" {
+				return fmt.Errorf("mount flags must not be empty, got: %q", option)
+			}
+			if _, reserved := driverMountFlags[flag]; reserved {
+				return fmt.Errorf("mount flag %s is set by the driver and cannot be requested", flag)
+			}
+			requested[flag] = struct{}{}
+		}
+	}
+
+	if _, _, err := parseMountPropagation(flags); err != nil {
+		return err
+	}
+
+	for flag, opposite := range conflictingMountFlags {
+		_, hasFlag := requested[flag]
+		_, hasOpposite := requested[opposite]
+		if hasFlag && hasOpposite {
+			return fmt.Errorf("mount flags %s and %s conflict", flag, opposite)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mountCapability returns a mount capability of the access mode and mount flags
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode, flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+// blockCapability returns a block capability of the access mode
+func blockCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestValidateAccessModes(t *testing.T) {
+	// The access modes the driver advertises
+	supported := map[csi.VolumeCapability_AccessMode_Mode]bool{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:       true,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER: true,
+	}
+	d := &driver{}
+	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	})
+
+	modes := make([]int, 0, len(csi.VolumeCapability_AccessMode_Mode_name))
+	for mode := range csi.VolumeCapability_AccessMode_Mode_name {
+		modes = append(modes, int(mode))
+	}
+	sort.Ints(modes)
+
+	for _, value := range modes {
+		mode := csi.VolumeCapability_AccessMode_Mode(value)
+		t.Run(mode.String(), func(t *testing.T) {
+			for _, capability := range []*csi.VolumeCapability{mountCapability(mode), blockCapability(mode)} {
+				err := d.validateVolumeCapabilities([]*csi.VolumeCapability{capability})
+				if supported[mode] {
+					if err != nil {
+						t.Errorf("validateVolumeCapabilities(%v) = %v, want supported", capability, err)
+					}
+					continue
+				}
+				if err == nil || !strings.Contains(err.Error(), mode.String()) {
+					t.Errorf("validateVolumeCapabilities(%v) = %v, want an error naming %s", capability, err, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMountFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []string
+		wantErr bool
+	}{
+		{name: "no flags"},
+		{name: "independent flags", flags: []string{"noatime", "nodev", "discard"}},
+		{name: "comma-separated flags", flags: []string{"noatime,nodev"}},
+		{name: "mount propagation", flags: []string{"rshared"}},
+		{name: "read-only and read-write", flags: []string{"ro", "rw"}, wantErr: true},
+		{name: "conflict in one option", flags: []string{"sync,async"}, wantErr: true},
+		{name: "exec and noexec", flags: []string{"exec", "noexec"}, wantErr: true},
+		{name: "conflicting propagations", flags: []string{"shared", "private"}, wantErr: true},
+		{name: "bind mount", flags: []string{"bind"}, wantErr: true},
+		{name: "remount", flags: []string{"remount,ro"}, wantErr: true},
+		{name: "empty flag", flags: []string{"noatime,"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateMountFlags(test.flags); (err != nil) != test.wantErr {
+				t.Errorf("validateMountFlags(%v) = %v, want error %v", test.flags, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCapabilityValidationShared(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities []*csi.VolumeCapability
+		wantValid    bool
+	}{
+		{name: "mount", capabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "noatime")}, wantValid: true},
+		{name: "block", capabilities: []*csi.VolumeCapability{blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)}, wantValid: true},
+		{name: "unsupported access mode", capabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER)}},
+		{name: "conflicting mount flags", capabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ro", "rw")}},
+		{name: "block and mount", capabilities: []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		}},
+		{name: "missing access mode", capabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			})
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, "nqn.2024-01.io.example:volume-2")
+			created, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+
+			resp, err := c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           created.GetVolume().GetVolumeId(),
+				VolumeCapabilities: test.capabilities,
+			})
+			if err != nil {
+				t.Fatalf("ValidateVolumeCapabilities: %v", err)
+			}
+			if confirmed := resp.GetConfirmed() != nil; confirmed != test.wantValid {
+				t.Errorf("ValidateVolumeCapabilities confirmed = %v, want %v: %s", confirmed, test.wantValid, resp.GetMessage())
+			}
+
+			req := createRequest("pv-2", nil)
+			req.VolumeCapabilities = test.capabilities
+			_, err = c.CreateVolume(ctx, req)
+			want := codes.InvalidArgument
+			if test.wantValid {
+				want = codes.OK
+			}
+			if got := status.Code(err); got != want {
+				t.Errorf("CreateVolume code = %v, want %v: %v", got, want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+)
+
+// ErrInsufficientCapacity is returned when formatting or mounting a device
+// failed because it is too small or full
+var ErrInsufficientCapacity = errors.New("insufficient device capacity")
+
+// capacityErrorMessages are the messages of mkfs and mount failures caused by
+// the capacity of the device, in lowercase
+var capacityErrorMessages = []string{
+	"no space left on device",
+	"file too large",
+	"device is too small",
+	"filesystem too small",
+	"too small for a",
+	"larger than apparent device size",
+	"not enough space",
+}
+
+// isCapacityError reports whether a failure of mkfs or mount, with its output,
+// was caused by the capacity of the device
+func isCapacityError(err error, output string) bool {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EFBIG) {
+		return true
+	}
+
+	text := strings.ToLower(output)
+	if err != nil {
+		text += " " + strings.ToLower(err.Error())
+	}
+	for _, message := range capacityErrorMessages {
+		if strings.Contains(text, message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describeCapacity describes the size of a device and the bytes requested of
+// it, as recorded in the volume context, for capacity error messages
+func describeCapacity(devicePath, requestedBytes string) string {
+	size := "unknown size"
+	if bytes, err := stagedDeviceSize(devicePath); err == nil {
+		size = fmt.Sprintf("%d bytes", bytes)
+	}
+	if requestedBytes == "" {
+		return fmt.Sprintf("of %s ran out of capacity", size)
+	}
+
+	return fmt.Sprintf("of %s cannot hold the requested %s bytes", size, requestedBytes)
+}
+
+// mountFailureStatus returns the status of a stage whose device failed to be
+// formatted or mounted: a corrupt filesystem loses data, a device too small
+// or full is out of capacity, and other failures are retried
+func mountFailureStatus(volumeID, devicePath string, volumeContext map[string]string, err error) error {
+	switch {
+	case errors.Is(err, ErrFilesystemCorrupt):
+		return status.Errorf(codes.DataLoss, "failed to mount volume: %v", err)
+	case errors.Is(err, ErrInsufficientCapacity):
+		return status.Errorf(codes.ResourceExhausted, "device %s of volume %s %s: %v",
+			devicePath, volumeID, describeCapacity(devicePath, volumeContext[volumeContextUsedBytes]), err)
+	}
+
+	return status.Errorf(codes.Unavailable, "failed to mount volume: %v", err)
+}
+
+// wipeFailedFormat erases the signatures a failed mkfs may have written to a
+// device that had no filesystem, so that the next stage formats it again
+// instead of mounting a partial filesystem
+func wipeFailedFormat(devicePath string, executor exec.Interface) {
+	if output, err := executor.Command("wipefs", "-a", devicePath).CombinedOutput(); err != nil {
+		klog.Errorf("Failed to wipe the partial filesystem of %s, it must be wiped before the volume is staged again: %v: %s", devicePath, err, strings.TrimSpace(string(output)))
+		return
+	}
+
+	klog.Infof("Wiped the partial filesystem of %s after the failed format", devicePath)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+)
+
+// outputAction returns a command failing with err and output, recording its
+// command line
+func outputAction(commands *[]string, output string, err error) testingexec.FakeCommandAction {
+	return func(cmd string, args ...string) exec.Cmd {
+		*commands = append(*commands, strings.Join(append([]string{cmd}, args...), " "))
+		fake := &testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{func() ([]byte, []byte, error) { return []byte(output), nil, err }},
+		}
+		return testingexec.InitFakeCmd(fake, cmd, args...)
+	}
+}
+
+// failingMounter is a fake mounter whose mounts fail with err
+type failingMounter struct {
+	*mount.FakeMounter
+	err error
+}
+
+func (m *failingMounter) Mount(source, target, fstype string, options []string) error {
+	return m.err
+}
+
+func (m *failingMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	return m.err
+}
+
+func TestIsCapacityError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		output string
+		want   bool
+	}{
+		{name: "ENOSPC", err: fmt.Errorf("write: %w", syscall.ENOSPC), want: true},
+		{name: "EFBIG", err: fmt.Errorf("write: %w", syscall.EFBIG), want: true},
+		{name: "mkfs output", err: &testingexec.FakeExitError{Status: 1}, output: "mkfs.ext4: No space left on device while writing out and closing file system", want: true},
+		{name: "xfs too small", err: &testingexec.FakeExitError{Status: 1}, output: "agsize (4096 blocks) too small, need at least 4096 blocks\nFilesystem too small", want: true},
+		{name: "mount error message", err: errors.New("mount failed: exit status 32: No space left on device"), want: true},
+		{name: "other failure", err: &testingexec.FakeExitError{Status: 1}, output: "mkfs.ext4: Invalid argument while setting up superblock"},
+		{name: "no failure"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isCapacityError(test.err, test.output); got != test.want {
+				t.Errorf("isCapacityError(%v, %q) = %v, want %v", test.err, test.output, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatCapacityError(t *testing.T) {
+	tests := []struct {
+		name       string
+		mkfsOutput string
+		mkfsErr    error
+		// wipeErr fails the wipe of the partial filesystem
+		wipeErr      error
+		wantCapacity bool
+	}{
+		{name: "ENOSPC", mkfsErr: syscall.ENOSPC, wantCapacity: true},
+		{name: "no space in the output", mkfsOutput: "mkfs.ext4: No space left on device while writing out and closing file system", mkfsErr: &testingexec.FakeExitError{Status: 1}, wantCapacity: true},
+		{name: "failed wipe", mkfsErr: syscall.ENOSPC, wipeErr: &testingexec.FakeExitError{Status: 1}, wantCapacity: true},
+		{name: "other failure", mkfsOutput: "mkfs.ext4: Invalid argument while setting up superblock", mkfsErr: &testingexec.FakeExitError{Status: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commands := []string{}
+			executor := &testingexec.FakeExec{
+				CommandScript: []testingexec.FakeCommandAction{
+					blkidAction(""),
+					outputAction(&commands, test.mkfsOutput, test.mkfsErr),
+					outputAction(&commands, "", test.wipeErr),
+				},
+				ExactOrder: true,
+			}
+			mounter := mount.NewFakeMounter(nil)
+			nm := &nvmfDiskMounter{
+				fsType:     "ext4",
+				mounter:    &mount.SafeFormatAndMount{Interface: mounter, Exec: executor},
+				exec:       executor,
+				targetPath: t.TempDir(),
+			}
+
+			err := mountFilesystem("/dev/nvme0n1", nm)
+			if err == nil {
+				t.Fatal("mountFilesystem of a failed format succeeded")
+			}
+			if got := errors.Is(err, ErrInsufficientCapacity); got != test.wantCapacity {
+				t.Errorf("mountFilesystem error %v is a capacity error = %v, want %v", err, got, test.wantCapacity)
+			}
+
+			// The partial filesystem is wiped so the next stage formats again
+			want := []string{"mkfs.ext4 -F /dev/nvme0n1", "wipefs -a /dev/nvme0n1"}
+			if strings.Join(commands, "\n") != strings.Join(want, "\n") {
+				t.Errorf("commands = %q, want %q", commands, want)
+			}
+			if log := mounter.GetLog(); len(log) > 0 {
+				t.Errorf("failed format mounted: %v", log)
+			}
+		})
+	}
+}
+
+func TestMountCapacityError(t *testing.T) {
+	tests := []struct {
+		name         string
+		mountErr     error
+		wantCapacity bool
+	}{
+		{name: "full device", mountErr: errors.New("mount failed: exit status 32: No space left on device"), wantCapacity: true},
+		{name: "other failure", mountErr: errors.New("mount failed: exit status 32: wrong fs type, bad option, bad superblock")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The existing filesystem is detected, checked by the mounter and mounted
+			commands := []string{}
+			executor := &testingexec.FakeExec{
+				CommandScript: []testingexec.FakeCommandAction{blkidAction("ext4"), blkidAction("ext4"), recordAction(&commands)},
+				ExactOrder:    true,
+			}
+			nm := &nvmfDiskMounter{
+				fsType:     "ext4",
+				mounter:    &mount.SafeFormatAndMount{Interface: &failingMounter{FakeMounter: mount.NewFakeMounter(nil), err: test.mountErr}, Exec: executor},
+				exec:       executor,
+				targetPath: t.TempDir(),
+			}
+
+			err := mountFilesystem("/dev/nvme0n1", nm)
+			if err == nil {
+				t.Fatal("mountFilesystem of a failed mount succeeded")
+			}
+			if got := errors.Is(err, ErrInsufficientCapacity); got != test.wantCapacity {
+				t.Errorf("mountFilesystem error %v is a capacity error = %v, want %v", err, got, test.wantCapacity)
+			}
+
+			// A filesystem holding data is never wiped
+			for _, command := range commands {
+				if strings.HasPrefix(command, "wipefs") {
+					t.Errorf("existing filesystem wiped by %q", command)
+				}
+			}
+		})
+	}
+}
+
+func TestMountFailureStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		// sectors is the size of the device in sysfs, unknown if empty
+		sectors       string
+		volumeContext map[string]string
+		want          codes.Code
+		// wantMessage are parts of the status message
+		wantMessage []string
+	}{
+		{
+			name:          "requested bytes",
+			err:           fmt.Errorf("%w: mkfs.ext4 failed", ErrInsufficientCapacity),
+			sectors:       "2048\n",
+			volumeContext: map[string]string{volumeContextUsedBytes: "4194304"},
+			want:          codes.ResourceExhausted,
+			wantMessage:   []string{"of 1048576 bytes cannot hold the requested 4194304 bytes", "pv-1"},
+		},
+		{
+			name:        "no requested bytes",
+			err:         fmt.Errorf("%w: mount failed", ErrInsufficientCapacity),
+			sectors:     "2048\n",
+			want:        codes.ResourceExhausted,
+			wantMessage: []string{"of 1048576 bytes ran out of capacity"},
+		},
+		{
+			name:        "unknown device size",
+			err:         fmt.Errorf("%w: mount failed", ErrInsufficientCapacity),
+			want:        codes.ResourceExhausted,
+			wantMessage: []string{"of unknown size ran out of capacity"},
+		},
+		{name: "corrupt filesystem", err: fmt.Errorf("%w: e2fsck failed", ErrFilesystemCorrupt), want: codes.DataLoss},
+		{name: "other failure", err: errors.New("mount failed"), want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFakeNullDevice(t)
+			if test.sectors != "" {
+				if err := os.WriteFile(filepath.Join(sysfsBlockDir, "null", "size"), []byte(test.sectors), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			devicePath, err := namespaceDevicePath(testVolumeNqn, 1)
+			if err != nil {
+				t.Fatalf("namespaceDevicePath: %v", err)
+			}
+
+			st := status.Convert(mountFailureStatus("pv-1", devicePath, test.volumeContext, test.err))
+			if st.Code() != test.want {
+				t.Fatalf("mountFailureStatus code = %v, want %v: %s", st.Code(), test.want, st.Message())
+			}
+			for _, part := range append(test.wantMessage, test.err.Error()) {
+				if !strings.Contains(st.Message(), part) {
+					t.Errorf("mountFailureStatus message %q does not contain %q", st.Message(), part)
+				}
+			}
+		})
+	}
+}
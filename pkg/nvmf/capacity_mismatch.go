@@ -0,0 +1,96 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// ErrCapacityMismatch is returned when the device of a volume is smaller than
+// the capacity recorded for the volume, e.g. because the device was replaced
+// out of band by a smaller one with the same NQN
+var ErrCapacityMismatch = errors.New("device smaller than the recorded volume capacity")
+
+// checkCapacityMatch returns ErrCapacityMismatch if the current size of the
+// device of a volume is below the capacity recorded for it. An unknown
+// recorded capacity matches any size.
+func checkCapacityMatch(volumeID string, recordedBytes, actualBytes int64) error {
+	if recordedBytes <= 0 || actualBytes >= recordedBytes {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: device of volume %s has %d bytes, %d recorded", ErrCapacityMismatch, volumeID, actualBytes, recordedBytes)
+	klog.Errorf("CAPACITY MISMATCH: %v. The device may have been replaced by a smaller one with the same NQN, check the target before using the volume", err)
+	return err
+}
+
+// recordedVolumeBytes returns the capacity recorded for a volume in its volume
+// context: the bytes it consumes, or the capacity of its device if unknown
+func recordedVolumeBytes(volumeContext map[string]string) int64 {
+	if used := parseAttributeBytes(volumeContext, volumeContextUsedBytes); used > 0 {
+		return used
+	}
+	return parseAttributeBytes(volumeContext, volumeContextDeviceCapacity)
+}
+
+// capacityCondition reads the current size of the device of an allocated
+// volume and reports the volume abnormal if it is smaller than the capacity
+// recorded for it, nil otherwise. Reading the size may connect the device, so
+// it is only read with capacity probing enabled. The recorded capacity of a
+// shrunk device is lowered to its size, so that it is no longer overstated.
+func (r *DeviceRegistry) capacityCondition(ctx context.Context, volumeID string) *csi.VolumeCondition {
+	if !r.Driver.probeDeviceCapacity {
+		return nil
+	}
+
+	r.mutex.RLock()
+	device, exists := r.devices[volumeID]
+	if !exists || !device.IsAllocated || device.IsStale {
+		r.mutex.RUnlock()
+		return nil
+	}
+	diskInfo := *device.nvmfDiskInfo
+	recordedBytes := device.VolumeBytes
+	if recordedBytes == 0 {
+		recordedBytes = device.Capacity
+	}
+	r.mutex.RUnlock()
+
+	actualBytes, err := r.readDeviceSize(ctx, &VolumeInfo{nvmfDiskInfo: &diskInfo})
+	if err != nil {
+		klog.Warningf("Cannot read the size of the device of volume %s to verify its capacity: %v", volumeID, err)
+		return nil
+	}
+
+	err = checkCapacityMatch(volumeID, recordedBytes, actualBytes)
+	if err == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	if device, exists := r.devices[volumeID]; exists && device.Capacity > actualBytes {
+		device.Capacity = actualBytes
+	}
+	r.mutex.Unlock()
+
+	return &csi.VolumeCondition{Abnormal: true, Message: err.Error()}
+}
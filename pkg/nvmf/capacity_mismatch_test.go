@@ -0,0 +1,228 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withFakeNullDevice links the namespace of every connected subsystem to
+// /dev/null, a device node present everywhere, and mocks its sysfs size and
+// rescan attributes. It returns the function setting the size of the device.
+func withFakeNullDevice(t *testing.T) func(size int64) {
+	t.Helper()
+	links := t.TempDir()
+	sysfs := t.TempDir()
+
+	savedPath, savedSysfs := namespaceDevicePath, sysfsBlockDir
+	namespaceDevicePath = func(nqn string, nsid uint32) (string, error) {
+		link := filepath.Join(links, fmt.Sprintf("nvme-fake-%s-%d", nqn, nsid))
+		if err := os.Symlink("/dev/null", link); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		return link, nil
+	}
+	sysfsBlockDir = sysfs
+	t.Cleanup(func() { namespaceDevicePath, sysfsBlockDir = savedPath, savedSysfs })
+
+	// The rescan attribute of the controller of device "null"
+	if err := os.MkdirAll(filepath.Join(sysfs, "c0null", "device"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sysfs, "c0null", "device", "rescan_controller"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sysfs, "null"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	return func(size int64) {
+		sectors := strconv.FormatInt(size/sysfsSectorSize, 10)
+		if err := os.WriteFile(filepath.Join(sysfs, "null", "size"), []byte(sectors), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckCapacityMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded int64
+		actual   int64
+		wantErr  bool
+	}{
+		{name: "matching device", recorded: 1 << 30, actual: 1 << 30},
+		{name: "grown device", recorded: 1 << 30, actual: 2 << 30},
+		{name: "shrunk device", recorded: 2 << 30, actual: 1 << 30, wantErr: true},
+		{name: "unknown recorded capacity", actual: 1 << 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkCapacityMatch(testVolumeNqn, test.recorded, test.actual)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("checkCapacityMatch error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrCapacityMismatch) {
+				t.Errorf("checkCapacityMatch error = %v, want ErrCapacityMismatch", err)
+			}
+		})
+	}
+}
+
+func TestRecordedVolumeBytes(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		want          int64
+	}{
+		{name: "used bytes", volumeContext: map[string]string{volumeContextUsedBytes: "1073741824", volumeContextDeviceCapacity: "2147483648"}, want: 1 << 30},
+		{name: "device capacity only", volumeContext: map[string]string{volumeContextDeviceCapacity: "2147483648"}, want: 2 << 30},
+		{name: "nothing recorded", volumeContext: map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := recordedVolumeBytes(test.volumeContext); got != test.want {
+				t.Errorf("recordedVolumeBytes = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetDeviceNameByVolumeID(t *testing.T) {
+	withFakeNullDevice(t)
+
+	tests := []struct {
+		name     string
+		volumeID string
+	}{
+		{name: "NQN", volumeID: testVolumeNqn},
+		{name: "NQN and NSID", volumeID: formatVolumeID(testVolumeNqn, 2)},
+		{name: "opaque", volumeID: encodeVolumeID(volumeIDFields{Nqn: testVolumeNqn, Nsid: 2, Transport: "tcp"})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := GetDeviceNameByVolumeID(test.volumeID)
+			if err != nil {
+				t.Fatalf("GetDeviceNameByVolumeID: %v", err)
+			}
+			if name != "null" {
+				t.Errorf("GetDeviceNameByVolumeID = %q, want the linked device %q", name, "null")
+			}
+		})
+	}
+}
+
+func TestNodeExpandVolumeCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded int64 // 0 if the volume was staged before the plugin started
+		size     int64
+		required int64
+		want     codes.Code
+	}{
+		{name: "matching device", recorded: 1 << 30, size: 2 << 30, required: 2 << 30, want: codes.OK},
+		{name: "device lags the request", recorded: 1 << 30, size: 1 << 30, required: 2 << 30, want: codes.OK},
+		{name: "shrunk device", recorded: 2 << 30, size: 1 << 30, required: 2 << 30, want: codes.OutOfRange},
+		{name: "no recorded size", size: 1 << 30, required: 2 << 30, want: codes.OK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setSize := withFakeNullDevice(t)
+			setSize(test.size)
+			n := newTestNodeServer(newFakeNvmeClient())
+			volumeID := formatVolumeID(testVolumeNqn, 1)
+			if test.recorded > 0 {
+				n.deviceSizes[volumeID] = test.recorded
+			}
+
+			resp, err := n.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:      volumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: test.required},
+			})
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("NodeExpandVolume code = %v, want %v: %v", got, test.want, err)
+			}
+
+			size, _ := n.deviceSize(volumeID)
+			if err != nil {
+				if size != test.recorded {
+					t.Errorf("recorded size = %d after a refused expansion, want %d kept", size, test.recorded)
+				}
+				return
+			}
+			if resp.CapacityBytes != test.size {
+				t.Errorf("CapacityBytes = %d, want the device size %d", resp.CapacityBytes, test.size)
+			}
+			if test.recorded > 0 && size != test.size {
+				t.Errorf("recorded size = %d, want %d", size, test.size)
+			}
+		})
+	}
+}
+
+func TestCapacityCondition(t *testing.T) {
+	tests := []struct {
+		name         string
+		volumeBytes  int64
+		actual       int64
+		wantAbnormal bool
+	}{
+		{name: "matching device", volumeBytes: 1 << 30, actual: 1 << 30},
+		{name: "shrunk device", volumeBytes: 2 << 30, actual: 1 << 30, wantAbnormal: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.probeDeviceCapacity = true
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.sizes["/dev/nvme0n1"] = test.actual
+			r := c.deviceRegistry
+			r.devices[testVolumeNqn] = &VolumeInfo{
+				nvmfDiskInfo: &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+				IsAllocated:  true,
+				Capacity:     test.volumeBytes,
+				VolumeBytes:  test.volumeBytes,
+			}
+
+			condition := r.capacityCondition(context.Background(), testVolumeNqn)
+			if abnormal := condition != nil && condition.Abnormal; abnormal != test.wantAbnormal {
+				t.Fatalf("capacityCondition = %v, want abnormal %v", condition, test.wantAbnormal)
+			}
+			if capacity := r.devices[testVolumeNqn].Capacity; capacity != test.actual {
+				t.Errorf("recorded device capacity = %d, want the actual %d", capacity, test.actual)
+			}
+			if client.disconnectCount() != 1 {
+				t.Errorf("disconnects = %d, want the probe connection released", client.disconnectCount())
+			}
+		})
+	}
+}
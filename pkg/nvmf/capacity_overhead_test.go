@@ -0,0 +1,235 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCapacityOverhead(t *testing.T) {
+	const deviceBytes = 10 << 30
+
+	tests := []struct {
+		name     string
+		overhead string
+		headroom string
+		required int64
+		want     codes.Code
+		// wantCapacity is the capacity reported by CreateVolume
+		wantCapacity int64
+		// wantAvailable is the capacity reported by GetCapacity, and by the dry
+		// run of a request that fits
+		wantAvailable int64
+	}{
+		{name: "no overhead", wantCapacity: UseActualDeviceCapacity, wantAvailable: deviceBytes},
+		{name: "overhead without a requested capacity", overhead: "10", wantCapacity: 9 << 30, wantAvailable: 9 << 30},
+		{name: "request within the net capacity", overhead: "10", required: 9 << 30, wantCapacity: 9 << 30, wantAvailable: 9 << 30},
+		{name: "request beyond the net capacity", overhead: "10", required: 9<<30 + 1, want: codes.ResourceExhausted, wantAvailable: 9 << 30},
+		{name: "request within the raw capacity only", overhead: "50", required: 6 << 30, want: codes.ResourceExhausted, wantAvailable: 5 << 30},
+		{name: "headroom reserved from the net capacity", overhead: "10", headroom: "10", required: 9 << 30, want: codes.ResourceExhausted, wantAvailable: deviceBytes * 9 / 10 * 9 / 10},
+		{name: "zero overhead", overhead: "0", required: deviceBytes, wantCapacity: deviceBytes, wantAvailable: deviceBytes},
+		{name: "overhead of the whole device", overhead: "100", want: codes.InvalidArgument},
+		{name: "negative overhead", overhead: "-1", want: codes.InvalidArgument},
+		{name: "overhead not an integer", overhead: "10%", want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.probeDeviceCapacity = true
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.sizes["/dev/nvme0n1"] = deviceBytes
+
+			extra := map[string]string{}
+			if test.overhead != "" {
+				extra[paramCapacityOverheadPercent] = test.overhead
+			}
+			if test.headroom != "" {
+				extra[paramReserveHeadroomPercent] = test.headroom
+			}
+			req := createRequest("pv-1", extra)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: test.required}
+
+			capacity, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: req.Parameters})
+			if test.want == codes.InvalidArgument {
+				if got := status.Code(err); got != test.want {
+					t.Errorf("GetCapacity code = %v, want %v: %v", got, test.want, err)
+				}
+			} else if err != nil {
+				t.Fatalf("GetCapacity: %v", err)
+			} else if capacity.GetAvailableCapacity() != test.wantAvailable || capacity.GetMaximumVolumeSize().GetValue() != test.wantAvailable {
+				t.Errorf("GetCapacity = %d available, %d maximum, want %d", capacity.GetAvailableCapacity(), capacity.GetMaximumVolumeSize().GetValue(), test.wantAvailable)
+			}
+
+			// The dry run applies the fit check of the request and reports the
+			// net capacity of the device discovered by GetCapacity
+			dryRun := createRequest("pv-1", map[string]string{paramDryRun: "true"})
+			for key, value := range extra {
+				dryRun.Parameters[key] = value
+			}
+			dryRun.CapacityRange = req.CapacityRange
+			_, err = c.CreateVolume(ctx, dryRun)
+			wantDryRun := test.want
+			if wantDryRun == codes.OK {
+				wantDryRun = dryRunFeasibleCode
+			}
+			if got := status.Code(err); got != wantDryRun {
+				t.Errorf("dry-run CreateVolume code = %v, want %v: %v", got, wantDryRun, err)
+			} else if wantBytes := fmt.Sprintf("of %d bytes", test.wantAvailable); test.want == codes.OK && !strings.Contains(status.Convert(err).Message(), wantBytes) {
+				t.Errorf("dry-run CreateVolume message %q, want the capacity %s", status.Convert(err).Message(), wantBytes)
+			}
+
+			resp, err := c.CreateVolume(ctx, req)
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err != nil {
+				if _, allocated := c.deviceRegistry.volumeToNQN["pv-1"]; allocated {
+					t.Error("pv-1 was allocated a device")
+				}
+				return
+			}
+			if got := resp.GetVolume().GetCapacityBytes(); got != test.wantCapacity {
+				t.Errorf("CreateVolume capacity = %d, want %d", got, test.wantCapacity)
+			}
+		})
+	}
+}
+
+func TestReserveHeadroom(t *testing.T) {
+	const deviceBytes = 10 << 30
+	ctx := context.Background()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.probeDeviceCapacity = true
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2, maintenanceNqn3)
+	for i := 0; i < 8; i++ {
+		client.sizes[fmt.Sprintf("/dev/nvme%dn1", i)] = deviceBytes
+	}
+	r := c.deviceRegistry
+	headroom := map[string]string{paramReserveHeadroomPercent: "20"}
+
+	// wantCapacity checks the capacity reported by GetCapacity, 80% of the
+	// capacity of each allocatable device
+	wantCapacity := func(stage string, want, wantMaximum int64) {
+		t.Helper()
+		capacity, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: createRequest("", headroom).Parameters})
+		if err != nil {
+			t.Fatalf("GetCapacity %s: %v", stage, err)
+		}
+		if capacity.GetAvailableCapacity() != want || capacity.GetMaximumVolumeSize().GetValue() != wantMaximum {
+			t.Errorf("GetCapacity %s = %d available, %d maximum, want %d and %d",
+				stage, capacity.GetAvailableCapacity(), capacity.GetMaximumVolumeSize().GetValue(), want, wantMaximum)
+		}
+	}
+	create := func(name string, required int64, want codes.Code) {
+		t.Helper()
+		req := createRequest(name, headroom)
+		req.CapacityRange = &csi.CapacityRange{RequiredBytes: required}
+		if _, err := c.CreateVolume(ctx, req); status.Code(err) != want {
+			t.Errorf("CreateVolume(%s, %d) code = %v, want %v: %v", name, required, status.Code(err), want, err)
+		}
+	}
+
+	wantCapacity("of three devices", 24<<30, 8<<30)
+
+	// Devices under maintenance are not allocatable, so not available
+	if _, err := r.EnterMaintenance(ctx, maintenanceNqn3, "replacement"); err != nil {
+		t.Fatalf("EnterMaintenance: %v", err)
+	}
+	wantCapacity("once a device is under maintenance", 16<<30, 8<<30)
+
+	// Requests up to the capacity less the headroom are allocated, beyond it
+	// they are rejected even though the device would hold them
+	create("pv-a", 8<<30, codes.OK)
+	wantCapacity("once a device is allocated", 8<<30, 8<<30)
+	create("pv-b", 8<<30+1, codes.ResourceExhausted)
+	create("pv-b", 8<<30, codes.OK)
+	wantCapacity("once all devices are allocated", 0, 0)
+	create("pv-c", 1, codes.ResourceExhausted)
+
+	// Nor are quarantined devices available
+	if _, err := r.ExitMaintenance(ctx, maintenanceNqn3); err != nil {
+		t.Fatalf("ExitMaintenance: %v", err)
+	}
+	wantCapacity("once the maintenance is over", 8<<30, 8<<30)
+	r.mutex.Lock()
+	r.devices[maintenanceNqn3].QuarantinedUntil = time.Now().Add(time.Hour)
+	r.mutex.Unlock()
+	wantCapacity("once a device is quarantined", 0, 0)
+}
+
+func TestReserveHeadroomWithoutProbe(t *testing.T) {
+	tests := []struct {
+		name     string
+		headroom string
+		// driverHeadroom is the headroom of the driver, overridden by the
+		// parameter if set
+		driverHeadroom int
+		want           codes.Code
+	}{
+		{name: "no headroom"},
+		{name: "headroom parameter", headroom: "20", want: codes.InvalidArgument},
+		{name: "driver headroom", driverHeadroom: 20, want: codes.InvalidArgument},
+		{name: "driver headroom disabled by the parameter", headroom: "0", driverHeadroom: 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.reserveHeadroomPercent = test.driverHeadroom
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+
+			extra := map[string]string{}
+			if test.headroom != "" {
+				extra[paramReserveHeadroomPercent] = test.headroom
+			}
+			req := createRequest("pv-1", extra)
+
+			// Without the probe the headroom could not be reserved, so it is
+			// refused rather than ignored
+			if _, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: req.Parameters}); status.Code(err) != test.want {
+				t.Errorf("GetCapacity code = %v, want %v: %v", status.Code(err), test.want, err)
+			}
+			if _, err := c.CreateVolume(ctx, req); status.Code(err) != test.want {
+				t.Errorf("CreateVolume code = %v, want %v: %v", status.Code(err), test.want, err)
+			}
+		})
+	}
+}
+
+func TestFitsUnprobedDevice(t *testing.T) {
+	device := &VolumeInfo{}
+	if !device.fits(&AllocationRequest{RequiredBytes: 1 << 30}) {
+		t.Error("unprobed device does not fit a request without headroom")
+	}
+	if device.fits(&AllocationRequest{RequiredBytes: 1 << 30, ReserveHeadroomPercent: 20}) {
+		t.Error("unprobed device fits a request with headroom")
+	}
+}
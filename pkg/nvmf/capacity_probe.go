@@ -0,0 +1,139 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// capacityProbeHostNqn is the host NQN the controller connects with to read the
+// size of devices. Targets restricting hosts must allow it.
+const capacityProbeHostNqn = "nqn.2014-08.org.nvmexpress:csi-nvmf:capacity-probe"
+
+// sysfsSectorSize is the unit of the size attribute of block devices
+const sysfsSectorSize = 512
+
+// probeCapacity reads the size of a newly discovered device and records it. A
+// subsystem already connected on this host is read in place, any other is
+// connected for the duration of the read. Devices whose size cannot be read are
+// marked capacity-unknown. The device is not registered yet, so the mutex is
+// not held while connecting.
+func (r *DeviceRegistry) probeCapacity(ctx context.Context, device *VolumeInfo) {
+	size, err := r.readDeviceSize(ctx, device)
+	if err != nil {
+		klog.Warningf("Failed to read the capacity of device %s, excluding it from sized requests: %v", device.volumeID(), err)
+		device.CapacityUnknown = true
+		return
+	}
+
+	registryLog.V(4).Infof("Device %s has a capacity of %d bytes", device.volumeID(), size)
+	device.Capacity = size
+	device.CapacityUnknown = false
+}
+
+func (r *DeviceRegistry) readDeviceSize(ctx context.Context, device *VolumeInfo) (int64, error) {
+	client := r.Driver.nvme
+
+	if controller, exists := findController(client, device.Nqn, ""); exists {
+		return namespaceSize(ctx, client, controller.Name, device.Nsid, r.Driver.nvmeCliTimeout)
+	}
+
+	connector := getNvmfConnector(device.nvmfDiskInfo, capacityProbeHostNqn, r.Driver.connectOptions())
+	devicePath, err := client.Connect(connector)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer func() {
+		if err := client.Disconnect(device.Nqn, capacityProbeHostNqn, r.Driver.nvmeCliTimeout); err != nil {
+			klog.Errorf("Failed to disconnect capacity probe of %s: %v", device.Nqn, err)
+		}
+	}()
+
+	return client.NamespaceSize(ctx, devicePath, r.Driver.nvmeCliTimeout)
+}
+
+// namespaceSize returns the size of namespace nsid of a controller, the first
+// namespace for a device backed by a whole subsystem
+func namespaceSize(ctx context.Context, client NvmeClient, controller string, nsid uint32, timeout time.Duration) (int64, error) {
+	devicePaths, err := client.ListNamespaces(controller, nsid)
+	if err != nil {
+		return 0, err
+	}
+	if len(devicePaths) == 0 {
+		return 0, fmt.Errorf("controller %s has no namespace %d", controller, nsid)
+	}
+
+	return client.NamespaceSize(ctx, devicePaths[0], timeout)
+}
+
+// readSysfsSize returns the size of a block device from its sysfs size attribute
+func readSysfsSize(devicePath string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(sysfsBlockDir, filepath.Base(devicePath), "size"))
+	if err != nil {
+		return 0, err
+	}
+
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size of %s: %v", devicePath, err)
+	}
+
+	return sectors * sysfsSectorSize, nil
+}
+
+// idNsOutput is the part of the nvme-cli id-ns JSON output that sizes a namespace
+type idNsOutput struct {
+	Nsze  *uint64 `json:"nsze"`
+	Flbas uint8   `json:"flbas"`
+	Lbafs []struct {
+		Ds uint8 `json:"ds"`
+	} `json:"lbafs"`
+}
+
+// parseIdNsSize returns the size in bytes of a namespace from the JSON output of
+// nvme id-ns, which is its block count times the block size of the formatted LBA format
+func parseIdNsSize(output []byte) (int64, error) {
+	var idNs idNsOutput
+	if err := json.Unmarshal(output, &idNs); err != nil {
+		return 0, fmt.Errorf("failed to parse id-ns output: %v", err)
+	}
+	if idNs.Nsze == nil {
+		return 0, fmt.Errorf("id-ns output has no namespace size")
+	}
+
+	// The format index is split over bits 0-3 and, beyond 16 formats, bits 5-6
+	format := int(idNs.Flbas&0x0f) | int(idNs.Flbas>>5&0x03)<<4
+	if format >= len(idNs.Lbafs) {
+		return 0, fmt.Errorf("id-ns output has no LBA format %d", format)
+	}
+
+	ds := idNs.Lbafs[format].Ds
+	if ds < 9 || ds > 32 {
+		return 0, fmt.Errorf("invalid LBA data size 2^%d of format %d", ds, format)
+	}
+
+	return int64(*idNs.Nsze << ds), nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseIdNsSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:   "512 byte blocks",
+			output: `{"nsze":2097152,"ncap":2097152,"nuse":0,"flbas":0,"lbafs":[{"ms":0,"ds":9,"rp":0}]}`,
+			want:   1 << 30,
+		},
+		{
+			name:   "4 KiB blocks of the second format",
+			output: `{"nsze":262144,"flbas":1,"lbafs":[{"ms":0,"ds":9,"rp":0},{"ms":0,"ds":12,"rp":0}]}`,
+			want:   1 << 30,
+		},
+		{
+			name:   "format index beyond 16 formats",
+			output: `{"nsze":1,"flbas":32,"lbafs":[{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":9},{"ds":12}]}`,
+			want:   4096,
+		},
+		{name: "no namespace size", output: `{"flbas":0,"lbafs":[{"ds":9}]}`, wantErr: true},
+		{name: "missing LBA format", output: `{"nsze":1,"flbas":2,"lbafs":[{"ds":9}]}`, wantErr: true},
+		{name: "invalid data size", output: `{"nsze":1,"flbas":0,"lbafs":[{"ds":0}]}`, wantErr: true},
+		{name: "not JSON", output: `nvme0n1: namespace size 1G`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseIdNsSize([]byte(test.output))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseIdNsSize error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseIdNsSize = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProbeCapacity(t *testing.T) {
+	tests := []struct {
+		name        string
+		recorded    int64 // capacity recorded before the probe
+		size        int64 // 0 if the namespace has no readable size
+		connectErr  error
+		wantKnown   bool
+		wantFitSize bool // whether a sized request fits the device
+	}{
+		{name: "size read", size: 1 << 30, wantKnown: true, wantFitSize: true},
+		{name: "connect fails", connectErr: errors.New("connection refused")},
+		{name: "size unreadable", recorded: 1 << 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			if test.size > 0 {
+				client.sizes["/dev/nvme0n1"] = test.size
+			}
+			if test.connectErr != nil {
+				client.connectErrs = []error{test.connectErr}
+			}
+			r := c.deviceRegistry
+			device := &VolumeInfo{
+				nvmfDiskInfo: &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+				Capacity:     test.recorded,
+			}
+
+			r.probeCapacity(context.Background(), device)
+			if device.CapacityUnknown == test.wantKnown {
+				t.Errorf("CapacityUnknown = %v, want %v", device.CapacityUnknown, !test.wantKnown)
+			}
+			if test.wantKnown && device.Capacity != test.size {
+				t.Errorf("Capacity = %d, want %d", device.Capacity, test.size)
+			}
+			if fits := device.fits(&AllocationRequest{RequiredBytes: 1 << 20}); fits != test.wantFitSize {
+				t.Errorf("sized request fits = %v, want %v", fits, test.wantFitSize)
+			}
+			if !device.fits(&AllocationRequest{}) {
+				t.Error("request without capacity does not fit")
+			}
+
+			r.devices[device.volumeID()] = device
+			statuses := r.DeviceStatuses()
+			if len(statuses) != 1 {
+				t.Fatalf("%d device statuses, want 1", len(statuses))
+			}
+			if statuses[0].CapacityKnown != test.wantKnown {
+				t.Errorf("CapacityKnown = %v, want %v", statuses[0].CapacityKnown, test.wantKnown)
+			}
+			if controllers, _ := client.ListSubsystems(); len(controllers) != 0 {
+				t.Errorf("%d probe connection(s) left behind", len(controllers))
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// rewatchInterval is the delay before a failed or closed watch of a ConfigMap
+// or of records is established again
+const rewatchInterval = 5 * time.Second
+
+// watchConfigMap loads the ConfigMap and calls apply with it, nil while it
+// does not exist, then calls apply with each of its changes until ctx is done.
+// The first load is done once watchConfigMap returns. The ConfigMap is loaded
+// again whenever the watch is closed, so that no change is missed, and on
+// failure the last applied version is kept.
+func watchConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name string, apply func(cm *corev1.ConfigMap)) {
+	resourceVersion, err := loadConfigMap(ctx, client, namespace, name, apply)
+
+	go func() {
+		for ctx.Err() == nil {
+			if err == nil {
+				err = followConfigMap(ctx, client, namespace, name, resourceVersion, apply)
+			}
+			if err != nil {
+				klog.Warningf("Failed to watch ConfigMap %s/%s, retrying in %v: %v", namespace, name, rewatchInterval, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(rewatchInterval):
+				}
+			}
+			resourceVersion, err = loadConfigMap(ctx, client, namespace, name, apply)
+		}
+	}()
+}
+
+// loadConfigMap calls apply with the current ConfigMap and returns its
+// resource version, the start of the watch of its changes
+func loadConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name string, apply func(cm *corev1.ConfigMap)) (string, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		apply(nil)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	apply(cm)
+	return cm.ResourceVersion, nil
+}
+
+// followConfigMap calls apply with each change of the ConfigMap after
+// resourceVersion until ctx is done or the API server closes the watch
+func followConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name, resourceVersion string, apply func(cm *corev1.ConfigMap)) error {
+	watcher, err := client.CoreV1().ConfigMaps(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for {
+		var change watch.Event
+		var open bool
+		select {
+		case <-ctx.Done():
+			return nil
+		case change, open = <-watcher.ResultChan():
+		}
+		if !open {
+			return nil
+		}
+
+		switch change.Type {
+		case watch.Added, watch.Modified:
+			if cm, ok := change.Object.(*corev1.ConfigMap); ok && cm.Name == name {
+				apply(cm)
+			}
+		case watch.Deleted:
+			if cm, ok := change.Object.(*corev1.ConfigMap); ok && cm.Name == name {
+				apply(nil)
+			}
+		case watch.Error:
+			return apierrors.FromObject(change.Object)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Connection tuning parameters passed through to the fabrics connect
+const (
+	paramKeepAliveTmo   = "keepAliveTmo"   // Keep-alive timeout in seconds
+	paramCtrlLossTmo    = "ctrlLossTmo"    // Seconds to keep reconnecting before the controller is removed
+	paramReconnectDelay = "reconnectDelay" // Seconds between reconnect attempts
+	paramNrIoQueues     = "nrIoQueues"     // Number of I/O queues
+)
+
+// connectTuningParams maps the tuning parameters to their connect option and the
+// smallest value the kernel accepts, in the order they are passed to connect
+var connectTuningParams = []struct {
+	param  string
+	option string
+	min    int
+}{
+	{paramKeepAliveTmo, "keep_alive_tmo", 0},
+	{paramCtrlLossTmo, "ctrl_loss_tmo", 0},
+	{paramReconnectDelay, "reconnect_delay", 1},
+	{paramNrIoQueues, "nr_io_queues", 1},
+}
+
+// onlineCPUCount returns the number of CPUs of the node usable by the driver
+var onlineCPUCount = runtime.NumCPU
+
+// withNodeIoQueues returns the connect options completed with one I/O queue per
+// online CPU, capped by maxQueues, unless the StorageClass sets the queue count.
+// A maxQueues of 0 leaves the queue count to the kernel.
+func withNodeIoQueues(options []string, maxQueues int) []string {
+	for _, option := range options {
+		if strings.HasPrefix(option, "nr_io_queues=") {
+			nvmeLog.V(4).Infof("Using %s set by the StorageClass", option)
+			return options
+		}
+	}
+	if maxQueues <= 0 {
+		return options
+	}
+
+	cpus := onlineCPUCount()
+	queues := cpus
+	if queues > maxQueues {
+		queues = maxQueues
+	}
+	klog.Infof("Using %d I/O queues for %d online CPUs (at most %d)", queues, cpus, maxQueues)
+
+	return append(append([]string{}, options...), fmt.Sprintf("nr_io_queues=%d", queues))
+}
+
+// parseConnectTuning validates the tuning parameters that are set and returns
+// them as fabrics connect options, e.g. "keep_alive_tmo=5"
+func parseConnectTuning(params map[string]string) ([]string, error) {
+	options := []string{}
+	for _, tuning := range connectTuningParams {
+		value, exists := params[tuning.param]
+		if !exists || value == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < tuning.min {
+			return nil, fmt.Errorf("%s must be an integer of at least %d, got: %q", tuning.param, tuning.min, value)
+		}
+		options = append(options, fmt.Sprintf("%s=%d", tuning.option, parsed))
+	}
+
+	return options, nil
+}
+
+// connectTuningValues returns the tuning parameters of fabrics connect options,
+// the inverse of parseConnectTuning
+func connectTuningValues(options []string) map[string]string {
+	values := map[string]string{}
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		for _, tuning := range connectTuningParams {
+			if tuning.option == name {
+				values[tuning.param] = value
+			}
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withOnlineCPUs makes the node report cpus online CPUs
+func withOnlineCPUs(t *testing.T, cpus int) {
+	t.Helper()
+	saved := onlineCPUCount
+	onlineCPUCount = func() int { return cpus }
+	t.Cleanup(func() { onlineCPUCount = saved })
+}
+
+func TestWithNodeIoQueues(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   []string
+		cpus      int
+		maxQueues int
+		want      []string
+	}{
+		{name: "fewer CPUs than the cap", cpus: 4, maxQueues: 8, want: []string{"nr_io_queues=4"}},
+		{name: "more CPUs than the cap", cpus: 64, maxQueues: 8, want: []string{"nr_io_queues=8"}},
+		{name: "kernel default", cpus: 64, maxQueues: 0, want: []string{}},
+		{name: "set by the StorageClass", options: []string{"nr_io_queues=16"}, cpus: 4, maxQueues: 8, want: []string{"nr_io_queues=16"}},
+		{name: "other tuning kept", options: []string{"keep_alive_tmo=5"}, cpus: 2, maxQueues: 8, want: []string{"keep_alive_tmo=5", "nr_io_queues=2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withOnlineCPUs(t, test.cpus)
+			options := append([]string{}, test.options...)
+			if got := withNodeIoQueues(options, test.maxQueues); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("withNodeIoQueues(%v, %d) = %v, want %v", test.options, test.maxQueues, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStageConnectsWithNodeIoQueues(t *testing.T) {
+	tests := []struct {
+		name      string
+		cpus      int
+		maxQueues int
+		nrQueues  string // set by the StorageClass
+		want      string
+	}{
+		{name: "online CPUs", cpus: 6, maxQueues: 16, want: "nr_io_queues=6"},
+		{name: "capped", cpus: 96, maxQueues: 16, want: "nr_io_queues=16"},
+		{name: "StorageClass override", cpus: 96, maxQueues: 16, nrQueues: "2", want: "nr_io_queues=2"},
+		{name: "kernel default", cpus: 96},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withOnlineCPUs(t, test.cpus)
+			client := newFakeNvmeClient()
+			// The stage stops after the connect, the connect command is recorded
+			client.connectErrs = []error{errors.New("connect failed")}
+			n := newTestNodeServer(client)
+			n.Driver.maxIoQueues = test.maxQueues
+			req := stageRequest(testVolumeNqn, t.TempDir())
+			if test.nrQueues != "" {
+				req.VolumeContext[paramNrIoQueues] = test.nrQueues
+			}
+
+			if _, err := n.NodeStageVolume(context.Background(), req); err == nil {
+				t.Fatal("NodeStageVolume succeeded, want the connect failure")
+			}
+			if client.connectCount() != 1 {
+				t.Fatalf("connects = %d, want 1", client.connectCount())
+			}
+			args := client.connects[0].connectArgString("192.0.2.10", "4420")
+			if test.want == "" {
+				if strings.Contains(args, "nr_io_queues") {
+					t.Errorf("connect %q sets the queue count, want the kernel default", args)
+				}
+				return
+			}
+			if !strings.Contains(args, ","+test.want) {
+				t.Errorf("connect %q, want %s", args, test.want)
+			}
+		})
+	}
+}
+
+func TestStageConnectsWithTuning(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		// want are the connect options, none if the parameters are invalid
+		want []string
+	}{
+		{name: "keep-alive timeout", params: map[string]string{paramKeepAliveTmo: "5"}, want: []string{"keep_alive_tmo=5"}},
+		{name: "controller loss timeout", params: map[string]string{paramCtrlLossTmo: "600"}, want: []string{"ctrl_loss_tmo=600"}},
+		{name: "reconnect delay", params: map[string]string{paramReconnectDelay: "2"}, want: []string{"reconnect_delay=2"}},
+		{name: "I/O queues", params: map[string]string{paramNrIoQueues: "8"}, want: []string{"nr_io_queues=8"}},
+		{
+			name:   "all tuned",
+			params: map[string]string{paramKeepAliveTmo: "0", paramCtrlLossTmo: "30", paramReconnectDelay: "10", paramNrIoQueues: "4"},
+			want:   []string{"keep_alive_tmo=0", "ctrl_loss_tmo=30", "reconnect_delay=10", "nr_io_queues=4"},
+		},
+		{name: "none tuned", want: []string{}},
+		{name: "negative keep-alive timeout", params: map[string]string{paramKeepAliveTmo: "-1"}},
+		{name: "malformed controller loss timeout", params: map[string]string{paramCtrlLossTmo: "10m"}},
+		{name: "no reconnect delay", params: map[string]string{paramReconnectDelay: "0"}},
+		{name: "no I/O queue", params: map[string]string{paramNrIoQueues: "0"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.nvme.(*fakeNvmeClient).discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client := newFakeNvmeClient()
+			// The stage stops after the connect, the connect command is recorded
+			client.connectErrs = []error{errors.New("connect failed")}
+			n := newTestNodeServer(client)
+
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", test.params))
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			for key, value := range test.params {
+				stage.VolumeContext[key] = value
+			}
+			if test.want == nil {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("CreateVolume code = %v, want InvalidArgument: %v", status.Code(err), err)
+				}
+				// The node rejects the parameters of a volume created before
+				// they were validated
+				if _, err := n.NodeStageVolume(ctx, stage); status.Code(err) != codes.InvalidArgument {
+					t.Errorf("NodeStageVolume code = %v, want InvalidArgument: %v", status.Code(err), err)
+				}
+				if client.connectCount() != 0 {
+					t.Errorf("connects = %d, want none", client.connectCount())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+
+			// The node is given the tuning in the volume context of the volume
+			stage.VolumeId = resp.GetVolume().GetVolumeId()
+			stage.VolumeContext = resp.GetVolume().GetVolumeContext()
+			if _, err := n.NodeStageVolume(ctx, stage); err == nil {
+				t.Fatal("NodeStageVolume succeeded, want the connect failure")
+			}
+			if client.connectCount() != 1 {
+				t.Fatalf("connects = %d, want 1", client.connectCount())
+			}
+			args := strings.Split(client.connects[0].connectArgString("192.0.2.10", "4420"), ",")
+			tuned := []string{}
+			for _, arg := range args {
+				name, _, _ := strings.Cut(arg, "=")
+				for _, tuning := range connectTuningParams {
+					if tuning.option == name {
+						tuned = append(tuned, arg)
+					}
+				}
+			}
+			if !reflect.DeepEqual(tuned, test.want) {
+				t.Errorf("connect %v tunes %v, want %v", args, tuned, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// maxReconnectBackoff caps the backoff between reconnects of a failed connection
+const maxReconnectBackoff = 5 * time.Minute
+
+// connectionHealth is the state of a connection found unhealthy by the monitor
+type connectionHealth struct {
+	nqn         string
+	reason      string    // Why the connection is unhealthy
+	attempts    int       // Reconnects attempted since it became unhealthy
+	lastError   error     // Error of the last reconnect, nil if none failed
+	nextAttempt time.Time // Earliest time of the next reconnect
+}
+
+// connectionMonitor watches the controllers of the connections staged on the
+// node. A connection whose controllers are all dead or being deleted, or which
+// lost its controllers, e.g. once the kernel gave up reconnecting after
+// ctrl_loss_tmo, is connected again. Reconnects of a connection back off
+// exponentially from the monitor interval up to maxReconnectBackoff.
+type connectionMonitor struct {
+	n        *NodeServer
+	interval time.Duration
+
+	mutex     sync.Mutex
+	unhealthy map[string]*connectionHealth // Indexed by connection key
+}
+
+func newConnectionMonitor(n *NodeServer, interval time.Duration) *connectionMonitor {
+	return &connectionMonitor{
+		n:         n,
+		interval:  interval,
+		unhealthy: map[string]*connectionHealth{},
+	}
+}
+
+// run checks the connections every interval, forever
+func (m *connectionMonitor) run() {
+	klog.Infof("Monitoring NVMe-oF connections every %v", m.interval)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.check(time.Now())
+	}
+}
+
+// monitoredConnection is a snapshot of a tracked connection
+type monitoredConnection struct {
+	nqn         string
+	hostNqn     string
+	stagingPath string
+	secrets     authSecrets
+}
+
+// check reconnects the unhealthy connections whose backoff expired by now
+func (m *connectionMonitor) check(now time.Time) {
+	connections := m.n.monitoredConnections()
+
+	m.mutex.Lock()
+	for key := range m.unhealthy {
+		if _, tracked := connections[key]; !tracked {
+			delete(m.unhealthy, key)
+		}
+	}
+	m.mutex.Unlock()
+	if len(connections) == 0 {
+		return
+	}
+
+	controllers, err := m.n.Driver.nvme.ListSubsystems()
+	if err != nil {
+		klog.Warningf("Connection monitor failed to list NVMe controllers: %v", err)
+		return
+	}
+
+	for key, conn := range connections {
+		reason := connectionFailure(conn, controllers)
+		if reason == "" {
+			m.markHealthy(key, conn)
+			continue
+		}
+		if !m.markUnhealthy(key, conn.nqn, reason, now) {
+			continue
+		}
+		m.reconnect(key, conn, now)
+	}
+}
+
+// connectionFailure returns why the controllers of conn are unhealthy, or an
+// empty string if one of them is live or recovering on its own
+func connectionFailure(conn *monitoredConnection, controllers []NvmeController) string {
+	states := []string{}
+	for _, controller := range controllers {
+		if controller.SubsysNqn != conn.nqn || controller.HostNqn != "" && controller.HostNqn != conn.hostNqn {
+			continue
+		}
+		if _, stuck := stuckControllerStates[controller.State]; !stuck {
+			return ""
+		}
+		states = append(states, fmt.Sprintf("%s %s", controller.Name, controller.State))
+	}
+
+	if len(states) == 0 {
+		return "no NVMe controller is connected"
+	}
+	return fmt.Sprintf("NVMe controllers are not recovering: %v", states)
+}
+
+// markHealthy forgets the failure of a connection that recovered
+func (m *connectionMonitor) markHealthy(key string, conn *monitoredConnection) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if health, exists := m.unhealthy[key]; exists {
+		klog.Infof("Connection of %s with host NQN %s is healthy again after %d reconnect(s)", conn.nqn, conn.hostNqn, health.attempts)
+		delete(m.unhealthy, key)
+	}
+}
+
+// markUnhealthy records the failure of a connection and reports whether its
+// reconnect is due by now
+func (m *connectionMonitor) markUnhealthy(key, nqn, reason string, now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	health, exists := m.unhealthy[key]
+	if !exists {
+		health = &connectionHealth{nqn: nqn, nextAttempt: now}
+		m.unhealthy[key] = health
+	}
+	health.reason = reason
+
+	return !now.Before(health.nextAttempt)
+}
+
+// reconnect connects the subsystem of conn again with the connector persisted
+// at its staging path. It is skipped while a request holds the connection lock,
+// the request either connects the subsystem itself or the next check retries.
+func (m *connectionMonitor) reconnect(key string, conn *monitoredConnection, now time.Time) {
+	n := m.n
+	if !n.nqnLocks.TryAcquire(connectionLockKey(conn.nqn)) {
+		nvmeLog.V(4).Infof("Operation in progress on %s, deferring its reconnect", conn.nqn)
+		return
+	}
+	defer n.nqnLocks.Release(connectionLockKey(conn.nqn))
+
+	connector, err := GetConnectorFromFile(connectorFilePath(conn.stagingPath))
+	if err == nil {
+		opts := n.Driver.connectOptions()
+		connector.Timeout = opts.Timeout
+		connector.ConnectRetries = opts.Retries
+		connector.ConnectRetryInterval = opts.RetryInterval
+		connector.DeviceWaitTimeout = opts.DeviceWait
+		connector.DeviceReady = opts.DeviceReady
+		conn.secrets.applyTo(connector)
+
+		klog.Warningf("Connection of %s with host NQN %s is unhealthy, reconnecting", conn.nqn, conn.hostNqn)
+		n.recoverStuckControllers(conn.nqn)
+		_, err = AttachDisk(n.Driver.nvme, connector.VolumeID, connector)
+	} else {
+		err = fmt.Errorf("failed to read connector of %s: %v", conn.stagingPath, err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	health, exists := m.unhealthy[key]
+	if !exists {
+		return
+	}
+	health.attempts++
+	health.lastError = err
+	if err != nil {
+		backoff := m.interval << uint(health.attempts-1)
+		if backoff <= 0 || backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+		health.nextAttempt = now.Add(backoff)
+		klog.Errorf("Reconnect %d of %s failed, retrying in %v: %v", health.attempts, conn.nqn, backoff, err)
+		return
+	}
+	// The connection is healthy once the next check finds a live controller
+	health.nextAttempt = now.Add(m.interval)
+	klog.Infof("Reconnected %s with host NQN %s", conn.nqn, conn.hostNqn)
+}
+
+// condition returns the failure of the connection of nqn, if it is unhealthy
+func (m *connectionMonitor) condition(nqn string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, health := range m.unhealthy {
+		if health.nqn != nqn {
+			continue
+		}
+		message := fmt.Sprintf("%s, %d reconnect(s) attempted", health.reason, health.attempts)
+		if health.lastError != nil {
+			message += fmt.Sprintf(", last failed: %v", health.lastError)
+		}
+		return message, true
+	}
+
+	return "", false
+}
+
+// monitoredConnections returns a snapshot of the tracked connections, indexed
+// by connection key, with one of their staging paths
+func (n *NodeServer) monitoredConnections() map[string]*monitoredConnection {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	connections := make(map[string]*monitoredConnection, len(n.connections))
+	for key, conn := range n.connections {
+		for stagingPath := range conn.stagingPaths {
+			connections[key] = &monitoredConnection{
+				nqn:         conn.nqn,
+				hostNqn:     conn.hostNqn,
+				stagingPath: stagingPath,
+				secrets:     conn.secrets,
+			}
+			break
+		}
+	}
+
+	return connections
+}
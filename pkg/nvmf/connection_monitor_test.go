@@ -0,0 +1,167 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// monitorStep sets the state of the controllers of the staged subsystem, then
+// checks the connections after elapsed intervals
+type monitorStep struct {
+	// state of the controllers, "" to keep them and "gone" to remove them
+	state   string
+	elapsed int
+	// wantConnects is the number of reconnects so far
+	wantConnects  int
+	wantUnhealthy bool
+	// wantMessage is part of the condition of an unhealthy connection
+	wantMessage string
+}
+
+func TestConnectionMonitor(t *testing.T) {
+	const interval = time.Minute
+
+	tests := []struct {
+		name       string
+		connectErr []error
+		// locked holds the connection lock during the checks
+		locked bool
+		steps  []monitorStep
+	}{
+		{
+			name:  "live controller",
+			steps: []monitorStep{{state: nvmeControllerLive}},
+		},
+		{
+			name:  "kernel reconnecting",
+			steps: []monitorStep{{state: "connecting"}, {state: "resetting", elapsed: 1}},
+		},
+		{
+			name: "dead controller",
+			steps: []monitorStep{
+				{state: "dead", wantConnects: 1, wantUnhealthy: true, wantMessage: "nvme0 dead"},
+				// The reconnected controller is live
+				{elapsed: 1, wantConnects: 1},
+			},
+		},
+		{
+			name: "controller lost",
+			steps: []monitorStep{
+				{state: "gone", wantConnects: 1, wantUnhealthy: true, wantMessage: "no NVMe controller is connected"},
+				{elapsed: 1, wantConnects: 1},
+			},
+		},
+		{
+			name:       "failing reconnects back off",
+			connectErr: []error{errors.New("connect failed"), errors.New("connect failed")},
+			steps: []monitorStep{
+				{state: "deleting", wantConnects: 1, wantUnhealthy: true, wantMessage: "1 reconnect(s) attempted, last failed: connect failed"},
+				{elapsed: 0, wantConnects: 1, wantUnhealthy: true},
+				{elapsed: 1, wantConnects: 2, wantUnhealthy: true, wantMessage: "2 reconnect(s) attempted, last failed: connect failed"},
+				// The second failure doubles the backoff
+				{elapsed: 2, wantConnects: 2, wantUnhealthy: true},
+				{elapsed: 3, wantConnects: 3, wantUnhealthy: true, wantMessage: "3 reconnect(s) attempted"},
+				{elapsed: 4, wantConnects: 3},
+			},
+		},
+		{
+			name:   "operation in progress",
+			locked: true,
+			steps: []monitorStep{
+				{state: "dead", wantUnhealthy: true, wantMessage: "0 reconnect(s) attempted"},
+				{elapsed: 1, wantUnhealthy: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+			volumeID := formatVolumeID(testVolumeNqn, 1)
+			stagingPath := stagingVolumePath(t.TempDir(), volumeID)
+			if err := os.MkdirAll(filepath.Dir(connectorFilePath(stagingPath)), 0750); err != nil {
+				t.Fatal(err)
+			}
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+			connector := getNvmfConnector(info, testNodeHostNqn, n.Driver.connectOptions())
+			if _, _, err := n.connectStage(volumeID, stagingPath, connector, false, authSecrets{}); err != nil {
+				t.Fatalf("connectStage: %v", err)
+			}
+			if err := persistConnectorFile(connector, connectorFilePath(stagingPath)); err != nil {
+				t.Fatal(err)
+			}
+			client.connectErrs = test.connectErr
+			if test.locked {
+				n.nqnLocks.Acquire(connectionLockKey(testVolumeNqn))
+				defer n.nqnLocks.Release(connectionLockKey(testVolumeNqn))
+			}
+
+			m := newConnectionMonitor(n, interval)
+			start := time.Now()
+			for i, step := range test.steps {
+				client.mutex.Lock()
+				switch step.state {
+				case "":
+				case "gone":
+					client.controllers = nil
+				default:
+					for j := range client.controllers {
+						client.controllers[j].State = step.state
+					}
+				}
+				client.mutex.Unlock()
+
+				m.check(start.Add(time.Duration(step.elapsed) * interval))
+
+				if got := client.connectCount() - 1; got != step.wantConnects {
+					t.Errorf("step %d: reconnects = %d, want %d", i, got, step.wantConnects)
+				}
+				message, unhealthy := m.condition(testVolumeNqn)
+				if unhealthy != step.wantUnhealthy {
+					t.Errorf("step %d: unhealthy = %t (%s), want %t", i, unhealthy, message, step.wantUnhealthy)
+				}
+				if !strings.Contains(message, step.wantMessage) {
+					t.Errorf("step %d: condition %q, want it to contain %q", i, message, step.wantMessage)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionMonitorForgetsUnstaged(t *testing.T) {
+	client := newFakeNvmeClient()
+	withFakeNamespaces(t, client)
+	n := newTestNodeServer(client)
+	m := newConnectionMonitor(n, time.Minute)
+	m.unhealthy["unstaged"] = &connectionHealth{nqn: testVolumeNqn, reason: "no NVMe controller is connected"}
+
+	m.check(time.Now())
+	if _, unhealthy := m.condition(testVolumeNqn); unhealthy {
+		t.Error("condition of an unstaged connection is still reported")
+	}
+	if got := client.connectCount(); got != 0 {
+		t.Errorf("connects = %d, want none for an unstaged connection", got)
+	}
+}
@@ -15,16 +15,24 @@ limitations under the License.
 */
 package nvmf
 
+import "time"
+
 const (
 	NVMF_NQN_SIZE = 223
 	SYS_NVMF      = "/sys/class/nvme"
 	RUN_NVMF      = "/run/nvmf"
+
+	// Parent of the kubelet staging paths of CSI volumes
+	KUBELET_CSI_DIR = "/var/lib/kubelet/plugins/kubernetes.io/csi"
+
+	NVMF_DISCOVERY_NQN = "nqn.2014-08.org.nvmexpress.discovery"
 )
 
 // Here erron
 const (
-	ENOENT = 1 /* No such file or directory */
-	EINVAL = 2 /* Invalid argument */
+	ENOENT    = 1 /* No such file or directory */
+	EINVAL    = 2 /* Invalid argument */
+	ETIMEDOUT = 3 /* Operation timed out */
 )
 
 const (
@@ -33,6 +41,48 @@ const (
 	DefaultDriverVersion     = "v1.0.0"
 
 	DefaultVolumeMapPath = "/var/lib/nvmf/volumes"
+	DefaultNamespace     = "kube-system"
+
+	DefaultShutdownGracePeriod  = 30 * time.Second
+	DefaultNvmeCliTimeout       = 30 * time.Second
+	DefaultConnectRetries       = 5
+	DefaultConnectRetryInterval = time.Second
+	DefaultDeviceWaitTimeout    = 10 * time.Second
+	DefaultGrantTimeout         = 30 * time.Second
+	DefaultDeadlineMargin       = 2 * time.Second
+	DefaultDeleteRetries        = 3
+	DefaultDeleteRetryInterval  = 500 * time.Millisecond
+
+	DefaultConnectionMonitorInterval = 30 * time.Second
+	DefaultHostAclInterval           = 5 * time.Minute
+	DefaultWarmPoolInterval          = time.Minute
+
+	// DefaultEtcdPrefix keeps the keys of versions without a prefix, so that
+	// upgrades find their records
+	DefaultEtcdPrefix = ""
+
+	DefaultCordonFile = "/var/lib/kubelet/plugins/csi.nvmf.com/cordoned"
+
+	DefaultNodeStateFile = "/var/lib/kubelet/plugins/csi.nvmf.com/node-state.json"
+
+	DefaultEphemeralDir       = "/var/lib/kubelet/plugins/csi.nvmf.com/ephemeral"
+	DefaultEphemeralNamespace = "csi-nvmf-ephemeral"
+
+	DefaultHostNqnFile = "/etc/nvme/hostnqn" // Read by nvme-cli when connecting
+
+	DefaultDiscoveryPort      = "8009" // Well-known port of NVMe-oF discovery controllers
+	DefaultDiscoveryTransport = "tcp"
+
+	DefaultMaxDiscoveryConcurrency = 8
+	DefaultDiscoveryCacheTTL       = 2 * time.Second
+
+	DefaultMDNSInterval = 30 * time.Second
+
+	DefaultVolumeLockTimeout = 5 * time.Second
+
+	DefaultLeaderElectionLeaseDuration = 15 * time.Second
+	DefaultLeaderElectionRenewDeadline = 10 * time.Second
+	DefaultLeaderElectionRetryPeriod   = 2 * time.Second
 )
 
 type GlobalConfig struct {
@@ -44,4 +94,136 @@ type GlobalConfig struct {
 	Version            string
 	IsControllerServer bool
 	LogLevel           string
+
+	Namespace             string // Namespace of driver-managed ConfigMaps
+	DeviceFilterConfigMap string // ConfigMap holding the device allow/deny lists
+	DeviceLabelsConfigMap string // ConfigMap holding the labels of devices by NQN or endpoint glob
+	ExportDeviceLabels    string // Comma-separated device labels recorded in the volume context
+
+	// Connection to the API server storing the driver records in etcd, all
+	// optional and overriding the kubeconfig or in-cluster configuration
+	KubeAPIEndpoints    string // Comma-separated API server URLs, the first reachable one is used
+	KubeAPICAFile       string // CA bundle verifying the API server
+	KubeAPICertFile     string // Client certificate
+	KubeAPIKeyFile      string // Key of the client certificate
+	KubeAPIUsername     string // Basic authentication user
+	KubeAPIPasswordFile string // File holding the basic authentication password
+
+	ReserveHeadroomPercent int // Default per-device capacity kept in reserve
+
+	Backend             string // Target-side integration: none or hook
+	BackendHook         string // Executable invoked by the hook backend
+	BackendCapabilities string // Comma-separated operations supported by the hook
+	HealthChecker       string // Source of the volume condition: sysfs or backend
+
+	Persistence     string // Record store: kubernetes, file or bolt
+	PersistencePath string // Directory of the file record store, or file of the bolt database
+
+	EtcdPrefix        string // Prefix of the record keys, isolating deployments sharing a store
+	EtcdPrefixMigrate bool   // Move the records stored without a prefix under EtcdPrefix at startup
+
+	ForceDeleteWithSnapshots bool // Allow deleting volumes that still have snapshots
+
+	DeleteRetries       int           // Retries of a DeleteVolume failing to persist the release
+	DeleteRetryInterval time.Duration // Initial backoff between delete retries, doubled each retry
+
+	VolumeIDFormat string // Format of the IDs of new volumes: nqn or opaque
+
+	ShutdownGracePeriod time.Duration // Time allowed for in-flight RPCs on shutdown
+
+	// Lease-based election of the controller replica serving the controller RPCs
+	LeaderElection              bool
+	LeaderElectionLeaseDuration time.Duration // Time a standby waits before taking over an unrenewed lease
+	LeaderElectionRenewDeadline time.Duration // Time the leader retries renewing before giving up the lease
+	LeaderElectionRetryPeriod   time.Duration // Interval between attempts to acquire or renew the lease
+
+	ReadinessAddress string // Address of a dedicated readiness server, empty to use the health port
+
+	NvmeCliTimeout time.Duration // Bound on each nvme discover, connect and disconnect
+
+	ConnectRetries       int           // Retries of a transiently failing nvme connect
+	ConnectRetryInterval time.Duration // Initial backoff between connect retries, doubled each retry
+
+	DeviceWaitTimeout   time.Duration // Wait for the namespace device node after a connect
+	DeviceReadyStrategy string        // How the wait detects the namespace device node appeared: sysfs-poll, udev-settle or inotify
+	GrantTimeout        time.Duration // Bound on granting or revoking the access of a node through the backend
+	DeadlineMargin      time.Duration // Time taken off request deadlines so that errors are returned before them
+
+	ConnectionMonitor         bool          // Reconnect staged connections whose controllers failed
+	ConnectionMonitorInterval time.Duration // Interval between checks of the staged connections
+
+	OrphanCleanup bool // Disconnect controllers not referenced by any staging path at startup
+
+	FsckOnStage bool // Check existing filesystems before mounting them at stage
+
+	CordonFile string // Marker file of a node cordoned for maintenance
+
+	NodeStateFile string // Staging references of the node's connections, restored at startup
+
+	EphemeralVolumes bool   // Serve CSI ephemeral inline volumes, claiming devices from the nodes
+	EphemeralDir     string // Staging entries and claims of the ephemeral volumes of the node
+
+	EphemeralNamespace string // Namespace of the ConfigMaps holding the claims of ephemeral volumes
+
+	VolumeContextKey string // Key source encrypting sensitive volume context fields, empty keeps them clear
+
+	HostNqnFile       string // Host NQN of the node, used by nvme-cli
+	HostNqnGeneration string // Scheme generating a missing host NQN: none, uuid or name
+	PublishHostNqn    bool   // Publish the host NQN in an annotation of the Node of the node
+
+	EmitEvents bool // Record Kubernetes events on PVCs for provisioning failures
+
+	AdminAddress   string // Address of the admin server, disabled if empty
+	AdminTokenFile string // Bearer token required by the admin requests changing state, refused if empty
+
+	// Self-test run on POST /selftest of the admin server, against a subsystem
+	// dedicated to it whose content it overwrites
+	SelfTest    bool
+	SelfTestNqn string
+
+	// Discovery service queried when the StorageClass sets no target address
+	DiscoveryAddress   string // Comma-separated addresses, disabled if empty
+	DiscoveryPort      string // Comma-separated ports
+	DiscoveryTransport string // tcp or rdma
+
+	MaxDiscoveryConcurrency int           // Endpoints queried at once by a discovery
+	DiscoveryCacheTTL       time.Duration // Time the devices found by a discovery are reused
+	AllocateRetry           bool          // Rediscover once before failing an allocation without a suitable device
+
+	MDNSDiscovery bool          // Learn discovery controllers advertised over mDNS
+	MDNSInterval  time.Duration // Interval between mDNS queries
+
+	VolumeLockTimeout time.Duration // Wait for a concurrent operation on a volume, 0 fails immediately
+
+	ReclaimRetention time.Duration // Quarantine of the devices of deleted volumes, 0 releases immediately
+	RecordRetention  time.Duration // Age of the allocation tombstones and superseded quarantine records removed by the record GC, 0 disables it
+	RecordGCInterval time.Duration // Interval between record GC runs
+	WipeOnDelete     bool          // Erase the devices of deleted volumes through the backend before release
+
+	MaxVolumesPerNode int64 // Volumes a node may stage, 0 is unlimited
+
+	MaxIoQueues int // Cap of the per-CPU I/O queue count, 0 uses the kernel default
+
+	ProbeDeviceCapacity bool // Connect newly discovered devices from the controller to read their size
+	VerifyDuplicateNqn  bool // Connect each endpoint of an NQN discovered on several to compare the subsystems
+
+	ReconcileInterval time.Duration // Interval between registry reconcile cycles, 0 disables them
+	HostAclInterval   time.Duration // Interval between reconciliations of the subsystem host allowlists, 0 disables them
+
+	// Per-component log verbosity, FollowGlobalVerbosity to follow -v
+	RegistryVerbosity int // Registry logs
+	NvmeVerbosity     int // nvme-cli and connection logs
+	EtcdVerbosity     int // Record store logs
+
+	Tracing bool // Export traces of the RPCs over OTLP/HTTP, configured by the OTEL_* environment variables
+
+	WarmPoolSize     int           // Free devices kept pre-formatted by the controller, 0 disables the warm pool
+	WarmPoolFsType   string        // Filesystem the warm pool formats free devices with
+	WarmPoolInterval time.Duration // Interval between warm pool refills
+
+	FreeDeviceLowWatermark string // Free devices, as a count or a percentage such as "10%", below which the controller alerts, empty disables it
+	FreeDeviceAlertWebhook string // URL posted a JSON alert when the free devices cross the low watermark, empty disables it
+
+	DefaultParameters map[string]string // StorageClass parameters applied unless a request sets them
+	StrictParameters  bool              // Reject unknown parameters instead of ignoring them
 }
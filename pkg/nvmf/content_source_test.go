@@ -0,0 +1,159 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeFromContentSource(t *testing.T) {
+	const deviceBytes = 10 << 30
+
+	tests := []struct {
+		name string
+		// probe probes the capacity of the devices, of deviceBytes
+		probe bool
+		// sourceParams and sourceBytes are those of the source volume
+		sourceParams map[string]string
+		sourceBytes  int64
+		// snapshotSize is the size of the snapshot taken of the source, which
+		// the volume is restored from unless 0
+		snapshotSize int64
+		required     int64
+		want         codes.Code
+		wantBytes    int64
+	}{
+		{name: "clone of a probed volume", probe: true, wantBytes: deviceBytes},
+		{name: "clone of a namespace", probe: true, sourceParams: map[string]string{paramNamespaces: "1,2"}, wantBytes: deviceBytes},
+		{name: "clone of a volume of a requested capacity", sourceBytes: 1 << 30, wantBytes: 1 << 30},
+		{name: "clone larger than its source", sourceBytes: 1 << 30, required: 2 << 30, wantBytes: 2 << 30},
+		{name: "clone smaller than its source", sourceBytes: 2 << 30, required: 1 << 30, want: codes.OutOfRange},
+		// Neither the device nor the volume tells the size of the data to copy
+		{name: "clone of a volume of unknown size", want: codes.FailedPrecondition},
+		{name: "restore of a snapshot", snapshotSize: 1 << 30, wantBytes: 1 << 30},
+		{name: "restore of a snapshot of a namespace", sourceParams: map[string]string{paramNamespaces: "1,2"}, snapshotSize: 1 << 30, wantBytes: 1 << 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend(BackendCapabilityClone, BackendCapabilitySnapshot)
+			backend.snapshotSize = test.snapshotSize
+			c, _ := newTestControllerServer(t, backend)
+			c.Driver.probeDeviceCapacity = test.probe
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2, maintenanceNqn3)
+			for i := 0; i < 8; i++ {
+				client.sizes[fmt.Sprintf("/dev/nvme%dn1", i)] = deviceBytes
+			}
+
+			sourceReq := createRequest("pv-source", test.sourceParams)
+			sourceReq.CapacityRange = &csi.CapacityRange{RequiredBytes: test.sourceBytes}
+			source, err := c.CreateVolume(ctx, sourceReq)
+			if err != nil {
+				t.Fatalf("CreateVolume(pv-source): %v", err)
+			}
+			sourceID := source.GetVolume().GetVolumeId()
+			contentSource := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID},
+			}}
+			snapshotID := ""
+			if test.snapshotSize > 0 {
+				snapshot, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: sourceID})
+				if err != nil {
+					t.Fatalf("CreateSnapshot: %v", err)
+				}
+				snapshotID = snapshot.GetSnapshot().GetSnapshotId()
+				contentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+				}}
+			}
+
+			req := createRequest("pv-target", test.sourceParams)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: test.required}
+			req.VolumeContentSource = contentSource
+			resp, err := c.CreateVolume(ctx, req)
+			if status.Code(err) != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", status.Code(err), test.want, err)
+			}
+			if err != nil {
+				if len(backend.copies) != 0 {
+					t.Errorf("backend copies = %+v, want none", backend.copies)
+				}
+				if _, allocated := c.deviceRegistry.volumeToNQN["pv-target"]; allocated {
+					t.Error("pv-target was allocated a device")
+				}
+				return
+			}
+			if got := resp.GetVolume().GetCapacityBytes(); got != test.wantBytes {
+				t.Errorf("CreateVolume capacity = %d, want %d", got, test.wantBytes)
+			}
+
+			// The backend copies from the namespace of the source into that of
+			// the target, each given as its subsystem and NSID
+			sourceNqn, sourceNsid := parseVolumeID(registryVolumeID(sourceID))
+			targetNqn, targetNsid := parseVolumeID(registryVolumeID(resp.GetVolume().GetVolumeId()))
+			want := namespaceCopy{source: namespaceRef{nqn: sourceNqn, nsid: sourceNsid}, target: namespaceRef{nqn: targetNqn, nsid: targetNsid}}
+			if snapshotID != "" {
+				want = namespaceCopy{snapshotID: snapshotID, target: want.target}
+			}
+			if len(backend.copies) != 1 || backend.copies[0] != want {
+				t.Fatalf("backend copies = %+v, want %+v", backend.copies, want)
+			}
+			if snapshotID == "" && sourceNqn == targetNqn && sourceNsid == targetNsid {
+				t.Errorf("volume cloned into its source %s", sourceID)
+			}
+			if wantNamespace := test.sourceParams[paramNamespaces] != ""; (sourceNsid != 0) != wantNamespace || (targetNsid != 0) != wantNamespace {
+				t.Errorf("copied from NSID %d into NSID %d, want namespaces %v", sourceNsid, targetNsid, wantNamespace)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeFromSnapshotOfUnknownSize(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeBackend(BackendCapabilityClone, BackendCapabilitySnapshot)
+	c, _ := newTestControllerServer(t, backend)
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2)
+	source, err := c.CreateVolume(ctx, createRequest("pv-source", nil))
+	if err != nil {
+		t.Fatalf("CreateVolume(pv-source): %v", err)
+	}
+	snapshot, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: source.GetVolume().GetVolumeId()})
+	if err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+
+	// The backend reported no size for the snapshot
+	req := createRequest("pv-target", nil)
+	req.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+		Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.GetSnapshot().GetSnapshotId()},
+	}}
+	if _, err := c.CreateVolume(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CreateVolume code = %v, want FailedPrecondition: %v", status.Code(err), err)
+	}
+	if len(backend.copies) != 0 {
+		t.Errorf("backend copies = %+v, want none", backend.copies)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// volumeContextSealed is the volume context key of the encrypted sensitive fields
+const volumeContextSealed = "sealedContext"
+
+// sealedContextVersion prefixes the sealed fields, for future formats
+const sealedContextVersion = "v1"
+
+// sensitiveContextKeys are the volume context fields encrypted when a key is
+// configured, the others stay clear
+var sensitiveContextKeys = []string{paramEndpoint, paramHostNqn}
+
+// Prefixes of the key sources of the volume context encryption
+const (
+	contextKeySourceFile = "file:" // File holding a 32-byte AES key, raw, hex or base64
+	contextKeySourceKMS  = "kms:"  // Executable wrapping and unwrapping data keys
+)
+
+// kmsTimeout bounds each invocation of the KMS executable
+const kmsTimeout = 10 * time.Second
+
+// keyWrapper encrypts the per-volume data keys with a key encryption key
+type keyWrapper interface {
+	wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// newKeyWrapper returns the wrapper of a key source, nil if source is empty
+func newKeyWrapper(source string) (keyWrapper, error) {
+	switch {
+	case source == "":
+		return nil, nil
+	case strings.HasPrefix(source, contextKeySourceFile):
+		key, err := readContextKey(strings.TrimPrefix(source, contextKeySourceFile))
+		if err != nil {
+			return nil, err
+		}
+		return &aeadKeyWrapper{key: key}, nil
+	case strings.HasPrefix(source, contextKeySourceKMS):
+		path := strings.TrimPrefix(source, contextKeySourceKMS)
+		if path == "" {
+			return nil, fmt.Errorf("key source %q has no KMS executable", source)
+		}
+		return &kmsKeyWrapper{path: path}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key source %q, must start with %s or %s", source, contextKeySourceFile, contextKeySourceKMS)
+}
+
+// readContextKey reads a 32-byte key stored raw, in hex or in base64
+func readContextKey(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume context key: %v", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("volume context key in %s is not 32 bytes, raw, hex or base64", file)
+}
+
+// aeadKeyWrapper wraps data keys with AES-256-GCM under a configured key
+type aeadKeyWrapper struct {
+	key []byte
+}
+
+func (w *aeadKeyWrapper) wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	return sealAEAD(w.key, dataKey, nil)
+}
+
+func (w *aeadKeyWrapper) unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	return openAEAD(w.key, wrapped, nil)
+}
+
+// kmsKeyWrapper wraps data keys through an executable talking to a KMS. It is
+// run with the operation, wrap or unwrap, as argument and reads and writes
+// {"key": "<base64>"} on stdin and stdout.
+type kmsKeyWrapper struct {
+	path string
+}
+
+type kmsMessage struct {
+	Key []byte `json:"key"`
+}
+
+func (w *kmsKeyWrapper) wrap(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return w.run(ctx, "wrap", dataKey)
+}
+
+func (w *kmsKeyWrapper) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return w.run(ctx, "unwrap", wrapped)
+}
+
+func (w *kmsKeyWrapper) run(ctx context.Context, operation string, key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, kmsTimeout)
+	defer cancel()
+
+	input, err := json.Marshal(kmsMessage{Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, w.path, operation)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	klog.V(4).Infof("Running KMS %s %s", w.path, operation)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("KMS %s failed: %v: %s", operation, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var output kmsMessage
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, fmt.Errorf("failed to decode KMS %s response: %v", operation, err)
+	}
+	if len(output.Key) == 0 {
+		return nil, fmt.Errorf("KMS %s returned no key", operation)
+	}
+
+	return output.Key, nil
+}
+
+// sealVolumeContext replaces the sensitive fields of the volume context of
+// volumeID with their encryption under a new data key, wrapped by the
+// configured key. The volume context is left clear if no key is configured.
+func (d *driver) sealVolumeContext(ctx context.Context, volumeID string, volumeContext map[string]string) error {
+	if d.contextKeys == nil {
+		return nil
+	}
+
+	sensitive := map[string]string{}
+	for _, key := range sensitiveContextKeys {
+		if value, exists := volumeContext[key]; exists {
+			sensitive[key] = value
+		}
+	}
+	if len(sensitive) == 0 {
+		return nil
+	}
+
+	plaintext, err := json.Marshal(sensitive)
+	if err != nil {
+		return err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate data key: %v", err)
+	}
+	// The volume ID is authenticated, so that sealed fields cannot be moved to another volume
+	ciphertext, err := sealAEAD(dataKey, plaintext, []byte(volumeID))
+	if err != nil {
+		return err
+	}
+	wrapped, err := d.contextKeys.wrap(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %v", err)
+	}
+
+	for key := range sensitive {
+		delete(volumeContext, key)
+	}
+	volumeContext[volumeContextSealed] = strings.Join([]string{
+		sealedContextVersion,
+		base64.StdEncoding.EncodeToString(wrapped),
+		base64.StdEncoding.EncodeToString(ciphertext),
+	}, ".")
+
+	return nil
+}
+
+// openVolumeContext returns the volume context of volumeID with its sealed
+// fields decrypted. A volume context without sealed fields is returned as is.
+func (d *driver) openVolumeContext(ctx context.Context, volumeID string, volumeContext map[string]string) (map[string]string, error) {
+	sealed, exists := volumeContext[volumeContextSealed]
+	if !exists {
+		return volumeContext, nil
+	}
+	if d.contextKeys == nil {
+		return nil, fmt.Errorf("volume context of %s is encrypted but no volume context key is configured", volumeID)
+	}
+
+	parts := strings.Split(sealed, ".")
+	if len(parts) != 3 || parts[0] != sealedContextVersion {
+		return nil, fmt.Errorf("unsupported sealed volume context of %s", volumeID)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key of %s: %v", volumeID, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealed fields of %s: %v", volumeID, err)
+	}
+
+	dataKey, err := d.contextKeys.unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of %s: %v", volumeID, err)
+	}
+	plaintext, err := openAEAD(dataKey, ciphertext, []byte(volumeID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt volume context of %s: %v", volumeID, err)
+	}
+	sensitive := map[string]string{}
+	if err := json.Unmarshal(plaintext, &sensitive); err != nil {
+		return nil, fmt.Errorf("invalid sealed fields of %s: %v", volumeID, err)
+	}
+
+	opened := make(map[string]string, len(volumeContext)+len(sensitive))
+	for key, value := range volumeContext {
+		if key != volumeContextSealed {
+			opened[key] = value
+		}
+	}
+	for key, value := range sensitive {
+		opened[key] = value
+	}
+
+	return opened, nil
+}
+
+// pvAttributes returns the volume context recorded in a PV, decrypted. The
+// sealed fields are left out if they cannot be decrypted.
+func (d *driver) pvAttributes(ctx context.Context, pv *corev1.PersistentVolume) map[string]string {
+	attributes := pv.Spec.CSI.VolumeAttributes
+	opened, err := d.openVolumeContext(ctx, pv.Spec.CSI.VolumeHandle, attributes)
+	if err != nil {
+		klog.Warningf("Ignoring the encrypted volume context of PV %s: %v", pv.Name, err)
+		return attributes
+	}
+
+	return opened
+}
+
+// sealAEAD encrypts plaintext with AES-GCM, prefixing the random nonce
+func sealAEAD(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAEAD decrypts the output of sealAEAD
+func openAEAD(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
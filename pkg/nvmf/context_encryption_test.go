@@ -0,0 +1,303 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sealedHostNqn = "nqn.2014-08.org.nvmexpress:uuid:11111111-2222-3333-4444-555555555555"
+
+// writeContextKey writes a new random key in the encoding to a file and
+// returns its key source
+func writeContextKey(t *testing.T, encoding string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	data := key
+	switch encoding {
+	case "hex":
+		data = []byte(hex.EncodeToString(key) + "\n")
+	case "base64":
+		data = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+	}
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return contextKeySourceFile + file
+}
+
+// writeKMS writes an executable KMS of the shell script and returns its key source
+func writeKMS(t *testing.T, script string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "kms")
+	if err := os.WriteFile(file, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return contextKeySourceKMS + file
+}
+
+// mustKeyWrapper returns the wrapper of the key source
+func mustKeyWrapper(t *testing.T, source string) keyWrapper {
+	t.Helper()
+	wrapper, err := newKeyWrapper(source)
+	if err != nil {
+		t.Fatalf("newKeyWrapper(%s): %v", source, err)
+	}
+	return wrapper
+}
+
+func TestNewKeyWrapper(t *testing.T) {
+	shortKey := filepath.Join(t.TempDir(), "short")
+	if err := os.WriteFile(shortKey, []byte(hex.EncodeToString(make([]byte, 16))+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		source  string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", source: "", wantNil: true},
+		{name: "raw key file", source: writeContextKey(t, "raw")},
+		{name: "hex key file", source: writeContextKey(t, "hex")},
+		{name: "base64 key file", source: writeContextKey(t, "base64")},
+		{name: "short key", source: contextKeySourceFile + shortKey, wantErr: true},
+		{name: "missing key file", source: contextKeySourceFile + filepath.Join(t.TempDir(), "missing"), wantErr: true},
+		{name: "KMS", source: writeKMS(t, "cat")},
+		{name: "KMS without executable", source: contextKeySourceKMS, wantErr: true},
+		{name: "unsupported source", source: "vault:secret/nvmf", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapper, err := newKeyWrapper(test.source)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newKeyWrapper(%s) error = %v, want error %v", test.source, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (wrapper == nil) != test.wantNil {
+				t.Fatalf("newKeyWrapper(%s) = %v, want nil %v", test.source, wrapper, test.wantNil)
+			}
+			if wrapper == nil {
+				return
+			}
+
+			dataKey := []byte("0123456789abcdef0123456789abcdef")
+			wrapped, err := wrapper.wrap(context.Background(), dataKey)
+			if err != nil {
+				t.Fatalf("wrap: %v", err)
+			}
+			unwrapped, err := wrapper.unwrap(context.Background(), wrapped)
+			if err != nil || !bytes.Equal(unwrapped, dataKey) {
+				t.Errorf("unwrap = %q, %v, want the data key back", unwrapped, err)
+			}
+		})
+	}
+}
+
+func TestKMSKeyWrapperFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{name: "KMS error", script: "echo 'permission denied' >&2; exit 1", wantErr: "permission denied"},
+		{name: "malformed response", script: "echo 'not json'", wantErr: "failed to decode"},
+		{name: "no key", script: "echo '{}'", wantErr: "returned no key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapper := mustKeyWrapper(t, writeKMS(t, test.script))
+			if _, err := wrapper.wrap(context.Background(), []byte("data key")); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("wrap error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVolumeContextEncryption(t *testing.T) {
+	controllerKey := writeContextKey(t, "hex")
+
+	tests := []struct {
+		name string
+		// controllerKey and nodeKey are the key sources of the controller and
+		// the node, empty if encryption is disabled
+		controllerKey string
+		nodeKey       string
+		// stageVolumeID stages the volume context under another volume ID
+		stageVolumeID string
+		// tamper modifies the volume context passed to the node
+		tamper      func(volumeContext map[string]string)
+		wantSealed  bool
+		wantDecrypt bool
+	}{
+		{name: "encryption disabled", wantDecrypt: true},
+		{name: "file key", controllerKey: controllerKey, nodeKey: controllerKey, wantSealed: true, wantDecrypt: true},
+		{name: "KMS", controllerKey: writeKMS(t, "cat"), nodeKey: writeKMS(t, "cat"), wantSealed: true, wantDecrypt: true},
+		{name: "clear context on a node with a key", nodeKey: controllerKey, wantDecrypt: true},
+		{name: "node without a key", controllerKey: controllerKey, wantSealed: true},
+		{name: "node with another key", controllerKey: controllerKey, nodeKey: writeContextKey(t, "raw"), wantSealed: true},
+		{name: "moved to another volume", controllerKey: controllerKey, nodeKey: controllerKey, stageVolumeID: "nqn.2024-01.io.example:volume-2", wantSealed: true},
+		{name: "unsupported format", controllerKey: controllerKey, nodeKey: controllerKey, wantSealed: true, tamper: func(volumeContext map[string]string) {
+			volumeContext[volumeContextSealed] = "v2" + strings.TrimPrefix(volumeContext[volumeContextSealed], sealedContextVersion)
+		}},
+		{name: "tampered fields", controllerKey: controllerKey, nodeKey: controllerKey, wantSealed: true, tamper: func(volumeContext map[string]string) {
+			parts := strings.Split(volumeContext[volumeContextSealed], ".")
+			ciphertext, _ := base64.StdEncoding.DecodeString(parts[2])
+			ciphertext[len(ciphertext)-1] ^= 1
+			parts[2] = base64.StdEncoding.EncodeToString(ciphertext)
+			volumeContext[volumeContextSealed] = strings.Join(parts, ".")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			if test.controllerKey != "" {
+				c.Driver.contextKeys = mustKeyWrapper(t, test.controllerKey)
+			}
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			addrs := []string{"192.0.2.10", "192.0.2.11"}
+			for _, addr := range addrs {
+				client.discovery[addr+":4420"] = discoveryPage(addr, "4420", testVolumeNqn)
+			}
+
+			resp, err := c.CreateVolume(context.Background(), createRequest("pv-1", map[string]string{
+				paramAddr:    strings.Join(addrs, ","),
+				paramHostNqn: sealedHostNqn,
+			}))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volumeContext := resp.GetVolume().GetVolumeContext()
+			_, sealed := volumeContext[volumeContextSealed]
+			if sealed != test.wantSealed {
+				t.Fatalf("volume context %v sealed = %v, want %v", volumeContext, sealed, test.wantSealed)
+			}
+			for _, key := range sensitiveContextKeys {
+				if _, clear := volumeContext[key]; clear == test.wantSealed {
+					t.Errorf("volume context field %s clear = %v, want %v", key, clear, !test.wantSealed)
+				}
+			}
+			if _, clear := volumeContext[paramType]; !clear {
+				t.Errorf("volume context %v lost the clear transport", volumeContext)
+			}
+			if test.tamper != nil {
+				test.tamper(volumeContext)
+			}
+
+			// The stage stops after the connect, the connect is recorded
+			nodeClient := newFakeNvmeClient()
+			nodeClient.connectErrs = []error{errors.New("connect failed")}
+			n := newTestNodeServer(nodeClient)
+			if test.nodeKey != "" {
+				n.Driver.contextKeys = mustKeyWrapper(t, test.nodeKey)
+			}
+			volumeID := resp.GetVolume().GetVolumeId()
+			if test.stageVolumeID != "" {
+				volumeID = test.stageVolumeID
+			}
+			req := stageRequest(volumeID, t.TempDir())
+			req.VolumeContext = volumeContext
+			if _, err := n.NodeStageVolume(context.Background(), req); err == nil {
+				t.Fatal("NodeStageVolume succeeded, want the connect to fail")
+			}
+
+			if !test.wantDecrypt {
+				if nodeClient.connectCount() != 0 {
+					t.Errorf("undecryptable volume context connected with %+v", nodeClient.connects)
+				}
+				return
+			}
+			if nodeClient.connectCount() != 1 {
+				t.Fatalf("connects = %d, want 1", nodeClient.connectCount())
+			}
+			connector := nodeClient.connects[0]
+			if want := []string{"192.0.2.10:4420", "192.0.2.11:4420"}; !reflect.DeepEqual(connector.TargetEndpoints, want) {
+				t.Errorf("connected through %v, want %v", connector.TargetEndpoints, want)
+			}
+			if connector.HostNqn != sealedHostNqn {
+				t.Errorf("connected with host NQN %q, want %q", connector.HostNqn, sealedHostNqn)
+			}
+		})
+	}
+}
+
+func TestSealedPVRestored(t *testing.T) {
+	ctx := context.Background()
+	key := writeContextKey(t, "base64")
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.contextKeys = mustKeyWrapper(t, key)
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	for _, addr := range []string{"192.0.2.10", "192.0.2.11"} {
+		client.discovery[addr+":4420"] = discoveryPage(addr, "4420", testVolumeNqn)
+	}
+	resp, err := c.CreateVolume(ctx, createRequest("pv-1", map[string]string{paramAddr: "192.0.2.10,192.0.2.11"}))
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		key           string
+		wantEndpoints []string
+	}{
+		{name: "with the key", key: key, wantEndpoints: []string{"192.0.2.10:4420", "192.0.2.11:4420"}},
+		{name: "without the key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The restarted controller reads the endpoints back from the PV
+			pv := driverPV("pv-1", resp.GetVolume().GetVolumeId(), resp.GetVolume().GetVolumeContext())
+			restarted, _ := newTestControllerServer(t, newFakeBackend(), pv)
+			if test.key != "" {
+				restarted.Driver.contextKeys = mustKeyWrapper(t, test.key)
+			}
+			r := restarted.deviceRegistry
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+
+			device, exists := r.devices[testVolumeNqn]
+			if !exists || !device.IsAllocated || r.volumeToNQN["pv-1"] != testVolumeNqn {
+				t.Fatalf("allocation of pv-1 was not restored: %+v", device)
+			}
+			if !reflect.DeepEqual(device.Endpoints, test.wantEndpoints) {
+				t.Errorf("restored endpoints = %v, want %v", device.Endpoints, test.wantEndpoints)
+			}
+		})
+	}
+}
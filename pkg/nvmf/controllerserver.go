@@ -18,21 +18,29 @@ package nvmf
 
 import (
 	"context"
+	"errors"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 )
 
 const (
 	UseActualDeviceCapacity int64 = 0 // Use the actual device capacity
+
+	initialSyncRetryInterval = 5 * time.Second
 )
 
 type ControllerServer struct {
 	Driver         *driver
 	deviceRegistry *DeviceRegistry
+	reconciler     *reconciler // nil if reconciliation is disabled
+	health         HealthChecker
 }
 
 // create controller server
@@ -41,6 +49,10 @@ func NewControllerServer(d *driver) *ControllerServer {
 		Driver:         d,
 		deviceRegistry: NewDeviceRegistry(d),
 	}
+	server.health = d.newHealthChecker(&registryHealthChecker{registry: server.deviceRegistry})
+	if d.reconcileInterval > 0 {
+		server.reconciler = newReconciler(server.deviceRegistry, d.reconcileInterval)
+	}
 
 	// Perform initial device discovery and etcd sync in the background
 	go server.initializeRegistry()
@@ -48,16 +60,65 @@ func NewControllerServer(d *driver) *ControllerServer {
 	return server
 }
 
-// initializeRegistry initializes the device registry with discovery and etcd sync
+// initializeRegistry initializes the device registry with discovery and etcd sync.
+// The sync is retried until it succeeds, since Probe reports not ready until then.
 func (c *ControllerServer) initializeRegistry() {
 	ctx := context.Background()
 
+	// The device filter and labels are loaded first, to apply from the first
+	// discovery, and kept up to date by standbys too
+	c.deviceRegistry.watchDeviceConfigMaps(ctx)
+
+	// A standby syncs once it leads, to load the allocations of the previous leader
+	if election := c.Driver.leaderElection; election != nil {
+		klog.Info("Waiting for leadership before syncing the device registry")
+		election.waitForLeadership()
+	}
+
+	// Records stored without a prefix must be moved before the sync loads them
+	if c.Driver.legacyMetadata != nil {
+		for {
+			err := c.migrateLegacyRecords(ctx)
+			if err == nil {
+				break
+			}
+			klog.Errorf("Record migration failed, retrying in %v: %v", initialSyncRetryInterval, err)
+			time.Sleep(initialSyncRetryInterval)
+		}
+	}
+
 	// Initial etcd sync - loads allocation data from persistent storage
-	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
-		klog.Errorf("Initial etcd sync failed: %v", err)
+	for {
+		err := c.deviceRegistry.EnsureInitialSync(ctx)
+		if err == nil {
+			break
+		}
+		klog.Errorf("Initial etcd sync failed, retrying in %v: %v", initialSyncRetryInterval, err)
+		time.Sleep(initialSyncRetryInterval)
 	}
 
 	klog.Info("Device registry initialization completed")
+
+	go c.deviceRegistry.watchMaintenance(ctx)
+
+	if c.Driver.reclaimRetention > 0 || c.Driver.wipeOnDelete {
+		go c.deviceRegistry.runReclaimLoop()
+	}
+	if c.Driver.recordRetention > 0 {
+		go c.deviceRegistry.runRecordGC(c.Driver.recordRetention, c.Driver.recordGCInterval)
+	}
+	c.deviceRegistry.reapplyQoS(context.Background())
+	if c.reconciler != nil {
+		go c.reconciler.run()
+	}
+	if manager, ok := c.Driver.hostAclManager(); ok && c.Driver.hostAclInterval > 0 {
+		hostAcls := newHostAclReconciler(c, manager, c.Driver.hostAclInterval)
+		hostAcls.reconcileOnce()
+		go hostAcls.run()
+	}
+	if c.Driver.warmPoolSize > 0 {
+		go newWarmPool(c.deviceRegistry, c.Driver.warmPoolSize, c.Driver.warmPoolFsType, c.Driver.warmPoolInterval).run()
+	}
 }
 
 // CreateVolume provisions a new volume
@@ -68,85 +129,402 @@ func (c *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	}
 
 	cap := req.GetVolumeCapabilities()
-	if !isValidVolumeCapabilities(cap) {
-		return nil, status.Error(codes.InvalidArgument, "volume Capabilities are invalid")
+	if err := c.Driver.validateVolumeCapabilities(cap); err != nil {
+		klog.Errorf("CreateVolume: invalid volume capabilities: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume capabilities: %v", err)
 	}
 
 	klog.V(4).Infof("CreateVolume called with name: %s", volumeName)
 
 	// Extract volume parameters
-	parameters := req.GetParameters()
-	if parameters == nil {
-		parameters = make(map[string]string)
+	params, err := c.Driver.parseVolumeParams(c.Driver.withDefaults(req.GetParameters()))
+	if err != nil {
+		klog.Errorf("CreateVolume: invalid parameters: %v", err)
+		return nil, err
+	}
+	for _, volCap := range cap {
+		if fsType := volCap.GetMount().GetFsType(); !isSupportedFsType(fsType) {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported fsType: %s", fsType)
+		}
 	}
 
 	// Ensure initial etcd sync has been done (non-blocking if already done)
 	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		if st := contextStatus(err); st != nil {
+			return nil, st
+		}
 		klog.Warningf("Failed to ensure etcd sync: %v", err)
 		// Continue anyway - not critical for operation
 	}
 
-	// Discover NVMe devices if needed
-	if err := c.deviceRegistry.DiscoverDevices(parameters); err != nil {
-		klog.Errorf("Failed to discover NVMe devices: %v", err)
-		return nil, status.Errorf(codes.Internal, "device discovery failed: %v", err)
+	headroomPercent, err := c.Driver.headroomPercent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discover NVMe devices if needed. A dry run discovers without registering
+	// the devices, and dynamic volumes are created on the discovered subsystems.
+	if !params.DryRun && params.ProvisioningMode != provisioningModeDynamic {
+		if err := c.deviceRegistry.DiscoverDevices(ctx, params); err != nil {
+			if st := contextStatus(err); st != nil {
+				return nil, st
+			}
+			return nil, c.discoveryError(ctx, params, err)
+		}
+	}
+
+	// A cloned volume must be able to hold the whole source
+	requiredBytes := req.GetCapacityRange().GetRequiredBytes()
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if limitBytes > 0 && requiredBytes > limitBytes {
+		return nil, status.Errorf(codes.OutOfRange, "required capacity %d exceeds limit %d", requiredBytes, limitBytes)
+	}
+	contentSource := req.GetVolumeContentSource()
+	if contentSource != nil {
+		sourceBytes, err := c.getContentSourceSize(ctx, contentSource)
+		if err != nil {
+			return nil, err
+		}
+		if requiredBytes != 0 && requiredBytes < sourceBytes {
+			return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than source size %d", requiredBytes, sourceBytes)
+		}
+		if sourceBytes > requiredBytes {
+			requiredBytes = sourceBytes
+		}
+	}
+
+	if err := c.checkQoS(params); err != nil {
+		return nil, err
+	}
+	if err := c.checkHostAcl(params); err != nil {
+		return nil, err
+	}
+	if err := c.checkProvisioningMode(params); err != nil {
+		return nil, err
+	}
+
+	if params.DryRun {
+		return c.dryRunCreateVolume(ctx, params, &AllocationRequest{
+			VolumeName:              volumeName,
+			RequiredBytes:           requiredBytes,
+			LimitBytes:              limitBytes,
+			Placement:               params.Placement,
+			PinnedID:                params.PinnedNqn,
+			FsType:                  requestedFsType(cap, params),
+			MkfsOptions:             params.MkfsOptions,
+			ReserveHeadroomPercent:  headroomPercent,
+			CapacityOverheadPercent: params.CapacityOverheadPercent,
+		})
 	}
 
 	// Acquire volume lock to prevent concurrent operations
-	if acquired := c.Driver.volumeLocks.TryAcquire(volumeName); !acquired {
-		return nil, status.Errorf(codes.Aborted, "concurrent operation in progress for volume: %s", volumeName)
+	if err := c.Driver.acquireLock(ctx, volumeName, "volume", volumeName); err != nil {
+		return nil, err
 	}
 	defer c.Driver.volumeLocks.Release(volumeName)
 
 	// Allocate a device
-	allocatedDevice, err := c.deviceRegistry.AllocateDevice(volumeName)
+	allocationReq := &AllocationRequest{
+		VolumeName:              volumeName,
+		RequiredBytes:           requiredBytes,
+		LimitBytes:              limitBytes,
+		SkipWipe:                params.SkipWipe,
+		Placement:               params.Placement,
+		PinnedID:                params.PinnedNqn,
+		QoS:                     params.QoS,
+		AllowedHosts:            params.AllowedHosts,
+		FsType:                  requestedFsType(cap, params),
+		MkfsOptions:             params.MkfsOptions,
+		ReserveHeadroomPercent:  headroomPercent,
+		CapacityOverheadPercent: params.CapacityOverheadPercent,
+	}
+	// A retried request gets the volume its first attempt created, which is
+	// neither populated again nor released if the retry fails
+	dynamic := params.ProvisioningMode == provisioningModeDynamic
+	allocatedDevice, err := c.deviceRegistry.ExistingAllocation(allocationReq, dynamic)
 	if err != nil {
-		klog.Errorf("Failed to allocate device for volume %s: %v", volumeName, err)
-		return nil, status.Errorf(codes.ResourceExhausted, "no suitable device available: %v", err)
+		return nil, registryStatus(err)
+	}
+	existing := allocatedDevice != nil
+	switch {
+	case existing:
+		klog.Infof("CreateVolume for %s retried, returning its device %s", volumeName, allocatedDevice.volumeID())
+	case dynamic:
+		allocatedDevice, err = c.provisionNamespace(ctx, params, allocationReq)
+	default:
+		allocatedDevice, err = c.allocatePoolDevice(ctx, params, allocationReq)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rollback := func() {
+		if !existing {
+			c.rollbackAllocation(allocatedDevice)
+		}
 	}
 
-	volumeContext := map[string]string{
-		paramType: allocatedDevice.Transport,
+	if contentSource != nil && !existing {
+		if err := c.populateVolume(ctx, contentSource, allocatedDevice.volumeID()); err != nil {
+			klog.Errorf("Failed to populate volume %s from content source: %v", volumeName, err)
+			rollback()
+			if st := contextStatus(ctx.Err()); st != nil {
+				return nil, st
+			}
+			return nil, status.Errorf(codes.Internal, "failed to populate volume from content source: %v", err)
+		}
 	}
 
-	if len(allocatedDevice.Endpoints) > 1 {
-		endpointPairs := []string{}
-		endpointPairs = append(endpointPairs, allocatedDevice.Endpoints...)
+	if err := c.applyQoS(ctx, allocatedDevice, params.QoS); err != nil {
+		klog.Errorf("Failed to apply QoS to volume %s: %v", volumeName, err)
+		rollback()
+		if st := contextStatus(ctx.Err()); st != nil {
+			return nil, st
+		}
+		return nil, status.Errorf(codes.Internal, "failed to apply QoS limits: %v", err)
+	}
+
+	if err := c.applyHostAcl(ctx, allocatedDevice); err != nil {
+		klog.Errorf("Failed to apply the host allowlist of volume %s: %v", volumeName, err)
+		rollback()
+		if st := contextStatus(ctx.Err()); st != nil {
+			return nil, st
+		}
+		return nil, status.Errorf(codes.Internal, "failed to apply host allowlist: %v", err)
+	}
+
+	// The provisioner abandoned the request, it will not record the volume
+	if st := contextStatus(ctx.Err()); st != nil {
+		klog.Warningf("CreateVolume for %s cancelled, releasing device %s", volumeName, allocatedDevice.volumeID())
+		rollback()
+		return nil, st
+	}
+
+	volumeContext := params.volumeContext()
+	volumeContext[paramType] = allocatedDevice.Transport
+	volumeContext[volumeContextUsedBytes] = strconv.FormatInt(allocatedDevice.UsedBytes, 10)
+	if allocatedDevice.Capacity > 0 {
+		volumeContext[volumeContextDeviceCapacity] = strconv.FormatInt(allocatedDevice.Capacity, 10)
+	}
+	if params.SkipWipe {
+		volumeContext[paramSkipWipe] = "true"
+	}
+	for key, value := range c.Driver.exportedLabels(allocatedDevice.Labels) {
+		volumeContext[key] = value
+	}
+
+	// The node connects through the endpoints of the context, even a single one
+	if len(allocatedDevice.Endpoints) > 0 {
+		endpointPairs := prioritizedEndpoints(allocatedDevice.Endpoints, params.EndpointPriorities)
 
 		volumeContext[paramEndpoint] = strings.Join(endpointPairs, ",")
 	}
 
+	volumeID := c.Driver.externalVolumeID(allocatedDevice.nvmfDiskInfo)
+	if err := c.Driver.sealVolumeContext(ctx, volumeID, volumeContext); err != nil {
+		klog.Errorf("Failed to encrypt volume context of %s: %v", volumeName, err)
+		rollback()
+		if st := contextStatus(ctx.Err()); st != nil {
+			return nil, st
+		}
+		return nil, status.Errorf(codes.Internal, "failed to encrypt volume context: %v", err)
+	}
+
+	// Without a requested capacity the PV will use the actual capacity, less
+	// the overhead if the capacity is known
+	capacityBytes := UseActualDeviceCapacity
+	if allocatedDevice.VolumeBytes > 0 {
+		capacityBytes = allocatedDevice.VolumeBytes
+	} else if allocatedDevice.Capacity > 0 && params.CapacityOverheadPercent > 0 {
+		capacityBytes = allocatedDevice.netCapacity(params.CapacityOverheadPercent)
+	}
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      allocatedDevice.Nqn,
-			CapacityBytes: UseActualDeviceCapacity, // PV will use the actual capacity
+			VolumeId:      volumeID,
+			CapacityBytes: capacityBytes,
 			VolumeContext: volumeContext,
 			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
 
+// allocatePoolDevice allocates a free device of the pre-created pool to the
+// volume of the request, discovering again if none suits it
+func (c *ControllerServer) allocatePoolDevice(ctx context.Context, params *VolumeParams, allocationReq *AllocationRequest) (*VolumeInfo, error) {
+	allocatedDevice, err := c.deviceRegistry.AllocateDevice(ctx, allocationReq)
+	// A pinned device missing from a reused discovery may have been added since
+	if errors.Is(err, ErrDeviceNotFound) && allocationReq.PinnedID != "" {
+		klog.V(4).Infof("Pinned device %s of volume %s is not registered, discovering again", allocationReq.PinnedID, allocationReq.VolumeName)
+		if discoverErr := c.deviceRegistry.RediscoverDevices(ctx, params); discoverErr == nil {
+			allocatedDevice, err = c.deviceRegistry.AllocateDevice(ctx, allocationReq)
+		} else {
+			klog.Warningf("Rediscovery for pinned device %s failed: %v", allocationReq.PinnedID, discoverErr)
+		}
+	}
+	// A device may have appeared on the targets since a reused discovery
+	if errors.Is(err, ErrNoSuitableDevice) && c.Driver.allocateRetry {
+		klog.V(4).Infof("No suitable device for volume %s, discovering again before retrying", allocationReq.VolumeName)
+		if discoverErr := c.deviceRegistry.RediscoverDevices(ctx, params); discoverErr == nil {
+			allocatedDevice, err = c.deviceRegistry.AllocateDevice(ctx, allocationReq)
+		} else if st := contextStatus(discoverErr); st != nil {
+			// The request ran out of time, not the targets out of devices
+			return nil, st
+		} else {
+			klog.Warningf("Rediscovery for volume %s failed: %v", allocationReq.VolumeName, discoverErr)
+		}
+	}
+	if err != nil {
+		if st := contextStatus(err); st != nil {
+			return nil, st
+		}
+		klog.Errorf("Failed to allocate device for volume %s: %v", allocationReq.VolumeName, err)
+		if errors.Is(err, ErrNoSuitableDevice) {
+			if c.deviceRegistry.FreeDeviceCount() == 0 {
+				c.Driver.events.warnPVC(ctx, params, eventReasonPoolExhausted,
+					"No free %s device left for %d bytes, all discovered devices are allocated", params.Transport, allocationReq.RequiredBytes)
+			} else {
+				c.Driver.events.warnPVC(ctx, params, eventReasonAllocationFailed,
+					"No free %s device can hold %d bytes with %d%% headroom: %v", params.Transport, allocationReq.RequiredBytes, allocationReq.ReserveHeadroomPercent, err)
+			}
+		}
+		return nil, registryStatus(err)
+	}
+
+	return allocatedDevice, nil
+}
+
+// dryRunFeasibleCode is the code of a dry-run CreateVolume that would
+// succeed, its message naming the device that would be allocated. A dry run
+// never returns a volume, which the external-provisioner would turn into a PV
+// of nothing; through the provisioner it only fails and is retried.
+const dryRunFeasibleCode = codes.Aborted
+
+// dryRunCreateVolume reports the device CreateVolume would allocate. The
+// report is an error of dryRunFeasibleCode rather than a response, so that no
+// volume ID is ever returned for a volume that was not allocated.
+func (c *ControllerServer) dryRunCreateVolume(ctx context.Context, params *VolumeParams, req *AllocationRequest) (*csi.CreateVolumeResponse, error) {
+	candidate, err := c.deviceRegistry.DryRunAllocate(ctx, params, req)
+	if err != nil {
+		var discoveryErr *DiscoveryError
+		if errors.As(err, &discoveryErr) {
+			return nil, c.discoveryError(ctx, params, err)
+		}
+		klog.V(4).Infof("Dry run for volume %s found no device: %v", req.VolumeName, err)
+		return nil, registryStatus(err)
+	}
+
+	klog.V(4).Infof("Dry run for volume %s would allocate %s", req.VolumeName, candidate.volumeID())
+
+	return nil, status.Errorf(dryRunFeasibleCode, "dry run: volume %s would be allocated %s of %d bytes, %s at %s",
+		req.VolumeName, candidate.volumeID(), candidate.netCapacity(req.CapacityOverheadPercent),
+		candidate.Transport, strings.Join(prioritizedEndpoints(candidate.Endpoints, params.EndpointPriorities), ","))
+}
+
+// contextStatus maps the error of a done request context to the status returned
+// to the CO, or returns nil for any other error
+func contextStatus(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request cancelled")
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "request deadline exceeded")
+	}
+	return nil
+}
+
+// discoveryError records a discovery failure and maps it to the status returned to the CO
+func (c *ControllerServer) discoveryError(ctx context.Context, params *VolumeParams, err error) error {
+	klog.Errorf("Failed to discover NVMe devices: %v", err)
+	c.Driver.events.warnPVC(ctx, params, eventReasonDiscoveryFailed,
+		"Discovery of %s targets at %s:%s failed: %v", params.Transport, params.TargetAddr, params.TargetPort, err)
+
+	return registryStatus(err)
+}
+
+// registryStatus maps an error of the device registry to the status returned to
+// the CO, so that the sidecars retry failures appropriately
+func registryStatus(err error) error {
+	if st := contextStatus(err); st != nil {
+		return st
+	}
+
+	var timeoutErr *TimeoutError
+	switch {
+	case errors.As(err, &timeoutErr):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, ErrNoSuitableDevice):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, ErrOutOfRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, ErrAlreadyAllocated):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrDeviceNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrDeviceNotFree):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrEtcdUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
 // DeleteVolume deletes a volume
 func (c *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	volumeID := req.GetVolumeId()
+	volumeID := registryVolumeID(req.GetVolumeId())
 	if !isValidVolumeID(volumeID) {
 		return nil, status.Error(codes.InvalidArgument, "volume ID must be provided")
 	}
+	if !isValidVolumeNQN(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "DeleteVolume Volume ID %s is not a valid NQN", volumeID)
+	}
 
 	klog.V(4).Infof("DeleteVolume called for volume ID %s", volumeID)
 
 	// Acquire lock to prevent concurrent operations on this volume
-	if acquired := c.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
-		return nil, status.Errorf(codes.Aborted, "concurrent operation in progress for volume: %s", volumeID)
+	if err := c.Driver.acquireLock(ctx, volumeID, "volume", volumeID); err != nil {
+		return nil, err
 	}
 	defer c.Driver.volumeLocks.Release(volumeID)
 
-	// Find the volume by NQN
-	// Note: volumeID is expected to be in NQN (NVMe Qualified Name) format.
-	// This assumption is valid because in CreateVolume, we assigned the device's NQN
-	// as the volumeID when returning the CreateVolumeResponse.
-	nqn := volumeID
-	c.deviceRegistry.ReleaseDevice(nqn)
+	// Volumes with snapshots would leave the snapshots without a source
+	if _, ok := c.Driver.snapshotter(); ok && !c.Driver.forceDeleteWithSnapshots {
+		records, err := listSnapshotRecords(ctx, c.Driver.metadata)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to list snapshots of volume %s: %v", volumeID, err)
+		}
+		for _, record := range records {
+			if registryVolumeID(record.SourceVolumeID) == volumeID {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %s still has snapshot %s", volumeID, record.SnapshotID)
+			}
+		}
+	}
+
+	// Releasing before the allocations are restored would be undone by the sync
+	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		return nil, registryStatus(err)
+	}
+
+	// The hosts of the volume lose access before its device can be reused
+	if err := c.revokeHostAcl(ctx, volumeID); err != nil {
+		return nil, err
+	}
+
+	// The namespace of a dynamic volume is deleted rather than returned to the pool
+	if err := c.deleteDynamicNamespace(ctx, volumeID); err != nil {
+		return nil, err
+	}
+
+	// Find the volume by its ID
+	// Note: volumeID is expected to be the device's NQN, followed by the NSID for
+	// namespaces of shared subsystems, as assigned in the CreateVolumeResponse.
+	if err := c.reclaimWithRetry(ctx, volumeID); err != nil {
+		if !errors.Is(err, ErrDeviceNotFound) {
+			return nil, registryStatus(err)
+		}
+		// CSI spec requires idempotency: return success even if volume doesn't exist
+		// This allows safe retries and prevents errors when volume was already deleted
+		klog.Infof("Volume %s not found", volumeID)
+	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -155,17 +533,52 @@ func (c *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 	return nil, status.Errorf(codes.Unimplemented, "ControllerExpandVolume should implement by yourself")
 }
 
-func (c *ControllerServer) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ControllerGetVolume not implement")
+// ControllerGetVolume reports the nodes a volume is published to and its condition
+func (c *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := registryVolumeID(req.GetVolumeId())
+	if !isValidVolumeID(volumeID) {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
+	}
+
+	klog.V(4).Infof("ControllerGetVolume called for volume %s", volumeID)
+
+	device, exists := c.deviceRegistry.GetDeviceByNQN(volumeID)
+	if !exists || !device.IsAllocated {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found or not allocated", volumeID)
+	}
+	capacityBytes := device.VolumeBytes
+	if capacityBytes == 0 {
+		capacityBytes = device.Capacity
+	}
+
+	// A device smaller than the volume claims outweighs any other condition
+	condition := c.deviceRegistry.capacityCondition(ctx, volumeID)
+	if condition == nil {
+		condition = c.health.VolumeCondition(ctx, volumeID)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      req.GetVolumeId(),
+			CapacityBytes: capacityBytes,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: c.deviceRegistry.PublishedNodeIDs(volumeID),
+			VolumeCondition:  condition,
+		},
+	}, nil
 }
 
 // ControllerPublishVolume attaches the given volume to the node
 func (c *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	volumeID := req.GetVolumeId()
+	volumeID := registryVolumeID(req.GetVolumeId())
 	nodeID := req.GetNodeId()
 	if !isValidVolumeID(volumeID) {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
+	if !isValidVolumeNQN(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume Volume ID %s is not a valid NQN", volumeID)
+	}
 	if nodeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Node ID must be provided")
 	}
@@ -173,8 +586,8 @@ func (c *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 	klog.V(4).Infof("ControllerPublishVolume called for volume %s on node %s", volumeID, nodeID)
 
 	// Acquire lock for the volume
-	if acquired := c.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
-		return nil, status.Errorf(codes.Aborted, "concurrent operation in progress for volume: %s", volumeID)
+	if err := c.Driver.acquireLock(ctx, volumeID, "volume", volumeID); err != nil {
+		return nil, err
 	}
 	defer c.Driver.volumeLocks.Release(volumeID)
 
@@ -185,24 +598,37 @@ func (c *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 		return nil, status.Errorf(codes.NotFound, "volume %s not found or not allocated", volumeID)
 	}
 
+	publishContext := map[string]string{}
+	if granter, ok := c.Driver.granter(); ok {
+		granted, err := c.grantNodeAccess(ctx, granter, volumeID, nodeID)
+		if err != nil {
+			return nil, err
+		}
+		publishContext = granted
+	}
+	c.deviceRegistry.MarkPublished(nqn, nodeID)
+
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{},
+		PublishContext: publishContext,
 	}, nil
 }
 
 // ControllerUnpublishVolume detaches the given volume from the node
 func (c *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	volumeID := req.GetVolumeId()
+	volumeID := registryVolumeID(req.GetVolumeId())
 	nodeID := req.GetNodeId() // Used for logging, actual unpublish might not be node-specific at controller level
 	if !isValidVolumeID(volumeID) {
 		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID must be provided")
 	}
+	if !isValidVolumeNQN(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID %s is not a valid NQN", volumeID)
+	}
 
 	klog.V(4).Infof("ControllerUnpublishVolume called for volume %s from node %s", volumeID, nodeID)
 
 	// Acquire lock for the volume
-	if acquired := c.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
-		return nil, status.Errorf(codes.Aborted, "concurrent operation in progress for volume: %s", volumeID)
+	if err := c.Driver.acquireLock(ctx, volumeID, "volume", volumeID); err != nil {
+		return nil, err
 	}
 	defer c.Driver.volumeLocks.Release(volumeID)
 
@@ -212,20 +638,96 @@ func (c *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *c
 		klog.Warningf("ControllerUnpublishVolume: Volume %s not found. Assuming already unpublished or never existed. Returning success as per idempotency.", volumeID)
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
+	// The volume stays tracked as published to a node until its access is revoked
+	if granter, ok := c.Driver.granter(); ok {
+		// Without a node ID the volume is unpublished from every node
+		nodeIDs := []string{nodeID}
+		if nodeID == "" {
+			nodeIDs = c.deviceRegistry.publishedNodes(nqn)
+		}
+		for _, id := range nodeIDs {
+			if err := c.revokeNodeAccess(ctx, granter, volumeID, id); err != nil {
+				return nil, err
+			}
+			c.deviceRegistry.MarkUnpublished(nqn, id)
+		}
+	}
+	c.deviceRegistry.MarkUnpublished(nqn, nodeID)
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (c *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ValidateVolumeCapabilities not implement")
-}
+// ValidateVolumeCapabilities confirms the capabilities of an existing volume
+// unless CreateVolume would reject them
+func (c *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	volumeID := registryVolumeID(req.GetVolumeId())
+	if !isValidVolumeID(volumeID) {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume ID must be provided")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities must be provided")
+	}
+
+	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		return nil, registryStatus(err)
+	}
+	if device, exists := c.deviceRegistry.GetDeviceByNQN(volumeID); !exists || !device.IsAllocated {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+
+	if err := c.Driver.validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		klog.V(4).Infof("ValidateVolumeCapabilities: capabilities of volume %s are not supported: %v", volumeID, err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
 
-func (c *ControllerServer) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ListVolumes not implement")
+	if len(req.GetParameters()) > 0 {
+		params, err := c.Driver.parseVolumeParams(req.GetParameters())
+		if err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+		}
+		if drift := c.deviceRegistry.parameterDrift(volumeID, req.GetParameters(), params); len(drift) > 0 {
+			klog.Warningf("ValidateVolumeCapabilities: parameters of volume %s drifted since it was provisioned: %s", volumeID, strings.Join(drift, "; "))
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: "parameters differ from the provisioned volume: " + strings.Join(drift, "; ")}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
 }
 
-func (c *ControllerServer) GetCapacity(ctx context.Context, request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "GetCapacity not implement")
+// GetCapacity reports the usable capacity of unallocated devices after deducting
+// the overhead and reserving headroom
+func (c *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	params, err := c.Driver.parseVolumeParams(c.Driver.withDefaults(req.GetParameters()))
+	if err != nil {
+		return nil, err
+	}
+	headroomPercent, err := c.Driver.headroomPercent(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refresh the pool so capacity is reported before the first CreateVolume
+	if err := c.deviceRegistry.DiscoverDevices(ctx, params); err != nil {
+		if st := contextStatus(err); st != nil {
+			return nil, st
+		}
+		klog.Warningf("GetCapacity: device discovery failed, reporting known devices only: %v", err)
+	}
+
+	available, maximum := c.deviceRegistry.AvailableCapacity(headroomPercent, params.CapacityOverheadPercent)
+	klog.V(4).Infof("GetCapacity: available %d bytes, maximum volume size %d bytes (%d%% overhead, %d%% headroom)",
+		available, maximum, params.CapacityOverheadPercent, headroomPercent)
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: wrapperspb.Int64(maximum),
+	}, nil
 }
 
 func (c *ControllerServer) ControllerGetCapabilities(ctx context.Context, request *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -236,16 +738,231 @@ func (c *ControllerServer) ControllerGetCapabilities(ctx context.Context, reques
 	}, nil
 }
 
-func (c *ControllerServer) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "CreateSnapshot not implement")
+// CreateSnapshot takes a backend snapshot of the source volume's namespace
+func (c *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	snapshotter, ok := c.Driver.snapshotter()
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "backend %s does not support snapshots", c.Driver.backend.Name())
+	}
+
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name must be provided")
+	}
+	sourceVolumeID := registryVolumeID(req.GetSourceVolumeId())
+	if !isValidVolumeID(sourceVolumeID) {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
+	}
+	if !isValidVolumeNQN(sourceVolumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateSnapshot Source Volume ID %s is not a valid NQN", sourceVolumeID)
+	}
+
+	klog.V(4).Infof("CreateSnapshot called for snapshot %s of volume %s", name, sourceVolumeID)
+
+	snapshotID := snapshotIDFromName(name)
+	if err := c.Driver.acquireLock(ctx, snapshotID, "snapshot", name); err != nil {
+		return nil, err
+	}
+	defer c.Driver.volumeLocks.Release(snapshotID)
+
+	// A retried request with the same name returns the existing snapshot
+	existing := &snapshotRecord{}
+	found, err := c.Driver.metadata.Get(ctx, metadataKindSnapshot, snapshotID, existing)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to look up snapshot %s: %v", name, err)
+	}
+	if found {
+		if registryVolumeID(existing.SourceVolumeID) != sourceVolumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for a different source volume %s", name, existing.SourceVolumeID)
+		}
+		klog.V(4).Infof("CreateSnapshot: snapshot %s already exists with ID %s", name, snapshotID)
+		return &csi.CreateSnapshotResponse{Snapshot: existing.toCSI()}, nil
+	}
+
+	device, exists := c.deviceRegistry.GetDeviceByNQN(sourceVolumeID)
+	if !exists || !device.IsAllocated {
+		return nil, status.Errorf(codes.NotFound, "source volume %s not found or not allocated", sourceVolumeID)
+	}
+
+	// The backend addresses the namespace of the volume within its subsystem
+	nqn, nsid := parseVolumeID(sourceVolumeID)
+	backendSnapshot, err := snapshotter.CreateSnapshot(ctx, nqn, nsid, snapshotID)
+	if err != nil {
+		klog.Errorf("CreateSnapshot: backend failed to snapshot %s: %v", sourceVolumeID, err)
+		return nil, status.Errorf(codes.Internal, "failed to create snapshot %s: %v", name, err)
+	}
+
+	// The record keeps the source volume ID the CO knows, in either format
+	record := &snapshotRecord{
+		SnapshotID:     snapshotID,
+		Name:           name,
+		SourceVolumeID: req.GetSourceVolumeId(),
+		SizeBytes:      backendSnapshot.SizeBytes,
+		ReadyToUse:     backendSnapshot.ReadyToUse,
+		CreationTime:   time.Now(),
+	}
+	if err := c.Driver.metadata.Put(ctx, metadataKindSnapshot, snapshotID, record); err != nil {
+		klog.Errorf("CreateSnapshot: failed to persist snapshot %s: %v", snapshotID, err)
+		return nil, status.Errorf(codes.Unavailable, "failed to persist snapshot %s: %v", name, err)
+	}
+
+	klog.V(4).Infof("Created snapshot %s (ID %s) of volume %s", name, snapshotID, sourceVolumeID)
+	return &csi.CreateSnapshotResponse{Snapshot: record.toCSI()}, nil
+}
+
+// DeleteSnapshot removes the backend snapshot and its metadata
+func (c *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotter, ok := c.Driver.snapshotter()
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "backend %s does not support snapshots", c.Driver.backend.Name())
+	}
+
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
+	}
+
+	klog.V(4).Infof("DeleteSnapshot called for snapshot %s", snapshotID)
+
+	if err := c.Driver.acquireLock(ctx, snapshotID, "snapshot", snapshotID); err != nil {
+		return nil, err
+	}
+	defer c.Driver.volumeLocks.Release(snapshotID)
+
+	record := &snapshotRecord{}
+	found, err := c.Driver.metadata.Get(ctx, metadataKindSnapshot, snapshotID, record)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to look up snapshot %s: %v", snapshotID, err)
+	}
+	if !found {
+		klog.Warningf("DeleteSnapshot: snapshot %s not found. Assuming already deleted. Returning success as per idempotency.", snapshotID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if err := snapshotter.DeleteSnapshot(ctx, snapshotID); err != nil {
+		klog.Errorf("DeleteSnapshot: backend failed to delete snapshot %s: %v", snapshotID, err)
+		return nil, status.Errorf(codes.Internal, "failed to delete snapshot %s: %v", snapshotID, err)
+	}
+
+	if err := c.Driver.metadata.Delete(ctx, metadataKindSnapshot, snapshotID); err != nil {
+		klog.Errorf("DeleteSnapshot: failed to delete metadata of snapshot %s: %v", snapshotID, err)
+		return nil, status.Errorf(codes.Unavailable, "failed to delete metadata of snapshot %s: %v", snapshotID, err)
+	}
+
+	klog.V(4).Infof("Deleted snapshot %s", snapshotID)
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (c *ControllerServer) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "DeleteSnapshot not implement")
+// ListSnapshots enumerates persisted snapshots, optionally filtered by snapshot or source volume
+func (c *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if _, ok := c.Driver.snapshotter(); !ok {
+		return nil, status.Errorf(codes.Unimplemented, "backend %s does not support snapshots", c.Driver.backend.Name())
+	}
+
+	records, err := listSnapshotRecords(ctx, c.Driver.metadata)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to list snapshots: %v", err)
+	}
+
+	filtered := make([]*snapshotRecord, 0, len(records))
+	for _, record := range records {
+		if req.GetSnapshotId() != "" && record.SnapshotID != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && registryVolumeID(record.SourceVolumeID) != registryVolumeID(req.GetSourceVolumeId()) {
+			continue
+		}
+		filtered = append(filtered, record)
+	}
+
+	// The starting token is the index of the first entry to return
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(filtered) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token: %s", token)
+		}
+	}
+
+	end := len(filtered)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)
+	for _, record := range filtered[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: record.toCSI()})
+	}
+
+	nextToken := ""
+	if end < len(filtered) {
+		nextToken = strconv.Itoa(end)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
-func (c *ControllerServer) ListSnapshots(ctx context.Context, request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ListSnapshots not implement")
+// getContentSourceSize validates a clone or restore source and returns its size
+// in bytes. A source of unknown size is refused, as the target could not be
+// sized to hold it.
+func (c *ControllerServer) getContentSourceSize(ctx context.Context, source *csi.VolumeContentSource) (int64, error) {
+	if _, ok := c.Driver.cloner(); !ok {
+		return 0, status.Errorf(codes.InvalidArgument, "backend %s does not support volume content sources", c.Driver.backend.Name())
+	}
+
+	switch {
+	case source.GetVolume() != nil:
+		sourceVolumeID := registryVolumeID(source.GetVolume().GetVolumeId())
+		device, exists := c.deviceRegistry.GetDeviceByNQN(sourceVolumeID)
+		if !exists || !device.IsAllocated {
+			return 0, status.Errorf(codes.NotFound, "source volume %s not found", sourceVolumeID)
+		}
+		// The bytes the volume consumes are its whole device when probed, else
+		// its requested capacity, unknown if neither
+		if device.UsedBytes == 0 {
+			return 0, status.Errorf(codes.FailedPrecondition, "size of source volume %s is unknown, it requested no capacity and its device was not probed", sourceVolumeID)
+		}
+		return device.UsedBytes, nil
+
+	case source.GetSnapshot() != nil:
+		snapshotID := source.GetSnapshot().GetSnapshotId()
+		record := &snapshotRecord{}
+		found, err := c.Driver.metadata.Get(ctx, metadataKindSnapshot, snapshotID, record)
+		if err != nil {
+			return 0, status.Errorf(codes.Unavailable, "failed to look up snapshot %s: %v", snapshotID, err)
+		}
+		if !found {
+			return 0, status.Errorf(codes.NotFound, "source snapshot %s not found", snapshotID)
+		}
+		if record.SizeBytes == 0 {
+			return 0, status.Errorf(codes.FailedPrecondition, "size of source snapshot %s is unknown", snapshotID)
+		}
+		return record.SizeBytes, nil
+
+	default:
+		return 0, status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
+}
+
+// populateVolume copies the content source into the newly allocated target namespace
+func (c *ControllerServer) populateVolume(ctx context.Context, source *csi.VolumeContentSource, targetVolumeID string) error {
+	cloner, _ := c.Driver.cloner()
+	// The backend addresses the namespaces within their subsystems
+	targetNqn, targetNsid := parseVolumeID(targetVolumeID)
+
+	if volume := source.GetVolume(); volume != nil {
+		sourceVolumeID := registryVolumeID(volume.GetVolumeId())
+		klog.V(4).Infof("Cloning volume %s into %s", sourceVolumeID, targetVolumeID)
+		sourceNqn, sourceNsid := parseVolumeID(sourceVolumeID)
+		return cloner.CloneVolume(ctx, sourceNqn, sourceNsid, targetNqn, targetNsid)
+	}
+
+	snapshotID := source.GetSnapshot().GetSnapshotId()
+	klog.V(4).Infof("Restoring snapshot %s into %s", snapshotID, targetVolumeID)
+	return cloner.RestoreSnapshot(ctx, snapshotID, targetNqn, targetNsid)
 }
 
 func isValidVolumeName(volumeName string) bool {
@@ -265,23 +982,3 @@ func isValidVolumeID(volumeID string) bool {
 
 	return true
 }
-
-func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
-	if len(volCaps) == 0 {
-		klog.Error("Volume Capabilities not provided")
-		return false
-	}
-
-	for _, cap := range volCaps {
-		if cap.GetBlock() != nil && cap.GetMount() != nil {
-			klog.Error("Cannot specify both block and mount access types")
-			return false
-		}
-		if cap.GetBlock() == nil && cap.GetMount() == nil {
-			klog.Error("Must specify either block or mount access type")
-			return false
-		}
-	}
-
-	return true
-}
@@ -0,0 +1,350 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestControllerServer returns a controller server of backend, with a
+// fake API server holding objects and a file store in a temporary directory.
+// The background loops of NewControllerServer are not started.
+func newTestControllerServer(t *testing.T, backend Backend, objects ...runtime.Object) (*ControllerServer, *fake.Clientset) {
+	t.Helper()
+	store, err := newFileStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubeClient := fake.NewSimpleClientset(objects...)
+	d := &driver{
+		name:              DefaultDriverName,
+		nodeId:            "controller",
+		nvme:              newFakeNvmeClient(),
+		nvmeCliTimeout:    time.Second,
+		metadata:          store,
+		kubeClient:        kubeClient,
+		backend:           backend,
+		grantTimeout:      time.Second,
+		discoveryCacheTTL: time.Minute,
+		volumeLocks:       utils.NewVolumeLocks(),
+	}
+	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	c := &ControllerServer{Driver: d, deviceRegistry: NewDeviceRegistry(d)}
+	c.health = &registryHealthChecker{registry: c.deviceRegistry}
+	return c, kubeClient
+}
+
+// driverPV returns a PV of the driver with the volume handle and volume context
+func driverPV(name, handle string, attributes map[string]string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": DefaultDriverName},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           DefaultDriverName,
+					VolumeHandle:     handle,
+					VolumeAttributes: attributes,
+				},
+			},
+		},
+	}
+}
+
+// attachment returns a VolumeAttachment of the driver attaching pvName to nodeName
+func attachment(pvName, nodeName string, attached bool) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-" + pvName + "-" + nodeName},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: DefaultDriverName,
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+	}
+}
+
+// kubeNode returns the Node named name, publishing hostNqn unless empty
+func kubeNode(name, hostNqn string) *corev1.Node {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if hostNqn != "" {
+		node.Annotations = map[string]string{nodeHostNqnAnnotation: hostNqn}
+	}
+	return node
+}
+
+// csiNode returns the CSINode of nodeName registering nodeID for the driver
+func csiNode(nodeName, nodeID string) *storagev1.CSINode {
+	return &storagev1.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Spec: storagev1.CSINodeSpec{
+			Drivers: []storagev1.CSINodeDriver{{Name: DefaultDriverName, NodeID: nodeID}},
+		},
+	}
+}
+
+// failingStore is a record store whose writes fail, as with the API server
+// or etcd out of reach
+type failingStore struct {
+	recordStore
+}
+
+func (s failingStore) Put(ctx context.Context, kind, key string, record interface{}) error {
+	return errors.New("connection refused")
+}
+
+func (s failingStore) Delete(ctx context.Context, kind, key string) error {
+	return errors.New("connection refused")
+}
+
+func TestRegistryStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{name: "no suitable device", err: fmt.Errorf("%w: none left", ErrNoSuitableDevice), want: codes.ResourceExhausted},
+		{name: "capacity out of range", err: fmt.Errorf("%w: too large", ErrOutOfRange), want: codes.OutOfRange},
+		{name: "already allocated", err: fmt.Errorf("%w: pv-1", ErrAlreadyAllocated), want: codes.AlreadyExists},
+		{name: "device not found", err: fmt.Errorf("%w: nqn", ErrDeviceNotFound), want: codes.NotFound},
+		{name: "device not free", err: fmt.Errorf("%w: in maintenance", ErrDeviceNotFree), want: codes.FailedPrecondition},
+		{name: "store unavailable", err: fmt.Errorf("%w: refused", ErrEtcdUnavailable), want: codes.Unavailable},
+		{name: "timeout", err: &TimeoutError{Operation: "nvme discover", Timeout: time.Second}, want: codes.DeadlineExceeded},
+		{name: "context canceled", err: context.Canceled, want: codes.Canceled},
+		{name: "unknown error", err: errors.New("boom"), want: codes.Internal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := status.Code(registryStatus(test.err)); got != test.want {
+				t.Errorf("registryStatus(%v) code = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		exported []string
+		failing  bool
+		want     codes.Code
+	}{
+		{name: "device allocated", exported: []string{testVolumeNqn}, want: codes.OK},
+		{name: "no device on the targets", want: codes.ResourceExhausted},
+		{name: "allocation cannot be recorded", exported: []string{testVolumeNqn}, failing: true, want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", test.exported...)
+			if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if test.failing {
+				c.Driver.metadata = failingStore{c.Driver.metadata}
+			}
+
+			_, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err != nil {
+				if _, exists := c.deviceRegistry.volumeToNQN["pv-1"]; exists {
+					t.Error("failed CreateVolume left pv-1 allocated")
+				}
+			}
+		})
+	}
+}
+
+func TestCreateVolumeCancelled(t *testing.T) {
+	tests := []struct {
+		name        string
+		synced      bool
+		cancelAfter time.Duration
+	}{
+		{name: "cancelled before the call", cancelAfter: 0},
+		{name: "cancelled during the initial sync", cancelAfter: 50 * time.Millisecond},
+		{name: "cancelled during a rediscovery", synced: true, cancelAfter: 50 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			if test.synced {
+				// The device appears after the initial sync, the allocation rediscovers it
+				if err := c.deviceRegistry.EnsureInitialSync(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.discoverDelay = 500 * time.Millisecond
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if test.cancelAfter == 0 {
+				cancel()
+			} else {
+				time.AfterFunc(test.cancelAfter, cancel)
+			}
+			defer cancel()
+
+			start := time.Now()
+			_, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if got := status.Code(err); got != codes.Canceled {
+				t.Fatalf("CreateVolume code = %v, want Canceled: %v", got, err)
+			}
+			if elapsed := time.Since(start); elapsed >= client.discoverDelay {
+				t.Errorf("cancelled CreateVolume took %v, want it to stop before the discovery completes", elapsed)
+			}
+			if _, exists := c.deviceRegistry.volumeToNQN["pv-1"]; exists {
+				t.Error("cancelled CreateVolume left pv-1 allocated")
+			}
+			for nqn, device := range c.deviceRegistry.devices {
+				if device.IsAllocated {
+					t.Errorf("cancelled CreateVolume left %s allocated", nqn)
+				}
+			}
+
+			// The volume lock was released, the retry of the provisioner allocates
+			client.discoverDelay = 0
+			resp, err := c.CreateVolume(context.Background(), createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("retried CreateVolume: %v", err)
+			}
+			if resp.GetVolume().GetVolumeId() != testVolumeNqn {
+				t.Errorf("retried CreateVolume returned %s, want %s", resp.GetVolume().GetVolumeId(), testVolumeNqn)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeRetry(t *testing.T) {
+	const requested = 1 << 30
+
+	tests := []struct {
+		name  string
+		retry func(*csi.CreateVolumeRequest)
+		want  codes.Code
+	}{
+		{name: "same request", retry: func(req *csi.CreateVolumeRequest) {}, want: codes.OK},
+		{name: "larger capacity", retry: func(req *csi.CreateVolumeRequest) {
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: 2 * requested}
+		}, want: codes.AlreadyExists},
+		{name: "limit below the allocation", retry: func(req *csi.CreateVolumeRequest) {
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: requested / 2, LimitBytes: requested / 2}
+		}, want: codes.AlreadyExists},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, "nqn.2024-01.io.example:volume-2")
+
+			req := createRequest("pv-1", nil)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: requested}
+			first, err := c.CreateVolume(ctx, req)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+
+			retry := createRequest("pv-1", nil)
+			retry.CapacityRange = &csi.CapacityRange{RequiredBytes: requested}
+			test.retry(retry)
+			resp, err := c.CreateVolume(ctx, retry)
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("retried CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err == nil && resp.GetVolume().GetVolumeId() != first.GetVolume().GetVolumeId() {
+				t.Errorf("retried CreateVolume returned %s, want the allocated %s", resp.GetVolume().GetVolumeId(), first.GetVolume().GetVolumeId())
+			}
+
+			// The allocation outlives a rejected retry
+			allocated := 0
+			for _, device := range c.deviceRegistry.devices {
+				if device.IsAllocated {
+					allocated++
+				}
+			}
+			if allocated != 1 {
+				t.Errorf("%d device(s) allocated, want the first request's one", allocated)
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		volumeID string
+		failing  bool
+		want     codes.Code
+	}{
+		{name: "allocated volume", volumeID: testVolumeNqn, want: codes.OK},
+		{name: "unknown volume", volumeID: "nqn.2024-01.io.example:unknown", want: codes.OK},
+		{name: "malformed volume ID", volumeID: "not-an-nqn", want: codes.InvalidArgument},
+		{name: "release cannot be recorded", volumeID: testVolumeNqn, failing: true, want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			if resp.GetVolume().GetVolumeId() != testVolumeNqn {
+				t.Fatalf("CreateVolume returned %s, want %s", resp.GetVolume().GetVolumeId(), testVolumeNqn)
+			}
+			if test.failing {
+				c.Driver.metadata = failingStore{c.Driver.metadata}
+			}
+
+			_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: test.volumeID})
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("DeleteVolume code = %v, want %v: %v", got, test.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// reclaimWithRetry reclaims the device of a deleted volume, retrying failures
+// to persist the release with a backoff doubled after each retry. The error of
+// the last attempt is returned once the retries are exhausted or the request
+// is done, so that the provisioner retries the delete.
+func (c *ControllerServer) reclaimWithRetry(ctx context.Context, volumeID string) error {
+	interval := c.Driver.deleteRetryInterval
+	for attempt := 0; ; attempt++ {
+		err := c.deviceRegistry.ReclaimDevice(ctx, volumeID)
+		if err == nil || !errors.Is(err, ErrEtcdUnavailable) || attempt >= c.Driver.deleteRetries {
+			return err
+		}
+
+		klog.Warningf("Release of volume %s failed (attempt %d/%d), retrying in %v: %v",
+			volumeID, attempt+1, c.Driver.deleteRetries+1, interval, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
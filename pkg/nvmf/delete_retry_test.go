@@ -0,0 +1,158 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyStore is a record store failing its next failures writes, counting them all
+type flakyStore struct {
+	recordStore
+
+	mutex    sync.Mutex
+	failures int
+	writes   int
+}
+
+func (s *flakyStore) fail() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writes++
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("etcdserver: leader changed")
+	}
+	return nil
+}
+
+func (s *flakyStore) Put(ctx context.Context, kind, key string, record interface{}) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.recordStore.Put(ctx, kind, key, record)
+}
+
+func (s *flakyStore) Delete(ctx context.Context, kind, key string) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.recordStore.Delete(ctx, kind, key)
+}
+
+func TestDeleteVolumeRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		failures  int
+		retention time.Duration
+		want      codes.Code
+		// wantWrites is the number of store writes of the delete
+		wantWrites int
+	}{
+		{name: "release", retries: 2, wantWrites: 1},
+		{name: "transient failures", retries: 2, failures: 2, wantWrites: 3},
+		{name: "retries exhausted", retries: 2, failures: 10, want: codes.Unavailable, wantWrites: 3},
+		{name: "no retries", failures: 1, want: codes.Unavailable, wantWrites: 1},
+		// The quarantine record is written, then the allocation record removed
+		{name: "quarantine", retries: 2, retention: time.Hour, wantWrites: 2},
+		{name: "transient quarantine failure", retries: 2, failures: 1, retention: time.Hour, wantWrites: 3},
+		{name: "quarantine retries exhausted", retries: 1, failures: 10, retention: time.Hour, want: codes.Unavailable, wantWrites: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.deleteRetries = test.retries
+			c.Driver.deleteRetryInterval = time.Millisecond
+			c.Driver.reclaimRetention = test.retention
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			r := c.deviceRegistry
+
+			if _, err := c.CreateVolume(ctx, createRequest("pv-1", nil)); err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			store := &flakyStore{recordStore: c.Driver.metadata, failures: test.failures}
+			c.Driver.metadata = store
+
+			_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn})
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("DeleteVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if store.writes != test.wantWrites {
+				t.Errorf("store writes = %d, want %d", store.writes, test.wantWrites)
+			}
+
+			// A failed delete leaves the volume allocated, for the provisioner
+			// to retry, and its record in place
+			_, allocated := r.volumeToNQN["pv-1"]
+			if allocated != (err != nil) {
+				t.Errorf("pv-1 allocated = %t after DeleteVolume = %v", allocated, err)
+			}
+			found, getErr := store.recordStore.Get(ctx, metadataKindAllocation, "pv-1", &allocationRecord{})
+			if getErr != nil || found != (err != nil) {
+				t.Errorf("allocation record found = %t: %v, want %t", found, getErr, err != nil)
+			}
+			if err == nil {
+				return
+			}
+
+			// The delete retried by the provisioner succeeds once the store is back
+			store.failures = 0
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn}); err != nil {
+				t.Fatalf("retried DeleteVolume: %v", err)
+			}
+			if _, allocated := r.volumeToNQN["pv-1"]; allocated {
+				t.Error("pv-1 is allocated after the retried delete")
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeRetryCancelled(t *testing.T) {
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.deleteRetries = 5
+	c.Driver.deleteRetryInterval = time.Hour
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	if _, err := c.CreateVolume(context.Background(), createRequest("pv-1", nil)); err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+	c.Driver.metadata = &flakyStore{recordStore: c.Driver.metadata, failures: 10}
+
+	// The backoff does not outlive the request
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Errorf("DeleteVolume code = %v, want %v: %v", got, codes.Unavailable, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DeleteVolume returned after %v, want once the request is done", elapsed)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// Keys of the device filter ConfigMap. Each value is a list of NQN or
+// "addr:port" endpoint globs separated by commas or newlines.
+const (
+	deviceFilterAllowKey = "allow"
+	deviceFilterDenyKey  = "deny"
+)
+
+// deviceFilter restricts which discovered subsystems the registry may use.
+// A device is permitted when it matches no deny pattern and, if an allowlist
+// is present, matches at least one allow pattern.
+type deviceFilter struct {
+	allow []string
+	deny  []string
+}
+
+// isPermitted reports whether the device passes the allow and deny lists
+func (f *deviceFilter) isPermitted(info *nvmfDiskInfo) bool {
+	if f == nil {
+		return true
+	}
+
+	if matchesAnyPattern(f.deny, info) {
+		return false
+	}
+
+	if len(f.allow) > 0 {
+		return matchesAnyPattern(f.allow, info)
+	}
+
+	return true
+}
+
+// matchesAnyPattern checks the device NQN and every endpoint against the patterns
+func matchesAnyPattern(patterns []string, info *nvmfDiskInfo) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, info.Nqn) {
+			return true
+		}
+		for _, endpoint := range info.Endpoints {
+			if globMatch(pattern, endpoint) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func globMatch(pattern, value string) bool {
+	matched, err := filepath.Match(pattern, value)
+	if err != nil {
+		klog.Warningf("Invalid device filter pattern %q: %v", pattern, err)
+		return false
+	}
+
+	return matched
+}
+
+// parseFilterPatterns splits a ConfigMap value into individual patterns
+func parseFilterPatterns(value string) []string {
+	patterns := []string{}
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n'
+	}) {
+		if pattern := strings.TrimSpace(field); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// deviceFilterFromConfigMap returns the allow and deny lists of the given
+// ConfigMap. A missing ConfigMap is an empty filter that permits every device.
+func deviceFilterFromConfigMap(cm *corev1.ConfigMap) *deviceFilter {
+	if cm == nil {
+		return &deviceFilter{}
+	}
+
+	return &deviceFilter{
+		allow: parseFilterPatterns(cm.Data[deviceFilterAllowKey]),
+		deny:  parseFilterPatterns(cm.Data[deviceFilterDenyKey]),
+	}
+}
+
+// setDeviceFilter replaces the device filter with that of the ConfigMap and
+// applies it to the registered devices at once
+func (r *DeviceRegistry) setDeviceFilter(cm *corev1.ConfigMap) {
+	filter := deviceFilterFromConfigMap(cm)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	registryLog.V(4).Infof("Device filter updated: allow %v, deny %v", filter.allow, filter.deny)
+	r.filter = filter
+	r.applyDeviceFilter()
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// filterConfigMap returns the device filter ConfigMap of the test driver
+func filterConfigMap(allow, deny string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "nvmf-device-filter", Namespace: "kube-system"},
+		Data:       map[string]string{deviceFilterAllowKey: allow, deviceFilterDenyKey: deny},
+	}
+}
+
+// newFilterServer returns a controller of three devices, the first two on one
+// endpoint and the third on another, watching the device filter ConfigMap
+func newFilterServer(t *testing.T, objects ...runtime.Object) (*ControllerServer, *fake.Clientset) {
+	t.Helper()
+	c, kubeClient := newTestControllerServer(t, newFakeBackend(), objects...)
+	c.Driver.namespace = "kube-system"
+	c.Driver.deviceFilterConfigMap = "nvmf-device-filter"
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2)
+	client.discovery["192.0.2.11:4420"] = discoveryPage("192.0.2.11", "4420", maintenanceNqn3)
+
+	// The fake API server only sends the changes made once the watch is set up
+	watching := make(chan struct{})
+	var once sync.Once
+	kubeClient.PrependWatchReactor("configmaps", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher, err := kubeClient.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		once.Do(func() { close(watching) })
+		return true, watcher, err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c.deviceRegistry.watchDeviceConfigMaps(ctx)
+	select {
+	case <-watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("device filter ConfigMap not watched")
+	}
+	return c, kubeClient
+}
+
+// registeredDevices returns the sorted IDs of the registered devices
+func registeredDevices(r *DeviceRegistry) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ids := []string{}
+	for id := range r.devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDeviceFilterIsPermitted(t *testing.T) {
+	info := &nvmfDiskInfo{Nqn: testVolumeNqn, Endpoints: []string{"192.0.2.10:4420", "192.0.2.11:4420"}}
+
+	tests := []struct {
+		name   string
+		filter *deviceFilter
+		want   bool
+	}{
+		{name: "no filter", want: true},
+		{name: "empty filter", filter: &deviceFilter{}, want: true},
+		{name: "allowed NQN", filter: &deviceFilter{allow: []string{"nqn.2024-01.io.example:*"}}, want: true},
+		{name: "allowed second endpoint", filter: &deviceFilter{allow: []string{"192.0.2.11:*"}}, want: true},
+		{name: "not allowed", filter: &deviceFilter{allow: []string{"192.0.2.12:*", "nqn.2024-01.io.other:*"}}},
+		{name: "denied NQN", filter: &deviceFilter{deny: []string{testVolumeNqn}}},
+		{name: "denied endpoint", filter: &deviceFilter{deny: []string{"192.0.2.10:4420"}}},
+		{name: "not denied", filter: &deviceFilter{deny: []string{"nqn.2024-01.io.other:*"}}, want: true},
+		{name: "allowed and denied", filter: &deviceFilter{allow: []string{"nqn.2024-01.io.example:*"}, deny: []string{"192.0.2.11:*"}}},
+		{name: "allowed and not denied", filter: &deviceFilter{allow: []string{"192.0.2.10:*"}, deny: []string{"*:4421"}}, want: true},
+		{name: "malformed pattern", filter: &deviceFilter{allow: []string{"nqn.2024-01.io.example:[volume"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.isPermitted(info); got != test.want {
+				t.Errorf("isPermitted = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterPatterns(t *testing.T) {
+	got := parseFilterPatterns(" nqn.2024-01.io.example:* ,192.0.2.10:4420\n\n 192.0.2.11:*,")
+	if want := []string{"nqn.2024-01.io.example:*", "192.0.2.10:4420", "192.0.2.11:*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFilterPatterns = %q, want %q", got, want)
+	}
+}
+
+func TestDeviceFilterDiscovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// filter is the ConfigMap, missing if nil
+		filter *corev1.ConfigMap
+		want   []string
+	}{
+		{name: "no ConfigMap", want: []string{testVolumeNqn, maintenanceNqn2, maintenanceNqn3}},
+		{name: "allow only", filter: filterConfigMap("192.0.2.10:*", ""), want: []string{testVolumeNqn, maintenanceNqn2}},
+		{name: "allow only by NQN", filter: filterConfigMap(maintenanceNqn3+"\n"+testVolumeNqn, ""), want: []string{testVolumeNqn, maintenanceNqn3}},
+		{name: "deny only", filter: filterConfigMap("", maintenanceNqn2), want: []string{testVolumeNqn, maintenanceNqn3}},
+		{name: "deny only by endpoint", filter: filterConfigMap("", "192.0.2.10:4420"), want: []string{maintenanceNqn3}},
+		{name: "allow and deny", filter: filterConfigMap("nqn.2024-01.io.example:*", "192.0.2.11:*,"+testVolumeNqn), want: []string{maintenanceNqn2}},
+		{name: "deny overrides allow", filter: filterConfigMap("192.0.2.11:*", maintenanceNqn3), want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := []runtime.Object{}
+			if test.filter != nil {
+				objects = append(objects, test.filter)
+			}
+			c, _ := newFilterServer(t, objects...)
+
+			params, err := ParseVolumeParams(map[string]string{paramAddr: "192.0.2.10,192.0.2.11", paramPort: "4420", paramType: "tcp"})
+			if err != nil {
+				t.Fatalf("ParseVolumeParams: %v", err)
+			}
+			if err := c.deviceRegistry.DiscoverDevices(context.Background(), params); err != nil {
+				t.Fatalf("DiscoverDevices: %v", err)
+			}
+			if got := registeredDevices(c.deviceRegistry); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("registered devices %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeviceFilterLiveUpdate(t *testing.T) {
+	ctx := context.Background()
+	c, kubeClient := newFilterServer(t, filterConfigMap("", ""))
+	if _, err := createMaintenanceVolume(t, c, "pv-a", map[string]string{paramPinnedNqn: testVolumeNqn}); err != nil {
+		t.Fatalf("CreateVolume(pv-a): %v", err)
+	}
+
+	// update changes the ConfigMap and waits for the watch to apply it
+	update := func(cm *corev1.ConfigMap) {
+		t.Helper()
+		if _, err := kubeClient.CoreV1().ConfigMaps(cm.Namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		want := deviceFilterFromConfigMap(cm)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c.deviceRegistry.mutex.RLock()
+			applied := reflect.DeepEqual(c.deviceRegistry.filter, want)
+			c.deviceRegistry.mutex.RUnlock()
+			if applied {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("device filter %+v not applied", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Denying applies at once, without waiting for a discovery: the free
+	// device is dropped, the allocated one keeps its volume
+	update(filterConfigMap("", "192.0.2.10:4420"))
+	if got, want := registeredDevices(c.deviceRegistry), []string{testVolumeNqn, maintenanceNqn3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("registered devices once denied %v, want %v", got, want)
+	}
+	device, exists := c.deviceRegistry.GetDeviceByNQN(testVolumeNqn)
+	if !exists || !device.IsAllocated || device.VolName != "pv-a" || !device.IsExcluded {
+		t.Errorf("denied device of pv-a = %+v, want it allocated to pv-a and excluded", device)
+	}
+	if got, want := allocateAll(t, c, "denied"), []string{maintenanceNqn3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allocated while denied %v, want %v", got, want)
+	}
+
+	// Once permitted again, the device of pv-a is no longer excluded and the
+	// free device is discovered again
+	update(filterConfigMap("", ""))
+	if got, want := allocateAll(t, c, "permitted"), []string{maintenanceNqn2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allocated once permitted %v, want %v", got, want)
+	}
+	if device, _ := c.deviceRegistry.GetDeviceByNQN(testVolumeNqn); device.IsExcluded {
+		t.Errorf("device of pv-a still excluded once permitted")
+	}
+}
+
+func TestDeviceFilterDeniedBeforeAllocation(t *testing.T) {
+	c, _ := newFilterServer(t)
+	params, err := ParseVolumeParams(map[string]string{paramAddr: "192.0.2.10,192.0.2.11", paramPort: "4420", paramType: "tcp"})
+	if err != nil {
+		t.Fatalf("ParseVolumeParams: %v", err)
+	}
+	if err := c.deviceRegistry.DiscoverDevices(context.Background(), params); err != nil {
+		t.Fatalf("DiscoverDevices: %v", err)
+	}
+
+	// Free devices denied by a filter not yet applied to the registry are not
+	// allocated
+	c.deviceRegistry.mutex.Lock()
+	c.deviceRegistry.filter = &deviceFilter{deny: []string{"192.0.2.10:*"}}
+	c.deviceRegistry.mutex.Unlock()
+	for _, name := range []string{"pv-a", "pv-b"} {
+		device, err := c.deviceRegistry.AllocateDevice(context.Background(), &AllocationRequest{VolumeName: name})
+		if name == "pv-a" && (err != nil || device.Nqn != maintenanceNqn3) {
+			t.Errorf("AllocateDevice(%s) = %+v, %v, want %s", name, device, err, maintenanceNqn3)
+		}
+		if name == "pv-b" && err == nil {
+			t.Errorf("AllocateDevice(%s) = %s, want no device", name, device.Nqn)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrWrongDevice is returned when the device resolved for a volume is not
+// the namespace of the volume, e.g. after the device numbering shifted
+var ErrWrongDevice = errors.New("device is not the namespace of the volume")
+
+// sysfsBlockDir holds the sysfs attributes of the block devices, a variable
+// so that tests can mock sysfs
+var sysfsBlockDir = "/sys/class/block"
+
+// subsystemNamespaceUUID returns a controller of the subsystem nqn and the
+// UUID, or NGUID, it reports for namespace nsid, empty if it reports none. A
+// variable so that tests can mock sysfs.
+var subsystemNamespaceUUID = func(nqn string, nsid uint32) (controller, uuid string) {
+	controller = getDeviceNameBySubNqn(nqn)
+	if controller == "" {
+		return "", ""
+	}
+
+	return controller, getDeviceUUID(controller, nsid)
+}
+
+// namespaceIdentity identifies the namespace behind a block device
+type namespaceIdentity struct {
+	Nqn  string
+	Nsid uint32
+	UUID string // Normalized by normalizeNamespaceUUID, empty if the namespace has none
+}
+
+func (id namespaceIdentity) String() string {
+	return fmt.Sprintf("namespace %d (uuid %s) of %s", id.Nsid, id.UUID, id.Nqn)
+}
+
+// readNamespaceIdentity reads the identity of the namespace behind the block
+// device at devicePath, which may be a link to it, from sysfs. The subsystem
+// NQN is that of the controller or, for multipath devices, of the subsystem
+// the device belongs to.
+func readNamespaceIdentity(devicePath string) (namespaceIdentity, error) {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return namespaceIdentity{}, err
+	}
+	dir := filepath.Join(sysfsBlockDir, filepath.Base(resolved))
+
+	nqn, err := readSysfsAttribute(filepath.Join(dir, "device", "subsysnqn"))
+	if err != nil {
+		return namespaceIdentity{}, err
+	}
+	nsidValue, err := readSysfsAttribute(filepath.Join(dir, "nsid"))
+	if err != nil {
+		return namespaceIdentity{}, err
+	}
+	nsid, err := strconv.ParseUint(nsidValue, 10, 32)
+	if err != nil {
+		return namespaceIdentity{}, fmt.Errorf("invalid nsid of %s: %q", resolved, nsidValue)
+	}
+
+	// Namespaces without a UUID are identified by their NGUID, and some
+	// targets report neither
+	uuid, err := readSysfsAttribute(filepath.Join(dir, "uuid"))
+	if err != nil || normalizeNamespaceUUID(uuid) == "" {
+		uuid, _ = readSysfsAttribute(filepath.Join(dir, "nguid"))
+	}
+
+	return namespaceIdentity{Nqn: nqn, Nsid: uint32(nsid), UUID: normalizeNamespaceUUID(uuid)}, nil
+}
+
+// readSysfsAttribute returns the trimmed content of a sysfs attribute, an
+// error if it is empty
+func readSysfsAttribute(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+
+	return value, nil
+}
+
+// normalizeNamespaceUUID returns the 32 lowercase hexadecimal digits of a UUID
+// or NGUID, whatever its separators, empty if it is unset (all zeros)
+func normalizeNamespaceUUID(id string) string {
+	digits := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(id))
+	if strings.Trim(digits, "0") == "" {
+		return ""
+	}
+
+	return digits
+}
+
+// verifyNamespaceIdentity confirms that the device resolved for a volume is
+// its namespace before it is formatted or mounted: the subsystem NQN and NSID
+// of the device must be those of the volume, and its UUID that the controllers
+// of the subsystem report for the namespace. The device path is resolved from
+// a udev link that may be stale when the device numbering shifts. Namespaces
+// without a UUID or NGUID are only matched by their NQN and NSID.
+func verifyNamespaceIdentity(devicePath, nqn string, nsid uint32) error {
+	actual, err := readNamespaceIdentity(devicePath)
+	if err != nil {
+		return fmt.Errorf("cannot read the identity of device %s: %v", devicePath, err)
+	}
+
+	if actual.Nqn != nqn {
+		return fmt.Errorf("%w: device %s is %s, expected subsystem %s", ErrWrongDevice, devicePath, actual, nqn)
+	}
+	if nsid != 0 && actual.Nsid != nsid {
+		return fmt.Errorf("%w: device %s is %s, expected namespace %d", ErrWrongDevice, devicePath, actual, nsid)
+	}
+
+	controller, uuid := subsystemNamespaceUUID(nqn, actual.Nsid)
+	if controller == "" {
+		return fmt.Errorf("cannot verify device %s: no controller of %s", devicePath, nqn)
+	}
+	expected := normalizeNamespaceUUID(uuid)
+	if actual.UUID == "" || expected == "" {
+		klog.Warningf("Device %s is %s, whose UUID controller %s reports as %q: verified by subsystem NQN and NSID only", devicePath, actual, controller, expected)
+		return nil
+	}
+	if actual.UUID != expected {
+		return fmt.Errorf("%w: device %s is %s, expected uuid %s", ErrWrongDevice, devicePath, actual, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testNamespaceUUID = "5b3f2a1c-7d4e-4f60-8a9b-0c1d2e3f4a5b"
+
+// withFakeBlockDevice mocks the sysfs attributes of the block device nvme0n1,
+// whose files are written unless empty, and returns its device path
+func withFakeBlockDevice(t *testing.T, attributes map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	devicePath := filepath.Join(root, "dev", "nvme0n1")
+	if err := os.MkdirAll(filepath.Dir(devicePath), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(devicePath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range attributes {
+		if content == "" {
+			continue
+		}
+		path := filepath.Join(root, "sys", "nvme0n1", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := sysfsBlockDir
+	sysfsBlockDir = filepath.Join(root, "sys")
+	t.Cleanup(func() { sysfsBlockDir = saved })
+	return devicePath
+}
+
+// withFakeSubsystemUUID mocks the UUID that the controller of each subsystem
+// reports for its namespaces, subsystems without an entry having no controller
+func withFakeSubsystemUUID(t *testing.T, uuids map[string]string) {
+	t.Helper()
+	saved := subsystemNamespaceUUID
+	subsystemNamespaceUUID = func(nqn string, nsid uint32) (string, string) {
+		uuid, exists := uuids[nqn]
+		if !exists {
+			return "", ""
+		}
+		return "nvme0", uuid
+	}
+	t.Cleanup(func() { subsystemNamespaceUUID = saved })
+}
+
+func TestVerifyNamespaceIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		reported   map[string]string // UUID reported by subsystem
+		nsid       uint32
+		wantErr    bool
+		wantWrong  bool
+	}{
+		{
+			name:       "matching uuid",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "1", "uuid": testNamespaceUUID},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+			nsid:       1,
+		},
+		{
+			name:       "matching nguid",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "1", "uuid": "00000000-0000-0000-0000-000000000000", "nguid": "5b3f2a1c 7d4e 4f60 8a9b 0c1d2e3f4a5b"},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+			nsid:       1,
+		},
+		{
+			name:       "whole subsystem volume",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "3", "uuid": testNamespaceUUID},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+		},
+		{
+			name:       "namespace without uuid falls back to NQN and NSID",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "1"},
+			reported:   map[string]string{testVolumeNqn: ""},
+			nsid:       1,
+		},
+		{
+			name:       "controller reporting no uuid falls back to NQN and NSID",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "1", "uuid": testNamespaceUUID},
+			reported:   map[string]string{testVolumeNqn: ""},
+			nsid:       1,
+		},
+		{
+			name:       "other subsystem",
+			attributes: map[string]string{"device/subsysnqn": "nqn.2024-01.io.example:volume-2", "nsid": "1", "uuid": testNamespaceUUID},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+			nsid:       1,
+			wantErr:    true,
+			wantWrong:  true,
+		},
+		{
+			name:       "other namespace",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "2", "uuid": testNamespaceUUID},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+			nsid:       1,
+			wantErr:    true,
+			wantWrong:  true,
+		},
+		{
+			name:       "other uuid",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "1", "uuid": "0f0e0d0c-0b0a-0908-0706-050403020100"},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+			nsid:       1,
+			wantErr:    true,
+			wantWrong:  true,
+		},
+		{
+			name:       "no controller of the subsystem",
+			attributes: map[string]string{"device/subsysnqn": testVolumeNqn, "nsid": "1", "uuid": testNamespaceUUID},
+			nsid:       1,
+			wantErr:    true,
+		},
+		{
+			name:       "unreadable identity",
+			attributes: map[string]string{"nsid": "1"},
+			reported:   map[string]string{testVolumeNqn: testNamespaceUUID},
+			nsid:       1,
+			wantErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			devicePath := withFakeBlockDevice(t, test.attributes)
+			withFakeSubsystemUUID(t, test.reported)
+
+			err := verifyNamespaceIdentity(devicePath, testVolumeNqn, test.nsid)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("verifyNamespaceIdentity error = %v, want error %v", err, test.wantErr)
+			}
+			if wrong := errors.Is(err, ErrWrongDevice); wrong != test.wantWrong {
+				t.Errorf("verifyNamespaceIdentity error = %v, want wrong device %v", err, test.wantWrong)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// volumeContextLabelPrefix prefixes the device labels exported to the volume
+// context, e.g. "label.nvmf.csi.k8s.io/array". The volume context is recorded
+// in the PV, so the labels of allocated devices survive a restart.
+const volumeContextLabelPrefix = "label.nvmf.csi.k8s.io/"
+
+// validLabelName matches the names of device labels
+var validLabelName = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+// labelRule labels the devices whose NQN or endpoint matches pattern
+type labelRule struct {
+	pattern string
+	labels  map[string]string
+}
+
+// deviceLabeler attaches labels to discovered devices. The labels ConfigMap
+// holds lines of an NQN or "addr:port" endpoint glob followed by
+// comma-separated name=value labels, e.g.
+//
+//	10.0.0.1:4420 array=array-a,media=nvme-ssd
+//	nqn.2024-01.com.example:tier-b* array=array-b,media=qlc
+//
+// under any keys. A device matching several lines gets the labels of all of
+// them, later lines, in key order, winning.
+type deviceLabeler struct {
+	rules []labelRule
+}
+
+// labelsFor returns the labels of the device, nil if it has none
+func (l *deviceLabeler) labelsFor(info *nvmfDiskInfo) map[string]string {
+	if l == nil {
+		return nil
+	}
+
+	var labels map[string]string
+	for _, rule := range l.rules {
+		if !matchesAnyPattern([]string{rule.pattern}, info) {
+			continue
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		for name, value := range rule.labels {
+			labels[name] = value
+		}
+	}
+
+	return labels
+}
+
+// parseLabelRules parses the lines of a labels ConfigMap value, skipping
+// malformed lines with a warning
+func parseLabelRules(value string) []labelRule {
+	rules := []labelRule{}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			klog.Warningf("Ignoring device labels line %q, expected a pattern and name=value labels", line)
+			continue
+		}
+
+		labels := map[string]string{}
+		for _, label := range strings.Split(fields[1], ",") {
+			name, value, found := strings.Cut(label, "=")
+			if !found || !validLabelName.MatchString(name) {
+				klog.Warningf("Ignoring invalid device label %q of pattern %s", label, fields[0])
+				continue
+			}
+			labels[name] = value
+		}
+		rules = append(rules, labelRule{pattern: fields[0], labels: labels})
+	}
+
+	return rules
+}
+
+// deviceLabelerFromConfigMap returns the label rules of the given ConfigMap. A
+// missing ConfigMap has no rules.
+func deviceLabelerFromConfigMap(cm *corev1.ConfigMap) *deviceLabeler {
+	labeler := &deviceLabeler{}
+	if cm == nil {
+		return labeler
+	}
+
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labeler.rules = append(labeler.rules, parseLabelRules(cm.Data[key])...)
+	}
+
+	return labeler
+}
+
+// setDeviceLabeler replaces the label rules with those of the ConfigMap and
+// relabels the free devices at once
+func (r *DeviceRegistry) setDeviceLabeler(cm *corev1.ConfigMap) {
+	labeler := deviceLabelerFromConfigMap(cm)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	registryLog.V(4).Infof("Device labels updated: %d rule(s)", len(labeler.rules))
+	r.labeler = labeler
+	r.applyDeviceLabels()
+}
+
+// applyDeviceLabels relabels the free devices with the current rules. Allocated
+// devices keep the labels recorded in the volume context of their PV.
+// Caller must hold the mutex.
+func (r *DeviceRegistry) applyDeviceLabels() {
+	if r.labeler == nil {
+		return
+	}
+
+	for _, device := range r.devices {
+		if !device.IsAllocated {
+			device.Labels = r.labeler.labelsFor(device.nvmfDiskInfo)
+		}
+	}
+}
+
+// exportedLabels returns the volume context entries of the device labels the
+// driver is configured to export
+func (d *driver) exportedLabels(labels map[string]string) map[string]string {
+	exported := map[string]string{}
+	for _, name := range d.exportDeviceLabels {
+		if value, exists := labels[name]; exists {
+			exported[volumeContextLabelPrefix+name] = value
+		}
+	}
+
+	return exported
+}
+
+// labelsFromAttributes returns the device labels recorded in the volume attributes of a PV
+func labelsFromAttributes(attributes map[string]string) map[string]string {
+	var labels map[string]string
+	for key, value := range attributes {
+		if name := strings.TrimPrefix(key, volumeContextLabelPrefix); name != key {
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[name] = value
+		}
+	}
+
+	return labels
+}
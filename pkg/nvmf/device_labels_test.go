@@ -0,0 +1,184 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// labelsConfigMap returns the device labels ConfigMap of the test driver
+func labelsConfigMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "nvmf-device-labels", Namespace: "kube-system"},
+		Data:       data,
+	}
+}
+
+func TestParseLabelRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []labelRule
+	}{
+		{name: "empty", value: "", want: []labelRule{}},
+		{
+			name:  "endpoint and NQN rules",
+			value: "192.0.2.10:4420 array=array-a,media=nvme-ssd\nnqn.2024-01.io.example:* tier=gold\n",
+			want: []labelRule{
+				{pattern: "192.0.2.10:4420", labels: map[string]string{"array": "array-a", "media": "nvme-ssd"}},
+				{pattern: "nqn.2024-01.io.example:*", labels: map[string]string{"tier": "gold"}},
+			},
+		},
+		{name: "comments and blank lines", value: "# arrays\n\n   \n", want: []labelRule{}},
+		{name: "empty value", value: "* array=", want: []labelRule{{pattern: "*", labels: map[string]string{"array": ""}}}},
+		{name: "missing labels", value: "192.0.2.10:4420", want: []labelRule{}},
+		{name: "extra field", value: "192.0.2.10:4420 array=a media=b", want: []labelRule{}},
+		{
+			name:  "invalid labels skipped",
+			value: "* array=array-a,media,-bad=x,ok.name=y",
+			want:  []labelRule{{pattern: "*", labels: map[string]string{"array": "array-a", "ok.name": "y"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseLabelRules(test.value); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseLabelRules(%q) = %+v, want %+v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLabelsFor(t *testing.T) {
+	labeler := &deviceLabeler{rules: []labelRule{
+		{pattern: "192.0.2.10:4420", labels: map[string]string{"array": "array-a", "media": "nvme-ssd"}},
+		{pattern: "nqn.2024-01.io.example:qlc-*", labels: map[string]string{"media": "qlc"}},
+	}}
+
+	tests := []struct {
+		name     string
+		labeler  *deviceLabeler
+		nqn      string
+		endpoint string
+		want     map[string]string
+	}{
+		{name: "endpoint match", labeler: labeler, nqn: testVolumeNqn, endpoint: "192.0.2.10:4420", want: map[string]string{"array": "array-a", "media": "nvme-ssd"}},
+		{name: "later rule wins", labeler: labeler, nqn: "nqn.2024-01.io.example:qlc-1", endpoint: "192.0.2.10:4420", want: map[string]string{"array": "array-a", "media": "qlc"}},
+		{name: "NQN match", labeler: labeler, nqn: "nqn.2024-01.io.example:qlc-1", endpoint: "192.0.2.11:4420", want: map[string]string{"media": "qlc"}},
+		{name: "no match", labeler: labeler, nqn: testVolumeNqn, endpoint: "192.0.2.11:4420"},
+		{name: "no labeler", nqn: testVolumeNqn, endpoint: "192.0.2.10:4420"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := &nvmfDiskInfo{Nqn: test.nqn, Endpoints: []string{test.endpoint}}
+			if got := test.labeler.labelsFor(info); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("labelsFor(%s at %s) = %v, want %v", test.nqn, test.endpoint, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeviceLabelsFlow(t *testing.T) {
+	labels := labelsConfigMap(map[string]string{
+		"arrays": "192.0.2.10:4420 array=array-a,media=nvme-ssd,owner=team-internal",
+	})
+	wantContext := map[string]string{
+		volumeContextLabelPrefix + "array": "array-a",
+		volumeContextLabelPrefix + "media": "nvme-ssd",
+	}
+
+	tests := []struct {
+		name string
+		// withPV restarts the controller once the PV exists, else before the
+		// provisioner created it
+		withPV bool
+		// wantLabels are the restored labels, all of them from the allocation
+		// record and the exported ones from the PV
+		wantLabels map[string]string
+	}{
+		{name: "restart before the PV", wantLabels: map[string]string{"array": "array-a", "media": "nvme-ssd", "owner": "team-internal"}},
+		{name: "restart after the PV", withPV: true, wantLabels: map[string]string{"array": "array-a", "media": "nvme-ssd"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			newServer := func(objects ...runtime.Object) *ControllerServer {
+				c, _ := newTestControllerServer(t, newFakeBackend(), append(objects, labels)...)
+				c.Driver.namespace = "kube-system"
+				c.Driver.deviceLabelsConfigMap = labels.Name
+				c.Driver.exportDeviceLabels = []string{"array", "media"}
+				client := c.Driver.nvme.(*fakeNvmeClient)
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+				return c
+			}
+
+			c := newServer()
+			watchCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			c.deviceRegistry.watchDeviceConfigMaps(watchCtx)
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volumeContext := resp.GetVolume().GetVolumeContext()
+			for key, value := range wantContext {
+				if volumeContext[key] != value {
+					t.Errorf("volume context %s = %q, want %q", key, volumeContext[key], value)
+				}
+			}
+			if _, leaked := volumeContext[volumeContextLabelPrefix+"owner"]; leaked {
+				t.Errorf("volume context exports the unselected label owner: %v", volumeContext)
+			}
+			if _, err := c.Driver.parseVolumeParams(volumeContext); err != nil {
+				t.Errorf("volume context with labels does not parse: %v", err)
+			}
+
+			// The restarted controller gets the labels from the PV or the
+			// allocation record, and returns them to a retried CreateVolume
+			objects := []runtime.Object{}
+			if test.withPV {
+				objects = append(objects, driverPV("pv-1", resp.GetVolume().GetVolumeId(), volumeContext))
+			}
+			restarted := newServer(objects...)
+			restarted.Driver.metadata = c.Driver.metadata
+			restarted.Driver.deviceLabelsConfigMap = ""
+			if err := restarted.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			if got := restarted.deviceRegistry.devices[testVolumeNqn].Labels; !reflect.DeepEqual(got, test.wantLabels) {
+				t.Errorf("restored labels = %v, want %v", got, test.wantLabels)
+			}
+			retried, err := restarted.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("retried CreateVolume: %v", err)
+			}
+			for key, value := range wantContext {
+				if got := retried.GetVolume().GetVolumeContext()[key]; got != value {
+					t.Errorf("retried volume context %s = %q, want %q", key, got, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// Supported strategies detecting that the device node of a namespace appeared
+// after a connect
+const (
+	DeviceReadySysfsPoll  = "sysfs-poll"  // Look the device up every deviceWaitInterval
+	DeviceReadyUdevSettle = "udev-settle" // Look the device up once udev processed its queued events
+	DeviceReadyInotify    = "inotify"     // Look the device up when a link appears in deviceLinkDir
+)
+
+// deviceLinkDir holds the by-id links the device of a namespace is looked up by
+const deviceLinkDir = "/dev/disk/by-id"
+
+// udevSettleMinInterval spaces the lookups of the udev-settle strategy, since
+// settling returns at once while the kernel has not queued the event yet
+const udevSettleMinInterval = 200 * time.Millisecond
+
+// deviceReadyStrategy detects that the device node of a namespace may have
+// appeared after a connect
+type deviceReadyStrategy interface {
+	// watch starts watching for device nodes. It is called before the first
+	// lookup, so that a device appearing meanwhile is not missed.
+	watch() deviceWatch
+}
+
+// deviceWatch waits for device nodes to appear
+type deviceWatch interface {
+	// await returns once a device node may have appeared, or after timeout
+	await(timeout time.Duration)
+	close()
+}
+
+// newDeviceReadyStrategy returns the strategy of the given name
+func newDeviceReadyStrategy(name string) (deviceReadyStrategy, error) {
+	switch name {
+	case "", DeviceReadySysfsPoll:
+		return sysfsPollStrategy{}, nil
+	case DeviceReadyUdevSettle:
+		return udevSettleStrategy{}, nil
+	case DeviceReadyInotify:
+		return inotifyStrategy{dir: deviceLinkDir}, nil
+	default:
+		return nil, fmt.Errorf("unknown device-ready-strategy %q, expected %s, %s or %s", name, DeviceReadySysfsPoll, DeviceReadyUdevSettle, DeviceReadyInotify)
+	}
+}
+
+// sysfsPollStrategy looks the device up every deviceWaitInterval
+type sysfsPollStrategy struct{}
+
+func (sysfsPollStrategy) watch() deviceWatch {
+	return pollWatch{}
+}
+
+type pollWatch struct{}
+
+func (pollWatch) await(timeout time.Duration) {
+	time.Sleep(timeout)
+}
+
+func (pollWatch) close() {}
+
+// udevSettleStrategy waits for udev to process its event queue, so that the
+// links of a device are created by the time it is looked up. Nodes without
+// udevadm fall back to polling.
+type udevSettleStrategy struct{}
+
+func (udevSettleStrategy) watch() deviceWatch {
+	return udevSettleWatch{}
+}
+
+type udevSettleWatch struct{}
+
+func (udevSettleWatch) await(timeout time.Duration) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	seconds := int(timeout.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	output, err := udevadmSettle(ctx, seconds)
+	if err != nil && ctx.Err() == nil {
+		nvmeLog.V(4).Infof("udevadm settle failed, polling instead: %v: %s", err, strings.TrimSpace(string(output)))
+		pollWatch{}.await(timeout - time.Since(start))
+		return
+	}
+
+	if elapsed := time.Since(start); elapsed < udevSettleMinInterval && elapsed < timeout {
+		time.Sleep(minDuration(udevSettleMinInterval, timeout) - elapsed)
+	}
+}
+
+func (udevSettleWatch) close() {}
+
+// udevadmSettle waits up to seconds for udev to process its event queue,
+// replaced in tests
+var udevadmSettle = func(ctx context.Context, seconds int) ([]byte, error) {
+	return exec.CommandContext(ctx, "udevadm", "settle", fmt.Sprintf("--timeout=%d", seconds)).CombinedOutput()
+}
+
+// inotifyStrategy looks the device up whenever an entry is created in dir.
+// Nodes where dir cannot be watched, e.g. before the first disk created it,
+// fall back to polling.
+type inotifyStrategy struct {
+	dir string
+}
+
+func (s inotifyStrategy) watch() deviceWatch {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		klog.Warningf("Cannot watch %s for devices, polling instead: %v", s.dir, err)
+		return pollWatch{}
+	}
+	if _, err := unix.InotifyAddWatch(fd, s.dir, unix.IN_CREATE|unix.IN_MOVED_TO); err != nil {
+		unix.Close(fd)
+		klog.Warningf("Cannot watch %s for devices, polling instead: %v", s.dir, err)
+		return pollWatch{}
+	}
+
+	return &inotifyWatch{fd: fd}
+}
+
+type inotifyWatch struct {
+	fd int
+}
+
+// await polls the inotify descriptor and drains the events it holds. The
+// events are not inspected, the lookup tells whether the device appeared.
+func (w *inotifyWatch) await(timeout time.Duration) {
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, int(timeout/time.Millisecond)); err != nil || n == 0 {
+		return
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		if n, err := unix.Read(w.fd, buf); err != nil || n <= 0 {
+			return
+		}
+	}
+}
+
+func (w *inotifyWatch) close() {
+	unix.Close(w.fd)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// deviceEvents simulates the appearance of the device node of a namespace:
+// the lookup fails until appear is called, which fires the events the
+// strategies watch for, a created link and a processed udev queue
+type deviceEvents struct {
+	appeared atomic.Bool
+	linkDir  string
+	udev     chan struct{}
+	// settleErr fails udevadm settle at once, as on nodes without udevadm
+	settleErr error
+}
+
+func withDeviceEvents(t *testing.T, settleErr error) *deviceEvents {
+	t.Helper()
+	events := &deviceEvents{linkDir: t.TempDir(), udev: make(chan struct{}), settleErr: settleErr}
+	savedPath, savedRescan, savedSettle := namespaceDevicePath, rescanNamespaces, udevadmSettle
+	namespaceDevicePath = func(nqn string, nsid uint32) (string, error) {
+		if !events.appeared.Load() {
+			return "", fmt.Errorf("namespace %d of %s not found", nsid, nqn)
+		}
+		return filepath.Join(events.linkDir, fmt.Sprintf("nvme-fake-%s-%d", nqn, nsid)), nil
+	}
+	rescanNamespaces = func(nqn string, timeout time.Duration) {}
+	udevadmSettle = func(ctx context.Context, seconds int) ([]byte, error) {
+		if events.settleErr != nil {
+			return []byte("udevadm: not found"), events.settleErr
+		}
+		select {
+		case <-events.udev:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	t.Cleanup(func() { namespaceDevicePath, rescanNamespaces, udevadmSettle = savedPath, savedRescan, savedSettle })
+	return events
+}
+
+// appear makes the device node appear and fires its events
+func (e *deviceEvents) appear(t *testing.T) {
+	e.appeared.Store(true)
+	close(e.udev)
+	if err := os.Symlink("../../nvme0n1", filepath.Join(e.linkDir, "nvme-fake")); err != nil {
+		t.Errorf("Symlink: %v", err)
+	}
+}
+
+func TestNewDeviceReadyStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    deviceReadyStrategy
+		wantErr bool
+	}{
+		{name: "", want: sysfsPollStrategy{}},
+		{name: DeviceReadySysfsPoll, want: sysfsPollStrategy{}},
+		{name: DeviceReadyUdevSettle, want: udevSettleStrategy{}},
+		{name: DeviceReadyInotify, want: inotifyStrategy{dir: deviceLinkDir}},
+		{name: "udev", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := newDeviceReadyStrategy(test.name)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newDeviceReadyStrategy(%q) error = %v, want error %v", test.name, err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("newDeviceReadyStrategy(%q) = %#v, want %#v", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeviceReadyStrategies(t *testing.T) {
+	const appearsAfter = 300 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// strategy returns the strategy, watching linkDir for links
+		strategy  func(linkDir string) deviceReadyStrategy
+		settleErr error
+		// wantEvent is set for the strategies looking the device up on its
+		// event rather than at the next poll
+		wantEvent bool
+	}{
+		{name: "sysfs poll", strategy: func(string) deviceReadyStrategy { return sysfsPollStrategy{} }},
+		{name: "udev settle", strategy: func(string) deviceReadyStrategy { return udevSettleStrategy{} }, wantEvent: true},
+		{
+			name:      "udev settle without udevadm",
+			strategy:  func(string) deviceReadyStrategy { return udevSettleStrategy{} },
+			settleErr: errors.New("executable file not found in $PATH"),
+		},
+		{name: "inotify", strategy: func(linkDir string) deviceReadyStrategy { return inotifyStrategy{dir: linkDir} }, wantEvent: true},
+		{
+			name:     "inotify of a missing directory",
+			strategy: func(linkDir string) deviceReadyStrategy { return inotifyStrategy{dir: filepath.Join(linkDir, "by-id")} },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := withDeviceEvents(t, test.settleErr)
+			c := &Connector{TargetNqn: testVolumeNqn, Nsid: 1, DeviceWaitTimeout: 5 * time.Second, DeviceReady: test.strategy(events.linkDir)}
+
+			var appearedAt time.Time
+			timer := time.AfterFunc(appearsAfter, func() {
+				appearedAt = time.Now()
+				events.appear(t)
+			})
+			defer timer.Stop()
+
+			devicePath, err := c.waitForDevice()
+			if err != nil {
+				t.Fatalf("waitForDevice: %v", err)
+			}
+			latency := time.Since(appearedAt)
+			if want := filepath.Join(events.linkDir, fmt.Sprintf("nvme-fake-%s-1", testVolumeNqn)); devicePath != want {
+				t.Errorf("waitForDevice = %s, want %s", devicePath, want)
+			}
+
+			// Events are acted on at once, polls within the poll interval
+			limit := deviceWaitInterval
+			if test.wantEvent {
+				limit = 150 * time.Millisecond
+			}
+			if latency > limit {
+				t.Errorf("device found %v after it appeared, want at most %v", latency, limit)
+			}
+		})
+	}
+}
+
+func TestDeviceReadyStrategiesTimeout(t *testing.T) {
+	const timeout = 250 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		strategy func(linkDir string) deviceReadyStrategy
+	}{
+		{name: "sysfs poll", strategy: func(string) deviceReadyStrategy { return sysfsPollStrategy{} }},
+		{name: "udev settle", strategy: func(string) deviceReadyStrategy { return udevSettleStrategy{} }},
+		{name: "inotify", strategy: func(linkDir string) deviceReadyStrategy { return inotifyStrategy{dir: linkDir} }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := withDeviceEvents(t, nil)
+			c := &Connector{TargetNqn: testVolumeNqn, Nsid: 1, DeviceWaitTimeout: timeout, DeviceReady: test.strategy(events.linkDir)}
+
+			// Unrelated links do not end the wait
+			if err := os.Symlink("../../sda", filepath.Join(events.linkDir, "scsi-other")); err != nil {
+				t.Fatalf("Symlink: %v", err)
+			}
+
+			start := time.Now()
+			_, err := c.waitForDevice()
+			if !errors.Is(err, ErrDeviceNodeMissing) {
+				t.Fatalf("waitForDevice error = %v, want %v", err, ErrDeviceNodeMissing)
+			}
+			if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+200*time.Millisecond {
+				t.Errorf("waitForDevice gave up after %v, want the timeout of %v", elapsed, timeout)
+			}
+		})
+	}
+}
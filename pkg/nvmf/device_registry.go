@@ -17,14 +17,16 @@ limitations under the License.
 package nvmf
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"os/exec"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 )
@@ -33,6 +35,183 @@ import (
 type VolumeInfo struct {
 	*nvmfDiskInfo
 	IsAllocated bool
+
+	// IsExcluded is set when the device filter denies an allocated device.
+	// The existing volume keeps working, but the device is dropped from the
+	// registry once released instead of returning to the pool.
+	IsExcluded bool
+
+	// IsStale is set for allocations restored from a PV whose device has not
+	// been discovered since startup, e.g. because its array was removed. The
+	// volume can still be deleted, but the device is dropped from the registry
+	// once released. Rediscovering the device clears the flag.
+	IsStale bool
+
+	// Capacity is the raw device capacity in bytes, 0 if unknown
+	Capacity int64
+
+	// CapacityUnknown is set when the capacity probe failed to read the size of
+	// the device, which then only backs volumes requesting no capacity
+	CapacityUnknown bool
+
+	// UsedBytes is the capacity consumed by the allocated volume
+	UsedBytes int64
+
+	// Granularity is the increment in which the device allocates capacity, 0 if any size fits
+	Granularity int64
+
+	// Labels are the labels of the device from the labels ConfigMap, or for a
+	// restored allocation, the labels exported to the volume context of its PV
+	Labels map[string]string
+
+	// VolumeBytes is the capacity of the allocated volume, the requested capacity
+	// rounded up to the granularity, 0 if no capacity was requested
+	VolumeBytes int64
+
+	// QuarantinedUntil is set while the device of a deleted volume awaits
+	// reclaim. VolName still names the deleted volume, which a CreateVolume of
+	// the same name undeletes until then.
+	QuarantinedUntil time.Time
+
+	// SkipWipe is set for volumes of StorageClasses whose backend zeroes
+	// released namespaces, so they are not wiped on delete
+	SkipWipe bool
+
+	// AffinityKey and AntiAffinityKey are the placement hints of the allocated volume
+	AffinityKey     string
+	AntiAffinityKey string
+
+	// VolumeHandle is the volume ID recorded in the PV of a restored allocation,
+	// which may be of another format than the one configured now
+	VolumeHandle string
+
+	// PublishedNodes are the nodes the volume is published to through ControllerPublishVolume
+	PublishedNodes map[string]struct{}
+
+	// QoS are the I/O limits the backend applied to the allocated volume
+	QoS BackendQoS
+
+	// AllowedHosts are the host NQNs the StorageClass of the allocated volume
+	// allows to connect to its subsystem
+	AllowedHosts []string
+
+	// FsType is the filesystem the warm pool found on or formatted the free
+	// device with, empty if the device is blank or was not inspected since
+	// its last allocation. Prewarmed is set if the warm pool formatted it.
+	FsType    string
+	Prewarmed bool
+
+	// Inspected is set once the warm pool read the filesystem of the free
+	// device, and warming while the warm pool holds it out of the pool
+	Inspected bool
+	warming   bool
+
+	// EphemeralVolume is the ephemeral inline volume a node claimed the free
+	// device for, which holds the device out of the pool until released
+	EphemeralVolume string
+
+	// Dynamic is set for namespaces the backend created for their volume,
+	// which are deleted with the volume instead of returning to the pool
+	Dynamic bool
+}
+
+// AllocationRequest describes the constraints a device must satisfy to back a volume
+type AllocationRequest struct {
+	VolumeName    string
+	RequiredBytes int64
+	LimitBytes    int64 // 0 if unlimited
+	SkipWipe      bool
+	Placement     placementHints
+	PinnedID      string // Volume ID of the only device to allocate, empty to select one
+	QoS           BackendQoS
+	AllowedHosts  []string
+	FsType        string   // Filesystem the volume is staged with, empty for block volumes
+	MkfsOptions   []string // Extra mkfs arguments, which a pre-formatted device was not formatted with
+
+	// Percentage of each device's capacity kept in reserve, so that thin-provisioned
+	// arrays are not overcommitted
+	ReserveHeadroomPercent int
+
+	// Percentage of each device's raw capacity lost to filesystem and backend
+	// overhead, so that devices are not overcommitted once formatted
+	CapacityOverheadPercent int
+}
+
+// netCapacity returns the raw capacity less the overhead
+func (v *VolumeInfo) netCapacity(overheadPercent int) int64 {
+	return v.Capacity * int64(100-overheadPercent) / 100
+}
+
+// capacityKnown reports whether the capacity of the device was read. A failed
+// probe outweighs any capacity recorded before it, e.g. in the volume context of
+// a restored allocation.
+func (v *VolumeInfo) capacityKnown() bool {
+	return !v.CapacityUnknown && v.Capacity > 0
+}
+
+// usableCapacity returns the capacity that may be handed out once the overhead
+// is deducted and headroom is reserved
+func (v *VolumeInfo) usableCapacity(headroomPercent, overheadPercent int) int64 {
+	return v.netCapacity(overheadPercent) * int64(100-headroomPercent) / 100
+}
+
+// fits reports whether the device can satisfy the request. Devices that were
+// not probed only fit requests without headroom, as the headroom cannot be
+// reserved, and devices that failed the probe only fit requests without a
+// capacity.
+func (v *VolumeInfo) fits(req *AllocationRequest) bool {
+	if v.CapacityUnknown {
+		return req.RequiredBytes == 0
+	}
+	if v.Capacity == 0 {
+		return req.ReserveHeadroomPercent == 0
+	}
+
+	return v.volumeBytes(req) <= v.usableCapacity(req.ReserveHeadroomPercent, req.CapacityOverheadPercent)
+}
+
+// satisfies reports whether the device allocated to the volume of the request
+// satisfies it, so that a retried CreateVolume gets the device back. dynamic
+// is set for requests whose namespace is created for the volume.
+func (v *VolumeInfo) satisfies(req *AllocationRequest, dynamic bool) bool {
+	switch {
+	case v.Dynamic != dynamic:
+		return false
+	case req.PinnedID != "" && req.PinnedID != v.volumeID():
+		return false
+	case req.RequiredBytes > 0 && v.VolumeBytes < req.RequiredBytes:
+		return false
+	case req.LimitBytes > 0 && v.VolumeBytes > req.LimitBytes:
+		return false
+	}
+
+	return true
+}
+
+// volumeBytes returns the requested capacity rounded up to the device granularity
+func (v *VolumeInfo) volumeBytes(req *AllocationRequest) int64 {
+	return roundUpToGranularity(req.RequiredBytes, v.Granularity)
+}
+
+// consumedBytes returns the capacity an allocation for req consumes. A device
+// backs a single volume, so a device of known capacity is consumed whole.
+func (v *VolumeInfo) consumedBytes(req *AllocationRequest) int64 {
+	if v.Capacity > 0 {
+		return v.Capacity
+	}
+
+	return v.volumeBytes(req)
+}
+
+// freeCapacity returns the usable capacity left once the overhead and the used
+// bytes are deducted and headroom is reserved
+func (v *VolumeInfo) freeCapacity(headroomPercent, overheadPercent int) int64 {
+	free := v.usableCapacity(headroomPercent, overheadPercent) - v.UsedBytes
+	if free < 0 {
+		return 0
+	}
+
+	return free
 }
 
 // DeviceRegistry manages NVMe device discovery and allocation
@@ -42,17 +221,47 @@ type DeviceRegistry struct {
 	// Protects device registry data
 	mutex sync.RWMutex
 
-	// All discovered volume info indexed by NQN
+	// All discovered volume info indexed by volume ID, which is the NQN of a
+	// whole subsystem or the NQN and NSID of one of its namespaces
 	devices map[string]*VolumeInfo
 
-	// Set of available NQNs for quick lookup
+	// Set of available volume IDs for quick lookup
 	availableNQNs map[string]struct{}
 
-	// Map from volume name to NQN for allocated devices
+	// Map from volume name to volume ID for allocated devices
 	volumeToNQN map[string]string
 
+	// Map from volume name to volume ID for quarantined devices of deleted volumes
+	quarantined map[string]string
+
 	// Tracks if initial sync from etcd has been performed
 	initialSyncDone bool
+
+	// Set once the published nodes of the volumes are restored from the
+	// VolumeAttachments, until then the nodes granted access are unknown
+	publishedNodesRestored bool
+
+	// Outcome of the last sync from the Kubernetes API
+	lastSyncTime  time.Time
+	lastSyncError error
+
+	// Allow/deny lists applied to discovered devices, updated by the watch of
+	// their ConfigMap
+	filter *deviceFilter
+
+	// Label rules applied to discovered devices, updated by the watch of their
+	// ConfigMap
+	labeler *deviceLabeler
+
+	// Shares the outcome of discoveries of the same targets
+	discovery *discoveryCache
+
+	// Allocation counts and utilization of the devices, exported as metrics
+	fairness *allocationMetrics
+
+	// NQNs and endpoints under maintenance by target, updated by the watch of
+	// their records
+	maintenance map[string]*maintenanceRecord
 }
 
 // NewDeviceRegistry creates a new device registry
@@ -62,7 +271,11 @@ func NewDeviceRegistry(d *driver) *DeviceRegistry {
 		devices:         make(map[string]*VolumeInfo),
 		availableNQNs:   make(map[string]struct{}),
 		volumeToNQN:     make(map[string]string),
+		quarantined:     make(map[string]string),
 		initialSyncDone: false,
+		discovery:       newDiscoveryCache(d.discoveryCacheTTL),
+		fairness:        newAllocationMetrics(),
+		maintenance:     make(map[string]*maintenanceRecord),
 	}
 }
 
@@ -74,16 +287,35 @@ func (r *DeviceRegistry) EnsureInitialSync(ctx context.Context) error {
 	if r.initialSyncDone {
 		return nil
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	klog.V(4).Info("Performing initial sync from existing PersistentVolumes")
+	registryLog.V(4).Info("Performing initial sync from existing PersistentVolumes")
 
-	if err := r.SyncFromPV(ctx); err != nil {
-		return fmt.Errorf("failed to sync from Kubernetes API: %v", err)
+	err := r.SyncFromPV(ctx)
+	if err == nil {
+		err = r.restoreAllocations(ctx)
+	}
+	if err == nil {
+		err = r.restoreQuarantine(ctx)
+	}
+	if err == nil {
+		r.reloadMaintenance(ctx)
+		// Retried until it succeeds by the callers needing the published nodes
+		if err := r.restorePublishedNodes(ctx); err != nil {
+			klog.Warningf("Failed to restore the published nodes: %v", err)
+		}
+	}
+	r.lastSyncTime = time.Now()
+	r.lastSyncError = err
+	if err != nil {
+		return fmt.Errorf("%w: failed to sync: %v", ErrEtcdUnavailable, err)
 	}
 
 	r.initialSyncDone = true
 
-	klog.V(4).Infof("Successfully synced %d volumes from Kubernetes API", len(r.devices))
+	registryLog.V(4).Infof("Successfully synced %d volumes from Kubernetes API", len(r.devices))
 	return nil
 }
 
@@ -100,140 +332,820 @@ func (r *DeviceRegistry) SyncFromPV(ctx context.Context) error {
 		return err
 	}
 
-	for _, pv := range list.Items {
-		// Check if the PV was provisioned by this driver using annotations
-		provisionedBy, exists := pv.Annotations["pv.kubernetes.io/provisioned-by"]
-		if !exists || provisionedBy != r.Driver.name {
+	reconciled, orphaned, skipped := 0, 0, 0
+	for i := range list.Items {
+		pv := &list.Items[i]
+		if !r.isDriverPV(pv) {
 			continue
 		}
 
-		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == r.Driver.name {
-			nqn := pv.Spec.CSI.VolumeHandle
-			if nqn, exists := r.volumeToNQN[pv.Name]; exists {
-				klog.Errorf("Volume %s is already existing in the registry with NQN %s", pv.Name, nqn)
-				continue
-			}
+		volumeID := registryVolumeID(pv.Spec.CSI.VolumeHandle)
+		if existing, exists := r.volumeToNQN[pv.Name]; exists {
+			klog.Errorf("Volume %s is already existing in the registry with ID %s", pv.Name, existing)
+			skipped++
+			continue
+		}
+		info := volumeInfoFromPV(pv, r.Driver.pvAttributes(ctx, pv))
+		if info.Transport == "" {
+			klog.Warningf("PV %s has no target transport, allocation of %s is orphaned until rediscovered", pv.Name, volumeID)
+			orphaned++
+		}
 
-			// Update the volume info with the allocated device
-			r.devices[nqn] = &VolumeInfo{
-				nvmfDiskInfo: &nvmfDiskInfo{
-					VolName:   pv.Name,
-					Nqn:       nqn,
-					Transport: pv.Spec.CSI.VolumeAttributes[paramType],
-					Endpoints: strings.Split(pv.Spec.CSI.VolumeAttributes["targetTrEndpoint"], ","),
-				},
-				IsAllocated: true,
-			}
+		// Update the volume info with the allocated device
+		r.devices[volumeID] = info
+
+		registryLog.V(4).Infof("Recovered device mapping: [PV] %s → [Device] %s", pv.Name, volumeID)
+		r.volumeToNQN[pv.Name] = volumeID
+		reconciled++
+	}
+
+	klog.Infof("Sync from PersistentVolumes: %d allocations reconciled (%d orphaned without target info), %d duplicates skipped",
+		reconciled, orphaned, skipped)
+
+	return nil
+}
 
-			klog.V(4).Infof("Recovered device mapping: [PV] %s → [Device NQN] %s", pv.Name, nqn)
-			r.volumeToNQN[pv.Name] = nqn
+// isDriverPV reports whether the PV was provisioned by this driver
+func (r *DeviceRegistry) isDriverPV(pv *corev1.PersistentVolume) bool {
+	provisionedBy, exists := pv.Annotations["pv.kubernetes.io/provisioned-by"]
+	if !exists || provisionedBy != r.Driver.name {
+		return false
+	}
 
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == r.Driver.name
+}
+
+// volumeInfoFromPV returns the allocation recorded in a PV. Restored allocations
+// are stale until discovery finds their device again. Single-path volumes carry
+// no endpoints, so only the transport is required, from the volume context or
+// an opaque volume ID. attributes is the decrypted volume context of the PV.
+func volumeInfoFromPV(pv *corev1.PersistentVolume, attributes map[string]string) *VolumeInfo {
+	nqn, nsid := parseVolumeID(pv.Spec.CSI.VolumeHandle)
+	transport := attributes[paramType]
+	if fields, err := decodeVolumeID(pv.Spec.CSI.VolumeHandle); err == nil && transport == "" {
+		transport = fields.Transport
+	}
+	qos, err := parseQoS(attributes)
+	if err != nil {
+		klog.Warningf("Ignoring QoS of PV %s: %v", pv.Name, err)
+	}
+	allowedHosts, err := parseAllowedHosts(attributes[paramAllowedHostNqns])
+	if err != nil {
+		klog.Warningf("Ignoring allowed hosts of PV %s: %v", pv.Name, err)
+	}
+	var endpoints []string
+	if value := attributes[paramEndpoint]; value != "" {
+		var err error
+		if endpoints, err = sortEndpoints(strings.Split(value, ",")); err != nil {
+			klog.Warningf("Ignoring endpoints of PV %s: %v", pv.Name, err)
+			endpoints = nil
 		}
 	}
 
-	return nil
+	return &VolumeInfo{
+		nvmfDiskInfo: &nvmfDiskInfo{
+			VolName:   pv.Name,
+			Nqn:       nqn,
+			Nsid:      nsid,
+			Transport: transport,
+			Endpoints: endpoints,
+		},
+		IsAllocated:  true,
+		IsStale:      true,
+		VolumeHandle: pv.Spec.CSI.VolumeHandle,
+		Capacity:     parseAttributeBytes(attributes, volumeContextDeviceCapacity),
+		UsedBytes:    restoredUsedBytes(pv),
+		SkipWipe:     attributes[paramSkipWipe] == "true",
+		Labels:       labelsFromAttributes(attributes),
+
+		AffinityKey:     attributes[paramAffinityKey],
+		AntiAffinityKey: attributes[paramAntiAffinityKey],
+		QoS:             qos,
+		AllowedHosts:    allowedHosts,
+		Dynamic:         attributes[paramProvisioningMode] == provisioningModeDynamic,
+	}
 }
 
-// DiscoverDevices performs NVMe device discovery
-func (r *DeviceRegistry) DiscoverDevices(params map[string]string) error {
+// restoredUsedBytes returns the bytes a PV consumes, as recorded at allocation.
+// PVs created before the accounting was recorded fall back to their capacity.
+func restoredUsedBytes(pv *corev1.PersistentVolume) int64 {
+	if used := parseAttributeBytes(pv.Spec.CSI.VolumeAttributes, volumeContextUsedBytes); used > 0 {
+		return used
+	}
+
+	capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+	return capacity.Value()
+}
+
+// parseAttributeBytes parses a byte count of the volume attributes, 0 if unset or invalid
+func parseAttributeBytes(attributes map[string]string, key string) int64 {
+	value, exists := attributes[key]
+	if !exists {
+		return 0
+	}
+
+	bytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || bytes < 0 {
+		klog.Warningf("Ignoring invalid %s volume attribute %q", key, value)
+		return 0
+	}
+
+	return bytes
+}
+
+// DiscoverDevices performs NVMe device discovery, or uses the devices of a
+// recent discovery of the same targets. If ctx is done the registry is left
+// unchanged and the context error is returned.
+func (r *DeviceRegistry) DiscoverDevices(ctx context.Context, params *VolumeParams) error {
+	ctx, span := startSpan(ctx, "DiscoverDevices")
+	err := r.discoverDevices(ctx, params, false)
+	span.end(err)
+	return err
+}
+
+// RediscoverDevices performs NVMe device discovery, ignoring recent discoveries,
+// e.g. when a device expected on the targets is not registered
+func (r *DeviceRegistry) RediscoverDevices(ctx context.Context, params *VolumeParams) error {
+	ctx, span := startSpan(ctx, "DiscoverDevices", "discovery.forced", "true")
+	err := r.discoverDevices(ctx, params, true)
+	span.end(err)
+	return err
+}
+
+func (r *DeviceRegistry) discoverDevices(ctx context.Context, params *VolumeParams, force bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The discovery runs out of the lock, so that concurrent discoveries of the
+	// same targets share it and allocations are not held up meanwhile
+	discoveredDevices, err := r.discoverTargets(ctx, params, force)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return &DiscoveryError{Err: err}
+	}
+
+	r.mutex.Lock()
+	r.applyDeviceFilter()
+	stale, unregistered := r.pendingDevices(discoveredDevices)
+	r.mutex.Unlock()
+
+	// So do the connections verifying the endpoints and probing the capacity
+	// of the devices to register
+	probed := endpointIdentities{}
+	for id, rediscovered := range stale {
+		if r.Driver.verifyDuplicateNqn && !r.verifyEndpoints(ctx, rediscovered.diskInfo, rediscovered.recorded, probed) {
+			klog.Warningf("Device %s discovered again without a verified endpoint, keeping it stale", id)
+			delete(stale, id)
+		}
+	}
+	discovered := make(map[string]*VolumeInfo, len(unregistered))
+	for id, diskInfo := range unregistered {
+		if r.Driver.verifyDuplicateNqn && !r.verifyEndpoints(ctx, diskInfo, nil, probed) {
+			klog.Warningf("Device %s has no verified endpoint, skipping", id)
+			continue
+		}
+		device := &VolumeInfo{
+			nvmfDiskInfo: diskInfo,
+			IsAllocated:  false,
+			Granularity:  params.AllocationGranularity,
+		}
+		if r.Driver.probeDeviceCapacity {
+			r.probeCapacity(ctx, device)
+		}
+		discovered[id] = device
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	defer r.applyDeviceLabels()
 
-	klog.V(4).Info("Performing NVMe device discovery")
-	discoveredDevices, err := discoverNVMeDevices(params)
-	if err != nil {
-		return fmt.Errorf("device discovery failed: %v", err)
+	for id, rediscovered := range stale {
+		// Reattached or removed by a concurrent discovery or sync meanwhile
+		device, exists := r.devices[id]
+		if !exists || !device.IsStale {
+			continue
+		}
+		klog.Infof("Device %s of volume %s discovered again, reattaching allocation", id, device.VolName)
+		device.IsStale = false
+		device.Transport = rediscovered.diskInfo.Transport
+		device.Endpoints = rediscovered.diskInfo.Endpoints
+		device.Granularity = params.AllocationGranularity
+	}
+
+	added := 0
+	for id, device := range discovered {
+		// Registered by a concurrent discovery meanwhile
+		if _, exists := r.devices[id]; exists || r.conflictsWithRegistered(device.nvmfDiskInfo) {
+			continue
+		}
+		r.devices[id] = device
+		r.availableNQNs[id] = struct{}{}
+		added++
 	}
 
-	if len(discoveredDevices) == len(r.devices) {
-		klog.V(4).Info("No new devices discovered, skipping update")
+	if added == 0 {
+		registryLog.V(4).Info("No new devices discovered, skipping update")
 		return nil
 	}
+	registryLog.V(4).Infof("Discovered %d NVMe targets", len(r.devices))
 
-	for nqn, diskInfo := range discoveredDevices {
-		if _, exists := r.devices[nqn]; !exists {
-			r.devices[nqn] = &VolumeInfo{
-				nvmfDiskInfo: diskInfo,
-				IsAllocated:  false,
-			}
+	for _, device := range r.devices {
+		registryLog.V(4).Infof("- NQN: %s, isAllocated: %t, Endpoints: %v", device.Nqn, device.IsAllocated, device.Endpoints)
+	}
+
+	return nil
+}
 
-			r.availableNQNs[nqn] = struct{}{}
+// rediscoveredDevice is a stale device discovered again, with the endpoints
+// recorded for its volume
+type rediscoveredDevice struct {
+	diskInfo *nvmfDiskInfo
+	recorded []string
+}
+
+// pendingDevices splits the discovered devices to be registered into the
+// stale devices discovered again and the permitted unregistered ones.
+// Caller must hold the mutex.
+func (r *DeviceRegistry) pendingDevices(discoveredDevices map[string]*nvmfDiskInfo) (stale map[string]rediscoveredDevice, unregistered map[string]*nvmfDiskInfo) {
+	stale = map[string]rediscoveredDevice{}
+	unregistered = map[string]*nvmfDiskInfo{}
+	for id, diskInfo := range discoveredDevices {
+		if device, exists := r.devices[id]; exists {
+			if device.IsStale {
+				stale[id] = rediscoveredDevice{diskInfo: diskInfo, recorded: append([]string{}, device.Endpoints...)}
+			}
+			continue
+		}
+		if !r.filter.isPermitted(diskInfo) {
+			registryLog.V(4).Infof("Device %s is not permitted by the device filter, skipping", id)
+			continue
+		}
+		if r.conflictsWithRegistered(diskInfo) {
+			klog.Warningf("Device %s overlaps a registered %s, skipping", id, diskInfo.Nqn)
+			continue
 		}
+		unregistered[id] = diskInfo
 	}
-	klog.V(4).Infof("Discovered %d NVMe targets", len(r.devices))
 
+	return stale, unregistered
+}
+
+// discoverTargets returns the devices on the targets of the parameters, shared
+// with the concurrent and recent discoveries of the same targets unless forced
+func (r *DeviceRegistry) discoverTargets(ctx context.Context, params *VolumeParams, force bool) (map[string]*nvmfDiskInfo, error) {
+	extra := r.Driver.mdns.endpoints(params.Transport)
+
+	return r.discovery.discover(ctx, discoveryKey(params, extra), force, func() (map[string]*nvmfDiskInfo, error) {
+		registryLog.V(4).Info("Performing NVMe device discovery")
+		devices, err := discoverNVMeDevices(ctx, r.Driver.nvme, params, extra, r.Driver.nvmeCliTimeout, r.Driver.maxDiscoveryConcurrency)
+		// An interrupted discovery may have missed targets, it is not shared
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return devices, err
+	})
+}
+
+// conflictsWithRegistered reports whether a subsystem is registered both as a
+// whole and by namespace, which would hand out the same namespace twice, e.g.
+// after the namespaces parameter changed. Caller must hold the mutex.
+func (r *DeviceRegistry) conflictsWithRegistered(diskInfo *nvmfDiskInfo) bool {
 	for _, device := range r.devices {
-		klog.V(4).Infof("- NQN: %s, isAllocated: %t, Endpoints: %v", device.Nqn, device.IsAllocated, device.Endpoints)
+		if device.Nqn == diskInfo.Nqn && (device.Nsid == 0) != (diskInfo.Nsid == 0) {
+			return true
+		}
 	}
 
-	return nil
+	return false
+}
+
+// watchDeviceConfigMaps loads the device filter and label rules from their
+// ConfigMaps, then applies their changes as they are made until ctx is done
+func (r *DeviceRegistry) watchDeviceConfigMaps(ctx context.Context) {
+	if name := r.Driver.deviceFilterConfigMap; name != "" {
+		watchConfigMap(ctx, r.Driver.kubeClient, r.Driver.namespace, name, r.setDeviceFilter)
+	}
+	if name := r.Driver.deviceLabelsConfigMap; name != "" {
+		watchConfigMap(ctx, r.Driver.kubeClient, r.Driver.namespace, name, r.setDeviceLabeler)
+	}
 }
 
-// AllocateDevice selects and allocates a device for a volume
-func (r *DeviceRegistry) AllocateDevice(volumeName string) (*VolumeInfo, error) {
+// applyDeviceFilter re-evaluates registered devices against the current filter.
+// Denied free devices are removed, denied allocated or quarantined devices are
+// excluded from future allocations, and devices permitted again are returned to the pool.
+// Caller must hold the mutex.
+func (r *DeviceRegistry) applyDeviceFilter() {
+	for nqn, device := range r.devices {
+		permitted := r.filter.isPermitted(device.nvmfDiskInfo)
+		switch {
+		case !permitted && device.warming:
+			// Dropped once the warm pool returns it
+			device.IsExcluded = true
+		case !permitted && !device.IsAllocated && !device.isQuarantined():
+			klog.Infof("Device %s is denied by the device filter, removing from registry", nqn)
+			delete(r.devices, nqn)
+			r.recordRemoval(nqn)
+			delete(r.availableNQNs, nqn)
+		case !permitted && !device.IsExcluded:
+			klog.Infof("Device %s is denied by the device filter, excluding from new allocations", nqn)
+			device.IsExcluded = true
+		case permitted && device.IsExcluded:
+			klog.Infof("Device %s is permitted by the device filter again", nqn)
+			device.IsExcluded = false
+		}
+	}
+}
+
+// AllocateDevice selects and allocates a device for a volume. Nothing is
+// allocated if ctx is done by the time the registry lock is acquired.
+func (r *DeviceRegistry) AllocateDevice(ctx context.Context, req *AllocationRequest) (*VolumeInfo, error) {
+	ctx, span := startSpan(ctx, "AllocateDevice", "csi.volume_name", req.VolumeName)
+	device, err := r.allocateDevice(ctx, req)
+	if device != nil {
+		span.setAttribute("nvmf.device", device.volumeID())
+	}
+	span.end(err)
+	r.checkFreeDevices()
+	return device, err
+}
+
+func (r *DeviceRegistry) allocateDevice(ctx context.Context, req *AllocationRequest) (*VolumeInfo, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	// Check this volume is already allocated
-	if nqn, exists := r.volumeToNQN[volumeName]; exists {
-		return nil, fmt.Errorf("already allocated. PV: %s, device: %s", volumeName, nqn)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	// Check if any devices are available
-	if len(r.availableNQNs) == 0 {
-		return nil, fmt.Errorf("no available devices found")
+	volumeName := req.VolumeName
+
+	// A retried request gets the device already allocated to its volume
+	if device, exists, err := r.existingAllocation(req, false); exists {
+		return device, err
 	}
 
-	var nqn string
-	for n := range r.availableNQNs {
-		if r.devices[n].IsAllocated {
-			klog.Errorf("Device %s is marked as available but is already allocated. Device details: %+v", n, r.devices[n])
-			continue
-		}
+	// A deleted volume recreated during its retention gets its device back
+	if device, exists, err := r.undelete(ctx, req); exists {
+		return device, err
+	}
 
-		nqn = n
-		break
+	if r.Driver.ephemeralVolumes {
+		r.syncEphemeralClaims(ctx)
 	}
 
-	if nqn == "" {
-		return nil, fmt.Errorf("no available devices found")
+	var device *VolumeInfo
+	var usedBytes, volumeBytes int64
+	for device == nil {
+		candidates := make([]*VolumeInfo, 0, len(r.availableNQNs))
+		for id := range r.availableNQNs {
+			if device := r.devices[id]; r.filter.isPermitted(device.nvmfDiskInfo) && !r.inMaintenance(device.nvmfDiskInfo) {
+				candidates = append(candidates, device)
+			}
+		}
+
+		placed, err := r.placeFormattedDevice(candidates, req)
+		if err != nil {
+			return nil, err
+		}
+
+		// The registry is only updated once the allocation is persisted, so that
+		// it never holds an allocation a restart would lose
+		usedBytes, volumeBytes = placed.consumedBytes(req), placed.volumeBytes(req)
+		if err := r.persistAllocation(ctx, placed, req, usedBytes, volumeBytes); err != nil {
+			return nil, err
+		}
+		if err := r.checkEphemeralClaim(ctx, placed, req.VolumeName); err != nil {
+			return nil, err
+		}
+		if placed.EphemeralVolume == "" {
+			device = placed
+		}
 	}
+	id := device.volumeID()
 
 	// Update tracking maps
-	delete(r.availableNQNs, nqn)
-	r.volumeToNQN[volumeName] = nqn
-	device := r.devices[nqn]
+	delete(r.availableNQNs, id)
+	r.volumeToNQN[volumeName] = id
 	device.VolName = volumeName
 	device.IsAllocated = true
-
-	klog.V(4).Infof("[%d/%d] Allocated volume %s (NQN %s)", len(r.devices)-len(r.availableNQNs), len(r.devices), volumeName, nqn)
+	device.UsedBytes = usedBytes
+	device.VolumeBytes = volumeBytes
+	device.SkipWipe = req.SkipWipe
+	device.AffinityKey = req.Placement.AffinityKey
+	device.AntiAffinityKey = req.Placement.AntiAffinityKey
+	device.QoS = req.QoS
+	device.AllowedHosts = req.AllowedHosts
+	// The volume may reformat the device, which is inspected again once released
+	device.FsType = ""
+	device.Prewarmed = false
+	device.Inspected = false
+	r.recordAllocation(id, device)
+
+	registryLog.V(4).Infof("[%d/%d] Allocated volume %s (device %s)", len(r.devices)-len(r.availableNQNs), len(r.devices), volumeName, id)
 
 	return device, nil
 }
 
-// ReleaseDevice releases a device allocation
-func (r *DeviceRegistry) ReleaseDevice(nqn string) {
+// selectDevice picks the first free candidate that satisfies the request
+func selectDevice(candidates []*VolumeInfo, req *AllocationRequest) (*VolumeInfo, error) {
+	// Check if any devices are available
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: no free devices", ErrNoSuitableDevice)
+	}
+
+	exceedsLimit := false
+	for _, device := range candidates {
+		if device.IsAllocated {
+			klog.Errorf("Device %s is marked as available but is already allocated. Device details: %+v", device.Nqn, device)
+			continue
+		}
+
+		if volumeBytes := device.volumeBytes(req); req.LimitBytes > 0 && volumeBytes > req.LimitBytes {
+			registryLog.V(4).Infof("Device %s skipped: %d bytes requested round up to %d bytes, above the limit of %d bytes", device.Nqn, req.RequiredBytes, volumeBytes, req.LimitBytes)
+			exceedsLimit = true
+			continue
+		}
+
+		if !device.fits(req) {
+			registryLog.V(4).Infof("Device %s skipped: %d bytes requested exceeds usable capacity with %d%% overhead and %d%% headroom",
+				device.Nqn, req.RequiredBytes, req.CapacityOverheadPercent, req.ReserveHeadroomPercent)
+			continue
+		}
+
+		return device, nil
+	}
+
+	if exceedsLimit {
+		return nil, fmt.Errorf("%w: %d bytes requested exceed the limit of %d bytes once rounded to the device granularity", ErrOutOfRange, req.RequiredBytes, req.LimitBytes)
+	}
+	return nil, fmt.Errorf("%w: no free device can hold %d bytes with %d%% headroom", ErrNoSuitableDevice, req.RequiredBytes, req.ReserveHeadroomPercent)
+}
+
+// DryRunAllocate runs discovery, filtering and the capacity checks of AllocateDevice
+// and returns the device that would be allocated, without changing the registry.
+// The discovery runs out of the lock, so that dry runs do not hold up the
+// allocations and share the discoveries in flight.
+func (r *DeviceRegistry) DryRunAllocate(ctx context.Context, params *VolumeParams, req *AllocationRequest) (*VolumeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	discoveredDevices, err := r.discoverTargets(ctx, params, false)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, &DiscoveryError{Err: err}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if device, exists, err := r.existingAllocation(req, false); exists {
+		return device, err
+	}
+
+	candidates := make([]*VolumeInfo, 0, len(r.availableNQNs)+len(discoveredDevices))
+	for id := range r.availableNQNs {
+		if device := r.devices[id]; r.filter.isPermitted(device.nvmfDiskInfo) && !r.inMaintenance(device.nvmfDiskInfo) {
+			candidates = append(candidates, device)
+		}
+	}
+	for id, diskInfo := range discoveredDevices {
+		if _, exists := r.devices[id]; exists || !r.filter.isPermitted(diskInfo) || r.inMaintenance(diskInfo) || r.conflictsWithRegistered(diskInfo) {
+			continue
+		}
+		candidates = append(candidates, &VolumeInfo{nvmfDiskInfo: diskInfo, Granularity: params.AllocationGranularity})
+	}
+
+	return r.placeDevice(candidates, req)
+}
+
+// ExistingAllocation returns the device allocated to the volume of the request
+// if it satisfies the request, nil if the volume has no device. A device that
+// does not satisfy it is reported as ErrAlreadyAllocated.
+func (r *DeviceRegistry) ExistingAllocation(req *AllocationRequest, dynamic bool) (*VolumeInfo, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	device, _, err := r.existingAllocation(req, dynamic)
+	return device, err
+}
+
+// existingAllocation returns the device allocated to the volume of the request
+// and whether there is one, with ErrAlreadyAllocated if it does not satisfy
+// the request. Caller must hold the mutex.
+func (r *DeviceRegistry) existingAllocation(req *AllocationRequest, dynamic bool) (*VolumeInfo, bool, error) {
+	id, exists := r.volumeToNQN[req.VolumeName]
+	if !exists {
+		return nil, false, nil
+	}
+	device, found := r.devices[id]
+	if !found || !device.satisfies(req, dynamic) {
+		return nil, true, fmt.Errorf("%w: PV: %s, device: %s, which does not satisfy the request", ErrAlreadyAllocated, req.VolumeName, id)
+	}
+
+	registryLog.V(4).Infof("Volume %s is already allocated device %s", req.VolumeName, id)
+	return device, true, nil
+}
+
+// ReleaseDevice releases the device allocation of a volume ID, removing its
+// allocation record on a best-effort basis, e.g. to roll back an allocation.
+// ErrDeviceNotFound is returned if no device of the volume is registered.
+func (r *DeviceRegistry) ReleaseDevice(nqn string) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
 	device, exists := r.devices[nqn]
 	if !exists {
-		// CSI spec requires idempotency: return success even if volume doesn't exist
-		// This allows safe retries and prevents errors when volume was already deleted
-		klog.Infof("Volume %s not found", nqn)
-		return
+		return fmt.Errorf("%w: volume %s", ErrDeviceNotFound, nqn)
 	}
 
+	if device.IsAllocated {
+		r.forgetAllocation(device.VolName)
+	}
+	r.release(nqn, device)
+	return nil
+}
+
+// releaseAllocated releases the device allocation of a deleted volume once its
+// allocation record is removed, so that a failed removal leaves the volume
+// allocated and its delete is retried. ErrDeviceNotFound is returned if no
+// device of the volume is registered.
+func (r *DeviceRegistry) releaseAllocated(ctx context.Context, nqn string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	device, exists := r.devices[nqn]
+	if !exists {
+		return fmt.Errorf("%w: volume %s", ErrDeviceNotFound, nqn)
+	}
+
+	if device.IsAllocated {
+		if err := r.removeAllocation(ctx, device.VolName); err != nil {
+			return err
+		}
+	}
+	r.release(nqn, device)
+	return nil
+}
+
+// release returns the device to the pool, or drops it from the registry if it
+// is excluded or stale. Caller must hold the mutex.
+func (r *DeviceRegistry) release(nqn string, device *VolumeInfo) {
 	// Update tracking maps
 	device.IsAllocated = false
 	delete(r.volumeToNQN, device.VolName)
-	r.availableNQNs[nqn] = struct{}{}
 	device.VolName = ""
+	device.VolumeHandle = ""
+	device.UsedBytes = 0
+	device.VolumeBytes = 0
+	device.SkipWipe = false
+	device.AffinityKey = ""
+	device.AntiAffinityKey = ""
+	device.PublishedNodes = nil
+	device.QoS = BackendQoS{}
+	device.AllowedHosts = nil
+	r.recordRelease(nqn)
+
+	if device.Dynamic {
+		klog.Infof("Released provisioned namespace %s, removing from registry", nqn)
+		delete(r.devices, nqn)
+		r.recordRemoval(nqn)
+		return
+	}
+	if device.IsExcluded {
+		klog.Infof("Device %s is excluded by the device filter, removing from registry", nqn)
+		delete(r.devices, nqn)
+		r.recordRemoval(nqn)
+		return
+	}
+	if device.IsStale {
+		klog.Infof("Reclaimed stale allocation of undiscovered device %s, removing from registry", nqn)
+		delete(r.devices, nqn)
+		r.recordRemoval(nqn)
+		return
+	}
+	r.availableNQNs[nqn] = struct{}{}
+
+	registryLog.V(4).Infof("[%d/%d] Released volume %s", len(r.devices)-len(r.availableNQNs), len(r.devices), nqn)
+}
+
+// AvailableCapacity returns the free capacity of the devices new volumes may be
+// allocated, which is their capacity less overhead, headroom and used bytes,
+// and the largest single volume that can currently be provisioned
+func (r *DeviceRegistry) AvailableCapacity(headroomPercent, overheadPercent int) (int64, int64) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var total, maximum int64
+	for _, device := range r.devices {
+		if device.IsAllocated || device.IsExcluded || device.IsStale || device.warming || device.isQuarantined() ||
+			!r.filter.isPermitted(device.nvmfDiskInfo) || r.inMaintenance(device.nvmfDiskInfo) {
+			continue
+		}
+
+		free := device.freeCapacity(headroomPercent, overheadPercent)
+		total += free
+		if free > maximum {
+			maximum = free
+		}
+	}
+
+	return total, maximum
+}
+
+// InitialSyncDone reports whether the initial sync from persistent storage has completed
+func (r *DeviceRegistry) InitialSyncDone() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.initialSyncDone
+}
+
+// UsableDeviceCount returns the number of registered devices not excluded by the device filter
+func (r *DeviceRegistry) UsableDeviceCount() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	count := 0
+	for _, device := range r.devices {
+		if !device.IsExcluded && !device.IsStale {
+			count++
+		}
+	}
 
-	klog.V(4).Infof("[%d/%d] Released volume %s", len(r.devices)-len(r.availableNQNs), len(r.devices), nqn)
+	return count
 }
 
-// GetDeviceByNQN returns device info for a given NQN
+// MarkPublished records that the volume on the device is published to nodeID
+func (r *DeviceRegistry) MarkPublished(nqn, nodeID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	device, exists := r.devices[nqn]
+	if !exists {
+		return
+	}
+	if device.PublishedNodes == nil {
+		device.PublishedNodes = make(map[string]struct{})
+	}
+	device.PublishedNodes[nodeID] = struct{}{}
+}
+
+// MarkUnpublished records that the volume on the device is no longer published to nodeID
+func (r *DeviceRegistry) MarkUnpublished(nqn, nodeID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if device, exists := r.devices[nqn]; exists {
+		delete(device.PublishedNodes, nodeID)
+	}
+}
+
+// PublishedNodeIDs returns the sorted nodes the volume on the device is published to
+func (r *DeviceRegistry) PublishedNodeIDs(nqn string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	nodes := []string{}
+	if device, exists := r.devices[nqn]; exists {
+		for node := range device.PublishedNodes {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// Connection states of a registered device. Devices are registered from the
+// discovery log page without connecting; nodes connect them when staging.
+const (
+	deviceStateAdvertised  = "advertised"  // Listed by a discovery controller, not published to any node
+	deviceStateConnected   = "connected"   // Published to at least one node
+	deviceStateQuarantined = "quarantined" // Held for the deleted volume until its retention expires
+)
+
+// state reports whether the device is only advertised, connected by a node, or quarantined
+func (v *VolumeInfo) state() string {
+	if v.isQuarantined() {
+		return deviceStateQuarantined
+	}
+	if len(v.PublishedNodes) > 0 {
+		return deviceStateConnected
+	}
+	return deviceStateAdvertised
+}
+
+// DeviceStatus is a point-in-time view of a registered device
+type DeviceStatus struct {
+	Nqn            string   `json:"nqn"`
+	Nsid           uint32   `json:"nsid,omitempty"`
+	State          string   `json:"state"`
+	Allocated      bool     `json:"allocated"`
+	Excluded       bool     `json:"excluded"`
+	Maintenance    bool     `json:"maintenance"`
+	Stale          bool     `json:"stale"`
+	VolumeName     string   `json:"volumeName,omitempty"`
+	Capacity       int64    `json:"capacityBytes"`
+	CapacityKnown  bool     `json:"capacityKnown"`
+	UsedBytes      int64    `json:"usedBytes"`
+	Granularity    int64    `json:"granularityBytes,omitempty"`
+	Transport      string   `json:"transport"`
+	Endpoints      []string `json:"endpoints"`
+	PublishedNodes []string `json:"publishedNodes"`
+
+	// QuarantinedUntil is set while the device is quarantined
+	QuarantinedUntil *time.Time `json:"quarantinedUntil,omitempty"`
+}
+
+// SyncStatus describes the state of the registry sync from the Kubernetes API
+type SyncStatus struct {
+	InitialSyncDone bool       `json:"initialSyncDone"`
+	LastSyncTime    *time.Time `json:"lastSyncTime,omitempty"`
+	LastSyncError   string     `json:"lastSyncError,omitempty"`
+}
+
+// DeviceStatuses returns the status of every registered device sorted by NQN and NSID
+func (r *DeviceRegistry) DeviceStatuses() []DeviceStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	statuses := make([]DeviceStatus, 0, len(r.devices))
+	for _, device := range r.devices {
+		status := DeviceStatus{
+			Nqn:            device.Nqn,
+			Nsid:           device.Nsid,
+			State:          device.state(),
+			Allocated:      device.IsAllocated,
+			Excluded:       device.IsExcluded,
+			Maintenance:    r.inMaintenance(device.nvmfDiskInfo),
+			Stale:          device.IsStale,
+			Capacity:       device.Capacity,
+			CapacityKnown:  device.capacityKnown(),
+			UsedBytes:      device.UsedBytes,
+			Granularity:    device.Granularity,
+			Transport:      device.Transport,
+			Endpoints:      append([]string{}, device.Endpoints...),
+			PublishedNodes: make([]string, 0, len(device.PublishedNodes)),
+		}
+		if device.IsAllocated || device.isQuarantined() {
+			status.VolumeName = device.VolName
+		}
+		if device.isQuarantined() {
+			until := device.QuarantinedUntil
+			status.QuarantinedUntil = &until
+		}
+		for node := range device.PublishedNodes {
+			status.PublishedNodes = append(status.PublishedNodes, node)
+		}
+		sort.Strings(status.PublishedNodes)
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Nqn != statuses[j].Nqn {
+			return statuses[i].Nqn < statuses[j].Nqn
+		}
+		return statuses[i].Nsid < statuses[j].Nsid
+	})
+
+	return statuses
+}
+
+// SyncStatus returns the outcome of the last sync from the Kubernetes API
+func (r *DeviceRegistry) SyncStatus() SyncStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	status := SyncStatus{InitialSyncDone: r.initialSyncDone}
+	if !r.lastSyncTime.IsZero() {
+		lastSyncTime := r.lastSyncTime
+		status.LastSyncTime = &lastSyncTime
+	}
+	if r.lastSyncError != nil {
+		status.LastSyncError = r.lastSyncError.Error()
+	}
+
+	return status
+}
+
+// FreeDeviceCount returns the number of devices available for allocation
+func (r *DeviceRegistry) FreeDeviceCount() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.availableNQNs)
+}
+
+// GetDeviceByNQN returns device info for a given volume ID
 func (r *DeviceRegistry) GetDeviceByNQN(nqn string) (*VolumeInfo, bool) {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
@@ -242,110 +1154,158 @@ func (r *DeviceRegistry) GetDeviceByNQN(nqn string) (*VolumeInfo, bool) {
 	return device, exists
 }
 
-// discoverNVMeDevices runs NVMe discovery and returns available targets
-func discoverNVMeDevices(params map[string]string) (map[string]*nvmfDiskInfo, error) {
+// discoverNVMeDevices runs NVMe discovery and returns available targets indexed by
+// volume ID, with one entry per configured namespace of each subsystem.
+// The discovery controllers queried are those of the parameters plus the extra
+// addr:port endpoints, e.g. learned over mDNS.
+// Up to concurrency endpoints are queried at once, a failing endpoint does not
+// abort the discovery of the others.
+// Each nvme discover invocation is killed once timeout expires; a TimeoutError
+// is returned if no target could be discovered and at least one port timed out.
+func discoverNVMeDevices(ctx context.Context, client NvmeClient, params *VolumeParams, extra []string, timeout time.Duration, concurrency int) (map[string]*nvmfDiskInfo, error) {
 	if params == nil {
 		return nil, fmt.Errorf("discovery parameters are nil")
 	}
 
-	targetAddr := params[paramAddr]
-	targetPort := params[paramPort]
-	targetType := params[paramType]
+	targetAddr := params.TargetAddr
+	targetPort := params.TargetPort
+	targetType := params.Transport
+	nsids := params.Namespaces
 
-	if targetAddr == "" || targetPort == "" || targetType == "" {
+	if (targetAddr == "" || targetPort == "") && len(extra) == 0 || targetType == "" {
 		return nil, fmt.Errorf("missing required discovery parameters")
 	}
 
-	if strings.ToLower(targetType) != "tcp" && strings.ToLower(targetType) != "rdma" {
-		return nil, fmt.Errorf("transport type must be tcp or rdma, got: %s", targetType)
-	}
-
-	klog.V(4).Infof("Discovering NVMe targets at %s:%s using %s", targetAddr, targetPort, targetType)
+	registryLog.V(4).Infof("Discovering NVMe targets at %s:%s and %v using %s", targetAddr, targetPort, extra, targetType)
 
-	// Discover devices on each port
-	ips := strings.Split(targetAddr, ",")
-	ports := strings.Split(targetPort, ",")
-	// collect devices by NQN with endpoints as a list
-	deviceMap := make(map[string]*nvmfDiskInfo)
-	for _, ip := range ips {
-		ip = strings.TrimSpace(ip) // Trim spaces in case there are spaces after commas
-		for _, port := range ports {
-			port = strings.TrimSpace(port) // Trim spaces in case there are spaces after commas
-			if port == "" {
-				continue
+	// Discover devices on each address and port
+	endpoints := [][2]string{}
+	seen := map[[2]string]struct{}{}
+	addEndpoint := func(ip, port string) {
+		endpoint := [2]string{ip, port}
+		if _, exists := seen[endpoint]; exists || ip == "" || port == "" {
+			return
+		}
+		seen[endpoint] = struct{}{}
+		endpoints = append(endpoints, endpoint)
+	}
+	if targetAddr != "" && targetPort != "" {
+		for _, ip := range targetAddrs(targetAddr) {
+			for _, port := range strings.Split(targetPort, ",") {
+				// Trim spaces in case there are spaces after commas
+				addEndpoint(ip, strings.TrimSpace(port))
 			}
+		}
+	}
+	for _, endpoint := range extra {
+		if ip, port, err := net.SplitHostPort(endpoint); err == nil {
+			addEndpoint(ip, port)
+		}
+	}
 
-			klog.V(4).Infof("Running discovery on %s://%s:%s", targetType, ip, port)
-			cmd := exec.Command("nvme", "discover", "-a", ip, "-s", port, "-t", targetType, "-o", "json")
-			var out bytes.Buffer
-			cmd.Stdout = &out
+	start := time.Now()
+	outputs := probeDiscoveryEndpoints(ctx, client, targetType, endpoints, timeout, concurrency)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-			if err := cmd.Run(); err != nil {
-				klog.Warningf("nvme discover command failed for port %s: %v", port, err)
-				continue // Continue with next port instead of failing completely
+	// collect devices by NQN with endpoints as a list, in endpoint order
+	deviceMap := make(map[string]*nvmfDiskInfo)
+	var timeoutErr error
+	for _, output := range outputs {
+		if output.err != nil {
+			if _, ok := output.err.(*TimeoutError); ok {
+				timeoutErr = output.err
 			}
+			continue // Continue with next endpoint instead of failing completely
+		}
 
-			// Parse JSON output and organize by NQN
-			devices := parseNvmeDiscoveryOutput(out.String(), targetType)
-			for _, device := range devices {
-				if existingDevice, exists := deviceMap[device.Nqn]; exists {
-					// NQN already exists, just add the new endpoint if it's not already in the list
-					endpoint := device.Endpoints[0]
-					endpointExists := false
-					for _, existingEndpoint := range existingDevice.Endpoints {
-						if existingEndpoint == endpoint {
-							endpointExists = true
-							break
-						}
-					}
-					if !endpointExists {
-						existingDevice.Endpoints = append(existingDevice.Endpoints, endpoint)
+		// Parse JSON output and organize by NQN
+		devices := parseNvmeDiscoveryOutput(string(output.out), targetType)
+		for _, device := range devices {
+			if existingDevice, exists := deviceMap[device.Nqn]; exists {
+				// NQN already exists, just add the new endpoint if it's not already in the list
+				endpoint := device.Endpoints[0]
+				endpointExists := false
+				for _, existingEndpoint := range existingDevice.Endpoints {
+					if existingEndpoint == endpoint {
+						endpointExists = true
+						break
 					}
-				} else {
-					// New NQN, add the device to the map
-					deviceMap[device.Nqn] = device
 				}
+				if !endpointExists {
+					existingDevice.Endpoints = append(existingDevice.Endpoints, endpoint)
+				}
+			} else {
+				// New NQN, add the device to the map
+				deviceMap[device.Nqn] = device
 			}
 		}
 	}
 
-	return deviceMap, nil
+	registryLog.V(2).Infof("Discovered %d subsystems on %d endpoints in %v", len(deviceMap), len(endpoints), time.Since(start))
+
+	if len(deviceMap) == 0 && timeoutErr != nil {
+		return nil, timeoutErr
+	}
+
+	return expandNamespaces(deviceMap, nsids), nil
 }
 
-// parseNvmeDiscoveryOutput parses the JSON output of nvme discover command
-func parseNvmeDiscoveryOutput(output string, targetType string) []*nvmfDiskInfo {
-	targets := make([]*nvmfDiskInfo, 0)
-	discoveryNQN := "discovery"
+// discoveryOutput is the outcome of nvme discover on one endpoint
+type discoveryOutput struct {
+	out []byte
+	err error
+}
 
-	// Define structure for JSON parsing
-	type discoveryResponse struct {
-		Records []nvmfDiskInfo `json:"records"`
+// probeDiscoveryEndpoints runs nvme discover on the addr/port endpoints with up
+// to concurrency invocations at once and returns their outcomes in endpoint
+// order. No endpoint is started once ctx is done.
+func probeDiscoveryEndpoints(ctx context.Context, client NvmeClient, targetType string, endpoints [][2]string, timeout time.Duration, concurrency int) []discoveryOutput {
+	if concurrency < 1 {
+		concurrency = 1
 	}
 
-	var response discoveryResponse
-	if err := json.Unmarshal([]byte(output), &response); err != nil {
-		klog.Errorf("Failed to parse NVMe discovery JSON output: %v", err)
-		return targets
+	outputs := make([]discoveryOutput, len(endpoints))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, ip, port string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			outputs[i] = probeDiscoveryEndpoint(ctx, client, targetType, ip, port, timeout)
+		}(i, endpoint[0], endpoint[1])
 	}
+	wg.Wait()
 
-	for _, record := range response.Records {
-		// Skip discovery NQN and non-matching transport type
-		if strings.Contains(strings.ToLower(record.Nqn), discoveryNQN) ||
-			record.Transport != targetType {
-			continue
-		}
+	return outputs
+}
 
-		// Set endpoint address if both Addr and Port are provided
-		// These are required for the noder server to connect to the target with multipath
-		if record.Addr != "" && record.Port != "" {
-			record.Endpoints = []string{record.Addr + ":" + record.Port}
+// probeDiscoveryEndpoint runs nvme discover on one endpoint
+func probeDiscoveryEndpoint(ctx context.Context, client NvmeClient, targetType, ip, port string, timeout time.Duration) discoveryOutput {
+	registryLog.V(4).Infof("Running discovery on %s://%s:%s", targetType, ip, port)
+	out, err := client.Discover(ctx, targetType, ip, port, timeout)
+	if err != nil {
+		if ctx.Err() != nil {
+			klog.Warningf("nvme discover for %s:%s abandoned: %v", ip, port, err)
+			cleanupDiscoveryControllers(targetType, ip, port, timeout)
+		} else if _, ok := err.(*TimeoutError); ok {
+			klog.Warningf("nvme discover for %s:%s killed: %v", ip, port, err)
+			// The killed process may leave its discovery controller behind
+			cleanupDiscoveryControllers(targetType, ip, port, timeout)
 		} else {
-			klog.Warningf("Skipping record with invalid Addr or Port: Addr=%s, Port=%s", record.Addr, record.Port)
+			klog.Warningf("nvme discover command failed for %s:%s: %v", ip, port, err)
 		}
-
-		// Append to targets list
-		recordCopy := record // Create a copy because 'record' is reused in each loop iteration
-		targets = append(targets, &recordCopy)
 	}
-	return targets
+
+	return discoveryOutput{out: out, err: err}
 }
@@ -0,0 +1,501 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDiscoverDevicesOutOfLock(t *testing.T) {
+	const delay = 200 * time.Millisecond
+
+	tests := []struct {
+		name          string
+		discoverDelay time.Duration
+		connectDelay  time.Duration
+		probe         bool
+		discoveries   int // 0 if the discoveries may or may not overlap
+	}{
+		{name: "discovery in flight", discoverDelay: delay, discoveries: 1},
+		{name: "capacity probe in flight", connectDelay: delay, probe: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.probeDeviceCapacity = test.probe
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.sizes["/dev/nvme0n1"] = 1 << 30
+			client.sizes["/dev/nvme1n1"] = 1 << 30
+			client.discoverDelay = test.discoverDelay
+			client.connectDelay = test.connectDelay
+			r := c.deviceRegistry
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			params := &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"}
+
+			// Forced discoveries still join the one in flight
+			var wg sync.WaitGroup
+			errs := make([]error, 2)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = r.RediscoverDevices(ctx, params)
+				}(i)
+			}
+
+			time.Sleep(delay / 4)
+			done := make(chan struct{})
+			go func() {
+				r.FreeDeviceCount()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(delay / 2):
+				t.Error("registry is locked while the targets are discovered or probed")
+			}
+
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					t.Fatalf("RediscoverDevices: %v", err)
+				}
+			}
+			if got := client.discoverCount(); test.discoveries > 0 && got != test.discoveries {
+				t.Errorf("discoveries = %d, want %d", got, test.discoveries)
+			}
+			device, exists := r.GetDeviceByNQN(testVolumeNqn)
+			if !exists || r.FreeDeviceCount() != 1 {
+				t.Fatalf("registry holds %d free device(s), want %s", r.FreeDeviceCount(), testVolumeNqn)
+			}
+			if test.probe && (device.CapacityUnknown || device.Capacity != 1<<30) {
+				t.Errorf("probed capacity = %d (unknown %t), want %d", device.Capacity, device.CapacityUnknown, 1<<30)
+			}
+		})
+	}
+}
+
+func TestCapacityAfterRestart(t *testing.T) {
+	tests := []struct {
+		name string
+		// probe learns the device capacity, else it is unknown
+		probe bool
+		// legacy drops the used bytes from the PV, as recorded by older releases
+		legacy bool
+	}{
+		{name: "probed capacity", probe: true},
+		{name: "unknown capacity"},
+		{name: "PV without used bytes", probe: true, legacy: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			newServer := func(objects ...runtime.Object) *ControllerServer {
+				c, _ := newTestControllerServer(t, newFakeBackend(), objects...)
+				c.Driver.probeDeviceCapacity = test.probe
+				client := c.Driver.nvme.(*fakeNvmeClient)
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, "nqn.2024-01.io.example:volume-2")
+				client.sizes["/dev/nvme0n1"] = 1 << 30
+				client.sizes["/dev/nvme1n1"] = 1 << 30
+				return c
+			}
+
+			c := newServer()
+			req := createRequest("pv-1", nil)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 29}
+			resp, err := c.CreateVolume(ctx, req)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			total, maximum := c.deviceRegistry.AvailableCapacity(0, 0)
+			used := c.deviceRegistry.devices[resp.GetVolume().GetVolumeId()].UsedBytes
+			if used < req.CapacityRange.RequiredBytes {
+				t.Fatalf("used bytes = %d, want at least the requested %d", used, req.CapacityRange.RequiredBytes)
+			}
+
+			// The restarted controller only has the PV recorded by the provisioner
+			attributes := resp.GetVolume().GetVolumeContext()
+			if test.legacy {
+				delete(attributes, volumeContextUsedBytes)
+			}
+			restarted := newServer(driverPV("pv-1", resp.GetVolume().GetVolumeId(), attributes))
+			restarted.Driver.metadata = c.Driver.metadata
+			if err := restarted.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			if err := restarted.deviceRegistry.DiscoverDevices(ctx, &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"}); err != nil {
+				t.Fatalf("DiscoverDevices: %v", err)
+			}
+
+			device, exists := restarted.deviceRegistry.devices[resp.GetVolume().GetVolumeId()]
+			if !exists || !device.IsAllocated {
+				t.Fatalf("allocation of pv-1 was not restored")
+			}
+			if device.UsedBytes != used {
+				t.Errorf("restored used bytes = %d, want %d", device.UsedBytes, used)
+			}
+			gotTotal, gotMaximum := restarted.deviceRegistry.AvailableCapacity(0, 0)
+			if gotTotal != total || gotMaximum != maximum {
+				t.Errorf("AvailableCapacity after restart = %d, %d, want %d, %d", gotTotal, gotMaximum, total, maximum)
+			}
+		})
+	}
+}
+
+// concurrencyClient records the most nvme discover invocations in flight at once
+type concurrencyClient struct {
+	*fakeNvmeClient
+
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (c *concurrencyClient) Discover(ctx context.Context, transport, addr, port string, timeout time.Duration) ([]byte, error) {
+	c.mutex.Lock()
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.inFlight--
+		c.mutex.Unlock()
+	}()
+
+	return c.fakeNvmeClient.Discover(ctx, transport, addr, port, timeout)
+}
+
+func TestDiscoveryConcurrency(t *testing.T) {
+	const endpoints = 20
+
+	tests := []struct {
+		name        string
+		concurrency int
+		// unreachable are the endpoints without a discovery controller
+		unreachable int
+		cancelled   bool
+		wantMax     int
+	}{
+		{name: "serial", concurrency: 1, wantMax: 1},
+		{name: "bounded", concurrency: 4, wantMax: 4},
+		{name: "default", concurrency: DefaultMaxDiscoveryConcurrency, wantMax: DefaultMaxDiscoveryConcurrency},
+		{name: "beyond the endpoints", concurrency: 32, wantMax: endpoints},
+		{name: "unset", wantMax: 1},
+		{name: "failing endpoints", concurrency: 4, unreachable: 5, wantMax: 4},
+		{name: "cancelled", concurrency: 4, cancelled: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &concurrencyClient{fakeNvmeClient: newFakeNvmeClient()}
+			client.discoverDelay = 50 * time.Millisecond
+			addrs := []string{}
+			for i := 0; i < endpoints; i++ {
+				addr := fmt.Sprintf("192.0.2.%d", i+1)
+				addrs = append(addrs, addr)
+				if i >= test.unreachable {
+					// Every array exports the shared subsystem and one of its own
+					client.discovery[addr+":4420"] = discoveryPage(addr, "4420", testVolumeNqn, fmt.Sprintf("nqn.2024-01.io.example:array-%d", i))
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelled {
+				cancel()
+			}
+
+			params := &VolumeParams{Transport: "tcp", TargetAddr: strings.Join(addrs, ","), TargetPort: "4420"}
+			devices, err := discoverNVMeDevices(ctx, client, params, nil, time.Second, test.concurrency)
+			if test.cancelled {
+				if !errors.Is(err, context.Canceled) || len(client.discovers) > 0 {
+					t.Fatalf("discoverNVMeDevices = %v after %d discover(s), want the cancellation before any", err, len(client.discovers))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("discoverNVMeDevices: %v", err)
+			}
+			if client.maxInFlight != test.wantMax {
+				t.Errorf("discoveries in flight at most %d, want %d", client.maxInFlight, test.wantMax)
+			}
+			if len(client.discovers) != endpoints {
+				t.Errorf("discovered %d endpoint(s), want %d", len(client.discovers), endpoints)
+			}
+
+			reachable := endpoints - test.unreachable
+			if len(devices) != reachable+1 {
+				t.Errorf("discovered %d device(s), want %d", len(devices), reachable+1)
+			}
+			// The endpoints of the shared subsystem are in endpoint order,
+			// whichever discovery completed first
+			wantEndpoints := []string{}
+			for _, addr := range addrs[test.unreachable:] {
+				wantEndpoints = append(wantEndpoints, addr+":4420")
+			}
+			if shared := devices[testVolumeNqn]; shared == nil || !reflect.DeepEqual(shared.Endpoints, wantEndpoints) {
+				t.Errorf("shared subsystem = %+v, want the endpoints %v", shared, wantEndpoints)
+			}
+		})
+	}
+}
+
+func TestStaleAllocations(t *testing.T) {
+	tests := []struct {
+		name string
+		// record seeds the allocations as records of the store, else as PVs
+		record bool
+		// rediscovered exports the device of the orphaned allocation again
+		rediscovered bool
+	}{
+		{name: "orphaned PV"},
+		{name: "orphaned allocation record", record: true},
+		{name: "PV of a device discovered again", rediscovered: true},
+		{name: "allocation record of a device discovered again", record: true, rediscovered: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			attributes := map[string]string{paramType: "tcp", paramEndpoint: "192.0.2.10:4420"}
+			objects := []runtime.Object{}
+			if !test.record {
+				objects = append(objects, driverPV("pv-live", testVolumeNqn, attributes), driverPV("pv-orphan", maintenanceNqn3, attributes))
+			}
+			c, _ := newTestControllerServer(t, newFakeBackend(), objects...)
+			if test.record {
+				for name, volumeID := range map[string]string{"pv-live": testVolumeNqn, "pv-orphan": maintenanceNqn3} {
+					record := &allocationRecord{VolumeName: name, VolumeID: volumeID, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+					if err := c.Driver.metadata.Put(ctx, metadataKindAllocation, name, record); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			exported := []string{testVolumeNqn, maintenanceNqn2}
+			if test.rediscovered {
+				exported = append(exported, maintenanceNqn3)
+			}
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", exported...)
+			client.discovery["192.0.2.11:4420"] = discoveryPage("192.0.2.11", "4420")
+			r := c.deviceRegistry
+			// allocation returns the device allocated to the volume
+			allocation := func(name string) (*VolumeInfo, bool) {
+				r.mutex.RLock()
+				defer r.mutex.RUnlock()
+				device, exists := r.devices[r.volumeToNQN[name]]
+				return device, exists
+			}
+
+			// The allocation of the undiscovered device does not fail the sync
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			if err := r.DiscoverDevices(ctx, &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"}); err != nil {
+				t.Fatalf("DiscoverDevices: %v", err)
+			}
+			for name, wantStale := range map[string]bool{"pv-live": false, "pv-orphan": !test.rediscovered} {
+				device, exists := allocation(name)
+				if !exists || !device.IsAllocated || device.IsStale != wantStale {
+					t.Fatalf("device of %s = %+v, want allocated and stale %t", name, device, wantStale)
+				}
+			}
+
+			// Neither allocated device is handed out again
+			if got, want := allocateAll(t, c, "pv-new"), []string{maintenanceNqn2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("allocated %v, want %v", got, want)
+			}
+
+			// Deleting the orphaned volume removes its device from the registry,
+			// the device of a volume discovered again returns to the pool
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: maintenanceNqn3}); err != nil {
+				t.Fatalf("DeleteVolume(pv-orphan): %v", err)
+			}
+			if _, exists := r.GetDeviceByNQN(maintenanceNqn3); exists == !test.rediscovered {
+				t.Errorf("device of the deleted pv-orphan registered = %t, want %t", exists, test.rediscovered)
+			}
+			if _, free := r.availableNQNs[maintenanceNqn3]; free != test.rediscovered {
+				t.Errorf("device of the deleted pv-orphan free = %t, want %t", free, test.rediscovered)
+			}
+			if device, exists := allocation("pv-live"); !exists || !device.IsAllocated || device.Nqn != testVolumeNqn {
+				t.Errorf("allocation of pv-live = %+v, want %s still allocated", device, testVolumeNqn)
+			}
+		})
+	}
+}
+
+func TestDiscoverNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces string
+		// before discovers the namespaces of beforeNamespaces first, the
+		// whole subsystems if empty
+		before           bool
+		beforeNamespaces string
+		want             []string
+	}{
+		{name: "whole subsystems", want: []string{testVolumeNqn, maintenanceNqn2}},
+		{
+			name:       "namespace range",
+			namespaces: "1-3",
+			want: []string{
+				formatVolumeID(testVolumeNqn, 1), formatVolumeID(testVolumeNqn, 2), formatVolumeID(testVolumeNqn, 3),
+				formatVolumeID(maintenanceNqn2, 1), formatVolumeID(maintenanceNqn2, 2), formatVolumeID(maintenanceNqn2, 3),
+			},
+		},
+		{
+			name:       "namespace list",
+			namespaces: "2,5",
+			want: []string{
+				formatVolumeID(testVolumeNqn, 2), formatVolumeID(testVolumeNqn, 5),
+				formatVolumeID(maintenanceNqn2, 2), formatVolumeID(maintenanceNqn2, 5),
+			},
+		},
+		{
+			name:             "more namespaces of registered subsystems",
+			namespaces:       "1-2",
+			before:           true,
+			beforeNamespaces: "1",
+			want: []string{
+				formatVolumeID(testVolumeNqn, 1), formatVolumeID(testVolumeNqn, 2),
+				formatVolumeID(maintenanceNqn2, 1), formatVolumeID(maintenanceNqn2, 2),
+			},
+		},
+		// A subsystem is never registered both whole and by namespace, which
+		// would hand out its namespaces twice
+		{name: "namespaces of subsystems registered whole", namespaces: "1-2", before: true, want: []string{testVolumeNqn, maintenanceNqn2}},
+		{
+			name:             "whole subsystems registered by namespace",
+			before:           true,
+			beforeNamespaces: "1",
+			want:             []string{formatVolumeID(testVolumeNqn, 1), formatVolumeID(maintenanceNqn2, 1)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2)
+			discover := func(namespaces string) {
+				t.Helper()
+				values := map[string]string{paramAddr: "192.0.2.10", paramPort: "4420", paramType: "tcp"}
+				if namespaces != "" {
+					values[paramNamespaces] = namespaces
+				}
+				params, err := ParseVolumeParams(values)
+				if err != nil {
+					t.Fatalf("ParseVolumeParams: %v", err)
+				}
+				if err := c.deviceRegistry.DiscoverDevices(ctx, params); err != nil {
+					t.Fatalf("DiscoverDevices: %v", err)
+				}
+			}
+			if test.before {
+				discover(test.beforeNamespaces)
+			}
+			discover(test.namespaces)
+
+			want := append([]string{}, test.want...)
+			sort.Strings(want)
+			if got := registeredDevices(c.deviceRegistry); !reflect.DeepEqual(got, want) {
+				t.Errorf("registered devices %v, want %v", got, want)
+			}
+			for _, id := range want {
+				device, _ := c.deviceRegistry.GetDeviceByNQN(id)
+				if nqn, nsid := parseVolumeID(id); device.Nqn != nqn || device.Nsid != nsid || device.volumeID() != id {
+					t.Errorf("device %s is namespace %d of %s", id, device.Nsid, device.Nqn)
+				}
+			}
+		})
+	}
+}
+
+func TestNamespaceAllocationIsolation(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	namespaces := map[string]string{paramNamespaces: "1-3"}
+
+	// Each volume is given a namespace of its own of the shared subsystem
+	allocated := map[string]string{}
+	for _, name := range []string{"pv-1", "pv-2", "pv-3"} {
+		resp, err := c.CreateVolume(ctx, createRequest(name, namespaces))
+		if err != nil {
+			t.Fatalf("CreateVolume(%s): %v", name, err)
+		}
+		volumeID := resp.GetVolume().GetVolumeId()
+		if nqn, nsid := parseVolumeID(volumeID); nqn != testVolumeNqn || nsid == 0 {
+			t.Fatalf("CreateVolume(%s) = %s, want a namespace of %s", name, volumeID, testVolumeNqn)
+		}
+		for other, otherID := range allocated {
+			if otherID == volumeID {
+				t.Fatalf("%s was given the namespace %s of %s", name, volumeID, other)
+			}
+		}
+		allocated[name] = volumeID
+	}
+	if _, err := c.CreateVolume(ctx, createRequest("pv-4", namespaces)); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("CreateVolume(pv-4) code = %v, want ResourceExhausted once the namespaces are allocated: %v", status.Code(err), err)
+	}
+
+	// Deleting a volume frees its namespace only, which the next volume is given
+	if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: allocated["pv-2"]}); err != nil {
+		t.Fatalf("DeleteVolume(pv-2): %v", err)
+	}
+	for _, name := range []string{"pv-1", "pv-3"} {
+		device, exists := c.deviceRegistry.GetDeviceByNQN(allocated[name])
+		if !exists || !device.IsAllocated || device.VolName != name {
+			t.Errorf("namespace %s of %s = %+v once pv-2 deleted, want it still allocated", allocated[name], name, device)
+		}
+	}
+	resp, err := c.CreateVolume(ctx, createRequest("pv-4", namespaces))
+	if err != nil {
+		t.Fatalf("CreateVolume(pv-4): %v", err)
+	}
+	if got := resp.GetVolume().GetVolumeId(); got != allocated["pv-2"] {
+		t.Errorf("CreateVolume(pv-4) = %s, want the freed %s", got, allocated["pv-2"])
+	}
+
+	// A retried CreateVolume gets its own namespace back
+	resp, err = c.CreateVolume(ctx, createRequest("pv-1", namespaces))
+	if err != nil || resp.GetVolume().GetVolumeId() != allocated["pv-1"] {
+		t.Errorf("retried CreateVolume(pv-1) = %s, %v, want %s", resp.GetVolume().GetVolumeId(), err, allocated["pv-1"])
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// stagedDeviceSize returns the size of the device at devicePath, which may be
+// a link to it, from its sysfs size attribute
+func stagedDeviceSize(devicePath string) (int64, error) {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return readSysfsSize(resolved)
+}
+
+// recordDeviceSize caches the size of the device staged for volumeID, as read
+// from sysfs, so that the capacity reported for the volume is the actual one
+// rather than the size the PV claims
+func (n *NodeServer) recordDeviceSize(volumeID, devicePath string) {
+	size, err := stagedDeviceSize(devicePath)
+	if err != nil {
+		klog.Warningf("Cannot read the size of device %s of volume %s: %v", devicePath, volumeID, err)
+		return
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	klog.V(4).Infof("Device %s of volume %s has %d bytes", devicePath, volumeID, size)
+	n.deviceSizes[volumeID] = size
+}
+
+// updateDeviceSize replaces the cached size of the device of a staged volume,
+// e.g. once it is expanded
+func (n *NodeServer) updateDeviceSize(volumeID string, size int64) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if _, staged := n.deviceSizes[volumeID]; staged {
+		n.deviceSizes[volumeID] = size
+	}
+}
+
+// forgetDeviceSize drops the cached size of the device of an unstaged volume
+func (n *NodeServer) forgetDeviceSize(volumeID string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	delete(n.deviceSizes, volumeID)
+}
+
+// deviceSize returns the cached size of the device staged for volumeID
+func (n *NodeServer) deviceSize(volumeID string) (int64, bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	size, exists := n.deviceSizes[volumeID]
+	return size, exists
+}
+
+// blockVolumeUsage returns the usage of a block volume published at
+// volumePath from the cached device size, false for filesystem volumes and
+// devices staged before the plugin started
+func (n *NodeServer) blockVolumeUsage(volumeID, volumePath string) ([]*csi.VolumeUsage, bool) {
+	size, exists := n.deviceSize(volumeID)
+	if !exists {
+		return nil, false
+	}
+	if info, err := os.Stat(volumePath); err != nil || info.IsDir() {
+		return nil, false
+	}
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: size,
+		},
+	}, true
+}
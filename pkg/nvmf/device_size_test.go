@@ -0,0 +1,127 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestRecordDeviceSize(t *testing.T) {
+	tests := []struct {
+		name string
+		// sectors is the content of the sysfs size attribute, none if empty
+		sectors    string
+		wantCached bool
+		want       int64
+	}{
+		{name: "sysfs size", sectors: "8388608\n", wantCached: true, want: 4 << 30},
+		{name: "no size attribute"},
+		{name: "invalid size attribute", sectors: "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFakeNullDevice(t)
+			if test.sectors != "" {
+				if err := os.WriteFile(filepath.Join(sysfsBlockDir, "null", "size"), []byte(test.sectors), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			devicePath, err := namespaceDevicePath(testVolumeNqn, 1)
+			if err != nil {
+				t.Fatalf("namespaceDevicePath: %v", err)
+			}
+			n := newTestNodeServer(newFakeNvmeClient())
+			volumeID := formatVolumeID(testVolumeNqn, 1)
+
+			// The size is read through the link the device is staged from
+			n.recordDeviceSize(volumeID, devicePath)
+			size, cached := n.deviceSize(volumeID)
+			if cached != test.wantCached || size != test.want {
+				t.Errorf("cached size = %d, %v, want %d, %v", size, cached, test.want, test.wantCached)
+			}
+		})
+	}
+}
+
+func TestBlockVolumeUsage(t *testing.T) {
+	const size = 4 << 30
+
+	tests := []struct {
+		name string
+		// staged records the device size of the volume at stage
+		staged bool
+		// expanded is the size the device is expanded to after the stage
+		expanded int64
+		// unstaged unstages the volume again
+		unstaged bool
+		// dir publishes the volume at a directory, as a filesystem volume
+		dir       bool
+		wantUsage bool
+		want      int64
+	}{
+		{name: "staged block volume", staged: true, wantUsage: true, want: size},
+		{name: "expanded block volume", staged: true, expanded: 2 * size, wantUsage: true, want: 2 * size},
+		{name: "filesystem volume", staged: true, dir: true},
+		{name: "staged before the plugin started"},
+		{name: "expanded before the plugin started", expanded: 2 * size},
+		{name: "unstaged volume", staged: true, unstaged: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNodeServer(newFakeNvmeClient())
+			volumeID := formatVolumeID(testVolumeNqn, 1)
+			volumePath := filepath.Join(t.TempDir(), "volume")
+			if test.dir {
+				if err := os.Mkdir(volumePath, 0750); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(volumePath, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.staged {
+				n.deviceSizes[volumeID] = size
+			}
+			if test.expanded > 0 {
+				n.updateDeviceSize(volumeID, test.expanded)
+			}
+			if test.unstaged {
+				n.forgetDeviceSize(volumeID)
+			}
+
+			usage, reported := n.blockVolumeUsage(volumeID, volumePath)
+			if reported != test.wantUsage {
+				t.Fatalf("blockVolumeUsage reported = %v, want %v", reported, test.wantUsage)
+			}
+			if !reported {
+				if _, cached := n.deviceSize(volumeID); cached && (test.unstaged || !test.staged) {
+					t.Error("size cached for a volume not staged by the plugin")
+				}
+				return
+			}
+			if len(usage) != 1 || usage[0].GetUnit() != csi.VolumeUsage_BYTES || usage[0].GetTotal() != test.want {
+				t.Errorf("usage = %v, want a total of %d bytes", usage, test.want)
+			}
+		})
+	}
+}
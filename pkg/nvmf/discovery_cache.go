@@ -0,0 +1,144 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// discoveryCache shares the devices found by a discovery with the discoveries
+// of the same discovery controllers running concurrently or started within
+// ttl, so that a burst of CreateVolume calls probes the fabric once. Failed
+// discoveries are not cached.
+type discoveryCache struct {
+	ttl time.Duration // 0 disables the cache
+
+	mutex sync.Mutex
+	calls map[string]*discoveryCall
+}
+
+// discoveryCall is a discovery in flight, or done at finished
+type discoveryCall struct {
+	done     chan struct{}
+	finished time.Time
+	devices  map[string]*nvmfDiskInfo
+	err      error
+}
+
+func newDiscoveryCache(ttl time.Duration) *discoveryCache {
+	return &discoveryCache{ttl: ttl, calls: make(map[string]*discoveryCall)}
+}
+
+// discoveryKey identifies the discovery controllers and namespaces a discovery queries
+func discoveryKey(params *VolumeParams, extra []string) string {
+	endpoints := append([]string{}, extra...)
+	sort.Strings(endpoints)
+
+	return strings.Join([]string{
+		params.Transport,
+		params.TargetAddr,
+		params.TargetPort,
+		fmt.Sprint(params.Namespaces),
+		strings.Join(endpoints, ","),
+	}, "|")
+}
+
+// discover returns the devices of the discovery run joined or cached for key,
+// or runs discover. force skips a cached result, but still joins a discovery
+// in flight, which started after the caller asked.
+func (c *discoveryCache) discover(ctx context.Context, key string, force bool, discover func() (map[string]*nvmfDiskInfo, error)) (map[string]*nvmfDiskInfo, error) {
+	if c == nil || c.ttl <= 0 {
+		return discover()
+	}
+
+	for {
+		c.mutex.Lock()
+		call, exists := c.calls[key]
+		if exists && !call.isDone() {
+			c.mutex.Unlock()
+			registryLog.V(4).Infof("Joining discovery in flight for %s", key)
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			// A discovery cancelled by its caller is retried by the others
+			if isContextError(call.err) && ctx.Err() == nil {
+				continue
+			}
+			return cloneDiscovered(call.devices), call.err
+		}
+		if exists && !force && call.err == nil && time.Since(call.finished) < c.ttl {
+			c.mutex.Unlock()
+			registryLog.V(4).Infof("Using discovery of %s from %v ago", key, time.Since(call.finished).Round(time.Millisecond))
+			return cloneDiscovered(call.devices), nil
+		}
+
+		call = &discoveryCall{done: make(chan struct{})}
+		c.calls[key] = call
+		c.mutex.Unlock()
+
+		devices, err := discover()
+
+		c.mutex.Lock()
+		call.devices, call.err, call.finished = devices, err, time.Now()
+		close(call.done)
+		if err != nil && c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mutex.Unlock()
+
+		return cloneDiscovered(devices), err
+	}
+}
+
+func (call *discoveryCall) isDone() bool {
+	select {
+	case <-call.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// isContextError reports whether err is the error of a done context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// cloneDiscovered copies discovered devices, since the registry keeps and
+// updates the devices it registers
+func cloneDiscovered(devices map[string]*nvmfDiskInfo) map[string]*nvmfDiskInfo {
+	if devices == nil {
+		return nil
+	}
+
+	clone := make(map[string]*nvmfDiskInfo, len(devices))
+	for id, device := range devices {
+		copied := *device
+		copied.Endpoints = append([]string{}, device.Endpoints...)
+		clone[id] = &copied
+	}
+
+	return clone
+}
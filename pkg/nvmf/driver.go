@@ -17,7 +17,15 @@ limitations under the License.
 package nvmf
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/client-go/kubernetes"
@@ -35,10 +43,99 @@ type driver struct {
 	volumeMapDir string
 	volumeLocks  *utils.VolumeLocks
 
+	volumeLockTimeout time.Duration
+
+	namespace             string
+	deviceFilterConfigMap string
+	deviceLabelsConfigMap string
+	exportDeviceLabels    []string // Names of the device labels exported to the volume context
+
+	reserveHeadroomPercent int
+
+	backend  Backend
+	metadata recordStore
+	// legacyMetadata holds the records stored without a prefix, to migrate
+	// under the configured prefix. nil unless migrating.
+	legacyMetadata recordStore
+
+	healthChecker string // HealthCheckerSysfs or HealthCheckerBackend
+
+	forceDeleteWithSnapshots bool
+	deleteRetries            int
+	deleteRetryInterval      time.Duration
+
+	volumeIDFormat string
+
+	selfTestNqn string // Device of the self-test, empty if the self-test is disabled
+	adminToken  []byte // Bearer token of the admin requests changing state, empty if they are refused
+
+	reclaimRetention time.Duration
+	recordRetention  time.Duration
+	recordGCInterval time.Duration
+	wipeOnDelete     bool
+
+	maxVolumesPerNode int64
+	maxIoQueues       int
+
+	probeDeviceCapacity bool
+	verifyDuplicateNqn  bool
+	reconcileInterval   time.Duration
+	hostAclInterval     time.Duration
+	warmPoolSize        int
+	warmPoolFsType      string
+	warmPoolInterval    time.Duration
+	freeDeviceWatermark *freeDeviceWatermark // nil unless a low watermark of free devices is set
+
+	events *eventRecorder // nil if event emission is disabled
+
+	nvme                 NvmeClient
+	nvmeCliTimeout       time.Duration
+	connectRetries       int32
+	connectRetryInterval time.Duration
+	deviceWaitTimeout    time.Duration
+	deviceReady          deviceReadyStrategy
+	grantTimeout         time.Duration
+
+	connectionMonitorInterval time.Duration // 0 if connection monitoring is disabled
+
+	fsckOnStageDefault bool // Overridden by the fsckOnStage parameter
+
+	cordonFile string // Marker file of a cordoned node, empty if not persisted
+
+	nodeStateFile string // Staging state of the node, empty if not persisted
+
+	ephemeralVolumes bool
+	ephemeralDir     string
+	ephemeralClaims  recordStore // Claims of the ephemeral volumes, nil if disabled
+
+	contextKeys keyWrapper // Wraps the data keys of sealed volume contexts, nil if disabled
+
+	hostNqnFile       string
+	hostNqnGeneration string // HostNqnGeneration* scheme of a missing host NQN
+	publishHostNqn    bool
+
+	// Discovery parameters applied to StorageClasses without a target address, nil if unset
+	discoveryDefaults map[string]string
+	defaultParameters map[string]string
+	strictParameters  bool
+
+	maxDiscoveryConcurrency int           // nvme discover invocations run at once
+	discoveryCacheTTL       time.Duration // Time the devices found by a discovery are reused, 0 if never
+	allocateRetry           bool
+
+	mdns *mdnsBrowser // nil if mDNS discovery is disabled
+
+	leaderElection *leaderElection // nil if leader election is disabled
+
+	tracerProvider *sdktrace.TracerProvider // nil if tracing is disabled
+
 	idServer         *IdentityServer
 	nodeServer       *NodeServer
 	controllerServer *ControllerServer
 
+	server    NonBlockingGRPCServer
+	apiHealth apiHealth
+
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 
@@ -52,15 +149,326 @@ func NewDriver(conf *GlobalConfig) *driver {
 		return nil
 	}
 
+	if conf.ReserveHeadroomPercent < 0 || conf.ReserveHeadroomPercent >= 100 {
+		klog.Fatalf("reserve-headroom-percent must be between 0 and 99, got: %d", conf.ReserveHeadroomPercent)
+		return nil
+	}
+	if conf.ReserveHeadroomPercent > 0 && !conf.ProbeDeviceCapacity {
+		klog.Fatalf("reserve-headroom-percent requires probe-device-capacity, without which the capacity of the devices is unknown")
+		return nil
+	}
+
+	if conf.VolumeLockTimeout < 0 {
+		klog.Fatalf("volume-lock-timeout must not be negative, got: %v", conf.VolumeLockTimeout)
+		return nil
+	}
+
+	if conf.GrantTimeout <= 0 {
+		klog.Fatalf("grant-timeout must be positive, got: %v", conf.GrantTimeout)
+		return nil
+	}
+
+	connectionMonitorInterval := time.Duration(0)
+	if conf.ConnectionMonitor {
+		if conf.ConnectionMonitorInterval <= 0 {
+			klog.Fatalf("connection-monitor-interval must be positive, got: %v", conf.ConnectionMonitorInterval)
+			return nil
+		}
+		connectionMonitorInterval = conf.ConnectionMonitorInterval
+	}
+
+	if conf.ReconcileInterval != 0 && conf.ReconcileInterval < minReconcileInterval {
+		klog.Fatalf("reconcile-interval must be 0 or at least %v, got: %v", minReconcileInterval, conf.ReconcileInterval)
+		return nil
+	}
+
+	if conf.HostAclInterval < 0 {
+		klog.Fatalf("host-acl-interval must not be negative, got: %v", conf.HostAclInterval)
+		return nil
+	}
+
+	if conf.EphemeralVolumes && conf.EphemeralDir == "" {
+		klog.Fatalf("ephemeral-volumes requires an ephemeral-dir")
+		return nil
+	}
+	// Nodes claim devices through the record store the controller reads
+	if conf.EphemeralVolumes && isLocalPersistence(conf.Persistence) {
+		klog.Fatalf("ephemeral-volumes requires a record store shared with the nodes, not %s persistence", conf.Persistence)
+		return nil
+	}
+	if conf.EphemeralVolumes && conf.EphemeralNamespace == "" {
+		klog.Fatalf("ephemeral-volumes requires an ephemeral-namespace")
+		return nil
+	}
+
+	if conf.WarmPoolSize < 0 {
+		klog.Fatalf("warm-pool-size must not be negative, got: %d", conf.WarmPoolSize)
+		return nil
+	}
+	if conf.WarmPoolSize > 0 && (conf.WarmPoolFsType == "" || !isSupportedFsType(conf.WarmPoolFsType)) {
+		klog.Fatalf("unsupported warm-pool-fs-type: %q", conf.WarmPoolFsType)
+		return nil
+	}
+	if conf.WarmPoolSize > 0 && conf.WarmPoolInterval <= 0 {
+		klog.Fatalf("warm-pool-interval must be positive with a warm pool, got: %v", conf.WarmPoolInterval)
+		return nil
+	}
+
+	freeDeviceWatermark, err := parseFreeDeviceWatermark(conf.FreeDeviceLowWatermark, conf.FreeDeviceAlertWebhook)
+	if err != nil {
+		klog.Fatalf("%v", err)
+		return nil
+	}
+
+	for name, level := range map[string]int{
+		"v-registry": conf.RegistryVerbosity,
+		"v-nvme":     conf.NvmeVerbosity,
+		"v-etcd":     conf.EtcdVerbosity,
+	} {
+		if level < FollowGlobalVerbosity {
+			klog.Fatalf("%s must be %d or a verbosity level, got: %d", name, FollowGlobalVerbosity, level)
+			return nil
+		}
+	}
+	registryLog.setVerbosity(conf.RegistryVerbosity)
+	nvmeLog.setVerbosity(conf.NvmeVerbosity)
+	etcdLog.setVerbosity(conf.EtcdVerbosity)
+
+	if conf.MaxIoQueues < 0 {
+		klog.Fatalf("max-io-queues must not be negative, got: %d", conf.MaxIoQueues)
+		return nil
+	}
+
+	if conf.MaxVolumesPerNode < 0 {
+		klog.Fatalf("max-volumes-per-node must not be negative, got: %d", conf.MaxVolumesPerNode)
+		return nil
+	}
+
+	if conf.ReclaimRetention < 0 {
+		klog.Fatalf("reclaim-retention must not be negative, got: %v", conf.ReclaimRetention)
+		return nil
+	}
+	if conf.RecordRetention < 0 {
+		klog.Fatalf("record-retention must not be negative, got: %v", conf.RecordRetention)
+		return nil
+	}
+	if conf.RecordRetention > 0 && conf.RecordGCInterval <= 0 {
+		klog.Fatalf("record-gc-interval must be positive with a record retention, got: %v", conf.RecordGCInterval)
+		return nil
+	}
+
+	if conf.DeviceWaitTimeout <= 0 {
+		klog.Fatalf("device-wait-timeout must be positive, got: %v", conf.DeviceWaitTimeout)
+		return nil
+	}
+	deviceReady, err := newDeviceReadyStrategy(conf.DeviceReadyStrategy)
+	if err != nil {
+		klog.Fatalf("%v", err)
+		return nil
+	}
+
+	if conf.ConnectRetries < 0 || conf.ConnectRetryInterval < 0 {
+		klog.Fatalf("connect-retries and connect-retry-interval must not be negative, got: %d, %v", conf.ConnectRetries, conf.ConnectRetryInterval)
+		return nil
+	}
+
+	if conf.DeleteRetries < 0 || conf.DeleteRetryInterval < 0 {
+		klog.Fatalf("delete-retries and delete-retry-interval must not be negative, got: %d, %v", conf.DeleteRetries, conf.DeleteRetryInterval)
+		return nil
+	}
+
+	if conf.MaxDiscoveryConcurrency < 1 {
+		klog.Fatalf("max-discovery-concurrency must be at least 1, got: %d", conf.MaxDiscoveryConcurrency)
+		return nil
+	}
+	if conf.DiscoveryCacheTTL < 0 {
+		klog.Fatalf("discovery-cache-ttl must not be negative, got: %v", conf.DiscoveryCacheTTL)
+		return nil
+	}
+
+	if transport := strings.ToLower(conf.DiscoveryTransport); conf.DiscoveryAddress != "" && transport != "tcp" && transport != "rdma" {
+		klog.Fatalf("discovery-transport must be tcp or rdma, got: %s", conf.DiscoveryTransport)
+		return nil
+	}
+
 	klog.Infof("Driver: %v version: %v", conf.DriverName, conf.Version)
 
 	// Create kubernetes client
-	kubeClient, err := utils.GetK8sClient()
+	kubeOptions, err := kubeClientOptions(conf)
+	if err != nil {
+		klog.Fatalf("Invalid API server connection options: %v", err)
+		return nil
+	}
+	kubeClient, err := utils.NewK8sClient(kubeOptions)
 	if err != nil {
 		klog.Fatalf("Failed to create kubernetes client: %v", err)
 		return nil
 	}
 
+	metadata, err := newRecordStore(conf, kubeClient)
+	if err != nil {
+		klog.Fatalf("Failed to create record store: %v", err)
+		return nil
+	}
+	if isLocalPersistence(conf.Persistence) && conf.IsControllerServer {
+		klog.Warningf("Records are persisted in %s, the controller must run as a single replica", conf.PersistencePath)
+	}
+	// The records stored without a prefix are migrated by the leader, once
+	// it leads, so that standbys never move records the leader serves
+	var legacyMetadata recordStore
+	if conf.EtcdPrefixMigrate && conf.EtcdPrefix != "" && conf.IsControllerServer {
+		if legacyMetadata, err = newPrefixedRecordStore(conf, kubeClient, ""); err != nil {
+			klog.Fatalf("Failed to create record store without prefix: %v", err)
+			return nil
+		}
+	}
+	// The claims are kept apart from the other records, so that the nodes
+	// only write the ConfigMaps of the ephemeral namespace
+	var ephemeralClaims recordStore
+	if conf.EphemeralVolumes {
+		ephemeralClaims = newMetadataStore(kubeClient, conf.EphemeralNamespace, conf.DriverName, conf.EtcdPrefix)
+	}
+
+	backend, err := newBackend(conf)
+	if err != nil {
+		klog.Fatalf("Failed to create backend: %v", err)
+		return nil
+	}
+	klog.Infof("Using backend: %s", backend.Name())
+
+	if _, ok := backend.(Wiper); conf.WipeOnDelete && !(ok && backend.Supports(BackendCapabilityWipe)) {
+		klog.Fatalf("wipe-on-delete requires a backend with the %s capability, backend %s has none", BackendCapabilityWipe, backend.Name())
+		return nil
+	}
+	switch conf.HealthChecker {
+	case "", HealthCheckerSysfs:
+	case HealthCheckerBackend:
+		if _, ok := backend.(HealthReporter); !(ok && backend.Supports(BackendCapabilityHealth)) {
+			klog.Fatalf("health-checker %s requires a backend with the %s capability, backend %s has none", HealthCheckerBackend, BackendCapabilityHealth, backend.Name())
+			return nil
+		}
+	default:
+		klog.Fatalf("Unsupported health-checker %q, must be %s or %s", conf.HealthChecker, HealthCheckerSysfs, HealthCheckerBackend)
+		return nil
+	}
+
+	switch conf.HostNqnGeneration {
+	case "", HostNqnGenerationNone, HostNqnGenerationUUID, HostNqnGenerationName:
+	default:
+		klog.Fatalf("Unsupported host-nqn-generation %q, must be %s, %s or %s", conf.HostNqnGeneration, HostNqnGenerationNone, HostNqnGenerationUUID, HostNqnGenerationName)
+		return nil
+	}
+
+	contextKeys, err := newKeyWrapper(conf.VolumeContextKey)
+	if err != nil {
+		klog.Fatalf("Invalid volume-context-key: %v", err)
+		return nil
+	}
+
+	adminToken, err := loadAdminToken(conf.AdminTokenFile)
+	if err != nil {
+		klog.Fatalf("Invalid admin-token-file: %v", err)
+		return nil
+	}
+
+	var events *eventRecorder
+	if conf.EmitEvents {
+		events = newEventRecorder(kubeClient, conf.DriverName)
+	}
+
+	var discoveryDefaults map[string]string
+	if conf.DiscoveryAddress != "" {
+		discoveryDefaults = map[string]string{
+			paramAddr: conf.DiscoveryAddress,
+			paramPort: conf.DiscoveryPort,
+			paramType: conf.DiscoveryTransport,
+		}
+		klog.Infof("Using discovery service %s:%s (%s) for StorageClasses without a target address", conf.DiscoveryAddress, conf.DiscoveryPort, conf.DiscoveryTransport)
+	}
+
+	if len(conf.DefaultParameters) > 0 {
+		klog.Infof("Using default StorageClass parameters: %v", conf.DefaultParameters)
+	}
+
+	var mdns *mdnsBrowser
+	if conf.MDNSDiscovery {
+		if conf.MDNSInterval <= 0 {
+			klog.Fatalf("mdns-interval must be positive, got: %v", conf.MDNSInterval)
+			return nil
+		}
+		mdns = newMDNSBrowser(conf.MDNSInterval, mdnsQueryTimeout)
+		// StorageClasses without a target address rely on the advertised controllers
+		if discoveryDefaults == nil {
+			discoveryDefaults = map[string]string{paramType: conf.DiscoveryTransport}
+		}
+	}
+
+	exportDeviceLabels := []string{}
+	for _, name := range strings.Split(conf.ExportDeviceLabels, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !validLabelName.MatchString(name) {
+			klog.Fatalf("export-device-labels holds an invalid label name: %q", name)
+			return nil
+		}
+		exportDeviceLabels = append(exportDeviceLabels, name)
+	}
+
+	switch conf.VolumeIDFormat {
+	case VolumeIDFormatNQN, VolumeIDFormatOpaque:
+	default:
+		klog.Fatalf("volume-id-format must be %s or %s, got: %s", VolumeIDFormatNQN, VolumeIDFormatOpaque, conf.VolumeIDFormat)
+		return nil
+	}
+
+	selfTestNqn := ""
+	if conf.SelfTest {
+		if !conf.IsControllerServer {
+			klog.Fatalf("self-test requires IsControllerServer")
+			return nil
+		}
+		if !isValidVolumeNQN(conf.SelfTestNqn) {
+			klog.Fatalf("self-test requires self-test-nqn to be a valid NQN, got: %q", conf.SelfTestNqn)
+			return nil
+		}
+		selfTestNqn = conf.SelfTestNqn
+		klog.Warningf("Self-test is enabled, POST /selftest overwrites the content of %s", selfTestNqn)
+	}
+
+	if conf.DeadlineMargin < 0 {
+		klog.Fatalf("deadline-margin must not be negative, got: %v", conf.DeadlineMargin)
+		return nil
+	}
+
+	var election *leaderElection
+	var tracerProvider *sdktrace.TracerProvider
+	var interceptors []grpc.UnaryServerInterceptor
+	if conf.Tracing {
+		provider, err := newTracerProvider(context.Background(), conf.DriverName)
+		if err != nil {
+			klog.Fatalf("Failed to set up tracing: %v", err)
+			return nil
+		}
+		setTracerProvider(provider)
+		tracerProvider = provider
+		interceptors = append(interceptors, tracingInterceptor)
+	}
+	if conf.DeadlineMargin > 0 {
+		interceptors = append(interceptors, deadlineInterceptor(conf.DeadlineMargin))
+	}
+	if conf.LeaderElection {
+		if !conf.IsControllerServer {
+			klog.Fatalf("leader-election requires IsControllerServer")
+			return nil
+		}
+		if election, err = newLeaderElection(kubeClient, conf); err != nil {
+			klog.Fatalf("Failed to set up leader election: %v", err)
+			return nil
+		}
+		interceptors = append(interceptors, election.unaryInterceptor)
+	}
+
 	return &driver{
 		name:         conf.DriverName,
 		version:      conf.Version,
@@ -68,29 +476,326 @@ func NewDriver(conf *GlobalConfig) *driver {
 		region:       conf.Region,
 		volumeMapDir: conf.NVMfVolumeMapDir,
 		volumeLocks:  utils.NewVolumeLocks(),
-		kubeClient:   kubeClient,
+
+		volumeLockTimeout: conf.VolumeLockTimeout,
+		kubeClient:        kubeClient,
+		server:            NewNonBlockingGRPCServer(interceptors...),
+
+		namespace:             conf.Namespace,
+		deviceFilterConfigMap: conf.DeviceFilterConfigMap,
+		deviceLabelsConfigMap: conf.DeviceLabelsConfigMap,
+		exportDeviceLabels:    exportDeviceLabels,
+
+		reserveHeadroomPercent: conf.ReserveHeadroomPercent,
+
+		backend:  backend,
+		metadata: metadata,
+
+		legacyMetadata: legacyMetadata,
+
+		healthChecker: conf.HealthChecker,
+
+		forceDeleteWithSnapshots: conf.ForceDeleteWithSnapshots,
+		deleteRetries:            conf.DeleteRetries,
+		deleteRetryInterval:      conf.DeleteRetryInterval,
+		volumeIDFormat:           conf.VolumeIDFormat,
+
+		selfTestNqn: selfTestNqn,
+		adminToken:  adminToken,
+
+		reclaimRetention: conf.ReclaimRetention,
+		recordRetention:  conf.RecordRetention,
+		recordGCInterval: conf.RecordGCInterval,
+		wipeOnDelete:     conf.WipeOnDelete,
+
+		maxVolumesPerNode: conf.MaxVolumesPerNode,
+		maxIoQueues:       conf.MaxIoQueues,
+
+		probeDeviceCapacity: conf.ProbeDeviceCapacity,
+		verifyDuplicateNqn:  conf.VerifyDuplicateNqn,
+		reconcileInterval:   conf.ReconcileInterval,
+		hostAclInterval:     conf.HostAclInterval,
+		warmPoolSize:        conf.WarmPoolSize,
+		warmPoolFsType:      conf.WarmPoolFsType,
+		warmPoolInterval:    conf.WarmPoolInterval,
+		freeDeviceWatermark: freeDeviceWatermark,
+
+		events: events,
+
+		nvme:                 newExecNvmeClient(),
+		nvmeCliTimeout:       conf.NvmeCliTimeout,
+		connectRetries:       int32(conf.ConnectRetries),
+		connectRetryInterval: conf.ConnectRetryInterval,
+		deviceWaitTimeout:    conf.DeviceWaitTimeout,
+		deviceReady:          deviceReady,
+		grantTimeout:         conf.GrantTimeout,
+
+		connectionMonitorInterval: connectionMonitorInterval,
+
+		fsckOnStageDefault: conf.FsckOnStage,
+		cordonFile:         conf.CordonFile,
+		nodeStateFile:      conf.NodeStateFile,
+
+		ephemeralVolumes: conf.EphemeralVolumes,
+		ephemeralDir:     conf.EphemeralDir,
+		ephemeralClaims:  ephemeralClaims,
+
+		contextKeys: contextKeys,
+
+		hostNqnFile:       conf.HostNqnFile,
+		hostNqnGeneration: conf.HostNqnGeneration,
+		publishHostNqn:    conf.PublishHostNqn,
+
+		discoveryDefaults: discoveryDefaults,
+		defaultParameters: conf.DefaultParameters,
+		strictParameters:  conf.StrictParameters,
+
+		maxDiscoveryConcurrency: conf.MaxDiscoveryConcurrency,
+		discoveryCacheTTL:       conf.DiscoveryCacheTTL,
+		allocateRetry:           conf.AllocateRetry,
+
+		leaderElection: election,
+		tracerProvider: tracerProvider,
+		mdns:           mdns,
 	}
 }
 
+// withDefaults returns the parameters of a request merged over the default
+// parameters, then completed with the discovery defaults. Parameters the
+// request leaves empty take the default.
+func (d *driver) withDefaults(parameters map[string]string) map[string]string {
+	if len(d.defaultParameters) == 0 {
+		return d.withDiscoveryDefaults(parameters)
+	}
+
+	merged := make(map[string]string, len(parameters)+len(d.defaultParameters))
+	for key, value := range d.defaultParameters {
+		merged[key] = value
+	}
+	for key, value := range parameters {
+		if value != "" {
+			merged[key] = value
+		}
+	}
+
+	return d.withDiscoveryDefaults(merged)
+}
+
+// withDiscoveryDefaults returns the parameters of a request, completed with the
+// configured discovery service if they carry no target address
+func (d *driver) withDiscoveryDefaults(parameters map[string]string) map[string]string {
+	if d.discoveryDefaults == nil || parameters[paramAddr] != "" {
+		return parameters
+	}
+
+	merged := make(map[string]string, len(parameters)+len(d.discoveryDefaults))
+	for key, value := range d.discoveryDefaults {
+		merged[key] = value
+	}
+	for key, value := range parameters {
+		if value != "" {
+			merged[key] = value
+		}
+	}
+
+	return merged
+}
+
+// acquireLock takes the volume lock of lockID, waiting up to the configured
+// timeout for a concurrent operation on the kind named name to finish
+func (d *driver) acquireLock(ctx context.Context, lockID, kind, name string) error {
+	if d.volumeLockTimeout == 0 {
+		if !d.volumeLocks.TryAcquire(lockID) {
+			return status.Errorf(codes.Aborted, "concurrent operation in progress for %s: %s", kind, name)
+		}
+		return nil
+	}
+
+	if err := d.volumeLocks.AcquireWithTimeout(ctx, lockID, d.volumeLockTimeout); err != nil {
+		if st := contextStatus(ctx.Err()); st != nil {
+			return st
+		}
+		return status.Errorf(codes.Aborted, "concurrent operation in progress for %s: %s, still running after %v", kind, name, d.volumeLockTimeout)
+	}
+	return nil
+}
+
+// connectOptions returns the settings used by the node to establish NVMe-oF controllers
+func (d *driver) connectOptions() connectOptions {
+	return connectOptions{
+		Timeout:       d.nvmeCliTimeout,
+		Retries:       d.connectRetries,
+		RetryInterval: d.connectRetryInterval,
+		DeviceWait:    d.deviceWaitTimeout,
+		DeviceReady:   d.deviceReady,
+	}
+}
+
+// kubeClientOptions returns the API server connection options of the configuration
+func kubeClientOptions(conf *GlobalConfig) (utils.K8sClientOptions, error) {
+	opts := utils.K8sClientOptions{
+		CAFile:   conf.KubeAPICAFile,
+		CertFile: conf.KubeAPICertFile,
+		KeyFile:  conf.KubeAPIKeyFile,
+		Username: conf.KubeAPIUsername,
+	}
+	for _, endpoint := range strings.Split(conf.KubeAPIEndpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			opts.Endpoints = append(opts.Endpoints, endpoint)
+		}
+	}
+	if conf.KubeAPIPasswordFile != "" {
+		password, err := os.ReadFile(conf.KubeAPIPasswordFile)
+		if err != nil {
+			return opts, fmt.Errorf("failed to read password file: %v", err)
+		}
+		opts.Password = strings.TrimSpace(string(password))
+	}
+
+	return opts, opts.Validate()
+}
+
 func (d *driver) Run(conf *GlobalConfig) {
-	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	if version, err := nvmeCliVersion(d.nvmeCliTimeout); err != nil {
+		klog.Warningf("Failed to detect the nvme-cli version: %v", err)
+	} else {
+		klog.Infof("Using %s", version)
+	}
+
+	controllerCaps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-	})
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+	}
+	if _, ok := d.snapshotter(); ok {
+		controllerCaps = append(controllerCaps,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		)
+	}
+	if _, ok := d.cloner(); ok {
+		controllerCaps = append(controllerCaps, csi.ControllerServiceCapability_RPC_CLONE_VOLUME)
+	}
+	d.AddControllerServiceCapabilities(controllerCaps)
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
 	})
 
 	d.idServer = NewIdentityServer(d)
 	d.nodeServer = NewNodeServer(d)
+	if conf.OrphanCleanup {
+		cleanupOrphanedConnections(KUBELET_CSI_DIR, d.nvmeCliTimeout)
+	}
 	if conf.IsControllerServer {
+		if d.leaderElection != nil {
+			d.leaderElection.start()
+		}
 		d.controllerServer = NewControllerServer(d)
+		if d.mdns != nil {
+			go d.mdns.run()
+		}
 	}
 
 	klog.Infof("Starting csi-plugin Driver: %v", d.name)
-	s := NewNonBlockingGRPCServer()
-	s.Start(conf.Endpoint, d.idServer, d.controllerServer, d.nodeServer)
-	s.Wait()
+	d.server.Start(conf.Endpoint, d.idServer, d.controllerServer, d.nodeServer)
+	d.server.Wait()
+}
+
+// Shutdown stops accepting new RPCs and waits up to gracePeriod for in-flight
+// calls to finish. Registry and metadata writes are synchronous within each call,
+// so once the calls have returned only the queued spans are left to flush.
+func (d *driver) Shutdown(gracePeriod time.Duration) {
+	klog.Infof("Shutting down csi-plugin Driver: %v, grace period %v", d.name, gracePeriod)
+	if d.mdns != nil {
+		d.mdns.stop()
+	}
+	deadline := time.Now().Add(gracePeriod)
+
+	stopped := make(chan struct{})
+	go func() {
+		d.server.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		klog.Info("All in-flight RPCs completed")
+	case <-time.After(gracePeriod):
+		klog.Warningf("In-flight RPCs did not complete within %v, forcing stop", gracePeriod)
+		d.server.ForceStop()
+	}
+
+	if held := d.volumeLocks.WaitForIdle(time.Until(deadline)); len(held) > 0 {
+		klog.Warningf("Volume locks still held at shutdown: %v", held)
+	}
+
+	// Release the lease once no RPC is left, so that a standby takes over
+	if d.leaderElection != nil {
+		d.leaderElection.stop()
+	}
+
+	// Export the spans of the last RPCs
+	if d.tracerProvider != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		if err := d.tracerProvider.Shutdown(ctx); err != nil {
+			klog.Warningf("Failed to export the remaining spans: %v", err)
+		}
+	}
+}
+
+// snapshotter returns the backend Snapshotter if the backend supports snapshots
+func (d *driver) snapshotter() (Snapshotter, bool) {
+	snapshotter, ok := d.backend.(Snapshotter)
+	return snapshotter, ok && d.backend.Supports(BackendCapabilitySnapshot)
+}
+
+// cloner returns the backend Cloner if the backend supports cloning
+func (d *driver) cloner() (Cloner, bool) {
+	cloner, ok := d.backend.(Cloner)
+	return cloner, ok && d.backend.Supports(BackendCapabilityClone)
+}
+
+// granter returns the backend NodeGranter if the backend controls node access
+func (d *driver) granter() (NodeGranter, bool) {
+	granter, ok := d.backend.(NodeGranter)
+	return granter, ok && d.backend.Supports(BackendCapabilityGrant)
+}
+
+// hostAclManager returns the backend HostAclManager if the backend manages host allowlists
+func (d *driver) hostAclManager() (HostAclManager, bool) {
+	manager, ok := d.backend.(HostAclManager)
+	return manager, ok && d.backend.Supports(BackendCapabilityHostAcl)
+}
+
+// namespaceProvisioner returns the backend NamespaceProvisioner if the backend creates namespaces
+func (d *driver) namespaceProvisioner() (NamespaceProvisioner, bool) {
+	provisioner, ok := d.backend.(NamespaceProvisioner)
+	return provisioner, ok && d.backend.Supports(BackendCapabilityProvision)
+}
+
+// healthReporter returns the backend HealthReporter if the backend reports volume health
+func (d *driver) healthReporter() (HealthReporter, bool) {
+	reporter, ok := d.backend.(HealthReporter)
+	return reporter, ok && d.backend.Supports(BackendCapabilityHealth)
+}
+
+// qosApplier returns the backend QoSApplier if the backend applies I/O limits
+func (d *driver) qosApplier() (QoSApplier, bool) {
+	applier, ok := d.backend.(QoSApplier)
+	return applier, ok && d.backend.Supports(BackendCapabilityQoS)
+}
+
+// wiper returns the backend Wiper if the backend supports wiping
+func (d *driver) wiper() (Wiper, bool) {
+	wiper, ok := d.backend.(Wiper)
+	return wiper, ok && d.backend.Supports(BackendCapabilityWipe)
 }
 
 func (d *driver) AddVolumeCapabilityAccessModes(caps []csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability_AccessMode {
@@ -0,0 +1,281 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// slowControllerServer holds the volume lock of each CreateVolume for delay
+type slowControllerServer struct {
+	csi.UnimplementedControllerServer
+	locks   *utils.VolumeLocks
+	delay   time.Duration
+	started chan struct{}
+}
+
+func (s *slowControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	s.locks.Acquire(req.Name)
+	defer s.locks.Release(req.Name)
+	close(s.started)
+
+	time.Sleep(s.delay)
+	return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: testVolumeNqn}}, nil
+}
+
+func TestShutdownDrainsInFlightRPCs(t *testing.T) {
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		gracePeriod time.Duration
+		want        codes.Code
+	}{
+		{name: "call completes within the grace period", delay: 300 * time.Millisecond, gracePeriod: 5 * time.Second, want: codes.OK},
+		{name: "call outlives the grace period", delay: 3 * time.Second, gracePeriod: 200 * time.Millisecond, want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "csi.sock")
+			d := &driver{
+				name:        DefaultDriverName,
+				volumeLocks: utils.NewVolumeLocks(),
+				server:      NewNonBlockingGRPCServer(),
+			}
+			controller := &slowControllerServer{locks: d.volumeLocks, delay: test.delay, started: make(chan struct{})}
+			d.server.Start("unix://"+strings.TrimPrefix(socket, "/"), nil, controller, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := grpc.DialContext(ctx, "unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+
+			result := make(chan error, 1)
+			go func() {
+				_, err := csi.NewControllerClient(conn).CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "pvc-1"})
+				result <- err
+			}()
+			<-controller.started
+
+			start := time.Now()
+			d.Shutdown(test.gracePeriod)
+			elapsed := time.Since(start)
+
+			select {
+			case err := <-result:
+				if got := status.Code(err); got != test.want {
+					t.Errorf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("CreateVolume is still running after the shutdown")
+			}
+			if elapsed > test.gracePeriod+time.Second {
+				t.Errorf("Shutdown took %v, beyond the grace period of %v", elapsed, test.gracePeriod)
+			}
+			d.server.Wait()
+		})
+	}
+}
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		releaseIn time.Duration
+		cancelIn  time.Duration
+		want      codes.Code
+	}{
+		{name: "immediate fail", timeout: 0, releaseIn: 50 * time.Millisecond, want: codes.Aborted},
+		{name: "wait then acquire", timeout: time.Second, releaseIn: 50 * time.Millisecond, want: codes.OK},
+		{name: "wait then timeout", timeout: 100 * time.Millisecond, want: codes.Aborted},
+		{name: "request cancelled while waiting", timeout: time.Second, cancelIn: 50 * time.Millisecond, want: codes.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &driver{volumeLocks: utils.NewVolumeLocks(), volumeLockTimeout: test.timeout}
+			d.volumeLocks.Acquire("pv-1")
+			if test.releaseIn > 0 {
+				time.AfterFunc(test.releaseIn, func() { d.volumeLocks.Release("pv-1") })
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelIn > 0 {
+				time.AfterFunc(test.cancelIn, cancel)
+			}
+
+			err := d.acquireLock(ctx, "pv-1", "volume", "pv-1")
+			if got := status.Code(err); got != test.want {
+				t.Errorf("acquireLock code = %v, want %v: %v", got, test.want, err)
+			}
+		})
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	tests := []struct {
+		name              string
+		defaults          map[string]string
+		discoveryDefaults map[string]string
+		parameters        map[string]string
+		want              map[string]string
+	}{
+		{
+			name:       "no defaults",
+			parameters: map[string]string{paramAddr: "192.0.2.10"},
+			want:       map[string]string{paramAddr: "192.0.2.10"},
+		},
+		{
+			name:       "empty request inherits all defaults",
+			defaults:   map[string]string{paramAddr: "192.0.2.10", paramPort: "4420", paramType: "tcp"},
+			parameters: map[string]string{},
+			want:       map[string]string{paramAddr: "192.0.2.10", paramPort: "4420", paramType: "tcp"},
+		},
+		{
+			name:       "request takes precedence",
+			defaults:   map[string]string{paramAddr: "192.0.2.10", paramType: "tcp"},
+			parameters: map[string]string{paramType: "rdma", paramFsType: "xfs"},
+			want:       map[string]string{paramAddr: "192.0.2.10", paramType: "rdma", paramFsType: "xfs"},
+		},
+		{
+			name:       "empty request value takes the default",
+			defaults:   map[string]string{paramType: "tcp"},
+			parameters: map[string]string{paramType: ""},
+			want:       map[string]string{paramType: "tcp"},
+		},
+		{
+			name:              "discovery defaults complete the defaults",
+			defaults:          map[string]string{paramFsType: "xfs"},
+			discoveryDefaults: map[string]string{paramAddr: "192.0.2.20", paramPort: "8009"},
+			parameters:        map[string]string{},
+			want:              map[string]string{paramAddr: "192.0.2.20", paramPort: "8009", paramFsType: "xfs"},
+		},
+		{
+			name:              "default address overrides the discovery service",
+			defaults:          map[string]string{paramAddr: "192.0.2.10"},
+			discoveryDefaults: map[string]string{paramAddr: "192.0.2.20", paramPort: "8009"},
+			parameters:        map[string]string{},
+			want:              map[string]string{paramAddr: "192.0.2.10"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &driver{defaultParameters: test.defaults, discoveryDefaults: test.discoveryDefaults}
+			if got := d.withDefaults(test.parameters); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("withDefaults(%v) = %v, want %v", test.parameters, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKubeClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		conf    GlobalConfig
+		want    utils.K8sClientOptions
+		wantErr bool
+	}{
+		{name: "no options"},
+		{
+			name: "endpoints",
+			conf: GlobalConfig{KubeAPIEndpoints: " https://192.0.2.1:6443,,https://192.0.2.2:6443 "},
+			want: utils.K8sClientOptions{Endpoints: []string{"https://192.0.2.1:6443", "https://192.0.2.2:6443"}},
+		},
+		{
+			name: "basic authentication",
+			conf: GlobalConfig{KubeAPIUsername: "csi", KubeAPIPasswordFile: passwordFile},
+			want: utils.K8sClientOptions{Username: "csi", Password: "secret"},
+		},
+		{name: "missing password file", conf: GlobalConfig{KubeAPIUsername: "csi", KubeAPIPasswordFile: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "username without password", conf: GlobalConfig{KubeAPIUsername: "csi"}, wantErr: true},
+		{name: "missing certificate", conf: GlobalConfig{KubeAPICertFile: filepath.Join(dir, "tls.crt"), KubeAPIKeyFile: filepath.Join(dir, "tls.key")}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := kubeClientOptions(&test.conf)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("kubeClientOptions() = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("kubeClientOptions() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeDefaultParameters(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		wantTarget string
+		wantFsType string
+	}{
+		{name: "empty request", parameters: map[string]string{}, wantTarget: "192.0.2.10", wantFsType: "xfs"},
+		{name: "overridden address", parameters: map[string]string{paramAddr: "192.0.2.11"}, wantTarget: "192.0.2.11", wantFsType: "xfs"},
+		{name: "overridden fsType", parameters: map[string]string{paramFsType: "ext4"}, wantTarget: "192.0.2.10", wantFsType: "ext4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.defaultParameters = map[string]string{paramAddr: "192.0.2.10", paramPort: "4420", paramType: "tcp", paramFsType: "xfs"}
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.discovery["192.0.2.11:4420"] = discoveryPage("192.0.2.11", "4420", "nqn.2024-01.io.example:volume-2")
+
+			req := createRequest("pv-1", nil)
+			req.Parameters = test.parameters
+			resp, err := c.CreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+
+			if got := resp.GetVolume().GetVolumeContext()[paramFsType]; got != test.wantFsType {
+				t.Errorf("volume context fsType = %q, want %q", got, test.wantFsType)
+			}
+			for _, device := range c.deviceRegistry.devices {
+				if device.IsAllocated && device.physicalTarget() != test.wantTarget {
+					t.Errorf("volume allocated on %s, want %s", device.physicalTarget(), test.wantTarget)
+				}
+			}
+		})
+	}
+}
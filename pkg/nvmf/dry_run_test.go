@@ -0,0 +1,120 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// createRequest returns a CreateVolume request of a mount volume on the
+// target at 192.0.2.10:4420 with the extra parameters
+func createRequest(name string, extra map[string]string) *csi.CreateVolumeRequest {
+	params := map[string]string{
+		paramAddr: "192.0.2.10",
+		paramPort: "4420",
+		paramType: "tcp",
+	}
+	for key, value := range extra {
+		params[key] = value
+	}
+	return &csi.CreateVolumeRequest{
+		Name: name,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: params,
+	}
+}
+
+func TestDryRunCreateVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		exported  []string
+		allocated bool
+		want      codes.Code
+	}{
+		{name: "free device", exported: []string{testVolumeNqn}, want: dryRunFeasibleCode},
+		{name: "no device on the targets", want: codes.ResourceExhausted},
+		{name: "only device allocated", exported: []string{testVolumeNqn}, allocated: true, want: codes.ResourceExhausted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", test.exported...)
+			r := c.deviceRegistry
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if test.allocated {
+				if _, err := c.CreateVolume(ctx, createRequest("pv-0", nil)); err != nil {
+					t.Fatalf("CreateVolume of the allocated volume: %v", err)
+				}
+			}
+			devices, available := len(r.devices), len(r.availableNQNs)
+			records, err := c.Driver.metadata.List(ctx, metadataKindAllocation)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", map[string]string{paramDryRun: "true"}))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("dry-run CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			// No volume is returned, which the provisioner would make a PV of,
+			// the feasible dry run naming its candidate in the error instead
+			if resp != nil {
+				t.Errorf("dry-run CreateVolume returned volume %v", resp.GetVolume())
+			}
+			if test.want == dryRunFeasibleCode && !strings.Contains(status.Convert(err).Message(), testVolumeNqn) {
+				t.Errorf("dry-run CreateVolume message %q does not name the candidate %s", status.Convert(err).Message(), testVolumeNqn)
+			}
+
+			// Nothing was registered, allocated or recorded
+			if len(r.devices) != devices || len(r.availableNQNs) != available {
+				t.Errorf("registry holds %d device(s), %d free, want %d, %d", len(r.devices), len(r.availableNQNs), devices, available)
+			}
+			if _, exists := r.volumeToNQN["pv-1"]; exists {
+				t.Error("dry run allocated pv-1")
+			}
+			after, err := c.Driver.metadata.List(ctx, metadataKindAllocation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(records) {
+				t.Errorf("allocation records = %d, want %d", len(after), len(records))
+			}
+
+			// A real request fails the same way
+			if test.want != dryRunFeasibleCode {
+				_, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+				if got := status.Code(err); got != test.want {
+					t.Errorf("CreateVolume code = %v, want the dry run's %v: %v", got, test.want, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// identityProbeHostNqn is the host NQN the controller connects with to read the
+// identity of the subsystem behind an endpoint. Targets restricting hosts must
+// allow it.
+const identityProbeHostNqn = "nqn.2014-08.org.nvmexpress:csi-nvmf:identity-probe"
+
+// subsystemIdentity tells apart subsystems advertising the same NQN, which
+// report different serial numbers or models
+type subsystemIdentity struct {
+	Serial string
+	Model  string
+}
+
+func (i subsystemIdentity) String() string {
+	return fmt.Sprintf("serial %q, model %q", i.Serial, i.Model)
+}
+
+// endpointIdentities caches the identities probed during one discovery, since
+// every namespace of a subsystem is a device of its own
+type endpointIdentities map[string]endpointIdentity
+
+type endpointIdentity struct {
+	identity subsystemIdentity
+	err      error
+}
+
+// verifyEndpoints keeps the endpoints of a device discovered on several
+// endpoints only if they lead to the same subsystem, so that the device is a
+// multipath device of one subsystem rather than distinct subsystems sharing an
+// NQN. The subsystem is the one behind the recorded endpoints of the volume of
+// the device, if any is reachable. Otherwise nothing tells the subsystems
+// apart, and the device is refused unless all endpoints agree. It returns
+// false if no endpoint is left. It connects to the targets, so it is called
+// without holding the mutex.
+func (r *DeviceRegistry) verifyEndpoints(ctx context.Context, diskInfo *nvmfDiskInfo, recorded []string, probed endpointIdentities) bool {
+	if len(diskInfo.Endpoints) < 2 {
+		return true
+	}
+
+	identities := make(map[string]subsystemIdentity, len(diskInfo.Endpoints))
+	reachable := make([]string, 0, len(diskInfo.Endpoints))
+	for _, endpoint := range diskInfo.Endpoints {
+		result, exists := probed[diskInfo.Nqn+" "+endpoint]
+		if !exists {
+			result.identity, result.err = r.probeIdentity(ctx, diskInfo, endpoint)
+			probed[diskInfo.Nqn+" "+endpoint] = result
+		}
+		if result.err != nil {
+			klog.Errorf("Cannot verify that endpoint %s of %s leads to the same subsystem as the others, not registering it: %v", endpoint, diskInfo.Nqn, result.err)
+			continue
+		}
+		identities[endpoint] = result.identity
+		reachable = append(reachable, endpoint)
+	}
+	if len(reachable) == 0 {
+		return false
+	}
+
+	var reference *subsystemIdentity
+	for _, endpoint := range recorded {
+		if identity, exists := identities[endpoint]; exists {
+			reference = &identity
+			break
+		}
+	}
+	if reference == nil {
+		first := identities[reachable[0]]
+		for _, endpoint := range reachable[1:] {
+			if identities[endpoint] != first {
+				klog.Errorf("CONFLICT: NQN %s is advertised by distinct subsystems, endpoint %s reports %s but %s reports %s; not registering it, fix the target configuration",
+					diskInfo.Nqn, endpoint, identities[endpoint], reachable[0], first)
+				return false
+			}
+		}
+		reference = &first
+	}
+
+	endpoints := make([]string, 0, len(reachable))
+	for _, endpoint := range reachable {
+		if identities[endpoint] != *reference {
+			klog.Errorf("CONFLICT: NQN %s is advertised by distinct subsystems, endpoint %s reports %s but the recorded endpoints %v report %s; not registering the duplicate, fix the target configuration",
+				diskInfo.Nqn, endpoint, identities[endpoint], recorded, *reference)
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if len(endpoints) > 1 {
+		registryLog.V(4).Infof("Endpoints %v of %s lead to the same subsystem (%s), registering them as multipath endpoints", endpoints, diskInfo.Nqn, *reference)
+	}
+	diskInfo.Endpoints = endpoints
+
+	return len(endpoints) > 0
+}
+
+// probeIdentity connects the subsystem of a device through a single endpoint
+// and reads the serial number and model its controller reports
+func (r *DeviceRegistry) probeIdentity(ctx context.Context, diskInfo *nvmfDiskInfo, endpoint string) (subsystemIdentity, error) {
+	client := r.Driver.nvme
+
+	if err := ctx.Err(); err != nil {
+		return subsystemIdentity{}, err
+	}
+
+	single := *diskInfo
+	single.Endpoints = []string{endpoint}
+	connector := getNvmfConnector(&single, identityProbeHostNqn, r.Driver.connectOptions())
+	if _, err := client.Connect(connector); err != nil {
+		return subsystemIdentity{}, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer func() {
+		if err := client.Disconnect(diskInfo.Nqn, identityProbeHostNqn, r.Driver.nvmeCliTimeout); err != nil {
+			klog.Errorf("Failed to disconnect identity probe of %s at %s: %v", diskInfo.Nqn, endpoint, err)
+		}
+	}()
+
+	controller, found := findController(client, diskInfo.Nqn, identityProbeHostNqn)
+	if !found {
+		return subsystemIdentity{}, fmt.Errorf("no controller of %s connected with %s", diskInfo.Nqn, identityProbeHostNqn)
+	}
+	if controller.Serial == "" && controller.Model == "" {
+		return subsystemIdentity{}, fmt.Errorf("controller %s reports no serial number or model", controller.Name)
+	}
+
+	return subsystemIdentity{Serial: controller.Serial, Model: controller.Model}, nil
+}
+
+// readControllerAttribute returns a sysfs attribute of a controller, or an
+// empty string if it cannot be read
+func readControllerAttribute(controller, name string) string {
+	data, err := os.ReadFile(filepath.Join(SYS_NVMF, controller, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
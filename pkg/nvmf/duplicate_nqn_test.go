@@ -0,0 +1,118 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestVerifyEndpoints(t *testing.T) {
+	const (
+		endpointA = "192.0.2.10:4420"
+		endpointB = "192.0.2.11:4420"
+		endpointC = "192.0.2.12:4420"
+	)
+	subsystem := subsystemIdentity{Serial: "SN-1", Model: "target-1"}
+	other := subsystemIdentity{Serial: "SN-2", Model: "target-2"}
+
+	tests := []struct {
+		name       string
+		endpoints  []string
+		identities map[string]subsystemIdentity // unset endpoints report no identity
+		recorded   []string
+		want       bool
+		wantKept   []string
+		probes     int
+	}{
+		{
+			name:      "single endpoint is not probed",
+			endpoints: []string{endpointA},
+			want:      true,
+			wantKept:  []string{endpointA},
+		},
+		{
+			name:       "multipath endpoints of one subsystem",
+			endpoints:  []string{endpointA, endpointB},
+			identities: map[string]subsystemIdentity{endpointA: subsystem, endpointB: subsystem},
+			want:       true,
+			wantKept:   []string{endpointA, endpointB},
+			probes:     2,
+		},
+		{
+			name:       "distinct subsystems without a recorded endpoint are refused",
+			endpoints:  []string{endpointA, endpointB},
+			identities: map[string]subsystemIdentity{endpointA: subsystem, endpointB: other},
+			probes:     2,
+		},
+		{
+			name:       "recorded endpoint picks the subsystem",
+			endpoints:  []string{endpointA, endpointB, endpointC},
+			identities: map[string]subsystemIdentity{endpointA: other, endpointB: subsystem, endpointC: subsystem},
+			recorded:   []string{endpointB},
+			want:       true,
+			wantKept:   []string{endpointB, endpointC},
+			probes:     3,
+		},
+		{
+			name:       "unreachable recorded endpoint leaves the conflict unresolved",
+			endpoints:  []string{endpointA, endpointB},
+			identities: map[string]subsystemIdentity{endpointA: subsystem, endpointB: other},
+			recorded:   []string{endpointC},
+			probes:     2,
+		},
+		{
+			name:       "endpoint without identity is dropped",
+			endpoints:  []string{endpointA, endpointB},
+			identities: map[string]subsystemIdentity{endpointB: subsystem},
+			want:       true,
+			wantKept:   []string{endpointB},
+			probes:     2,
+		},
+		{
+			name:      "no endpoint with an identity",
+			endpoints: []string{endpointA, endpointB},
+			probes:    2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			for endpoint, identity := range test.identities {
+				client.identities[endpoint] = identity
+			}
+			diskInfo := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: append([]string{}, test.endpoints...)}
+
+			got := c.deviceRegistry.verifyEndpoints(context.Background(), diskInfo, test.recorded, endpointIdentities{})
+			if got != test.want {
+				t.Fatalf("verifyEndpoints = %t, want %t", got, test.want)
+			}
+			if test.want && !reflect.DeepEqual(diskInfo.Endpoints, test.wantKept) {
+				t.Errorf("kept endpoints %v, want %v", diskInfo.Endpoints, test.wantKept)
+			}
+			if client.connectCount() != test.probes {
+				t.Errorf("probes = %d, want %d", client.connectCount(), test.probes)
+			}
+			if len(client.controllers) != 0 {
+				t.Errorf("%d identity probe(s) left connected", len(client.controllers))
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Endpoints are "addr:port" strings, with IPv6 addresses in brackets, e.g.
+// "192.168.122.18:4420", "[2001:db8::1]:4420" or "target.example.com:4420".
+// The nvme-cli and the fabrics connect take the address without brackets.
+
+// hostnamePattern matches DNS names, whose labels are letters, digits and inner hyphens
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// joinEndpoint returns the endpoint of a target address and port, bracketing
+// IPv6 addresses
+func joinEndpoint(addr, port string) string {
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// splitEndpoint returns the address, without brackets, and the port of an
+// endpoint. IPv6 addresses must be bracketed, since their colons would
+// otherwise be ambiguous with the port separator.
+func splitEndpoint(endpoint string) (string, string, error) {
+	addr, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %q, expected addr:port with IPv6 addresses in brackets: %v", endpoint, err)
+	}
+	if err := validateTargetAddr(addr); err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	if err := validateTargetPort(port); err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+
+	return addr, port, nil
+}
+
+// validateTargetAddr checks that addr is an IP address, possibly an IPv6
+// address with a zone, or a hostname
+func validateTargetAddr(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("empty address")
+	}
+	if ip, _, _ := strings.Cut(addr, "%"); net.ParseIP(ip) != nil {
+		return nil
+	}
+	if strings.Contains(addr, ":") {
+		return fmt.Errorf("address %q is not a valid IPv6 address", addr)
+	}
+	if len(addr) > 253 || !hostnamePattern.MatchString(addr) {
+		return fmt.Errorf("address %q is neither an IP address nor a hostname", addr)
+	}
+
+	return nil
+}
+
+// validateTargetPort checks that port is a TCP port number
+func validateTargetPort(port string) error {
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 1 || number > 65535 {
+		return fmt.Errorf("port %q is not a number between 1 and 65535", port)
+	}
+
+	return nil
+}
+
+// targetAddrs returns the comma-separated addresses of a targetTrAddr value,
+// without brackets, so that IPv6 addresses may be given either way
+func targetAddrs(value string) []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.Trim(strings.TrimSpace(addr), "[]"); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
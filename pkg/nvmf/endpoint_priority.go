@@ -0,0 +1,121 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramEndpointPriority assigns priorities to the endpoints of a device, as
+// comma-separated "<addr:port glob>=<priority>" entries, e.g.
+// "10.0.0.1:*=0,10.0.0.2:*=1". The first matching entry applies. IPv6
+// endpoints are bracketed, so their brackets are escaped in globs, e.g.
+// \[2001:db8::1\]:*=0.
+const paramEndpointPriority = "endpointPriority"
+
+// endpointPrioritySeparator separates an endpoint in the volume context from
+// its priority, e.g. "10.0.0.1:4420@0"
+const endpointPrioritySeparator = "@"
+
+// endpointPriority is the priority of the endpoints matching a glob. Lower
+// priorities are connected first, and so are preferred by the host among
+// paths the target reports in the same ANA state.
+type endpointPriority struct {
+	Pattern  string
+	Priority int
+}
+
+// parseEndpointPriorities parses the value of paramEndpointPriority
+func parseEndpointPriorities(value string) ([]endpointPriority, error) {
+	priorities := []endpointPriority{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, rank, found := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !found || pattern == "" {
+			return nil, fmt.Errorf("entry %q is not <endpoint glob>=<priority>", entry)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid endpoint glob %q: %v", pattern, err)
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(rank))
+		if err != nil || priority < 0 {
+			return nil, fmt.Errorf("priority of %q must be a non-negative integer, got: %q", pattern, rank)
+		}
+		priorities = append(priorities, endpointPriority{Pattern: pattern, Priority: priority})
+	}
+
+	return priorities, nil
+}
+
+// prioritizedEndpoints returns the endpoints, in discovery order, with the
+// priority of the first matching entry appended for the volume context
+func prioritizedEndpoints(endpoints []string, priorities []endpointPriority) []string {
+	entries := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		entry := endpoint
+		for _, priority := range priorities {
+			if globMatch(priority.Pattern, endpoint) {
+				entry = endpoint + endpointPrioritySeparator + strconv.Itoa(priority.Priority)
+				break
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// sortEndpoints strips the priorities from volume context endpoints and orders
+// them by priority. Endpoints without a priority follow those with one, and
+// endpoints of equal priority keep their discovery order.
+func sortEndpoints(entries []string) ([]string, error) {
+	type ranked struct {
+		endpoint string
+		priority int
+	}
+
+	endpoints := make([]ranked, 0, len(entries))
+	for _, entry := range entries {
+		endpoint, rank, found := strings.Cut(entry, endpointPrioritySeparator)
+		priority := math.MaxInt
+		if found {
+			var err error
+			if priority, err = strconv.Atoi(rank); err != nil || priority < 0 {
+				return nil, fmt.Errorf("invalid priority of endpoint %s: %q", endpoint, rank)
+			}
+		}
+		endpoints = append(endpoints, ranked{endpoint: endpoint, priority: priority})
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].priority < endpoints[j].priority
+	})
+
+	sorted := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		sorted = append(sorted, endpoint.endpoint)
+	}
+
+	return sorted, nil
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withRecordedConnects records the addresses connected through the fabrics
+// device, failing the connect to the last endpoint so that Connect returns
+// before waiting for a device
+func withRecordedConnects(t *testing.T, endpoints int) *[]string {
+	t.Helper()
+	addrs := []string{}
+	saved := fabricsConnect
+	fabricsConnect = func(argStr string) (string, error) {
+		for _, arg := range strings.Split(argStr, ",") {
+			if strings.HasPrefix(arg, "traddr=") {
+				addrs = append(addrs, strings.TrimPrefix(arg, "traddr="))
+			}
+		}
+		if len(addrs) == endpoints {
+			return "", syscall.EINVAL
+		}
+		return "instance=1,cntlid=1", nil
+	}
+	t.Cleanup(func() { fabricsConnect = saved })
+	return &addrs
+}
+
+func TestParseEndpointPriorities(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []endpointPriority
+		wantErr bool
+	}{
+		{name: "unset", want: []endpointPriority{}},
+		{name: "entries", value: "10.0.0.1:*=0, 10.0.0.2:4420 = 1", want: []endpointPriority{{Pattern: "10.0.0.1:*", Priority: 0}, {Pattern: "10.0.0.2:4420", Priority: 1}}},
+		{name: "bracketed IPv6", value: `\[2001:db8::1\]:*=0`, want: []endpointPriority{{Pattern: `\[2001:db8::1\]:*`, Priority: 0}}},
+		{name: "empty entries", value: ",10.0.0.1:*=2,", want: []endpointPriority{{Pattern: "10.0.0.1:*", Priority: 2}}},
+		{name: "no priority", value: "10.0.0.1:*", wantErr: true},
+		{name: "no glob", value: "=1", wantErr: true},
+		{name: "negative priority", value: "10.0.0.1:*=-1", wantErr: true},
+		{name: "priority not an integer", value: "10.0.0.1:*=high", wantErr: true},
+		{name: "invalid glob", value: "10.0.0.[1:*=0", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseEndpointPriorities(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseEndpointPriorities(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseEndpointPriorities(%q) = %+v, want %+v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSortEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "without priorities", entries: []string{"10.0.0.2:4420", "10.0.0.1:4420"}, want: []string{"10.0.0.2:4420", "10.0.0.1:4420"}},
+		{name: "by priority", entries: []string{"10.0.0.1:4420@2", "10.0.0.2:4420@0", "10.0.0.3:4420@1"}, want: []string{"10.0.0.2:4420", "10.0.0.3:4420", "10.0.0.1:4420"}},
+		{name: "equal priorities keep their order", entries: []string{"10.0.0.3:4420@1", "10.0.0.1:4420@0", "10.0.0.2:4420@1"}, want: []string{"10.0.0.1:4420", "10.0.0.3:4420", "10.0.0.2:4420"}},
+		{name: "unprioritized last", entries: []string{"10.0.0.1:4420", "10.0.0.2:4420@5"}, want: []string{"10.0.0.2:4420", "10.0.0.1:4420"}},
+		{name: "IPv6", entries: []string{"[2001:db8::1]:4420@1", "[2001:db8::2]:4420@0"}, want: []string{"[2001:db8::2]:4420", "[2001:db8::1]:4420"}},
+		{name: "invalid priority", entries: []string{"10.0.0.1:4420@first"}, wantErr: true},
+		{name: "negative priority", entries: []string{"10.0.0.1:4420@-1"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := sortEndpoints(test.entries)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("sortEndpoints(%v) error = %v, want error %v", test.entries, err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sortEndpoints(%v) = %v, want %v", test.entries, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEndpointPriorityConnectOrder(t *testing.T) {
+	addrs := []string{"192.0.2.10", "192.0.2.11", "192.0.2.12"}
+
+	tests := []struct {
+		name       string
+		priorities string
+		want       codes.Code
+		// wantContext is the endpoints recorded in the volume context
+		wantContext string
+		// wantOrder is the order the node connects the addresses in
+		wantOrder []string
+	}{
+		{
+			name:        "no priorities",
+			wantContext: "192.0.2.10:4420,192.0.2.11:4420,192.0.2.12:4420",
+			wantOrder:   []string{"192.0.2.10", "192.0.2.11", "192.0.2.12"},
+		},
+		{
+			name:        "reversed",
+			priorities:  "192.0.2.12:*=0,192.0.2.11:*=1,192.0.2.10:*=2",
+			wantContext: "192.0.2.10:4420@2,192.0.2.11:4420@1,192.0.2.12:4420@0",
+			wantOrder:   []string{"192.0.2.12", "192.0.2.11", "192.0.2.10"},
+		},
+		{
+			name:        "one preferred endpoint",
+			priorities:  "192.0.2.11:4420=0",
+			wantContext: "192.0.2.10:4420,192.0.2.11:4420@0,192.0.2.12:4420",
+			wantOrder:   []string{"192.0.2.11", "192.0.2.10", "192.0.2.12"},
+		},
+		{
+			name:        "equal priorities keep the discovery order",
+			priorities:  "192.0.2.1[12]:*=0,*=1",
+			wantContext: "192.0.2.10:4420@1,192.0.2.11:4420@0,192.0.2.12:4420@0",
+			wantOrder:   []string{"192.0.2.11", "192.0.2.12", "192.0.2.10"},
+		},
+		{
+			name:        "first matching entry",
+			priorities:  "*=1,192.0.2.12:*=0",
+			wantContext: "192.0.2.10:4420@1,192.0.2.11:4420@1,192.0.2.12:4420@1",
+			wantOrder:   []string{"192.0.2.10", "192.0.2.11", "192.0.2.12"},
+		},
+		{name: "invalid priorities", priorities: "192.0.2.12:*", want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			for _, addr := range addrs {
+				client.discovery[addr+":4420"] = discoveryPage(addr, "4420", testVolumeNqn)
+			}
+
+			extra := map[string]string{paramAddr: strings.Join(addrs, ",")}
+			if test.priorities != "" {
+				extra[paramEndpointPriority] = test.priorities
+			}
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", extra))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err != nil {
+				return
+			}
+			volumeContext := resp.GetVolume().GetVolumeContext()
+			if got := volumeContext[paramEndpoint]; got != test.wantContext {
+				t.Errorf("volume context endpoints = %q, want %q", got, test.wantContext)
+			}
+
+			// The node connects the endpoints of the volume context by priority
+			params, err := ParseVolumeParams(volumeContext)
+			if err != nil {
+				t.Fatalf("ParseVolumeParams: %v", err)
+			}
+			info, err := getNVMfDiskInfo(resp.GetVolume().GetVolumeId(), params)
+			if err != nil {
+				t.Fatalf("getNVMfDiskInfo: %v", err)
+			}
+			connected := withRecordedConnects(t, len(addrs))
+			if _, err := getNvmfConnector(info, testNodeHostNqn, connectOptions{}).Connect(); err == nil {
+				t.Fatal("Connect succeeded, want the failure of the last endpoint")
+			}
+			if !reflect.DeepEqual(*connected, test.wantOrder) {
+				t.Errorf("connected %v, want %v", *connected, test.wantOrder)
+			}
+
+			// A restarted controller restores the endpoints without their priorities
+			pv := driverPV("pv-1", resp.GetVolume().GetVolumeId(), volumeContext)
+			restored := volumeInfoFromPV(pv, volumeContext)
+			wantEndpoints := []string{}
+			for _, addr := range test.wantOrder {
+				wantEndpoints = append(wantEndpoints, addr+":4420")
+			}
+			if restored == nil || !reflect.DeepEqual(restored.Endpoints, wantEndpoints) {
+				t.Errorf("restored device = %+v, want the endpoints %v", restored, wantEndpoints)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withRecordedConnectArgs records the traddr and trsvcid arguments of each
+// connect through the fabrics device, failing the connect to the last endpoint
+// so that Connect returns before waiting for a device
+func withRecordedConnectArgs(t *testing.T, endpoints int) *[]string {
+	t.Helper()
+	args := []string{}
+	saved := fabricsConnect
+	fabricsConnect = func(argStr string) (string, error) {
+		target := []string{}
+		for _, arg := range strings.Split(argStr, ",") {
+			if strings.HasPrefix(arg, "traddr=") || strings.HasPrefix(arg, "trsvcid=") {
+				target = append(target, arg)
+			}
+		}
+		args = append(args, strings.Join(target, ","))
+		if len(args) == endpoints {
+			return "", syscall.EINVAL
+		}
+		return "instance=1,cntlid=1", nil
+	}
+	t.Cleanup(func() { fabricsConnect = saved })
+	return &args
+}
+
+func TestSplitEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		wantAddr string
+		wantPort string
+		wantErr  bool
+	}{
+		{name: "IPv4", endpoint: "192.0.2.10:4420", wantAddr: "192.0.2.10", wantPort: "4420"},
+		{name: "IPv6", endpoint: "[2001:db8::1]:4420", wantAddr: "2001:db8::1", wantPort: "4420"},
+		{name: "IPv6 with a zone", endpoint: "[fe80::1%eth0]:4420", wantAddr: "fe80::1%eth0", wantPort: "4420"},
+		{name: "hostname", endpoint: "target.example.com:4420", wantAddr: "target.example.com", wantPort: "4420"},
+		{name: "unbracketed IPv6", endpoint: "2001:db8::1:4420", wantErr: true},
+		{name: "invalid IPv6", endpoint: "[2001:db8::zz]:4420", wantErr: true},
+		{name: "no port", endpoint: "192.0.2.10", wantErr: true},
+		{name: "empty address", endpoint: ":4420", wantErr: true},
+		{name: "empty brackets", endpoint: "[]:4420", wantErr: true},
+		{name: "port out of range", endpoint: "192.0.2.10:65536", wantErr: true},
+		{name: "port zero", endpoint: "192.0.2.10:0", wantErr: true},
+		{name: "port not a number", endpoint: "192.0.2.10:nvme", wantErr: true},
+		{name: "invalid hostname", endpoint: "target_1.example.com:4420", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, port, err := splitEndpoint(test.endpoint)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("splitEndpoint(%q) error = %v, want error %v", test.endpoint, err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if addr != test.wantAddr || port != test.wantPort {
+				t.Errorf("splitEndpoint(%q) = %q, %q, want %q, %q", test.endpoint, addr, port, test.wantAddr, test.wantPort)
+			}
+
+			// Joining the address, bracketed or not, restores the endpoint
+			for _, joined := range []string{joinEndpoint(addr, port), joinEndpoint("["+addr+"]", port)} {
+				if joined != test.endpoint {
+					t.Errorf("joinEndpoint(%q, %q) = %q, want %q", addr, port, joined, test.endpoint)
+				}
+			}
+		})
+	}
+}
+
+func TestParseVolumeParamsEndpoints(t *testing.T) {
+	tests := []struct {
+		name          string
+		params        map[string]string
+		wantEndpoints []string
+		wantAddrs     []string
+		// wantErr is the parameter of the expected InvalidArgument error
+		wantErr string
+	}{
+		{
+			name:          "joined endpoints",
+			params:        map[string]string{paramEndpoint: "192.0.2.10:4420,[2001:db8::1]:4420, target.example.com:4421"},
+			wantEndpoints: []string{"192.0.2.10:4420", "[2001:db8::1]:4420", "target.example.com:4421"},
+		},
+		{
+			name:          "prioritized IPv6 endpoints",
+			params:        map[string]string{paramEndpoint: "[2001:db8::1]:4420@1,[2001:db8::2]:4420@0"},
+			wantEndpoints: []string{"[2001:db8::2]:4420", "[2001:db8::1]:4420"},
+		},
+		{
+			name:      "addresses with and without brackets",
+			params:    map[string]string{paramAddr: "192.0.2.10, 2001:db8::1,[2001:db8::2],target.example.com", paramPort: "4420,4421"},
+			wantAddrs: []string{"192.0.2.10", "2001:db8::1", "2001:db8::2", "target.example.com"},
+		},
+		{name: "unbracketed IPv6 endpoint", params: map[string]string{paramEndpoint: "2001:db8::1:4420"}, wantErr: paramEndpoint},
+		{name: "endpoint without port", params: map[string]string{paramEndpoint: "192.0.2.10:4420,192.0.2.11"}, wantErr: paramEndpoint},
+		{name: "invalid IPv6 address", params: map[string]string{paramAddr: "2001:db8::zz"}, wantErr: paramAddr},
+		{name: "invalid hostname", params: map[string]string{paramAddr: "target_1.example.com"}, wantErr: paramAddr},
+		{name: "invalid port", params: map[string]string{paramAddr: "192.0.2.10", paramPort: "4420,nvme"}, wantErr: paramPort},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := ParseVolumeParams(test.params)
+			if test.wantErr != "" {
+				if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseVolumeParams error = %v, want InvalidArgument of %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeParams: %v", err)
+			}
+			if test.wantEndpoints != nil && !reflect.DeepEqual(p.Endpoints, test.wantEndpoints) {
+				t.Errorf("endpoints = %v, want %v", p.Endpoints, test.wantEndpoints)
+			}
+			if test.wantAddrs != nil && !reflect.DeepEqual(targetAddrs(p.TargetAddr), test.wantAddrs) {
+				t.Errorf("addresses = %v, want %v", targetAddrs(p.TargetAddr), test.wantAddrs)
+			}
+		})
+	}
+}
+
+func TestEndpointsFromDiscoveryToConnect(t *testing.T) {
+	tests := []struct {
+		name string
+		// addrs are the discovery addresses of the StorageClass, on port 4420
+		addrs       string
+		wantContext string
+		wantConnect []string
+	}{
+		{
+			name:        "IPv4",
+			addrs:       "192.0.2.10",
+			wantContext: "192.0.2.10:4420",
+			wantConnect: []string{"traddr=192.0.2.10,trsvcid=4420"},
+		},
+		{
+			name:        "IPv6",
+			addrs:       "2001:db8::1",
+			wantContext: "[2001:db8::1]:4420",
+			wantConnect: []string{"traddr=2001:db8::1,trsvcid=4420"},
+		},
+		{
+			name:        "hostname",
+			addrs:       "target.example.com",
+			wantContext: "target.example.com:4420",
+			wantConnect: []string{"traddr=target.example.com,trsvcid=4420"},
+		},
+		{
+			name:        "mixed multipath",
+			addrs:       "[2001:db8::1],192.0.2.10,2001:db8::2",
+			wantContext: "[2001:db8::1]:4420,192.0.2.10:4420,[2001:db8::2]:4420",
+			wantConnect: []string{"traddr=2001:db8::1,trsvcid=4420", "traddr=192.0.2.10,trsvcid=4420", "traddr=2001:db8::2,trsvcid=4420"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			for _, addr := range targetAddrs(test.addrs) {
+				client.discovery[joinEndpoint(addr, "4420")] = discoveryPage(addr, "4420", testVolumeNqn)
+			}
+
+			// The discovered targets keep their addresses apart from their ports
+			resp, err := c.CreateVolume(context.Background(), createRequest("pv-1", map[string]string{paramAddr: test.addrs}))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volumeContext := resp.GetVolume().GetVolumeContext()
+			if got := volumeContext[paramEndpoint]; got != test.wantContext {
+				t.Errorf("volume context endpoints = %q, want %q", got, test.wantContext)
+			}
+
+			// The node connects each endpoint with its address unbracketed
+			params, err := ParseVolumeParams(volumeContext)
+			if err != nil {
+				t.Fatalf("ParseVolumeParams: %v", err)
+			}
+			info, err := getNVMfDiskInfo(resp.GetVolume().GetVolumeId(), params)
+			if err != nil {
+				t.Fatalf("getNVMfDiskInfo: %v", err)
+			}
+			connected := withRecordedConnectArgs(t, len(test.wantConnect))
+			if _, err := getNvmfConnector(info, testNodeHostNqn, connectOptions{}).Connect(); err == nil {
+				t.Fatal("Connect succeeded, want the failure of the last endpoint")
+			}
+			if !reflect.DeepEqual(*connected, test.wantConnect) {
+				t.Errorf("connected %v, want %v", *connected, test.wantConnect)
+			}
+		})
+	}
+}
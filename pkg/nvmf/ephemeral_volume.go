@@ -0,0 +1,600 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
+)
+
+// volumeContextEphemeral is set to "true" by the kubelet in the volume context
+// of CSI ephemeral inline volumes, which carries the volume attributes of the
+// pod spec instead of a volume context recorded by CreateVolume
+const volumeContextEphemeral = "csi.storage.k8s.io/ephemeral"
+
+// metadataKindEphemeral records the devices nodes claimed for ephemeral inline
+// volumes, keyed by the ephemeral volume ID. The controller does not allocate
+// claimed devices. The claims are kept in a namespace of their own, the only
+// one whose ConfigMaps the nodes write.
+const metadataKindEphemeral = "ephemeral"
+
+// Ephemeral layout. An ephemeral volume is staged at "<ephemeral dir>/<volume
+// ID>" as if it were the staging target path of a persistent volume of its
+// device, and "<ephemeral dir>/<volume ID>.json" holds its claim, which the
+// unpublish needs to unstage and release the device.
+
+// ephemeralClaim is the device a node claimed for an ephemeral volume. The node
+// marks the claim released once the volume is torn down, and the controller
+// reclaims the device like that of a deleted volume before removing the claim,
+// so that the device is not reused with the data of the volume.
+type ephemeralClaim struct {
+	VolumeID   string    `json:"volumeId"` // Volume ID of the claimed device
+	Transport  string    `json:"transport"`
+	Endpoints  []string  `json:"endpoints,omitempty"`
+	NodeID     string    `json:"nodeId"`
+	ClaimedAt  time.Time `json:"claimedAt"`
+	ReleasedAt time.Time `json:"releasedAt,omitempty"`
+}
+
+// isReleased reports whether the node released the claimed device
+func (c *ephemeralClaim) isReleased() bool {
+	return !c.ReleasedAt.IsZero()
+}
+
+// precedes reports whether the claim of key wins over the claim of otherKey
+// for the same device: the earliest claim wins, the smallest key on a tie
+func (c *ephemeralClaim) precedes(key string, other *ephemeralClaim, otherKey string) bool {
+	if !c.ClaimedAt.Equal(other.ClaimedAt) {
+		return c.ClaimedAt.Before(other.ClaimedAt)
+	}
+	return key < otherKey
+}
+
+// isEphemeralRequest reports whether a publish is that of an ephemeral inline volume
+func isEphemeralRequest(volumeContext map[string]string) bool {
+	return volumeContext[volumeContextEphemeral] == "true"
+}
+
+// isValidEphemeralID checks that an ephemeral volume ID, which the kubelet
+// generates, can name the files of the volume in the ephemeral dir
+func isValidEphemeralID(volumeID string) bool {
+	return volumeID != "" && volumeID != "." && volumeID != ".." && filepath.Base(volumeID) == volumeID
+}
+
+func (d *driver) ephemeralStagingPath(volumeID string) string {
+	return filepath.Join(d.ephemeralDir, volumeID)
+}
+
+func (d *driver) ephemeralClaimPath(volumeID string) string {
+	return filepath.Join(d.ephemeralDir, volumeID+".json")
+}
+
+// parseEphemeralParams validates the volume attributes of an ephemeral volume.
+// They must locate the discovery controllers, and cannot request what only
+// CreateVolume applies.
+func (d *driver) parseEphemeralParams(attributes map[string]string) (*VolumeParams, error) {
+	params, err := d.parseVolumeParams(d.withDefaults(attributes))
+	if err != nil {
+		return nil, err
+	}
+
+	if params.TargetAddr == "" || params.TargetPort == "" || params.Transport == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "ephemeral volumes require the %s, %s and %s attributes", paramAddr, paramPort, paramType)
+	}
+	unsupported := []string{}
+	if params.DryRun {
+		unsupported = append(unsupported, paramDryRun)
+	}
+	if params.Placement.isSet() {
+		unsupported = append(unsupported, paramAffinityKey+"/"+paramAntiAffinityKey)
+	}
+	if params.QoS != (BackendQoS{}) {
+		unsupported = append(unsupported, "QoS")
+	}
+	if len(params.AllowedHosts) > 0 {
+		unsupported = append(unsupported, paramAllowedHostNqns)
+	}
+	if len(unsupported) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "ephemeral volumes do not support %s", strings.Join(unsupported, ", "))
+	}
+
+	return params, nil
+}
+
+// publishEphemeral claims a free device for an ephemeral volume, then stages
+// and publishes it as a volume of that device. A failed publish releases the
+// device, so that the kubelet retries from scratch.
+func (n *NodeServer) publishEphemeral(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if !n.Driver.ephemeralVolumes {
+		return nil, status.Errorf(codes.InvalidArgument, "ephemeral volume %s: ephemeral inline volumes are not enabled", volumeID)
+	}
+	if !isValidEphemeralID(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid ephemeral volume ID %q", volumeID)
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume missing TargetPath in req.")
+	}
+	if req.GetVolumeCapability().GetMount() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ephemeral volume %s must be a filesystem volume", volumeID)
+	}
+	params, err := n.Driver.parseEphemeralParams(req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+
+	lockKey := metadataKindEphemeral + "/" + volumeID
+	n.nqnLocks.Acquire(lockKey)
+	defer n.nqnLocks.Release(lockKey)
+
+	klog.V(4).Infof("NodePublishVolume called for ephemeral volume %s", volumeID)
+
+	claim, err := loadEphemeralClaim(n.Driver.ephemeralClaimPath(volumeID))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read the claim of ephemeral volume %s: %v", volumeID, err)
+	}
+	if claim != nil {
+		// A repeated publish finds the volume published
+		if notMnt, err := mount.New("").IsLikelyNotMountPoint(req.GetTargetPath()); err == nil && !notMnt {
+			klog.V(4).Infof("NodePublishVolume: ephemeral volume %s is already published at %s", volumeID, req.GetTargetPath())
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+	} else {
+		if n.cordon.isCordoned() {
+			return nil, status.Errorf(codes.Unavailable, "node %s is cordoned for maintenance", n.Driver.nodeId)
+		}
+		if claim, err = n.claimEphemeralDevice(ctx, volumeID, params); err != nil {
+			return nil, err
+		}
+	}
+
+	published := false
+	defer func() {
+		if !published {
+			if err := n.teardownEphemeral(ctx, volumeID, claim); err != nil {
+				klog.Errorf("Failed to release the device of ephemeral volume %s after a failed publish: %v", volumeID, err)
+			}
+		}
+	}()
+
+	volumeContext := params.volumeContext()
+	volumeContext[paramType] = claim.Transport
+	volumeContext[paramEndpoint] = strings.Join(claim.Endpoints, ",")
+	stagingTarget := n.Driver.ephemeralStagingPath(volumeID)
+	if err := os.MkdirAll(stagingTarget, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create the staging directory of ephemeral volume %s: %v", volumeID, err)
+	}
+
+	_, err = n.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          claim.VolumeID,
+		StagingTargetPath: stagingTarget,
+		VolumeCapability:  req.GetVolumeCapability(),
+		VolumeContext:     volumeContext,
+		Secrets:           req.GetSecrets(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          claim.VolumeID,
+		StagingTargetPath: stagingTarget,
+		TargetPath:        req.GetTargetPath(),
+		VolumeCapability:  req.GetVolumeCapability(),
+		VolumeContext:     volumeContext,
+		Readonly:          req.GetReadonly(),
+		Secrets:           req.GetSecrets(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	published = true
+	klog.Infof("Published ephemeral volume %s on device %s at %s", volumeID, claim.VolumeID, req.GetTargetPath())
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// unpublishEphemeral unpublishes and unstages an ephemeral volume, then
+// releases its device
+func (n *NodeServer) unpublishEphemeral(ctx context.Context, req *csi.NodeUnpublishVolumeRequest, claim *ephemeralClaim) (*csi.NodeUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	lockKey := metadataKindEphemeral + "/" + volumeID
+	n.nqnLocks.Acquire(lockKey)
+	defer n.nqnLocks.Release(lockKey)
+
+	klog.V(4).Infof("NodeUnpublishVolume called for ephemeral volume %s", volumeID)
+
+	_, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   claim.VolumeID,
+		TargetPath: req.GetTargetPath(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := n.teardownEphemeral(ctx, volumeID, claim); err != nil {
+		return nil, err
+	}
+
+	klog.Infof("Unpublished ephemeral volume %s and released device %s", volumeID, claim.VolumeID)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// teardownEphemeral unstages an unpublished ephemeral volume and releases its
+// claim for the controller to reclaim the device. The local claim is removed
+// last, so that a failure is retried by the next unpublish.
+func (n *NodeServer) teardownEphemeral(ctx context.Context, volumeID string, claim *ephemeralClaim) error {
+	stagingTarget := n.Driver.ephemeralStagingPath(volumeID)
+	if _, err := n.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          claim.VolumeID,
+		StagingTargetPath: stagingTarget,
+	}); err != nil {
+		return err
+	}
+	if err := os.Remove(stagingTarget); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Failed to remove the staging directory of ephemeral volume %s: %v", volumeID, err)
+	}
+
+	released := *claim
+	released.ReleasedAt = time.Now().UTC()
+	if err := n.Driver.ephemeralClaims.Put(ctx, metadataKindEphemeral, volumeID, &released); err != nil {
+		return status.Errorf(codes.Unavailable, "%v: failed to release the claim of ephemeral volume %s: %v", ErrEtcdUnavailable, volumeID, err)
+	}
+	if err := os.Remove(n.Driver.ephemeralClaimPath(volumeID)); err != nil && !os.IsNotExist(err) {
+		return status.Errorf(codes.Internal, "failed to remove the claim of ephemeral volume %s: %v", volumeID, err)
+	}
+
+	return nil
+}
+
+// claimEphemeralDevice selects a free device among those the attributes
+// discover, or the pinned one, and claims it. The claim is written before the
+// claims and allocations are checked, so that of two nodes, or a node and the
+// controller, picking the same device at once, at most one keeps it.
+func (n *NodeServer) claimEphemeralDevice(ctx context.Context, volumeID string, params *VolumeParams) (*ephemeralClaim, error) {
+	devices, err := discoverNVMeDevices(ctx, n.Driver.nvme, params, nil, n.Driver.nvmeCliTimeout, n.Driver.maxDiscoveryConcurrency)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to discover devices for ephemeral volume %s: %v", volumeID, err)
+	}
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		if params.PinnedNqn == "" || id == params.PinnedNqn {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	lost := map[string]struct{}{}
+	for {
+		inUse, err := n.Driver.devicesInUse(ctx, volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to list the devices in use: %v", err)
+		}
+		id := ""
+		for _, candidate := range ids {
+			_, used := inUse[candidate]
+			if _, skipped := lost[candidate]; !used && !skipped {
+				id = candidate
+				break
+			}
+		}
+		if id == "" {
+			return nil, status.Errorf(codes.ResourceExhausted, "%v: no free device for ephemeral volume %s", ErrNoSuitableDevice, volumeID)
+		}
+
+		device := devices[id]
+		claim := &ephemeralClaim{
+			VolumeID:  id,
+			Transport: device.Transport,
+			Endpoints: device.Endpoints,
+			NodeID:    n.Driver.nodeId,
+			ClaimedAt: time.Now().UTC(),
+		}
+		if err := n.Driver.ephemeralClaims.Put(ctx, metadataKindEphemeral, volumeID, claim); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "%v: failed to claim device %s for ephemeral volume %s: %v", ErrEtcdUnavailable, id, volumeID, err)
+		}
+
+		won, err := n.Driver.keepsEphemeralClaim(ctx, volumeID, claim)
+		if err == nil && won {
+			err = saveEphemeralClaim(n.Driver.ephemeralClaimPath(volumeID), claim)
+			if err == nil {
+				klog.Infof("Claimed device %s for ephemeral volume %s", id, volumeID)
+				return claim, nil
+			}
+		}
+		if deleteErr := n.Driver.ephemeralClaims.Delete(ctx, metadataKindEphemeral, volumeID); deleteErr != nil {
+			klog.Errorf("Failed to withdraw the claim of device %s for ephemeral volume %s: %v", id, volumeID, deleteErr)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to claim device %s for ephemeral volume %s: %v", id, volumeID, err)
+		}
+		klog.V(4).Infof("Device %s was claimed concurrently, ephemeral volume %s tries another", id, volumeID)
+		lost[id] = struct{}{}
+	}
+}
+
+// keepsEphemeralClaim reports whether the claim of an ephemeral volume holds
+// once written: the device is not allocated, and no other claim of it wins or
+// awaits its reclaim
+func (d *driver) keepsEphemeralClaim(ctx context.Context, volumeID string, claim *ephemeralClaim) (bool, error) {
+	allocations, err := d.metadata.List(ctx, metadataKindAllocation)
+	if err != nil {
+		return false, err
+	}
+	for _, data := range allocations {
+		if _, deleted := tombstoneDeletedAt(data); deleted {
+			continue
+		}
+		record := &allocationRecord{}
+		if json.Unmarshal(data, record) == nil && record.VolumeID == claim.VolumeID {
+			return false, nil
+		}
+	}
+
+	claims, err := d.ephemeralClaims.List(ctx, metadataKindEphemeral)
+	if err != nil {
+		return false, err
+	}
+	for key, data := range claims {
+		other := &ephemeralClaim{}
+		if key == volumeID || json.Unmarshal(data, other) != nil || other.VolumeID != claim.VolumeID {
+			continue
+		}
+		if other.isReleased() || !claim.precedes(volumeID, other, key) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// devicesInUse returns the volume IDs of the devices that back volumes: those
+// of PVs, allocation and quarantine records, and ephemeral claims other than
+// that of exclude
+func (d *driver) devicesInUse(ctx context.Context, exclude string) (map[string]struct{}, error) {
+	inUse := map[string]struct{}{}
+
+	pvs, err := d.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvs.Items {
+		if csiSource := pvs.Items[i].Spec.CSI; csiSource != nil && csiSource.Driver == d.name {
+			inUse[registryVolumeID(csiSource.VolumeHandle)] = struct{}{}
+		}
+	}
+
+	for _, kind := range []string{metadataKindAllocation, metadataKindQuarantine, metadataKindEphemeral} {
+		store := d.metadata
+		if kind == metadataKindEphemeral {
+			store = d.ephemeralClaims
+		}
+		records, err := store.List(ctx, kind)
+		if err != nil {
+			return nil, err
+		}
+		for key, data := range records {
+			record := struct {
+				VolumeID string `json:"volumeId"`
+			}{}
+			if kind == metadataKindEphemeral && key == exclude || json.Unmarshal(data, &record) != nil {
+				continue
+			}
+			if _, deleted := tombstoneDeletedAt(data); kind == metadataKindAllocation && deleted {
+				continue
+			}
+			inUse[record.VolumeID] = struct{}{}
+		}
+	}
+
+	return inUse, nil
+}
+
+// listEphemeralClaims returns the ephemeral volume claiming each claimed
+// device, by volume ID of the device, and the released claims, by ephemeral
+// volume ID. Released claims still claim their device until reclaimed.
+func (d *driver) listEphemeralClaims(ctx context.Context) (map[string]string, map[string]*ephemeralClaim, error) {
+	records, err := d.ephemeralClaims.List(ctx, metadataKindEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claimants := map[string]string{}
+	released := map[string]*ephemeralClaim{}
+	for key, data := range records {
+		claim := &ephemeralClaim{}
+		if err := json.Unmarshal(data, claim); err != nil {
+			klog.Warningf("Ignoring malformed ephemeral claim of %s: %v", key, err)
+			continue
+		}
+		if existing, exists := claimants[claim.VolumeID]; !exists || key < existing {
+			claimants[claim.VolumeID] = key
+		}
+		if claim.isReleased() {
+			released[key] = claim
+		}
+	}
+
+	return claimants, released, nil
+}
+
+// syncEphemeralClaims holds the free devices claimed by ephemeral volumes out
+// of the pool, and reclaims those released since. On failure the known claims
+// are kept. Caller must hold the mutex.
+func (r *DeviceRegistry) syncEphemeralClaims(ctx context.Context) {
+	claimants, released, err := r.Driver.listEphemeralClaims(ctx)
+	if err != nil {
+		klog.Warningf("Failed to list the devices claimed by ephemeral volumes, keeping the known claims: %v", err)
+		return
+	}
+
+	for key, claim := range released {
+		if r.reclaimEphemeral(ctx, key, claim) {
+			delete(claimants, claim.VolumeID)
+		}
+	}
+
+	for id, device := range r.devices {
+		claimant := claimants[id]
+		switch {
+		case claimant == device.EphemeralVolume:
+		case device.IsAllocated || device.isQuarantined():
+			if _, reclaiming := released[claimant]; claimant != "" && !reclaiming {
+				klog.Errorf("Device %s of volume %s is claimed by ephemeral volume %s", id, device.VolName, claimant)
+			}
+		case claimant != "":
+			if _, free := r.availableNQNs[id]; free || device.EphemeralVolume != "" {
+				registryLog.V(4).Infof("Device %s is claimed by ephemeral volume %s, holding it out of the pool", id, claimant)
+				delete(r.availableNQNs, id)
+				device.EphemeralVolume = claimant
+			}
+		default:
+			registryLog.V(4).Infof("Device %s was released by ephemeral volume %s, returned to the pool", id, device.EphemeralVolume)
+			device.EphemeralVolume = ""
+			r.availableNQNs[id] = struct{}{}
+		}
+	}
+}
+
+// reclaimEphemeral reclaims the device of a released ephemeral claim, then
+// removes the claim, and reports whether it was removed. A device to be wiped
+// is quarantined until the reclaim loop wiped it, as that of a deleted volume,
+// and one registered by no discovery yet is registered stale meanwhile. Other
+// devices return to the pool right away. Caller must hold the mutex.
+func (r *DeviceRegistry) reclaimEphemeral(ctx context.Context, key string, claim *ephemeralClaim) bool {
+	id := claim.VolumeID
+	device, exists := r.devices[id]
+	switch {
+	case exists && device.isQuarantined() && device.VolName == key:
+		// Quarantined by a previous sync that failed to remove the claim
+	case exists && (device.IsAllocated || device.isQuarantined()):
+		klog.Errorf("Device %s of volume %s has a released claim of ephemeral volume %s", id, device.VolName, key)
+	case r.Driver.wipeOnDelete:
+		now := time.Now()
+		record := &quarantineRecord{
+			VolumeID:   id,
+			VolumeName: key,
+			Transport:  claim.Transport,
+			Endpoints:  claim.Endpoints,
+			Expiry:     now,
+			DeletedAt:  now,
+		}
+		if exists {
+			record.Capacity = device.Capacity
+		}
+		if err := r.Driver.metadata.Put(ctx, metadataKindQuarantine, id, record); err != nil {
+			klog.Warningf("Failed to quarantine device %s released by ephemeral volume %s, retrying later: %v", id, key, err)
+			return false
+		}
+		if !exists {
+			device = record.volumeInfo(id)
+			r.devices[id] = device
+		}
+		delete(r.availableNQNs, id)
+		r.quarantined[key] = id
+		device.VolName = key
+		device.EphemeralVolume = ""
+		device.QuarantinedUntil = record.Expiry
+		klog.Infof("Quarantined device %s released by ephemeral volume %s until wiped", id, key)
+	}
+
+	if err := r.Driver.ephemeralClaims.Delete(ctx, metadataKindEphemeral, key); err != nil {
+		klog.Warningf("Failed to remove the released claim of ephemeral volume %s, retrying later: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// refreshEphemeralClaims syncs the claims of ephemeral volumes outside of an allocation
+func (r *DeviceRegistry) refreshEphemeralClaims(ctx context.Context) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.syncEphemeralClaims(ctx)
+}
+
+// checkEphemeralClaim verifies, once the allocation of a device is recorded,
+// that no node claimed it for an ephemeral volume meanwhile. A claimed device
+// is held out of the pool and its allocation record removed, for the caller
+// to select another. Caller must hold the mutex.
+func (r *DeviceRegistry) checkEphemeralClaim(ctx context.Context, device *VolumeInfo, volumeName string) error {
+	if !r.Driver.ephemeralVolumes {
+		return nil
+	}
+
+	id := device.volumeID()
+	claimants, _, err := r.Driver.listEphemeralClaims(ctx)
+	if err != nil {
+		r.forgetAllocation(volumeName)
+		return fmt.Errorf("%w: failed to list the devices claimed by ephemeral volumes: %v", ErrEtcdUnavailable, err)
+	}
+	claimant, claimed := claimants[id]
+	if !claimed {
+		return nil
+	}
+
+	if err := r.removeAllocation(ctx, volumeName); err != nil {
+		return err
+	}
+	klog.Warningf("Device %s was claimed by ephemeral volume %s while allocated to volume %s, selecting another", id, claimant, volumeName)
+	delete(r.availableNQNs, id)
+	device.EphemeralVolume = claimant
+
+	return nil
+}
+
+// loadEphemeralClaim reads the local claim of an ephemeral volume, nil if there is none
+func loadEphemeralClaim(path string) (*ephemeralClaim, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claim := &ephemeralClaim{}
+	if err := json.Unmarshal(data, claim); err != nil {
+		return nil, fmt.Errorf("malformed claim %s: %v", path, err)
+	}
+	return claim, nil
+}
+
+// saveEphemeralClaim writes the local claim of an ephemeral volume
+func saveEphemeralClaim(path string, claim *ephemeralClaim) error {
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newEphemeralRegistry returns the registry of a controller serving ephemeral
+// volumes, with a free device for each of registered
+func newEphemeralRegistry(t *testing.T, backend *fakeBackend, wipeOnDelete bool, registered ...string) *DeviceRegistry {
+	t.Helper()
+	c, _ := newTestControllerServer(t, backend)
+	claims, err := newFileStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Driver.ephemeralVolumes = true
+	c.Driver.ephemeralClaims = claims
+	c.Driver.wipeOnDelete = wipeOnDelete
+
+	r := c.deviceRegistry
+	for _, id := range registered {
+		nqn, nsid := parseVolumeID(id)
+		r.devices[id] = &VolumeInfo{nvmfDiskInfo: &nvmfDiskInfo{Nqn: nqn, Nsid: nsid, Transport: "tcp"}}
+		r.availableNQNs[id] = struct{}{}
+	}
+	return r
+}
+
+func TestEphemeralClaimLifecycle(t *testing.T) {
+	const ephemeralID = "csi-0123456789abcdef"
+	claimedAt := time.Now().Add(-time.Hour).UTC()
+
+	tests := []struct {
+		name         string
+		registered   bool
+		wipeOnDelete bool
+		released     bool
+		// State once the controller synced the claims
+		wantHeld        bool
+		wantQuarantined bool
+		wantClaim       bool
+		// State once the reclaim loop ran
+		wantWiped      []namespaceRef
+		wantFree       bool
+		wantRegistered bool
+	}{
+		{
+			name:           "claimed device is held out of the pool",
+			registered:     true,
+			wantHeld:       true,
+			wantClaim:      true,
+			wantRegistered: true,
+		},
+		{
+			name:            "released device is wiped before returning to the pool",
+			registered:      true,
+			wipeOnDelete:    true,
+			released:        true,
+			wantQuarantined: true,
+			wantWiped:       []namespaceRef{{nqn: testVolumeNqn}},
+			wantFree:        true,
+			wantRegistered:  true,
+		},
+		{
+			name:           "released device returns to the pool without wipe",
+			registered:     true,
+			released:       true,
+			wantFree:       true,
+			wantRegistered: true,
+		},
+		{
+			name:            "released device of no discovery is wiped",
+			wipeOnDelete:    true,
+			released:        true,
+			wantQuarantined: true,
+			wantWiped:       []namespaceRef{{nqn: testVolumeNqn}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(BackendCapabilityWipe)
+			registered := []string{}
+			if test.registered {
+				registered = append(registered, testVolumeNqn)
+			}
+			r := newEphemeralRegistry(t, backend, test.wipeOnDelete, registered...)
+			ctx := context.Background()
+
+			claim := &ephemeralClaim{VolumeID: testVolumeNqn, Transport: "tcp", NodeID: "node-1", ClaimedAt: claimedAt}
+			if test.released {
+				claim.ReleasedAt = time.Now().UTC()
+			}
+			if err := r.Driver.ephemeralClaims.Put(ctx, metadataKindEphemeral, ephemeralID, claim); err != nil {
+				t.Fatal(err)
+			}
+
+			r.refreshEphemeralClaims(ctx)
+			device, exists := r.devices[testVolumeNqn]
+			if held := exists && device.EphemeralVolume == ephemeralID; held != test.wantHeld {
+				t.Errorf("held = %v, want %v", held, test.wantHeld)
+			}
+			if quarantined := exists && device.isQuarantined(); quarantined != test.wantQuarantined {
+				t.Errorf("quarantined = %v, want %v", quarantined, test.wantQuarantined)
+			}
+			if _, free := r.availableNQNs[testVolumeNqn]; free && (test.wantHeld || test.wantQuarantined) {
+				t.Errorf("device of an unreclaimed claim is in the pool")
+			}
+			found, err := r.Driver.ephemeralClaims.Get(ctx, metadataKindEphemeral, ephemeralID, &ephemeralClaim{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != test.wantClaim {
+				t.Errorf("claim present = %v, want %v", found, test.wantClaim)
+			}
+
+			r.ReclaimExpired(ctx, time.Now())
+			if !reflect.DeepEqual(backend.wiped, test.wantWiped) {
+				t.Errorf("wiped = %v, want %v", backend.wiped, test.wantWiped)
+			}
+			if _, free := r.availableNQNs[testVolumeNqn]; free != test.wantFree {
+				t.Errorf("free = %v, want %v", free, test.wantFree)
+			}
+			if _, exists := r.devices[testVolumeNqn]; exists != test.wantRegistered {
+				t.Errorf("registered = %v, want %v", exists, test.wantRegistered)
+			}
+			records, err := r.Driver.metadata.List(ctx, metadataKindQuarantine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 0 {
+				t.Errorf("%d quarantine record(s) left after the reclaim", len(records))
+			}
+		})
+	}
+}
+
+func TestKeepsEphemeralClaim(t *testing.T) {
+	now := time.Now().UTC()
+	const (
+		ownKey   = "csi-own"
+		otherKey = "csi-other"
+	)
+
+	tests := []struct {
+		name      string
+		other     *ephemeralClaim
+		allocated bool
+		want      bool
+	}{
+		{name: "only claim", want: true},
+		{name: "device allocated", allocated: true, want: false},
+		{name: "earlier claim wins", other: &ephemeralClaim{VolumeID: testVolumeNqn, ClaimedAt: now.Add(-time.Second)}, want: false},
+		{name: "later claim loses", other: &ephemeralClaim{VolumeID: testVolumeNqn, ClaimedAt: now.Add(time.Second)}, want: true},
+		{name: "released claim awaits its reclaim", other: &ephemeralClaim{VolumeID: testVolumeNqn, ClaimedAt: now.Add(time.Second), ReleasedAt: now}, want: false},
+		{name: "claim of another device", other: &ephemeralClaim{VolumeID: "nqn.2024-01.io.example:volume-2", ClaimedAt: now.Add(-time.Second)}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newEphemeralRegistry(t, newFakeBackend(), false)
+			ctx := context.Background()
+			if test.other != nil {
+				if err := r.Driver.ephemeralClaims.Put(ctx, metadataKindEphemeral, otherKey, test.other); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.allocated {
+				if err := r.Driver.metadata.Put(ctx, metadataKindAllocation, "pv-1", &allocationRecord{VolumeID: testVolumeNqn}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := r.Driver.keepsEphemeralClaim(ctx, ownKey, &ephemeralClaim{VolumeID: testVolumeNqn, ClaimedAt: now})
+			if err != nil {
+				t.Fatalf("keepsEphemeralClaim: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("keepsEphemeralClaim = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTeardownEphemeralReleasesClaim(t *testing.T) {
+	const ephemeralID = "csi-0123456789abcdef"
+	n := newTestNodeServer(newFakeNvmeClient())
+	claims, err := newFileStore(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Driver.ephemeralDir = t.TempDir()
+	n.Driver.ephemeralClaims = claims
+	ctx := context.Background()
+
+	claim := &ephemeralClaim{VolumeID: testVolumeNqn, Transport: "tcp", NodeID: "node-1", ClaimedAt: time.Now().UTC()}
+	if err := claims.Put(ctx, metadataKindEphemeral, ephemeralID, claim); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveEphemeralClaim(n.Driver.ephemeralClaimPath(ephemeralID), claim); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.teardownEphemeral(ctx, ephemeralID, claim); err != nil {
+		t.Fatalf("teardownEphemeral: %v", err)
+	}
+
+	// The claim is left for the controller to reclaim the device
+	stored := &ephemeralClaim{}
+	found, err := claims.Get(ctx, metadataKindEphemeral, ephemeralID, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !stored.isReleased() {
+		t.Errorf("stored claim = %+v (found %v), want it released", stored, found)
+	}
+	if _, err := os.Stat(n.Driver.ephemeralClaimPath(ephemeralID)); !os.IsNotExist(err) {
+		t.Errorf("local claim left behind: %v", err)
+	}
+}
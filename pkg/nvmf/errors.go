@@ -16,7 +16,24 @@ limitations under the License.
 
 package nvmf
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors of the device registry, mapped to gRPC codes by registryStatus
+var (
+	ErrNoSuitableDevice = errors.New("no suitable device available")
+	ErrOutOfRange       = errors.New("capacity out of range")
+	ErrAlreadyAllocated = errors.New("volume already allocated")
+	ErrDeviceNotFound   = errors.New("device not found")
+	ErrDeviceNotFree    = errors.New("device not free")
+	ErrEtcdUnavailable  = errors.New("kubernetes API unavailable")
+)
+
+// ErrDeviceNodeMissing is returned when a connected namespace exposes no device node in time
+var ErrDeviceNodeMissing = errors.New("namespace device node did not appear")
 
 type NoControllerError struct {
 	Nqn     string
@@ -34,3 +51,26 @@ type UnsupportedHostnqnError struct {
 func (e *UnsupportedHostnqnError) Error() string {
 	return fmt.Sprintf("unsupported hostnqn sysfs file: target=%s", e.Target)
 }
+
+// TimeoutError is returned when an NVMe-oF operation does not complete in time
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Operation, e.Timeout)
+}
+
+// DiscoveryError is returned when the targets of a StorageClass cannot be discovered
+type DiscoveryError struct {
+	Err error
+}
+
+func (e *DiscoveryError) Error() string {
+	return fmt.Sprintf("device discovery failed: %v", e.Err)
+}
+
+func (e *DiscoveryError) Unwrap() error {
+	return e.Err
+}
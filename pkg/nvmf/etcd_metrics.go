@@ -0,0 +1,106 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// etcdLatencyBuckets are the upper bounds in seconds of the etcd latency histogram
+var etcdLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// operationHistogram is the latency histogram and error count of one operation
+type operationHistogram struct {
+	buckets []uint64 // Observations per bucket, not cumulative
+	count   uint64
+	sum     float64
+	errors  uint64
+}
+
+// etcdMetrics records the latency and the errors of the metadata store
+// operations, which are reads and writes of ConfigMaps in the cluster's etcd
+type etcdMetrics struct {
+	mutex      sync.Mutex
+	operations map[string]*operationHistogram
+}
+
+func newEtcdMetrics() *etcdMetrics {
+	return &etcdMetrics{operations: map[string]*operationHistogram{}}
+}
+
+// observe records an operation that took duration and failed with err, if not nil
+func (m *etcdMetrics) observe(operation string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	histogram, exists := m.operations[operation]
+	if !exists {
+		histogram = &operationHistogram{buckets: make([]uint64, len(etcdLatencyBuckets))}
+		m.operations[operation] = histogram
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range etcdLatencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+			break
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+	if err != nil {
+		histogram.errors++
+	}
+}
+
+// writeMetrics writes the histograms and error counters in the Prometheus text format
+func (m *etcdMetrics) writeMetrics(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	operations := make([]string, 0, len(m.operations))
+	for operation := range m.operations {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	fmt.Fprintf(w, "# HELP csi_nvmf_etcd_operation_duration_seconds Latency of the metadata store operations on etcd\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_etcd_operation_duration_seconds histogram\n")
+	for _, operation := range operations {
+		histogram := m.operations[operation]
+		cumulative := uint64(0)
+		for i, bound := range etcdLatencyBuckets {
+			cumulative += histogram.buckets[i]
+			fmt.Fprintf(w, "csi_nvmf_etcd_operation_duration_seconds_bucket{operation=%q,le=%q} %d\n",
+				operation, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "csi_nvmf_etcd_operation_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, histogram.count)
+		fmt.Fprintf(w, "csi_nvmf_etcd_operation_duration_seconds_sum{operation=%q} %g\n", operation, histogram.sum)
+		fmt.Fprintf(w, "csi_nvmf_etcd_operation_duration_seconds_count{operation=%q} %d\n", operation, histogram.count)
+	}
+
+	fmt.Fprintf(w, "# HELP csi_nvmf_etcd_operation_errors_total Failed metadata store operations on etcd\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_etcd_operation_errors_total counter\n")
+	for _, operation := range operations {
+		fmt.Fprintf(w, "csi_nvmf_etcd_operation_errors_total{operation=%q} %d\n", operation, m.operations[operation].errors)
+	}
+}
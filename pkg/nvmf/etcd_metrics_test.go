@@ -0,0 +1,144 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestEtcdMetricsObserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		err      error
+		// wantBucket is the index of the bucket of the observation, -1 for none but +Inf
+		wantBucket int
+		wantErrors uint64
+	}{
+		{name: "fast operation", duration: time.Millisecond, wantBucket: 0},
+		{name: "on a bucket bound", duration: 10 * time.Millisecond, wantBucket: 1},
+		{name: "between bucket bounds", duration: 300 * time.Millisecond, wantBucket: 6},
+		{name: "beyond the last bound", duration: time.Minute, wantBucket: -1},
+		{name: "failed operation", duration: time.Millisecond, err: errors.New("etcdserver: request timed out"), wantBucket: 0, wantErrors: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newEtcdMetrics()
+			m.observe("put", test.duration, test.err)
+
+			histogram := m.operations["put"]
+			want := make([]uint64, len(etcdLatencyBuckets))
+			if test.wantBucket >= 0 {
+				want[test.wantBucket] = 1
+			}
+			if !reflect.DeepEqual(histogram.buckets, want) {
+				t.Errorf("buckets = %v, want %v", histogram.buckets, want)
+			}
+			if histogram.count != 1 || histogram.sum != test.duration.Seconds() {
+				t.Errorf("count %d and sum %g, want 1 and %g", histogram.count, histogram.sum, test.duration.Seconds())
+			}
+			if histogram.errors != test.wantErrors {
+				t.Errorf("errors = %d, want %d", histogram.errors, test.wantErrors)
+			}
+		})
+	}
+}
+
+func TestEtcdMetricsExported(t *testing.T) {
+	tests := []struct {
+		name      string
+		createErr error
+		wantLines []string
+	}{
+		{
+			name: "allocation",
+			wantLines: []string{
+				`csi_nvmf_etcd_operation_duration_seconds_bucket{operation="put",le="+Inf"} 1`,
+				`csi_nvmf_etcd_operation_duration_seconds_count{operation="put"} 1`,
+				`csi_nvmf_etcd_operation_errors_total{operation="put"} 0`,
+			},
+		},
+		{
+			name:      "failed allocation write",
+			createErr: errors.New("etcdserver: request timed out"),
+			wantLines: []string{
+				`csi_nvmf_etcd_operation_duration_seconds_count{operation="put"} 1`,
+				`csi_nvmf_etcd_operation_errors_total{operation="put"} 1`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, kubeClient := newTestControllerServer(t, newFakeBackend())
+			c.Driver.controllerServer = c
+			c.Driver.metadata = newMetadataStore(kubeClient, "kube-system", DefaultDriverName, "")
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			if err := c.deviceRegistry.EnsureInitialSync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if test.createErr != nil {
+				kubeClient.PrependReactor("create", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, test.createErr
+				})
+			}
+
+			_, err := c.CreateVolume(context.Background(), createRequest("pv-1", nil))
+			if (err != nil) != (test.createErr != nil) {
+				t.Fatalf("CreateVolume = %v, want error %v", err, test.createErr != nil)
+			}
+
+			rec := httptest.NewRecorder()
+			c.Driver.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET /metrics status = %d", rec.Code)
+			}
+			lines := map[string]bool{}
+			for _, line := range strings.Split(rec.Body.String(), "\n") {
+				lines[line] = true
+			}
+			for _, want := range test.wantLines {
+				if !lines[want] {
+					t.Errorf("metrics miss %q:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEtcdMetricsOnlyOfTheMetadataStore(t *testing.T) {
+	// The file store is not etcd, so the endpoint has no etcd metrics
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.controllerServer = c
+	rec := httptest.NewRecorder()
+	c.Driver.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "csi_nvmf_etcd_operation") {
+		t.Errorf("metrics of the file store contain etcd metrics:\n%s", rec.Body.String())
+	}
+}
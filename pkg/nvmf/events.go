@@ -0,0 +1,102 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// PVC reference passed by the external-provisioner when run with --extra-create-metadata
+const (
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// Reasons of the events emitted by the controller
+const (
+	eventReasonDiscoveryFailed  = "DeviceDiscoveryFailed"
+	eventReasonPoolExhausted    = "DevicePoolExhausted"
+	eventReasonAllocationFailed = "DeviceAllocationFailed"
+)
+
+// eventRecorder emits Kubernetes events about the PVC a request was made for.
+// A nil recorder discards all events.
+type eventRecorder struct {
+	client    kubernetes.Interface
+	component string
+}
+
+func newEventRecorder(client kubernetes.Interface, driverName string) *eventRecorder {
+	return &eventRecorder{
+		client:    client,
+		component: driverName,
+	}
+}
+
+// warnPVC records a warning event on the PVC referenced by the request parameters.
+// Failures are only logged, since events are best effort.
+func (e *eventRecorder) warnPVC(ctx context.Context, params *VolumeParams, reason, messageFmt string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+
+	name, namespace := params.PVCName, params.PVCNamespace
+	if name == "" || namespace == "" {
+		klog.V(4).Infof("No PVC reference in request, not recording %s event", reason)
+		return
+	}
+
+	pvc, err := e.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("Cannot resolve PVC %s/%s, not recording %s event: %v", namespace, name, reason, err)
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pvc.Name + ".",
+			Namespace:    pvc.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:            "PersistentVolumeClaim",
+			APIVersion:      "v1",
+			Name:            pvc.Name,
+			Namespace:       pvc.Namespace,
+			UID:             pvc.UID,
+			ResourceVersion: pvc.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: e.component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := e.client.CoreV1().Events(pvc.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		klog.Warningf("Failed to record %s event on PVC %s/%s: %v", reason, namespace, name, err)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreateVolumeResourceExhaustedEvent(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "claim-a", Namespace: "team-a", UID: "uid-a"}}
+	pvcParams := map[string]string{paramPVCName: "claim-a", paramPVCNamespace: "team-a"}
+
+	tests := []struct {
+		name string
+		// allocated allocates the only device before the request
+		allocated bool
+		required  int64
+		params    map[string]string
+		// disabled leaves the driver without an event recorder
+		disabled   bool
+		wantReason string
+	}{
+		{name: "pool exhausted", allocated: true, params: pvcParams, wantReason: eventReasonPoolExhausted},
+		{name: "no device large enough", required: 2 << 30, params: pvcParams, wantReason: eventReasonAllocationFailed},
+		{name: "no PVC reference", allocated: true},
+		{name: "unknown PVC", allocated: true, params: map[string]string{paramPVCName: "claim-b", paramPVCNamespace: "team-a"}},
+		{name: "events disabled", allocated: true, params: pvcParams, disabled: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, kubeClient := newTestControllerServer(t, newFakeBackend(), pvc)
+			if !test.disabled {
+				c.Driver.events = newEventRecorder(kubeClient, DefaultDriverName)
+			}
+			c.Driver.probeDeviceCapacity = true
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.sizes["/dev/nvme0n1"] = 1 << 30
+			if test.allocated {
+				if _, err := c.CreateVolume(ctx, createRequest("pv-a", nil)); err != nil {
+					t.Fatalf("CreateVolume(pv-a): %v", err)
+				}
+			}
+
+			req := createRequest("pv-b", test.params)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: test.required}
+			if _, err := c.CreateVolume(ctx, req); status.Code(err) != codes.ResourceExhausted {
+				t.Fatalf("CreateVolume code = %v, want ResourceExhausted: %v", status.Code(err), err)
+			}
+
+			events, err := kubeClient.CoreV1().Events("team-a").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("List events: %v", err)
+			}
+			if test.wantReason == "" {
+				if len(events.Items) != 0 {
+					t.Errorf("events = %+v, want none", events.Items)
+				}
+				return
+			}
+
+			// A single warning is recorded on the PVC the volume was requested for
+			if len(events.Items) != 1 {
+				t.Fatalf("events = %+v, want one", events.Items)
+			}
+			event := events.Items[0]
+			if event.Reason != test.wantReason || event.Type != corev1.EventTypeWarning || event.Message == "" {
+				t.Errorf("event %s %s %q, want a %s warning", event.Type, event.Reason, event.Message, test.wantReason)
+			}
+			want := corev1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Name: "claim-a", Namespace: "team-a", UID: "uid-a"}
+			if event.InvolvedObject != want {
+				t.Errorf("event involves %+v, want %+v", event.InvolvedObject, want)
+			}
+			if event.Source.Component != DefaultDriverName {
+				t.Errorf("event source %q, want %q", event.Source.Component, DefaultDriverName)
+			}
+		})
+	}
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package nvmf
 
 import (
+	"bytes"
+	"context"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
@@ -32,69 +37,335 @@ import (
 type Connector struct {
 	VolumeID        string
 	TargetNqn       string
+	Nsid            uint32
 	TargetEndpoints []string
 	Transport       string
 	HostNqn         string
 	RetryCount      int32
 	CheckInterval   int32
+
+	// ConnectArgs are extra fabrics options such as keep_alive_tmo=5
+	ConnectArgs []string
+
+	// Timeout bounds each connect and disconnect, 0 waits forever
+	Timeout time.Duration `json:"-"`
+
+	// ConnectRetries is the number of retries of a transiently failing connect,
+	// starting ConnectRetryInterval apart and doubling after each attempt
+	ConnectRetries       int32         `json:"-"`
+	ConnectRetryInterval time.Duration `json:"-"`
+
+	// DeviceWaitTimeout bounds the wait for the namespace device node after
+	// connect, RetryCount checks CheckInterval seconds apart if 0
+	DeviceWaitTimeout time.Duration `json:"-"`
+
+	// DeviceReady decides when to look for the device node again, polling if nil
+	DeviceReady deviceReadyStrategy `json:"-"`
+
+	// DH-HMAC-CHAP secrets, never persisted
+	DhchapSecret     string `json:"-"`
+	DhchapCtrlSecret string `json:"-"`
+
+	// Deadline bounds the connect attempts and the device wait, zero if unbounded
+	Deadline time.Time `json:"-"`
+}
+
+// connectOptions configures how a Connector establishes controllers
+type connectOptions struct {
+	Timeout       time.Duration
+	Retries       int32
+	RetryInterval time.Duration
+	DeviceWait    time.Duration
+	DeviceReady   deviceReadyStrategy
+	Deadline      time.Time // Deadline of the request connecting, zero if none
 }
 
-func getNvmfConnector(nvmfInfo *nvmfDiskInfo, hostnqn string) *Connector {
+// maxConnectRetryBackoff caps the exponential backoff between connect attempts
+const maxConnectRetryBackoff = 30 * time.Second
+
+// deviceWaitInterval is the longest delay between lookups of the device node
+// after connect
+const deviceWaitInterval = time.Second
+
+func getNvmfConnector(nvmfInfo *nvmfDiskInfo, hostnqn string, opts connectOptions) *Connector {
 	return &Connector{
-		VolumeID:        nvmfInfo.VolName,
-		TargetNqn:       nvmfInfo.Nqn,
-		TargetEndpoints: nvmfInfo.Endpoints,
-		Transport:       nvmfInfo.Transport,
-		HostNqn:         hostnqn,
-		RetryCount:      10, // Default retry count
-		CheckInterval:   1,  // Default check interval in seconds
+		VolumeID:             nvmfInfo.VolName,
+		TargetNqn:            nvmfInfo.Nqn,
+		Nsid:                 nvmfInfo.Nsid,
+		TargetEndpoints:      nvmfInfo.Endpoints,
+		Transport:            nvmfInfo.Transport,
+		HostNqn:              hostnqn,
+		ConnectArgs:          nvmfInfo.ConnectArgs,
+		RetryCount:           10, // Default retry count
+		CheckInterval:        1,  // Default check interval in seconds
+		Timeout:              opts.Timeout,
+		ConnectRetries:       opts.Retries,
+		ConnectRetryInterval: opts.RetryInterval,
+		DeviceWaitTimeout:    opts.DeviceWait,
+		DeviceReady:          opts.DeviceReady,
+		Deadline:             opts.Deadline,
 	}
 }
 
 // connector provides a struct to hold all of the needed parameters to make nvmf connection
 
-func _connect(argStr string, maxRetries, intervalSeconds int32) error {
+// _connect writes the connect arguments to the fabrics device. Transient failures
+// are retried up to retries times with exponential backoff, calling cleanup before
+// each retry to remove any controller the failed attempt left behind.
+func _connect(argStr string, retries int32, interval, timeout time.Duration, deadline time.Time, cleanup func()) error {
 	var err error
-	for i := int32(0); i < maxRetries; i++ {
-		time.Sleep(time.Second * time.Duration(intervalSeconds))
-		file, err := os.OpenFile("/dev/nvme-fabrics", os.O_RDWR, 0666)
-		if err != nil {
-			klog.Warningf("_connect: attempt %d/%d for '%s', error opening /dev/nvme-fabrics: %v", i+1, maxRetries, argStr, err)
-			continue
+	backoff := interval
+	loggedArgs := redactConnectArgs(argStr)
+	start := time.Now()
+	for i := int32(0); i <= retries; i++ {
+		// No attempt is started that could not finish by the deadline
+		attemptTimeout := timeout
+		if !deadline.IsZero() {
+			wait := time.Duration(0)
+			if i > 0 {
+				wait = backoff
+			}
+			remaining := time.Until(deadline) - wait
+			if remaining <= 0 {
+				klog.Errorf("_connect: deadline reached after %d attempt(s) for '%s'", i, loggedArgs)
+				return &TimeoutError{Operation: "nvme connect", Timeout: time.Since(start)}
+			}
+			if attemptTimeout <= 0 || attemptTimeout > remaining {
+				attemptTimeout = remaining
+			}
 		}
 
-		defer file.Close()
-		err = utils.WriteStringToFile(file, argStr)
-		if err != nil {
-			klog.Warningf("_connect: attempt %d/%d to write arg for '%s' failed: %v", i+1, maxRetries, argStr, err)
-			continue
+		if i > 0 {
+			cleanup()
+			nvmeLog.V(4).Infof("_connect: retrying '%s' in %v", loggedArgs, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxConnectRetryBackoff {
+				backoff = maxConnectRetryBackoff
+			}
 		}
 
-		// todo: read file to verify
-		lines, _ := utils.ReadLinesFromFile(file)
-		klog.Infof("Connect: read string %s", lines)
-
-		return nil
+		var response string
+		err = runWithTimeout("nvme connect", attemptTimeout, func() error {
+			var writeErr error
+			response, writeErr = fabricsConnect(argStr)
+			return writeErr
+		}, func(err error) {
+			// The kernel finished connecting after we gave up, remove the controller it created
+			if err == nil {
+				deleteConnectedController(response)
+			}
+		})
+		if err == nil {
+			klog.Infof("Connect: read string %s", response)
+			return nil
+		}
+		if _, ok := err.(*TimeoutError); ok {
+			klog.Errorf("_connect: attempt %d/%d for '%s' timed out, giving up", i+1, retries+1, loggedArgs)
+			return err
+		}
+		if !isTransientConnectError(err) {
+			klog.Errorf("_connect: attempt %d/%d for '%s' failed permanently: %v", i+1, retries+1, loggedArgs, err)
+			return err
+		}
+		klog.Warningf("_connect: attempt %d/%d for '%s' failed: %v", i+1, retries+1, loggedArgs, err)
 	}
 
-	klog.Errorf("Connect: failed to connect after %d attempts", maxRetries)
+	klog.Errorf("Connect: failed to connect after %d attempts", retries+1)
 	return err
 }
 
-func _disconnect(sysfs_path string) error {
-	file, err := os.OpenFile(sysfs_path, os.O_WRONLY, 0755)
+// isTransientConnectError reports whether a failed connect may succeed when retried,
+// e.g. while the target fails over or the fabrics device is busy. Authentication
+// and argument errors are permanent.
+func isTransientConnectError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.ETIMEDOUT,
+		syscall.EHOSTUNREACH,
+		syscall.ENETUNREACH,
+		syscall.EAGAIN,
+		syscall.EBUSY,
+		syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// fabricsConnect writes connect arguments to the fabrics device, replaced in tests
+var fabricsConnect = writeConnectArgs
+
+// writeConnectArgs writes the connect arguments to /dev/nvme-fabrics and returns
+// the kernel's response, e.g. "instance=2,cntlid=1"
+func writeConnectArgs(argStr string) (string, error) {
+	file, err := os.OpenFile("/dev/nvme-fabrics", os.O_RDWR, 0666)
 	if err != nil {
+		return "", fmt.Errorf("error opening /dev/nvme-fabrics: %w", err)
+	}
+	defer file.Close()
+
+	if err := utils.WriteStringToFile(file, argStr); err != nil {
+		return "", fmt.Errorf("write arg failed: %w", err)
+	}
+
+	// todo: read file to verify
+	lines, _ := utils.ReadLinesFromFile(file)
+	if len(lines) == 0 {
+		return "", nil
+	}
+
+	return lines[0], nil
+}
+
+// deleteConnectedController removes the controller named in a connect response
+func deleteConnectedController(response string) {
+	var instance, cntlid int
+	if _, err := fmt.Sscanf(response, "instance=%d,cntlid=%d", &instance, &cntlid); err != nil {
+		klog.Warningf("Connect: cannot parse connect response %q, controller may be left behind: %v", response, err)
+		return
+	}
+
+	sysfs_del_path := fmt.Sprintf("%s/nvme%d/delete_controller", SYS_NVMF, instance)
+	klog.Warningf("Connect: removing controller nvme%d established after timeout", instance)
+	if err := _disconnect(sysfs_del_path, 0); err != nil {
+		klog.Errorf("Connect: failed to remove controller nvme%d: %v", instance, err)
+	}
+}
+
+// runWithTimeout runs fn and stops waiting for it once timeout expires, returning a
+// TimeoutError. Kernel writes cannot be interrupted, so fn keeps running; if set,
+// onAbandoned is called with its result when it eventually returns.
+// A timeout of zero waits forever.
+func runWithTimeout(operation string, timeout time.Duration, fn func() error, onAbandoned func(error)) error {
+	if timeout <= 0 {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
 		return err
+	case <-timer.C:
+	}
+
+	if onAbandoned != nil {
+		go func() {
+			onAbandoned(<-done)
+		}()
+	}
+
+	return &TimeoutError{Operation: operation, Timeout: timeout}
+}
+
+func _disconnect(sysfs_path string, timeout time.Duration) error {
+	return runWithTimeout("nvme disconnect", timeout, func() error {
+		file, err := os.OpenFile(sysfs_path, os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		err = utils.WriteStringToFile(file, "1")
+		if err != nil {
+			klog.Errorf("Disconnect: write 1 to delete_controller error: %v", err)
+			return err
+		}
+		return nil
+	}, nil)
+}
+
+// runNvmeCli runs nvme-cli with the given arguments and returns its standard output.
+// The command runs in its own process group, which is killed if it does not exit
+// within timeout or if ctx is done. A timeout of zero waits for ctx only.
+func runNvmeCli(ctx context.Context, timeout time.Duration, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("nvme", args...)
+	cmd.Stdout = &stdout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case err := <-done:
+		nvmeLog.V(5).Infof("nvme %s exited: %v, output: %s", strings.Join(args, " "), err, stdout.String())
+		return stdout.Bytes(), err
+	case <-expired:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, &TimeoutError{Operation: "nvme " + strings.Join(args, " "), Timeout: timeout}
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, ctx.Err()
 	}
-	err = utils.WriteStringToFile(file, "1")
+}
+
+// cleanupDiscoveryControllers removes discovery controllers connected to the
+// given address, as left behind by an nvme discover that was killed
+func cleanupDiscoveryControllers(transport, traddr, trsvcid string, timeout time.Duration) {
+	deleteControllersAt(NVMF_DISCOVERY_NQN, transport, traddr, trsvcid, false, timeout)
+}
+
+// deleteControllersAt removes the controllers of subsysnqn connected to the given address.
+// With skipLive, controllers in the live state are kept, so that only the remains of a
+// failed connect are removed.
+func deleteControllersAt(subsysnqn, transport, traddr, trsvcid string, skipLive bool, timeout time.Duration) {
+	devices, err := os.ReadDir(SYS_NVMF)
 	if err != nil {
-		klog.Errorf("Disconnect: write 1 to delete_controller error: %v", err)
-		return err
+		klog.Errorf("Controller cleanup: readdir %s err: %s", SYS_NVMF, err)
+		return
+	}
+
+	for _, device := range devices {
+		ctrl := device.Name()
+		nqn, _ := os.ReadFile(fmt.Sprintf("%s/%s/subsysnqn", SYS_NVMF, ctrl))
+		if strings.TrimSpace(string(nqn)) != subsysnqn {
+			continue
+		}
+
+		trtype, _ := os.ReadFile(fmt.Sprintf("%s/%s/transport", SYS_NVMF, ctrl))
+		address, _ := os.ReadFile(fmt.Sprintf("%s/%s/address", SYS_NVMF, ctrl))
+		fields := strings.Split(strings.TrimSpace(string(address)), ",")
+		if !strings.EqualFold(strings.TrimSpace(string(trtype)), transport) ||
+			!containsString(fields, "traddr="+traddr) || !containsString(fields, "trsvcid="+trsvcid) {
+			continue
+		}
+		if skipLive && getControllerState(ctrl) == nvmeControllerLive {
+			continue
+		}
+
+		klog.Warningf("Controller cleanup: removing controller %s of %s at %s:%s", ctrl, subsysnqn, traddr, trsvcid)
+		if err := _disconnect(fmt.Sprintf("%s/%s/delete_controller", SYS_NVMF, ctrl), timeout); err != nil {
+			klog.Errorf("Controller cleanup: failed to remove %s: %v", ctrl, err)
+		}
 	}
-	return nil
 }
 
-func disconnectSubsysWithHostNqn(nqn, hostnqn, ctrl string) error {
+func disconnectSubsysWithHostNqn(nqn, hostnqn, ctrl string, timeout time.Duration) error {
 	sysfs_subsysnqn_path := fmt.Sprintf("%s/%s/subsysnqn", SYS_NVMF, ctrl)
 	sysfs_hostnqn_path := fmt.Sprintf("%s/%s/hostnqn", SYS_NVMF, ctrl)
 	sysfs_del_path := fmt.Sprintf("%s/%s/delete_controller", SYS_NVMF, ctrl)
@@ -135,16 +406,19 @@ func disconnectSubsysWithHostNqn(nqn, hostnqn, ctrl string) error {
 		return &NoControllerError{Nqn: nqn, Hostnqn: hostnqn}
 	}
 
-	err = _disconnect(sysfs_del_path)
+	err = _disconnect(sysfs_del_path, timeout)
 	if err != nil {
 		klog.Errorf("Disconnect: disconnect error: %s", err)
+		if _, ok := err.(*TimeoutError); ok {
+			return err
+		}
 		return &NoControllerError{Nqn: nqn, Hostnqn: hostnqn}
 	}
 
 	return nil
 }
 
-func disconnectSubsys(nqn, ctrl string) error {
+func disconnectSubsys(nqn, ctrl string, timeout time.Duration) error {
 	sysfs_subsysnqn_path := fmt.Sprintf("%s/%s/subsysnqn", SYS_NVMF, ctrl)
 	sysfs_del_path := fmt.Sprintf("%s/%s/delete_controller", SYS_NVMF, ctrl)
 
@@ -166,16 +440,19 @@ func disconnectSubsys(nqn, ctrl string) error {
 		return &NoControllerError{Nqn: nqn, Hostnqn: ""}
 	}
 
-	err = _disconnect(sysfs_del_path)
+	err = _disconnect(sysfs_del_path, timeout)
 	if err != nil {
 		klog.Errorf("Disconnect: disconnect error: %s", err)
+		if _, ok := err.(*TimeoutError); ok {
+			return err
+		}
 		return &NoControllerError{Nqn: nqn, Hostnqn: ""}
 	}
 
 	return nil
 }
 
-func disconnectByNqn(nqn, hostnqn string) int {
+func disconnectByNqn(nqn, hostnqn string, timeout time.Duration) int {
 	ret := 0
 	if len(nqn) > NVMF_NQN_SIZE {
 		klog.Errorf("Disconnect: nqn %s is too long ", nqn)
@@ -204,7 +481,10 @@ func disconnectByNqn(nqn, hostnqn string) int {
 	}
 
 	for _, device := range devices {
-		if err := disconnectSubsysWithHostNqn(nqn, hostnqn, device.Name()); err != nil {
+		if err := disconnectSubsysWithHostNqn(nqn, hostnqn, device.Name(), timeout); err != nil {
+			if _, ok := err.(*TimeoutError); ok {
+				return -ETIMEDOUT
+			}
 			if _, ok := err.(*UnsupportedHostnqnError); ok {
 				klog.Infof("Fallback because you have no hostnqn supports!")
 
@@ -217,8 +497,11 @@ func disconnectByNqn(nqn, hostnqn string) int {
 					}
 
 					for _, device := range devices {
-						if err := disconnectSubsys(nqn, device.Name()); err == nil {
+						err := disconnectSubsys(nqn, device.Name(), timeout)
+						if err == nil {
 							ret++
+						} else if _, ok := err.(*TimeoutError); ok {
+							return -ETIMEDOUT
 						}
 					}
 				}
@@ -244,41 +527,39 @@ func (c *Connector) Connect() (string, error) {
 		return "", fmt.Errorf("csi transport only support tcp/rdma ")
 	}
 
-	// TargetEndpoints is assumed to be populated (via CreateVolume) with multiple "IP:Port" entries
-	// Attempt to connect to all endpoints to support multi-path configurations
+	// TargetEndpoints is assumed to be populated (via CreateVolume) with multiple "IP:Port" entries,
+	// ordered by priority. Attempt to connect to all endpoints to support multi-path configurations
+	nvmeLog.V(4).Infof("Connect: connecting volume %s through %v in order", c.VolumeID, c.TargetEndpoints)
 	for _, endpoint := range c.TargetEndpoints {
-		// Split the endpoint into IP and port
-		parts := strings.Split(endpoint, ":")
-		if len(parts) != 2 {
-			return "", fmt.Errorf("invalid endpoint format: %s", endpoint)
-		}
-
-		ip, port := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
-		if ip == "" || port == "" {
-			return "", fmt.Errorf("empty IP or port in endpoint: %s", endpoint)
+		// Split the endpoint into IP and port, IPv6 addresses lose their brackets
+		ip, port, err := splitEndpoint(strings.TrimSpace(endpoint))
+		if err != nil {
+			return "", err
 		}
 
-		baseString := fmt.Sprintf("nqn=%s,transport=%s,traddr=%s,trsvcid=%s,hostnqn=%s", c.TargetNqn, c.Transport, ip, port, c.HostNqn)
-		klog.V(4).Infof("Running connect on %s://%s:%s", c.Transport, ip, port)
+		baseString := c.connectArgString(ip, port)
+		nvmeLog.V(4).Infof("Running connect on %s://%s", c.Transport, endpoint)
 
 		// connect to nvmf disk
-		err := _connect(baseString, c.RetryCount, c.CheckInterval)
+		err = _connect(baseString, c.ConnectRetries, c.ConnectRetryInterval, c.Timeout, c.Deadline, func() {
+			deleteControllersAt(c.TargetNqn, c.Transport, ip, port, true, c.Timeout)
+		})
 		if err != nil {
 			klog.Errorf("Connect: failed to connect to endpoint %s, error: %v", endpoint, err)
-			ret := disconnectByNqn(c.TargetNqn, c.HostNqn)
+			ret := disconnectByNqn(c.TargetNqn, c.HostNqn, c.Timeout)
 			if ret < 0 {
 				klog.Errorf("rollback error !!!")
 			}
 			return "", err
 		}
 	}
-	klog.V(4).Infof("Connect Volume %s success nqn: %s, hostnqn: %s", c.VolumeID, c.TargetNqn, c.HostNqn)
+	nvmeLog.V(4).Infof("Connect Volume %s success nqn: %s, hostnqn: %s", c.VolumeID, c.TargetNqn, c.HostNqn)
 
 	// Wait for device to be ready (find UUID and check path)
-	devicePath, err := findPathWithRetry(c.TargetNqn, c.RetryCount, c.CheckInterval)
+	devicePath, err := c.waitForDevice()
 	if err != nil {
 		klog.Errorf("connect nqn %s error %v, rollback!!!", c.TargetNqn, err)
-		ret := disconnectByNqn(c.TargetNqn, c.HostNqn)
+		ret := disconnectByNqn(c.TargetNqn, c.HostNqn, c.Timeout)
 		if ret < 0 {
 			klog.Errorf("rollback error !!!")
 		}
@@ -288,7 +569,7 @@ func (c *Connector) Connect() (string, error) {
 	// create tracking files
 	if err := createTrackingFiles(c); err != nil {
 		klog.Errorf("create nqn directory %s error %v, rollback!!!", c.TargetNqn, err)
-		ret := disconnectByNqn(c.TargetNqn, c.HostNqn)
+		ret := disconnectByNqn(c.TargetNqn, c.HostNqn, c.Timeout)
 		if ret < 0 {
 			klog.Errorf("rollback error !!!")
 		}
@@ -299,9 +580,86 @@ func (c *Connector) Connect() (string, error) {
 	return devicePath, nil
 }
 
+// waitForDevice looks for the device node of the namespace until the device
+// wait timeout, rescanning the namespaces of the subsystem between lookups,
+// since slower fabrics may only expose the namespace some time after connect.
+// The device-ready strategy decides when to look again.
+func (c *Connector) waitForDevice() (string, error) {
+	timeout := c.DeviceWaitTimeout
+	if timeout <= 0 {
+		timeout = time.Duration(c.RetryCount*c.CheckInterval) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if !c.Deadline.IsZero() && c.Deadline.Before(deadline) {
+		deadline = c.Deadline
+	}
+
+	strategy := c.DeviceReady
+	if strategy == nil {
+		strategy = sysfsPollStrategy{}
+	}
+	watch := strategy.watch()
+	defer watch.close()
+
+	for {
+		if devicePath, err := namespaceDevicePath(c.TargetNqn, c.Nsid); err == nil {
+			return devicePath, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", fmt.Errorf("%w: namespace %d of %s after %v", ErrDeviceNodeMissing, c.Nsid, c.TargetNqn, timeout)
+		}
+
+		rescanNamespaces(c.TargetNqn, c.Timeout)
+		watch.await(minDuration(remaining, deviceWaitInterval))
+	}
+}
+
+// rescanNamespaces asks the controllers of nqn to rescan their namespaces.
+// Failures are logged, the caller keeps polling for the device. Replaced in tests.
+var rescanNamespaces = func(nqn string, timeout time.Duration) {
+	devices, err := os.ReadDir(SYS_NVMF)
+	if err != nil {
+		klog.Errorf("Rescan: readdir %s err: %s", SYS_NVMF, err)
+		return
+	}
+
+	for _, device := range devices {
+		ctrl := device.Name()
+		subsysnqn, _ := os.ReadFile(filepath.Join(SYS_NVMF, ctrl, "subsysnqn"))
+		if strings.TrimSpace(string(subsysnqn)) != nqn {
+			continue
+		}
+
+		nvmeLog.V(4).Infof("Rescanning namespaces of controller %s of %s", ctrl, nqn)
+		if _, err := runNvmeCli(context.Background(), timeout, "ns-rescan", filepath.Join("/dev", ctrl)); err != nil {
+			klog.Warningf("Rescan: nvme ns-rescan of %s failed: %v", ctrl, err)
+		}
+	}
+}
+
+// connectArgString returns the arguments written to the fabrics device to connect to ip:port
+func (c *Connector) connectArgString(ip, port string) string {
+	args := fmt.Sprintf("nqn=%s,transport=%s,traddr=%s,trsvcid=%s,hostnqn=%s", c.TargetNqn, c.Transport, ip, port, c.HostNqn)
+	for _, arg := range c.ConnectArgs {
+		args += "," + arg
+	}
+	if c.DhchapSecret != "" {
+		args += "," + dhchapSecretOption + "=" + c.DhchapSecret
+	}
+	if c.DhchapCtrlSecret != "" {
+		args += "," + dhchapCtrlSecretOption + "=" + c.DhchapCtrlSecret
+	}
+
+	return args
+}
+
 // we disconnect only by nqn
 func (c *Connector) Disconnect() error {
-	ret := disconnectByNqn(c.TargetNqn, c.HostNqn)
+	ret := disconnectByNqn(c.TargetNqn, c.HostNqn, c.Timeout)
+	if ret == -ETIMEDOUT {
+		return &TimeoutError{Operation: "nvme disconnect of " + c.TargetNqn, Timeout: c.Timeout}
+	}
 	if ret < 0 {
 		return fmt.Errorf("Disconnect: failed to disconnect by nqn: %s ", c.TargetNqn)
 	}
@@ -328,28 +686,42 @@ func createTrackingFiles(c *Connector) error {
 	return nil
 }
 
-// PersistConnector persists the provided Connector to the specified file (ie /var/lib/pfile/myConnector.json)
+// hasTrackingFile reports whether this driver connected nqn with hostnqn and has
+// not disconnected it since
+func hasTrackingFile(nqn, hostnqn string) bool {
+	hostnqnPath := filepath.Join(RUN_NVMF, nqn, b64.StdEncoding.EncodeToString([]byte(hostnqn)))
+	_, err := os.Stat(hostnqnPath)
+	return err == nil
+}
+
+// persistConnectorFile writes the connector file through a temporary file
+// renamed into place, so that a failed write never leaves a partial file
 func persistConnectorFile(c *Connector, filePath string) error {
-	f, err := os.Create(filePath)
+	tmpPath := filePath + ".tmp"
+	f, err := os.Create(tmpPath)
 	if err != nil {
 		return fmt.Errorf("error creating nvmf persistence file %s: %s", filePath, err)
 	}
-	defer f.Close()
 	encoder := json.NewEncoder(f)
-	if err = encoder.Encode(c); err != nil {
+	err = encoder.Encode(c)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
 		return fmt.Errorf("error encoding connector: %v", err)
 	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error renaming nvmf persistence file %s: %v", filePath, err)
+	}
 	return nil
-
 }
 
-func removeConnectorFile(targetPath string) {
-	// todo: here maybe be attack for os.Remove can operate any file, fix?
-	if err := os.Remove(targetPath + ".json"); err != nil {
-		klog.Errorf("DetachDisk: Can't remove connector file: %s", targetPath)
-	}
-	if err := os.RemoveAll(targetPath); err != nil {
-		klog.Errorf("DetachDisk: failed to remove mount path Error: %v", err)
+// removeConnectorFile removes the connector file of a staging entry
+func removeConnectorFile(stagingPath string) {
+	if err := os.Remove(connectorFilePath(stagingPath)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("DetachDisk: Can't remove connector file: %s", stagingPath)
 	}
 }
 
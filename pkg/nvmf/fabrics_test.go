@@ -0,0 +1,309 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withFabricsConnect replaces the fabrics device write for the test, returning
+// the errors of results in turn and succeeding once they are used up
+func withFabricsConnect(t *testing.T, results ...error) *int {
+	t.Helper()
+	calls := 0
+	saved := fabricsConnect
+	fabricsConnect = func(argStr string) (string, error) {
+		calls++
+		if calls <= len(results) && results[calls-1] != nil {
+			return "", results[calls-1]
+		}
+		return "instance=1,cntlid=1", nil
+	}
+	t.Cleanup(func() { fabricsConnect = saved })
+	return &calls
+}
+
+func TestConnectRetries(t *testing.T) {
+	reset := fmt.Errorf("write arg failed: %w", &os.PathError{Op: "write", Path: "/dev/nvme-fabrics", Err: syscall.ECONNRESET})
+	busy := fmt.Errorf("error opening /dev/nvme-fabrics: %w", &os.PathError{Op: "open", Path: "/dev/nvme-fabrics", Err: syscall.EBUSY})
+	invalid := fmt.Errorf("write arg failed: %w", &os.PathError{Op: "write", Path: "/dev/nvme-fabrics", Err: syscall.EINVAL})
+
+	tests := []struct {
+		name     string
+		results  []error
+		retries  int32
+		wantErr  bool
+		calls    int
+		cleanups int
+	}{
+		{name: "first attempt succeeds", retries: 3, calls: 1},
+		{name: "fails twice then succeeds", results: []error{reset, reset}, retries: 3, calls: 3, cleanups: 2},
+		{name: "busy fabrics device is retried", results: []error{busy}, retries: 3, calls: 2, cleanups: 1},
+		{name: "permanent error is not retried", results: []error{invalid}, retries: 3, wantErr: true, calls: 1},
+		{name: "retries exhausted", results: []error{reset, reset, reset}, retries: 2, wantErr: true, calls: 3, cleanups: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := withFabricsConnect(t, test.results...)
+			cleanups := 0
+
+			err := _connect("nqn=test", test.retries, time.Millisecond, 0, time.Time{}, func() { cleanups++ })
+			if (err != nil) != test.wantErr {
+				t.Fatalf("_connect error = %v, want error %v", err, test.wantErr)
+			}
+			if *calls != test.calls {
+				t.Errorf("connect attempts = %d, want %d", *calls, test.calls)
+			}
+			if cleanups != test.cleanups {
+				t.Errorf("cleanups = %d, want %d", cleanups, test.cleanups)
+			}
+		})
+	}
+}
+
+func TestConnectDeadline(t *testing.T) {
+	reset := &os.PathError{Op: "write", Path: "/dev/nvme-fabrics", Err: syscall.ECONNRESET}
+	calls := withFabricsConnect(t, reset, reset, reset, reset)
+
+	err := _connect("nqn=test", 10, 50*time.Millisecond, 0, time.Now().Add(80*time.Millisecond), func() {})
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("_connect error = %v, want a TimeoutError", err)
+	}
+	if *calls >= 4 {
+		t.Errorf("connect attempts = %d, want the deadline to stop the retries", *calls)
+	}
+}
+
+func TestIsTransientConnectError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection refused", err: syscall.ECONNREFUSED, want: true},
+		{name: "wrapped connection reset", err: fmt.Errorf("write arg failed: %w", syscall.ECONNRESET), want: true},
+		{name: "busy open", err: fmt.Errorf("error opening /dev/nvme-fabrics: %w", &os.PathError{Err: syscall.EBUSY}), want: true},
+		{name: "try again", err: &os.PathError{Err: syscall.EAGAIN}, want: true},
+		{name: "invalid argument", err: syscall.EINVAL, want: false},
+		{name: "access denied", err: syscall.EACCES, want: false},
+		{name: "unwrapped message", err: errors.New("connection reset"), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTransientConnectError(test.err); got != test.want {
+				t.Errorf("isTransientConnectError(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// withFakeNvmeCli puts an nvme executable running script first in the PATH
+func withFakeNvmeCli(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "nvme"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRunNvmeCliTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		timeout     time.Duration
+		cancel      bool
+		wantOutput  string
+		wantTimeout bool
+		wantErr     error
+	}{
+		{name: "exits in time", script: "echo discovered", timeout: 5 * time.Second, wantOutput: "discovered\n"},
+		{name: "no timeout", script: "echo discovered", wantOutput: "discovered\n"},
+		// The backgrounded sleep holds the output open, so the call only returns
+		// early if the whole process group is killed
+		{name: "hangs past the timeout", script: "sleep 10 & wait", timeout: 200 * time.Millisecond, wantTimeout: true},
+		{name: "context canceled", script: "sleep 10 & wait", cancel: true, wantErr: context.Canceled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFakeNvmeCli(t, test.script)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancel {
+				time.AfterFunc(200*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			output, err := runNvmeCli(ctx, test.timeout, "discover", "-t", "tcp")
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("runNvmeCli returned after %v, want the hung command killed", elapsed)
+			}
+
+			var timeout *TimeoutError
+			if errors.As(err, &timeout) != test.wantTimeout {
+				t.Fatalf("runNvmeCli error = %v, want a TimeoutError %v", err, test.wantTimeout)
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("runNvmeCli error = %v, want %v", err, test.wantErr)
+			}
+			if !test.wantTimeout && test.wantErr == nil && err != nil {
+				t.Fatalf("runNvmeCli: %v", err)
+			}
+			if string(output) != test.wantOutput {
+				t.Errorf("runNvmeCli output = %q, want %q", output, test.wantOutput)
+			}
+		})
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	failed := errors.New("write failed")
+
+	tests := []struct {
+		name          string
+		delay         time.Duration
+		result        error
+		timeout       time.Duration
+		wantTimeout   bool
+		wantAbandoned bool
+	}{
+		{name: "returns in time", delay: 10 * time.Millisecond, timeout: time.Second},
+		{name: "fails in time", result: failed, timeout: time.Second},
+		{name: "no timeout", delay: 10 * time.Millisecond},
+		{name: "outlives the timeout", delay: 300 * time.Millisecond, result: failed, timeout: 50 * time.Millisecond, wantTimeout: true, wantAbandoned: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			abandoned := make(chan error, 1)
+			err := runWithTimeout("nvme connect", test.timeout, func() error {
+				time.Sleep(test.delay)
+				return test.result
+			}, func(err error) { abandoned <- err })
+
+			var timeout *TimeoutError
+			if errors.As(err, &timeout) != test.wantTimeout {
+				t.Fatalf("runWithTimeout error = %v, want a TimeoutError %v", err, test.wantTimeout)
+			}
+			if !test.wantTimeout && err != test.result {
+				t.Fatalf("runWithTimeout error = %v, want %v", err, test.result)
+			}
+
+			// The abandoned write is still cleaned up once it returns
+			wait := 100 * time.Millisecond
+			if test.wantAbandoned {
+				wait = time.Second
+			}
+			select {
+			case err := <-abandoned:
+				if !test.wantAbandoned {
+					t.Errorf("onAbandoned called with %v for a call that returned in time", err)
+				} else if err != test.result {
+					t.Errorf("onAbandoned got %v, want %v", err, test.result)
+				}
+			case <-time.After(wait):
+				if test.wantAbandoned {
+					t.Error("onAbandoned not called once the abandoned call returned")
+				}
+			}
+		})
+	}
+}
+
+// countingStrategy is a device-ready strategy waiting a few milliseconds
+// between lookups instead of deviceWaitInterval, counting the waits
+type countingStrategy struct {
+	waits *int
+}
+
+func (s countingStrategy) watch() deviceWatch {
+	return s
+}
+
+func (s countingStrategy) await(timeout time.Duration) {
+	*s.waits++
+	time.Sleep(minDuration(timeout, 5*time.Millisecond))
+}
+
+func (s countingStrategy) close() {}
+
+func TestWaitForDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		// appearsAfter is the number of failed lookups before the device
+		// node appears, -1 if it never does
+		appearsAfter int
+		timeout      time.Duration
+		wantErr      error
+		wantRescans  int
+	}{
+		{name: "present at once", timeout: time.Second},
+		{name: "appears after two polls", appearsAfter: 2, timeout: time.Second, wantRescans: 2},
+		{name: "never appears", appearsAfter: -1, timeout: 50 * time.Millisecond, wantErr: ErrDeviceNodeMissing},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookups, rescans, waits := 0, 0, 0
+			savedPath, savedRescan := namespaceDevicePath, rescanNamespaces
+			namespaceDevicePath = func(nqn string, nsid uint32) (string, error) {
+				lookups++
+				if test.appearsAfter < 0 || lookups <= test.appearsAfter {
+					return "", fmt.Errorf("namespace %d of %s not found", nsid, nqn)
+				}
+				return "/dev/nvme0n1", nil
+			}
+			rescanNamespaces = func(nqn string, timeout time.Duration) {
+				rescans++
+			}
+			t.Cleanup(func() { namespaceDevicePath, rescanNamespaces = savedPath, savedRescan })
+
+			c := &Connector{TargetNqn: testVolumeNqn, Nsid: 1, DeviceWaitTimeout: test.timeout, DeviceReady: countingStrategy{waits: &waits}}
+			start := time.Now()
+			devicePath, err := c.waitForDevice()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("waitForDevice error = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				if elapsed := time.Since(start); elapsed < test.timeout {
+					t.Errorf("waitForDevice gave up after %v, want the timeout of %v", elapsed, test.timeout)
+				}
+				if rescans == 0 {
+					t.Error("waitForDevice gave up without rescanning")
+				}
+				return
+			}
+			if devicePath != "/dev/nvme0n1" {
+				t.Errorf("waitForDevice = %s, want /dev/nvme0n1", devicePath)
+			}
+			if rescans != test.wantRescans || waits != test.wantRescans {
+				t.Errorf("rescans = %d, waits = %d, want %d of each", rescans, waits, test.wantRescans)
+			}
+		})
+	}
+}
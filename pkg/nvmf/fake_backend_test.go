@@ -0,0 +1,292 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// namespaceRef is a namespace the backend operated on, nsid 0 for a whole subsystem
+type namespaceRef struct {
+	nqn  string
+	nsid uint32
+}
+
+// namespaceCopy is a clone of a namespace, or a restore of a snapshot, into a namespace
+type namespaceCopy struct {
+	source     namespaceRef
+	snapshotID string
+	target     namespaceRef
+}
+
+// appliedQoS are limits applied to a namespace
+type appliedQoS struct {
+	namespace namespaceRef
+	qos       BackendQoS
+}
+
+// fakeBackend is a Backend keeping the host allowlists of the subsystems in
+// memory. It supports the capabilities it is created with.
+type fakeBackend struct {
+	mutex sync.Mutex
+
+	capabilities map[BackendCapability]bool
+	// allowed are the allowed host NQNs by subsystem NQN
+	allowed map[string]map[string]struct{}
+
+	// health is the admin state reported by subsystem NQN, healthy if unset
+	health map[string]*BackendVolumeHealth
+
+	// namespaces are the created namespaces by subsystem NQN and name, and
+	// nsids the last NSID created on each subsystem
+	namespaces map[string]map[string]*BackendNamespace
+	nsids      map[string]uint32
+	// namespaceSize is the size of the created namespaces, the requested one if 0
+	namespaceSize int64
+
+	// snapshots are the namespaces snapshotted by snapshot ID, and
+	// snapshotSize the size of the snapshots taken
+	snapshots    map[string]namespaceRef
+	snapshotSize int64
+
+	// wipeErrs, revokeErrs and healthErrs are returned by the next wipes,
+	// revocations and health reports, in turn
+	wipeErrs   []error
+	revokeErrs []error
+	healthErrs []error
+	// createErrs and deleteErrs are returned by the next namespace creations
+	// and deletions, in turn
+	createErrs []error
+	deleteErrs []error
+	// grantErrs are returned by the next grants, in turn, and grantHang makes
+	// the grants wait for their context to be done
+	grantErrs []error
+	grantHang bool
+	// qosErrs are returned by the next QoS applications, in turn
+	qosErrs []error
+	// publishContext is the publish context of the grants, empty if nil
+	publishContext map[string]string
+
+	// wiped are the wiped namespaces, in turn
+	wiped       []namespaceRef
+	disallowed  []string
+	grants      []string
+	revocations []string
+	// created and deleted are the volume IDs of the namespaces
+	created []string
+	deleted []string
+	// deletedSnapshots are the IDs of the deleted snapshots
+	deletedSnapshots []string
+	// copies are the clones and restores, in turn
+	copies []namespaceCopy
+	// applied are the QoS limits applied, in turn
+	applied []appliedQoS
+}
+
+func newFakeBackend(capabilities ...BackendCapability) *fakeBackend {
+	b := &fakeBackend{
+		capabilities: map[BackendCapability]bool{},
+		allowed:      map[string]map[string]struct{}{},
+		health:       map[string]*BackendVolumeHealth{},
+		namespaces:   map[string]map[string]*BackendNamespace{},
+		nsids:        map[string]uint32{},
+		snapshots:    map[string]namespaceRef{},
+	}
+	for _, capability := range capabilities {
+		b.capabilities[capability] = true
+	}
+	return b
+}
+
+func (b *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Supports(capability BackendCapability) bool {
+	return b.capabilities[capability]
+}
+
+func (b *fakeBackend) CreateSnapshot(ctx context.Context, sourceNqn string, sourceNsid uint32, snapshotID string) (*BackendSnapshot, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.snapshots[snapshotID] = namespaceRef{nqn: sourceNqn, nsid: sourceNsid}
+	return &BackendSnapshot{SizeBytes: b.snapshotSize, ReadyToUse: true}, nil
+}
+
+func (b *fakeBackend) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.snapshots, snapshotID)
+	b.deletedSnapshots = append(b.deletedSnapshots, snapshotID)
+	return nil
+}
+
+func (b *fakeBackend) CloneVolume(ctx context.Context, sourceNqn string, sourceNsid uint32, targetNqn string, targetNsid uint32) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.copies = append(b.copies, namespaceCopy{source: namespaceRef{nqn: sourceNqn, nsid: sourceNsid}, target: namespaceRef{nqn: targetNqn, nsid: targetNsid}})
+	return nil
+}
+
+func (b *fakeBackend) RestoreSnapshot(ctx context.Context, snapshotID, targetNqn string, targetNsid uint32) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.copies = append(b.copies, namespaceCopy{snapshotID: snapshotID, target: namespaceRef{nqn: targetNqn, nsid: targetNsid}})
+	return nil
+}
+
+func (b *fakeBackend) WipeVolume(ctx context.Context, targetNqn string, nsid uint32) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := popError(&b.wipeErrs); err != nil {
+		return err
+	}
+	b.wiped = append(b.wiped, namespaceRef{nqn: targetNqn, nsid: nsid})
+	return nil
+}
+
+func (b *fakeBackend) GrantNodeAccess(ctx context.Context, targetNqn string, nsid uint32, nodeID, hostNqn string) (map[string]string, error) {
+	b.mutex.Lock()
+	b.grants = append(b.grants, nodeID)
+	err := popError(&b.grantErrs)
+	hang := b.grantHang
+	publishContext := map[string]string{}
+	for key, value := range b.publishContext {
+		publishContext[key] = value
+	}
+	b.mutex.Unlock()
+
+	// The mutex is not held while hanging, so that the grant can be revoked
+	if hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return publishContext, nil
+}
+
+func (b *fakeBackend) RevokeNodeAccess(ctx context.Context, targetNqn string, nsid uint32, nodeID, hostNqn string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.revocations = append(b.revocations, nodeID)
+	return popError(&b.revokeErrs)
+}
+
+func (b *fakeBackend) ApplyQoS(ctx context.Context, targetNqn string, nsid uint32, qos BackendQoS) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := popError(&b.qosErrs); err != nil {
+		return err
+	}
+	b.applied = append(b.applied, appliedQoS{namespace: namespaceRef{nqn: targetNqn, nsid: nsid}, qos: qos})
+	return nil
+}
+
+func (b *fakeBackend) VolumeHealth(ctx context.Context, targetNqn string, nsid uint32) (*BackendVolumeHealth, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := popError(&b.healthErrs); err != nil {
+		return nil, err
+	}
+	if health, exists := b.health[targetNqn]; exists {
+		return health, nil
+	}
+	return &BackendVolumeHealth{}, nil
+}
+
+func (b *fakeBackend) AllowedHosts(ctx context.Context, targetNqn string) ([]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	hosts := []string{}
+	for hostNqn := range b.allowed[targetNqn] {
+		hosts = append(hosts, hostNqn)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+func (b *fakeBackend) AllowHost(ctx context.Context, targetNqn, hostNqn string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.allowed[targetNqn] == nil {
+		b.allowed[targetNqn] = map[string]struct{}{}
+	}
+	b.allowed[targetNqn][hostNqn] = struct{}{}
+	return nil
+}
+
+func (b *fakeBackend) DisallowHost(ctx context.Context, targetNqn, hostNqn string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.disallowed = append(b.disallowed, hostNqn)
+	delete(b.allowed[targetNqn], hostNqn)
+	return nil
+}
+
+func (b *fakeBackend) CreateNamespace(ctx context.Context, targetNqn, name string, sizeBytes int64) (*BackendNamespace, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := popError(&b.createErrs); err != nil {
+		return nil, err
+	}
+	if namespace, exists := b.namespaces[targetNqn][name]; exists {
+		return namespace, nil
+	}
+	if b.namespaces[targetNqn] == nil {
+		b.namespaces[targetNqn] = map[string]*BackendNamespace{}
+	}
+	if b.namespaceSize > 0 {
+		sizeBytes = b.namespaceSize
+	}
+	b.nsids[targetNqn]++
+	namespace := &BackendNamespace{Nsid: b.nsids[targetNqn], SizeBytes: sizeBytes}
+	b.namespaces[targetNqn][name] = namespace
+	b.created = append(b.created, formatVolumeID(targetNqn, namespace.Nsid))
+	return namespace, nil
+}
+
+func (b *fakeBackend) DeleteNamespace(ctx context.Context, targetNqn string, nsid uint32) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := popError(&b.deleteErrs); err != nil {
+		return err
+	}
+	for name, namespace := range b.namespaces[targetNqn] {
+		if namespace.Nsid == nsid {
+			delete(b.namespaces[targetNqn], name)
+		}
+	}
+	b.deleted = append(b.deleted, formatVolumeID(targetNqn, nsid))
+	return nil
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// fakeNvmeClient is an NvmeClient keeping the controllers of a node in memory.
+// Failures are injected per operation and the calls are recorded.
+type fakeNvmeClient struct {
+	mutex sync.Mutex
+
+	controllers []NvmeController
+	// namespaces are the device paths of each controller
+	namespaces map[string][]string
+	// sizes are the namespace sizes by device path
+	sizes map[string]int64
+	// devicePath is the device of the connected namespaces, /dev/<controller>n1 if empty
+	devicePath string
+	// discovery are the discovery log pages by "addr:port"
+	discovery map[string][]byte
+	// identities are the serial numbers and models reported by the
+	// controllers connected through each "addr:port"
+	identities map[string]subsystemIdentity
+
+	// Errors returned by the next calls of each operation, in turn
+	connectErrs    []error
+	disconnectErrs []error
+	discoverErrs   []error
+
+	// connectDelay and discoverDelay are slept by each connect and discover,
+	// outside of the mutex
+	connectDelay  time.Duration
+	discoverDelay time.Duration
+
+	connects    []Connector
+	disconnects []string
+	deletes     []string
+	discovers   []string
+}
+
+func newFakeNvmeClient() *fakeNvmeClient {
+	return &fakeNvmeClient{
+		namespaces: map[string][]string{},
+		sizes:      map[string]int64{},
+		discovery:  map[string][]byte{},
+		identities: map[string]subsystemIdentity{},
+	}
+}
+
+// popError returns and drops the first error of errs, nil if there is none
+func popError(errs *[]error) error {
+	if len(*errs) == 0 {
+		return nil
+	}
+	err := (*errs)[0]
+	*errs = (*errs)[1:]
+	return err
+}
+
+func (f *fakeNvmeClient) Connect(connector *Connector) (string, error) {
+	if f.connectDelay > 0 {
+		time.Sleep(f.connectDelay)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.connects = append(f.connects, *connector)
+	if err := popError(&f.connectErrs); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("nvme%d", len(f.connects)-1)
+	controller := NvmeController{
+		Name:      name,
+		SubsysNqn: connector.TargetNqn,
+		HostNqn:   connector.HostNqn,
+		State:     nvmeControllerLive,
+	}
+	if len(connector.TargetEndpoints) > 0 {
+		identity := f.identities[connector.TargetEndpoints[0]]
+		controller.Serial, controller.Model = identity.Serial, identity.Model
+	}
+	f.controllers = append(f.controllers, controller)
+	devicePath := f.devicePath
+	if devicePath == "" {
+		devicePath = fmt.Sprintf("/dev/%sn1", name)
+	}
+	f.namespaces[name] = []string{devicePath}
+
+	return devicePath, nil
+}
+
+func (f *fakeNvmeClient) Disconnect(nqn, hostNqn string, timeout time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.disconnects = append(f.disconnects, nqn)
+	if err := popError(&f.disconnectErrs); err != nil {
+		return err
+	}
+	f.removeControllers(func(c NvmeController) bool {
+		return c.SubsysNqn == nqn && (hostNqn == "" || c.HostNqn == hostNqn)
+	})
+	return nil
+}
+
+func (f *fakeNvmeClient) DisconnectAll(ctx context.Context, nqn string, timeout time.Duration) error {
+	return f.Disconnect(nqn, "", timeout)
+}
+
+func (f *fakeNvmeClient) DeleteController(controller string, timeout time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.deletes = append(f.deletes, controller)
+	f.removeControllers(func(c NvmeController) bool { return c.Name == controller })
+	return nil
+}
+
+// removeControllers drops the controllers matching remove. Caller must hold the mutex.
+func (f *fakeNvmeClient) removeControllers(remove func(NvmeController) bool) {
+	kept := f.controllers[:0]
+	for _, controller := range f.controllers {
+		if remove(controller) {
+			delete(f.namespaces, controller.Name)
+			continue
+		}
+		kept = append(kept, controller)
+	}
+	f.controllers = kept
+}
+
+func (f *fakeNvmeClient) Discover(ctx context.Context, transport, addr, port string, timeout time.Duration) ([]byte, error) {
+	// Like nvme-cli killed by the context, the discovery is interrupted
+	if f.discoverDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(f.discoverDelay):
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	endpoint := joinEndpoint(addr, port)
+	f.discovers = append(f.discovers, endpoint)
+	if err := popError(&f.discoverErrs); err != nil {
+		return nil, err
+	}
+	page, exists := f.discovery[endpoint]
+	if !exists {
+		return nil, fmt.Errorf("no discovery controller at %s", endpoint)
+	}
+	return page, nil
+}
+
+func (f *fakeNvmeClient) ListSubsystems() ([]NvmeController, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]NvmeController(nil), f.controllers...), nil
+}
+
+func (f *fakeNvmeClient) ListNamespaces(controller string, nsid uint32) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string(nil), f.namespaces[controller]...), nil
+}
+
+func (f *fakeNvmeClient) NamespaceSize(ctx context.Context, devicePath string, timeout time.Duration) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	size, exists := f.sizes[devicePath]
+	if !exists {
+		return 0, fmt.Errorf("no namespace at %s", devicePath)
+	}
+	return size, nil
+}
+
+// connectCount returns the number of connects made so far
+func (f *fakeNvmeClient) connectCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.connects)
+}
+
+// disconnectCount returns the number of disconnects made so far
+func (f *fakeNvmeClient) disconnectCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.disconnects)
+}
+
+// discoverCount returns the number of discoveries made so far
+func (f *fakeNvmeClient) discoverCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.discovers)
+}
+
+// discoveryPage returns the JSON discovery log page of a target at addr:port
+// exporting the subsystems nqns over tcp
+func discoveryPage(addr, port string, nqns ...string) []byte {
+	records := []map[string]string{}
+	for _, nqn := range nqns {
+		records = append(records, map[string]string{"trtype": "tcp", "traddr": addr, "trsvcid": port, "subnqn": nqn})
+	}
+	page, _ := json.Marshal(map[string]interface{}{"records": records})
+	return page
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileRecord is the content of a record file. The key is kept in the file
+// since the file name is derived from a hash of it.
+type fileRecord struct {
+	Key    string          `json:"key"`
+	Record json.RawMessage `json:"record"`
+}
+
+// fileStore persists driver records as JSON files under a local directory,
+// one directory per kind, for deployments without access to the API server
+// for them. The files are only visible to the controller that writes them, so
+// the controller must run as a single replica on persistent storage. Record
+// keys are prefixed as in the metadata store.
+type fileStore struct {
+	dir      string
+	prefix   string
+	mutex    sync.Mutex
+	watchers *recordWatchers
+}
+
+func newFileStore(dir, prefix string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create persistence directory %s: %v", dir, err)
+	}
+
+	return &fileStore{dir: dir, prefix: prefix, watchers: recordWatchersOf(dir)}, nil
+}
+
+// recordPath returns the file of the record stored under kind/key. Keys such
+// as NQNs contain characters that are not allowed in file names, so they are hashed.
+func (s *fileStore) recordPath(kind, key string) string {
+	sum := sha256.Sum256([]byte(s.prefix + key))
+	return filepath.Join(s.dir, kind, hex.EncodeToString(sum[:])[:20]+".json")
+}
+
+// Put creates or replaces the record stored under kind/key
+func (s *fileStore) Put(ctx context.Context, kind, key string, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s record %s: %v", kind, key, err)
+	}
+	content, err := json.Marshal(fileRecord{Key: s.prefix + key, Record: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode %s record %s: %v", kind, key, err)
+	}
+
+	// The watchers are notified out of the mutex, so that they may read the store
+	if err := s.write(kind, key, content); err != nil {
+		return err
+	}
+	s.watchers.notify(kind, s.prefix+key, data)
+
+	return nil
+}
+
+// write stores the content of the record file of kind/key
+func (s *fileStore) write(kind, key string, content []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := s.recordPath(kind, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to store %s record %s: %v", kind, key, err)
+	}
+	// Write a temporary file renamed into place, so that a crash never leaves
+	// a partially written record
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return fmt.Errorf("failed to store %s record %s: %v", kind, key, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to store %s record %s: %v", kind, key, err)
+	}
+
+	return nil
+}
+
+// Get loads the record stored under kind/key into record and reports whether it exists
+func (s *fileStore) Get(ctx context.Context, kind, key string, record interface{}) (bool, error) {
+	s.mutex.Lock()
+	content, err := os.ReadFile(s.recordPath(kind, key))
+	s.mutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get %s record %s: %v", kind, key, err)
+	}
+
+	var stored fileRecord
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return false, fmt.Errorf("failed to decode %s record %s: %v", kind, key, err)
+	}
+	if err := json.Unmarshal(stored.Record, record); err != nil {
+		return false, fmt.Errorf("failed to decode %s record %s: %v", kind, key, err)
+	}
+
+	return true, nil
+}
+
+// Delete removes the record stored under kind/key. Deleting a missing record is not an error.
+func (s *fileStore) Delete(ctx context.Context, kind, key string) error {
+	s.mutex.Lock()
+	err := os.Remove(s.recordPath(kind, key))
+	s.mutex.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete %s record %s: %v", kind, key, err)
+	}
+	s.watchers.notify(kind, s.prefix+key, nil)
+
+	return nil
+}
+
+// List returns the raw JSON of every record of the given kind, indexed by key
+func (s *fileStore) List(ctx context.Context, kind string) (map[string][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, kind))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string][]byte{}, nil
+		}
+		return nil, fmt.Errorf("failed to list %s records: %v", kind, err)
+	}
+
+	records := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(s.dir, kind, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s records: %v", kind, err)
+		}
+		var stored fileRecord
+		if err := json.Unmarshal(content, &stored); err != nil {
+			return nil, fmt.Errorf("failed to decode %s record %s: %v", kind, entry.Name(), err)
+		}
+		records[stored.Key] = stored.Record
+	}
+
+	return unprefixedRecords(s.prefix, records), nil
+}
+
+// Watch returns the changes of the records of the given kind made through the
+// stores of the directory of this process until ctx is done. The changes other
+// processes make to the files are not seen.
+func (s *fileStore) Watch(ctx context.Context, kind string) (<-chan recordEvent, error) {
+	return s.watchers.watch(ctx, kind, s.prefix), nil
+}
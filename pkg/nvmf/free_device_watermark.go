@@ -0,0 +1,245 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// freeDeviceAlertTimeout bounds a call of the alert webhook
+const freeDeviceAlertTimeout = 10 * time.Second
+
+// States of the free devices reported to the alert webhook
+const (
+	freeDevicesLow       = "low"
+	freeDevicesRecovered = "recovered"
+)
+
+// freeDeviceAlert is the JSON body posted to the alert webhook
+type freeDeviceAlert struct {
+	State        string    `json:"state"`
+	FreeDevices  int       `json:"freeDevices"`
+	TotalDevices int       `json:"totalDevices"`
+	Watermark    string    `json:"watermark"`
+	Time         time.Time `json:"time"`
+}
+
+// freeDeviceWatermark alerts once when the free devices of the pool fall below
+// a low watermark, and re-arms the alert once they recover above it
+type freeDeviceWatermark struct {
+	threshold int
+	percent   bool // threshold is a percentage of the registered devices
+	webhook   string
+	client    *http.Client
+
+	mutex  sync.Mutex
+	low    bool
+	alerts uint64
+	// pending are the alerts not posted yet, in the order of the crossings.
+	// A single goroutine posts them while notifying is set, so that the
+	// webhook never receives a recovery before the alert it follows.
+	pending   []freeDeviceAlert
+	notifying bool
+}
+
+// parseFreeDeviceWatermark parses a watermark given as a count of free devices
+// or as a percentage of the registered devices, e.g. "10" or "20%". An empty
+// value disables the watermark.
+func parseFreeDeviceWatermark(value, webhook string) (*freeDeviceWatermark, error) {
+	if value == "" {
+		if webhook != "" {
+			return nil, fmt.Errorf("free-device-alert-webhook requires free-device-low-watermark")
+		}
+		return nil, nil
+	}
+
+	percent := strings.HasSuffix(value, "%")
+	threshold, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || threshold <= 0 || percent && threshold > 100 {
+		return nil, fmt.Errorf("free-device-low-watermark must be a positive count or a percentage up to 100%%, got: %q", value)
+	}
+	if webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid free-device-alert-webhook %q", webhook)
+		}
+	}
+
+	return &freeDeviceWatermark{
+		threshold: threshold,
+		percent:   percent,
+		webhook:   webhook,
+		client:    &http.Client{Timeout: freeDeviceAlertTimeout},
+	}, nil
+}
+
+func (w *freeDeviceWatermark) String() string {
+	if w.percent {
+		return fmt.Sprintf("%d%%", w.threshold)
+	}
+	return strconv.Itoa(w.threshold)
+}
+
+// below reports whether free of total devices is below the watermark. An empty
+// pool, e.g. before the first discovery, is not.
+func (w *freeDeviceWatermark) below(free, total int) bool {
+	if total == 0 {
+		return false
+	}
+	if w.percent {
+		return free*100 < w.threshold*total
+	}
+	return free < w.threshold
+}
+
+// observe alerts when the free devices cross below the watermark and re-arms
+// the alert when they recover
+func (w *freeDeviceWatermark) observe(free, total int) {
+	below := w.below(free, total)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if below == w.low {
+		return
+	}
+	w.low = below
+
+	alert := freeDeviceAlert{
+		FreeDevices:  free,
+		TotalDevices: total,
+		Watermark:    w.String(),
+		Time:         time.Now(),
+	}
+	if below {
+		w.alerts++
+		alert.State = freeDevicesLow
+		klog.Warningf("Free devices below the low watermark of %s: %d of %d device(s) free", w, free, total)
+	} else {
+		alert.State = freeDevicesRecovered
+		klog.Infof("Free devices recovered above the low watermark of %s: %d of %d device(s) free", w, free, total)
+	}
+
+	if w.webhook != "" {
+		w.pending = append(w.pending, alert)
+		if !w.notifying {
+			w.notifying = true
+			go w.notifyPending()
+		}
+	}
+}
+
+// notifyPending posts the pending alerts in turn until there is none left
+func (w *freeDeviceWatermark) notifyPending() {
+	for {
+		w.mutex.Lock()
+		if len(w.pending) == 0 {
+			w.notifying = false
+			w.mutex.Unlock()
+			return
+		}
+		alert := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mutex.Unlock()
+
+		w.notify(alert)
+	}
+}
+
+// notify posts the alert to the webhook. Failures are only logged, since the
+// alert is best effort.
+func (w *freeDeviceWatermark) notify(alert freeDeviceAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		klog.Errorf("Failed to encode free device alert: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), freeDeviceAlertTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.webhook, bytes.NewReader(body))
+	if err != nil {
+		klog.Errorf("Failed to post free device alert to %s: %v", w.webhook, err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		klog.Errorf("Failed to post free device alert to %s: %v", w.webhook, err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		klog.Errorf("Free device alert webhook %s answered %s", w.webhook, response.Status)
+		return
+	}
+	klog.V(4).Infof("Posted %s free device alert to %s", alert.State, w.webhook)
+}
+
+// writeMetrics writes the alert state and count in the Prometheus text format
+func (w *freeDeviceWatermark) writeMetrics(out io.Writer) {
+	w.mutex.Lock()
+	low, alerts := 0, w.alerts
+	if w.low {
+		low = 1
+	}
+	w.mutex.Unlock()
+
+	fmt.Fprintf(out, "# HELP csi_nvmf_free_devices_low Whether the free devices are below the low watermark\n")
+	fmt.Fprintf(out, "# TYPE csi_nvmf_free_devices_low gauge\n")
+	fmt.Fprintf(out, "csi_nvmf_free_devices_low %d\n", low)
+	fmt.Fprintf(out, "# HELP csi_nvmf_free_devices_low_alerts_total Crossings of the free devices below the low watermark\n")
+	fmt.Fprintf(out, "# TYPE csi_nvmf_free_devices_low_alerts_total counter\n")
+	fmt.Fprintf(out, "csi_nvmf_free_devices_low_alerts_total %d\n", alerts)
+}
+
+// checkFreeDevices evaluates the low watermark against the devices of the
+// pool. Devices the warm pool holds are free, namespaces the backend created
+// for dynamic volumes are not part of the pool.
+func (r *DeviceRegistry) checkFreeDevices() {
+	watermark := r.Driver.freeDeviceWatermark
+	if watermark == nil {
+		return
+	}
+
+	r.mutex.RLock()
+	free, total := 0, 0
+	for id, device := range r.devices {
+		if device.Dynamic {
+			continue
+		}
+		total++
+		if _, available := r.availableNQNs[id]; available || device.warming {
+			free++
+		}
+	}
+	r.mutex.RUnlock()
+
+	watermark.observe(free, total)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFreeDeviceWatermark(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		webhook  string
+		wantNil  bool
+		wantErr  bool
+		wantText string
+	}{
+		{name: "disabled", wantNil: true},
+		{name: "count", value: "3", wantText: "3"},
+		{name: "percentage", value: "20%", wantText: "20%"},
+		{name: "with webhook", value: "3", webhook: "https://alerts.example.com/hook", wantText: "3"},
+		{name: "webhook without watermark", webhook: "https://alerts.example.com/hook", wantErr: true},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "percentage above 100", value: "101%", wantErr: true},
+		{name: "not a number", value: "few", wantErr: true},
+		{name: "webhook without scheme", value: "3", webhook: "alerts.example.com/hook", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, err := parseFreeDeviceWatermark(test.value, test.webhook)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseFreeDeviceWatermark error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (w == nil) != test.wantNil {
+				t.Fatalf("parseFreeDeviceWatermark = %v, want nil %v", w, test.wantNil)
+			}
+			if w != nil && w.String() != test.wantText {
+				t.Errorf("watermark = %s, want %s", w, test.wantText)
+			}
+		})
+	}
+}
+
+// alertRecorder is a webhook recording the states of the alerts it receives.
+// The first alert is answered after a delay, so that a later one posted
+// concurrently would overtake it.
+type alertRecorder struct {
+	mutex  sync.Mutex
+	states []string
+}
+
+func (a *alertRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var alert freeDeviceAlert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	first := len(a.states) == 0 && alert.State == freeDevicesLow
+	a.mutex.Unlock()
+	if first {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	a.mutex.Lock()
+	a.states = append(a.states, alert.State)
+	a.mutex.Unlock()
+}
+
+// received waits for count alerts and returns their states
+func (a *alertRecorder) received(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mutex.Lock()
+		states := append([]string{}, a.states...)
+		a.mutex.Unlock()
+		if len(states) >= count || time.Now().After(deadline) {
+			return states
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFreeDeviceWatermark(t *testing.T) {
+	tests := []struct {
+		name       string
+		watermark  string
+		free       []int // free devices observed in turn, out of 10
+		wantLow    bool
+		wantAlerts uint64
+		wantStates []string
+	}{
+		{
+			name:      "above the watermark",
+			watermark: "3",
+			free:      []int{10, 5, 3},
+		},
+		{
+			name:       "crossing below",
+			watermark:  "3",
+			free:       []int{5, 2},
+			wantLow:    true,
+			wantAlerts: 1,
+			wantStates: []string{freeDevicesLow},
+		},
+		{
+			name:       "staying below",
+			watermark:  "30%",
+			free:       []int{2, 1, 0, 2},
+			wantLow:    true,
+			wantAlerts: 1,
+			wantStates: []string{freeDevicesLow},
+		},
+		{
+			name:       "recovering above",
+			watermark:  "3",
+			free:       []int{2, 4, 5},
+			wantAlerts: 1,
+			wantStates: []string{freeDevicesLow, freeDevicesRecovered},
+		},
+		{
+			name:       "crossing below again",
+			watermark:  "3",
+			free:       []int{2, 4, 1},
+			wantLow:    true,
+			wantAlerts: 2,
+			wantStates: []string{freeDevicesLow, freeDevicesRecovered, freeDevicesLow},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &alertRecorder{}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+			w, err := parseFreeDeviceWatermark(test.watermark, server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, free := range test.free {
+				w.observe(free, 10)
+			}
+
+			states := recorder.received(t, len(test.wantStates))
+			if len(states) == 0 {
+				states = nil
+			}
+			if !reflect.DeepEqual(states, test.wantStates) {
+				t.Errorf("webhook received %v, want %v in order", states, test.wantStates)
+			}
+			w.mutex.Lock()
+			low, alerts := w.low, w.alerts
+			w.mutex.Unlock()
+			if low != test.wantLow {
+				t.Errorf("low = %v, want %v", low, test.wantLow)
+			}
+			if alerts != test.wantAlerts {
+				t.Errorf("alerts = %d, want %d", alerts, test.wantAlerts)
+			}
+		})
+	}
+}
+
+func TestFreeDeviceWatermarkEmptyPool(t *testing.T) {
+	w, err := parseFreeDeviceWatermark("50%", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.observe(0, 0)
+	if w.low || w.alerts != 0 {
+		t.Errorf("empty pool raised an alert: low %v, alerts %d", w.low, w.alerts)
+	}
+}
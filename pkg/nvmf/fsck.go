@@ -0,0 +1,143 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+)
+
+// paramFsckOnStage overrides, per StorageClass, whether the filesystem of a
+// volume is checked before it is mounted at stage
+const paramFsckOnStage = "fsckOnStage"
+
+// ErrFilesystemCorrupt is returned when the check of a filesystem found errors
+// it could not repair
+var ErrFilesystemCorrupt = errors.New("filesystem corrupt")
+
+// Exit codes of e2fsck
+const (
+	e2fsckCorrected       = 1 // Errors were corrected
+	e2fsckCorrectedReboot = 2 // Errors were corrected, a reboot is required for a mounted root filesystem
+	e2fsckUncorrected     = 4 // Errors were left uncorrected
+)
+
+// Exit codes of xfs_repair -n
+const (
+	xfsRepairCorrupt  = 1 // Corruption was detected
+	xfsRepairDirtyLog = 2 // The log must be replayed by a mount before checking
+)
+
+// fsckResult is the outcome of a filesystem check
+type fsckResult string
+
+const (
+	fsckClean    fsckResult = "clean"
+	fsckRepaired fsckResult = "repaired"
+	fsckSkipped  fsckResult = "skipped"
+)
+
+// checkFilesystem checks the filesystem of fsType on devicePath before it is
+// mounted. ext4 is repaired automatically where it is safe (e2fsck -p), xfs is
+// only checked (xfs_repair -n), since its repairs may discard the log. Other
+// filesystems are not checked. ErrFilesystemCorrupt is returned for errors
+// that were not repaired.
+func checkFilesystem(executor exec.Interface, devicePath, fsType string) (fsckResult, error) {
+	var checker string
+	var args []string
+	switch fsType {
+	case "ext4":
+		checker, args = "e2fsck", []string{"-p", devicePath}
+	case "xfs":
+		checker, args = "xfs_repair", []string{"-n", devicePath}
+	default:
+		return fsckSkipped, nil
+	}
+
+	klog.Infof("checkFilesystem: running %s %v", checker, args)
+	output, err := executor.Command(checker, args...).CombinedOutput()
+	if err == nil {
+		return fsckClean, nil
+	}
+	if err == exec.ErrExecutableNotFound {
+		klog.Warningf("checkFilesystem: %s is not installed, mounting %s unchecked", checker, devicePath)
+		return fsckSkipped, nil
+	}
+	out := strings.TrimSpace(string(output))
+
+	var exitErr exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("failed to run %s on %s: %v", checker, devicePath, err)
+	}
+
+	code := exitErr.ExitStatus()
+	switch {
+	case fsType == "ext4" && (code == e2fsckCorrected || code == e2fsckCorrectedReboot):
+		return fsckRepaired, nil
+	case fsType == "ext4" && code&e2fsckUncorrected != 0:
+		return "", fmt.Errorf("%w: %s found errors on %s it could not correct: %s", ErrFilesystemCorrupt, checker, devicePath, out)
+	case fsType == "xfs" && code == xfsRepairDirtyLog:
+		// The mount replays the log, which is the repair of an unclean shutdown
+		klog.Infof("checkFilesystem: the log of %s is dirty, leaving its replay to the mount", devicePath)
+		return fsckSkipped, nil
+	case fsType == "xfs" && code == xfsRepairCorrupt:
+		return "", fmt.Errorf("%w: %s found corruption on %s: %s", ErrFilesystemCorrupt, checker, devicePath, out)
+	}
+
+	return "", fmt.Errorf("%s failed on %s with exit code %d: %s", checker, devicePath, code, out)
+}
+
+// isReadOnlyMount reports whether the volume capability mounts the volume
+// read-only, which a filesystem check must not write to
+func isReadOnlyMount(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+
+	return containsString(capability.GetMount().GetMountFlags(), "ro")
+}
+
+// fsckOnStage reports whether the filesystem of a volume is checked at stage,
+// the StorageClass parameter overriding the driver default
+func (d *driver) fsckOnStage(params *VolumeParams) bool {
+	if params.FsckOnStage != nil {
+		return *params.FsckOnStage
+	}
+
+	return d.fsckOnStageDefault
+}
+
+// checksFilesystemAtStage reports whether the filesystem of a volume staged
+// with the capability is checked before it is mounted. Block volumes have no
+// filesystem and a read-only mount must not be written to by a repair.
+func (d *driver) checksFilesystemAtStage(params *VolumeParams, capability *csi.VolumeCapability) bool {
+	if capability.GetBlock() != nil || !d.fsckOnStage(params) {
+		return false
+	}
+	if isReadOnlyMount(capability) {
+		klog.V(4).Infof("Not checking the filesystem of a read-only mount")
+		return false
+	}
+
+	return true
+}
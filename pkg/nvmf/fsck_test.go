@@ -0,0 +1,186 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+)
+
+// fsckAction returns a command recording its command line and exiting with
+// status, or failing with err if set
+func fsckAction(commands *[]string, status int, err error) testingexec.FakeCommandAction {
+	return func(cmd string, args ...string) exec.Cmd {
+		*commands = append(*commands, strings.Join(append([]string{cmd}, args...), " "))
+		if err == nil && status != 0 {
+			err = &testingexec.FakeExitError{Status: status}
+		}
+		fake := &testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{func() ([]byte, []byte, error) { return []byte("fsck output"), nil, err }},
+		}
+		return testingexec.InitFakeCmd(fake, cmd, args...)
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsType  string
+		status  int
+		runErr  error
+		want    fsckResult
+		wantErr error
+		// wantCommand is the checker run, empty if none
+		wantCommand string
+	}{
+		{name: "clean ext4", fsType: "ext4", want: fsckClean, wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "repaired ext4", fsType: "ext4", status: 1, want: fsckRepaired, wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "repaired ext4 needing a reboot", fsType: "ext4", status: 2, want: fsckRepaired, wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "corrupt ext4", fsType: "ext4", status: 4, wantErr: ErrFilesystemCorrupt, wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "partly repaired ext4", fsType: "ext4", status: 5, wantErr: ErrFilesystemCorrupt, wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "e2fsck operational error", fsType: "ext4", status: 8, wantErr: errors.New("exit code 8"), wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "clean xfs", fsType: "xfs", want: fsckClean, wantCommand: "xfs_repair -n /dev/nvme0n1"},
+		{name: "corrupt xfs", fsType: "xfs", status: 1, wantErr: ErrFilesystemCorrupt, wantCommand: "xfs_repair -n /dev/nvme0n1"},
+		{name: "xfs with a dirty log", fsType: "xfs", status: 2, want: fsckSkipped, wantCommand: "xfs_repair -n /dev/nvme0n1"},
+		{name: "checker not installed", fsType: "ext4", runErr: exec.ErrExecutableNotFound, want: fsckSkipped, wantCommand: "e2fsck -p /dev/nvme0n1"},
+		{name: "checker not run", fsType: "xfs", runErr: errors.New("permission denied"), wantErr: errors.New("failed to run"), wantCommand: "xfs_repair -n /dev/nvme0n1"},
+		{name: "filesystem without a checker", fsType: "btrfs", want: fsckSkipped},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commands := []string{}
+			executor := &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{fsckAction(&commands, test.status, test.runErr)}}
+
+			got, err := checkFilesystem(executor, "/dev/nvme0n1", test.fsType)
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Fatalf("checkFilesystem = %v, want %s", err, test.want)
+			case errors.Is(test.wantErr, ErrFilesystemCorrupt) && !errors.Is(err, ErrFilesystemCorrupt):
+				t.Fatalf("checkFilesystem = %v, want %v", err, ErrFilesystemCorrupt)
+			case test.wantErr != nil && !errors.Is(test.wantErr, ErrFilesystemCorrupt):
+				if err == nil || errors.Is(err, ErrFilesystemCorrupt) || !strings.Contains(err.Error(), test.wantErr.Error()) {
+					t.Fatalf("checkFilesystem = %v, want an error containing %q", err, test.wantErr)
+				}
+			}
+			if got != test.want {
+				t.Errorf("checkFilesystem = %q, want %q", got, test.want)
+			}
+			if ran := strings.Join(commands, "; "); ran != test.wantCommand {
+				t.Errorf("commands run = %q, want %q", ran, test.wantCommand)
+			}
+		})
+	}
+}
+
+func TestMountFilesystemFsck(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsck     bool
+		existing string
+		status   int
+		// wantChecked is whether the checker ran before the mount
+		wantChecked bool
+		wantCorrupt bool
+	}{
+		{name: "clean", fsck: true, existing: "ext4", wantChecked: true},
+		{name: "repaired", fsck: true, existing: "ext4", status: 1, wantChecked: true},
+		{name: "corrupt", fsck: true, existing: "ext4", status: 4, wantChecked: true, wantCorrupt: true},
+		{name: "check disabled", existing: "ext4"},
+		// A new filesystem has nothing to check
+		{name: "blank device", fsck: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The mounter detects the filesystem again and runs its own fsck -a
+			commands := []string{}
+			actions := []testingexec.FakeCommandAction{blkidAction(test.existing)}
+			switch {
+			case test.existing == "":
+				actions = append(actions, recordAction(&commands), blkidAction("ext4"), recordAction(&commands))
+			case test.wantCorrupt:
+				actions = append(actions, fsckAction(&commands, test.status, nil))
+			case test.wantChecked:
+				actions = append(actions, fsckAction(&commands, test.status, nil), blkidAction(test.existing), recordAction(&commands))
+			default:
+				actions = append(actions, blkidAction(test.existing), recordAction(&commands))
+			}
+			executor := &testingexec.FakeExec{CommandScript: actions, ExactOrder: true}
+			mounter := mount.NewFakeMounter(nil)
+			nm := &nvmfDiskMounter{
+				fsType:     "ext4",
+				mounter:    &mount.SafeFormatAndMount{Interface: mounter, Exec: executor},
+				exec:       executor,
+				targetPath: t.TempDir(),
+				fsck:       test.fsck,
+			}
+
+			err := mountFilesystem("/dev/nvme0n1", nm)
+			if errors.Is(err, ErrFilesystemCorrupt) != test.wantCorrupt || (err != nil && !test.wantCorrupt) {
+				t.Fatalf("mountFilesystem = %v, want corrupt %v", err, test.wantCorrupt)
+			}
+			checked := len(commands) > 0 && strings.HasPrefix(commands[0], "e2fsck ")
+			if checked != test.wantChecked {
+				t.Errorf("commands run = %v, want checked %v", commands, test.wantChecked)
+			}
+			if executor.CommandCalls != len(actions) {
+				t.Errorf("commands run = %d, want %d", executor.CommandCalls, len(actions))
+			}
+			if mounted := len(mounter.GetLog()) > 0; mounted == test.wantCorrupt {
+				t.Errorf("mounted = %v, want %v", mounted, !test.wantCorrupt)
+			}
+		})
+	}
+}
+
+func TestChecksFilesystemAtStage(t *testing.T) {
+	enabled, disabled := true, false
+
+	tests := []struct {
+		name       string
+		defaultOn  bool
+		param      *bool
+		capability *csi.VolumeCapability
+		want       bool
+	}{
+		{name: "driver default", defaultOn: true, capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), want: true},
+		{name: "disabled by default", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		{name: "enabled by the StorageClass", param: &enabled, capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), want: true},
+		{name: "disabled by the StorageClass", defaultOn: true, param: &disabled, capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		{name: "read-only access mode", defaultOn: true, capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)},
+		{name: "read-only multi-node access mode", defaultOn: true, capability: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)},
+		{name: "read-only mount flag", defaultOn: true, capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "noatime", "ro")},
+		{name: "block volume", defaultOn: true, capability: blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+		{name: "block volume enabled by the StorageClass", param: &enabled, capability: blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &driver{fsckOnStageDefault: test.defaultOn}
+			if got := d.checksFilesystemAtStage(&VolumeParams{FsckOnStage: test.param}, test.capability); got != test.want {
+				t.Errorf("checksFilesystemAtStage = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
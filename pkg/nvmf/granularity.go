@@ -0,0 +1,54 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// paramAllocationGranularity is the increment in which the devices of a
+// StorageClass allocate capacity, as a quantity such as "1Gi". Requested
+// capacities are rounded up to it.
+const paramAllocationGranularity = "allocationGranularity"
+
+// parseAllocationGranularity returns the configured allocation granularity in
+// bytes, 0 if unset
+func parseAllocationGranularity(params map[string]string) (int64, error) {
+	value, exists := params[paramAllocationGranularity]
+	if !exists || value == "" {
+		return 0, nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Value() <= 0 {
+		return 0, fmt.Errorf("%s must be a positive quantity, got: %q", paramAllocationGranularity, value)
+	}
+
+	return quantity.Value(), nil
+}
+
+// roundUpToGranularity rounds bytes up to a multiple of granularity. A
+// granularity of 0 leaves bytes unchanged.
+func roundUpToGranularity(bytes, granularity int64) int64 {
+	if granularity <= 0 || bytes%granularity == 0 {
+		return bytes
+	}
+
+	return (bytes/granularity + 1) * granularity
+}
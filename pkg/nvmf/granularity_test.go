@@ -0,0 +1,132 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRoundUpToGranularity(t *testing.T) {
+	tests := []struct {
+		name        string
+		bytes       int64
+		granularity int64
+		want        int64
+	}{
+		{name: "no granularity", bytes: 1000, want: 1000},
+		{name: "aligned", bytes: 2 << 30, granularity: 1 << 30, want: 2 << 30},
+		{name: "rounded up", bytes: 1<<30 + 1, granularity: 1 << 30, want: 2 << 30},
+		{name: "below one increment", bytes: 1, granularity: 1 << 30, want: 1 << 30},
+		{name: "nothing requested", bytes: 0, granularity: 1 << 30, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := roundUpToGranularity(test.bytes, test.granularity); got != test.want {
+				t.Errorf("roundUpToGranularity(%d, %d) = %d, want %d", test.bytes, test.granularity, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAllocationGranularity(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "binary quantity", value: "1Gi", want: 1 << 30},
+		{name: "plain bytes", value: "4096", want: 4096},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "negative", value: "-1Gi", wantErr: true},
+		{name: "not a quantity", value: "one gig", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := map[string]string{}
+			if test.value != "" {
+				params[paramAllocationGranularity] = test.value
+			}
+			got, err := parseAllocationGranularity(params)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseAllocationGranularity(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseAllocationGranularity(%q) = %d, want %d", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeGranularity(t *testing.T) {
+	tests := []struct {
+		name        string
+		granularity string
+		required    int64
+		limit       int64
+		want        int64
+		wantCode    codes.Code
+	}{
+		{name: "aligned request", granularity: "1Gi", required: 1 << 30, want: 1 << 30},
+		{name: "rounded-up request", granularity: "1Gi", required: 3 << 29, want: 2 << 30},
+		{name: "rounded up to the limit", granularity: "1Gi", required: 3 << 29, limit: 2 << 30, want: 2 << 30},
+		{name: "limit-exceeding request", granularity: "1Gi", required: 3 << 29, limit: 7 << 28, wantCode: codes.OutOfRange},
+		{name: "no granularity", required: 3 << 29, limit: 7 << 28, want: 3 << 29},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.probeDeviceCapacity = true
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.sizes["/dev/nvme0n1"] = 4 << 30
+
+			extra := map[string]string{}
+			if test.granularity != "" {
+				extra[paramAllocationGranularity] = test.granularity
+			}
+			req := createRequest("pv-1", extra)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: test.required, LimitBytes: test.limit}
+			resp, err := c.CreateVolume(context.Background(), req)
+			if got := status.Code(err); got != test.wantCode {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := resp.GetVolume().GetCapacityBytes(); got != test.want {
+				t.Errorf("CreateVolume capacity = %d, want %d", got, test.want)
+			}
+
+			// The debug endpoint reports the granularity of the device
+			granularity, _ := parseAllocationGranularity(extra)
+			statuses := c.deviceRegistry.DeviceStatuses()
+			if len(statuses) != 1 || statuses[0].Granularity != granularity {
+				t.Errorf("reported devices = %+v, want one of granularity %d", statuses, granularity)
+			}
+		})
+	}
+}
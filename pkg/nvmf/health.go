@@ -0,0 +1,101 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// apiHealthCacheTTL bounds how often health checks contact the API server,
+// keeping the frequently called Probe cheap
+const apiHealthCacheTTL = 10 * time.Second
+
+// apiHealth caches the result of the last API server reachability check
+type apiHealth struct {
+	mutex     sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// checkHealth reports why the driver cannot serve requests, or nil if it can.
+// Only the controller depends on the registry and the API server; a node-only
+// driver is always healthy. When requireDevices is set, the controller is also
+// unhealthy until at least one usable device has been discovered.
+func (d *driver) checkHealth(ctx context.Context, requireDevices bool) error {
+	if d.controllerServer == nil {
+		return nil
+	}
+
+	// A standby syncs the registry and serves no requests until it leads
+	if election := d.leaderElection; election != nil && !election.isLeader() {
+		if err := d.checkAPIServer(); err != nil {
+			return fmt.Errorf("kubernetes API server is unreachable: %v", err)
+		}
+		return nil
+	}
+
+	registry := d.controllerServer.deviceRegistry
+	if !registry.InitialSyncDone() {
+		return fmt.Errorf("initial sync of the device registry is in progress")
+	}
+
+	if err := d.checkAPIServer(); err != nil {
+		return fmt.Errorf("kubernetes API server is unreachable: %v", err)
+	}
+
+	if requireDevices && registry.UsableDeviceCount() == 0 {
+		return fmt.Errorf("no usable NVMe devices discovered")
+	}
+
+	return nil
+}
+
+// checkAPIServer returns the cached API server reachability, refreshing it once the cache expires
+func (d *driver) checkAPIServer() error {
+	d.apiHealth.mutex.Lock()
+	defer d.apiHealth.mutex.Unlock()
+
+	if time.Since(d.apiHealth.checkedAt) < apiHealthCacheTTL {
+		return d.apiHealth.err
+	}
+
+	_, err := d.kubeClient.Discovery().ServerVersion()
+	d.apiHealth.checkedAt = time.Now()
+	d.apiHealth.err = err
+
+	return err
+}
+
+// ReadinessHandler serves the readiness endpoint. The driver is ready once the
+// registry is synced, the API server is reachable and devices are available.
+func (d *driver) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if err := d.checkHealth(r.Context(), true); err != nil {
+		klog.V(4).Infof("Readiness check failed: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ready"))
+}
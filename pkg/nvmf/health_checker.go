@@ -0,0 +1,122 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// Supported health checkers
+const (
+	// HealthCheckerSysfs checks the controllers connected on a node, and the
+	// registry state of devices on a controller
+	HealthCheckerSysfs = "sysfs"
+	// HealthCheckerBackend checks the admin state the backend reports first
+	HealthCheckerBackend = "backend"
+)
+
+// HealthChecker reports the condition of a volume for ControllerGetVolume and
+// NodeGetVolumeStats
+type HealthChecker interface {
+	VolumeCondition(ctx context.Context, volumeID string) *csi.VolumeCondition
+}
+
+// newHealthChecker returns the configured health checker, falling back to
+// local checks of the controller or the node
+func (d *driver) newHealthChecker(local HealthChecker) HealthChecker {
+	reporter, ok := d.healthReporter()
+	if d.healthChecker != HealthCheckerBackend || !ok {
+		return local
+	}
+
+	return &backendHealthChecker{reporter: reporter, fallback: local}
+}
+
+// sysfsHealthChecker checks the NVMe controllers and namespace devices of the node
+type sysfsHealthChecker struct {
+	client NvmeClient
+}
+
+func (h *sysfsHealthChecker) VolumeCondition(ctx context.Context, volumeID string) *csi.VolumeCondition {
+	return getVolumeCondition(h.client, volumeID)
+}
+
+// registryHealthChecker checks the allocation and discovery state of devices,
+// since the controller does not connect them
+type registryHealthChecker struct {
+	registry *DeviceRegistry
+}
+
+func (h *registryHealthChecker) VolumeCondition(ctx context.Context, volumeID string) *csi.VolumeCondition {
+	return h.registry.volumeCondition(volumeID)
+}
+
+// backendHealthChecker reports the reason of an abnormal admin state reported
+// by the backend. A healthy admin state, or one the backend fails to report,
+// is completed with the fallback checks.
+type backendHealthChecker struct {
+	reporter HealthReporter
+	fallback HealthChecker
+}
+
+func (h *backendHealthChecker) VolumeCondition(ctx context.Context, volumeID string) *csi.VolumeCondition {
+	nqn, nsid := parseVolumeID(volumeID)
+	health, err := h.reporter.VolumeHealth(ctx, nqn, nsid)
+	if err != nil {
+		klog.Warningf("Failed to get the backend health of volume %s, using local checks: %v", volumeID, err)
+		return h.fallback.VolumeCondition(ctx, volumeID)
+	}
+	if health.Abnormal {
+		message := health.Message
+		if message == "" {
+			message = "backend reports the volume abnormal"
+		}
+		return &csi.VolumeCondition{Abnormal: true, Message: message}
+	}
+
+	return h.fallback.VolumeCondition(ctx, volumeID)
+}
+
+// volumeCondition reports a volume abnormal if its device is not allocated, or
+// was not found again by discovery since the allocation was restored
+func (r *DeviceRegistry) volumeCondition(volumeID string) *csi.VolumeCondition {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	device, exists := r.devices[volumeID]
+	if !exists || !device.IsAllocated {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("device %s is not allocated in the device registry", volumeID),
+		}
+	}
+	if device.IsStale {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("device %s was not found by discovery", volumeID),
+		}
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNewHealthChecker(t *testing.T) {
+	tests := []struct {
+		name        string
+		checker     string
+		capable     bool
+		wantBackend bool
+	}{
+		{name: "default", capable: true},
+		{name: "sysfs", checker: HealthCheckerSysfs, capable: true},
+		{name: "backend", checker: HealthCheckerBackend, capable: true, wantBackend: true},
+		{name: "backend without the health capability", checker: HealthCheckerBackend},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend()
+			if test.capable {
+				backend = newFakeBackend(BackendCapabilityHealth)
+			}
+			d := &driver{backend: backend, healthChecker: test.checker}
+			local := &sysfsHealthChecker{client: newFakeNvmeClient()}
+
+			checker := d.newHealthChecker(local)
+			if _, isBackend := checker.(*backendHealthChecker); isBackend != test.wantBackend {
+				t.Errorf("newHealthChecker = %T, want the backend checker %v", checker, test.wantBackend)
+			}
+			if !test.wantBackend && checker != HealthChecker(local) {
+				t.Errorf("newHealthChecker = %T, want the local checker", checker)
+			}
+		})
+	}
+}
+
+func TestNodeHealthChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		checker string
+		health  *BackendVolumeHealth
+		// healthErr fails the backend report
+		healthErr error
+		// controller is the state of the controller connected on the node, none if empty
+		controller   string
+		wantAbnormal bool
+		wantMessage  string
+	}{
+		{name: "healthy", checker: HealthCheckerBackend, controller: nvmeControllerLive, wantMessage: "volume is healthy"},
+		{name: "degraded", checker: HealthCheckerBackend, health: &BackendVolumeHealth{Abnormal: true, Message: "array degraded"}, controller: nvmeControllerLive, wantAbnormal: true, wantMessage: "array degraded"},
+		{name: "degraded without a reason", checker: HealthCheckerBackend, health: &BackendVolumeHealth{Abnormal: true}, controller: nvmeControllerLive, wantAbnormal: true, wantMessage: "backend reports the volume abnormal"},
+		{name: "healthy backend of a disconnected volume", checker: HealthCheckerBackend, wantAbnormal: true, wantMessage: "no NVMe controller connected"},
+		{name: "healthy backend of a reconnecting controller", checker: HealthCheckerBackend, controller: "connecting", wantAbnormal: true, wantMessage: `in state "connecting"`},
+		{name: "backend unreachable", checker: HealthCheckerBackend, healthErr: errors.New("hook timed out"), controller: nvmeControllerLive, wantMessage: "volume is healthy"},
+		{name: "backend unreachable for a disconnected volume", checker: HealthCheckerBackend, healthErr: errors.New("hook timed out"), wantAbnormal: true, wantMessage: "no NVMe controller connected"},
+		{name: "degraded with the sysfs checker", checker: HealthCheckerSysfs, health: &BackendVolumeHealth{Abnormal: true, Message: "array degraded"}, controller: nvmeControllerLive, wantMessage: "volume is healthy"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(BackendCapabilityHealth)
+			if test.health != nil {
+				backend.health[testVolumeNqn] = test.health
+			}
+			if test.healthErr != nil {
+				backend.healthErrs = []error{test.healthErr}
+			}
+			client := newFakeNvmeClient()
+			if test.controller != "" {
+				client.controllers = []NvmeController{{Name: "nvme0", SubsysNqn: testVolumeNqn, State: test.controller}}
+				client.namespaces["nvme0"] = []string{"/dev/nvme0n1"}
+			}
+			d := &driver{backend: backend, healthChecker: test.checker, nvme: client}
+			checker := d.newHealthChecker(&sysfsHealthChecker{client: client})
+
+			condition := checker.VolumeCondition(context.Background(), testVolumeNqn)
+			if condition.GetAbnormal() != test.wantAbnormal || !strings.Contains(condition.GetMessage(), test.wantMessage) {
+				t.Errorf("VolumeCondition = %+v, want abnormal %v with %q", condition, test.wantAbnormal, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		checker string
+		health  *BackendVolumeHealth
+		// volumeID is the volume looked up, the created volume if empty
+		volumeID string
+		// noVolumeID omits the volume ID from the request
+		noVolumeID bool
+		// stale marks the device of the volume not found by discovery
+		stale        bool
+		want         codes.Code
+		wantAbnormal bool
+		wantMessage  string
+	}{
+		{name: "healthy", checker: HealthCheckerBackend, wantMessage: "volume is healthy"},
+		{name: "degraded", checker: HealthCheckerBackend, health: &BackendVolumeHealth{Abnormal: true, Message: "array degraded"}, wantAbnormal: true, wantMessage: "array degraded"},
+		{name: "degraded with the sysfs checker", health: &BackendVolumeHealth{Abnormal: true, Message: "array degraded"}, wantMessage: "volume is healthy"},
+		{name: "device not found by discovery", checker: HealthCheckerBackend, stale: true, wantAbnormal: true, wantMessage: "not found by discovery"},
+		{name: "unknown volume", volumeID: "nqn.2024-01.io.example:volume-9", want: codes.NotFound},
+		{name: "missing volume ID", noVolumeID: true, want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend(BackendCapabilityHealth)
+			if test.health != nil {
+				backend.health[testVolumeNqn] = test.health
+			}
+			c, _ := newTestControllerServer(t, backend)
+			c.Driver.healthChecker = test.checker
+			c.health = c.Driver.newHealthChecker(&registryHealthChecker{registry: c.deviceRegistry})
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+
+			req := createRequest("pv-1", nil)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+			created, err := c.CreateVolume(ctx, req)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			c.deviceRegistry.MarkPublished(testVolumeNqn, "node-2")
+			c.deviceRegistry.MarkPublished(testVolumeNqn, "node-1")
+			if test.stale {
+				c.deviceRegistry.devices[testVolumeNqn].IsStale = true
+			}
+
+			volumeID := test.volumeID
+			if volumeID == "" && !test.noVolumeID {
+				volumeID = created.GetVolume().GetVolumeId()
+			}
+			resp, err := c.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("ControllerGetVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetVolume().GetVolumeId() != volumeID || resp.GetVolume().GetCapacityBytes() != 1<<30 {
+				t.Errorf("ControllerGetVolume volume = %+v, want %s of 1Gi", resp.GetVolume(), volumeID)
+			}
+			if nodes := resp.GetStatus().GetPublishedNodeIds(); !reflect.DeepEqual(nodes, []string{"node-1", "node-2"}) {
+				t.Errorf("published nodes = %v, want [node-1 node-2]", nodes)
+			}
+			condition := resp.GetStatus().GetVolumeCondition()
+			if condition.GetAbnormal() != test.wantAbnormal || !strings.Contains(condition.GetMessage(), test.wantMessage) {
+				t.Errorf("VolumeCondition = %+v, want abnormal %v with %q", condition, test.wantAbnormal, test.wantMessage)
+			}
+		})
+	}
+}
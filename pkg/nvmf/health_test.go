@@ -0,0 +1,116 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// unreachableClientset is a clientset whose API server does not answer
+type unreachableClientset struct {
+	*fake.Clientset
+}
+
+func (c unreachableClientset) Discovery() discovery.DiscoveryInterface {
+	return unreachableDiscovery{c.Clientset.Discovery().(*fakediscovery.FakeDiscovery)}
+}
+
+type unreachableDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d unreachableDiscovery) ServerVersion() (*version.Info, error) {
+	return nil, errors.New("dial tcp 10.96.0.1:443: connect: connection refused")
+}
+
+// newTestHealthDriver returns a controller driver whose registry is synced if
+// synced and holds a usable device if device, and whose API server is
+// unreachable if apiDown
+func newTestHealthDriver(t *testing.T, synced, device, apiDown bool) *driver {
+	t.Helper()
+	c, kubeClient := newTestControllerServer(t, newFakeBackend())
+	d := c.Driver
+	d.controllerServer = c
+	if apiDown {
+		d.kubeClient = unreachableClientset{kubeClient}
+	}
+	r := c.deviceRegistry
+	r.initialSyncDone = synced
+	if device {
+		r.devices[testVolumeNqn] = &VolumeInfo{nvmfDiskInfo: &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp"}}
+		r.availableNQNs[testVolumeNqn] = struct{}{}
+	}
+	return d
+}
+
+func TestReadinessHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeOnly bool
+		synced   bool
+		device   bool
+		apiDown  bool
+		want     int
+	}{
+		{name: "initial sync in progress", device: true, want: http.StatusServiceUnavailable},
+		{name: "healthy", synced: true, device: true, want: http.StatusOK},
+		{name: "no usable device", synced: true, want: http.StatusServiceUnavailable},
+		{name: "API server unreachable", synced: true, device: true, apiDown: true, want: http.StatusServiceUnavailable},
+		{name: "node only", nodeOnly: true, apiDown: true, want: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestHealthDriver(t, test.synced, test.device, test.apiDown)
+			if test.nodeOnly {
+				d.controllerServer = nil
+			}
+
+			recorder := httptest.NewRecorder()
+			d.ReadinessHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if recorder.Code != test.want {
+				t.Errorf("readiness status = %d, want %d: %s", recorder.Code, test.want, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIServerCheckCached(t *testing.T) {
+	d := newTestHealthDriver(t, true, false, false)
+	if err := d.checkHealth(context.Background(), false); err != nil {
+		t.Fatalf("checkHealth: %v", err)
+	}
+
+	// The API server going down is only noticed once the cached check expires
+	d.kubeClient = unreachableClientset{d.kubeClient.(*fake.Clientset)}
+	if err := d.checkHealth(context.Background(), false); err != nil {
+		t.Errorf("checkHealth within the cache TTL = %v, want the cached success", err)
+	}
+	d.apiHealth.checkedAt = d.apiHealth.checkedAt.Add(-apiHealthCacheTTL)
+	if err := d.checkHealth(context.Background(), false); err == nil {
+		t.Error("checkHealth after the cache TTL succeeded, want the API server unreachable")
+	}
+}
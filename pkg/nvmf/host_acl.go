@@ -0,0 +1,341 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// paramAllowedHostNqns is the StorageClass parameter listing, comma-separated,
+// the host NQNs allowed to connect to the subsystem of a volume. The allowlist
+// is applied by backends with the host-acl capability and recorded in the
+// volume context.
+const paramAllowedHostNqns = "allowedHostNqns"
+
+// parseAllowedHosts parses a list of host NQNs, returned sorted without duplicates
+func parseAllowedHosts(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	unique := map[string]struct{}{}
+	for _, hostNqn := range strings.Split(value, ",") {
+		hostNqn = strings.TrimSpace(hostNqn)
+		if !isValidNQN(hostNqn) {
+			return nil, fmt.Errorf("%s entry %q is not a valid NQN", paramAllowedHostNqns, hostNqn)
+		}
+		unique[hostNqn] = struct{}{}
+	}
+
+	hosts := make([]string, 0, len(unique))
+	for hostNqn := range unique {
+		hosts = append(hosts, hostNqn)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
+
+// checkHostAcl verifies that the backend can apply the requested allowlist.
+// Provisioning without it would leave the subsystem open to other hosts.
+func (c *ControllerServer) checkHostAcl(params *VolumeParams) error {
+	if len(params.AllowedHosts) == 0 {
+		return nil
+	}
+	if _, ok := c.Driver.hostAclManager(); !ok {
+		return status.Errorf(codes.InvalidArgument, "backend %s cannot apply the host allowlist of %s", c.Driver.backend.Name(), paramAllowedHostNqns)
+	}
+
+	return nil
+}
+
+// applyHostAcl allows the hosts of a newly allocated volume to connect to its
+// subsystem. Hosts already allowed, e.g. by other namespaces, are left alone.
+func (c *ControllerServer) applyHostAcl(ctx context.Context, device *VolumeInfo) error {
+	manager, ok := c.Driver.hostAclManager()
+	if !ok || len(device.AllowedHosts) == 0 {
+		return nil
+	}
+
+	present, err := manager.AllowedHosts(ctx, device.Nqn)
+	if err != nil {
+		return err
+	}
+	for _, hostNqn := range missingHosts(device.AllowedHosts, present) {
+		if err := manager.AllowHost(ctx, device.Nqn, hostNqn); err != nil {
+			return err
+		}
+		klog.Infof("Allowed host %s to connect to subsystem %s of volume %s", hostNqn, device.Nqn, device.volumeID())
+	}
+
+	return nil
+}
+
+// revokeHostAcl disallows the hosts of a volume being deleted, except those
+// other volumes of its subsystem still allow. It runs before the device is
+// released, so that a failure is retried rather than leaving the hosts access
+// to the next volume of the device.
+func (c *ControllerServer) revokeHostAcl(ctx context.Context, volumeID string) error {
+	manager, ok := c.Driver.hostAclManager()
+	if !ok {
+		return nil
+	}
+	hosts := c.deviceRegistry.volumeAllowedHosts(volumeID)
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	// A host of the volume may be granted to a node through another volume
+	if _, granting := c.Driver.granter(); granting {
+		if err := c.deviceRegistry.ensurePublishedNodes(ctx); err != nil {
+			return status.Errorf(codes.Unavailable, "failed to restore the nodes granted access before disallowing the hosts of volume %s: %v", volumeID, err)
+		}
+	}
+
+	nqn, _ := parseVolumeID(volumeID)
+	expected, _ := c.deviceRegistry.expectedHosts(ctx, nqn, volumeID)
+	for _, hostNqn := range hosts {
+		if _, kept := expected[hostNqn]; kept {
+			continue
+		}
+		if err := manager.DisallowHost(ctx, nqn, hostNqn); err != nil {
+			if st := contextStatus(ctx.Err()); st != nil {
+				return st
+			}
+			return status.Errorf(codes.Unavailable, "failed to disallow host %s of volume %s: %v", hostNqn, volumeID, err)
+		}
+		klog.Infof("Disallowed host %s of deleted volume %s on subsystem %s", hostNqn, volumeID, nqn)
+	}
+
+	return nil
+}
+
+// missingHosts returns the hosts of want that are not in present
+func missingHosts(want, present []string) []string {
+	allowed := make(map[string]struct{}, len(present))
+	for _, hostNqn := range present {
+		allowed[hostNqn] = struct{}{}
+	}
+
+	missing := []string{}
+	for _, hostNqn := range want {
+		if _, exists := allowed[hostNqn]; !exists {
+			missing = append(missing, hostNqn)
+		}
+	}
+
+	return missing
+}
+
+// hostAclReconciler periodically compares the allowlists of the subsystems of
+// volumes with allowed hosts against the backend. Missing hosts are allowed
+// again, and hosts added out-of-band are disallowed once two consecutive cycles
+// observe them, so that a node being granted access is left alone.
+type hostAclReconciler struct {
+	controller *ControllerServer
+	manager    HostAclManager
+	interval   time.Duration
+
+	// Unexpected hosts observed by the previous cycle, by subsystem NQN
+	suspected map[string]map[string]struct{}
+}
+
+func newHostAclReconciler(controller *ControllerServer, manager HostAclManager, interval time.Duration) *hostAclReconciler {
+	return &hostAclReconciler{
+		controller: controller,
+		manager:    manager,
+		interval:   interval,
+		suspected:  map[string]map[string]struct{}{},
+	}
+}
+
+// run reconciles the allowlists every interval
+func (ac *hostAclReconciler) run() {
+	ticker := time.NewTicker(ac.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ac.reconcileOnce()
+	}
+}
+
+// reconcileOnce reconciles the allowlist of each subsystem with allowed hosts
+func (ac *hostAclReconciler) reconcileOnce() {
+	registry := ac.controller.deviceRegistry
+	subsystems := registry.hostAclSubsystems()
+
+	// Until the published nodes are restored no host is disallowed
+	if err := registry.ensurePublishedNodes(context.Background()); err != nil {
+		klog.Warningf("Host ACL: %v", err)
+	}
+
+	corrections := 0
+	suspected := map[string]map[string]struct{}{}
+	for _, nqn := range subsystems {
+		ctx, cancel := context.WithTimeout(context.Background(), ac.controller.Driver.grantTimeout)
+		fixed, unexpected, err := ac.reconcileSubsystem(ctx, nqn)
+		cancel()
+		if err != nil {
+			klog.Warningf("Host ACL: failed to reconcile the allowlist of subsystem %s: %v", nqn, err)
+			// Keep the suspicions of the subsystem for the next cycle
+			unexpected = ac.suspected[nqn]
+		}
+		if len(unexpected) > 0 {
+			suspected[nqn] = unexpected
+		}
+		corrections += fixed
+	}
+	ac.suspected = suspected
+
+	registryLog.V(4).Infof("Host ACL: reconciled the allowlists of %d subsystem(s), %d correction(s)", len(subsystems), corrections)
+}
+
+// reconcileSubsystem allows the missing hosts of a subsystem and disallows the
+// unexpected hosts the previous cycle observed too. It returns the number of
+// corrections and the unexpected hosts left for the next cycle.
+func (ac *hostAclReconciler) reconcileSubsystem(ctx context.Context, nqn string) (int, map[string]struct{}, error) {
+	registry := ac.controller.deviceRegistry
+	expected, grantsUnknown := registry.expectedHosts(ctx, nqn, "")
+
+	present, err := ac.manager.AllowedHosts(ctx, nqn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	corrections := 0
+	want := make([]string, 0, len(expected))
+	for hostNqn := range expected {
+		want = append(want, hostNqn)
+	}
+	sort.Strings(want)
+	for _, hostNqn := range missingHosts(want, present) {
+		if err := ac.manager.AllowHost(ctx, nqn, hostNqn); err != nil {
+			return corrections, nil, err
+		}
+		klog.Warningf("Host ACL: host %s was missing from the allowlist of subsystem %s, allowed it again", hostNqn, nqn)
+		corrections++
+	}
+
+	unexpected := map[string]struct{}{}
+	for _, hostNqn := range present {
+		if _, exists := expected[hostNqn]; exists {
+			continue
+		}
+		// The host NQN a node was granted is not known for every node ID
+		if grantsUnknown {
+			registryLog.V(4).Infof("Host ACL: host %s of subsystem %s may be granted to a node, leaving it", hostNqn, nqn)
+			continue
+		}
+		if _, seen := ac.suspected[nqn][hostNqn]; !seen {
+			unexpected[hostNqn] = struct{}{}
+			continue
+		}
+		if err := ac.manager.DisallowHost(ctx, nqn, hostNqn); err != nil {
+			return corrections, nil, err
+		}
+		klog.Warningf("Host ACL: host %s was added to the allowlist of subsystem %s out-of-band, disallowed it", hostNqn, nqn)
+		corrections++
+	}
+
+	return corrections, unexpected, nil
+}
+
+// volumeAllowedHosts returns the allowed hosts of the volume allocated the device
+func (r *DeviceRegistry) volumeAllowedHosts(volumeID string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	device, exists := r.devices[volumeID]
+	if !exists || !device.IsAllocated {
+		return nil
+	}
+	return append([]string(nil), device.AllowedHosts...)
+}
+
+// hostAclSubsystems returns the sorted subsystems with an allocated volume
+// that has allowed hosts
+func (r *DeviceRegistry) hostAclSubsystems() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	unique := map[string]struct{}{}
+	for _, device := range r.devices {
+		if device.IsAllocated && len(device.AllowedHosts) > 0 {
+			unique[device.Nqn] = struct{}{}
+		}
+	}
+
+	subsystems := make([]string, 0, len(unique))
+	for nqn := range unique {
+		subsystems = append(subsystems, nqn)
+	}
+	sort.Strings(subsystems)
+
+	return subsystems
+}
+
+// expectedHosts returns the hosts the allocated volumes of a subsystem allow,
+// except the volume exclude, and with a backend granting nodes access, the
+// host NQNs of the nodes the volumes are published to. grantsUnknown is set if
+// a volume is published to a node whose host NQN cannot be resolved, or the
+// published nodes are not restored yet after a restart.
+func (r *DeviceRegistry) expectedHosts(ctx context.Context, nqn, exclude string) (expected map[string]struct{}, grantsUnknown bool) {
+	_, granting := r.Driver.granter()
+
+	expected = map[string]struct{}{}
+	nodeIDs := map[string]struct{}{}
+	r.mutex.RLock()
+	grantsUnknown = granting && !r.publishedNodesRestored
+	for id, device := range r.devices {
+		if device.Nqn != nqn || !device.IsAllocated || id == exclude {
+			continue
+		}
+		for _, hostNqn := range device.AllowedHosts {
+			expected[hostNqn] = struct{}{}
+		}
+		if !granting {
+			continue
+		}
+		for nodeID := range device.PublishedNodes {
+			nodeIDs[nodeID] = struct{}{}
+		}
+	}
+	r.mutex.RUnlock()
+
+	// The host NQNs are resolved through the API server, outside of the lock
+	for nodeID := range nodeIDs {
+		hostNqn, err := r.Driver.nodeHostNqn(ctx, nodeID)
+		if err != nil {
+			klog.Warningf("Host ACL: %v", err)
+		}
+		if hostNqn == "" {
+			grantsUnknown = true
+			continue
+		}
+		expected[hostNqn] = struct{}{}
+	}
+
+	return expected, grantsUnknown
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestHostAclReconcileAfterRestart(t *testing.T) {
+	const (
+		allowedHost = "nqn.2014-08.org.nvmexpress:uuid:6f1d9a52-0c3e-4b8f-9a27-5d4e8c1b2a30"
+		grantedHost = "nqn.2014-08.org.nvmexpress:uuid:c3a8e7d1-4f2b-4e6a-8b19-0d5f7a9c6e42"
+	)
+	pv := driverPV("pv-1", testVolumeNqn, map[string]string{
+		paramType:            "tcp",
+		paramAllowedHostNqns: allowedHost,
+	})
+
+	tests := []struct {
+		name           string
+		objects        []runtime.Object
+		listErr        error
+		wantDisallowed []string
+	}{
+		{
+			name:    "attached volume keeps the host of its node",
+			objects: []runtime.Object{pv, attachment("pv-1", "worker-1", true), csiNode("worker-1", "worker-1"), kubeNode("worker-1", grantedHost)},
+		},
+		{
+			name:           "no attachment disallows the host",
+			objects:        []runtime.Object{pv, csiNode("worker-1", "worker-1"), kubeNode("worker-1", grantedHost)},
+			wantDisallowed: []string{grantedHost},
+		},
+		{
+			name:           "detached volume disallows the host",
+			objects:        []runtime.Object{pv, attachment("pv-1", "worker-1", false), csiNode("worker-1", "worker-1"), kubeNode("worker-1", grantedHost)},
+			wantDisallowed: []string{grantedHost},
+		},
+		{
+			name:    "node without a published host NQN disallows nothing",
+			objects: []runtime.Object{pv, attachment("pv-1", "worker-1", true), csiNode("worker-1", "worker-1"), kubeNode("worker-1", "")},
+		},
+		{
+			name:    "unknown attachments disallow nothing",
+			objects: []runtime.Object{pv, csiNode("worker-1", "worker-1"), kubeNode("worker-1", grantedHost)},
+			listErr: errors.New("apiserver unavailable"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(BackendCapabilityGrant, BackendCapabilityHostAcl)
+			backend.allowed[testVolumeNqn] = map[string]struct{}{allowedHost: {}, grantedHost: {}}
+			c, kubeClient := newTestControllerServer(t, backend, test.objects...)
+			if test.listErr != nil {
+				kubeClient.PrependReactor("list", "volumeattachments", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, test.listErr
+				})
+			}
+
+			// A restarted controller syncs before its first reconcile
+			if err := c.deviceRegistry.EnsureInitialSync(context.Background()); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			ac := newHostAclReconciler(c, backend, 0)
+			// Unexpected hosts are disallowed once two cycles observed them
+			ac.reconcileOnce()
+			ac.reconcileOnce()
+
+			if !reflect.DeepEqual(backend.disallowed, test.wantDisallowed) {
+				t.Errorf("disallowed hosts = %v, want %v", backend.disallowed, test.wantDisallowed)
+			}
+		})
+	}
+}
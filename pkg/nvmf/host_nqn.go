@@ -0,0 +1,180 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Schemes generating the host NQN of a node that has none
+const (
+	// HostNqnGenerationNone leaves a missing host NQN to the administrator
+	HostNqnGenerationNone = "none"
+	// HostNqnGenerationUUID derives a UUID-based host NQN from the machine ID,
+	// or a random UUID if the machine ID cannot be read
+	HostNqnGenerationUUID = "uuid"
+	// HostNqnGenerationName derives the host NQN from the node ID
+	HostNqnGenerationName = "name"
+)
+
+// machineIDFile holds the 128-bit machine ID of systemd hosts
+const machineIDFile = "/etc/machine-id"
+
+// nodeHostNqnAnnotation is the annotation of its Node in which a node publishes
+// its host NQN, for backends granting access per host NQN. The node ID stays
+// the node name, and label values cannot hold the colons of NQNs.
+const nodeHostNqnAnnotation = "nvmf.csi.k8s.io/host-nqn"
+
+// loadHostNqn returns the host NQN recorded in file, generating and writing it
+// with scheme if the file is missing or empty. The NQN is empty if none is
+// recorded and scheme is HostNqnGenerationNone.
+func loadHostNqn(file, scheme, nodeID string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read host NQN from %s: %v", file, err)
+	}
+	if hostNqn := strings.TrimSpace(string(data)); hostNqn != "" {
+		if !isValidNQN(hostNqn) {
+			klog.Warningf("Host NQN %s recorded in %s is not a valid NQN, connects may fail", hostNqn, file)
+		}
+		return hostNqn, nil
+	}
+
+	if scheme == "" || scheme == HostNqnGenerationNone {
+		klog.Warningf("No host NQN in %s and none generated, backends cannot grant access by host NQN unless the StorageClass sets %s", file, paramHostNqn)
+		return "", nil
+	}
+	hostNqn, err := generateHostNqn(scheme, nodeID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory of host NQN file %s: %v", file, err)
+	}
+	// Written through a rename, so that nvme-cli never reads a partial NQN
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(hostNqn+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write host NQN file %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write host NQN file %s: %v", file, err)
+	}
+
+	klog.Infof("Generated host NQN %s with scheme %s in %s", hostNqn, scheme, file)
+	return hostNqn, nil
+}
+
+// generateHostNqn returns a new host NQN for the node following scheme
+func generateHostNqn(scheme, nodeID string) (string, error) {
+	switch scheme {
+	case HostNqnGenerationUUID:
+		id, err := machineUUID(machineIDFile)
+		if err != nil {
+			klog.Warningf("Cannot derive the host NQN from the machine ID, using a random UUID: %v", err)
+			if id, err = randomUUID(); err != nil {
+				return "", fmt.Errorf("failed to generate a host NQN UUID: %v", err)
+			}
+		}
+		return uuidNqnPrefix + id, nil
+
+	case HostNqnGenerationName:
+		hostNqn := fmt.Sprintf("nqn.2014-08.org.nvmexpress:node:%s", nodeID)
+		if !isValidNQN(hostNqn) {
+			return "", fmt.Errorf("node ID %s does not form a valid host NQN", nodeID)
+		}
+		return hostNqn, nil
+	}
+
+	return "", fmt.Errorf("unsupported host NQN generation scheme %q", scheme)
+}
+
+// machineUUID formats the machine ID recorded in file as a UUID
+func machineUUID(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(data))
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", fmt.Errorf("machine ID %q in %s is not 32 hexadecimal digits", id, file)
+	}
+
+	return formatUUID(strings.ToLower(id)), nil
+}
+
+// randomUUID returns a version 4 UUID
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return formatUUID(hex.EncodeToString(b)), nil
+}
+
+// formatUUID inserts the dashes of the UUID form into 32 hexadecimal digits
+func formatUUID(id string) string {
+	return strings.Join([]string{id[0:8], id[8:12], id[12:16], id[16:20], id[20:32]}, "-")
+}
+
+// publishHostNqn records the host NQN of the node in the annotation of its Node
+func (n *NodeServer) publishHostNqn(ctx context.Context) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{nodeHostNqnAnnotation: n.hostNqn},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = n.Driver.kubeClient.CoreV1().Nodes().Patch(ctx, n.Driver.nodeId, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// nodeHostNqn returns the host NQN node nodeID published in its Node, empty if
+// the node published none or is not a Node
+func (d *driver) nodeHostNqn(ctx context.Context, nodeID string) (string, error) {
+	node, err := d.kubeClient.CoreV1().Nodes().Get(ctx, nodeID, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get node %s: %v", nodeID, err)
+	}
+
+	hostNqn := node.Annotations[nodeHostNqnAnnotation]
+	if hostNqn != "" && !isValidNQN(hostNqn) {
+		return "", fmt.Errorf("node %s published invalid host NQN %q", nodeID, hostNqn)
+	}
+	return hostNqn, nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeGetInfoPublishesHostNqn(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish bool
+		want    string
+	}{
+		{name: "published", publish: true, want: testNodeHostNqn},
+		{name: "not published", publish: false, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset(kubeNode("node-1", ""))
+			n := newTestNodeServer(newFakeNvmeClient())
+			n.Driver.kubeClient = kubeClient
+			n.Driver.publishHostNqn = test.publish
+
+			resp, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if err != nil {
+				t.Fatalf("NodeGetInfo: %v", err)
+			}
+			// The node ID stays the node name
+			if resp.NodeId != "node-1" {
+				t.Errorf("NodeId = %q, want node-1", resp.NodeId)
+			}
+			node, err := kubeClient.CoreV1().Nodes().Get(context.Background(), "node-1", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := node.Annotations[nodeHostNqnAnnotation]; got != test.want {
+				t.Errorf("host NQN annotation = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNodeHostNqn(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    string
+		wantErr bool
+	}{
+		{name: "published", objects: []runtime.Object{kubeNode("node-1", testNodeHostNqn)}, want: testNodeHostNqn},
+		{name: "not published", objects: []runtime.Object{kubeNode("node-1", "")}},
+		{name: "not a node"},
+		{name: "invalid host NQN", objects: []runtime.Object{kubeNode("node-1", "host-1")}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &driver{kubeClient: fake.NewSimpleClientset(test.objects...)}
+			hostNqn, err := d.nodeHostNqn(context.Background(), "node-1")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("nodeHostNqn error = %v, want error %v", err, test.wantErr)
+			}
+			if hostNqn != test.want {
+				t.Errorf("nodeHostNqn = %q, want %q", hostNqn, test.want)
+			}
+		})
+	}
+}
+
+func TestStageConnectsWithHostNqn(t *testing.T) {
+	const (
+		classHostNqn   = "nqn.2014-08.org.nvmexpress:uuid:6f1d9a52-0c3e-4b8f-9a27-5d4e8c1b2a30"
+		grantedHostNqn = "nqn.2014-08.org.nvmexpress:uuid:c3a8e7d1-4f2b-4e6a-8b19-0d5f7a9c6e42"
+	)
+
+	tests := []struct {
+		name string
+		// classHostNqn is the host NQN of the StorageClass, grantedHostNqn
+		// the one granted by ControllerPublishVolume
+		classHostNqn   string
+		grantedHostNqn string
+		// want is the host NQN connected with, none if the request is invalid
+		want string
+	}{
+		{name: "node host NQN", want: testNodeHostNqn},
+		{name: "StorageClass host NQN", classHostNqn: classHostNqn, want: classHostNqn},
+		{name: "granted host NQN", grantedHostNqn: grantedHostNqn, want: grantedHostNqn},
+		{name: "granted over StorageClass host NQN", classHostNqn: classHostNqn, grantedHostNqn: grantedHostNqn, want: grantedHostNqn},
+		{name: "invalid StorageClass host NQN", classHostNqn: "host-1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			// The stage stops after the connect, the connect command is recorded
+			client.connectErrs = []error{errors.New("connect failed")}
+			n := newTestNodeServer(client)
+			req := stageRequest(testVolumeNqn, t.TempDir())
+			if test.classHostNqn != "" {
+				req.VolumeContext[paramHostNqn] = test.classHostNqn
+			}
+			if test.grantedHostNqn != "" {
+				req.PublishContext = map[string]string{publishContextHostNqn: test.grantedHostNqn}
+			}
+
+			_, err := n.NodeStageVolume(context.Background(), req)
+			if test.want == "" {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("NodeStageVolume code = %v, want InvalidArgument: %v", status.Code(err), err)
+				}
+				if client.connectCount() != 0 {
+					t.Errorf("connects = %d, want none", client.connectCount())
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("NodeStageVolume succeeded, want the connect failure")
+			}
+			if client.connectCount() != 1 {
+				t.Fatalf("connects = %d, want 1", client.connectCount())
+			}
+			args := strings.Split(client.connects[0].connectArgString("192.0.2.10", "4420"), ",")
+			hostNqns := []string{}
+			for _, arg := range args {
+				if strings.HasPrefix(arg, "hostnqn=") {
+					hostNqns = append(hostNqns, strings.TrimPrefix(arg, "hostnqn="))
+				}
+			}
+			if want := []string{test.want}; !reflect.DeepEqual(hostNqns, want) {
+				t.Errorf("connect %v with host NQNs %v, want %v", args, hostNqns, want)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 )
 
@@ -52,8 +53,23 @@ func (ids *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 	}, nil
 }
 
+// Probe reports the same health as the readiness endpoint, except that devices are
+// not required: the sidecars wait for a ready Probe before issuing the CreateVolume
+// calls that trigger discovery, so requiring devices here would never become ready.
 func (ids *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	ready := true
+	if err := ids.Driver.checkHealth(ctx, false); err != nil {
+		klog.V(4).Infof("Probe: driver not ready: %v", err)
+		ready = false
+	}
+
+	if cs := ids.Driver.controllerServer; cs != nil {
+		klog.V(5).Infof("Probe: ready=%t, usable devices=%d", ready, cs.deviceRegistry.UsableDeviceCount())
+	}
+
+	return &csi.ProbeResponse{
+		Ready: wrapperspb.Bool(ready),
+	}, nil
 }
 
 func (ids *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
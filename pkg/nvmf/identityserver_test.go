@@ -0,0 +1,98 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestProbe(t *testing.T) {
+	// Each step changes the state of the same driver, in turn
+	tests := []struct {
+		name   string
+		modify func(d *driver, kubeClient *fake.Clientset)
+		want   bool
+	}{
+		{
+			name:   "initial sync in progress",
+			modify: func(d *driver, kubeClient *fake.Clientset) {},
+		},
+		{
+			name: "synced without devices",
+			modify: func(d *driver, kubeClient *fake.Clientset) {
+				d.controllerServer.deviceRegistry.initialSyncDone = true
+			},
+			want: true,
+		},
+		{
+			name: "devices discovered",
+			modify: func(d *driver, kubeClient *fake.Clientset) {
+				r := d.controllerServer.deviceRegistry
+				r.devices[testVolumeNqn] = &VolumeInfo{nvmfDiskInfo: &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp"}}
+				r.availableNQNs[testVolumeNqn] = struct{}{}
+			},
+			want: true,
+		},
+		{
+			name: "API server unreachable",
+			modify: func(d *driver, kubeClient *fake.Clientset) {
+				d.kubeClient = unreachableClientset{kubeClient}
+			},
+		},
+		{
+			name: "API server back",
+			modify: func(d *driver, kubeClient *fake.Clientset) {
+				d.kubeClient = kubeClient
+			},
+			want: true,
+		},
+		{
+			name: "standby of an unsynced registry",
+			modify: func(d *driver, kubeClient *fake.Clientset) {
+				d.controllerServer.deviceRegistry.initialSyncDone = false
+				d.leaderElection = &leaderElection{}
+			},
+			want: true,
+		},
+	}
+
+	c, kubeClient := newTestControllerServer(t, newFakeBackend())
+	d := c.Driver
+	d.controllerServer = c
+	ids := NewIdentityServer(d)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.modify(d, kubeClient)
+			// Check the API server again rather than the cached result
+			d.apiHealth.checkedAt = time.Time{}
+
+			resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+			if err != nil {
+				t.Fatalf("Probe: %v", err)
+			}
+			if ready := resp.GetReady().GetValue(); ready != test.want {
+				t.Errorf("Probe ready = %v, want %v", ready, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// Full names of the controller RPCs. The capabilities are served by standbys
+// too, since the sidecars query them at startup.
+const (
+	controllerMethodPrefix        = "/csi.v1.Controller/"
+	controllerGetCapabilitiesName = controllerMethodPrefix + "ControllerGetCapabilities"
+)
+
+// hostname returns the identity of the replica in the election, replaced in tests
+var hostname = os.Hostname
+
+// invalidLeaseNameChars are replaced in the driver name to form the lease name
+var invalidLeaseNameChars = regexp.MustCompile(`[^a-z0-9.-]`)
+
+// leaderElection elects, through a Lease, the controller replica that serves
+// the controller RPCs. The device registry is only synced once a replica leads,
+// so that it loads the allocations of the previous leader, and a replica that
+// loses the lease exits so that it restarts as a standby with no stale state.
+type leaderElection struct {
+	elector *leaderelection.LeaderElector
+	leading atomic.Bool
+	elected chan struct{} // Closed once the replica leads
+
+	cancel   context.CancelFunc
+	stopping atomic.Bool
+	done     chan struct{} // Closed once the election stopped
+	once     sync.Once
+}
+
+// leaseName returns the name of the lease of the driver
+func leaseName(driverName string) string {
+	return strings.Trim(invalidLeaseNameChars.ReplaceAllString(strings.ToLower(driverName), "-"), "-.")
+}
+
+func newLeaderElection(client kubernetes.Interface, conf *GlobalConfig) (*leaderElection, error) {
+	identity, err := hostname()
+	if err != nil || identity == "" {
+		identity = conf.NodeID
+	}
+
+	l := &leaderElection{
+		elected: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName(conf.DriverName),
+			Namespace: conf.Namespace,
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	l.elector, err = leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   conf.LeaderElectionLeaseDuration,
+		RenewDeadline:   conf.LeaderElectionRenewDeadline,
+		RetryPeriod:     conf.LeaderElectionRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            conf.DriverName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Elected leader of %s/%s as %s", lock.LeaseMeta.Namespace, lock.LeaseMeta.Name, identity)
+				l.leading.Store(true)
+				close(l.elected)
+			},
+			OnStoppedLeading: func() {
+				// Also called when the election stops before the replica led
+				if !l.leading.Swap(false) {
+					return
+				}
+				if l.stopping.Load() {
+					klog.Infof("Released the leadership of %s/%s", lock.LeaseMeta.Namespace, lock.LeaseMeta.Name)
+					return
+				}
+				klog.Fatalf("Lost the leadership of %s/%s, exiting to restart as a standby", lock.LeaseMeta.Namespace, lock.LeaseMeta.Name)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("Controller %s is the leader, waiting as a standby", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid leader election configuration: %v", err)
+	}
+
+	return l, nil
+}
+
+// waitForLeadership blocks until the replica leads
+func (l *leaderElection) waitForLeadership() {
+	<-l.elected
+}
+
+// start runs the election in the background until stop
+func (l *leaderElection) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	go func() {
+		defer close(l.done)
+		l.elector.Run(ctx)
+	}()
+}
+
+// stop releases the lease, if held, so that a standby takes over without
+// waiting for the lease to expire
+func (l *leaderElection) stop() {
+	l.once.Do(func() {
+		l.stopping.Store(true)
+		if l.cancel != nil {
+			l.cancel()
+			<-l.done
+		}
+	})
+}
+
+func (l *leaderElection) isLeader() bool {
+	return l.leading.Load()
+}
+
+// leader returns the identity of the current leader, empty if unknown
+func (l *leaderElection) leader() string {
+	return l.elector.GetLeader()
+}
+
+// unaryInterceptor rejects controller RPCs with Unavailable unless the replica leads
+func (l *leaderElection) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, controllerMethodPrefix) && info.FullMethod != controllerGetCapabilitiesName && !l.isLeader() {
+		return nil, status.Errorf(codes.Unavailable, "controller is a standby, the leader is %q", l.leader())
+	}
+
+	return handler(ctx, req)
+}
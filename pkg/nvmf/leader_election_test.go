@@ -0,0 +1,167 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestElection returns the election of the replica identity, with short
+// lease timings
+func newTestElection(t *testing.T, client kubernetes.Interface, identity string) *leaderElection {
+	t.Helper()
+	saved := hostname
+	hostname = func() (string, error) { return identity, nil }
+	defer func() { hostname = saved }()
+
+	l, err := newLeaderElection(client, &GlobalConfig{
+		DriverName:                  DefaultDriverName,
+		Namespace:                   "kube-system",
+		LeaderElectionLeaseDuration: 2 * time.Second,
+		LeaderElectionRenewDeadline: time.Second,
+		LeaderElectionRetryPeriod:   100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("newLeaderElection: %v", err)
+	}
+	t.Cleanup(l.stop)
+	return l
+}
+
+// waitForLeader waits until l observes leader as the leader
+func waitForLeader(t *testing.T, l *leaderElection, leader string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.leader() != leader {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader = %q, want %q", l.leader(), leader)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaseName(t *testing.T) {
+	tests := []struct {
+		driverName string
+		want       string
+	}{
+		{driverName: DefaultDriverName, want: DefaultDriverName},
+		{driverName: "NVMf.CSI.example.com", want: "nvmf.csi.example.com"},
+		{driverName: "csi_nvmf/driver", want: "csi-nvmf-driver"},
+		{driverName: "_nvmf.", want: "nvmf"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.driverName, func(t *testing.T) {
+			if got := leaseName(test.driverName); got != test.want {
+				t.Errorf("leaseName(%q) = %q, want %q", test.driverName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLeaderElectionInterceptor(t *testing.T) {
+	tests := []struct {
+		method  string
+		leading bool
+		want    codes.Code
+	}{
+		{method: "/csi.v1.Controller/CreateVolume", leading: true},
+		{method: "/csi.v1.Controller/CreateVolume", want: codes.Unavailable},
+		{method: "/csi.v1.Controller/ControllerPublishVolume", want: codes.Unavailable},
+		{method: controllerGetCapabilitiesName},
+		{method: "/csi.v1.Identity/Probe"},
+		{method: "/csi.v1.Node/NodeStageVolume"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s leading %t", test.method, test.leading), func(t *testing.T) {
+			l := newTestElection(t, fake.NewSimpleClientset(), "replica-a")
+			l.leading.Store(test.leading)
+			handled := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				handled = true
+				return nil, nil
+			}
+
+			_, err := l.unaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: test.method}, handler)
+			if got := status.Code(err); got != test.want {
+				t.Errorf("code = %v, want %v: %v", got, test.want, err)
+			}
+			if handled != (test.want == codes.OK) {
+				t.Errorf("handled = %t, want %t", handled, test.want == codes.OK)
+			}
+		})
+	}
+}
+
+func TestLeadershipTransition(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	leader := newTestElection(t, kubeClient, "replica-a")
+	standby := newTestElection(t, kubeClient, "replica-b")
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+
+	// createVolume creates a volume on the standby replica, through its interceptor
+	createVolume := func() error {
+		info := &grpc.UnaryServerInfo{FullMethod: controllerMethodPrefix + "CreateVolume"}
+		_, err := standby.unaryInterceptor(ctx, createRequest("pv-1", nil), info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return c.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+		})
+		return err
+	}
+
+	leader.start()
+	leader.waitForLeadership()
+	standby.start()
+	waitForLeader(t, standby, "replica-a")
+	if standby.isLeader() {
+		t.Fatal("standby leads along with the leader")
+	}
+	if err := createVolume(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("CreateVolume on the standby = %v, want Unavailable", err)
+	}
+	if _, allocated := c.deviceRegistry.devices[testVolumeNqn]; allocated {
+		t.Fatal("standby allocated a device")
+	}
+
+	// The leader releases the lease when it stops, the standby takes over
+	leader.stop()
+	select {
+	case <-standby.elected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby was not elected after the leader stopped")
+	}
+	if err := createVolume(); err != nil {
+		t.Fatalf("CreateVolume on the new leader: %v", err)
+	}
+	if device := c.deviceRegistry.devices[testVolumeNqn]; device == nil || !device.IsAllocated {
+		t.Errorf("new leader did not allocate a device: %+v", device)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"sync/atomic"
+
+	"k8s.io/klog/v2"
+)
+
+// FollowGlobalVerbosity leaves the verbosity of a log component to the -v flag
+const FollowGlobalVerbosity = -1
+
+// logComponent gates the verbose logs of one area of the driver, so that an
+// area can log verbosely without drowning the logs in the others. Unless its
+// verbosity is set, the -v and -vmodule flags apply.
+type logComponent struct {
+	name  string
+	level atomic.Int32
+}
+
+// Log components of the driver
+var (
+	registryLog = newLogComponent("registry") // Device discovery, allocation and reconciliation
+	nvmeLog     = newLogComponent("nvme")     // nvme-cli invocations and fabrics connections on nodes
+	etcdLog     = newLogComponent("etcd")     // Operations of the record store
+)
+
+func newLogComponent(name string) *logComponent {
+	c := &logComponent{name: name}
+	c.level.Store(FollowGlobalVerbosity)
+	return c
+}
+
+// V returns the klog verbosity gate of level for the component
+func (c *logComponent) V(level klog.Level) klog.Verbose {
+	threshold := c.level.Load()
+	if threshold == FollowGlobalVerbosity {
+		return klog.V(level)
+	}
+	if int32(level) <= threshold {
+		return klog.V(0)
+	}
+
+	// The zero Verbose logs nothing
+	return klog.Verbose{}
+}
+
+// setVerbosity sets the verbosity of the component, FollowGlobalVerbosity to
+// follow -v again
+func (c *logComponent) setVerbosity(level int) {
+	c.level.Store(int32(level))
+	if level != FollowGlobalVerbosity {
+		klog.Infof("Logging %s messages up to verbosity %d", c.name, level)
+	}
+}
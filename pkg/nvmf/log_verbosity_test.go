@@ -0,0 +1,116 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+// withGlobalVerbosity sets the -v flag of klog for the test and captures the
+// logs, which are returned by the returned function
+func withGlobalVerbosity(t *testing.T, level int) func() string {
+	t.Helper()
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	if err := flags.Set("v", strconv.Itoa(level)); err != nil {
+		t.Fatalf("set -v: %v", err)
+	}
+
+	var logs bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&logs)
+	t.Cleanup(func() {
+		klog.LogToStderr(true)
+		if err := flags.Set("v", "0"); err != nil {
+			t.Errorf("reset -v: %v", err)
+		}
+	})
+	return func() string {
+		klog.Flush()
+		return logs.String()
+	}
+}
+
+func TestLogComponentVerbosity(t *testing.T) {
+	tests := []struct {
+		name string
+		// global is the -v flag and component the verbosity of the component
+		global    int
+		component int
+		// want are whether the levels 0 to 5 are logged
+		want []bool
+	}{
+		{name: "follows -v", global: 2, component: FollowGlobalVerbosity, want: []bool{true, true, true, false, false, false}},
+		{name: "follows -v 0", component: FollowGlobalVerbosity, want: []bool{true, false, false, false, false, false}},
+		{name: "above -v", global: 0, component: 4, want: []bool{true, true, true, true, true, false}},
+		{name: "below -v", global: 5, component: 1, want: []bool{true, true, false, false, false, false}},
+		{name: "quiet", global: 5, component: 0, want: []bool{true, false, false, false, false, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs := withGlobalVerbosity(t, test.global)
+			c := newLogComponent("test")
+			c.setVerbosity(test.component)
+
+			for level, want := range test.want {
+				if got := c.V(klog.Level(level)).Enabled(); got != want {
+					t.Errorf("V(%d) enabled = %v, want %v", level, got, want)
+				}
+				c.V(klog.Level(level)).Infof("message at level %d", level)
+			}
+
+			output := logs()
+			for level, want := range test.want {
+				message := fmt.Sprintf("message at level %d", level)
+				if got := strings.Contains(output, message); got != want {
+					t.Errorf("%q logged = %v, want %v", message, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogComponentsAreIndependent(t *testing.T) {
+	withGlobalVerbosity(t, 0)
+	t.Cleanup(func() {
+		registryLog.setVerbosity(FollowGlobalVerbosity)
+		nvmeLog.setVerbosity(FollowGlobalVerbosity)
+	})
+
+	// Cranking up the registry leaves the nvme-cli logs at -v
+	registryLog.setVerbosity(5)
+	if !registryLog.V(5).Enabled() {
+		t.Error("registry V(5) not enabled at -v-registry 5")
+	}
+	if nvmeLog.V(1).Enabled() || etcdLog.V(1).Enabled() {
+		t.Error("nvme or etcd V(1) enabled at -v 0")
+	}
+
+	// Following -v again
+	registryLog.setVerbosity(FollowGlobalVerbosity)
+	if registryLog.V(1).Enabled() {
+		t.Error("registry V(1) enabled once following -v 0")
+	}
+}
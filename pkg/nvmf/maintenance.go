@@ -0,0 +1,252 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// metadataKindMaintenance records the NQNs and endpoints under maintenance
+const metadataKindMaintenance = "maintenance"
+
+// maintenanceRecord puts the subsystems whose NQN or one of whose "addr:port"
+// endpoints matches the target, a glob as in the device filter, under
+// maintenance. Keyed by target.
+type maintenanceRecord struct {
+	Target string    `json:"target"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// inMaintenance reports whether the device is under maintenance. New volumes
+// are not allocated such devices, allocated ones are left alone. Caller must
+// hold the mutex.
+func (r *DeviceRegistry) inMaintenance(info *nvmfDiskInfo) bool {
+	for target := range r.maintenance {
+		if matchesAnyPattern([]string{target}, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadMaintenance returns the targets under maintenance from the record store
+func (r *DeviceRegistry) loadMaintenance(ctx context.Context) (map[string]*maintenanceRecord, error) {
+	records, err := r.Driver.metadata.List(ctx, metadataKindMaintenance)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance := make(map[string]*maintenanceRecord, len(records))
+	for key, data := range records {
+		if record := decodeMaintenanceRecord(key, data); record != nil {
+			maintenance[record.Target] = record
+		}
+	}
+
+	return maintenance, nil
+}
+
+// decodeMaintenanceRecord returns the maintenance record stored under key, nil
+// if it is malformed
+func decodeMaintenanceRecord(key string, data []byte) *maintenanceRecord {
+	record := &maintenanceRecord{}
+	if err := json.Unmarshal(data, record); err != nil || record.Target == "" {
+		klog.Warningf("Ignoring malformed maintenance record %s: %v", key, err)
+		return nil
+	}
+
+	return record
+}
+
+// reloadMaintenance refreshes the targets under maintenance from the record
+// store. On failure the previously loaded targets are kept. Caller must hold
+// the mutex.
+func (r *DeviceRegistry) reloadMaintenance(ctx context.Context) {
+	maintenance, err := r.loadMaintenance(ctx)
+	if err != nil {
+		klog.Warningf("Failed to load the targets under maintenance, keeping previous ones: %v", err)
+		return
+	}
+	r.maintenance = maintenance
+}
+
+// watchMaintenance applies the maintenance entered and exited through other
+// controller replicas until ctx is done. The targets are loaded again out of
+// the lock each time the watch is established, so that no change made in
+// between is missed and the allocations are not held up by the record store.
+func (r *DeviceRegistry) watchMaintenance(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := r.followMaintenance(ctx); err != nil {
+			klog.Warningf("Failed to watch the targets under maintenance, retrying in %v: %v", rewatchInterval, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rewatchInterval):
+		}
+	}
+}
+
+// followMaintenance loads the targets under maintenance, then applies their
+// changes until ctx is done or the record store closes the watch
+func (r *DeviceRegistry) followMaintenance(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := r.Driver.metadata.Watch(ctx, metadataKindMaintenance)
+	if err != nil {
+		return err
+	}
+	maintenance, err := r.loadMaintenance(ctx)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.maintenance = maintenance
+	r.mutex.Unlock()
+
+	for event := range events {
+		r.mutex.Lock()
+		if event.Record == nil {
+			delete(r.maintenance, event.Key)
+		} else if record := decodeMaintenanceRecord(event.Key, event.Record); record != nil {
+			r.maintenance[record.Target] = record
+		}
+		r.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// EnterMaintenance puts target under maintenance. The record is persisted
+// first, so that the maintenance survives a restart.
+func (r *DeviceRegistry) EnterMaintenance(ctx context.Context, target, reason string) (*maintenanceRecord, error) {
+	if _, err := filepath.Match(target, ""); err != nil || target == "" {
+		return nil, fmt.Errorf("invalid maintenance target %q", target)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if record, exists := r.maintenance[target]; exists {
+		return record, nil
+	}
+
+	record := &maintenanceRecord{Target: target, Reason: reason, Since: time.Now()}
+	if err := r.Driver.metadata.Put(ctx, metadataKindMaintenance, target, record); err != nil {
+		return nil, fmt.Errorf("%w: failed to record maintenance of %s: %v", ErrEtcdUnavailable, target, err)
+	}
+	r.maintenance[target] = record
+
+	klog.Infof("Entered maintenance of %s, its free devices are no longer allocated: %s", target, reason)
+	return record, nil
+}
+
+// ExitMaintenance makes the devices of target allocatable again. It reports
+// whether target was under maintenance.
+func (r *DeviceRegistry) ExitMaintenance(ctx context.Context, target string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.maintenance[target]; !exists {
+		return false, nil
+	}
+	if err := r.Driver.metadata.Delete(ctx, metadataKindMaintenance, target); err != nil {
+		return true, fmt.Errorf("%w: failed to remove maintenance of %s: %v", ErrEtcdUnavailable, target, err)
+	}
+	delete(r.maintenance, target)
+
+	klog.Infof("Exited maintenance of %s", target)
+	return true, nil
+}
+
+// MaintenanceRecords returns the targets under maintenance, sorted
+func (r *DeviceRegistry) MaintenanceRecords() []maintenanceRecord {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	records := make([]maintenanceRecord, 0, len(r.maintenance))
+	for _, record := range r.maintenance {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Target < records[j].Target })
+
+	return records
+}
+
+// maintenanceHandler lists the targets under maintenance on GET, puts the
+// target of the query under maintenance on POST and ends it on DELETE, e.g.
+// POST /maintenance?target=10.0.0.1:4420&reason=firmware-upgrade
+func (d *driver) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if d.controllerServer == nil {
+		http.Error(w, "not running as controller", http.StatusNotFound)
+		return
+	}
+	registry := d.controllerServer.deviceRegistry
+	if r.Method == http.MethodGet {
+		writeJSON(w, registry.MaintenanceRecords())
+		return
+	}
+	if d.leaderElection != nil && !d.leaderElection.isLeader() {
+		http.Error(w, "not the leader controller replica", http.StatusServiceUnavailable)
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		record, err := registry.EnterMaintenance(r.Context(), target, r.URL.Query().Get("reason"))
+		if err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, ErrEtcdUnavailable) {
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, record)
+	case http.MethodDelete:
+		found, err := registry.ExitMaintenance(r.Context(), target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("%s is not under maintenance", target), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maintenanceNqn2 = "nqn.2024-01.io.example:volume-2"
+	maintenanceNqn3 = "nqn.2024-01.io.example:volume-3"
+)
+
+// newMaintenanceServer returns a controller of three devices, the first two
+// on one endpoint and the third on another, with pv-a allocated the first
+func newMaintenanceServer(t *testing.T) *ControllerServer {
+	t.Helper()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2)
+	client.discovery["192.0.2.11:4420"] = discoveryPage("192.0.2.11", "4420", maintenanceNqn3)
+	if _, err := createMaintenanceVolume(t, c, "pv-a", map[string]string{paramPinnedNqn: testVolumeNqn}); err != nil {
+		t.Fatalf("CreateVolume(pv-a): %v", err)
+	}
+	return c
+}
+
+// createMaintenanceVolume creates a volume discovering both endpoints
+func createMaintenanceVolume(t *testing.T, c *ControllerServer, name string, extra map[string]string) (string, error) {
+	t.Helper()
+	params := map[string]string{paramAddr: "192.0.2.10,192.0.2.11"}
+	for key, value := range extra {
+		params[key] = value
+	}
+	resp, err := c.CreateVolume(context.Background(), createRequest(name, params))
+	return resp.GetVolume().GetVolumeId(), err
+}
+
+// allocateAll creates volumes until the devices run out, returning the sorted
+// devices they were allocated
+func allocateAll(t *testing.T, c *ControllerServer, prefix string) []string {
+	t.Helper()
+	allocated := []string{}
+	for i := 0; ; i++ {
+		volumeID, err := createMaintenanceVolume(t, c, fmt.Sprintf("%s-%d", prefix, i), nil)
+		if status.Code(err) == codes.ResourceExhausted {
+			break
+		}
+		if err != nil {
+			t.Fatalf("CreateVolume(%s-%d): %v", prefix, i, err)
+		}
+		allocated = append(allocated, volumeID)
+	}
+	sort.Strings(allocated)
+	return allocated
+}
+
+// waitForMaintenance waits until the registry has n targets under maintenance
+func waitForMaintenance(t *testing.T, r *DeviceRegistry, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.MaintenanceRecords()) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("targets under maintenance %+v, want %d", r.MaintenanceRecords(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaintenanceCycle(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		// wantAllocatable are the free devices allocated during the maintenance
+		wantAllocatable []string
+	}{
+		{name: "NQN", target: maintenanceNqn2, wantAllocatable: []string{maintenanceNqn3}},
+		{name: "NQN glob", target: "nqn.2024-01.io.example:*", wantAllocatable: []string{}},
+		{name: "endpoint", target: "192.0.2.10:4420", wantAllocatable: []string{maintenanceNqn3}},
+		{name: "endpoint glob", target: "192.0.2.11:*", wantAllocatable: []string{maintenanceNqn2}},
+		{name: "no matching device", target: "nqn.2024-01.io.other:*", wantAllocatable: []string{maintenanceNqn2, maintenanceNqn3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := newMaintenanceServer(t)
+			if _, err := c.deviceRegistry.EnterMaintenance(ctx, test.target, "firmware upgrade"); err != nil {
+				t.Fatalf("EnterMaintenance: %v", err)
+			}
+
+			if got := allocateAll(t, c, "during"); !reflect.DeepEqual(got, test.wantAllocatable) {
+				t.Errorf("allocated during the maintenance %v, want %v", got, test.wantAllocatable)
+			}
+
+			// The existing allocation is untouched, a retry returns its device
+			if volumeID, err := createMaintenanceVolume(t, c, "pv-a", map[string]string{paramPinnedNqn: testVolumeNqn}); err != nil || volumeID != testVolumeNqn {
+				t.Errorf("retried CreateVolume(pv-a) = %s, %v, want %s", volumeID, err, testVolumeNqn)
+			}
+			if device, exists := c.deviceRegistry.GetDeviceByNQN(testVolumeNqn); !exists || !device.IsAllocated || device.VolName != "pv-a" {
+				t.Errorf("device of pv-a = %+v, want it allocated to pv-a", device)
+			}
+
+			found, err := c.deviceRegistry.ExitMaintenance(ctx, test.target)
+			if err != nil || !found {
+				t.Fatalf("ExitMaintenance = %v, %v, want found", found, err)
+			}
+			if found, err := c.deviceRegistry.ExitMaintenance(ctx, test.target); err != nil || found {
+				t.Errorf("second ExitMaintenance = %v, %v, want not found", found, err)
+			}
+
+			// Once exited, the devices left over are allocatable again
+			all := append(allocateAll(t, c, "after"), test.wantAllocatable...)
+			sort.Strings(all)
+			if want := []string{maintenanceNqn2, maintenanceNqn3}; !reflect.DeepEqual(all, want) {
+				t.Errorf("allocated before and after the maintenance %v, want %v", all, want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceReleasedDevice(t *testing.T) {
+	ctx := context.Background()
+	c := newMaintenanceServer(t)
+	if _, err := c.deviceRegistry.EnterMaintenance(ctx, testVolumeNqn, "replacement"); err != nil {
+		t.Fatalf("EnterMaintenance: %v", err)
+	}
+
+	// A volume of a device under maintenance is deleted as usual, its device
+	// is not allocated again until the maintenance ends
+	if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn}); err != nil {
+		t.Fatalf("DeleteVolume(pv-a): %v", err)
+	}
+	if got, want := allocateAll(t, c, "during"), []string{maintenanceNqn2, maintenanceNqn3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allocated during the maintenance %v, want %v", got, want)
+	}
+	if _, err := c.deviceRegistry.ExitMaintenance(ctx, testVolumeNqn); err != nil {
+		t.Fatalf("ExitMaintenance: %v", err)
+	}
+	if got, want := allocateAll(t, c, "after"), []string{testVolumeNqn}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allocated after the maintenance %v, want %v", got, want)
+	}
+}
+
+func TestMaintenanceSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	c := newMaintenanceServer(t)
+	if _, err := c.deviceRegistry.EnterMaintenance(ctx, "192.0.2.11:4420", "cabling"); err != nil {
+		t.Fatalf("EnterMaintenance: %v", err)
+	}
+
+	// The maintenance entered through another replica applies once watched
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go c.deviceRegistry.watchMaintenance(watchCtx)
+	replica := NewDeviceRegistry(c.Driver)
+	if _, err := replica.EnterMaintenance(ctx, maintenanceNqn2, "firmware"); err != nil {
+		t.Fatalf("EnterMaintenance through the replica: %v", err)
+	}
+	waitForMaintenance(t, c.deviceRegistry, 2)
+	if got := allocateAll(t, c, "replica"); len(got) != 0 {
+		t.Errorf("allocated under the maintenance of both replicas %v, want none", got)
+	}
+
+	// A restarted controller restores the maintenance from the record store
+	restarted := &ControllerServer{Driver: c.Driver, deviceRegistry: NewDeviceRegistry(c.Driver)}
+	if err := restarted.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		t.Fatalf("EnsureInitialSync: %v", err)
+	}
+	targets := []string{}
+	for _, record := range restarted.deviceRegistry.MaintenanceRecords() {
+		if record.Reason == "" || record.Since.IsZero() {
+			t.Errorf("restored maintenance %+v lost its reason or start", record)
+		}
+		targets = append(targets, record.Target)
+	}
+	if want := []string{"192.0.2.11:4420", maintenanceNqn2}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("restored maintenance of %v, want %v", targets, want)
+	}
+	if got := allocateAll(t, restarted, "restarted"); len(got) != 0 {
+		t.Errorf("allocated after the restart %v, want none", got)
+	}
+
+	for _, target := range targets {
+		if _, err := restarted.deviceRegistry.ExitMaintenance(ctx, target); err != nil {
+			t.Fatalf("ExitMaintenance(%s): %v", target, err)
+		}
+	}
+	if got, want := allocateAll(t, restarted, "exited"), []string{maintenanceNqn2, maintenanceNqn3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("allocated after the maintenance %v, want %v", got, want)
+	}
+}
+
+func TestMaintenanceErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		// failStore fails the changes of the record store
+		failStore bool
+		wantErr   error
+	}{
+		{name: "empty target"},
+		{name: "malformed glob", target: "nqn.2024-01.io.example:[volume"},
+		{name: "unavailable store", target: maintenanceNqn2, failStore: true, wantErr: ErrEtcdUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newMaintenanceServer(t)
+			if test.failStore {
+				c.Driver.metadata = failingStore{c.Driver.metadata}
+			}
+
+			_, err := c.deviceRegistry.EnterMaintenance(context.Background(), test.target, "")
+			if err == nil || test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("EnterMaintenance error = %v, want %v", err, test.wantErr)
+			}
+			if records := c.deviceRegistry.MaintenanceRecords(); len(records) != 0 {
+				t.Errorf("maintenance %+v after a failure, want none", records)
+			}
+		})
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		// entered puts the second device under maintenance beforehand
+		entered  bool
+		notCtrl  bool
+		want     int
+		wantBody string
+		// wantTargets are the targets under maintenance afterwards
+		wantTargets []string
+	}{
+		{name: "list", method: http.MethodGet, entered: true, want: http.StatusOK, wantBody: `"target":"` + maintenanceNqn2 + `"`, wantTargets: []string{maintenanceNqn2}},
+		{name: "enter", method: http.MethodPost, target: "192.0.2.11:*", want: http.StatusOK, wantBody: `"reason":"firmware"`, wantTargets: []string{"192.0.2.11:*"}},
+		{name: "enter again", method: http.MethodPost, target: maintenanceNqn2, entered: true, want: http.StatusOK, wantTargets: []string{maintenanceNqn2}},
+		{name: "malformed target", method: http.MethodPost, target: "[", want: http.StatusBadRequest, wantTargets: []string{}},
+		{name: "no target", method: http.MethodPost, want: http.StatusBadRequest, wantTargets: []string{}},
+		{name: "exit", method: http.MethodDelete, target: maintenanceNqn2, entered: true, want: http.StatusNoContent, wantTargets: []string{}},
+		{name: "exit of another target", method: http.MethodDelete, target: maintenanceNqn3, entered: true, want: http.StatusNotFound, wantTargets: []string{maintenanceNqn2}},
+		{name: "other method", method: http.MethodPut, target: maintenanceNqn2, want: http.StatusMethodNotAllowed, wantTargets: []string{}},
+		{name: "not a controller", method: http.MethodGet, notCtrl: true, want: http.StatusNotFound, wantTargets: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newMaintenanceServer(t)
+			if test.entered {
+				if _, err := c.deviceRegistry.EnterMaintenance(context.Background(), maintenanceNqn2, "firmware"); err != nil {
+					t.Fatalf("EnterMaintenance: %v", err)
+				}
+			}
+			c.Driver.controllerServer = c
+			if test.notCtrl {
+				c.Driver.controllerServer = nil
+			}
+
+			url := "/maintenance?reason=firmware"
+			if test.target != "" {
+				url += "&target=" + test.target
+			}
+			w := httptest.NewRecorder()
+			c.Driver.maintenanceHandler(w, httptest.NewRequest(test.method, url, nil))
+			if w.Code != test.want {
+				t.Fatalf("/maintenance status = %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("/maintenance body = %s, want it to contain %s", w.Body, test.wantBody)
+			}
+
+			targets := []string{}
+			for _, record := range c.deviceRegistry.MaintenanceRecords() {
+				targets = append(targets, record.Target)
+			}
+			if !reflect.DeepEqual(targets, test.wantTargets) {
+				t.Errorf("targets under maintenance %v, want %v", targets, test.wantTargets)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/klog/v2"
+)
+
+// DNS-SD service of NVMe-oF discovery controllers, as defined by NVMe TP 8009
+const mdnsDiscoveryService = "_nvme-disc._tcp.local."
+
+// mdnsQueryTimeout bounds how long answers to one mDNS query are collected
+const mdnsQueryTimeout = 2 * time.Second
+
+// mdnsGroupAddress is the IPv4 multicast group of mDNS
+var mdnsGroupAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// discoveryController is a discovery controller advertised over mDNS
+type discoveryController struct {
+	Transport string
+	Addr      string
+	Port      string
+}
+
+func (c discoveryController) endpoint() string {
+	return net.JoinHostPort(c.Addr, c.Port)
+}
+
+// mdnsBrowser periodically queries mDNS for discovery controllers and keeps the
+// last successful answer, so that an unavailable responder leaves the static
+// discovery configuration and the previously seen controllers in use
+type mdnsBrowser struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	mutex       sync.RWMutex
+	controllers []discoveryController
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newMDNSBrowser(interval, timeout time.Duration) *mdnsBrowser {
+	return &mdnsBrowser{
+		interval: interval,
+		timeout:  timeout,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// run browses until stop is called
+func (b *mdnsBrowser) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		b.refresh()
+
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *mdnsBrowser) stop() {
+	b.stopOnce.Do(func() { close(b.stopCh) })
+}
+
+// refresh runs one mDNS query and records the controllers that answered
+func (b *mdnsBrowser) refresh() {
+	controllers, err := browseDiscoveryControllers(b.timeout)
+	if err != nil {
+		klog.Warningf("mDNS discovery failed, keeping %d known discovery controller(s): %v", len(b.knownControllers()), err)
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(controllers) != len(b.controllers) {
+		klog.Infof("mDNS discovery found %d discovery controller(s): %v", len(controllers), controllers)
+	}
+	b.controllers = controllers
+}
+
+func (b *mdnsBrowser) knownControllers() []discoveryController {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.controllers
+}
+
+// endpoints returns the addr:port of the known discovery controllers of a transport.
+// A nil browser returns no endpoints.
+func (b *mdnsBrowser) endpoints(transport string) []string {
+	if b == nil {
+		return nil
+	}
+
+	endpoints := []string{}
+	for _, controller := range b.knownControllers() {
+		if strings.EqualFold(controller.Transport, transport) {
+			endpoints = append(endpoints, controller.endpoint())
+		}
+	}
+
+	return endpoints
+}
+
+// browseDiscoveryControllers sends a DNS-SD query for discovery controllers and
+// collects the answers received within timeout
+func browseDiscoveryControllers(timeout time.Duration) ([]discoveryController, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+	defer conn.Close()
+
+	query, err := buildMDNSQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, mdnsGroupAddress); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	responses := [][]byte{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("failed to read mDNS response: %v", err)
+		}
+		responses = append(responses, append([]byte{}, buf[:n]...))
+	}
+
+	return parseMDNSResponses(responses), nil
+}
+
+// buildMDNSQuery builds a PTR query for the discovery service. The unicast-response
+// bit lets responders answer the ephemeral port directly.
+func buildMDNSQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(mdnsDiscoveryService)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET | 1<<15,
+		}},
+	}
+
+	return msg.Pack()
+}
+
+// parseMDNSResponses assembles discovery controllers from the PTR, SRV, TXT and
+// A records of the responses. Instances without a resolvable address are skipped.
+func parseMDNSResponses(responses [][]byte) []discoveryController {
+	instances := map[string]struct{}{}
+	srvs := map[string]dnsmessage.SRVResource{}
+	transports := map[string]string{}
+	addrs := map[string]string{}
+
+	for _, response := range responses {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(response); err != nil {
+			klog.V(4).Infof("Ignoring malformed mDNS response: %v", err)
+			continue
+		}
+
+		records := append(append([]dnsmessage.Resource{}, msg.Answers...), msg.Additionals...)
+		for _, record := range records {
+			name := strings.ToLower(record.Header.Name.String())
+			switch body := record.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if name == mdnsDiscoveryService {
+					instances[strings.ToLower(body.PTR.String())] = struct{}{}
+				}
+			case *dnsmessage.SRVResource:
+				srvs[name] = *body
+			case *dnsmessage.TXTResource:
+				for _, txt := range body.TXT {
+					if value := strings.TrimPrefix(txt, "p="); value != txt {
+						transports[name] = value
+					}
+				}
+			case *dnsmessage.AResource:
+				addrs[name] = net.IP(body.A[:]).String()
+			}
+		}
+	}
+
+	controllers := []discoveryController{}
+	for instance := range instances {
+		srv, exists := srvs[instance]
+		if !exists {
+			continue
+		}
+		addr, exists := addrs[strings.ToLower(srv.Target.String())]
+		if !exists {
+			continue
+		}
+
+		// Discovery controllers without a transport record are reached over TCP
+		transport := transports[instance]
+		if transport == "" {
+			transport = "tcp"
+		}
+
+		controllers = append(controllers, discoveryController{
+			Transport: transport,
+			Addr:      addr,
+			Port:      strconv.Itoa(int(srv.Port)),
+		})
+	}
+
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].endpoint() < controllers[j].endpoint()
+	})
+
+	return controllers
+}
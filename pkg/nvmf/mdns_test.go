@@ -0,0 +1,228 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsRecord advertises a discovery controller instance. An empty addr leaves
+// out the A record of its host.
+type mdnsRecord struct {
+	instance  string
+	host      string
+	addr      string
+	port      uint16
+	transport string
+}
+
+// mdnsResponse packs the PTR, SRV, TXT and A records of the instances
+func mdnsResponse(t *testing.T, records ...mdnsRecord) []byte {
+	t.Helper()
+	service := dnsmessage.MustNewName(mdnsDiscoveryService)
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	for _, record := range records {
+		instance := dnsmessage.MustNewName(record.instance + "." + mdnsDiscoveryService)
+		host := dnsmessage.MustNewName(record.host)
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		})
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.SRVResource{Target: host, Port: record.port},
+		})
+		if record.transport != "" {
+			msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.TXTResource{TXT: []string{"nqn=nqn.2014-08.org.nvmexpress.discovery", "p=" + record.transport}},
+			})
+		}
+		if record.addr != "" {
+			var a [4]byte
+			copy(a[:], net.ParseIP(record.addr).To4())
+			msg.Additionals = append(msg.Additionals, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AResource{A: a},
+			})
+		}
+	}
+
+	response, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("pack mDNS response: %v", err)
+	}
+	return response
+}
+
+// withMDNSResponder points the mDNS queries at a local responder answering
+// each query with response
+func withMDNSResponder(t *testing.T, response []byte) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("local UDP is unavailable: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 || query.Questions[0].Name.String() != mdnsDiscoveryService {
+				continue
+			}
+			conn.WriteToUDP(response, from)
+		}
+	}()
+
+	original := mdnsGroupAddress
+	mdnsGroupAddress = conn.LocalAddr().(*net.UDPAddr)
+	t.Cleanup(func() {
+		mdnsGroupAddress = original
+		conn.Close()
+	})
+}
+
+func TestMDNSBrowserEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		records   []mdnsRecord
+		transport string
+		want      []string
+	}{
+		{
+			name:      "controller record",
+			records:   []mdnsRecord{{instance: "target-1", host: "target-1.local.", addr: "192.0.2.20", port: 8009, transport: "tcp"}},
+			transport: "tcp",
+			want:      []string{"192.0.2.20:8009"},
+		},
+		{
+			name:      "controller without a transport record",
+			records:   []mdnsRecord{{instance: "target-1", host: "target-1.local.", addr: "192.0.2.20", port: 8009}},
+			transport: "tcp",
+			want:      []string{"192.0.2.20:8009"},
+		},
+		{
+			name: "controllers of other transports",
+			records: []mdnsRecord{
+				{instance: "target-1", host: "target-1.local.", addr: "192.0.2.20", port: 8009, transport: "tcp"},
+				{instance: "target-2", host: "target-2.local.", addr: "192.0.2.21", port: 4420, transport: "rdma"},
+			},
+			transport: "rdma",
+			want:      []string{"192.0.2.21:4420"},
+		},
+		{
+			name:      "controller host without an address",
+			records:   []mdnsRecord{{instance: "target-1", host: "target-1.local.", port: 8009, transport: "tcp"}},
+			transport: "tcp",
+			want:      []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withMDNSResponder(t, mdnsResponse(t, test.records...))
+			b := newMDNSBrowser(time.Hour, 200*time.Millisecond)
+			b.refresh()
+
+			if got := b.endpoints(test.transport); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("endpoints(%q) = %v, want %v", test.transport, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMDNSBrowserKeepsControllersOnFailure(t *testing.T) {
+	withMDNSResponder(t, mdnsResponse(t, mdnsRecord{instance: "target-1", host: "target-1.local.", addr: "192.0.2.20", port: 8009, transport: "tcp"}))
+	b := newMDNSBrowser(time.Hour, 200*time.Millisecond)
+	b.refresh()
+
+	// An IPv6 group cannot be reached from the IPv4 socket, failing the query
+	mdnsGroupAddress = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+	b.refresh()
+
+	if got, want := b.endpoints("tcp"), []string{"192.0.2.20:8009"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints after a failed query = %v, want %v", got, want)
+	}
+}
+
+func TestDiscoveryOfMDNSControllers(t *testing.T) {
+	tests := []struct {
+		name   string
+		mdns   bool
+		params *VolumeParams
+		want   []string
+	}{
+		{
+			name:   "static target",
+			params: &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"},
+			want:   []string{testVolumeNqn},
+		},
+		{
+			name:   "static target and mDNS controller",
+			mdns:   true,
+			params: &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"},
+			want:   []string{testVolumeNqn, "nqn.2024-01.io.example:volume-2"},
+		},
+		{
+			name:   "mDNS controller only",
+			mdns:   true,
+			params: &VolumeParams{Transport: "tcp"},
+			want:   []string{"nqn.2024-01.io.example:volume-2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			client.discovery["192.0.2.20:8009"] = discoveryPage("192.0.2.20", "4420", "nqn.2024-01.io.example:volume-2")
+			if test.mdns {
+				withMDNSResponder(t, mdnsResponse(t, mdnsRecord{instance: "target-1", host: "target-1.local.", addr: "192.0.2.20", port: 8009, transport: "tcp"}))
+				c.Driver.mdns = newMDNSBrowser(time.Hour, 200*time.Millisecond)
+				c.Driver.mdns.refresh()
+			}
+
+			devices, err := c.deviceRegistry.discoverTargets(context.Background(), test.params, true)
+			if err != nil {
+				t.Fatalf("discoverTargets: %v", err)
+			}
+			got := map[string]struct{}{}
+			for _, device := range devices {
+				got[device.Nqn] = struct{}{}
+			}
+			if len(got) != len(test.want) {
+				t.Errorf("discovered %v, want %v", got, test.want)
+			}
+			for _, nqn := range test.want {
+				if _, exists := got[nqn]; !exists {
+					t.Errorf("discovered %v, want %s", got, nqn)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Labels and keys of the ConfigMaps written by the metadata store
+const (
+	metadataManagedByLabel = "app.kubernetes.io/managed-by"
+	metadataKindLabel      = "nvmf.csi.k8s.io/kind"
+	metadataKeyAnnotation  = "nvmf.csi.k8s.io/key"
+	metadataRecordKey      = "record"
+)
+
+// Persistence backends of the driver records
+const (
+	PersistenceKubernetes = "kubernetes" // ConfigMaps, stored in the cluster's etcd
+	PersistenceFile       = "file"       // Files on the local disk of a single controller replica
+	PersistenceBolt       = "bolt"       // Embedded BoltDB database on the local disk of a single controller replica
+)
+
+// Kinds of records kept in the metadata store
+const (
+	metadataKindSnapshot = "snapshot"
+)
+
+// isLocalPersistence reports whether the records of persistence are kept on
+// the local disk of the controller, which must then run as a single replica
+func isLocalPersistence(persistence string) bool {
+	return persistence == PersistenceFile || persistence == PersistenceBolt
+}
+
+// recordStore persists driver records, JSON documents identified by a kind and
+// a key, that have no home in the PV spec
+type recordStore interface {
+	// Put creates or replaces the record stored under kind/key
+	Put(ctx context.Context, kind, key string, record interface{}) error
+	// Get loads the record stored under kind/key into record and reports whether it exists
+	Get(ctx context.Context, kind, key string, record interface{}) (bool, error)
+	// Delete removes the record stored under kind/key, a missing record is not an error
+	Delete(ctx context.Context, kind, key string) error
+	// List returns the raw JSON of every record of the given kind, indexed by key
+	List(ctx context.Context, kind string) (map[string][]byte, error)
+	// Watch returns the changes of the records of the given kind, made through
+	// any store of the same persistence and prefix, until ctx is done or the
+	// store stops watching, when the channel is closed
+	Watch(ctx context.Context, kind string) (<-chan recordEvent, error)
+}
+
+// newRecordStore returns the record store of the configured persistence, with
+// the configured key prefix
+func newRecordStore(conf *GlobalConfig, client kubernetes.Interface) (recordStore, error) {
+	return newPrefixedRecordStore(conf, client, conf.EtcdPrefix)
+}
+
+// newPrefixedRecordStore returns the record store of the configured
+// persistence whose keys are namespaced by prefix
+func newPrefixedRecordStore(conf *GlobalConfig, client kubernetes.Interface, prefix string) (recordStore, error) {
+	if err := validateRecordPrefix(prefix); err != nil {
+		return nil, err
+	}
+
+	switch conf.Persistence {
+	case "", PersistenceKubernetes:
+		return newMetadataStore(client, conf.Namespace, conf.DriverName, prefix), nil
+	case PersistenceFile:
+		if conf.PersistencePath == "" {
+			return nil, fmt.Errorf("persistence %s requires persistence-path", PersistenceFile)
+		}
+		return newFileStore(conf.PersistencePath, prefix)
+	case PersistenceBolt:
+		if conf.PersistencePath == "" {
+			return nil, fmt.Errorf("persistence %s requires persistence-path", PersistenceBolt)
+		}
+		return newBoltStore(conf.PersistencePath, prefix)
+	default:
+		return nil, fmt.Errorf("unknown persistence %q, expected %s, %s or %s", conf.Persistence, PersistenceKubernetes, PersistenceFile, PersistenceBolt)
+	}
+}
+
+// metadataStore persists driver records that have no home in the PV spec.
+// Each record is a JSON document kept in a labeled ConfigMap in the driver
+// namespace, so it is stored in the cluster's etcd alongside the PVs. Each
+// operation is timed and its failures counted in metrics. Record keys are
+// prefixed, so that deployments sharing a namespace keep separate records.
+type metadataStore struct {
+	client     kubernetes.Interface
+	namespace  string
+	driverName string
+	prefix     string
+	metrics    *etcdMetrics
+}
+
+func newMetadataStore(client kubernetes.Interface, namespace, driverName, prefix string) *metadataStore {
+	return &metadataStore{
+		client:     client,
+		namespace:  namespace,
+		driverName: driverName,
+		prefix:     prefix,
+		metrics:    newEtcdMetrics(),
+	}
+}
+
+// Put creates or replaces the record stored under kind/key
+func (s *metadataStore) Put(ctx context.Context, kind, key string, record interface{}) error {
+	ctx, span := startSpan(ctx, "etcd.put", "record.kind", kind, "record.key", key)
+	start := time.Now()
+	err := s.put(ctx, kind, key, record)
+	span.end(err)
+	s.metrics.observe("put", time.Since(start), err)
+	etcdLog.V(5).Infof("Record store: put %s record %s in %v: %v", kind, key, time.Since(start), err)
+	return err
+}
+
+// Get loads the record stored under kind/key into record and reports whether it exists
+func (s *metadataStore) Get(ctx context.Context, kind, key string, record interface{}) (bool, error) {
+	start := time.Now()
+	found, err := s.get(ctx, kind, key, record)
+	s.metrics.observe("get", time.Since(start), err)
+	etcdLog.V(5).Infof("Record store: got %s record %s (found: %t) in %v: %v", kind, key, found, time.Since(start), err)
+	return found, err
+}
+
+// Delete removes the record stored under kind/key. Deleting a missing record is not an error.
+func (s *metadataStore) Delete(ctx context.Context, kind, key string) error {
+	ctx, span := startSpan(ctx, "etcd.delete", "record.kind", kind, "record.key", key)
+	start := time.Now()
+	err := s.delete(ctx, kind, key)
+	span.end(err)
+	s.metrics.observe("delete", time.Since(start), err)
+	etcdLog.V(5).Infof("Record store: deleted %s record %s in %v: %v", kind, key, time.Since(start), err)
+	return err
+}
+
+// List returns the raw JSON of every record of the given kind, indexed by key
+func (s *metadataStore) List(ctx context.Context, kind string) (map[string][]byte, error) {
+	start := time.Now()
+	records, err := s.list(ctx, kind)
+	s.metrics.observe("list", time.Since(start), err)
+	etcdLog.V(5).Infof("Record store: listed %d %s record(s) in %v: %v", len(records), kind, time.Since(start), err)
+	return records, err
+}
+
+// Watch returns the changes of the records of the given kind until ctx is
+// done or the API server closes the watch
+func (s *metadataStore) Watch(ctx context.Context, kind string) (<-chan recordEvent, error) {
+	selector := fmt.Sprintf("%s=%s,%s=%s", metadataManagedByLabel, s.driverName, metadataKindLabel, kind)
+	watcher, err := s.client.CoreV1().ConfigMaps(s.namespace).Watch(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s records: %v", kind, err)
+	}
+
+	events := make(chan recordEvent, recordWatchBuffer)
+	go func() {
+		defer close(events)
+		defer watcher.Stop()
+		for {
+			var change watch.Event
+			select {
+			case <-ctx.Done():
+				return
+			case change = <-watcher.ResultChan():
+			}
+			if change.Type == "" {
+				etcdLog.V(4).Infof("Record store: watch of %s records closed", kind)
+				return
+			}
+
+			cm, ok := change.Object.(*corev1.ConfigMap)
+			if !ok || cm.Labels[metadataKindLabel] != kind {
+				continue
+			}
+			key, matches := unprefixedKey(s.prefix, cm.Annotations[metadataKeyAnnotation])
+			if !matches {
+				continue
+			}
+			event := recordEvent{Key: key}
+			switch change.Type {
+			case watch.Added, watch.Modified:
+				event.Record = []byte(cm.Data[metadataRecordKey])
+			case watch.Deleted:
+			default:
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// objectName maps a record key to a valid ConfigMap name. Keys such as NQNs
+// contain characters that are not allowed in object names, so they are hashed.
+func (s *metadataStore) objectName(kind, key string) string {
+	sum := sha256.Sum256([]byte(s.prefix + key))
+	return fmt.Sprintf("nvmf-%s-%s", kind, hex.EncodeToString(sum[:])[:20])
+}
+
+// put creates or replaces the record stored under kind/key
+func (s *metadataStore) put(ctx context.Context, kind, key string, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s record %s: %v", kind, key, err)
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.objectName(kind, key),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				metadataManagedByLabel: s.driverName,
+				metadataKindLabel:      kind,
+			},
+			Annotations: map[string]string{
+				metadataKeyAnnotation: s.prefix + key,
+			},
+		},
+		Data: map[string]string{
+			metadataRecordKey: string(data),
+		},
+	}
+
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	if _, err := configMaps.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to store %s record %s: %v", kind, key, err)
+		}
+		if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update %s record %s: %v", kind, key, err)
+		}
+	}
+
+	return nil
+}
+
+// get loads the record stored under kind/key into record and reports whether it exists
+func (s *metadataStore) get(ctx context.Context, kind, key string, record interface{}) (bool, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.objectName(kind, key), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get %s record %s: %v", kind, key, err)
+	}
+
+	if err := json.Unmarshal([]byte(cm.Data[metadataRecordKey]), record); err != nil {
+		return false, fmt.Errorf("failed to decode %s record %s: %v", kind, key, err)
+	}
+
+	return true, nil
+}
+
+// delete removes the record stored under kind/key. Deleting a missing record is not an error.
+func (s *metadataStore) delete(ctx context.Context, kind, key string) error {
+	err := s.client.CoreV1().ConfigMaps(s.namespace).Delete(ctx, s.objectName(kind, key), metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %s record %s: %v", kind, key, err)
+	}
+
+	return nil
+}
+
+// list returns the raw JSON of every record of the given kind, indexed by key
+func (s *metadataStore) list(ctx context.Context, kind string) (map[string][]byte, error) {
+	selector := fmt.Sprintf("%s=%s,%s=%s", metadataManagedByLabel, s.driverName, metadataKindLabel, kind)
+	list, err := s.client.CoreV1().ConfigMaps(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s records: %v", kind, err)
+	}
+
+	records := make(map[string][]byte, len(list.Items))
+	for _, cm := range list.Items {
+		records[cm.Annotations[metadataKeyAnnotation]] = []byte(cm.Data[metadataRecordKey])
+	}
+
+	return unprefixedRecords(s.prefix, records), nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// mountPropagationFlags are the mount flags selecting the propagation of the
+// publish bind mount and their mount(2) flags. rshared matches the
+// Bidirectional mount propagation of Kubernetes and rslave HostToContainer.
+var mountPropagationFlags = map[string]uintptr{
+	"shared":   unix.MS_SHARED,
+	"rshared":  unix.MS_SHARED | unix.MS_REC,
+	"slave":    unix.MS_SLAVE,
+	"rslave":   unix.MS_SLAVE | unix.MS_REC,
+	"private":  unix.MS_PRIVATE,
+	"rprivate": unix.MS_PRIVATE | unix.MS_REC,
+}
+
+// mountSyscall is mount(2), replaced in tests
+var mountSyscall = unix.Mount
+
+// parseMountPropagation splits the propagation flag off mount flags, which
+// may hold comma-separated entries. Requesting more than one propagation is an
+// error.
+func parseMountPropagation(flags []string) (options []string, propagation string, err error) {
+	for _, option := range flags {
+		for _, flag := range strings.Split(option, ",") {
+			flag = strings.TrimSpace(flag)
+			if _, isPropagation := mountPropagationFlags[flag]; !isPropagation {
+				options = append(options, flag)
+				continue
+			}
+			if propagation != "" && propagation != flag {
+				return nil, "", fmt.Errorf("mount propagations %s and %s conflict", propagation, flag)
+			}
+			propagation = flag
+		}
+	}
+
+	return options, propagation, nil
+}
+
+// setMountPropagation changes the propagation of the mount at target
+func setMountPropagation(target, propagation string) error {
+	flags, exists := mountPropagationFlags[propagation]
+	if !exists {
+		return fmt.Errorf("unsupported mount propagation: %s", propagation)
+	}
+
+	klog.V(4).Infof("Setting mount propagation of %s to %s", target, propagation)
+	if err := mountSyscall("none", target, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to set mount propagation of %s to %s: %v", target, propagation, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// propagationMount is a mount(2) call changing the propagation of a mount
+type propagationMount struct {
+	target string
+	flags  uintptr
+}
+
+// withFakeMountSyscall records the mount(2) calls, failing them with err
+func withFakeMountSyscall(t *testing.T, err error) *[]propagationMount {
+	t.Helper()
+	calls := []propagationMount{}
+	saved := mountSyscall
+	mountSyscall = func(source, target, fstype string, flags uintptr, data string) error {
+		calls = append(calls, propagationMount{target: target, flags: flags})
+		return err
+	}
+	t.Cleanup(func() { mountSyscall = saved })
+	return &calls
+}
+
+func TestParseMountPropagation(t *testing.T) {
+	tests := []struct {
+		name            string
+		flags           []string
+		wantOptions     []string
+		wantPropagation string
+		wantErr         bool
+	}{
+		{name: "none", flags: []string{"noatime"}, wantOptions: []string{"noatime"}},
+		{name: "separate flag", flags: []string{"noatime", "rshared"}, wantOptions: []string{"noatime"}, wantPropagation: "rshared"},
+		{name: "within an option", flags: []string{"noatime, rslave"}, wantOptions: []string{"noatime"}, wantPropagation: "rslave"},
+		{name: "repeated", flags: []string{"private", "private"}, wantPropagation: "private"},
+		{name: "conflicting", flags: []string{"rshared", "rslave"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options, propagation, err := parseMountPropagation(test.flags)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseMountPropagation(%v) error = %v, want error %v", test.flags, err, test.wantErr)
+			}
+			if !reflect.DeepEqual(options, test.wantOptions) || propagation != test.wantPropagation {
+				t.Errorf("parseMountPropagation(%v) = %v, %q, want %v, %q", test.flags, options, propagation, test.wantOptions, test.wantPropagation)
+			}
+		})
+	}
+}
+
+func TestBindMountPropagation(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     []string
+		mountErr  error
+		wantFlags []uintptr
+		wantErr   bool
+	}{
+		{name: "default propagation", flags: []string{"noatime"}},
+		{name: "bidirectional", flags: []string{"noatime", "rshared"}, wantFlags: []uintptr{unix.MS_SHARED | unix.MS_REC}},
+		{name: "shared", flags: []string{"shared"}, wantFlags: []uintptr{unix.MS_SHARED}},
+		{name: "host to container", flags: []string{"rslave"}, wantFlags: []uintptr{unix.MS_SLAVE | unix.MS_REC}},
+		{name: "slave", flags: []string{"slave"}, wantFlags: []uintptr{unix.MS_SLAVE}},
+		{name: "rprivate", flags: []string{"rprivate"}, wantFlags: []uintptr{unix.MS_PRIVATE | unix.MS_REC}},
+		{name: "private", flags: []string{"private"}, wantFlags: []uintptr{unix.MS_PRIVATE}},
+		{name: "propagation failure", flags: []string{"rshared"}, mountErr: errors.New("invalid argument"), wantFlags: []uintptr{unix.MS_SHARED | unix.MS_REC}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := withFakeMountSyscall(t, test.mountErr)
+			mounter := mount.NewFakeMounter(nil)
+			nm := &nvmfDiskMounter{mountOptions: test.flags, mounter: &mount.SafeFormatAndMount{Interface: mounter}, targetPath: t.TempDir(), bind: true}
+			if err := nm.applyMountPropagation(); err != nil {
+				t.Fatalf("applyMountPropagation: %v", err)
+			}
+
+			err := bindMountFilesystem("/var/lib/kubelet/staging", nm)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("bindMountFilesystem error = %v, want error %v", err, test.wantErr)
+			}
+			flags := []uintptr{}
+			for _, call := range *calls {
+				if call.target != nm.targetPath {
+					t.Errorf("propagation set on %s, want %s", call.target, nm.targetPath)
+				}
+				flags = append(flags, call.flags)
+			}
+			if len(flags) != len(test.wantFlags) || len(flags) > 0 && !reflect.DeepEqual(flags, test.wantFlags) {
+				t.Errorf("propagation flags = %#x, want %#x", flags, test.wantFlags)
+			}
+
+			// The bind mount carries the other options only, and is undone
+			// when its propagation cannot be set
+			log := mounter.GetLog()
+			if len(log) == 0 || log[0].Action != mount.FakeActionMount {
+				t.Fatalf("mounter actions = %v, want a bind mount", log)
+			}
+			mounts, _ := mounter.List()
+			if test.wantErr != (len(mounts) == 0) {
+				t.Errorf("mounts after bindMountFilesystem = %v, want mounted %v", mounts, !test.wantErr)
+			}
+			for _, mp := range mounts {
+				for _, option := range mp.Opts {
+					if _, isPropagation := mountPropagationFlags[option]; isPropagation {
+						t.Errorf("bind mount options %v hold the propagation", mp.Opts)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPublishInvalidPropagation(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability *csi.VolumeCapability
+		want       codes.Code
+	}{
+		{name: "conflicting propagations", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "rshared", "private"), want: codes.InvalidArgument},
+		{name: "conflicting propagations in one option", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "noatime,shared,rslave"), want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := withFakeMountSyscall(t, nil)
+			n := newTestNodeServer(newFakeNvmeClient())
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          testVolumeNqn,
+				StagingTargetPath: stage.StagingTargetPath,
+				TargetPath:        t.TempDir(),
+				VolumeCapability:  test.capability,
+				VolumeContext:     stage.VolumeContext,
+			})
+			if got := status.Code(err); got != test.want {
+				t.Errorf("NodePublishVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if len(*calls) > 0 {
+				t.Errorf("propagation set %v, want no mount", *calls)
+			}
+		})
+	}
+}
+
+func TestBlockVolumePropagation(t *testing.T) {
+	nm := &nvmfDiskMounter{isBlock: true}
+	if err := nm.applyMountPropagation(); err != nil || nm.propagation != "" {
+		t.Errorf("applyMountPropagation of a block volume = %v with propagation %q, want none", err, nm.propagation)
+	}
+}
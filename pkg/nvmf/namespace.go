@@ -0,0 +1,183 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramNamespaces lists the namespace IDs every discovered subsystem exposes,
+// e.g. "1-4" or "1,3,5". The discovery log page only reports subsystems, so
+// the namespaces to hand out must be configured. Without it each subsystem is
+// allocated as a single volume backed by its first namespace.
+const paramNamespaces = "namespaces"
+
+// volumeIDNamespaceSeparator separates the subsystem NQN from the NSID in the
+// ID of a volume backed by one namespace of a shared subsystem
+const volumeIDNamespaceSeparator = "#"
+
+// maxNamespacesPerSubsystem bounds the expansion of namespace ranges
+const maxNamespacesPerSubsystem = 1024
+
+// formatVolumeID returns the volume ID of a namespace. NSID 0 denotes a whole
+// subsystem, whose volume ID is its NQN.
+func formatVolumeID(nqn string, nsid uint32) string {
+	if nsid == 0 {
+		return nqn
+	}
+
+	return nqn + volumeIDNamespaceSeparator + strconv.FormatUint(uint64(nsid), 10)
+}
+
+// parseVolumeID splits a volume ID of either format into the subsystem NQN and
+// the NSID, which is 0 for volumes backed by a whole subsystem
+func parseVolumeID(volumeID string) (string, uint32) {
+	fields, err := decodeVolumeID(volumeID)
+	if err != nil {
+		return volumeID, 0
+	}
+
+	return fields.Nqn, fields.Nsid
+}
+
+// splitVolumeID splits a volume ID of the NQN format
+func splitVolumeID(volumeID string) (string, uint32) {
+	index := strings.LastIndex(volumeID, volumeIDNamespaceSeparator)
+	if index < 0 {
+		return volumeID, 0
+	}
+
+	nsid, err := strconv.ParseUint(volumeID[index+1:], 10, 32)
+	if err != nil || nsid == 0 {
+		return volumeID, 0
+	}
+
+	return volumeID[:index], uint32(nsid)
+}
+
+// isValidVolumeNQN reports whether the volume ID is made of a valid subsystem NQN
+// and an optional NSID
+func isValidVolumeNQN(volumeID string) bool {
+	nqn, _ := parseVolumeID(volumeID)
+	return isValidNQN(nqn)
+}
+
+// volumeID returns the ID of the volume backed by the disk
+func (d *nvmfDiskInfo) volumeID() string {
+	return formatVolumeID(d.Nqn, d.Nsid)
+}
+
+// parseNamespaceIDs parses the namespaces parameter into sorted, unique NSIDs.
+// An empty value yields no NSIDs.
+func parseNamespaceIDs(value string) ([]uint32, error) {
+	seen := make(map[uint32]struct{})
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		first, last := field, field
+		if parts := strings.SplitN(field, "-", 2); len(parts) == 2 {
+			first, last = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		}
+
+		start, err := parseNamespaceID(first)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseNamespaceID(last)
+		if err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid namespace range %q", field)
+		}
+
+		for nsid := start; nsid <= end; nsid++ {
+			seen[nsid] = struct{}{}
+			if len(seen) > maxNamespacesPerSubsystem {
+				return nil, fmt.Errorf("more than %d namespaces per subsystem", maxNamespacesPerSubsystem)
+			}
+		}
+	}
+
+	nsids := make([]uint32, 0, len(seen))
+	for nsid := range seen {
+		nsids = append(nsids, nsid)
+	}
+	sort.Slice(nsids, func(i, j int) bool { return nsids[i] < nsids[j] })
+
+	return nsids, nil
+}
+
+func parseNamespaceID(value string) (uint32, error) {
+	nsid, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || nsid == 0 || nsid == 0xffffffff {
+		return 0, fmt.Errorf("invalid namespace ID %q", value)
+	}
+
+	return uint32(nsid), nil
+}
+
+// expandNamespaces turns discovered subsystems into one disk per configured
+// namespace, indexed by volume ID. Without NSIDs the subsystems are returned as is.
+func expandNamespaces(subsystems map[string]*nvmfDiskInfo, nsids []uint32) map[string]*nvmfDiskInfo {
+	if len(nsids) == 0 {
+		return subsystems
+	}
+
+	disks := make(map[string]*nvmfDiskInfo, len(subsystems)*len(nsids))
+	for _, subsystem := range subsystems {
+		for _, nsid := range nsids {
+			disk := *subsystem
+			disk.Endpoints = append([]string{}, subsystem.Endpoints...)
+			disk.Nsid = nsid
+			disks[disk.volumeID()] = &disk
+		}
+	}
+
+	return disks
+}
+
+// namespaceDirs returns the sysfs directories of the namespaces attached through
+// a controller, restricted to nsid unless it is 0
+func namespaceDirs(controller string, nsid uint32) []string {
+	// Supports both standard (nvme0n1) and controller-based (nvme2c2n1) namespaces
+	namespaces, err := filepath.Glob(filepath.Join(SYS_NVMF, controller, "nvme*n*"))
+	if err != nil || nsid == 0 {
+		return namespaces
+	}
+
+	matching := []string{}
+	for _, ns := range namespaces {
+		data, err := os.ReadFile(filepath.Join(ns, "nsid"))
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == strconv.FormatUint(uint64(nsid), 10) {
+			matching = append(matching, ns)
+		}
+	}
+
+	return matching
+}
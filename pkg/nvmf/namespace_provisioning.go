@@ -0,0 +1,283 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// paramProvisioningMode is the StorageClass parameter selecting how the device
+// of a volume is obtained, recorded in the volume context of dynamic volumes
+const paramProvisioningMode = "provisioningMode"
+
+// Provisioning modes
+const (
+	provisioningModeStatic  = "static"  // A free device of the pre-created pool is allocated
+	provisioningModeDynamic = "dynamic" // The backend creates a namespace of the requested size
+)
+
+// parseProvisioningMode validates the provisioning mode of the parameters,
+// static if unset. The namespace of a dynamic volume is chosen by the backend
+// and deleted with the volume, so it cannot be pinned, listed or kept unwiped.
+func parseProvisioningMode(p *VolumeParams, value string) (string, error) {
+	switch value {
+	case "", provisioningModeStatic:
+		return provisioningModeStatic, nil
+	case provisioningModeDynamic:
+	default:
+		return "", fmt.Errorf("%s must be %s or %s, got: %q", paramProvisioningMode, provisioningModeStatic, provisioningModeDynamic, value)
+	}
+
+	for param, set := range map[string]bool{
+		paramPinnedNqn:  p.PinnedNqn != "",
+		paramNamespaces: len(p.Namespaces) > 0,
+		paramDryRun:     p.DryRun,
+		paramSkipWipe:   p.SkipWipe,
+	} {
+		if set {
+			return "", fmt.Errorf("%s cannot be set with %s=%s", param, paramProvisioningMode, provisioningModeDynamic)
+		}
+	}
+
+	return provisioningModeDynamic, nil
+}
+
+// checkProvisioningMode verifies that the backend can create the namespaces of
+// dynamic volumes
+func (c *ControllerServer) checkProvisioningMode(params *VolumeParams) error {
+	if params.ProvisioningMode != provisioningModeDynamic {
+		return nil
+	}
+	if _, ok := c.Driver.namespaceProvisioner(); !ok {
+		return status.Errorf(codes.InvalidArgument, "backend %s cannot create namespaces for %s=%s", c.Driver.backend.Name(), paramProvisioningMode, provisioningModeDynamic)
+	}
+
+	return nil
+}
+
+// provisionNamespace has the backend create a namespace of the requested
+// capacity, rounded up to the granularity, on a discovered subsystem and
+// registers it as the device of the volume. A namespace that cannot be
+// registered is deleted again.
+func (c *ControllerServer) provisionNamespace(ctx context.Context, params *VolumeParams, req *AllocationRequest) (*VolumeInfo, error) {
+	provisioner, _ := c.Driver.namespaceProvisioner()
+
+	if req.RequiredBytes == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "%s=%s requires a capacity", paramProvisioningMode, provisioningModeDynamic)
+	}
+	sizeBytes := roundUpToGranularity(req.RequiredBytes, params.AllocationGranularity)
+	if req.LimitBytes > 0 && sizeBytes > req.LimitBytes {
+		return nil, status.Errorf(codes.OutOfRange, "%d bytes requested exceed the limit of %d bytes once rounded to the granularity", req.RequiredBytes, req.LimitBytes)
+	}
+
+	subsystem, err := c.deviceRegistry.selectSubsystem(ctx, params, req.VolumeName)
+	if err != nil {
+		var discoveryErr *DiscoveryError
+		if errors.As(err, &discoveryErr) {
+			return nil, c.discoveryError(ctx, params, err)
+		}
+		return nil, registryStatus(err)
+	}
+
+	namespace, err := provisioner.CreateNamespace(ctx, subsystem.Nqn, req.VolumeName, sizeBytes)
+	if err != nil {
+		if st := contextStatus(ctx.Err()); st != nil {
+			return nil, st
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to create a namespace of %d bytes on subsystem %s: %v", sizeBytes, subsystem.Nqn, err)
+	}
+	if namespace.Nsid == 0 {
+		return nil, status.Errorf(codes.Internal, "backend created a namespace without NSID on subsystem %s", subsystem.Nqn)
+	}
+
+	diskInfo := *subsystem
+	diskInfo.Nsid = namespace.Nsid
+	device := &VolumeInfo{
+		nvmfDiskInfo: &diskInfo,
+		Capacity:     namespace.SizeBytes,
+		Granularity:  params.AllocationGranularity,
+		Dynamic:      true,
+	}
+	if device.Capacity == 0 {
+		device.Capacity = sizeBytes
+	}
+
+	if device.Capacity < sizeBytes {
+		err = fmt.Errorf("backend created namespace %s of %d bytes, %d requested", device.volumeID(), device.Capacity, sizeBytes)
+	} else {
+		err = c.deviceRegistry.registerNamespace(ctx, device, req)
+	}
+	if err != nil {
+		// A registered namespace backs another volume, it must not be deleted
+		if !errors.Is(err, ErrDeviceNotFree) {
+			c.deleteNamespace(device)
+		}
+		return nil, registryStatus(err)
+	}
+
+	klog.Infof("Created namespace %d of %d bytes on subsystem %s for volume %s", device.Nsid, device.Capacity, device.Nqn, req.VolumeName)
+	return device, nil
+}
+
+// rollbackAllocation releases the device allocated to a volume whose creation
+// failed, deleting it first if the backend created it for the volume
+func (c *ControllerServer) rollbackAllocation(device *VolumeInfo) {
+	if device.Dynamic {
+		c.deleteNamespace(device)
+	}
+	c.deviceRegistry.ReleaseDevice(device.volumeID())
+}
+
+// deleteNamespace deletes a namespace created for a volume whose creation
+// failed. A namespace left behind is returned to the retried CreateVolume.
+func (c *ControllerServer) deleteNamespace(device *VolumeInfo) {
+	provisioner, ok := c.Driver.namespaceProvisioner()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Driver.grantTimeout)
+	defer cancel()
+	if err := provisioner.DeleteNamespace(ctx, device.Nqn, device.Nsid); err != nil {
+		klog.Errorf("Failed to delete namespace %d of subsystem %s: %v", device.Nsid, device.Nqn, err)
+		return
+	}
+	klog.Infof("Deleted namespace %d of subsystem %s", device.Nsid, device.Nqn)
+}
+
+// deleteDynamicNamespace deletes the namespace of a dynamic volume being
+// deleted, before its allocation is released, so that a failure is retried
+func (c *ControllerServer) deleteDynamicNamespace(ctx context.Context, volumeID string) error {
+	device, exists := c.deviceRegistry.GetDeviceByNQN(volumeID)
+	if !exists || !device.IsAllocated || !device.Dynamic {
+		return nil
+	}
+
+	provisioner, ok := c.Driver.namespaceProvisioner()
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "backend %s cannot delete the namespace of dynamic volume %s", c.Driver.backend.Name(), volumeID)
+	}
+	if err := provisioner.DeleteNamespace(ctx, device.Nqn, device.Nsid); err != nil {
+		if st := contextStatus(ctx.Err()); st != nil {
+			return st
+		}
+		return status.Errorf(codes.Unavailable, "failed to delete namespace of volume %s: %v", volumeID, err)
+	}
+	klog.Infof("Deleted namespace %d of subsystem %s of volume %s", device.Nsid, device.Nqn, volumeID)
+
+	return nil
+}
+
+// selectSubsystem discovers the subsystems of the parameters and returns the
+// permitted one with the fewest registered namespaces, on which the namespace
+// of a dynamic volume is created. Subsystems registered as a whole are never
+// selected, their namespaces back a single volume. The discovery runs out of
+// the lock and is shared with the discoveries in flight.
+func (r *DeviceRegistry) selectSubsystem(ctx context.Context, params *VolumeParams, volumeName string) (*nvmfDiskInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	discovered, err := r.discoverTargets(ctx, params, false)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, &DiscoveryError{Err: err}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id, exists := r.volumeToNQN[volumeName]; exists {
+		return nil, fmt.Errorf("%w: PV: %s, device: %s", ErrAlreadyAllocated, volumeName, id)
+	}
+
+	namespaces := map[string]int{}
+	whole := map[string]bool{}
+	for _, device := range r.devices {
+		if device.Nsid == 0 {
+			whole[device.Nqn] = true
+		} else {
+			namespaces[device.Nqn]++
+		}
+	}
+
+	var selected *nvmfDiskInfo
+	for _, diskInfo := range discovered {
+		if whole[diskInfo.Nqn] || !r.filter.isPermitted(diskInfo) || r.inMaintenance(diskInfo) {
+			registryLog.V(4).Infof("Subsystem %s skipped for volume %s", diskInfo.Nqn, volumeName)
+			continue
+		}
+		if selected == nil || namespaces[diskInfo.Nqn] < namespaces[selected.Nqn] ||
+			namespaces[diskInfo.Nqn] == namespaces[selected.Nqn] && diskInfo.Nqn < selected.Nqn {
+			selected = diskInfo
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("%w: no permitted subsystem to create a namespace on", ErrNoSuitableDevice)
+	}
+
+	// The discovered devices are shared with other discoveries
+	subsystem := *selected
+	subsystem.Nsid = 0
+	return &subsystem, nil
+}
+
+// registerNamespace registers a namespace the backend created as the device
+// allocated to the volume of the request, once the allocation is persisted
+func (r *DeviceRegistry) registerNamespace(ctx context.Context, device *VolumeInfo, req *AllocationRequest) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id, exists := r.volumeToNQN[req.VolumeName]; exists {
+		return fmt.Errorf("%w: PV: %s, device: %s", ErrAlreadyAllocated, req.VolumeName, id)
+	}
+	id := device.volumeID()
+	if _, exists := r.devices[id]; exists {
+		return fmt.Errorf("%w: namespace %s is registered already", ErrDeviceNotFree, id)
+	}
+
+	usedBytes, volumeBytes := device.consumedBytes(req), device.volumeBytes(req)
+	if err := r.persistAllocation(ctx, device, req, usedBytes, volumeBytes); err != nil {
+		return err
+	}
+
+	r.devices[id] = device
+	r.volumeToNQN[req.VolumeName] = id
+	device.VolName = req.VolumeName
+	device.IsAllocated = true
+	device.UsedBytes = usedBytes
+	device.VolumeBytes = volumeBytes
+	device.AffinityKey = req.Placement.AffinityKey
+	device.AntiAffinityKey = req.Placement.AntiAffinityKey
+	device.QoS = req.QoS
+	device.AllowedHosts = req.AllowedHosts
+	r.recordAllocation(id, device)
+
+	registryLog.V(4).Infof("Registered namespace %s of volume %s", id, req.VolumeName)
+	return nil
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const dynamicNqn = "nqn.2024-01.io.example:volume-2"
+
+// newDynamicServer returns a controller whose target exports two subsystems
+// to create the namespaces of dynamic volumes on
+func newDynamicServer(t *testing.T, capabilities ...BackendCapability) (*ControllerServer, *fakeBackend) {
+	t.Helper()
+	backend := newFakeBackend(capabilities...)
+	c, _ := newTestControllerServer(t, backend)
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, dynamicNqn)
+	return c, backend
+}
+
+// dynamicRequest returns a request for a dynamic volume of requiredBytes
+func dynamicRequest(name string, requiredBytes, limitBytes int64, extra map[string]string) *csi.CreateVolumeRequest {
+	params := map[string]string{paramProvisioningMode: provisioningModeDynamic}
+	for key, value := range extra {
+		params[key] = value
+	}
+	req := createRequest(name, params)
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: requiredBytes, LimitBytes: limitBytes}
+	return req
+}
+
+func TestParseProvisioningMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset", params: map[string]string{}, want: provisioningModeStatic},
+		{name: "static", params: map[string]string{paramProvisioningMode: "static"}, want: provisioningModeStatic},
+		{name: "dynamic", params: map[string]string{paramProvisioningMode: "dynamic"}, want: provisioningModeDynamic},
+		{name: "unknown mode", params: map[string]string{paramProvisioningMode: "thin"}, wantErr: true},
+		{name: "dynamic pinned device", params: map[string]string{paramProvisioningMode: "dynamic", paramPinnedNqn: testVolumeNqn}, wantErr: true},
+		{name: "dynamic with namespaces", params: map[string]string{paramProvisioningMode: "dynamic", paramNamespaces: "1"}, wantErr: true},
+		{name: "dynamic dry run", params: map[string]string{paramProvisioningMode: "dynamic", paramDryRun: "true"}, wantErr: true},
+		{name: "dynamic without wipe", params: map[string]string{paramProvisioningMode: "dynamic", paramSkipWipe: "true"}, wantErr: true},
+		{name: "static pinned device", params: map[string]string{paramProvisioningMode: "static", paramPinnedNqn: testVolumeNqn}, want: provisioningModeStatic},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := ParseVolumeParams(test.params)
+			if test.wantErr {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Fatalf("ParseVolumeParams error = %v, want InvalidArgument", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeParams: %v", err)
+			}
+			if p.ProvisioningMode != test.want {
+				t.Errorf("provisioning mode = %q, want %q", p.ProvisioningMode, test.want)
+			}
+		})
+	}
+}
+
+func TestDynamicCreateVolume(t *testing.T) {
+	const gi = int64(1) << 30
+
+	tests := []struct {
+		name         string
+		capabilities []BackendCapability
+		required     int64
+		limit        int64
+		extra        map[string]string
+		// namespaceSize is the size of the namespaces the backend creates
+		namespaceSize int64
+		createErrs    []error
+		// failStore fails the persistence of the allocation
+		failStore   bool
+		want        codes.Code
+		wantCreated []string
+		wantDeleted []string
+		wantBytes   int64
+	}{
+		{
+			name:         "created",
+			capabilities: []BackendCapability{BackendCapabilityProvision},
+			required:     3 * gi,
+			extra:        map[string]string{paramAllocationGranularity: "2Gi"},
+			wantCreated:  []string{formatVolumeID(testVolumeNqn, 1)},
+			wantBytes:    4 * gi,
+		},
+		{
+			// The volume reports its rounded request, like those of pool devices
+			name:          "larger namespace",
+			capabilities:  []BackendCapability{BackendCapabilityProvision},
+			required:      3 * gi,
+			namespaceSize: 5 * gi,
+			wantCreated:   []string{formatVolumeID(testVolumeNqn, 1)},
+			wantBytes:     3 * gi,
+		},
+		{name: "backend without provisioning", required: gi, want: codes.InvalidArgument},
+		{name: "no capacity", capabilities: []BackendCapability{BackendCapabilityProvision}, want: codes.InvalidArgument},
+		{
+			name:         "limit below the granularity",
+			capabilities: []BackendCapability{BackendCapabilityProvision},
+			required:     3 * gi,
+			limit:        3 * gi,
+			extra:        map[string]string{paramAllocationGranularity: "2Gi"},
+			want:         codes.OutOfRange,
+		},
+		{
+			name:         "failed creation",
+			capabilities: []BackendCapability{BackendCapabilityProvision},
+			required:     gi,
+			createErrs:   []error{errors.New("pool full")},
+			want:         codes.Unavailable,
+		},
+		{
+			name:          "undersized namespace",
+			capabilities:  []BackendCapability{BackendCapabilityProvision},
+			required:      3 * gi,
+			namespaceSize: gi,
+			want:          codes.Internal,
+			wantCreated:   []string{formatVolumeID(testVolumeNqn, 1)},
+			wantDeleted:   []string{formatVolumeID(testVolumeNqn, 1)},
+		},
+		{
+			name:         "unavailable store",
+			capabilities: []BackendCapability{BackendCapabilityProvision},
+			required:     gi,
+			failStore:    true,
+			want:         codes.Unavailable,
+			wantCreated:  []string{formatVolumeID(testVolumeNqn, 1)},
+			wantDeleted:  []string{formatVolumeID(testVolumeNqn, 1)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, backend := newDynamicServer(t, test.capabilities...)
+			backend.namespaceSize = test.namespaceSize
+			backend.createErrs = test.createErrs
+			if test.failStore {
+				c.Driver.metadata = failingStore{c.Driver.metadata}
+			}
+
+			resp, err := c.CreateVolume(context.Background(), dynamicRequest("pv-1", test.required, test.limit, test.extra))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if !reflect.DeepEqual(backend.created, test.wantCreated) {
+				t.Errorf("created namespaces %v, want %v", backend.created, test.wantCreated)
+			}
+			if !reflect.DeepEqual(backend.deleted, test.wantDeleted) {
+				t.Errorf("deleted namespaces %v, want %v", backend.deleted, test.wantDeleted)
+			}
+			if err != nil {
+				if _, allocated := c.deviceRegistry.volumeToNQN["pv-1"]; allocated {
+					t.Error("pv-1 allocated after a failed CreateVolume")
+				}
+				if len(c.deviceRegistry.devices) > 0 {
+					t.Errorf("devices registered after a failed CreateVolume: %v", c.deviceRegistry.devices)
+				}
+				return
+			}
+
+			volume := resp.GetVolume()
+			if volume.GetVolumeId() != formatVolumeID(testVolumeNqn, 1) || volume.GetCapacityBytes() != test.wantBytes {
+				t.Errorf("CreateVolume = %s of %d bytes, want %s of %d bytes", volume.GetVolumeId(), volume.GetCapacityBytes(), formatVolumeID(testVolumeNqn, 1), test.wantBytes)
+			}
+			if got := volume.GetVolumeContext()[paramProvisioningMode]; got != provisioningModeDynamic {
+				t.Errorf("volume context %s = %q, want %q", paramProvisioningMode, got, provisioningModeDynamic)
+			}
+			if record := storedAllocation(t, c, "pv-1"); !record.Dynamic {
+				t.Errorf("allocation record %+v is not dynamic", record)
+			}
+		})
+	}
+}
+
+func TestDynamicCreateVolumeSpreadsNamespaces(t *testing.T) {
+	c, backend := newDynamicServer(t, BackendCapabilityProvision)
+
+	// Namespaces go to the subsystem with the fewest, a retry to its namespace
+	want := map[string]string{
+		"pv-1": formatVolumeID(testVolumeNqn, 1),
+		"pv-2": formatVolumeID(dynamicNqn, 1),
+		"pv-3": formatVolumeID(testVolumeNqn, 2),
+	}
+	for _, name := range []string{"pv-1", "pv-2", "pv-3", "pv-1"} {
+		resp, err := c.CreateVolume(context.Background(), dynamicRequest(name, 1<<30, 0, nil))
+		if err != nil {
+			t.Fatalf("CreateVolume(%s): %v", name, err)
+		}
+		if got := resp.GetVolume().GetVolumeId(); got != want[name] {
+			t.Errorf("CreateVolume(%s) = %s, want %s", name, got, want[name])
+		}
+	}
+	if len(backend.created) != len(want) {
+		t.Errorf("created namespaces %v, want one for each volume", backend.created)
+	}
+
+	// A pool volume of the same name is another volume
+	if _, err := c.CreateVolume(context.Background(), createRequest("pv-1", nil)); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("static CreateVolume(pv-1) error = %v, want AlreadyExists", err)
+	}
+}
+
+func TestDynamicDeleteVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		deleteErrs []error
+		want       codes.Code
+	}{
+		{name: "deleted"},
+		{name: "failed deletion", deleteErrs: []error{errors.New("namespace busy")}, want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, backend := newDynamicServer(t, BackendCapabilityProvision)
+			resp, err := c.CreateVolume(context.Background(), dynamicRequest("pv-1", 1<<30, 0, nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volumeID := resp.GetVolume().GetVolumeId()
+			backend.deleteErrs = test.deleteErrs
+
+			_, err = c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("DeleteVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err != nil {
+				// The volume keeps its namespace until the retried delete
+				if device, exists := c.deviceRegistry.GetDeviceByNQN(volumeID); !exists || !device.IsAllocated {
+					t.Fatalf("volume %s released after a failed namespace deletion", volumeID)
+				}
+				if _, err := c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+					t.Fatalf("retried DeleteVolume: %v", err)
+				}
+			}
+
+			// The namespace is deleted rather than returned to the pool
+			if want := []string{volumeID}; !reflect.DeepEqual(backend.deleted, want) {
+				t.Errorf("deleted namespaces %v, want %v", backend.deleted, want)
+			}
+			if _, exists := c.deviceRegistry.GetDeviceByNQN(volumeID); exists {
+				t.Errorf("deleted namespace %s is still registered", volumeID)
+			}
+			if c.deviceRegistry.FreeDeviceCount() != 0 {
+				t.Errorf("free devices = %d after the delete, want 0", c.deviceRegistry.FreeDeviceCount())
+			}
+			if exists, err := c.Driver.metadata.Get(context.Background(), metadataKindAllocation, "pv-1", &allocationRecord{}); err != nil || exists {
+				t.Errorf("allocation record of pv-1 = %v, %v after the delete, want none", exists, err)
+			}
+
+			// Deleting again is a no-op
+			if _, err := c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+				t.Errorf("DeleteVolume of the deleted volume: %v", err)
+			}
+			if len(backend.deleted) != 1 {
+				t.Errorf("deleted namespaces %v, want a single deletion", backend.deleted)
+			}
+		})
+	}
+}
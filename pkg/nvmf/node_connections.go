@@ -0,0 +1,312 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// nodeConnection tracks the staging paths sharing the controllers of one NQN
+// connected with one host NQN. The controllers are disconnected only when the
+// last staging path is unstaged.
+type nodeConnection struct {
+	nqn string
+	// hostNqn is the host NQN the controllers were connected with, needed to disconnect them
+	hostNqn      string
+	stagingPaths map[string]struct{}
+
+	// Transport and endpoints the controllers were connected through
+	transport string
+	endpoints []string
+
+	// Authentication secrets the controllers were connected or last rotated
+	// with, and the request phase they came from
+	secrets       authSecrets
+	secretsSource credentialSource
+}
+
+// connectionKey indexes the connections of an NQN by host NQN, so that volumes
+// presenting different host NQNs to the target never share controllers
+func connectionKey(nqn, hostNqn string) string {
+	return nqn + " " + hostNqn
+}
+
+// attachOrReuse returns the device of a namespace whose subsystem is already
+// connected on this node, or connects the subsystem. The caller must hold the
+// connection lock. With a pinned host NQN only controllers connected with that host
+// NQN are reused. Otherwise any controller of the NQN is reused and
+// connector.HostNqn is updated to the host NQN it was connected with. reused
+// reports whether an existing connection was found.
+func (n *NodeServer) attachOrReuse(volumeID string, connector *Connector, pinnedHostNqn bool) (devicePath string, reused bool, err error) {
+	hostNqn := ""
+	if pinnedHostNqn {
+		hostNqn = connector.HostNqn
+	}
+
+	if controller, found := findUsableController(n.Driver.nvme, connector.TargetNqn, hostNqn); found {
+		devicePath, err := namespaceDevicePath(connector.TargetNqn, connector.Nsid)
+		if err == nil {
+			if !pinnedHostNqn {
+				if hostNqn := n.connectionHostNqn(connector.TargetNqn, controller); hostNqn != "" {
+					connector.HostNqn = hostNqn
+				}
+			}
+			nvmeLog.V(4).Infof("Reusing existing connection of %s through controller %s, device %s", connector.TargetNqn, controller.Name, devicePath)
+			return devicePath, true, nil
+		}
+		klog.Warningf("Controller %s of %s has no usable device, connecting again: %v", controller.Name, connector.TargetNqn, err)
+	}
+
+	n.recoverStuckControllers(connector.TargetNqn)
+
+	devicePath, err = AttachDisk(n.Driver.nvme, volumeID, connector)
+	return devicePath, false, err
+}
+
+// Keys of the node locks. Operations on one volume, i.e. stage, publish and
+// their reverse, hold the volume lock. Operations on the controllers of an NQN,
+// shared by all its namespaces staged on the node, hold the connection lock.
+// A volume lock is always taken before a connection lock.
+
+// volumeLockKey is the key of the lock of one volume among the node locks
+func volumeLockKey(volumeID string) string {
+	return "volume/" + volumeID
+}
+
+// connectionLockKey is the key of the lock of the connection of an NQN among the node locks
+func connectionLockKey(nqn string) string {
+	return "nqn/" + nqn
+}
+
+// namespaceDevicePath returns the device of a namespace of a connected
+// subsystem, replaced in tests
+var namespaceDevicePath = func(nqn string, nsid uint32) (string, error) {
+	return findPathWithRetry(nqn, nsid, 1, 0)
+}
+
+// connectStage connects the subsystem of a volume being staged at stagingPath,
+// or reuses its connection, and references the connection from stagingPath,
+// all under the connection lock. Stages of several namespaces of one subsystem thus
+// share a single connection and format and mount their devices in parallel.
+// It returns the device of the namespace and the function undoing the stage's
+// reference if the stage fails afterwards, which disconnects the subsystem if
+// the stage connected it and no other stage references it meanwhile.
+func (n *NodeServer) connectStage(volumeID, stagingPath string, connector *Connector, pinnedHostNqn bool, stageSecrets authSecrets) (string, func(), error) {
+	nqn := connector.TargetNqn
+	n.nqnLocks.Acquire(connectionLockKey(nqn))
+	defer n.nqnLocks.Release(connectionLockKey(nqn))
+
+	secrets, secretsSource := n.stageSecrets(nqn, stageSecrets)
+	secrets.applyTo(connector)
+
+	devicePath, reused, err := n.attachOrReuse(volumeID, connector, pinnedHostNqn)
+	if err != nil {
+		return "", nil, err
+	}
+	added := n.addReference(connector, stagingPath)
+	if !reused {
+		n.cacheSecrets(nqn, connector.HostNqn, secrets, secretsSource)
+	}
+
+	release := func() {
+		if !added {
+			// A restaged path keeps the reference of its earlier stage
+			return
+		}
+		n.nqnLocks.Acquire(connectionLockKey(nqn))
+		defer n.nqnLocks.Release(connectionLockKey(nqn))
+
+		remaining, _, err := n.removeReference(nqn, stagingPath)
+		if err == nil && remaining > 0 {
+			nvmeLog.V(4).Infof("Connection of %s is used by %d other staging path(s), keeping it", nqn, remaining)
+			return
+		}
+		if !reused {
+			if err := DetachDisk(n.Driver.nvme, nqn, connector.HostNqn, n.Driver.nvmeCliTimeout); err != nil {
+				klog.Errorf("Failed to disconnect %s after a failed stage: %v", nqn, err)
+			}
+		}
+	}
+
+	return devicePath, release, nil
+}
+
+// connectionHostNqn returns the host NQN of an established connection, preferring
+// the controller's sysfs attribute and falling back to a tracked reference
+func (n *NodeServer) connectionHostNqn(nqn string, controller NvmeController) string {
+	if controller.HostNqn != "" {
+		return controller.HostNqn
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	for _, conn := range n.connections {
+		if conn.nqn == nqn {
+			return conn.hostNqn
+		}
+	}
+
+	return ""
+}
+
+// addPublish records that targetPath publishes the volume staged at stagingPath
+func (n *NodeServer) addPublish(stagingPath, targetPath string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	n.publishes[targetPath] = stagingPath
+}
+
+// removePublish drops the publish of targetPath
+func (n *NodeServer) removePublish(targetPath string) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	delete(n.publishes, targetPath)
+}
+
+// publishCount returns the number of target paths publishing the volume staged
+// at stagingPath. Publishes made before the plugin started are not counted.
+func (n *NodeServer) publishCount(stagingPath string) int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	count := 0
+	for _, published := range n.publishes {
+		if published == stagingPath {
+			count++
+		}
+	}
+	return count
+}
+
+// readControllerHostNqn returns the host NQN of a controller, or an empty string
+// if the kernel does not expose it
+func readControllerHostNqn(controller string) string {
+	data, err := os.ReadFile(filepath.Join(SYS_NVMF, controller, "hostnqn"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// addReference records that stagingPath uses the connection of the connector.
+// It reports whether stagingPath did not reference the connection yet.
+func (n *NodeServer) addReference(connector *Connector, stagingPath string) bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	added := true
+	if conn, exists := n.connections[connectionKey(connector.TargetNqn, connector.HostNqn)]; exists {
+		_, referenced := conn.stagingPaths[stagingPath]
+		added = !referenced
+	}
+	n.trackReference(connector.TargetNqn, connector.HostNqn, connector.Transport, connector.TargetEndpoints, stagingPath)
+	n.saveStagingState()
+
+	return added
+}
+
+// trackReference records that stagingPath uses the connection of nqn with
+// hostNqn. Caller must hold the mutex.
+func (n *NodeServer) trackReference(nqn, hostNqn, transport string, endpoints []string, stagingPath string) {
+	key := connectionKey(nqn, hostNqn)
+	conn, exists := n.connections[key]
+	if !exists {
+		conn = &nodeConnection{
+			nqn:          nqn,
+			hostNqn:      hostNqn,
+			stagingPaths: make(map[string]struct{}),
+		}
+		n.connections[key] = conn
+	}
+	conn.stagingPaths[stagingPath] = struct{}{}
+	conn.transport = transport
+	conn.endpoints = append([]string{}, endpoints...)
+
+	nvmeLog.V(4).Infof("Connection of %s with host NQN %s has %d reference(s)", nqn, hostNqn, len(conn.stagingPaths))
+}
+
+// removeReference drops the reference of stagingPath to the connection of nqn.
+// It returns the number of remaining references and the host NQN of the
+// connection, or an error if no connection of nqn is tracked for stagingPath.
+func (n *NodeServer) removeReference(nqn, stagingPath string) (int, string, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for key, conn := range n.connections {
+		if conn.nqn != nqn {
+			continue
+		}
+		if _, exists := conn.stagingPaths[stagingPath]; !exists {
+			continue
+		}
+
+		delete(conn.stagingPaths, stagingPath)
+		remaining := len(conn.stagingPaths)
+		if remaining == 0 {
+			delete(n.connections, key)
+		}
+		n.saveStagingState()
+
+		return remaining, conn.hostNqn, nil
+	}
+
+	return 0, "", fmt.Errorf("connection of %s is not tracked for %s", nqn, stagingPath)
+}
+
+// kubeletCSIDir holds the staging paths counted against the volume limit and
+// restored at startup, a variable so that tests can replace it
+var kubeletCSIDir = KUBELET_CSI_DIR
+
+// reserveStage counts a stage of stagingPath against the volume limit of the
+// node and returns the function ending the reservation. Staged volumes are
+// counted by their connector files, so that the count survives restarts and
+// drops as soon as a volume is unstaged. Stages that fail never persist a
+// connector file. Restaging a staged path is always accepted.
+func (n *NodeServer) reserveStage(stagingPath string) (func(), error) {
+	limit := n.Driver.maxVolumesPerNode
+	if limit <= 0 || utils.IsFileExisting(connectorFilePath(stagingPath)) {
+		return func() {}, nil
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	files, err := stagedConnectorFiles(kubeletCSIDir)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Cannot count staged volumes in %s: %v", kubeletCSIDir, err)
+	}
+	if staged := int64(len(files) + n.pendingStages); staged >= limit {
+		return nil, status.Errorf(codes.ResourceExhausted, "node %s already has %d of at most %d volumes staged", n.Driver.nodeId, staged, limit)
+	}
+
+	n.pendingStages++
+	return func() {
+		n.mtx.Lock()
+		defer n.mtx.Unlock()
+		n.pendingStages--
+	}, nil
+}
@@ -0,0 +1,423 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withFakeNamespaces resolves the namespaces of the subsystems connected
+// through client, instead of looking them up in sysfs
+func withFakeNamespaces(t *testing.T, client *fakeNvmeClient) {
+	t.Helper()
+	saved := namespaceDevicePath
+	namespaceDevicePath = func(nqn string, nsid uint32) (string, error) {
+		if _, found := findUsableController(client, nqn, ""); !found {
+			return "", fmt.Errorf("%s is not connected", nqn)
+		}
+		return fmt.Sprintf("/dev/disk/by-id/nvme-fake-%s-%d", nqn, nsid), nil
+	}
+	t.Cleanup(func() { namespaceDevicePath = saved })
+}
+
+func TestConcurrentStagesShareConnection(t *testing.T) {
+	const otherNqn = "nqn.2024-01.io.example:volume-2"
+
+	tests := []struct {
+		name        string
+		volumeIDs   []string
+		connections int
+	}{
+		{
+			name:        "two namespaces of one subsystem",
+			volumeIDs:   []string{formatVolumeID(testVolumeNqn, 1), formatVolumeID(testVolumeNqn, 2)},
+			connections: 1,
+		},
+		{
+			name:        "namespaces of two subsystems",
+			volumeIDs:   []string{formatVolumeID(testVolumeNqn, 1), formatVolumeID(otherNqn, 1)},
+			connections: 2,
+		},
+		{
+			name:        "whole subsystem staged twice",
+			volumeIDs:   []string{testVolumeNqn, testVolumeNqn},
+			connections: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			// Widen the window in which an unserialized stage would connect again
+			client.connectDelay = 20 * time.Millisecond
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+
+			// Each stage has its own staging target path, as for two pods
+			dirs := make([]string, len(test.volumeIDs))
+			for i := range dirs {
+				dirs[i] = t.TempDir()
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(test.volumeIDs))
+			for i, volumeID := range test.volumeIDs {
+				wg.Add(1)
+				go func(i int, volumeID string) {
+					defer wg.Done()
+					nqn, nsid := parseVolumeID(volumeID)
+					info := &nvmfDiskInfo{Nqn: nqn, Nsid: nsid, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+					connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+					_, _, errs[i] = n.connectStage(volumeID, stagingVolumePath(dirs[i], volumeID), connector, false, authSecrets{})
+				}(i, volumeID)
+			}
+			wg.Wait()
+			for i, err := range errs {
+				if err != nil {
+					t.Fatalf("stage of %s failed: %v", test.volumeIDs[i], err)
+				}
+			}
+			if got := client.connectCount(); got != test.connections {
+				t.Fatalf("connects = %d, want %d", got, test.connections)
+			}
+
+			for i, volumeID := range test.volumeIDs {
+				wg.Add(1)
+				go func(i int, volumeID string) {
+					defer wg.Done()
+					_, errs[i] = n.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+						VolumeId:          volumeID,
+						StagingTargetPath: dirs[i],
+					})
+				}(i, volumeID)
+			}
+			wg.Wait()
+			for i, err := range errs {
+				if err != nil {
+					t.Fatalf("unstage of %s failed: %v", test.volumeIDs[i], err)
+				}
+			}
+			if got := client.disconnectCount(); got != test.connections {
+				t.Errorf("disconnects = %d, want %d", got, test.connections)
+			}
+			if len(n.connections) != 0 {
+				t.Errorf("%d connection(s) still tracked after the last unstage", len(n.connections))
+			}
+		})
+	}
+}
+
+func TestConnectionReferences(t *testing.T) {
+	tests := []struct {
+		name string
+		// stages and unstages are the indexes of the staging paths staged and
+		// unstaged in turn, all of the same volume
+		stages   []int
+		unstages []int
+		// disconnects are the disconnects made after each unstage
+		disconnects []int
+	}{
+		{name: "single stage", stages: []int{0}, unstages: []int{0}, disconnects: []int{1}},
+		{name: "last of two stages disconnects", stages: []int{0, 1}, unstages: []int{0, 1}, disconnects: []int{0, 1}},
+		{name: "unstaged in reverse order", stages: []int{0, 1, 2}, unstages: []int{2, 0, 1}, disconnects: []int{0, 0, 1}},
+		{name: "restaged path keeps one reference", stages: []int{0, 0}, unstages: []int{0}, disconnects: []int{1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+			dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+
+			for _, i := range test.stages {
+				connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+				if _, _, err := n.connectStage(testVolumeNqn, stagingVolumePath(dirs[i], testVolumeNqn), connector, false, authSecrets{}); err != nil {
+					t.Fatalf("stage at %s: %v", dirs[i], err)
+				}
+			}
+			if got := client.connectCount(); got != 1 {
+				t.Fatalf("connects = %d, want the later stages to reuse the first connection", got)
+			}
+
+			for step, i := range test.unstages {
+				_, err := n.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+					VolumeId:          testVolumeNqn,
+					StagingTargetPath: dirs[i],
+				})
+				if err != nil {
+					t.Fatalf("unstage of %s: %v", dirs[i], err)
+				}
+				if got := client.disconnectCount(); got != test.disconnects[step] {
+					t.Errorf("disconnects after unstaging %s = %d, want %d", dirs[i], got, test.disconnects[step])
+				}
+			}
+		})
+	}
+}
+
+func TestFailedStageReleasesItsReference(t *testing.T) {
+	tests := []struct {
+		name            string
+		connectedBefore bool // whether another stage connected the subsystem
+		wantDisconnects int
+	}{
+		{name: "stage that connected", wantDisconnects: 1},
+		{name: "stage that reused the connection", connectedBefore: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+			if test.connectedBefore {
+				connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+				if _, _, err := n.connectStage(testVolumeNqn, stagingVolumePath(t.TempDir(), testVolumeNqn), connector, false, authSecrets{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+			_, release, err := n.connectStage(testVolumeNqn, stagingVolumePath(t.TempDir(), testVolumeNqn), connector, false, authSecrets{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The stage fails after connecting, e.g. to mount the device
+			release()
+
+			if got := client.disconnectCount(); got != test.wantDisconnects {
+				t.Errorf("disconnects = %d, want %d", got, test.wantDisconnects)
+			}
+			wantConnections := 0
+			if test.connectedBefore {
+				wantConnections = 1
+			}
+			if len(n.connections) != wantConnections {
+				t.Errorf("%d connection(s) tracked, want %d", len(n.connections), wantConnections)
+			}
+		})
+	}
+}
+
+func TestMaxVolumesPerNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int64
+		staged  int
+		pending int
+		// restage stages the path of an already staged volume
+		restage bool
+		want    codes.Code
+	}{
+		{name: "unlimited", staged: 3, want: codes.OK},
+		{name: "below the limit", limit: 2, staged: 1, want: codes.OK},
+		{name: "at the limit", limit: 2, staged: 2, want: codes.ResourceExhausted},
+		{name: "stage in progress at the limit", limit: 2, staged: 1, pending: 1, want: codes.ResourceExhausted},
+		{name: "restage at the limit", limit: 2, staged: 2, restage: true, want: codes.OK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csiDir := t.TempDir()
+			saved := kubeletCSIDir
+			kubeletCSIDir = csiDir
+			t.Cleanup(func() { kubeletCSIDir = saved })
+
+			n := newTestNodeServer(newFakeNvmeClient())
+			n.Driver.maxVolumesPerNode = test.limit
+			var stagingDirs []string
+			for i := 0; i < test.staged; i++ {
+				rel := filepath.Join(DefaultDriverName, fmt.Sprintf("volume-%d", i), "globalmount")
+				writeStagedConnector(t, csiDir, rel, fmt.Sprintf("nqn.2024-01.io.example:staged-%d", i))
+				stagingDirs = append(stagingDirs, filepath.Join(csiDir, rel))
+			}
+			n.pendingStages = test.pending
+
+			stagingPath := stagingVolumePath(filepath.Join(csiDir, DefaultDriverName, "new", "globalmount"), testVolumeNqn)
+			if test.restage {
+				stagingPath = stagingVolumePath(stagingDirs[0], "nqn.2024-01.io.example:staged-0")
+			}
+			release, err := n.reserveStage(stagingPath)
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("reserveStage code = %v, want %v: %v", got, test.want, err)
+			}
+			if err == nil {
+				release()
+			}
+			if n.pendingStages != test.pending {
+				t.Errorf("pending stages = %d, want %d once released", n.pendingStages, test.pending)
+			}
+
+			// NodeGetInfo reports the same limit to the scheduler
+			resp, err := n.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetMaxVolumesPerNode() != test.limit {
+				t.Errorf("NodeGetInfo MaxVolumesPerNode = %d, want %d", resp.GetMaxVolumesPerNode(), test.limit)
+			}
+		})
+	}
+}
+
+func TestStageBeyondMaxVolumesPerNode(t *testing.T) {
+	tests := []struct {
+		name string
+		// failStage fails the stage before the limit is reached, which must
+		// not count against it
+		failStage bool
+		// unstage unstages the staged volume before the next stage
+		unstage bool
+		want    codes.Code
+	}{
+		{name: "next stage at the limit", want: codes.ResourceExhausted},
+		{name: "next stage after a failed stage", failStage: true, want: codes.OK},
+		{name: "next stage after an unstage", unstage: true, want: codes.OK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csiDir := t.TempDir()
+			saved := kubeletCSIDir
+			kubeletCSIDir = csiDir
+			t.Cleanup(func() { kubeletCSIDir = saved })
+
+			client := newFakeNvmeClient()
+			n := newTestNodeServer(client)
+			n.Driver.maxVolumesPerNode = 1
+
+			const stagedNqn = "nqn.2024-01.io.example:staged-0"
+			stagingDir := filepath.Join(csiDir, DefaultDriverName, "volume-0", "globalmount")
+			if test.failStage {
+				client.connectErrs = []error{fmt.Errorf("write arg failed: %w", syscall.ECONNREFUSED)}
+				if _, err := n.NodeStageVolume(context.Background(), stageRequest(stagedNqn, stagingDir)); err == nil {
+					t.Fatal("NodeStageVolume succeeded, want the connect failure")
+				}
+			} else {
+				writeStagedConnector(t, csiDir, filepath.Join(DefaultDriverName, "volume-0", "globalmount"), stagedNqn)
+			}
+			if test.unstage {
+				if _, err := n.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: stagedNqn, StagingTargetPath: stagingDir}); err != nil {
+					t.Fatalf("NodeUnstageVolume: %v", err)
+				}
+			}
+
+			connects := client.connectCount()
+			release, err := n.reserveStage(stagingVolumePath(filepath.Join(csiDir, DefaultDriverName, "volume-1", "globalmount"), testVolumeNqn))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("reserveStage code = %v, want %v: %v", got, test.want, err)
+			}
+			if err == nil {
+				release()
+				return
+			}
+
+			// The rejected stage never connects
+			_, err = n.NodeStageVolume(context.Background(), stageRequest(testVolumeNqn, filepath.Join(csiDir, DefaultDriverName, "volume-1", "globalmount")))
+			if got := status.Code(err); got != codes.ResourceExhausted {
+				t.Errorf("NodeStageVolume code = %v, want ResourceExhausted: %v", got, err)
+			}
+			if client.connectCount() != connects {
+				t.Errorf("rejected stage connected %d time(s)", client.connectCount()-connects)
+			}
+		})
+	}
+}
+
+func TestMultiWriterPublishes(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+		// republished is published again, as a repeated NodePublishVolume
+		republished string
+	}{
+		{name: "one pod", targets: []string{"pod-a"}},
+		{name: "two pods", targets: []string{"pod-a", "pod-b"}},
+		{name: "three pods, one published twice", targets: []string{"pod-a", "pod-b", "pod-c"}, republished: "pod-b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := newFakeNvmeClient()
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+			stagingDir := t.TempDir()
+			stagingPath := stagingVolumePath(stagingDir, testVolumeNqn)
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+			connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+			if _, _, err := n.connectStage(testVolumeNqn, stagingPath, connector, false, authSecrets{}); err != nil {
+				t.Fatalf("connectStage: %v", err)
+			}
+
+			// Each pod publishes the volume staged once as a writer
+			targetPaths := []string{}
+			for _, target := range test.targets {
+				targetPath := filepath.Join(t.TempDir(), target)
+				if err := os.Mkdir(targetPath, 0750); err != nil {
+					t.Fatal(err)
+				}
+				n.addPublish(stagingPath, targetPath)
+				if target == test.republished {
+					n.addPublish(stagingPath, targetPath)
+				}
+				targetPaths = append(targetPaths, targetPath)
+			}
+			if got := n.publishCount(stagingPath); got != len(test.targets) {
+				t.Fatalf("publishes = %d, want %d", got, len(test.targets))
+			}
+			if got := client.connectCount(); got != 1 {
+				t.Errorf("connects = %d, want the single stage", got)
+			}
+
+			unstage := &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeNqn, StagingTargetPath: stagingDir}
+			for i, targetPath := range targetPaths {
+				_, err := n.NodeUnstageVolume(ctx, unstage)
+				if got := status.Code(err); got != codes.FailedPrecondition {
+					t.Fatalf("NodeUnstageVolume with %d publish(es) code = %v, want FailedPrecondition", len(targetPaths)-i, got)
+				}
+				if _, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: testVolumeNqn, TargetPath: targetPath}); err != nil {
+					t.Fatalf("NodeUnpublishVolume(%s): %v", targetPath, err)
+				}
+			}
+			if client.disconnectCount() != 0 {
+				t.Fatalf("disconnects before the unstage = %d, want 0", client.disconnectCount())
+			}
+
+			if _, err := n.NodeUnstageVolume(ctx, unstage); err != nil {
+				t.Fatalf("NodeUnstageVolume after all unpublishes: %v", err)
+			}
+			if got := client.disconnectCount(); got != 1 {
+				t.Errorf("disconnects = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
+)
+
+// nodeCordon rejects new stages on a node under maintenance. Volumes already
+// staged keep their connections. The state is kept in a marker file, so that
+// it survives restarts of the plugin.
+type nodeCordon struct {
+	mtx        sync.Mutex
+	markerFile string // Empty keeps the state in memory only
+	cordoned   bool
+}
+
+// newNodeCordon returns the cordon state recorded in markerFile
+func newNodeCordon(markerFile string) *nodeCordon {
+	c := &nodeCordon{markerFile: markerFile}
+	if markerFile != "" && utils.IsFileExisting(markerFile) {
+		klog.Warningf("Node is cordoned by %s, new stages are rejected", markerFile)
+		c.cordoned = true
+	}
+
+	return c
+}
+
+func (c *nodeCordon) isCordoned() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.cordoned
+}
+
+// set cordons or uncordons the node, recording the state in the marker file first
+func (c *nodeCordon) set(cordoned bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.markerFile != "" {
+		if cordoned {
+			if err := os.MkdirAll(filepath.Dir(c.markerFile), 0755); err != nil {
+				return fmt.Errorf("failed to create directory of cordon marker %s: %v", c.markerFile, err)
+			}
+			if err := os.WriteFile(c.markerFile, nil, 0644); err != nil {
+				return fmt.Errorf("failed to write cordon marker %s: %v", c.markerFile, err)
+			}
+		} else if err := os.Remove(c.markerFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove cordon marker %s: %v", c.markerFile, err)
+		}
+	}
+	c.cordoned = cordoned
+
+	return nil
+}
+
+// drainReport is the outcome of a drain, by volume ID
+type drainReport struct {
+	Drained []string          `json:"drained"`
+	Busy    []string          `json:"busy,omitempty"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// drain cordons the node and unstages, disconnecting their controllers, the
+// volumes staged on it. Volumes whose mounts are not released yet, i.e. still
+// published to a pod, are left staged and reported busy, so that a drain can
+// be repeated once their pods are evicted.
+func (n *NodeServer) drain(ctx context.Context) (*drainReport, error) {
+	if err := n.cordon.set(true); err != nil {
+		return nil, err
+	}
+
+	files, err := stagedConnectorFiles(KUBELET_CSI_DIR)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot list staged volumes in %s: %v", KUBELET_CSI_DIR, err)
+	}
+
+	report := &drainReport{Drained: []string{}, Failed: map[string]string{}}
+	mounter := mount.New("")
+	for _, file := range files {
+		stagingPath := strings.TrimSuffix(file, ".json")
+		volumeID := filepath.Base(stagingPath)
+
+		refs, err := mounter.GetMountRefs(stagingPath)
+		if err != nil {
+			report.Failed[volumeID] = fmt.Sprintf("failed to list mounts of %s: %v", stagingPath, err)
+			continue
+		}
+		if published := n.publishCount(stagingPath); published > 0 || len(refs) > 0 {
+			klog.Infof("Drain: volume %s is still mounted at %v, keeping it staged", volumeID, refs)
+			report.Busy = append(report.Busy, volumeID)
+			continue
+		}
+
+		klog.Infof("Drain: unstaging volume %s from %s", volumeID, stagingPath)
+		_, err = n.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: filepath.Dir(stagingPath),
+		})
+		if err != nil {
+			report.Failed[volumeID] = err.Error()
+			continue
+		}
+		report.Drained = append(report.Drained, volumeID)
+	}
+
+	klog.Infof("Drain: unstaged %d volume(s), %d busy, %d failed", len(report.Drained), len(report.Busy), len(report.Failed))
+	return report, nil
+}
+
+// cordonHandler reports the cordon state on GET, cordons the node on POST and
+// uncordons it on DELETE
+func (d *driver) cordonHandler(w http.ResponseWriter, r *http.Request) {
+	if d.nodeServer == nil {
+		http.Error(w, "not running as node", http.StatusNotFound)
+		return
+	}
+
+	cordon := d.nodeServer.cordon
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if err := cordon.set(r.Method == http.MethodPost); err != nil {
+			klog.Errorf("Failed to change the cordon state: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		klog.Infof("Node %s cordoned: %t", d.nodeId, r.Method == http.MethodPost)
+	default:
+		w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodPost, http.MethodDelete}, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, map[string]bool{"cordoned": cordon.isCordoned()})
+}
+
+// drainHandler drains the node on POST. Busy volumes answer 409, failures 500.
+func (d *driver) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.nodeServer == nil {
+		http.Error(w, "not running as node", http.StatusNotFound)
+		return
+	}
+
+	report, err := d.nodeServer.drain(r.Context())
+	if err != nil {
+		klog.Errorf("Drain failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case len(report.Failed) > 0:
+		w.WriteHeader(http.StatusInternalServerError)
+	case len(report.Busy) > 0:
+		w.WriteHeader(http.StatusConflict)
+	}
+	writeJSON(w, report)
+}
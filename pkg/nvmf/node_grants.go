@@ -0,0 +1,211 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// publishContextHostNqn is the publish context key of the host NQN a node must
+// connect with, set by backends granting access per host NQN
+const publishContextHostNqn = "hostNqn"
+
+// grantNodeAccess grants nodeID access to the volume through the backend and
+// returns the publish context of the grant. A failed or timed out grant is
+// revoked, so that no partial grant is left behind, unless the volume was
+// already published to the node.
+func (c *ControllerServer) grantNodeAccess(ctx context.Context, granter NodeGranter, volumeID, nodeID string) (map[string]string, error) {
+	nqn, nsid := parseVolumeID(volumeID)
+
+	grantCtx, cancel := context.WithTimeout(ctx, c.Driver.grantTimeout)
+	defer cancel()
+
+	hostNqn, err := c.Driver.nodeHostNqn(grantCtx, nodeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to resolve the host NQN of node %s: %v", nodeID, err)
+	}
+	publishContext, err := granter.GrantNodeAccess(grantCtx, nqn, nsid, nodeID, hostNqn)
+	if err == nil {
+		if publishContext == nil {
+			publishContext = map[string]string{}
+		}
+		granted := publishContext[publishContextHostNqn]
+		if granted == "" || isValidNQN(granted) {
+			klog.Infof("Granted node %s access to volume %s", nodeID, volumeID)
+			return publishContext, nil
+		}
+		err = fmt.Errorf("backend granted invalid host NQN %s", granted)
+	}
+
+	if c.deviceRegistry.IsPublishedTo(volumeID, nodeID) {
+		klog.Errorf("Failed to grant node %s access to volume %s again, keeping the existing grant: %v", nodeID, volumeID, err)
+	} else {
+		klog.Errorf("Failed to grant node %s access to volume %s, revoking any partial grant: %v", nodeID, volumeID, err)
+		if revokeErr := c.revokeWithTimeout(granter, nqn, nsid, nodeID, hostNqn); revokeErr != nil {
+			klog.Errorf("Failed to revoke the partial grant of node %s to volume %s: %v", nodeID, volumeID, revokeErr)
+		}
+	}
+
+	if st := contextStatus(ctx.Err()); st != nil {
+		return nil, st
+	}
+	if errors.Is(grantCtx.Err(), context.DeadlineExceeded) {
+		return nil, status.Errorf(codes.DeadlineExceeded, "granting node %s access to volume %s timed out after %v", nodeID, volumeID, c.Driver.grantTimeout)
+	}
+	return nil, status.Errorf(codes.Internal, "failed to grant node %s access to volume %s: %v", nodeID, volumeID, err)
+}
+
+// revokeNodeAccess revokes the access of nodeID to the volume through the
+// backend. The backend is called even if the volume is not tracked as
+// published to the node, since the tracking does not survive restarts, and
+// revoking an access the node does not have succeeds, so a repeated unpublish
+// succeeds too. Failures return Unavailable, so that the sidecar retries
+// rather than considering the volume detached.
+func (c *ControllerServer) revokeNodeAccess(ctx context.Context, granter NodeGranter, volumeID, nodeID string) error {
+	nqn, nsid := parseVolumeID(volumeID)
+
+	revokeCtx, cancel := context.WithTimeout(ctx, c.Driver.grantTimeout)
+	defer cancel()
+
+	hostNqn, err := c.Driver.nodeHostNqn(revokeCtx, nodeID)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to resolve the host NQN of node %s: %v", nodeID, err)
+	}
+	if err := granter.RevokeNodeAccess(revokeCtx, nqn, nsid, nodeID, hostNqn); err != nil {
+		klog.Errorf("Failed to revoke the access of node %s to volume %s: %v", nodeID, volumeID, err)
+		if st := contextStatus(ctx.Err()); st != nil {
+			return st
+		}
+		if errors.Is(revokeCtx.Err(), context.DeadlineExceeded) {
+			return status.Errorf(codes.Unavailable, "revoking the access of node %s to volume %s timed out after %v", nodeID, volumeID, c.Driver.grantTimeout)
+		}
+		return status.Errorf(codes.Unavailable, "failed to revoke the access of node %s to volume %s: %v", nodeID, volumeID, err)
+	}
+
+	klog.Infof("Revoked the access of node %s to volume %s", nodeID, volumeID)
+	return nil
+}
+
+// revokeWithTimeout cleans up a failed grant. The request context may be done
+// already, so the cleanup is bounded by the grant timeout alone.
+func (c *ControllerServer) revokeWithTimeout(granter NodeGranter, nqn string, nsid uint32, nodeID, hostNqn string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Driver.grantTimeout)
+	defer cancel()
+
+	return granter.RevokeNodeAccess(ctx, nqn, nsid, nodeID, hostNqn)
+}
+
+// IsPublishedTo reports whether the volume is published to nodeID. The volume
+// ID may be of either format.
+func (r *DeviceRegistry) IsPublishedTo(volumeID, nodeID string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	device, exists := r.devices[registryVolumeID(volumeID)]
+	if !exists {
+		return false
+	}
+	_, published := device.PublishedNodes[nodeID]
+	return published
+}
+
+// publishedNodes returns the nodes the volume on the device is published to
+func (r *DeviceRegistry) publishedNodes(nqn string) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	nodeIDs := []string{}
+	if device, exists := r.devices[nqn]; exists {
+		for nodeID := range device.PublishedNodes {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	return nodeIDs
+}
+
+// ensurePublishedNodes restores the nodes the volumes are published to, unless
+// they were restored already
+func (r *DeviceRegistry) ensurePublishedNodes(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.publishedNodesRestored {
+		return nil
+	}
+	// The volumes the attachments name are only known after the initial sync
+	if !r.initialSyncDone {
+		return fmt.Errorf("initial sync is not done")
+	}
+	return r.restorePublishedNodes(ctx)
+}
+
+// restorePublishedNodes rebuilds the nodes the volumes are published to from
+// the attached VolumeAttachments of the driver, which the registry loses on
+// restart. The node names are mapped to the node IDs of the driver through the
+// CSINodes. Caller must hold the write lock.
+func (r *DeviceRegistry) restorePublishedNodes(ctx context.Context) error {
+	attachments, err := r.Driver.kubeClient.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list VolumeAttachments: %v", err)
+	}
+	csiNodes, err := r.Driver.kubeClient.StorageV1().CSINodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list CSINodes: %v", err)
+	}
+
+	nodeIDs := map[string]string{}
+	for _, csiNode := range csiNodes.Items {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == r.Driver.name {
+				nodeIDs[csiNode.Name] = driver.NodeID
+			}
+		}
+	}
+
+	restored := 0
+	for _, attachment := range attachments.Items {
+		pvName := attachment.Spec.Source.PersistentVolumeName
+		if attachment.Spec.Attacher != r.Driver.name || !attachment.Status.Attached || pvName == nil {
+			continue
+		}
+		device, exists := r.devices[r.volumeToNQN[*pvName]]
+		if !exists {
+			continue
+		}
+		nodeID, exists := nodeIDs[attachment.Spec.NodeName]
+		if !exists {
+			klog.Warningf("No node ID of driver %s is registered for node %s of VolumeAttachment %s, using the node name", r.Driver.name, attachment.Spec.NodeName, attachment.Name)
+			nodeID = attachment.Spec.NodeName
+		}
+		if device.PublishedNodes == nil {
+			device.PublishedNodes = make(map[string]struct{})
+		}
+		device.PublishedNodes[nodeID] = struct{}{}
+		restored++
+	}
+
+	r.publishedNodesRestored = true
+	registryLog.V(4).Infof("Restored %d publication(s) from VolumeAttachments", restored)
+	return nil
+}
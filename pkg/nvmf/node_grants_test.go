@@ -0,0 +1,201 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestControllerPublishGrantsAccess(t *testing.T) {
+	const grantedHostNqn = "nqn.2014-08.org.nvmexpress:uuid:6f1d9a52-0c3e-4b8f-9a27-5d4e8c1b2a30"
+	failure := errors.New("backend unreachable")
+
+	tests := []struct {
+		name string
+		// published publishes the volume to the node before the grant tested
+		published      bool
+		grantErrs      []error
+		grantHang      bool
+		revokeErrs     []error
+		publishContext map[string]string
+		want           codes.Code
+		wantContext    map[string]string
+		// wantPublished is whether the volume ends up published to the node
+		wantPublished   bool
+		wantRevocations []string
+	}{
+		{name: "granted", wantContext: map[string]string{}, wantPublished: true},
+		{
+			name: "granted with a host NQN", publishContext: map[string]string{publishContextHostNqn: grantedHostNqn},
+			wantContext: map[string]string{publishContextHostNqn: grantedHostNqn}, wantPublished: true,
+		},
+		{name: "failed", grantErrs: []error{failure}, want: codes.Internal, wantRevocations: []string{"node-1"}},
+		{name: "timed out", grantHang: true, want: codes.DeadlineExceeded, wantRevocations: []string{"node-1"}},
+		{
+			name: "invalid host NQN granted", publishContext: map[string]string{publishContextHostNqn: "host-1"},
+			want: codes.Internal, wantRevocations: []string{"node-1"},
+		},
+		{
+			name: "failed with a failed cleanup", grantErrs: []error{failure}, revokeErrs: []error{failure},
+			want: codes.Internal, wantRevocations: []string{"node-1"},
+		},
+		// The grant of a volume published already is kept when granting it
+		// again fails
+		{name: "failed again", published: true, grantErrs: []error{failure}, want: codes.Internal, wantPublished: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend(BackendCapabilityGrant)
+			c, _ := newTestControllerServer(t, backend)
+			c.Driver.grantTimeout = 50 * time.Millisecond
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			req := &csi.ControllerPublishVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId(), NodeId: "node-1"}
+			if test.published {
+				if _, err := c.ControllerPublishVolume(ctx, req); err != nil {
+					t.Fatalf("ControllerPublishVolume: %v", err)
+				}
+			}
+			backend.grantErrs = test.grantErrs
+			backend.grantHang = test.grantHang
+			backend.revokeErrs = test.revokeErrs
+			backend.publishContext = test.publishContext
+
+			published, err := c.ControllerPublishVolume(ctx, req)
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("ControllerPublishVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err == nil && !reflect.DeepEqual(published.GetPublishContext(), test.wantContext) {
+				t.Errorf("publish context = %v, want %v", published.GetPublishContext(), test.wantContext)
+			}
+			if got := c.deviceRegistry.IsPublishedTo(testVolumeNqn, "node-1"); got != test.wantPublished {
+				t.Errorf("published to node-1 = %v, want %v", got, test.wantPublished)
+			}
+			if !reflect.DeepEqual(backend.revocations, test.wantRevocations) {
+				t.Errorf("revocations = %v, want %v", backend.revocations, test.wantRevocations)
+			}
+		})
+	}
+}
+
+func TestControllerPublishCanceled(t *testing.T) {
+	backend := newFakeBackend(BackendCapabilityGrant)
+	c, _ := newTestControllerServer(t, backend)
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	resp, err := c.CreateVolume(context.Background(), createRequest("pv-1", nil))
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	// The partial grant is revoked even though the request is done
+	backend.grantHang = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId(), NodeId: "node-1"})
+	if got := status.Code(err); got != codes.DeadlineExceeded {
+		t.Errorf("ControllerPublishVolume code = %v, want DeadlineExceeded: %v", got, err)
+	}
+	if want := []string{"node-1"}; !reflect.DeepEqual(backend.revocations, want) {
+		t.Errorf("revocations = %v, want %v", backend.revocations, want)
+	}
+	if c.deviceRegistry.IsPublishedTo(testVolumeNqn, "node-1") {
+		t.Error("volume published to node-1 after a canceled grant")
+	}
+}
+
+func TestControllerUnpublishRevokesAccess(t *testing.T) {
+	transient := errors.New("backend unreachable")
+
+	tests := []struct {
+		name       string
+		published  []string
+		revokeErrs []error
+		// unpublishes are the node IDs unpublished in turn, empty for all nodes
+		unpublishes []string
+		want        []codes.Code
+		// wantPublished is the number of nodes the volume stays published to
+		wantPublished   int
+		wantRevocations int
+	}{
+		{name: "revoked", published: []string{"node-1"}, unpublishes: []string{"node-1"}, want: []codes.Code{codes.OK}, wantRevocations: 1},
+		{name: "repeated unpublish", published: []string{"node-1"}, unpublishes: []string{"node-1", "node-1"}, want: []codes.Code{codes.OK, codes.OK}, wantRevocations: 2},
+		{name: "never published", unpublishes: []string{"node-1"}, want: []codes.Code{codes.OK}, wantRevocations: 1},
+		{
+			name: "transient failure retried", published: []string{"node-1"}, revokeErrs: []error{transient},
+			unpublishes: []string{"node-1", "node-1"}, want: []codes.Code{codes.Unavailable, codes.OK}, wantRevocations: 2,
+		},
+		{
+			name: "transient failure", published: []string{"node-1", "node-2"}, revokeErrs: []error{transient},
+			unpublishes: []string{"node-1"}, want: []codes.Code{codes.Unavailable}, wantPublished: 2, wantRevocations: 1,
+		},
+		{name: "all nodes", published: []string{"node-1", "node-2"}, unpublishes: []string{""}, want: []codes.Code{codes.OK}, wantRevocations: 2},
+		{
+			name: "all nodes with a failure", published: []string{"node-1", "node-2"}, revokeErrs: []error{nil, transient},
+			unpublishes: []string{""}, want: []codes.Code{codes.Unavailable}, wantPublished: 1, wantRevocations: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend(BackendCapabilityGrant)
+			c, _ := newTestControllerServer(t, backend)
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volumeID := resp.GetVolume().GetVolumeId()
+			for _, nodeID := range test.published {
+				if _, err := c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID}); err != nil {
+					t.Fatalf("ControllerPublishVolume(%s): %v", nodeID, err)
+				}
+			}
+			backend.revokeErrs = test.revokeErrs
+
+			for i, nodeID := range test.unpublishes {
+				_, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID})
+				if got := status.Code(err); got != test.want[i] {
+					t.Errorf("ControllerUnpublishVolume %d from %q code = %v, want %v: %v", i, nodeID, got, test.want[i], err)
+				}
+			}
+
+			if got := len(c.deviceRegistry.publishedNodes(testVolumeNqn)); got != test.wantPublished {
+				t.Errorf("published to %d node(s), want %d", got, test.wantPublished)
+			}
+			if got := len(backend.revocations); got != test.wantRevocations {
+				t.Errorf("revocations = %v, want %d", backend.revocations, test.wantRevocations)
+			}
+		})
+	}
+}
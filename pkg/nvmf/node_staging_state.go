@@ -0,0 +1,197 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"k8s.io/klog/v2"
+)
+
+// stagedConnectionRecord is the persisted state of a nodeConnection. The
+// authentication secrets are not persisted.
+type stagedConnectionRecord struct {
+	Nqn          string   `json:"nqn"`
+	HostNqn      string   `json:"hostNqn"`
+	Transport    string   `json:"transport,omitempty"`
+	Endpoints    []string `json:"endpoints,omitempty"`
+	StagingPaths []string `json:"stagingPaths"`
+}
+
+// nodeStagingState is the content of the staging state file of a node
+type nodeStagingState struct {
+	Connections []stagedConnectionRecord `json:"connections"`
+}
+
+// saveStagingState writes the tracked connections to the staging state file,
+// so that the references of shared connections survive plugin restarts.
+// Caller must hold the mutex.
+func (n *NodeServer) saveStagingState() {
+	file := n.Driver.nodeStateFile
+	if file == "" {
+		return
+	}
+
+	state := nodeStagingState{Connections: []stagedConnectionRecord{}}
+	for _, conn := range n.connections {
+		record := stagedConnectionRecord{
+			Nqn:          conn.nqn,
+			HostNqn:      conn.hostNqn,
+			Transport:    conn.transport,
+			Endpoints:    conn.endpoints,
+			StagingPaths: make([]string, 0, len(conn.stagingPaths)),
+		}
+		for stagingPath := range conn.stagingPaths {
+			record.StagingPaths = append(record.StagingPaths, stagingPath)
+		}
+		sort.Strings(record.StagingPaths)
+		state.Connections = append(state.Connections, record)
+	}
+	sort.Slice(state.Connections, func(i, j int) bool {
+		return connectionKey(state.Connections[i].Nqn, state.Connections[i].HostNqn) <
+			connectionKey(state.Connections[j].Nqn, state.Connections[j].HostNqn)
+	})
+
+	if err := writeStagingState(file, &state); err != nil {
+		klog.Errorf("Failed to save the staging state, it is rebuilt from the connector files at restart: %v", err)
+	}
+}
+
+// writeStagingState writes state to file through a rename, so that a crash
+// never leaves a partial file
+func writeStagingState(file string, state *nodeStagingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode staging state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of staging state %s: %v", file, err)
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write staging state %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write staging state %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// readStagingState returns the state recorded in file, empty if there is none
+func readStagingState(file string) (*nodeStagingState, error) {
+	state := &nodeStagingState{}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staging state %s: %v", file, err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to decode staging state %s: %v", file, err)
+	}
+
+	return state, nil
+}
+
+// rehydrateConnections restores the connections tracked before a restart from
+// the staging state file, reconciled against the controllers connected on the
+// node: connections without a live controller and staging paths without a
+// connector file are dropped, and staged volumes missing from the state, e.g.
+// staged by a version without it, are added from their connector files.
+// Controllers no staged volume references are left to the orphan cleanup.
+func (n *NodeServer) rehydrateConnections() {
+	file := n.Driver.nodeStateFile
+	if file == "" {
+		return
+	}
+
+	controllers, err := n.Driver.nvme.ListSubsystems()
+	if err != nil {
+		klog.Warningf("Cannot list NVMe controllers, not restoring the staging state: %v", err)
+		return
+	}
+	isLive := func(nqn, hostNqn string) bool {
+		for _, controller := range controllers {
+			if controller.SubsysNqn == nqn && (controller.HostNqn == "" || controller.HostNqn == hostNqn) {
+				return true
+			}
+		}
+		return false
+	}
+
+	state, err := readStagingState(file)
+	if err != nil {
+		klog.Warningf("Ignoring the staging state, rebuilding it from the connector files: %v", err)
+		state = &nodeStagingState{}
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	restored, dropped := 0, 0
+	for _, record := range state.Connections {
+		if !isLive(record.Nqn, record.HostNqn) {
+			klog.Infof("Connection of %s with host NQN %s is gone, dropping its %d staging path(s)", record.Nqn, record.HostNqn, len(record.StagingPaths))
+			dropped++
+			continue
+		}
+		for _, stagingPath := range record.StagingPaths {
+			if !utils.IsFileExisting(connectorFilePath(stagingPath)) {
+				klog.Infof("Staging path %s of %s was unstaged, dropping it", stagingPath, record.Nqn)
+				continue
+			}
+			n.trackReference(record.Nqn, record.HostNqn, record.Transport, record.Endpoints, stagingPath)
+			restored++
+		}
+	}
+
+	files, err := stagedConnectorFiles(kubeletCSIDir)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Cannot list staged volumes in %s: %v", kubeletCSIDir, err)
+	}
+	for _, connectorFile := range files {
+		stagingPath := strings.TrimSuffix(connectorFile, ".json")
+		connector, err := GetConnectorFromFile(connectorFile)
+		if err != nil || connector.TargetNqn == "" {
+			continue
+		}
+		if conn, exists := n.connections[connectionKey(connector.TargetNqn, connector.HostNqn)]; exists {
+			if _, tracked := conn.stagingPaths[stagingPath]; tracked {
+				continue
+			}
+		}
+		if !isLive(connector.TargetNqn, connector.HostNqn) {
+			continue
+		}
+		klog.Infof("Staging path %s of %s is missing from the staging state, adding it", stagingPath, connector.TargetNqn)
+		n.trackReference(connector.TargetNqn, connector.HostNqn, connector.Transport, connector.TargetEndpoints, stagingPath)
+		restored++
+	}
+
+	klog.Infof("Restored %d staging reference(s) to %d connection(s), dropped %d gone connection(s)", restored, len(n.connections), dropped)
+	n.saveStagingState()
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// withStagingDir replaces the kubelet directory of the staged volumes with a
+// temporary one
+func withStagingDir(t *testing.T) string {
+	t.Helper()
+	csiDir := t.TempDir()
+	saved := kubeletCSIDir
+	kubeletCSIDir = csiDir
+	t.Cleanup(func() { kubeletCSIDir = saved })
+	return csiDir
+}
+
+// stagingTarget returns the staging target path of the PV under csiDir, created
+func stagingTarget(t *testing.T, csiDir, pv string) string {
+	t.Helper()
+	dir := filepath.Join(csiDir, DefaultDriverName, pv, "globalmount")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	return dir
+}
+
+// trackedPaths returns the staging paths tracked by each connection
+func trackedPaths(n *NodeServer) map[string][]string {
+	tracked := map[string][]string{}
+	for key, conn := range n.connections {
+		for stagingPath := range conn.stagingPaths {
+			tracked[key] = append(tracked[key], stagingPath)
+		}
+		sort.Strings(tracked[key])
+	}
+	return tracked
+}
+
+func TestRehydrateConnections(t *testing.T) {
+	const otherNqn = "nqn.2024-01.io.example:volume-2"
+
+	tests := []struct {
+		name string
+		// recorded are the staging paths, by index, recorded in the state of
+		// each NQN
+		recorded map[string][]int
+		// staged are the staging paths, by index, with a connector file, of
+		// each NQN
+		staged map[string][]int
+		// live are the NQNs connected on the node, with their host NQN
+		live map[string]string
+		// corrupt replaces the state file with garbage
+		corrupt bool
+		want    map[string][]int
+	}{
+		{
+			name:     "matching connections",
+			recorded: map[string][]int{testVolumeNqn: {0, 1}},
+			staged:   map[string][]int{testVolumeNqn: {0, 1}},
+			live:     map[string]string{testVolumeNqn: testNodeHostNqn},
+			want:     map[string][]int{testVolumeNqn: {0, 1}},
+		},
+		{
+			name:     "missing connection",
+			recorded: map[string][]int{testVolumeNqn: {0}, otherNqn: {1}},
+			staged:   map[string][]int{testVolumeNqn: {0}, otherNqn: {1}},
+			live:     map[string]string{testVolumeNqn: testNodeHostNqn},
+			want:     map[string][]int{testVolumeNqn: {0}},
+		},
+		{
+			name:     "connection of another host NQN",
+			recorded: map[string][]int{testVolumeNqn: {0}},
+			staged:   map[string][]int{testVolumeNqn: {0}},
+			live:     map[string]string{testVolumeNqn: "nqn.2014-08.org.nvmexpress:uuid:other-host"},
+			want:     map[string][]int{},
+		},
+		{
+			name:     "unstaged path",
+			recorded: map[string][]int{testVolumeNqn: {0, 1}},
+			staged:   map[string][]int{testVolumeNqn: {0}},
+			live:     map[string]string{testVolumeNqn: testNodeHostNqn},
+			want:     map[string][]int{testVolumeNqn: {0}},
+		},
+		{
+			name:     "staged path missing from the state",
+			recorded: map[string][]int{testVolumeNqn: {0}},
+			staged:   map[string][]int{testVolumeNqn: {0, 1}, otherNqn: {2}},
+			live:     map[string]string{testVolumeNqn: testNodeHostNqn, otherNqn: testNodeHostNqn},
+			want:     map[string][]int{testVolumeNqn: {0, 1}, otherNqn: {2}},
+		},
+		{
+			name:     "extra connection",
+			recorded: map[string][]int{testVolumeNqn: {0}},
+			staged:   map[string][]int{testVolumeNqn: {0}},
+			live:     map[string]string{testVolumeNqn: testNodeHostNqn, otherNqn: testNodeHostNqn},
+			want:     map[string][]int{testVolumeNqn: {0}},
+		},
+		{
+			name:    "corrupt state",
+			staged:  map[string][]int{testVolumeNqn: {0}},
+			live:    map[string]string{testVolumeNqn: testNodeHostNqn},
+			corrupt: true,
+			want:    map[string][]int{testVolumeNqn: {0}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csiDir := withStagingDir(t)
+			stateFile := filepath.Join(t.TempDir(), "staging-state.json")
+			stagingPaths := make([]string, 3)
+			for i := range stagingPaths {
+				stagingPaths[i] = stagingVolumePath(stagingTarget(t, csiDir, "pv-"+string(rune('a'+i))), testVolumeNqn)
+			}
+
+			// The state the plugin saved before its restart
+			state := &nodeStagingState{}
+			for nqn, paths := range test.recorded {
+				record := stagedConnectionRecord{Nqn: nqn, HostNqn: testNodeHostNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+				for _, i := range paths {
+					record.StagingPaths = append(record.StagingPaths, stagingPaths[i])
+				}
+				state.Connections = append(state.Connections, record)
+			}
+			if err := writeStagingState(stateFile, state); err != nil {
+				t.Fatalf("writeStagingState: %v", err)
+			}
+			if test.corrupt {
+				if err := os.WriteFile(stateFile, []byte("{"), 0600); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+			for nqn, paths := range test.staged {
+				for _, i := range paths {
+					connector := &Connector{TargetNqn: nqn, HostNqn: testNodeHostNqn, Transport: "tcp", TargetEndpoints: []string{"192.0.2.10:4420"}}
+					if err := persistConnectorFile(connector, connectorFilePath(stagingPaths[i])); err != nil {
+						t.Fatalf("persistConnectorFile: %v", err)
+					}
+				}
+			}
+			client := newFakeNvmeClient()
+			for nqn, hostNqn := range test.live {
+				client.controllers = append(client.controllers, NvmeController{Name: "nvme" + nqn, SubsysNqn: nqn, HostNqn: hostNqn, State: nvmeControllerLive})
+			}
+
+			n := newTestNodeServer(client)
+			n.Driver.nodeStateFile = stateFile
+			n.rehydrateConnections()
+
+			want := map[string][]string{}
+			for nqn, paths := range test.want {
+				for _, i := range paths {
+					want[connectionKey(nqn, testNodeHostNqn)] = append(want[connectionKey(nqn, testNodeHostNqn)], stagingPaths[i])
+				}
+				sort.Strings(want[connectionKey(nqn, testNodeHostNqn)])
+			}
+			if got := trackedPaths(n); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored connections = %v, want %v", got, want)
+			}
+
+			// The reconciled state is saved for the next restart
+			saved, err := readStagingState(stateFile)
+			if err != nil {
+				t.Fatalf("readStagingState: %v", err)
+			}
+			got := map[string][]string{}
+			for _, record := range saved.Connections {
+				got[connectionKey(record.Nqn, record.HostNqn)] = record.StagingPaths
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("saved state = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUnstageAfterRestart(t *testing.T) {
+	tests := []struct {
+		name string
+		// lost removes the state file before the restart, as after an upgrade
+		// from a version without it
+		lost bool
+	}{
+		{name: "restored from the state"},
+		{name: "rebuilt from the connector files", lost: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csiDir := withStagingDir(t)
+			client := newFakeNvmeClient()
+			withFakeNamespaces(t, client)
+			stateFile := filepath.Join(t.TempDir(), "staging-state.json")
+
+			// Two pods stage the volume before the plugin restarts
+			n := newTestNodeServer(client)
+			n.Driver.nodeStateFile = stateFile
+			dirs := []string{stagingTarget(t, csiDir, "pv-a"), stagingTarget(t, csiDir, "pv-b")}
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+			for _, dir := range dirs {
+				connector := getNvmfConnector(info, n.hostNqn, n.Driver.connectOptions())
+				stagingPath := stagingVolumePath(dir, testVolumeNqn)
+				if _, _, err := n.connectStage(testVolumeNqn, stagingPath, connector, false, authSecrets{}); err != nil {
+					t.Fatalf("stage at %s: %v", dir, err)
+				}
+				if err := persistConnectorFile(connector, connectorFilePath(stagingPath)); err != nil {
+					t.Fatalf("persistConnectorFile: %v", err)
+				}
+			}
+
+			if test.lost {
+				if err := os.Remove(stateFile); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+			}
+
+			// Only the last unstage disconnects the shared connection
+			restarted := newTestNodeServer(client)
+			restarted.Driver.nodeStateFile = stateFile
+			restarted.rehydrateConnections()
+			for step, dir := range dirs {
+				_, err := restarted.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+					VolumeId:          testVolumeNqn,
+					StagingTargetPath: dir,
+				})
+				if err != nil {
+					t.Fatalf("unstage of %s: %v", dir, err)
+				}
+				if got, want := client.disconnectCount(), step; got != want {
+					t.Errorf("disconnects after unstaging %s = %d, want %d", dir, got, want)
+				}
+			}
+		})
+	}
+}
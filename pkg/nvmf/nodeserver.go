@@ -17,7 +17,10 @@ limitations under the License.
 package nvmf
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -26,17 +29,67 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
 )
 
 type NodeServer struct {
 	Driver *driver
-	mtx    sync.Mutex // protect volumes map
+	mtx    sync.Mutex // protect connections map
+
+	// Serializes operations on the same NQN
+	nqnLocks *utils.VolumeLocks
+
+	// Connections staged on this node indexed by NQN and host NQN
+	connections map[string]*nodeConnection
+
+	// Stages in progress, counted against the volume limit until their
+	// connector file is persisted. Protected by mtx.
+	pendingStages int
+
+	// Staging path of each published target path, since a volume staged once
+	// may be published to several pods. Protected by mtx.
+	publishes map[string]string
+
+	// Size of the device of each staged volume, read from sysfs at stage.
+	// Protected by mtx.
+	deviceSizes map[string]int64
+
+	// Reconnects failed connections, nil if connection monitoring is disabled
+	monitor *connectionMonitor
+
+	// Rejects new stages while the node is under maintenance
+	cordon *nodeCordon
+
+	// Reports the condition of the volumes in NodeGetVolumeStats
+	health HealthChecker
+
+	// hostNqn is the default host NQN of the node, empty if unknown
+	hostNqn string
 }
 
 func NewNodeServer(d *driver) *NodeServer {
-	return &NodeServer{
-		Driver: d,
+	n := &NodeServer{
+		Driver:      d,
+		nqnLocks:    utils.NewVolumeLocks(),
+		connections: make(map[string]*nodeConnection),
+		publishes:   make(map[string]string),
+		deviceSizes: make(map[string]int64),
+		cordon:      newNodeCordon(d.cordonFile),
+		health:      d.newHealthChecker(&sysfsHealthChecker{client: d.nvme}),
+	}
+	// Volumes without a pinned host NQN connect with the host NQN of the node
+	hostNqn, err := loadHostNqn(d.hostNqnFile, d.hostNqnGeneration, d.nodeId)
+	if err != nil {
+		klog.Errorf("Failed to set up the host NQN of node %s: %v", d.nodeId, err)
+	}
+	n.hostNqn = hostNqn
+	n.rehydrateConnections()
+	if d.connectionMonitorInterval > 0 {
+		n.monitor = newConnectionMonitor(n, d.connectionMonitorInterval)
+		go n.monitor.run()
 	}
+
+	return n
 }
 
 func (n *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -57,11 +110,44 @@ func (n *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
 func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	// Ephemeral inline volumes are not staged by the kubelet
+	if isEphemeralRequest(req.GetVolumeContext()) {
+		return n.publishEphemeral(ctx, req)
+	}
+
 	// 1. check parameters
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume missing Volume Capability in req.")
@@ -78,22 +164,47 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	if len(req.GetStagingTargetPath()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
 	}
-	n.mtx.Lock()
-	defer n.mtx.Unlock()
+	nqn, _ := parseVolumeID(req.GetVolumeId())
+	n.nqnLocks.Acquire(volumeLockKey(req.GetVolumeId()))
+	defer n.nqnLocks.Release(volumeLockKey(req.GetVolumeId()))
 
 	klog.V(4).Infof("NodePublishVolume called for volume %s", req.VolumeId)
 
 	// 2. mountdisk
 	// Create mounter for the volume to be published
-	parameter := req.GetVolumeContext()
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
-	stagingPath := req.GetStagingTargetPath() + "/" + volumeID
-	nvmfInfo, err := getNVMfDiskInfo(volumeID, parameter)
+	stagingPath := stagingVolumePath(req.GetStagingTargetPath(), volumeID)
+	volumeContext, err := n.Driver.openVolumeContext(ctx, volumeID, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodePublishVolume: %v", err)
+	}
+	params, err := n.Driver.parseVolumeParams(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	nvmfInfo, err := getNVMfDiskInfo(volumeID, params)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "NodePublishVolume: get NVMf disk info from req err: %v", err)
 	}
-	diskMounter := getNVMfDiskMounter(nvmfInfo, targetPath, req.GetVolumeCapability())
+	diskMounter := getNVMfDiskMounter(nvmfInfo, targetPath, n.hostNqn, req.GetVolumeCapability(), n.Driver.requestConnectOptions(ctx))
+	diskMounter.bind = true
+	if err := diskMounter.applyMountPropagation(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume %v", err)
+	}
+
+	// Publish secrets rotated since the stage replace the secrets of the connection
+	if err := n.applyPublishSecrets(nqn, stagingPath, req.GetSecrets()); err != nil {
+		klog.Errorf("NodePublishVolume: failed to apply the publish secrets of volume %s: %v", volumeID, err)
+		return nil, status.Errorf(codes.Unavailable, "NodePublishVolume: failed to apply publish secrets: %v", err)
+	}
+
+	// A readonly publish is honored regardless of the volume access mode.
+	// For block volumes the "ro" option makes the bind mount read-only.
+	if req.GetReadonly() {
+		klog.V(4).Infof("NodePublishVolume: publishing volume %s readonly", volumeID)
+		diskMounter.mountOptions = append(diskMounter.mountOptions, "ro")
+	}
 
 	// Mount to the docker path from the staging path
 	err = MountVolume(stagingPath, diskMounter)
@@ -102,6 +213,21 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return nil, status.Errorf(codes.Unavailable, "NodePublishVolume: failed to mount volume: %v", err)
 	}
 
+	// With VOLUME_MOUNT_GROUP the kubelet leaves the fsGroup ownership to the driver.
+	// It is applied through the staging mount, which stays writable for readonly publishes.
+	if group := req.GetVolumeCapability().GetMount().GetVolumeMountGroup(); group != "" && !diskMounter.isBlock {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: invalid volume mount group %q", group)
+		}
+		err = setVolumeOwnership(stagingPath, gid, params.FsGroupChangePolicy, req.GetReadonly())
+		if err != nil {
+			klog.Errorf("NodePublishVolume: failed to apply group %d to volume %s: %v", gid, volumeID, err)
+			return nil, status.Errorf(codes.Internal, "NodePublishVolume: failed to apply volume mount group: %v", err)
+		}
+	}
+	n.addPublish(stagingPath, targetPath)
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -113,9 +239,20 @@ func (n *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Staging TargetPath must be provided")
 	}
 
-	// Acquire lock to prevent concurrent operations on this server
-	n.mtx.Lock()
-	defer n.mtx.Unlock()
+	// The claim of an ephemeral volume holds the device to release
+	if n.Driver.ephemeralVolumes && isValidEphemeralID(req.VolumeId) {
+		claim, err := loadEphemeralClaim(n.Driver.ephemeralClaimPath(req.VolumeId))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read the claim of ephemeral volume %s: %v", req.VolumeId, err)
+		}
+		if claim != nil {
+			return n.unpublishEphemeral(ctx, req, claim)
+		}
+	}
+
+	// Acquire lock to prevent concurrent operations on this volume
+	n.nqnLocks.Acquire(volumeLockKey(req.VolumeId))
+	defer n.nqnLocks.Release(volumeLockKey(req.VolumeId))
 
 	klog.V(4).Infof("NodeUnpublishVolume called for volume %s", req.VolumeId)
 
@@ -127,6 +264,13 @@ func (n *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Errorf(codes.Unavailable, "NodeUnpublishVolume: failed to unmount volume. VolumeID: %s detachDisk err: %v", req.VolumeId, err)
 	}
 
+	// Remove the mount point created at publish, a directory for filesystem
+	// volumes or an empty file for block volumes. The connection is left to unstage.
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("NodeUnpublishVolume: failed to remove target path %s: %v", targetPath, err)
+	}
+	n.removePublish(targetPath)
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -136,6 +280,9 @@ func (n *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 	if volumeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume ID must be required")
 	}
+	if !isValidVolumeNQN(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume Volume ID %s is not a valid NQN", volumeID)
+	}
 
 	// Check for supported volume capabilities
 	if req.GetVolumeCapability() == nil {
@@ -147,57 +294,143 @@ func (n *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging target path is required")
 	}
 
-	n.mtx.Lock()
-	defer n.mtx.Unlock()
+	volumeContext, err := n.Driver.openVolumeContext(ctx, volumeID, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "NodeStageVolume: %v", err)
+	}
+	params, err := n.Driver.parseVolumeParams(volumeContext)
+	if err != nil {
+		klog.Errorf("NodeStageVolume: invalid volume context: %v", err)
+		return nil, err
+	}
+
+	// Namespaces of the same NQN are staged in parallel, only connecting the
+	// NQN is serialized, see connectStage
+	n.nqnLocks.Acquire(volumeLockKey(volumeID))
+	defer n.nqnLocks.Release(volumeLockKey(volumeID))
 
 	klog.V(4).Infof("NodeStageVolume called for volume %s", volumeID)
 
-	deviceName, err := GetDeviceNameByVolumeID(volumeID)
-	if err == nil && deviceName != "" {
-		klog.V(4).Infof("NodeStageVolume: Device %s already exists", deviceName)
-		return &csi.NodeStageVolumeResponse{}, nil
+	// Each volume gets its own staging entry, see stagingVolumePath
+	stagingPath := stagingVolumePath(req.GetStagingTargetPath(), volumeID)
+
+	// A cordoned node still accepts restaging a staged path
+	if n.cordon.isCordoned() && !utils.IsFileExisting(connectorFilePath(stagingPath)) {
+		return nil, status.Errorf(codes.Unavailable, "node %s is cordoned for maintenance", n.Driver.nodeId)
 	}
 
+	release, err := n.reserveStage(stagingPath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// A failed stage leaves no partial staging entry behind
+	created := !stagingPathExists(stagingPath)
+	staged := false
+	defer func() {
+		if !staged {
+			cleanupFailedStage(stagingPath, created)
+		}
+	}()
+
 	// Create Connector and mounter for the volume to be staged
-	nvmfInfo, err := getNVMfDiskInfo(volumeID, req.GetVolumeContext())
+	nvmfInfo, err := getNVMfDiskInfo(volumeID, params)
 	if err != nil {
 		klog.Errorf("NodeStageVolume: failed to get NVMf disk info: %v", err)
 		return nil, status.Errorf(codes.Internal, "failed to get NVMf disk info: %v", err)
 	}
+	nvmfInfo.ConnectArgs = withNodeIoQueues(nvmfInfo.ConnectArgs, n.Driver.maxIoQueues)
 
-	// stagingPath is appended with volumeID to avoid conflicts
-	// This is necessary to properly handle different volume modes:
-	// - In filesystem mode: need a dedicated directory for mounting
-	// - In block mode: need a specific path for the block device file
-	stagingPath := req.GetStagingTargetPath() + "/" + volumeID
-	diskMounter := getNVMfDiskMounter(nvmfInfo, stagingPath, req.GetVolumeCapability())
+	// A backend granting access per host NQN decides the host NQN to connect with
+	if hostNqn := req.GetPublishContext()[publishContextHostNqn]; hostNqn != "" {
+		if !isValidNQN(hostNqn) {
+			return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume published host NQN %s is not a valid NQN", hostNqn)
+		}
+		if nvmfInfo.HostNqn != "" && nvmfInfo.HostNqn != hostNqn {
+			klog.V(4).Infof("NodeStageVolume: connecting with granted host NQN %s instead of %s", hostNqn, nvmfInfo.HostNqn)
+		}
+		nvmfInfo.HostNqn = hostNqn
+	}
+
+	diskMounter := getNVMfDiskMounter(nvmfInfo, stagingPath, n.hostNqn, req.GetVolumeCapability(), n.Driver.requestConnectOptions(ctx))
+	// The propagation applies to the publish bind mounts only
+	if err := diskMounter.applyMountPropagation(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume %v", err)
+	}
+	diskMounter.propagation = ""
+	if !diskMounter.isBlock && !isSupportedFsType(diskMounter.fsType) {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume unsupported fsType: %s", diskMounter.fsType)
+	}
+	diskMounter.fsck = n.Driver.checksFilesystemAtStage(params, req.GetVolumeCapability())
 
-	// Attach the NVMe disk
-	devicePath, err := AttachDisk(volumeID, diskMounter.connector)
+	// Attach the NVMe disk, reusing the connection of another staging path if there is one
+	_, connectSpan := startSpan(ctx, "connect", "nvmf.nqn", nvmfInfo.Nqn, "nvmf.transport", nvmfInfo.Transport)
+	devicePath, releaseConnection, err := n.connectStage(volumeID, stagingPath, diskMounter.connector, nvmfInfo.HostNqn != "", authSecretsFrom(req.GetSecrets()))
+	connectSpan.end(err)
 	if err != nil {
 		klog.Errorf("NodeStageVolume: failed to attach volume %s: %v", volumeID, err)
+		if _, ok := err.(*TimeoutError); ok {
+			return nil, status.Errorf(codes.DeadlineExceeded, "failed to attach volume %s: %v", volumeID, err)
+		}
+		if errors.Is(err, ErrDeviceNodeMissing) {
+			return nil, status.Errorf(codes.Internal, "failed to attach volume %s: %v", volumeID, err)
+		}
 		return nil, status.Errorf(codes.Unavailable, "failed to attach volume %s: %v", volumeID, err)
 	}
 
+	// A raw block volume exposes the namespace device itself rather than its by-id link
+	if diskMounter.isBlock {
+		if resolved, err := filepath.EvalSymlinks(devicePath); err == nil {
+			devicePath = resolved
+		} else {
+			klog.Warningf("NodeStageVolume: failed to resolve block device %s, using it as is: %v", devicePath, err)
+		}
+	}
+
+	// The device numbering may shift on failover, never format or mount another namespace
+	if err := verifyNamespaceIdentity(devicePath, nvmfInfo.Nqn, nvmfInfo.Nsid); err != nil {
+		klog.Errorf("NodeStageVolume: refusing to mount device %s for volume %s: %v", devicePath, volumeID, err)
+		releaseConnection()
+		if errors.Is(err, ErrWrongDevice) {
+			return nil, status.Errorf(codes.Internal, "wrong device for volume %s: %v", volumeID, err)
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to verify the device of volume %s: %v", volumeID, err)
+	}
+
+	// Never mount a volume on a device smaller than it claims, its filesystem would extend past the device
+	if size, err := stagedDeviceSize(devicePath); err != nil {
+		klog.Warningf("NodeStageVolume: cannot read the size of device %s to verify the capacity of volume %s: %v", devicePath, volumeID, err)
+	} else if err := checkCapacityMatch(volumeID, recordedVolumeBytes(volumeContext), size); err != nil {
+		releaseConnection()
+		return nil, status.Errorf(codes.FailedPrecondition, "refusing to stage volume %s: %v", volumeID, err)
+	}
+
 	// Mount the volume
 	klog.V(4).Infof("NodeStageVolume: mounting device %s at %s", devicePath, stagingPath)
+	mountCtx, mountSpan := startSpan(ctx, "mount", "mount.device", devicePath)
+	diskMounter.traceCtx = mountCtx
 	err = MountVolume(devicePath, diskMounter)
+	mountSpan.end(err)
 	if err != nil {
 		klog.Errorf("NodeStageVolume: failed to mount volume %s: %v", volumeID, err)
-		diskMounter.connector.Disconnect()
-		return nil, status.Errorf(codes.Unavailable, "failed to mount volume: %v", err)
+		releaseConnection()
+		return nil, mountFailureStatus(volumeID, devicePath, volumeContext, err)
 	}
 
 	// Persist connector information for detachment
-	err = persistConnectorFile(diskMounter.connector, stagingPath+".json")
+	err = persistConnectorFile(diskMounter.connector, connectorFilePath(stagingPath))
 	if err != nil {
 		klog.Errorf("NodeStageVolume: failed to persist connection info: %v", err)
 		klog.Errorf("NodeStageVolume: disconnecting volume because persistence file is required for unstage")
 		UnmountVolume(stagingPath, getNVMfDiskUnMounter())
-		diskMounter.connector.Disconnect()
+		releaseConnection()
 		return nil, status.Errorf(codes.Unavailable, "failed to persist connection info: %v", err)
 	}
 
+	staged = true
+	n.recordDeviceSize(volumeID, devicePath)
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -208,35 +441,68 @@ func (n *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 	if volumeID == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Volume ID must be provided")
 	}
+	if !isValidVolumeNQN(volumeID) {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeUnstageVolume Volume ID %s is not a valid NQN", volumeID)
+	}
 	if req.GetStagingTargetPath() == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging target path must be provided")
 	}
 
-	// Acquire lock to prevent concurrent operations on this server
-	n.mtx.Lock()
-	defer n.mtx.Unlock()
+	// Namespaces of the same NQN are unmounted in parallel, only releasing the
+	// connection of the NQN is serialized
+	targetNqn, _ := parseVolumeID(volumeID)
+	n.nqnLocks.Acquire(volumeLockKey(volumeID))
+	defer n.nqnLocks.Release(volumeLockKey(volumeID))
 
 	klog.V(4).Infof("NodeUnstageVolume called for volume %s", req.VolumeId)
 
-	// Unmount the volume
-	// Staging path is appended with volumeID.
-	// This was defined in NodeStageVolume to avoid conflicts.
-	stagingPath := req.GetStagingTargetPath() + "/" + volumeID
+	// Unmount the volume and remove its staging entry
+	stagingPath := stagingVolumePath(req.GetStagingTargetPath(), volumeID)
+	if published := n.publishCount(stagingPath); published > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still published at %d target path(s)", volumeID, published)
+	}
 	unmounter := getNVMfDiskUnMounter()
 	err := UnmountVolume(stagingPath, unmounter)
 	if err != nil {
 		klog.Errorf("NodeUnstageVolume: failed to unmount volume %s: %v", volumeID, err)
 		return nil, status.Errorf(codes.Internal, "failed to unmount volume: %v", err)
 	}
+	removeStagingPath(stagingPath)
+	n.forgetDeviceSize(volumeID)
 
 	// Detach the volume
-	// NQN is used as the volume ID
-	// This assumption is valid because in CreateVolume, we assigned the device's NQN
-	// as the volumeID when returning the CreateVolumeResponse.
-	targetNqn := volumeID
-	err = DetachDisk(targetNqn, stagingPath)
+	// The volume ID is the device's NQN, followed by the NSID for namespaces of
+	// shared subsystems, as assigned in the CreateVolumeResponse. The controllers
+	// of the NQN are shared by all its namespaces staged on this node.
+	n.nqnLocks.Acquire(connectionLockKey(targetNqn))
+	defer n.nqnLocks.Release(connectionLockKey(targetNqn))
+	remaining, hostNqn, err := n.removeReference(targetNqn, stagingPath)
+	if err != nil {
+		// Not staged since the plugin started, use the host NQN recorded at stage time
+		hostNqn = connectHostNqn("", n.hostNqn, stagingPath)
+		if connector, err := GetConnectorFromFile(connectorFilePath(stagingPath)); err == nil && connector.HostNqn != "" {
+			hostNqn = connector.HostNqn
+		}
+
+		// A repeated unstage finds the connection already gone
+		if !hasTrackingFile(targetNqn, hostNqn) {
+			klog.Warningf("NodeUnstageVolume: no active connection of %s for volume %s. Assuming already unstaged. Returning success as per idempotency.", targetNqn, volumeID)
+			removeConnectorFile(stagingPath)
+			return &csi.NodeUnstageVolumeResponse{}, nil
+		}
+	}
+	if remaining > 0 {
+		klog.V(4).Infof("NodeUnstageVolume: connection of %s is still used by %d staging path(s), keeping it", targetNqn, remaining)
+		removeConnectorFile(stagingPath)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	err = DetachDisk(n.Driver.nvme, targetNqn, hostNqn, n.Driver.nvmeCliTimeout)
 	if err != nil {
 		klog.Errorf("NodeUnstageVolume: failed to detach volume %s: %v", volumeID, err)
+		if _, ok := err.(*TimeoutError); ok {
+			return nil, status.Errorf(codes.DeadlineExceeded, "failed to detach volume: %v", err)
+		}
 		return nil, status.Errorf(codes.Internal, "failed to detach volume: %v", err)
 	}
 
@@ -269,15 +535,86 @@ func (n *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume: rescan path %s not exist", scanPath)
 	}
 
-	return &csi.NodeExpandVolumeResponse{}, nil
+	// Report the size the device has after the rescan
+	size, err := readSysfsSize(deviceName)
+	if err != nil {
+		klog.Warningf("NodeExpandVolume: cannot read the size of %s after rescan: %v", deviceName, err)
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+	// Only a device smaller than the size recorded at stage has shrunk, e.g. by
+	// an out-of-band replacement. One that merely lags the request is reported
+	// with the size it has, for the resizer to retry.
+	recorded, _ := n.deviceSize(req.VolumeId)
+	if err := checkCapacityMatch(req.VolumeId, recorded, size); err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "cannot expand volume %s: %v", req.VolumeId, err)
+	}
+	n.updateDeviceSize(req.VolumeId, size)
+	if required := req.GetCapacityRange().GetRequiredBytes(); size < required {
+		klog.Warningf("NodeExpandVolume: device %s of volume %s has %d bytes after rescan, less than the %d requested", deviceName, req.VolumeId, size, required)
+	}
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
 
+// NodeGetInfo reports the node. The host NQN is published at registration, so
+// that a failure to publish it is retried by the kubelet.
 func (n *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	if n.Driver.publishHostNqn && n.hostNqn != "" {
+		if err := n.publishHostNqn(ctx); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to publish host NQN %s of node %s: %v", n.hostNqn, n.Driver.nodeId, err)
+		}
+		klog.V(4).Infof("Published host NQN %s of node %s", n.hostNqn, n.Driver.nodeId)
+	}
+
 	return &csi.NodeGetInfoResponse{
-		NodeId: n.Driver.nodeId,
+		NodeId:            n.Driver.nodeId,
+		MaxVolumesPerNode: n.Driver.maxVolumesPerNode,
 	}, nil
 }
 
+// NodeGetVolumeStats reports usage of a published volume and the health of its NVMe-oF connection
 func (n *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "NodeGetVolumeStats not implement")
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume ID must be provided")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume path must be provided")
+	}
+
+	klog.V(4).Infof("NodeGetVolumeStats called for volume %s at %s", volumeID, volumePath)
+
+	notMounted, err := mount.New("").IsLikelyNotMountPoint(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to check mount point %s: %v", volumePath, err)
+	}
+	if notMounted {
+		return nil, status.Errorf(codes.NotFound, "volume path %s is not mounted", volumePath)
+	}
+
+	usage, cached := n.blockVolumeUsage(volumeID, volumePath)
+	if !cached {
+		usage, err = getVolumeUsage(volumePath)
+	}
+	if err != nil {
+		klog.Errorf("NodeGetVolumeStats: failed to get usage of %s: %v", volumePath, err)
+		return nil, status.Errorf(codes.Internal, "failed to get usage of %s: %v", volumePath, err)
+	}
+
+	condition := n.health.VolumeCondition(ctx, volumeID)
+	if n.monitor != nil {
+		nqn, _ := parseVolumeID(volumeID)
+		if message, unhealthy := n.monitor.condition(nqn); unhealthy {
+			condition = &csi.VolumeCondition{Abnormal: true, Message: message}
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: condition,
+	}, nil
 }
@@ -0,0 +1,491 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+)
+
+const (
+	testNodeHostNqn = "nqn.2014-08.org.nvmexpress:uuid:2b6c6f7e-8b52-4b3a-9d7e-3f1c2a4b5c6d"
+	testVolumeNqn   = "nqn.2024-01.io.example:volume-1"
+)
+
+// newTestNodeServer returns a node server of node-1 connecting through client
+func newTestNodeServer(client NvmeClient) *NodeServer {
+	d := &driver{
+		name:           DefaultDriverName,
+		nodeId:         "node-1",
+		nvme:           client,
+		nvmeCliTimeout: time.Second,
+	}
+	return &NodeServer{
+		Driver:      d,
+		nqnLocks:    utils.NewVolumeLocks(),
+		connections: make(map[string]*nodeConnection),
+		publishes:   make(map[string]string),
+		deviceSizes: make(map[string]int64),
+		cordon:      newNodeCordon(""),
+		hostNqn:     testNodeHostNqn,
+	}
+}
+
+// withFakeMounter makes the node server mount through a fake mounter, whose
+// commands are run by the actions in turn, and returns the mounter
+func withFakeMounter(t *testing.T, actions ...testingexec.FakeCommandAction) *mount.FakeMounter {
+	t.Helper()
+	mounter := mount.NewFakeMounter(nil)
+	executor := &testingexec.FakeExec{CommandScript: actions, ExactOrder: true}
+	saved := newDiskMounter
+	newDiskMounter = func() (mount.Interface, exec.Interface) { return mounter, executor }
+	t.Cleanup(func() {
+		newDiskMounter = saved
+		if executor.CommandCalls != len(actions) {
+			t.Errorf("commands run = %d, want %d", executor.CommandCalls, len(actions))
+		}
+	})
+	return mounter
+}
+
+// withFakeNamespaceDevice makes the namespaces connected through client the
+// block device of a namespace of testVolumeNqn, of size bytes, and returns its
+// device path
+func withFakeNamespaceDevice(t *testing.T, client *fakeNvmeClient, size int64) string {
+	t.Helper()
+	devicePath := withFakeBlockDevice(t, map[string]string{
+		"device/subsysnqn": testVolumeNqn,
+		"nsid":             "1",
+		"size":             strconv.FormatInt(size/sysfsSectorSize, 10),
+	})
+	withFakeSubsystemUUID(t, map[string]string{testVolumeNqn: ""})
+	client.devicePath = devicePath
+	return devicePath
+}
+
+// stageRequest returns a NodeStageVolume request of a mount volume staged under dir
+func stageRequest(volumeID, dir string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: dir,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			paramType:     "tcp",
+			paramEndpoint: "192.0.2.10:4420",
+		},
+	}
+}
+
+func TestNodeStageVolumeConnectFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		connectErr error
+		want       codes.Code
+	}{
+		{name: "connect timed out", connectErr: &TimeoutError{Operation: "nvme connect", Timeout: time.Second}, want: codes.DeadlineExceeded},
+		{name: "device node never appeared", connectErr: fmt.Errorf("%w: namespace 0 of %s after 1s", ErrDeviceNodeMissing, testVolumeNqn), want: codes.Internal},
+		{name: "target refused the connection", connectErr: fmt.Errorf("write arg failed: %w", syscall.ECONNREFUSED), want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			client.connectErrs = []error{test.connectErr}
+			n := newTestNodeServer(client)
+			dir := t.TempDir()
+
+			_, err := n.NodeStageVolume(context.Background(), stageRequest(testVolumeNqn, dir))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("NodeStageVolume code = %v, want %v: %v", got, test.want, err)
+			}
+
+			if client.connectCount() != 1 {
+				t.Errorf("connects = %d, want 1", client.connectCount())
+			}
+			if hostNqn := client.connects[0].HostNqn; hostNqn != testNodeHostNqn {
+				t.Errorf("connected with host NQN %q, want the node's %q", hostNqn, testNodeHostNqn)
+			}
+			if _, err := os.Stat(filepath.Join(dir, testVolumeNqn)); !os.IsNotExist(err) {
+				t.Errorf("failed stage left its staging entry behind: %v", err)
+			}
+			if len(n.connections) != 0 {
+				t.Errorf("failed stage left %d connection reference(s)", len(n.connections))
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*csi.NodeStageVolumeRequest)
+	}{
+		{name: "missing volume ID", modify: func(req *csi.NodeStageVolumeRequest) { req.VolumeId = "" }},
+		{name: "malformed NQN", modify: func(req *csi.NodeStageVolumeRequest) { req.VolumeId = "not-an-nqn" }},
+		{name: "missing capability", modify: func(req *csi.NodeStageVolumeRequest) { req.VolumeCapability = nil }},
+		{name: "missing staging path", modify: func(req *csi.NodeStageVolumeRequest) { req.StagingTargetPath = "" }},
+		{name: "invalid published host NQN", modify: func(req *csi.NodeStageVolumeRequest) {
+			req.PublishContext = map[string]string{publishContextHostNqn: "host-1"}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			n := newTestNodeServer(client)
+			req := stageRequest(testVolumeNqn, t.TempDir())
+			test.modify(req)
+
+			_, err := n.NodeStageVolume(context.Background(), req)
+			if got := status.Code(err); got != codes.InvalidArgument {
+				t.Fatalf("NodeStageVolume code = %v, want InvalidArgument: %v", got, err)
+			}
+			if client.connectCount() != 0 {
+				t.Errorf("invalid request connected %d time(s)", client.connectCount())
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumeReadonly(t *testing.T) {
+	tests := []struct {
+		name       string
+		capability *csi.VolumeCapability
+		readonly   bool
+		want       []string
+	}{
+		{name: "filesystem", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "noatime"), want: []string{"noatime", "bind"}},
+		{name: "readonly filesystem", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "noatime"), readonly: true, want: []string{"noatime", "ro", "bind"}},
+		{name: "readonly filesystem of a writer access mode", capability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER), readonly: true, want: []string{"ro", "bind"}},
+		{name: "block volume", capability: blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), want: []string{"bind"}},
+		{name: "readonly block volume", capability: blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), readonly: true, want: []string{"ro", "bind"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mounter := withFakeMounter(t)
+			n := newTestNodeServer(newFakeNvmeClient())
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			targetPath := filepath.Join(t.TempDir(), "pod-a")
+
+			_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          testVolumeNqn,
+				StagingTargetPath: stage.StagingTargetPath,
+				TargetPath:        targetPath,
+				VolumeCapability:  test.capability,
+				VolumeContext:     stage.VolumeContext,
+				Readonly:          test.readonly,
+			})
+			if err != nil {
+				t.Fatalf("NodePublishVolume: %v", err)
+			}
+
+			// The staged volume is bind mounted at the target path, read-only
+			// if the publish is
+			mounts, _ := mounter.List()
+			if len(mounts) != 1 {
+				t.Fatalf("mounts = %v, want the bind mount of the staged volume", mounts)
+			}
+			if want := stagingVolumePath(stage.StagingTargetPath, testVolumeNqn); mounts[0].Device != want || mounts[0].Path != targetPath {
+				t.Errorf("mounted %s at %s, want %s at %s", mounts[0].Device, mounts[0].Path, want, targetPath)
+			}
+			if !reflect.DeepEqual(mounts[0].Opts, test.want) {
+				t.Errorf("bind mount options = %v, want %v", mounts[0].Opts, test.want)
+			}
+		})
+	}
+}
+
+func TestBlockVolumeLifecycle(t *testing.T) {
+	tests := []struct {
+		name     string
+		readonly bool
+		// republish publishes the volume again, as a retried NodePublishVolume
+		republish bool
+	}{
+		{name: "writable"},
+		{name: "readonly", readonly: true},
+		{name: "published twice", republish: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			// Block volumes are neither formatted nor checked, so no command runs
+			mounter := withFakeMounter(t)
+			client := newFakeNvmeClient()
+			devicePath := withFakeNamespaceDevice(t, client, 1<<30)
+			n := newTestNodeServer(client)
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			stage.VolumeCapability = blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			stagingPath := stagingVolumePath(stage.StagingTargetPath, testVolumeNqn)
+			targetPath := filepath.Join(t.TempDir(), "pod-a")
+
+			// wantMounts checks the devices mounted, by mount path, and returns
+			// the options of the mounts
+			wantMounts := func(step string, want map[string]string) map[string][]string {
+				t.Helper()
+				mounts, _ := mounter.List()
+				got, options := map[string]string{}, map[string][]string{}
+				for _, mp := range mounts {
+					got[mp.Path], options[mp.Path] = mp.Device, mp.Opts
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("mounts %s = %v, want %v", step, got, want)
+				}
+				return options
+			}
+
+			// The stage bind mounts the namespace device at a file of the staging path
+			if _, err := n.NodeStageVolume(ctx, stage); err != nil {
+				t.Fatalf("NodeStageVolume: %v", err)
+			}
+			options := wantMounts("once staged", map[string]string{stagingPath: devicePath})
+			if want := []string{"bind"}; !reflect.DeepEqual(options[stagingPath], want) {
+				t.Errorf("stage mount options = %v, want %v", options[stagingPath], want)
+			}
+			if info, err := os.Stat(stagingPath); err != nil || info.IsDir() {
+				t.Errorf("staging path %s = %v, want a file", stagingPath, err)
+			}
+			if _, err := os.Stat(connectorFilePath(stagingPath)); err != nil {
+				t.Errorf("connector file of the stage: %v", err)
+			}
+
+			// The publish bind mounts the staged file, thus the device, at the
+			// target path
+			publish := &csi.NodePublishVolumeRequest{
+				VolumeId:          testVolumeNqn,
+				StagingTargetPath: stage.StagingTargetPath,
+				TargetPath:        targetPath,
+				VolumeCapability:  stage.VolumeCapability,
+				VolumeContext:     stage.VolumeContext,
+				Readonly:          test.readonly,
+			}
+			publishes := 1
+			if test.republish {
+				publishes = 2
+			}
+			for i := 0; i < publishes; i++ {
+				if _, err := n.NodePublishVolume(ctx, publish); err != nil {
+					t.Fatalf("NodePublishVolume: %v", err)
+				}
+			}
+			options = wantMounts("once published", map[string]string{stagingPath: devicePath, targetPath: devicePath})
+			want := []string{"bind"}
+			if test.readonly {
+				want = []string{"ro", "bind"}
+			}
+			if !reflect.DeepEqual(options[targetPath], want) {
+				t.Errorf("publish mount options = %v, want %v", options[targetPath], want)
+			}
+			if info, err := os.Stat(targetPath); err != nil || info.IsDir() {
+				t.Errorf("target path %s = %v, want a file", targetPath, err)
+			}
+
+			// The volume is not unstaged while published
+			unstage := &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeNqn, StagingTargetPath: stage.StagingTargetPath}
+			if _, err := n.NodeUnstageVolume(ctx, unstage); status.Code(err) != codes.FailedPrecondition {
+				t.Errorf("NodeUnstageVolume while published code = %v, want FailedPrecondition: %v", status.Code(err), err)
+			}
+
+			// The unpublish removes the bind mount and its file, keeping the stage
+			if _, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: testVolumeNqn, TargetPath: targetPath}); err != nil {
+				t.Fatalf("NodeUnpublishVolume: %v", err)
+			}
+			wantMounts("once unpublished", map[string]string{stagingPath: devicePath})
+			if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+				t.Errorf("target path left behind: %v", err)
+			}
+			if client.disconnectCount() != 0 {
+				t.Errorf("unpublish disconnected %d time(s)", client.disconnectCount())
+			}
+
+			// The unstage unmounts the device and disconnects its subsystem
+			if _, err := n.NodeUnstageVolume(ctx, unstage); err != nil {
+				t.Fatalf("NodeUnstageVolume: %v", err)
+			}
+			wantMounts("once unstaged", map[string]string{})
+			for _, path := range []string{stagingPath, connectorFilePath(stagingPath)} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s left behind: %v", path, err)
+				}
+			}
+			if client.connectCount() != 1 || client.disconnectCount() != 1 {
+				t.Errorf("connects = %d, disconnects = %d, want 1 each", client.connectCount(), client.disconnectCount())
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		// capabilityFsType and contextFsType are the fsType of the volume
+		// capability and of the StorageClass
+		capabilityFsType string
+		contextFsType    string
+		// existing is the filesystem already on the device, none if empty
+		existing string
+		// wantMkfs is the mkfs command run, none if empty
+		wantMkfs string
+		wantType string
+		wantErr  bool
+	}{
+		{name: "default", wantMkfs: "mkfs.ext4 -F", wantType: "ext4"},
+		{name: "ext4", capabilityFsType: "ext4", wantMkfs: "mkfs.ext4 -F", wantType: "ext4"},
+		{name: "xfs", capabilityFsType: "xfs", wantMkfs: "mkfs.xfs", wantType: "xfs"},
+		{name: "btrfs", capabilityFsType: "btrfs", wantMkfs: "mkfs.btrfs", wantType: "btrfs"},
+		{name: "StorageClass fsType", contextFsType: "xfs", wantMkfs: "mkfs.xfs", wantType: "xfs"},
+		{name: "capability over StorageClass", capabilityFsType: "btrfs", contextFsType: "xfs", wantMkfs: "mkfs.btrfs", wantType: "btrfs"},
+		{name: "pre-formatted device", capabilityFsType: "xfs", existing: "xfs", wantType: "xfs"},
+		{name: "device of another filesystem", capabilityFsType: "ext4", existing: "xfs", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A blank device is formatted, then detected again and checked by
+			// the mounter, a formatted one only detected again and checked
+			commands := []string{}
+			actions := []testingexec.FakeCommandAction{blkidAction(test.existing)}
+			if test.wantMkfs != "" {
+				actions = append(actions, recordAction(&commands), blkidAction(test.wantType), recordAction(&commands))
+			} else if !test.wantErr {
+				actions = append(actions, blkidAction(test.existing), recordAction(&commands))
+			}
+			mounter := withFakeMounter(t, actions...)
+			client := newFakeNvmeClient()
+			devicePath := withFakeNamespaceDevice(t, client, 1<<30)
+			n := newTestNodeServer(client)
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			stage.VolumeCapability = mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			stage.VolumeCapability.GetMount().FsType = test.capabilityFsType
+			if test.contextFsType != "" {
+				stage.VolumeContext[paramFsType] = test.contextFsType
+			}
+
+			_, err := n.NodeStageVolume(context.Background(), stage)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NodeStageVolume error = %v, want error %v", err, test.wantErr)
+			}
+			ranMkfs := []string{}
+			for _, command := range commands {
+				if strings.HasPrefix(command, "mkfs.") {
+					ranMkfs = append(ranMkfs, command)
+				}
+			}
+			wantMkfs := []string{}
+			if test.wantMkfs != "" {
+				wantMkfs = append(wantMkfs, test.wantMkfs+" "+devicePath)
+			}
+			if !reflect.DeepEqual(ranMkfs, wantMkfs) {
+				t.Errorf("mkfs commands = %q, want %q", ranMkfs, wantMkfs)
+			}
+			if test.wantErr {
+				return
+			}
+
+			// The device is mounted at the staging path as the filesystem
+			mounts, _ := mounter.List()
+			stagingPath := stagingVolumePath(stage.StagingTargetPath, testVolumeNqn)
+			if len(mounts) != 1 || mounts[0].Device != devicePath || mounts[0].Path != stagingPath || mounts[0].Type != test.wantType {
+				t.Errorf("mounts = %+v, want %s mounted at %s as %s", mounts, devicePath, stagingPath, test.wantType)
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolumeTwice(t *testing.T) {
+	tests := []struct {
+		name   string
+		staged bool
+		// busy fails the first unmount of the staging path
+		busy bool
+	}{
+		{name: "staged volume", staged: true},
+		{name: "volume never staged"},
+		{name: "staging path busy", staged: true, busy: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			mounter := withFakeMounter(t)
+			client := newFakeNvmeClient()
+			withFakeNamespaceDevice(t, client, 1<<30)
+			n := newTestNodeServer(client)
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			stage.VolumeCapability = blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			if test.staged {
+				if _, err := n.NodeStageVolume(ctx, stage); err != nil {
+					t.Fatalf("NodeStageVolume: %v", err)
+				}
+			}
+			unstage := &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeNqn, StagingTargetPath: stage.StagingTargetPath}
+
+			// A mount that cannot be unmounted fails the unstage and keeps the
+			// connection, until the retried unstage unmounts it
+			if test.busy {
+				mounter.UnmountFunc = func(path string) error {
+					mounter.UnmountFunc = nil
+					return syscall.EBUSY
+				}
+				if _, err := n.NodeUnstageVolume(ctx, unstage); status.Code(err) != codes.Internal {
+					t.Errorf("NodeUnstageVolume of a busy mount code = %v, want Internal: %v", status.Code(err), err)
+				}
+				if client.disconnectCount() != 0 {
+					t.Errorf("disconnects = %d once the unmount failed, want none", client.disconnectCount())
+				}
+			}
+
+			// The second unstage finds the volume unmounted and disconnected
+			for i := 1; i <= 2; i++ {
+				if _, err := n.NodeUnstageVolume(ctx, unstage); err != nil {
+					t.Fatalf("NodeUnstageVolume #%d: %v", i, err)
+				}
+			}
+			if mounts, _ := mounter.List(); len(mounts) != 0 {
+				t.Errorf("mounts = %v once unstaged, want none", mounts)
+			}
+			wantDisconnects := 0
+			if test.staged {
+				wantDisconnects = 1
+			}
+			if client.disconnectCount() != wantDisconnects {
+				t.Errorf("disconnects = %d, want %d", client.disconnectCount(), wantDisconnects)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Names of the discovery log entry fields across nvme-cli versions
+var (
+	discoveryNqnFields       = []string{"subnqn", "subsys_nqn", "nqn"}
+	discoveryAddrFields      = []string{"traddr", "tr_addr", "addr"}
+	discoveryPortFields      = []string{"trsvcid", "tr_svcid", "svcid"}
+	discoveryTransportFields = []string{"trtype", "tr_type", "transport"}
+	discoverySubtypeFields   = []string{"subtype", "sub_type"}
+)
+
+// discoveryEntryPrefix starts each entry of the text output of nvme discover
+const discoveryEntryPrefix = "=====Discovery Log Entry"
+
+// parseNvmeDiscoveryOutput parses the output of nvme discover into the NVM
+// subsystems of the transport. The JSON output is parsed regardless of the
+// casing and naming of its fields, which differ between nvme-cli versions, and
+// output that is not JSON, e.g. of versions ignoring -o json, as text.
+func parseNvmeDiscoveryOutput(output string, targetType string) []*nvmfDiskInfo {
+	entries, err := parseDiscoveryJSON(output)
+	if err != nil {
+		nvmeLog.V(4).Infof("NVMe discovery output is not JSON, parsing it as text: %v", err)
+		entries = parseDiscoveryText(output)
+	}
+
+	targets := make([]*nvmfDiskInfo, 0, len(entries))
+	for _, entry := range entries {
+		record := nvmfDiskInfo{
+			Nqn:       entry.field(discoveryNqnFields),
+			Addr:      entry.field(discoveryAddrFields),
+			Port:      entry.field(discoveryPortFields),
+			Transport: entry.field(discoveryTransportFields),
+		}
+
+		// Skip discovery subsystems and referrals and non-matching transport types
+		if strings.Contains(strings.ToLower(record.Nqn), "discovery") ||
+			strings.Contains(strings.ToLower(entry.field(discoverySubtypeFields)), "discovery") ||
+			!strings.EqualFold(record.Transport, targetType) {
+			continue
+		}
+		if record.Nqn == "" {
+			klog.Warningf("Skipping discovery record without subsystem NQN: %v", entry)
+			continue
+		}
+
+		// Both Addr and Port are required for the node server to connect to
+		// the target with multipath
+		if record.Addr == "" || record.Port == "" {
+			klog.Warningf("Skipping record with invalid Addr or Port: Addr=%s, Port=%s", record.Addr, record.Port)
+			continue
+		}
+		record.Transport = targetType
+		record.Endpoints = []string{joinEndpoint(record.Addr, record.Port)}
+
+		targets = append(targets, &record)
+	}
+
+	return targets
+}
+
+// discoveryEntry is a discovery log entry keyed by lowercase field name
+type discoveryEntry map[string]string
+
+// field returns the value of the first of the names present in the entry
+func (e discoveryEntry) field(names []string) string {
+	for _, name := range names {
+		if value, exists := e[name]; exists {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseDiscoveryJSON returns the entries of the records array of the JSON
+// output, whatever the casing of its key. Scalar values of any JSON type are
+// kept as strings.
+func parseDiscoveryJSON(output string) ([]discoveryEntry, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(output), &top); err != nil {
+		return nil, err
+	}
+
+	var records []map[string]interface{}
+	for key, value := range top {
+		if strings.EqualFold(key, "records") {
+			if err := json.Unmarshal(value, &records); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			break
+		}
+	}
+
+	entries := make([]discoveryEntry, 0, len(records))
+	for _, record := range records {
+		entry := discoveryEntry{}
+		for key, value := range record {
+			switch v := value.(type) {
+			case string:
+				entry[strings.ToLower(key)] = strings.TrimSpace(v)
+			case float64:
+				entry[strings.ToLower(key)] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// parseDiscoveryText returns the entries of the text output of nvme discover,
+// whose fields are "name: value" lines following each entry header
+func parseDiscoveryText(output string) []discoveryEntry {
+	entries := []discoveryEntry{}
+	var entry discoveryEntry
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, discoveryEntryPrefix) {
+			entry = discoveryEntry{}
+			entries = append(entries, entry)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		entry[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+
+	return entries
+}
+
+// nvmeCliVersion returns the version line of the installed nvme-cli
+func nvmeCliVersion(timeout time.Duration) (string, error) {
+	output, err := runNvmeCli(context.Background(), timeout, "version")
+	if err != nil {
+		return "", err
+	}
+
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return version, nil
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleDiscoveryText is the text output of nvme discover against a target
+// advertising two subsystems over tcp, one over rdma and itself
+const sampleDiscoveryText = `
+Discovery Log Number of Records 4, Generation counter 8
+=====Discovery Log Entry 0======
+trtype:  tcp
+adrfam:  ipv4
+subtype: current discovery subsystem
+treq:    not specified
+portid:  1
+trsvcid: 8009
+subnqn:  nqn.2014-08.org.nvmexpress.discovery
+traddr:  192.0.2.10
+=====Discovery Log Entry 1======
+trtype:  tcp
+adrfam:  ipv4
+subtype: nvme subsystem
+treq:    not specified
+portid:  1
+trsvcid: 4420
+subnqn:  nqn.2024-01.io.example:volume-1
+traddr:  192.0.2.10
+=====Discovery Log Entry 2======
+trtype:  tcp
+adrfam:  ipv4
+subtype: nvme subsystem
+treq:    not specified
+portid:  1
+trsvcid: 4420
+subnqn:  nqn.2024-01.io.example:volume-2
+traddr:  192.0.2.10
+=====Discovery Log Entry 3======
+trtype:  rdma
+adrfam:  ipv4
+subtype: nvme subsystem
+treq:    not specified
+portid:  2
+trsvcid: 4420
+subnqn:  nqn.2024-01.io.example:volume-3
+traddr:  192.0.2.11
+`
+
+// sampleDiscoveryJSONv1 is the JSON output of nvme discover of nvme-cli 1.16
+// against the target of sampleDiscoveryText, limited to tcp
+const sampleDiscoveryJSONv1 = `{
+  "genctr" : 8,
+  "records" : [
+    {
+      "trtype" : "tcp",
+      "adrfam" : "ipv4",
+      "subtype" : "discovery subsystem",
+      "treq" : "not specified",
+      "portid" : 1,
+      "trsvcid" : "8009",
+      "subnqn" : "nqn.2014-08.org.nvmexpress.discovery",
+      "traddr" : "192.0.2.10",
+      "sectype" : "none"
+    },
+    {
+      "trtype" : "tcp",
+      "adrfam" : "ipv4",
+      "subtype" : "nvme subsystem",
+      "treq" : "not specified",
+      "portid" : 1,
+      "trsvcid" : "4420",
+      "subnqn" : "nqn.2024-01.io.example:volume-1",
+      "traddr" : "192.0.2.10",
+      "sectype" : "none"
+    }
+  ]
+}
+`
+
+// sampleDiscoveryJSONv2 is the same output of nvme-cli 2.8, which reports the
+// entry flags and a current discovery subsystem
+const sampleDiscoveryJSONv2 = `{
+  "genctr":8,
+  "records":[
+    {
+      "trtype":"tcp",
+      "adrfam":"ipv4",
+      "subtype":"current discovery subsystem",
+      "treq":"not specified",
+      "portid":1,
+      "trsvcid":"8009",
+      "subnqn":"nqn.2014-08.org.nvmexpress.discovery",
+      "traddr":"192.0.2.10",
+      "eflags":"explicit discovery connections, duplicate discovery information",
+      "sectype":"none"
+    },
+    {
+      "trtype":"tcp",
+      "adrfam":"ipv4",
+      "subtype":"nvme subsystem",
+      "treq":"not specified",
+      "portid":1,
+      "trsvcid":"4420",
+      "subnqn":"nqn.2024-01.io.example:volume-1",
+      "traddr":"192.0.2.10",
+      "eflags":"none",
+      "sectype":"none"
+    }
+  ]
+}
+`
+
+func formatDiskInfos(devices []*nvmfDiskInfo) string {
+	formatted := make([]string, 0, len(devices))
+	for _, device := range devices {
+		formatted = append(formatted, fmt.Sprintf("%+v", *device))
+	}
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
+
+func TestParseNvmeDiscoveryOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		transport string
+		want      []*nvmfDiskInfo
+	}{
+		{
+			name:      "text output",
+			output:    sampleDiscoveryText,
+			transport: "tcp",
+			want: []*nvmfDiskInfo{
+				{Nqn: "nqn.2024-01.io.example:volume-1", Addr: "192.0.2.10", Port: "4420", Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+				{Nqn: "nqn.2024-01.io.example:volume-2", Addr: "192.0.2.10", Port: "4420", Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+			},
+		},
+		{
+			name:      "text output of another transport",
+			output:    sampleDiscoveryText,
+			transport: "rdma",
+			want: []*nvmfDiskInfo{
+				{Nqn: "nqn.2024-01.io.example:volume-3", Addr: "192.0.2.11", Port: "4420", Transport: "rdma", Endpoints: []string{"192.0.2.11:4420"}},
+			},
+		},
+		{
+			name:      "JSON output of nvme-cli 1.16",
+			output:    sampleDiscoveryJSONv1,
+			transport: "tcp",
+			want: []*nvmfDiskInfo{
+				{Nqn: "nqn.2024-01.io.example:volume-1", Addr: "192.0.2.10", Port: "4420", Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+			},
+		},
+		{
+			name:      "JSON output of nvme-cli 2.8",
+			output:    sampleDiscoveryJSONv2,
+			transport: "tcp",
+			want: []*nvmfDiskInfo{
+				{Nqn: "nqn.2024-01.io.example:volume-1", Addr: "192.0.2.10", Port: "4420", Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+			},
+		},
+		{
+			name:      "JSON output",
+			output:    `{"genctr":8,"records":[{"trtype":"tcp","subtype":"nvme subsystem","trsvcid":"4420","subnqn":"nqn.2024-01.io.example:volume-1","traddr":"192.0.2.10"}]}`,
+			transport: "tcp",
+			want: []*nvmfDiskInfo{
+				{Nqn: "nqn.2024-01.io.example:volume-1", Addr: "192.0.2.10", Port: "4420", Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+			},
+		},
+		{
+			name:      "JSON output of an older nvme-cli",
+			output:    `{"Records":[{"TrType":"TCP","Subtype":"nvme subsystem","Tr_Svcid":4420,"Subsys_NQN":"nqn.2024-01.io.example:volume-1","Tr_Addr":"192.0.2.10"}]}`,
+			transport: "tcp",
+			want: []*nvmfDiskInfo{
+				{Nqn: "nqn.2024-01.io.example:volume-1", Addr: "192.0.2.10", Port: "4420", Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}},
+			},
+		},
+		{
+			name:      "records without address or NQN",
+			output:    `{"records":[{"trtype":"tcp","subnqn":"nqn.2024-01.io.example:volume-1","trsvcid":"4420"},{"trtype":"tcp","traddr":"192.0.2.10","trsvcid":"4420"}]}`,
+			transport: "tcp",
+			want:      []*nvmfDiskInfo{},
+		},
+		{
+			name:      "JSON output with invalid records",
+			output:    `{"records":{"trtype":"tcp"}}`,
+			transport: "tcp",
+			want:      []*nvmfDiskInfo{},
+		},
+		{
+			name:      "no records",
+			output:    "",
+			transport: "tcp",
+			want:      []*nvmfDiskInfo{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseNvmeDiscoveryOutput(test.output, test.transport)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseNvmeDiscoveryOutput = %s, want %s", formatDiskInfos(got), formatDiskInfos(test.want))
+			}
+		})
+	}
+}
+
+func TestNvmeCliVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		want    string
+		wantErr bool
+	}{
+		{name: "nvme-cli 1.x", script: `echo "nvme version 1.16"`, want: "nvme version 1.16"},
+		{name: "nvme-cli 2.x", script: `printf 'nvme version 2.8 (git 2.8)\nlibnvme version 1.8 (git 1.8)\n'`, want: "nvme version 2.8 (git 2.8)"},
+		{name: "failure", script: "exit 1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFakeNvmeCli(t, test.script)
+			got, err := nvmeCliVersion(time.Second)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("nvmeCliVersion error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("nvmeCliVersion = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveredDeviceState(t *testing.T) {
+	tests := []struct {
+		name   string
+		device *VolumeInfo
+		want   string
+	}{
+		{
+			name:   "advertised",
+			device: &VolumeInfo{},
+			want:   deviceStateAdvertised,
+		},
+		{
+			name:   "connected",
+			device: &VolumeInfo{PublishedNodes: map[string]struct{}{"node-1": {}}},
+			want:   deviceStateConnected,
+		},
+		{
+			name:   "quarantined",
+			device: &VolumeInfo{PublishedNodes: map[string]struct{}{"node-1": {}}, QuarantinedUntil: time.Now().Add(time.Hour)},
+			want:   deviceStateQuarantined,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.device.state(); got != test.want {
+				t.Errorf("state = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// NvmeController is an NVMe controller connected on this node
+type NvmeController struct {
+	Name      string // e.g. nvme0
+	SubsysNqn string
+	HostNqn   string // Empty if the kernel does not expose it
+	State     string // e.g. live, connecting, deleting
+	Serial    string // Serial number of the subsystem, empty if unknown
+	Model     string // Model of the subsystem, empty if unknown
+}
+
+// NvmeClient performs the NVMe-oF operations of the node server and of device
+// discovery, so that they can run against something other than a real fabric
+type NvmeClient interface {
+	// Connect connects the subsystem of the connector and returns the device path
+	Connect(connector *Connector) (string, error)
+
+	// Disconnect removes the controllers of nqn connected with hostNqn
+	Disconnect(nqn, hostNqn string, timeout time.Duration) error
+
+	// DisconnectAll removes every controller of nqn, whatever its host NQN
+	DisconnectAll(ctx context.Context, nqn string, timeout time.Duration) error
+
+	// DeleteController removes a single controller
+	DeleteController(controller string, timeout time.Duration) error
+
+	// Discover returns the discovery log page of a discovery controller in the
+	// JSON format of nvme-cli
+	Discover(ctx context.Context, transport, addr, port string, timeout time.Duration) ([]byte, error)
+
+	// ListSubsystems returns the controllers connected on this node
+	ListSubsystems() ([]NvmeController, error)
+
+	// ListNamespaces returns the device paths of namespace nsid of a controller,
+	// or of all its namespaces if nsid is 0
+	ListNamespaces(controller string, nsid uint32) ([]string, error)
+
+	// NamespaceSize returns the size in bytes of the namespace of a device path
+	NamespaceSize(ctx context.Context, devicePath string, timeout time.Duration) (int64, error)
+}
+
+// execNvmeClient is the NvmeClient of a real node. Controllers are managed
+// through /dev/nvme-fabrics and sysfs, discovery runs nvme-cli.
+type execNvmeClient struct{}
+
+func newExecNvmeClient() NvmeClient {
+	return &execNvmeClient{}
+}
+
+func (e *execNvmeClient) Connect(connector *Connector) (string, error) {
+	return connector.Connect()
+}
+
+func (e *execNvmeClient) Disconnect(nqn, hostNqn string, timeout time.Duration) error {
+	connector := Connector{
+		TargetNqn: nqn,
+		HostNqn:   hostNqn,
+		Timeout:   timeout,
+	}
+	return connector.Disconnect()
+}
+
+func (e *execNvmeClient) DisconnectAll(ctx context.Context, nqn string, timeout time.Duration) error {
+	_, err := runNvmeCli(ctx, timeout, "disconnect", "-n", nqn)
+	return err
+}
+
+func (e *execNvmeClient) DeleteController(controller string, timeout time.Duration) error {
+	return _disconnect(filepath.Join(SYS_NVMF, controller, "delete_controller"), timeout)
+}
+
+func (e *execNvmeClient) Discover(ctx context.Context, transport, addr, port string, timeout time.Duration) ([]byte, error) {
+	return runNvmeCli(ctx, timeout, "discover", "-a", addr, "-s", port, "-t", transport, "-o", "json")
+}
+
+func (e *execNvmeClient) ListSubsystems() ([]NvmeController, error) {
+	devices, err := os.ReadDir(SYS_NVMF)
+	if err != nil {
+		klog.Errorf("Failed to read NVMe devices directory: %v", err)
+		return nil, err
+	}
+
+	controllers := []NvmeController{}
+	for _, device := range devices {
+		data, err := os.ReadFile(filepath.Join(SYS_NVMF, device.Name(), "subsysnqn"))
+		if err != nil {
+			continue
+		}
+
+		controllers = append(controllers, NvmeController{
+			Name:      device.Name(),
+			SubsysNqn: strings.TrimSpace(string(data)),
+			HostNqn:   readControllerHostNqn(device.Name()),
+			State:     getControllerState(device.Name()),
+			Serial:    readControllerAttribute(device.Name(), "serial"),
+			Model:     readControllerAttribute(device.Name(), "model"),
+		})
+	}
+
+	return controllers, nil
+}
+
+func (e *execNvmeClient) ListNamespaces(controller string, nsid uint32) ([]string, error) {
+	return namespaceDevicePaths(controller, nsid), nil
+}
+
+// NamespaceSize reads the size from sysfs, falling back to nvme id-ns
+func (e *execNvmeClient) NamespaceSize(ctx context.Context, devicePath string, timeout time.Duration) (int64, error) {
+	if size, err := readSysfsSize(devicePath); err == nil {
+		return size, nil
+	}
+
+	output, err := runNvmeCli(ctx, timeout, "id-ns", devicePath, "-o", "json")
+	if err != nil {
+		return 0, fmt.Errorf("nvme id-ns %s failed: %v", devicePath, err)
+	}
+	return parseIdNsSize(output)
+}
+
+// findController returns the first controller of the subsystem nqn, restricted
+// to controllers connected with hostNqn unless it is empty
+func findController(client NvmeClient, nqn, hostNqn string) (NvmeController, bool) {
+	controllers, err := client.ListSubsystems()
+	if err != nil {
+		return NvmeController{}, false
+	}
+
+	for _, controller := range controllers {
+		if controller.SubsysNqn != nqn {
+			continue
+		}
+		if hostNqn != "" && controller.HostNqn != hostNqn {
+			continue
+		}
+		return controller, true
+	}
+
+	return NvmeController{}, false
+}
@@ -17,10 +17,12 @@ limitations under the License.
 package nvmf
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
@@ -34,8 +36,45 @@ const (
 	paramPort     = "targetTrPort"     // Target port parameter
 	paramType     = "targetTrType"     // Transport type parameter
 	paramEndpoint = "targetTrEndpoint" // Target endpoints parameter
+
+	paramReserveHeadroomPercent  = "reserveHeadroomPercent"  // Per-device capacity kept in reserve
+	paramCapacityOverheadPercent = "capacityOverheadPercent" // Raw device capacity lost to filesystem and backend overhead
+
+	paramFsType      = "fsType"      // Filesystem of mount-mode volumes
+	paramMkfsOptions = "mkfsOptions" // Extra mkfs arguments used when formatting
+
+	// paramDryRun validates a CreateVolume without allocating. It is meant for
+	// CSI clients calling the controller directly and must never be set in a
+	// StorageClass, see dryRunFeasibleCode.
+	paramDryRun = "dryRun"
+
+	paramHostNqn = "hostNqn" // Host NQN presented to the target instead of the per-volume default
+
+	paramSkipWipe = "skipWipe" // Skip the wipe on delete for backends that zero released namespaces
 )
 
+// Capacity accounting recorded in the volume context, so that it is persisted
+// in the PV and restored on the initial sync
+const (
+	volumeContextUsedBytes      = "usedBytes"           // Bytes of the device consumed by the volume
+	volumeContextDeviceCapacity = "deviceCapacityBytes" // Raw capacity of the device, if known
+)
+
+// defaultFsType is used when neither the volume capability nor the StorageClass sets a filesystem
+const defaultFsType = "ext4"
+
+// supportedFsTypes are the filesystems a mount-mode volume can be formatted with
+var supportedFsTypes = map[string]bool{
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+// isSupportedFsType reports whether fsType can be used, an empty fsType selects the default
+func isSupportedFsType(fsType string) bool {
+	return fsType == "" || supportedFsTypes[fsType]
+}
+
 type nvmfDiskInfo struct {
 	VolName   string
 	Nqn       string `json:"subnqn"`
@@ -43,17 +82,41 @@ type nvmfDiskInfo struct {
 	Port      string `json:"trsvcid"`
 	Transport string `json:"trtype"`
 	Endpoints []string
+
+	// Nsid selects one namespace of the subsystem, 0 for a volume backed by the whole subsystem
+	Nsid uint32 `json:"-"`
+
+	// Formatting requested through the StorageClass
+	FsType      string   `json:"-"`
+	MkfsOptions []string `json:"-"`
+
+	// ConnectArgs are the tuning options passed to the fabrics connect
+	ConnectArgs []string `json:"-"`
+
+	// HostNqn overrides the host NQN the node connects with
+	HostNqn string `json:"-"`
 }
 
 type nvmfDiskMounter struct {
 	*nvmfDiskInfo
 	isBlock      bool
 	fsType       string
+	mkfsOptions  []string
 	mountOptions []string
 	mounter      *mount.SafeFormatAndMount
 	exec         exec.Interface
 	targetPath   string
 	connector    *Connector
+
+	// bind mounts the staged filesystem at publish instead of the device
+	bind bool
+	// propagation of the bind mount, a key of mountPropagationFlags, empty to keep the default
+	propagation string
+
+	// fsck checks an existing filesystem before it is mounted
+	fsck bool
+	// traceCtx carries the span the format is traced under, nil if untraced
+	traceCtx context.Context
 }
 
 type nvmfDiskUnMounter struct {
@@ -62,62 +125,99 @@ type nvmfDiskUnMounter struct {
 }
 
 // getNVMfDiskInfo extracts NVMf disk information from the provided parameters
-func getNVMfDiskInfo(volID string, params map[string]string) (*nvmfDiskInfo, error) {
+func getNVMfDiskInfo(volID string, params *VolumeParams) (*nvmfDiskInfo, error) {
 	if params == nil {
 		return nil, fmt.Errorf("discovery parameters are nil")
 	}
 
-	targetTrType := params[paramType]
-	targetTrEndpoints := params[paramEndpoint]
-	nqn := volID
-
-	if nqn == "" || targetTrType == "" || targetTrEndpoints == "" {
-		return nil, fmt.Errorf("some nvme target info is missing, nqn: %s, type: %s, eindpoints: %s ", nqn, targetTrType, targetTrEndpoints)
+	fields, err := decodeVolumeID(volID)
+	if err != nil {
+		return nil, err
 	}
-
-	endpoints := strings.Split(targetTrEndpoints, ",")
-	if len(endpoints) == 0 {
-		return nil, fmt.Errorf("no endpoints found in %s", volID)
+	// Opaque volume IDs carry the transport of volumes whose context lacks it
+	nqn, nsid, transport := fields.Nqn, fields.Nsid, params.Transport
+	if transport == "" {
+		transport = fields.Transport
+	}
+	if nqn == "" || transport == "" || len(params.Endpoints) == 0 {
+		return nil, fmt.Errorf("some nvme target info is missing, nqn: %s, type: %s, endpoints: %v", nqn, transport, params.Endpoints)
 	}
 
 	return &nvmfDiskInfo{
-		VolName:   volID,
-		Endpoints: endpoints,
-		Nqn:       nqn,
-		Transport: targetTrType,
+		VolName:     volID,
+		Endpoints:   params.Endpoints,
+		Nqn:         nqn,
+		Nsid:        nsid,
+		Transport:   transport,
+		FsType:      params.FsType,
+		MkfsOptions: params.MkfsOptions,
+		ConnectArgs: params.ConnectArgs,
+		HostNqn:     params.HostNqn,
 	}, nil
 }
 
-// getNVMfDiskMounter creates and configures a new disk mounter
-func getNVMfDiskMounter(nvmfInfo *nvmfDiskInfo, targetPath string, cap *csi.VolumeCapability) *nvmfDiskMounter {
+// getNVMfDiskMounter creates and configures a new disk mounter. nodeHostNqn is
+// the host NQN of the node, used unless the StorageClass pins one.
+func getNVMfDiskMounter(nvmfInfo *nvmfDiskInfo, targetPath, nodeHostNqn string, cap *csi.VolumeCapability, opts connectOptions) *nvmfDiskMounter {
+	// The capability's fsType takes precedence over the StorageClass parameter
+	fsType := cap.GetMount().GetFsType()
+	if fsType == "" {
+		fsType = nvmfInfo.FsType
+	}
+
+	hostNqn := connectHostNqn(nvmfInfo.HostNqn, nodeHostNqn, targetPath)
+	mounter, executor := newDiskMounter()
+
 	return &nvmfDiskMounter{
 		nvmfDiskInfo: nvmfInfo,
 		isBlock:      cap.GetBlock() != nil,
-		fsType:       cap.GetMount().GetFsType(),
+		fsType:       fsType,
+		mkfsOptions:  nvmfInfo.MkfsOptions,
 		mountOptions: cap.GetMount().GetMountFlags(),
-		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()},
-		exec:         exec.New(),
+		mounter:      &mount.SafeFormatAndMount{Interface: mounter, Exec: executor},
+		exec:         executor,
 		targetPath:   targetPath,
-		connector:    getNvmfConnector(nvmfInfo, targetPath),
+		connector:    getNvmfConnector(nvmfInfo, hostNqn, opts),
+	}
+}
+
+// connectHostNqn returns the host NQN to connect with: the NQN pinned by the
+// StorageClass, else the host NQN of the node. Only a node without a host NQN
+// falls back to the target path, which targets filtering by host cannot allow.
+func connectHostNqn(pinned, nodeHostNqn, targetPath string) string {
+	switch {
+	case pinned != "":
+		return pinned
+	case nodeHostNqn != "":
+		return nodeHostNqn
+	default:
+		return targetPath
 	}
 }
 
 // getNVMfDiskUnMounter creates a new disk unmounter
 func getNVMfDiskUnMounter() *nvmfDiskUnMounter {
+	mounter, executor := newDiskMounter()
 	return &nvmfDiskUnMounter{
-		mounter: mount.New(""),
-		exec:    exec.New(),
+		mounter: mounter,
+		exec:    executor,
 	}
 }
 
+// newDiskMounter returns the mounter of the volumes and the executor of the
+// commands formatting them, replaced in tests
+var newDiskMounter = func() (mount.Interface, exec.Interface) {
+	return mount.New(""), exec.New()
+}
+
 // AttachDisk connects to an NVMe-oF disk and returns the device path
-func AttachDisk(volumeID string, connector *Connector) (string, error) {
+func AttachDisk(client NvmeClient, volumeID string, connector *Connector) (string, error) {
 	if connector == nil {
 		return "", fmt.Errorf("connector is nil")
 	}
 
 	// connect nvmf target disk
-	devicePath, err := connector.Connect()
+	devicePath, err := client.Connect(connector)
 	if err != nil {
 		klog.Errorf("AttachDisk: VolumeID %s failed to connect, Error: %v", volumeID, err)
 		return "", err
@@ -133,12 +233,8 @@ func AttachDisk(volumeID string, connector *Connector) (string, error) {
 }
 
 // DetachDisk disconnects an NVMe-oF disk
-func DetachDisk(targetNqn, targetPath string) error {
-	connector := Connector{
-		TargetNqn: targetNqn,
-		HostNqn:   targetPath,
-	}
-	err := connector.Disconnect()
+func DetachDisk(client NvmeClient, targetNqn, hostNqn string, timeout time.Duration) error {
+	err := client.Disconnect(targetNqn, hostNqn, timeout)
 	if err != nil {
 		klog.Errorf("DetachDisk: failed to disconnect, Error: %v", err)
 		return err
@@ -165,6 +261,9 @@ func MountVolume(sourcePath string, nm *nvmfDiskMounter) error {
 	if nm.isBlock {
 		// Handle block device mount
 		return mountBlockDevice(sourcePath, nm)
+	} else if nm.bind {
+		// Handle the bind mount of a staged filesystem
+		return bindMountFilesystem(sourcePath, nm)
 	} else {
 		// Handle regular filesystem mount
 		return mountFilesystem(sourcePath, nm)
@@ -206,19 +305,118 @@ func mountFilesystem(devicePath string, nm *nvmfDiskMounter) error {
 		return err
 	}
 
+	fsType := nm.fsType
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	// Format only a device without a filesystem, a device holding data is never reformatted
+	existingFormat, err := nm.mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		klog.Errorf("mountFilesystem: failed to detect filesystem on %s: %v", devicePath, err)
+		return fmt.Errorf("failed to detect filesystem on device: %v", err)
+	}
+	if existingFormat == "" {
+		_, span := startSpan(nm.traceCtx, "format", "mount.fs_type", fsType)
+		err := formatDevice(devicePath, fsType, nm.mkfsOptions, nm.exec)
+		span.end(err)
+		if err != nil {
+			klog.Errorf("mountFilesystem: failed to format %s as %s: %v", devicePath, fsType, err)
+			return err
+		}
+	} else if existingFormat != fsType {
+		klog.Errorf("mountFilesystem: %s is already formatted as %s, requested %s", devicePath, existingFormat, fsType)
+		return fmt.Errorf("device %s is already formatted as %s, refusing to use it as %s", devicePath, existingFormat, fsType)
+	} else if nm.fsck {
+		result, err := checkFilesystem(nm.exec, devicePath, fsType)
+		if err != nil {
+			klog.Errorf("mountFilesystem: check of %s failed: %v", devicePath, err)
+			return err
+		}
+		klog.Infof("mountFilesystem: %s filesystem on %s checked: %s", fsType, devicePath, result)
+	} else {
+		klog.V(4).Infof("mountFilesystem: %s already holds a %s filesystem, skipping mkfs", devicePath, fsType)
+	}
+
 	// Mount the filesystem
-	// Tips: use k8s mounter to mount fs and only support "ext4"
 	var options []string
 	options = append(options, nm.mountOptions...)
-	klog.Infof("mountFilesystem: mounting %s at %s with fstype %s and options: %v", devicePath, nm.targetPath, nm.fsType, options)
-	if err := nm.mounter.FormatAndMount(devicePath, nm.targetPath, nm.fsType, options); err != nil {
+	klog.Infof("mountFilesystem: mounting %s at %s with fstype %s and options: %v", devicePath, nm.targetPath, fsType, options)
+	if err := nm.mounter.FormatAndMount(devicePath, nm.targetPath, fsType, options); err != nil {
 		klog.Errorf("mountFilesystem: failed to format and mount %s at %s: %v", devicePath, nm.targetPath, err)
+		if isCapacityError(err, "") {
+			return fmt.Errorf("%w: failed to format and mount device: %v", ErrInsufficientCapacity, err)
+		}
 		return fmt.Errorf("failed to format and mount device: %v", err)
 	}
 
 	return nil
 }
 
+// bindMountFilesystem bind mounts the staged filesystem at sourcePath, with
+// the requested propagation
+func bindMountFilesystem(sourcePath string, nm *nvmfDiskMounter) error {
+	if err := os.MkdirAll(nm.targetPath, 0750); err != nil {
+		klog.Errorf("bindMountFilesystem: failed to mkdir %s: %v", nm.targetPath, err)
+		return err
+	}
+
+	options := append(append([]string{}, nm.mountOptions...), "bind")
+	klog.Infof("bindMountFilesystem: mounting %s at %s with options: %v", sourcePath, nm.targetPath, options)
+	if err := nm.mounter.Mount(sourcePath, nm.targetPath, "", options); err != nil {
+		klog.Errorf("bindMountFilesystem: failed to bind mount %s at %s: %v", sourcePath, nm.targetPath, err)
+		return fmt.Errorf("failed to bind mount volume: %v", err)
+	}
+
+	if nm.propagation != "" {
+		if err := setMountPropagation(nm.targetPath, nm.propagation); err != nil {
+			if unmountErr := nm.mounter.Unmount(nm.targetPath); unmountErr != nil {
+				klog.Errorf("bindMountFilesystem: failed to unmount %s: %v", nm.targetPath, unmountErr)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyMountPropagation moves the propagation flag of the mount options, if
+// any, to the propagation of the mounter. Block volumes have no mount options.
+func (nm *nvmfDiskMounter) applyMountPropagation() error {
+	options, propagation, err := parseMountPropagation(nm.mountOptions)
+	if err != nil {
+		return err
+	}
+
+	nm.mountOptions = options
+	nm.propagation = propagation
+	return nil
+}
+
+// formatDevice creates a filesystem of fsType on an unformatted device
+func formatDevice(devicePath, fsType string, mkfsOptions []string, executor exec.Interface) error {
+	var args []string
+	// mke2fs asks for confirmation when the device looks in use
+	if strings.HasPrefix(fsType, "ext") && !containsString(mkfsOptions, "-F") {
+		args = append(args, "-F")
+	}
+	args = append(args, mkfsOptions...)
+	args = append(args, devicePath)
+
+	klog.Infof("formatDevice: running mkfs.%s %v", fsType, args)
+	output, err := executor.Command("mkfs."+fsType, args...).CombinedOutput()
+	if err != nil {
+		// The device had no filesystem, so nothing but the failed format is erased
+		wipeFailedFormat(devicePath, executor)
+		if isCapacityError(err, string(output)) {
+			return fmt.Errorf("%w: mkfs.%s failed: %v: %s", ErrInsufficientCapacity, fsType, err, strings.TrimSpace(string(output)))
+		}
+		return fmt.Errorf("mkfs.%s failed: %v: %s", fsType, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
 // mountBlockDevice handles mounting a block device directly (without formatting)
 func mountBlockDevice(devicePath string, nm *nvmfDiskMounter) error {
 	// Create parent directory
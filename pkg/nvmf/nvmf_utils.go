@@ -18,9 +18,12 @@ package nvmf
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -30,6 +33,39 @@ import (
 	"k8s.io/klog/v2"
 )
 
+var (
+	// nqn.yyyy-mm.reverse-domain, optionally followed by ":" and a user-defined string
+	nqnPattern = regexp.MustCompile(`^nqn\.[0-9]{4}-(0[1-9]|1[0-2])\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*(:.+)?$`)
+
+	// nqn.2014-08.org.nvmexpress:uuid:<uuid>
+	uuidNqnPrefix  = "nqn.2014-08.org.nvmexpress:uuid:"
+	uuidNqnPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// isValidNQN checks that the NQN follows the NVMe Qualified Name grammar,
+// including the UUID-based form, and does not exceed the maximum length
+func isValidNQN(nqn string) bool {
+	if len(nqn) == 0 || len(nqn) > NVMF_NQN_SIZE {
+		return false
+	}
+
+	if strings.HasPrefix(nqn, uuidNqnPrefix) {
+		return uuidNqnPattern.MatchString(strings.TrimPrefix(nqn, uuidNqnPrefix))
+	}
+
+	return nqnPattern.MatchString(nqn)
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 func waitForPathToExist(devicePath string, maxRetries, intervalSeconds int, deviceTransport string) (bool, error) {
 	for i := 0; i < maxRetries; i++ {
 		exist := utils.IsFileExisting(devicePath)
@@ -44,8 +80,23 @@ func waitForPathToExist(devicePath string, maxRetries, intervalSeconds int, devi
 	return false, fmt.Errorf("not found devicePath %s", devicePath)
 }
 
-func GetDeviceNameByVolumeID(volumeID string) (deviceName string, err error) {
-	volumeLinkPath := strings.Join([]string{"/dev/disk/by-id/nvme-uuid", volumeID}, ".")
+// GetDeviceNameByVolumeID returns the name of the block device of a volume. The
+// subsystem NQN and NSID of volume IDs of the NQN and opaque formats locate the
+// namespace connected on the node, and the nvme-uuid link named after the
+// volume ID is the fallback for volumes whose namespace cannot be resolved.
+func GetDeviceNameByVolumeID(volumeID string) (string, error) {
+	nqn, nsid := parseVolumeID(volumeID)
+	devicePath, err := namespaceDevicePath(nqn, nsid)
+	if err == nil {
+		return deviceNameOfLink(devicePath)
+	}
+	klog.V(4).Infof("Cannot resolve namespace %d of %s for volume %s, trying its uuid link: %v", nsid, nqn, volumeID, err)
+
+	return deviceNameOfLink(strings.Join([]string{"/dev/disk/by-id/nvme-uuid", volumeID}, "."))
+}
+
+// deviceNameOfLink returns the name of the block device volumeLinkPath links to
+func deviceNameOfLink(volumeLinkPath string) (string, error) {
 	stat, err := os.Lstat(volumeLinkPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -73,7 +124,7 @@ func GetDeviceNameByVolumeID(volumeID string) (deviceName string, err error) {
 }
 
 func parseDeviceToControllerPath(deviceName string) string {
-	nvmfControllerPrefix := "/sys/class/block"
+	nvmfControllerPrefix := sysfsBlockDir
 	index := strings.LastIndex(deviceName, "n")
 	parsed := deviceName[:index] + "c0" + deviceName[index:]
 	scanPath := filepath.Join(nvmfControllerPrefix, parsed, "device/rescan_controller")
@@ -81,20 +132,43 @@ func parseDeviceToControllerPath(deviceName string) string {
 }
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	klog.Infof("GRPC call: %s", info.FullMethod)
+	requestID := newRequestID()
+	ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+
+	klog.Infof("GRPC call: %s, request ID: %s", info.FullMethod, requestID)
 	klog.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
 	resp, err := handler(ctx, req)
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		klog.Errorf("GRPC error: %v, request ID: %s", err, requestID)
 	} else {
 		klog.Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
 	}
 	return resp, err
 }
 
+type requestIDKey struct{}
+
+// newRequestID returns a random ID correlating the logs and spans of an RPC,
+// or one derived from the time if no random bytes can be read
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		klog.Warningf("Failed to read a random request ID, using the time instead: %v", err)
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// requestIDFrom returns the ID logGRPC assigned to the RPC of ctx
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
 // findPathWithRetry waits until the NVMe device with the specified NQN is fully connected
-// and returns its device path. It retries up to maxRetries times with intervalSeconds between attempts.
-func findPathWithRetry(targetNqn string, maxRetries, intervalSeconds int32) (string, error) {
+// and returns the device path of namespace nsid, or of the first namespace if nsid is 0.
+// It retries up to maxRetries times with intervalSeconds between attempts.
+func findPathWithRetry(targetNqn string, nsid uint32, maxRetries, intervalSeconds int32) (string, error) {
 	for i := int32(0); i < maxRetries; i++ {
 		time.Sleep(time.Second * time.Duration(intervalSeconds))
 
@@ -109,7 +183,7 @@ func findPathWithRetry(targetNqn string, maxRetries, intervalSeconds int32) (str
 		}
 
 		// Step 2: Find the UUID
-		uuid := getDeviceUUID(deviceName)
+		uuid := getDeviceUUID(deviceName, nsid)
 		if uuid == "" {
 			if i == maxRetries-1 {
 				klog.Infof("Failed to find UUID for device %s after %d attempts", deviceName, maxRetries)
@@ -167,13 +241,13 @@ func getDeviceNameBySubNqn(targetNqn string) string {
 	return ""
 }
 
-// getDeviceUUID returns the UUID for the given device name
-func getDeviceUUID(deviceName string) string {
+// getDeviceUUID returns the UUID of namespace nsid of the given device
+func getDeviceUUID(deviceName string, nsid uint32) string {
 	// Try uuid first, then nguid
 	identifierTypes := []string{"uuid", "nguid"}
 
 	for _, idType := range identifierTypes {
-		identifier, err := getDeviceIdentifierFromSysfs(deviceName, idType)
+		identifier, err := getDeviceIdentifierFromSysfs(deviceName, nsid, idType)
 		if err == nil {
 			return identifier
 		}
@@ -183,12 +257,10 @@ func getDeviceUUID(deviceName string) string {
 }
 
 // getDeviceIdentifierFromSysfs extracts device identifiers from sysfs
-func getDeviceIdentifierFromSysfs(deviceName string, identifierType string) (string, error) {
-	// Find namespaces - supports both standard (nvme0n1) and controller-based (nvme2c2n1) namespaces
-	namespacePattern := filepath.Join(SYS_NVMF, deviceName, "nvme*n*")
-	namespaces, err := filepath.Glob(namespacePattern)
-	if err != nil || len(namespaces) == 0 {
-		return "", fmt.Errorf("no namespace found for device %s: %v", deviceName, err)
+func getDeviceIdentifierFromSysfs(deviceName string, nsid uint32, identifierType string) (string, error) {
+	namespaces := namespaceDirs(deviceName, nsid)
+	if len(namespaces) == 0 {
+		return "", fmt.Errorf("no namespace %d found for device %s", nsid, deviceName)
 	}
 
 	nsDir := filepath.Base(namespaces[0])
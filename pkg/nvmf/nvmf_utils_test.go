@@ -0,0 +1,111 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsValidNQN(t *testing.T) {
+	tests := []struct {
+		name string
+		nqn  string
+		want bool
+	}{
+		{name: "reverse domain and user string", nqn: "nqn.2024-01.io.example:volume-1", want: true},
+		{name: "reverse domain only", nqn: "nqn.2016-06.io.spdk", want: true},
+		{name: "UUID form", nqn: "nqn.2014-08.org.nvmexpress:uuid:2b6c6f7e-8b52-4b3a-9d7e-3f1c2a4b5c6d", want: true},
+		{name: "maximum length", nqn: "nqn.2024-01.io.example:" + strings.Repeat("a", NVMF_NQN_SIZE-len("nqn.2024-01.io.example:")), want: true},
+		{name: "empty", nqn: ""},
+		{name: "too long", nqn: "nqn.2024-01.io.example:" + strings.Repeat("a", NVMF_NQN_SIZE)},
+		{name: "missing prefix", nqn: "2024-01.io.example:volume-1"},
+		{name: "uppercase prefix", nqn: "NQN.2024-01.io.example:volume-1"},
+		{name: "month 13", nqn: "nqn.2024-13.io.example:volume-1"},
+		{name: "two digit year", nqn: "nqn.24-01.io.example:volume-1"},
+		{name: "missing domain", nqn: "nqn.2024-01.:volume-1"},
+		{name: "domain label ending with a hyphen", nqn: "nqn.2024-01.io.example-:volume-1"},
+		{name: "empty user string", nqn: "nqn.2024-01.io.example:"},
+		{name: "malformed UUID", nqn: "nqn.2014-08.org.nvmexpress:uuid:not-a-uuid"},
+		{name: "not an NQN", nqn: "not-an-nqn"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isValidNQN(test.nqn); got != test.want {
+				t.Errorf("isValidNQN(%q) = %v, want %v", test.nqn, got, test.want)
+			}
+		})
+	}
+}
+
+func TestControllerRPCsRejectMalformedNQN(t *testing.T) {
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	tests := []struct {
+		name string
+		call func(c *ControllerServer, volumeID string) error
+	}{
+		{
+			name: "DeleteVolume",
+			call: func(c *ControllerServer, volumeID string) error {
+				_, err := c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: volumeID})
+				return err
+			},
+		},
+		{
+			name: "ControllerPublishVolume",
+			call: func(c *ControllerServer, volumeID string) error {
+				_, err := c.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+					VolumeId:         volumeID,
+					NodeId:           "node-1",
+					VolumeCapability: capability,
+				})
+				return err
+			},
+		},
+		{
+			name: "ControllerUnpublishVolume",
+			call: func(c *ControllerServer, volumeID string) error {
+				_, err := c.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+					VolumeId: volumeID,
+					NodeId:   "node-1",
+				})
+				return err
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, volumeID := range []string{"not-an-nqn", "nqn.2024-13.io.example:volume-1", "nqn.2014-08.org.nvmexpress:uuid:not-a-uuid"} {
+			t.Run(test.name+"/"+volumeID, func(t *testing.T) {
+				c, _ := newTestControllerServer(t, newFakeBackend())
+				if got := status.Code(test.call(c, volumeID)); got != codes.InvalidArgument {
+					t.Errorf("%s(%q) code = %v, want InvalidArgument", test.name, volumeID, got)
+				}
+			})
+		}
+	}
+}
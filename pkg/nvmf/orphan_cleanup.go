@@ -0,0 +1,125 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// stagedNQNs returns the NQNs referenced by the connector files persisted next to
+// the kubelet staging paths, see stagedConnectorFiles
+func stagedNQNs(csiDir string) (map[string]struct{}, error) {
+	files, err := stagedConnectorFiles(csiDir)
+	if err != nil {
+		return nil, err
+	}
+
+	nqns := make(map[string]struct{})
+	for _, file := range files {
+		connector, err := GetConnectorFromFile(file)
+		if err != nil || connector.TargetNqn == "" {
+			continue
+		}
+		nqns[connector.TargetNqn] = struct{}{}
+	}
+
+	return nqns, nil
+}
+
+// Kubelet staging target paths under the CSI directory, by volume mode
+var stagingTargetPatterns = []string{
+	filepath.Join("*", "*", "globalmount"),         // Filesystem: <driver or pv>/<id>/globalmount
+	filepath.Join("volumeDevices", "staging", "*"), // Block: volumeDevices/staging/<pv>
+}
+
+// stagedConnectorFiles returns the connector files of the volumes staged on this
+// node, one per staging path, of both filesystem and block volumes
+func stagedConnectorFiles(csiDir string) ([]string, error) {
+	if _, err := os.Stat(csiDir); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, pattern := range stagingTargetPatterns {
+		matches, err := filepath.Glob(filepath.Join(csiDir, pattern, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// cleanupOrphanedConnections disconnects NVMe-oF controllers left behind by a
+// crash. Only controllers of NQNs this driver connected, i.e. those with a
+// tracking directory, are considered, and only if no staging path references
+// them. If the staging paths cannot be listed nothing is disconnected.
+func cleanupOrphanedConnections(csiDir string, timeout time.Duration) {
+	staged, err := stagedNQNs(csiDir)
+	if err != nil {
+		klog.Warningf("Orphan cleanup: cannot list staged volumes in %s, skipping: %v", csiDir, err)
+		return
+	}
+
+	devices, err := os.ReadDir(SYS_NVMF)
+	if err != nil {
+		klog.Warningf("Orphan cleanup: readdir %s err: %v, skipping", SYS_NVMF, err)
+		return
+	}
+
+	orphans := make(map[string]struct{})
+	for _, device := range devices {
+		ctrl := device.Name()
+		data, err := os.ReadFile(fmt.Sprintf("%s/%s/subsysnqn", SYS_NVMF, ctrl))
+		if err != nil {
+			continue
+		}
+		nqn := strings.TrimSpace(string(data))
+		if nqn == "" || nqn == NVMF_DISCOVERY_NQN {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(RUN_NVMF, nqn)); err != nil {
+			klog.V(4).Infof("Orphan cleanup: controller %s of %s was not connected by this driver, keeping it", ctrl, nqn)
+			continue
+		}
+		if _, ok := staged[nqn]; ok {
+			continue
+		}
+
+		klog.Infof("Orphan cleanup: disconnecting controller %s of %s, no staging path references it", ctrl, nqn)
+		if err := _disconnect(fmt.Sprintf("%s/%s/delete_controller", SYS_NVMF, ctrl), timeout); err != nil {
+			klog.Errorf("Orphan cleanup: failed to disconnect controller %s: %v", ctrl, err)
+			continue
+		}
+		orphans[nqn] = struct{}{}
+	}
+
+	for nqn := range orphans {
+		if err := os.RemoveAll(filepath.Join(RUN_NVMF, nqn)); err != nil {
+			klog.Warningf("Orphan cleanup: failed to remove tracking files of %s: %v", nqn, err)
+		}
+	}
+
+	klog.Infof("Orphan cleanup: disconnected %d orphaned NQN(s)", len(orphans))
+}
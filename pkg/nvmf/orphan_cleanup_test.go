@@ -0,0 +1,134 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// writeStagedConnector persists the connector of nqn in the staging target
+// path rel of csiDir, as a successful stage does
+func writeStagedConnector(t *testing.T, csiDir, rel, nqn string) string {
+	t.Helper()
+	stagingPath := stagingVolumePath(filepath.Join(csiDir, rel), nqn)
+	if err := os.MkdirAll(filepath.Dir(stagingPath), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := persistConnectorFile(&Connector{TargetNqn: nqn, HostNqn: testNodeHostNqn}, connectorFilePath(stagingPath)); err != nil {
+		t.Fatal(err)
+	}
+	return connectorFilePath(stagingPath)
+}
+
+func TestStagedConnectorFiles(t *testing.T) {
+	const (
+		fsNqn    = "nqn.2024-01.io.example:fs-volume"
+		blockNqn = "nqn.2024-01.io.example:block-volume"
+		oldNqn   = "nqn.2024-01.io.example:pv-layout"
+	)
+
+	tests := []struct {
+		name    string
+		staged  map[string]string // staging target path by NQN
+		other   []string          // files that are not connector files of staging paths
+		wantNqn []string
+	}{
+		{
+			name:    "no staged volume",
+			wantNqn: []string{},
+		},
+		{
+			name: "filesystem and block volumes",
+			staged: map[string]string{
+				fsNqn:    filepath.Join(DefaultDriverName, "0a1b2c", "globalmount"),
+				blockNqn: filepath.Join("volumeDevices", "staging", "pv-block"),
+			},
+			wantNqn: []string{blockNqn, fsNqn},
+		},
+		{
+			name: "per-PV filesystem layout",
+			staged: map[string]string{
+				oldNqn: filepath.Join("pv", "pv-old", "globalmount"),
+			},
+			wantNqn: []string{oldNqn},
+		},
+		{
+			name: "publish paths are not staging paths",
+			staged: map[string]string{
+				blockNqn: filepath.Join("volumeDevices", "staging", "pv-block"),
+			},
+			other:   []string{filepath.Join("volumeDevices", "publish", "pv-block", "pod-uid.json")},
+			wantNqn: []string{blockNqn},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			csiDir := t.TempDir()
+			want := []string{}
+			for nqn, rel := range test.staged {
+				want = append(want, writeStagedConnector(t, csiDir, rel, nqn))
+			}
+			for _, rel := range test.other {
+				path := filepath.Join(csiDir, rel)
+				if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("{}"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, err := stagedConnectorFiles(csiDir)
+			if err != nil {
+				t.Fatalf("stagedConnectorFiles: %v", err)
+			}
+			if files == nil {
+				files = []string{}
+			}
+			sort.Strings(files)
+			sort.Strings(want)
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("stagedConnectorFiles = %v, want %v", files, want)
+			}
+
+			nqns, err := stagedNQNs(csiDir)
+			if err != nil {
+				t.Fatalf("stagedNQNs: %v", err)
+			}
+			got := []string{}
+			for nqn := range nqns {
+				got = append(got, nqn)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.wantNqn) {
+				t.Errorf("stagedNQNs = %v, want %v", got, test.wantNqn)
+			}
+		})
+	}
+}
+
+func TestStagedConnectorFilesMissingDir(t *testing.T) {
+	_, err := stagedConnectorFiles(filepath.Join(t.TempDir(), "missing"))
+	if !os.IsNotExist(err) {
+		t.Errorf("stagedConnectorFiles of a missing directory error = %v, want not exist", err)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parameterDrift compares the parameters of a ValidateVolumeCapabilities
+// request with those recorded for the volume when it was provisioned, and
+// returns one description per parameter that differs, e.g. because the
+// StorageClass was changed after the volume was created. Only the parameters
+// present in the request are compared. The driver has no TLS parameter, and
+// the authentication secrets are never recorded, so neither can drift.
+func (r *DeviceRegistry) parameterDrift(volumeID string, raw map[string]string, params *VolumeParams) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	device, exists := r.devices[volumeID]
+	if !exists {
+		return nil
+	}
+
+	drift := []string{}
+	differs := func(key, requested, recorded string) {
+		if requested != recorded {
+			drift = append(drift, fmt.Sprintf("%s is %q, volume provisioned with %q", key, requested, recorded))
+		}
+	}
+
+	if params.Transport != "" {
+		differs(paramType, params.Transport, strings.ToLower(device.Transport))
+	}
+	if _, exists := raw[paramSkipWipe]; exists {
+		differs(paramSkipWipe, strconv.FormatBool(params.SkipWipe), strconv.FormatBool(device.SkipWipe))
+	}
+	if _, exists := raw[paramAllowedHostNqns]; exists {
+		differs(paramAllowedHostNqns, strings.Join(params.AllowedHosts, ","), strings.Join(device.AllowedHosts, ","))
+	}
+	requestedQoS, recordedQoS := qosValues(params.QoS), qosValues(device.QoS)
+	for _, key := range []string{paramMaxIops, paramMaxBandwidthMBps, paramBurstIops} {
+		if _, exists := raw[key]; exists {
+			differs(key, requestedQoS[key], recordedQoS[key])
+		}
+	}
+
+	return drift
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestValidateVolumeCapabilitiesParameterDrift(t *testing.T) {
+	const (
+		allowedHost = "nqn.2014-08.org.nvmexpress:uuid:6f1d9a52-0c3e-4b8f-9a27-5d4e8c1b2a30"
+		otherHost   = "nqn.2014-08.org.nvmexpress:uuid:c3a8e7d1-4f2b-4e6a-8b19-0d5f7a9c6e42"
+	)
+	provisioned := map[string]string{paramSkipWipe: "true", paramAllowedHostNqns: allowedHost}
+
+	tests := []struct {
+		name string
+		// params are the StorageClass parameters of the request, over those
+		// the volume was provisioned with unless replaceParams is set
+		params        map[string]string
+		replaceParams bool
+		// wantMessage are parts of the message of an unconfirmed volume,
+		// confirmed if empty
+		wantMessage []string
+	}{
+		{name: "matching parameters"},
+		{name: "matching transport in capitals", params: map[string]string{paramType: "TCP"}},
+		{name: "matching subset of the parameters", params: map[string]string{paramType: "tcp"}, replaceParams: true},
+		{name: "no parameters", replaceParams: true},
+		{
+			name:        "drifted transport",
+			params:      map[string]string{paramType: "rdma"},
+			wantMessage: []string{`targetTrType is "rdma", volume provisioned with "tcp"`},
+		},
+		{
+			name:        "drifted skip wipe",
+			params:      map[string]string{paramSkipWipe: "false"},
+			wantMessage: []string{`skipWipe is "false", volume provisioned with "true"`},
+		},
+		{
+			name:   "drifted allowed hosts and transport",
+			params: map[string]string{paramType: "rdma", paramAllowedHostNqns: otherHost + "," + allowedHost},
+			wantMessage: []string{
+				`targetTrType is "rdma"`,
+				`allowedHostNqns is "` + allowedHost + "," + otherHost + `", volume provisioned with "` + allowedHost + `"`,
+			},
+		},
+		{
+			name:        "invalid parameter",
+			params:      map[string]string{paramType: "fc"},
+			wantMessage: []string{"targetTrType must be tcp or rdma"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend(BackendCapabilityHostAcl))
+			c.Driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			created := createRequest("pv-1", provisioned)
+			resp, err := c.CreateVolume(ctx, created)
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+
+			params := map[string]string{}
+			if !test.replaceParams {
+				for key, value := range created.GetParameters() {
+					params[key] = value
+				}
+			}
+			for key, value := range test.params {
+				params[key] = value
+			}
+
+			// The parameters are compared with the allocation of the registry,
+			// and with its record in the store after a restart
+			restarted := &ControllerServer{Driver: c.Driver, deviceRegistry: NewDeviceRegistry(c.Driver)}
+			for _, server := range []*ControllerServer{c, restarted} {
+				validated, err := server.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+					VolumeId:           resp.GetVolume().GetVolumeId(),
+					VolumeCapabilities: created.GetVolumeCapabilities(),
+					Parameters:         params,
+				})
+				if err != nil {
+					t.Fatalf("ValidateVolumeCapabilities: %v", err)
+				}
+				if len(test.wantMessage) == 0 {
+					if validated.GetConfirmed() == nil {
+						t.Errorf("ValidateVolumeCapabilities not confirmed: %s", validated.GetMessage())
+					}
+					continue
+				}
+				if validated.GetConfirmed() != nil {
+					t.Errorf("ValidateVolumeCapabilities of drifted parameters confirmed")
+				}
+				for _, part := range test.wantMessage {
+					if !strings.Contains(validated.GetMessage(), part) {
+						t.Errorf("ValidateVolumeCapabilities message %q does not contain %q", validated.GetMessage(), part)
+					}
+				}
+			}
+		})
+	}
+}
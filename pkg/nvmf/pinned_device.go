@@ -0,0 +1,45 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import "fmt"
+
+// paramPinnedNqn binds the volume to a pre-existing subsystem, or namespace
+// with "<nqn>#<nsid>", instead of selecting a device, for static provisioning
+const paramPinnedNqn = "nqn"
+
+// pinnedDevice returns the device the request is pinned to if it is among the
+// free candidates. Placement hints do not apply, the capacity of the request
+// still does. Caller must hold the mutex.
+func (r *DeviceRegistry) pinnedDevice(candidates []*VolumeInfo, req *AllocationRequest) (*VolumeInfo, error) {
+	for _, device := range candidates {
+		if device.volumeID() == req.PinnedID {
+			registryLog.V(4).Infof("Volume %s is pinned to device %s", req.VolumeName, req.PinnedID)
+			return selectDevice([]*VolumeInfo{device}, req)
+		}
+	}
+
+	device, exists := r.devices[req.PinnedID]
+	switch {
+	case !exists:
+		return nil, fmt.Errorf("%w: pinned device %s is not discovered", ErrDeviceNotFound, req.PinnedID)
+	case device.IsAllocated:
+		return nil, fmt.Errorf("%w: pinned device %s is allocated to volume %s", ErrDeviceNotFree, req.PinnedID, device.VolName)
+	}
+
+	return nil, fmt.Errorf("%w: pinned device %s is quarantined, filtered out or pending reclaim", ErrDeviceNotFree, req.PinnedID)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPinnedDevice(t *testing.T) {
+	const (
+		otherNqn   = "nqn.2024-01.io.example:volume-2"
+		missingNqn = "nqn.2024-01.io.example:volume-9"
+	)
+
+	tests := []struct {
+		name   string
+		pinned string
+		// allocated is the device allocated to another volume beforehand
+		allocated string
+		// quarantined deletes the volume of the allocated device, within the retention
+		quarantined bool
+		// added is the device exported once the registry discovered the others
+		added string
+		want  codes.Code
+	}{
+		{name: "free device", pinned: otherNqn},
+		{name: "device the selection would pick", pinned: testVolumeNqn},
+		{name: "device added since the discovery", pinned: missingNqn, allocated: testVolumeNqn, added: missingNqn},
+		{name: "device not discovered", pinned: missingNqn, want: codes.NotFound},
+		{name: "device allocated to another volume", pinned: otherNqn, allocated: otherNqn, want: codes.FailedPrecondition},
+		{name: "device quarantined", pinned: otherNqn, allocated: otherNqn, quarantined: true, want: codes.FailedPrecondition},
+		{name: "invalid NQN", pinned: "volume-2", want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.reclaimRetention = time.Hour
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, otherNqn)
+
+			if test.allocated != "" {
+				if _, err := c.CreateVolume(ctx, createRequest("pv-0", map[string]string{paramPinnedNqn: test.allocated})); err != nil {
+					t.Fatalf("CreateVolume(pv-0): %v", err)
+				}
+				if test.quarantined {
+					if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: test.allocated}); err != nil {
+						t.Fatalf("DeleteVolume(pv-0): %v", err)
+					}
+				}
+			}
+			if test.added != "" {
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, otherNqn, test.added)
+			}
+
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", map[string]string{paramPinnedNqn: test.pinned}))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			if err != nil {
+				if _, allocated := c.deviceRegistry.volumeToNQN["pv-1"]; allocated {
+					t.Error("pv-1 was allocated a device")
+				}
+				return
+			}
+			if got := resp.GetVolume().GetVolumeId(); got != test.pinned {
+				t.Errorf("CreateVolume = %s, want the pinned device %s", got, test.pinned)
+			}
+
+			// A retry returns the pinned device again
+			retried, err := c.CreateVolume(ctx, createRequest("pv-1", map[string]string{paramPinnedNqn: test.pinned}))
+			if err != nil || retried.GetVolume().GetVolumeId() != test.pinned {
+				t.Errorf("retried CreateVolume = %v, %v, want %s", retried.GetVolume().GetVolumeId(), err, test.pinned)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Placement hints of a StorageClass. Volumes sharing an affinity key are
+// co-located on the same physical target, volumes sharing an anti-affinity key
+// are spread across distinct targets. The keys are recorded in the volume
+// context, so that the placement survives a restart.
+const (
+	paramAffinityKey     = "affinityKey"
+	paramAntiAffinityKey = "antiAffinityKey"
+
+	// paramStrict fails allocations whose placement hints cannot be satisfied
+	// instead of falling back to any device
+	paramStrict = "strict"
+)
+
+// placementHints are the placement constraints of an allocation
+type placementHints struct {
+	AffinityKey     string
+	AntiAffinityKey string
+	Strict          bool
+}
+
+// parsePlacementHints returns the placement hints of the StorageClass parameters
+func parsePlacementHints(params map[string]string) (placementHints, error) {
+	hints := placementHints{
+		AffinityKey:     params[paramAffinityKey],
+		AntiAffinityKey: params[paramAntiAffinityKey],
+	}
+
+	if value, exists := params[paramStrict]; exists {
+		strict, err := strconv.ParseBool(value)
+		if err != nil {
+			return placementHints{}, fmt.Errorf("invalid %s: %s", paramStrict, value)
+		}
+		hints.Strict = strict
+	}
+
+	return hints, nil
+}
+
+func (h placementHints) isSet() bool {
+	return h.AffinityKey != "" || h.AntiAffinityKey != ""
+}
+
+// physicalTarget identifies the array exporting the device by the addresses of
+// its endpoints, so that the subsystems and namespaces of one array and its
+// ports share a target. Devices without endpoints are identified by subsystem.
+func (v *VolumeInfo) physicalTarget() string {
+	hosts := map[string]struct{}{}
+	for _, endpoint := range v.Endpoints {
+		host, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			host = endpoint
+		}
+		hosts[host] = struct{}{}
+	}
+	if len(hosts) == 0 {
+		return v.Nqn
+	}
+
+	sorted := make([]string, 0, len(hosts))
+	for host := range hosts {
+		sorted = append(sorted, host)
+	}
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, ",")
+}
+
+// placeDevice selects a device for the request among the candidates, on a target
+// holding the affinity key if any and not holding the anti-affinity key.
+// Unless strict, a request whose hints cannot be satisfied falls back to any
+// candidate. A request pinned to a device gets that device only. Caller must
+// hold the mutex.
+func (r *DeviceRegistry) placeDevice(candidates []*VolumeInfo, req *AllocationRequest) (*VolumeInfo, error) {
+	if req.PinnedID != "" {
+		return r.pinnedDevice(candidates, req)
+	}
+
+	hints := req.Placement
+	if !hints.isSet() {
+		return selectDevice(candidates, req)
+	}
+
+	colocated := map[string]struct{}{}
+	spread := map[string]struct{}{}
+	for _, device := range r.devices {
+		if !device.IsAllocated {
+			continue
+		}
+		if hints.AffinityKey != "" && device.AffinityKey == hints.AffinityKey {
+			colocated[device.physicalTarget()] = struct{}{}
+		}
+		if hints.AntiAffinityKey != "" && device.AntiAffinityKey == hints.AntiAffinityKey {
+			spread[device.physicalTarget()] = struct{}{}
+		}
+	}
+
+	// The first volume of an affinity key may be placed on any target
+	preferred := make([]*VolumeInfo, 0, len(candidates))
+	for _, device := range candidates {
+		target := device.physicalTarget()
+		if _, exists := colocated[target]; len(colocated) > 0 && !exists {
+			continue
+		}
+		if _, exists := spread[target]; exists {
+			continue
+		}
+		preferred = append(preferred, device)
+	}
+
+	device, err := selectDevice(preferred, req)
+	if err == nil {
+		return device, nil
+	}
+	if hints.Strict {
+		return nil, fmt.Errorf("%w: placement of volume %s with affinity key %q and anti-affinity key %q cannot be satisfied by %d free device(s)",
+			ErrNoSuitableDevice, req.VolumeName, hints.AffinityKey, hints.AntiAffinityKey, len(candidates))
+	}
+
+	klog.Warningf("Placement of volume %s with affinity key %q and anti-affinity key %q cannot be satisfied, ignoring it: %v",
+		req.VolumeName, hints.AffinityKey, hints.AntiAffinityKey, err)
+	return selectDevice(candidates, req)
+}
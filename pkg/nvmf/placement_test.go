@@ -0,0 +1,112 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPlacementHints(t *testing.T) {
+	tests := []struct {
+		name string
+		// devices are the free devices of each of the arrays 192.0.2.10 and 192.0.2.11
+		devices [2]int
+		hints   map[string]string
+		// volumes is the number of volumes created with the hints, in turn
+		volumes int
+		// want is the code of the last creation
+		want codes.Code
+		// wantTargets is the number of arrays backing the created volumes
+		wantTargets int
+	}{
+		{name: "spread", devices: [2]int{2, 2}, hints: map[string]string{paramAntiAffinityKey: "db"}, volumes: 2, wantTargets: 2},
+		{name: "co-locate", devices: [2]int{2, 2}, hints: map[string]string{paramAffinityKey: "db"}, volumes: 2, wantTargets: 1},
+		{name: "spread beyond the arrays falls back", devices: [2]int{2, 2}, hints: map[string]string{paramAntiAffinityKey: "db"}, volumes: 3, wantTargets: 2},
+		{name: "strict spread beyond the arrays", devices: [2]int{2, 2}, hints: map[string]string{paramAntiAffinityKey: "db", paramStrict: "true"}, volumes: 3, want: codes.ResourceExhausted, wantTargets: 2},
+		{name: "co-locate beyond the array falls back", devices: [2]int{1, 1}, hints: map[string]string{paramAffinityKey: "db"}, volumes: 2, wantTargets: 2},
+		{name: "strict co-locate beyond the array", devices: [2]int{1, 1}, hints: map[string]string{paramAffinityKey: "db", paramStrict: "true"}, volumes: 2, want: codes.ResourceExhausted, wantTargets: 1},
+		{name: "invalid strict", devices: [2]int{1, 1}, hints: map[string]string{paramStrict: "always"}, volumes: 1, want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			for i, addr := range []string{"192.0.2.10", "192.0.2.11"} {
+				nqns := []string{}
+				for j := 0; j < test.devices[i]; j++ {
+					nqns = append(nqns, fmt.Sprintf("nqn.2024-01.io.example:array-%d-volume-%d", i, j))
+				}
+				client.discovery[addr+":4420"] = discoveryPage(addr, "4420", nqns...)
+			}
+
+			params := map[string]string{paramAddr: "192.0.2.10,192.0.2.11"}
+			for key, value := range test.hints {
+				params[key] = value
+			}
+			var err error
+			for i := 0; i < test.volumes; i++ {
+				_, err = c.CreateVolume(context.Background(), createRequest(fmt.Sprintf("pv-%d", i), params))
+				if err != nil && i < test.volumes-1 {
+					t.Fatalf("CreateVolume(pv-%d): %v", i, err)
+				}
+			}
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("last CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+
+			targets := map[string]struct{}{}
+			for _, device := range c.deviceRegistry.devices {
+				if device.IsAllocated {
+					targets[device.physicalTarget()] = struct{}{}
+				}
+			}
+			if len(targets) != test.wantTargets {
+				t.Errorf("volumes placed on %d array(s) %v, want %d", len(targets), targets, test.wantTargets)
+			}
+		})
+	}
+}
+
+func TestPlacementRestored(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+
+	resp, err := c.CreateVolume(ctx, createRequest("pv-1", map[string]string{paramAntiAffinityKey: "db"}))
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	// The restarted controller learns the key of the volume from its PV
+	pv := driverPV("pv-1", resp.GetVolume().GetVolumeId(), resp.GetVolume().GetVolumeContext())
+	restarted, _ := newTestControllerServer(t, newFakeBackend(), pv)
+	restarted.Driver.metadata = c.Driver.metadata
+	if err := restarted.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		t.Fatalf("EnsureInitialSync: %v", err)
+	}
+	device, exists := restarted.deviceRegistry.devices[testVolumeNqn]
+	if !exists || device.AntiAffinityKey != "db" {
+		t.Errorf("restored device = %+v, want the anti-affinity key db", device)
+	}
+}
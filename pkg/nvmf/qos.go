@@ -0,0 +1,171 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// StorageClass parameters limiting the I/O of a volume, applied by backends
+// with the qos capability and recorded in the volume context
+const (
+	paramMaxIops          = "maxIops"
+	paramMaxBandwidthMBps = "maxBandwidthMBps"
+	paramBurstIops        = "burstIops"
+
+	// paramQoSRequired fails CreateVolume when the backend cannot apply the
+	// limits, instead of provisioning the volume without them
+	paramQoSRequired = "qosRequired"
+)
+
+// qosApplyTimeout bounds the reapplication of the limits of one volume
+const qosApplyTimeout = 30 * time.Second
+
+// isZero reports whether the QoS sets no limit
+func (q BackendQoS) isZero() bool {
+	return q == BackendQoS{}
+}
+
+// parseQoS parses the limits of the parameters. Each limit is a positive
+// integer, a burst requires an IOPS limit no greater than it.
+func parseQoS(values map[string]string) (BackendQoS, error) {
+	qos := BackendQoS{}
+	for key, limit := range map[string]*int64{
+		paramMaxIops:          &qos.MaxIops,
+		paramMaxBandwidthMBps: &qos.MaxBandwidthMBps,
+		paramBurstIops:        &qos.BurstIops,
+	} {
+		value, exists := values[key]
+		if !exists {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return BackendQoS{}, fmt.Errorf("%s must be a positive integer, got: %q", key, value)
+		}
+		*limit = parsed
+	}
+
+	if qos.BurstIops > 0 && qos.MaxIops == 0 {
+		return BackendQoS{}, fmt.Errorf("%s requires %s", paramBurstIops, paramMaxIops)
+	}
+	if qos.BurstIops > 0 && qos.BurstIops < qos.MaxIops {
+		return BackendQoS{}, fmt.Errorf("%s %d must not be less than %s %d", paramBurstIops, qos.BurstIops, paramMaxIops, qos.MaxIops)
+	}
+
+	return qos, nil
+}
+
+// qosValues returns the volume context entries of the limits that are set
+func qosValues(qos BackendQoS) map[string]string {
+	values := map[string]string{}
+	for key, limit := range map[string]int64{
+		paramMaxIops:          qos.MaxIops,
+		paramMaxBandwidthMBps: qos.MaxBandwidthMBps,
+		paramBurstIops:        qos.BurstIops,
+	} {
+		if limit > 0 {
+			values[key] = strconv.FormatInt(limit, 10)
+		}
+	}
+
+	return values
+}
+
+// checkQoS verifies that the backend can apply the requested limits. Without
+// the qos capability, the limits are dropped with a warning unless required.
+func (c *ControllerServer) checkQoS(params *VolumeParams) error {
+	if params.QoS.isZero() {
+		return nil
+	}
+	if _, ok := c.Driver.qosApplier(); ok {
+		return nil
+	}
+
+	if params.QoSRequired {
+		return status.Errorf(codes.InvalidArgument, "backend %s cannot apply the QoS limits required by %s", c.Driver.backend.Name(), paramQoSRequired)
+	}
+	klog.Warningf("Backend %s cannot apply QoS limits, provisioning without %+v", c.Driver.backend.Name(), params.QoS)
+	params.QoS = BackendQoS{}
+
+	return nil
+}
+
+// applyQoS sets the limits of a newly allocated volume. A volume without
+// limits has those of a previous volume of its namespace removed, which only
+// warns on failure.
+func (c *ControllerServer) applyQoS(ctx context.Context, device *VolumeInfo, qos BackendQoS) error {
+	applier, ok := c.Driver.qosApplier()
+	if !ok {
+		return nil
+	}
+
+	klog.V(4).Infof("Applying QoS %+v to volume %s", qos, device.volumeID())
+	if err := applier.ApplyQoS(ctx, device.Nqn, device.Nsid, qos); err != nil {
+		if qos.isZero() {
+			klog.Warningf("Failed to remove the QoS limits of volume %s: %v", device.volumeID(), err)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// reapplyQoS applies the recorded limits of the allocated volumes again, e.g.
+// after the backend lost them while the controller was down. It runs at
+// startup and with each reconcile cycle.
+func (r *DeviceRegistry) reapplyQoS(ctx context.Context) {
+	applier, ok := r.Driver.qosApplier()
+	if !ok {
+		return
+	}
+
+	limits := r.AllocatedQoS()
+	for volumeID, qos := range limits {
+		nqn, nsid := parseVolumeID(volumeID)
+		applyCtx, cancel := context.WithTimeout(ctx, qosApplyTimeout)
+		if err := applier.ApplyQoS(applyCtx, nqn, nsid, qos); err != nil {
+			klog.Warningf("Failed to reapply QoS %+v to volume %s: %v", qos, volumeID, err)
+		}
+		cancel()
+	}
+
+	registryLog.V(4).Infof("Reapplied the QoS limits of %d volume(s)", len(limits))
+}
+
+// AllocatedQoS returns the limits of the allocated volumes that have some, by volume ID
+func (r *DeviceRegistry) AllocatedQoS() map[string]BackendQoS {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	limits := make(map[string]BackendQoS)
+	for id, device := range r.devices {
+		if device.IsAllocated && !device.QoS.isZero() {
+			limits[id] = device.QoS
+		}
+	}
+
+	return limits
+}
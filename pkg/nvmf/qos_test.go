@@ -0,0 +1,174 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseQoS(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		want    BackendQoS
+		wantErr bool
+	}{
+		{name: "no limits"},
+		{name: "IOPS", values: map[string]string{paramMaxIops: "1000"}, want: BackendQoS{MaxIops: 1000}},
+		{name: "bandwidth", values: map[string]string{paramMaxBandwidthMBps: "250"}, want: BackendQoS{MaxBandwidthMBps: 250}},
+		{
+			name:   "all limits",
+			values: map[string]string{paramMaxIops: "1000", paramMaxBandwidthMBps: "250", paramBurstIops: "5000"},
+			want:   BackendQoS{MaxIops: 1000, MaxBandwidthMBps: 250, BurstIops: 5000},
+		},
+		{name: "burst equal to the IOPS limit", values: map[string]string{paramMaxIops: "1000", paramBurstIops: "1000"}, want: BackendQoS{MaxIops: 1000, BurstIops: 1000}},
+		{name: "zero", values: map[string]string{paramMaxIops: "0"}, wantErr: true},
+		{name: "negative", values: map[string]string{paramMaxBandwidthMBps: "-1"}, wantErr: true},
+		{name: "not an integer", values: map[string]string{paramMaxIops: "1k"}, wantErr: true},
+		{name: "empty", values: map[string]string{paramBurstIops: ""}, wantErr: true},
+		{name: "burst without an IOPS limit", values: map[string]string{paramBurstIops: "5000"}, wantErr: true},
+		{name: "burst below the IOPS limit", values: map[string]string{paramMaxIops: "1000", paramBurstIops: "500"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseQoS(test.values)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseQoS error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseQoS = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeQoS(t *testing.T) {
+	limits := map[string]string{paramMaxIops: "1000", paramMaxBandwidthMBps: "250", paramBurstIops: "5000"}
+	failure := errors.New("backend unreachable")
+
+	tests := []struct {
+		name string
+		// supported gives the backend the qos capability
+		supported bool
+		params    map[string]string
+		qosErrs   []error
+		want      codes.Code
+		// wantApplied are the limits applied to the volume, none if nil
+		wantApplied *BackendQoS
+		// wantContext are the limits recorded in the volume context
+		wantContext map[string]string
+	}{
+		{
+			name: "applied", supported: true, params: limits,
+			wantApplied: &BackendQoS{MaxIops: 1000, MaxBandwidthMBps: 250, BurstIops: 5000}, wantContext: limits,
+		},
+		// The limits of a previous volume of the device are removed
+		{name: "no limits", supported: true, wantApplied: &BackendQoS{}, wantContext: map[string]string{}},
+		{name: "removal failure ignored", supported: true, qosErrs: []error{failure}, wantContext: map[string]string{}},
+		{name: "apply failure", supported: true, params: limits, qosErrs: []error{failure}, want: codes.Internal},
+		{name: "invalid limits", supported: true, params: map[string]string{paramMaxIops: "-1"}, want: codes.InvalidArgument},
+		{name: "unsupported", params: limits, wantContext: map[string]string{}},
+		{name: "unsupported and required", params: map[string]string{paramMaxIops: "1000", paramQoSRequired: "true"}, want: codes.InvalidArgument},
+		{
+			name: "supported and required", supported: true, params: map[string]string{paramMaxIops: "1000", paramQoSRequired: "true"},
+			wantApplied: &BackendQoS{MaxIops: 1000}, wantContext: map[string]string{paramMaxIops: "1000"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend()
+			if test.supported {
+				backend = newFakeBackend(BackendCapabilityQoS)
+			}
+			backend.qosErrs = test.qosErrs
+			c, _ := newTestControllerServer(t, backend)
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", test.params))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+
+			wantApplied := []appliedQoS(nil)
+			if test.wantApplied != nil {
+				wantApplied = []appliedQoS{{namespace: namespaceRef{nqn: testVolumeNqn}, qos: *test.wantApplied}}
+			}
+			if !reflect.DeepEqual(backend.applied, wantApplied) {
+				t.Errorf("applied QoS = %+v, want %+v", backend.applied, wantApplied)
+			}
+			if err != nil {
+				if _, allocated := c.deviceRegistry.volumeToNQN["pv-1"]; allocated {
+					t.Error("pv-1 was allocated a device")
+				}
+				return
+			}
+
+			volumeContext := resp.GetVolume().GetVolumeContext()
+			for _, key := range []string{paramMaxIops, paramMaxBandwidthMBps, paramBurstIops} {
+				if got, want := volumeContext[key], test.wantContext[key]; got != want {
+					t.Errorf("volume context %s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReapplyQoS(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeBackend(BackendCapabilityQoS)
+	c, _ := newTestControllerServer(t, backend)
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2)
+	if _, err := c.CreateVolume(ctx, createRequest("pv-limited", map[string]string{paramPinnedNqn: testVolumeNqn, paramMaxIops: "1000"})); err != nil {
+		t.Fatalf("CreateVolume(pv-limited): %v", err)
+	}
+	if _, err := c.CreateVolume(ctx, createRequest("pv-unlimited", map[string]string{paramPinnedNqn: maintenanceNqn2})); err != nil {
+		t.Fatalf("CreateVolume(pv-unlimited): %v", err)
+	}
+
+	// After a restart the limits are restored from the allocation records in
+	// the store and applied again, to the limited volume only
+	backend.applied = nil
+	restarted := NewDeviceRegistry(c.Driver)
+	if err := restarted.EnsureInitialSync(ctx); err != nil {
+		t.Fatalf("EnsureInitialSync: %v", err)
+	}
+	restarted.reapplyQoS(ctx)
+	want := []appliedQoS{{namespace: namespaceRef{nqn: testVolumeNqn}, qos: BackendQoS{MaxIops: 1000}}}
+	if !reflect.DeepEqual(backend.applied, want) {
+		t.Errorf("reapplied QoS = %+v, want %+v", backend.applied, want)
+	}
+
+	// A failure is retried with the next reapplication
+	backend.applied = nil
+	backend.qosErrs = []error{errors.New("backend unreachable")}
+	restarted.reapplyQoS(ctx)
+	restarted.reapplyQoS(ctx)
+	if !reflect.DeepEqual(backend.applied, want) {
+		t.Errorf("reapplied QoS after a failure = %+v, want %+v", backend.applied, want)
+	}
+}
@@ -0,0 +1,317 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// metadataKindQuarantine records the devices of deleted volumes awaiting reclaim
+const metadataKindQuarantine = "quarantine"
+
+// maxQuarantineCheckInterval bounds the delay between the expiry of a quarantine
+// and the release of its device
+const maxQuarantineCheckInterval = time.Minute
+
+// quarantineRecord is the persisted state of a quarantined device
+type quarantineRecord struct {
+	VolumeID    string    `json:"volumeId"`
+	VolumeName  string    `json:"volumeName"`
+	Transport   string    `json:"transport"`
+	Endpoints   []string  `json:"endpoints,omitempty"`
+	Capacity    int64     `json:"capacityBytes,omitempty"`
+	UsedBytes   int64     `json:"usedBytes,omitempty"`
+	VolumeBytes int64     `json:"volumeBytes,omitempty"`
+	SkipWipe    bool      `json:"skipWipe,omitempty"`
+	Expiry      time.Time `json:"expiry"`
+	DeletedAt   time.Time `json:"deletedAt,omitempty"`
+}
+
+// isQuarantined reports whether the device belongs to a deleted volume that
+// can still be undeleted
+func (v *VolumeInfo) isQuarantined() bool {
+	return !v.QuarantinedUntil.IsZero()
+}
+
+// needsWipe reports whether the device must be wiped before it is released
+func (r *DeviceRegistry) needsWipe(device *VolumeInfo) bool {
+	return r.Driver.wipeOnDelete && !device.SkipWipe
+}
+
+// ReclaimDevice releases the device of a deleted volume. With a retention
+// window the device is quarantined until the window expires, so that the volume
+// can be undeleted by a CreateVolume of the same name. Devices to be wiped are
+// quarantined at least until the wipe succeeded, so that they are never
+// returned to the pool with the data of the deleted volume.
+func (r *DeviceRegistry) ReclaimDevice(ctx context.Context, volumeID string) error {
+	r.mutex.Lock()
+	device, exists := r.devices[volumeID]
+	if exists && device.isQuarantined() {
+		r.mutex.Unlock()
+		klog.Infof("Device %s of volume %s is already quarantined", volumeID, device.VolName)
+		return nil
+	}
+	if !exists || !device.IsAllocated || device.Dynamic || !r.needsWipe(device) &&
+		(r.Driver.reclaimRetention == 0 || device.IsExcluded || device.IsStale) {
+		r.mutex.Unlock()
+		return r.releaseAllocated(ctx, volumeID)
+	}
+
+	expiry, err := r.quarantine(ctx, volumeID, device)
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Without a retention window the device is wiped and released right away
+	if r.Driver.reclaimRetention == 0 {
+		r.reclaim(ctx, volumeID, expiry)
+	}
+	return nil
+}
+
+// quarantine persists and records the quarantine of the device of a deleted
+// volume and returns its expiry. Caller must hold the mutex.
+func (r *DeviceRegistry) quarantine(ctx context.Context, volumeID string, device *VolumeInfo) (time.Time, error) {
+
+	now := time.Now()
+	expiry := now.Add(r.Driver.reclaimRetention)
+	record := &quarantineRecord{
+		VolumeID:    volumeID,
+		VolumeName:  device.VolName,
+		Transport:   device.Transport,
+		Endpoints:   device.Endpoints,
+		Capacity:    device.Capacity,
+		UsedBytes:   device.UsedBytes,
+		VolumeBytes: device.VolumeBytes,
+		SkipWipe:    device.SkipWipe,
+		Expiry:      expiry,
+		DeletedAt:   now,
+	}
+	if err := r.Driver.metadata.Put(ctx, metadataKindQuarantine, volumeID, record); err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", ErrEtcdUnavailable, err)
+	}
+	// A retried delete quarantines the device again, replacing the record
+	if err := r.removeAllocation(ctx, device.VolName); err != nil {
+		return time.Time{}, err
+	}
+
+	// The device keeps its used bytes, so it is not counted as free capacity
+	delete(r.volumeToNQN, device.VolName)
+	r.quarantined[device.VolName] = volumeID
+	device.IsAllocated = false
+	device.AffinityKey = ""
+	device.AntiAffinityKey = ""
+	device.PublishedNodes = nil
+	device.QuarantinedUntil = expiry
+
+	klog.Infof("Quarantined device %s of deleted volume %s until %s", volumeID, device.VolName, expiry.Format(time.RFC3339))
+	return expiry, nil
+}
+
+// undelete allocates the quarantined device of a deleted volume to it again.
+// Once the retention expired the device may be wiped, so it is not undeleted.
+// Caller must hold the mutex.
+func (r *DeviceRegistry) undelete(ctx context.Context, req *AllocationRequest) (*VolumeInfo, bool, error) {
+	volumeName := req.VolumeName
+	id, exists := r.quarantined[volumeName]
+	if !exists || !r.devices[id].QuarantinedUntil.After(time.Now()) {
+		return nil, false, nil
+	}
+
+	device := r.devices[id]
+	if err := r.persistAllocation(ctx, device, req, device.UsedBytes, device.VolumeBytes); err != nil {
+		return nil, true, err
+	}
+	if err := r.Driver.metadata.Delete(ctx, metadataKindQuarantine, id); err != nil {
+		r.forgetAllocation(volumeName)
+		return nil, true, fmt.Errorf("%w: %v", ErrEtcdUnavailable, err)
+	}
+
+	delete(r.quarantined, volumeName)
+	r.volumeToNQN[volumeName] = id
+	device.IsAllocated = true
+	device.QuarantinedUntil = time.Time{}
+	device.SkipWipe = req.SkipWipe
+	device.AffinityKey = req.Placement.AffinityKey
+	device.AntiAffinityKey = req.Placement.AntiAffinityKey
+	device.QoS = req.QoS
+	device.AllowedHosts = req.AllowedHosts
+	r.recordAllocation(id, device)
+
+	klog.Infof("Undeleted volume %s, reallocated quarantined device %s", volumeName, id)
+	return device, true, nil
+}
+
+// restoreQuarantine reloads the quarantined devices persisted before a restart.
+// They are stale until discovery finds them again. Caller must hold the mutex.
+func (r *DeviceRegistry) restoreQuarantine(ctx context.Context) error {
+	records, err := r.Driver.metadata.List(ctx, metadataKindQuarantine)
+	if err != nil {
+		return err
+	}
+
+	// Superseded records are left to the record GC
+	superseded := 0
+	for id, data := range records {
+		record := &quarantineRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			klog.Warningf("Ignoring malformed quarantine record of %s: %v", id, err)
+			continue
+		}
+		if _, exists := r.devices[id]; exists {
+			registryLog.V(4).Infof("Quarantined device %s is allocated again, ignoring quarantine record", id)
+			superseded++
+			continue
+		}
+		if _, exists := r.volumeToNQN[record.VolumeName]; exists {
+			registryLog.V(4).Infof("Volume %s of quarantined device %s exists again, ignoring quarantine record", record.VolumeName, id)
+			superseded++
+			continue
+		}
+
+		r.devices[id] = record.volumeInfo(id)
+		r.quarantined[record.VolumeName] = id
+	}
+
+	klog.Infof("Restored %d quarantined device(s), skipped %d superseded quarantine record(s)", len(r.quarantined), superseded)
+	return nil
+}
+
+// volumeInfo returns the quarantined device id of the record, stale until
+// discovery finds it again
+func (record *quarantineRecord) volumeInfo(id string) *VolumeInfo {
+	nqn, nsid := parseVolumeID(id)
+	return &VolumeInfo{
+		nvmfDiskInfo: &nvmfDiskInfo{
+			VolName:   record.VolumeName,
+			Nqn:       nqn,
+			Nsid:      nsid,
+			Transport: record.Transport,
+			Endpoints: record.Endpoints,
+		},
+		IsStale:          true,
+		Capacity:         record.Capacity,
+		UsedBytes:        record.UsedBytes,
+		VolumeBytes:      record.VolumeBytes,
+		SkipWipe:         record.SkipWipe,
+		QuarantinedUntil: record.Expiry,
+	}
+}
+
+// runReclaimLoop releases quarantined devices once their retention expires,
+// retries failed wipes and reclaims the devices released by ephemeral volumes
+func (r *DeviceRegistry) runReclaimLoop() {
+	interval := r.Driver.reclaimRetention
+	if interval == 0 || interval > maxQuarantineCheckInterval {
+		interval = maxQuarantineCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Devices released by ephemeral volumes are quarantined to be wiped
+		if r.Driver.ephemeralVolumes {
+			r.refreshEphemeralClaims(context.Background())
+		}
+		r.ReclaimExpired(context.Background(), time.Now())
+	}
+}
+
+// ReclaimExpired releases the quarantined devices whose retention expired by now
+func (r *DeviceRegistry) ReclaimExpired(ctx context.Context, now time.Time) {
+	r.mutex.RLock()
+	expired := map[string]time.Time{}
+	for id, device := range r.devices {
+		if device.isQuarantined() && !device.QuarantinedUntil.After(now) {
+			expired[id] = device.QuarantinedUntil
+		}
+	}
+	r.mutex.RUnlock()
+
+	for id, expiry := range expired {
+		r.reclaim(ctx, id, expiry)
+	}
+}
+
+// reclaim wipes an expired quarantined device if required and returns it to
+// the pool. A device that fails to be wiped stays quarantined and is retried
+// by the reclaim loop.
+func (r *DeviceRegistry) reclaim(ctx context.Context, id string, expiry time.Time) {
+	r.mutex.RLock()
+	device, exists := r.devices[id]
+	wipe := exists && r.needsWipe(device)
+	r.mutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	// Wipe without holding the mutex, expired devices are no longer undeleted
+	if wipe {
+		wiper, _ := r.Driver.wiper()
+		nqn, nsid := parseVolumeID(id)
+		if err := wiper.WipeVolume(ctx, nqn, nsid); err != nil {
+			klog.Errorf("Failed to wipe device %s, keeping it quarantined: %v", id, err)
+			return
+		}
+		klog.Infof("Wiped device %s of deleted volume", id)
+	}
+
+	r.releaseQuarantined(ctx, id, expiry)
+}
+
+// releaseQuarantined returns a quarantined device to the pool unless it was
+// undeleted since its expiry was read
+func (r *DeviceRegistry) releaseQuarantined(ctx context.Context, id string, expiry time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	device, exists := r.devices[id]
+	if !exists || !device.QuarantinedUntil.Equal(expiry) {
+		return
+	}
+
+	if err := r.Driver.metadata.Delete(ctx, metadataKindQuarantine, id); err != nil {
+		klog.Errorf("Failed to remove quarantine record of %s, retrying later: %v", id, err)
+		return
+	}
+
+	if r.quarantined[device.VolName] == id {
+		delete(r.quarantined, device.VolName)
+	}
+	device.VolName = ""
+	device.UsedBytes = 0
+	device.VolumeBytes = 0
+	device.QuarantinedUntil = time.Time{}
+	device.SkipWipe = false
+
+	if device.IsExcluded || device.IsStale {
+		klog.Infof("Retention of device %s expired, removing from registry", id)
+		delete(r.devices, id)
+		r.recordRemoval(id)
+		return
+	}
+	r.availableNQNs[id] = struct{}{}
+
+	klog.Infof("Retention of device %s expired, returned to the pool", id)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeferredReclaim(t *testing.T) {
+	const retention = time.Hour
+
+	tests := []struct {
+		name string
+		// elapsed is the time passed since the delete when the expired
+		// quarantines are reclaimed, 0 to not reclaim
+		elapsed  time.Duration
+		wipe     bool
+		wipeErrs []error
+		// create is the volume created after the delete
+		create    string
+		want      codes.Code
+		wantWiped []namespaceRef
+	}{
+		{name: "same volume during quarantine", create: "pv-1", want: codes.OK},
+		{name: "other volume during quarantine", create: "pv-2", want: codes.ResourceExhausted},
+		{name: "same volume after a reclaim within the retention", elapsed: retention / 2, create: "pv-1", want: codes.OK},
+		{name: "other volume after expiry", elapsed: retention, create: "pv-2", want: codes.OK},
+		{name: "other volume after expiry and wipe", elapsed: retention, wipe: true, create: "pv-2", want: codes.OK, wantWiped: []namespaceRef{{nqn: testVolumeNqn}}},
+		{name: "other volume after a failed wipe", elapsed: retention, wipe: true, wipeErrs: []error{errors.New("wipe failed")}, create: "pv-2", want: codes.ResourceExhausted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend(BackendCapabilityWipe)
+			backend.wipeErrs = test.wipeErrs
+			c, _ := newTestControllerServer(t, backend)
+			c.Driver.reclaimRetention = retention
+			c.Driver.wipeOnDelete = test.wipe
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			r := c.deviceRegistry
+
+			if _, err := c.CreateVolume(ctx, createRequest("pv-1", nil)); err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn}); err != nil {
+				t.Fatalf("DeleteVolume: %v", err)
+			}
+			if !r.devices[testVolumeNqn].isQuarantined() {
+				t.Fatal("deleted volume's device is not quarantined")
+			}
+			if test.elapsed > 0 {
+				r.ReclaimExpired(ctx, time.Now().Add(test.elapsed))
+			}
+
+			resp, err := c.CreateVolume(ctx, createRequest(test.create, nil))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume(%s) code = %v, want %v: %v", test.create, got, test.want, err)
+			}
+			if err == nil && resp.GetVolume().GetVolumeId() != testVolumeNqn {
+				t.Errorf("CreateVolume(%s) = %s, want %s", test.create, resp.GetVolume().GetVolumeId(), testVolumeNqn)
+			}
+			if !reflect.DeepEqual(backend.wiped, test.wantWiped) {
+				t.Errorf("wiped = %v, want %v", backend.wiped, test.wantWiped)
+			}
+		})
+	}
+}
+
+func TestQuarantineRestored(t *testing.T) {
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		wantPool bool
+	}{
+		{name: "within the retention"},
+		{name: "after expiry", elapsed: time.Hour, wantPool: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			newServer := func() *ControllerServer {
+				c, _ := newTestControllerServer(t, newFakeBackend())
+				c.Driver.reclaimRetention = time.Hour
+				client := c.Driver.nvme.(*fakeNvmeClient)
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+				return c
+			}
+
+			c := newServer()
+			if _, err := c.CreateVolume(ctx, createRequest("pv-1", nil)); err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn}); err != nil {
+				t.Fatalf("DeleteVolume: %v", err)
+			}
+
+			// The restarted controller only has the persisted records
+			restarted := newServer()
+			restarted.Driver.metadata = c.Driver.metadata
+			r := restarted.deviceRegistry
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			if r.quarantined["pv-1"] != testVolumeNqn {
+				t.Fatalf("quarantine of pv-1 was not restored: %v", r.quarantined)
+			}
+			if err := r.DiscoverDevices(ctx, &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"}); err != nil {
+				t.Fatalf("DiscoverDevices: %v", err)
+			}
+			if test.elapsed > 0 {
+				r.ReclaimExpired(ctx, time.Now().Add(test.elapsed))
+			}
+
+			if _, inPool := r.availableNQNs[testVolumeNqn]; inPool != test.wantPool {
+				t.Errorf("device in the pool = %v, want %v", inPool, test.wantPool)
+			}
+			_, err := restarted.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume after restart: %v", err)
+			}
+			if _, undeleted := r.quarantined["pv-1"]; undeleted {
+				t.Error("pv-1 is still quarantined after being created again")
+			}
+		})
+	}
+}
+
+func TestWipeOnDelete(t *testing.T) {
+	tests := []struct {
+		name      string
+		wipe      bool
+		skipWipe  string
+		wipeErrs  []error
+		wantPool  bool
+		wantWiped []namespaceRef
+	}{
+		{name: "wipe disabled", wantPool: true},
+		{name: "successful wipe", wipe: true, wantPool: true, wantWiped: []namespaceRef{{nqn: testVolumeNqn}}},
+		{name: "wipe failure", wipe: true, wipeErrs: []error{errors.New("format failed")}},
+		{name: "skipped by the StorageClass", wipe: true, skipWipe: "true", wantPool: true},
+		{name: "not skipped by the StorageClass", wipe: true, skipWipe: "false", wantPool: true, wantWiped: []namespaceRef{{nqn: testVolumeNqn}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := newFakeBackend(BackendCapabilityWipe)
+			backend.wipeErrs = test.wipeErrs
+			c, _ := newTestControllerServer(t, backend)
+			c.Driver.wipeOnDelete = test.wipe
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			r := c.deviceRegistry
+
+			extra := map[string]string{}
+			if test.skipWipe != "" {
+				extra[paramSkipWipe] = test.skipWipe
+			}
+			if _, err := c.CreateVolume(ctx, createRequest("pv-1", extra)); err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: testVolumeNqn}); err != nil {
+				t.Fatalf("DeleteVolume: %v", err)
+			}
+
+			if _, inPool := r.availableNQNs[testVolumeNqn]; inPool != test.wantPool {
+				t.Errorf("device in the pool = %v, want %v", inPool, test.wantPool)
+			}
+			if quarantined := r.devices[testVolumeNqn].isQuarantined(); quarantined == test.wantPool {
+				t.Errorf("device quarantined = %v, want %v", quarantined, !test.wantPool)
+			}
+			if !reflect.DeepEqual(backend.wiped, test.wantWiped) {
+				t.Errorf("wiped = %v, want %v", backend.wiped, test.wantWiped)
+			}
+
+			// The reclaim loop retries a failed wipe
+			r.ReclaimExpired(ctx, time.Now())
+			if _, inPool := r.availableNQNs[testVolumeNqn]; !inPool {
+				t.Error("device is not in the pool after the reclaim retry")
+			}
+		})
+	}
+}
+
+func TestWipeNamespaceOnDelete(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeBackend(BackendCapabilityWipe)
+	c, _ := newTestControllerServer(t, backend)
+	c.Driver.wipeOnDelete = true
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	namespaces := map[string]string{paramNamespaces: "1-3"}
+
+	volumeIDs := map[string]string{}
+	for _, name := range []string{"pv-1", "pv-2"} {
+		resp, err := c.CreateVolume(ctx, createRequest(name, namespaces))
+		if err != nil {
+			t.Fatalf("CreateVolume(%s): %v", name, err)
+		}
+		volumeIDs[name] = resp.GetVolume().GetVolumeId()
+	}
+	if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeIDs["pv-1"]}); err != nil {
+		t.Fatalf("DeleteVolume: %v", err)
+	}
+
+	// The backend is given the subsystem and the NSID of the deleted volume
+	// apart, and wipes no other namespace of the subsystem
+	nqn, nsid := parseVolumeID(volumeIDs["pv-1"])
+	if want := []namespaceRef{{nqn: testVolumeNqn, nsid: nsid}}; nqn != testVolumeNqn || nsid == 0 || !reflect.DeepEqual(backend.wiped, want) {
+		t.Errorf("wiped = %+v, want %+v", backend.wiped, want)
+	}
+	if _, inPool := c.deviceRegistry.availableNQNs[volumeIDs["pv-1"]]; !inPool {
+		t.Errorf("wiped namespace %s not returned to the pool", volumeIDs["pv-1"])
+	}
+	if device, exists := c.deviceRegistry.GetDeviceByNQN(volumeIDs["pv-2"]); !exists || !device.IsAllocated || device.VolName != "pv-2" {
+		t.Errorf("namespace %s of pv-2 = %+v, want it still allocated", volumeIDs["pv-2"], device)
+	}
+}
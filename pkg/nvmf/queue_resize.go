@@ -0,0 +1,400 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+var (
+	// nvmeMultipathParam reports whether the kernel merges the paths of a
+	// namespace into one device, which a reconnect relies on to keep it open
+	nvmeMultipathParam = "/sys/module/nvme_core/parameters/multipath"
+
+	// sysfsNvmeDir holds the sysfs attributes of the NVMe controllers, a
+	// variable so that tests can fake the queue counts
+	sysfsNvmeDir = SYS_NVMF
+)
+
+// queueResizeLiveWait bounds the wait for the controllers of a resize to be live
+const queueResizeLiveWait = 30 * time.Second
+
+// Ways a queue resize is carried out
+const (
+	queueResizeUnchanged = "unchanged" // The controllers already have the queue count
+	queueResizeReconnect = "reconnect" // New controllers replace the old ones
+)
+
+var (
+	// errQueueResizeNotConnected is returned when the subsystem has no connection on this node
+	errQueueResizeNotConnected = errors.New("subsystem is not connected on this node")
+
+	// errQueueResizeMaintenance is returned when the queues would be resized
+	// while the node is not under maintenance
+	errQueueResizeMaintenance = errors.New("resizing the queues reconnects the controllers, cordon the node to resize them")
+)
+
+// queueResizeReport is the outcome of a queue resize
+type queueResizeReport struct {
+	Nqn    string `json:"nqn"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+	Method string `json:"method"`
+}
+
+// planQueueResize returns how the I/O queues of a connection are resized from
+// current to requested. Controllers keep the queue count they were connected
+// with, so they are reconnected, which is only allowed during maintenance.
+func planQueueResize(current, requested int, maintenance bool) (string, error) {
+	switch {
+	case current == requested:
+		return queueResizeUnchanged, nil
+	case maintenance:
+		return queueResizeReconnect, nil
+	default:
+		return "", errQueueResizeMaintenance
+	}
+}
+
+// controllerIoQueues returns the number of I/O queues of a controller, its
+// queue count less the admin queue
+func controllerIoQueues(controller string) (int, error) {
+	value, err := readSysfsAttribute(filepath.Join(sysfsNvmeDir, controller, "queue_count"))
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid queue count of %s: %q", controller, value)
+	}
+
+	return count - 1, nil
+}
+
+// nativeMultipath reports whether the kernel runs native NVMe multipath
+func nativeMultipath() bool {
+	value, err := readSysfsAttribute(nvmeMultipathParam)
+	return err == nil && value == "Y"
+}
+
+// withConnectOption returns the connect options with key set to value
+func withConnectOption(options []string, key, value string) []string {
+	updated := []string{}
+	for _, option := range options {
+		if !strings.HasPrefix(option, key+"=") {
+			updated = append(updated, option)
+		}
+	}
+
+	return append(updated, key+"="+value)
+}
+
+// connectionControllers returns the controllers of nqn connected with hostNqn,
+// any host NQN if the kernel does not expose it
+func connectionControllers(client NvmeClient, nqn, hostNqn string) ([]NvmeController, error) {
+	controllers, err := client.ListSubsystems()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []NvmeController{}
+	for _, controller := range controllers {
+		if controller.SubsysNqn != nqn {
+			continue
+		}
+		if controller.HostNqn != "" && controller.HostNqn != hostNqn {
+			continue
+		}
+		matching = append(matching, controller)
+	}
+
+	return matching, nil
+}
+
+// connectionOf returns a snapshot of the connection of nqn, restricted to the
+// host NQN unless it is empty
+func (n *NodeServer) connectionOf(nqn, hostNqn string) (*nodeConnection, bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for _, conn := range n.connections {
+		if conn.nqn != nqn || (hostNqn != "" && conn.hostNqn != hostNqn) {
+			continue
+		}
+		stagingPaths := make(map[string]struct{}, len(conn.stagingPaths))
+		for stagingPath := range conn.stagingPaths {
+			stagingPaths[stagingPath] = struct{}{}
+		}
+		return &nodeConnection{
+			nqn:          conn.nqn,
+			hostNqn:      conn.hostNqn,
+			stagingPaths: stagingPaths,
+			transport:    conn.transport,
+			endpoints:    append([]string(nil), conn.endpoints...),
+			secrets:      conn.secrets,
+		}, true
+	}
+
+	return nil, false
+}
+
+// resizeQueues changes the number of I/O queues of the controllers connecting
+// nqn on this node. On a cordoned node, new controllers with the queue count
+// are connected next to the old ones before those are removed, so that the
+// multipath device of each namespace stays open.
+func (n *NodeServer) resizeQueues(nqn, hostNqn string, queues int) (*queueResizeReport, error) {
+	n.nqnLocks.Acquire(connectionLockKey(nqn))
+	defer n.nqnLocks.Release(connectionLockKey(nqn))
+
+	conn, exists := n.connectionOf(nqn, hostNqn)
+	if !exists {
+		return nil, errQueueResizeNotConnected
+	}
+	client := n.Driver.nvme
+	controllers, err := connectionControllers(client, conn.nqn, conn.hostNqn)
+	if err != nil {
+		return nil, err
+	}
+	if len(controllers) == 0 {
+		return nil, errQueueResizeNotConnected
+	}
+
+	report := &queueResizeReport{Nqn: nqn}
+	for _, controller := range controllers {
+		current, err := controllerIoQueues(controller.Name)
+		if err != nil {
+			return nil, err
+		}
+		if current > report.Before {
+			report.Before = current
+		}
+	}
+
+	report.Method, err = planQueueResize(report.Before, queues, n.cordon.isCordoned())
+	if err != nil {
+		return nil, err
+	}
+	if report.Method == queueResizeReconnect {
+		if err := n.reconnectWithQueues(conn, controllers, queues); err != nil {
+			return nil, err
+		}
+	}
+
+	if report.Method == queueResizeUnchanged {
+		report.After = report.Before
+	} else if report.After, err = n.connectionIoQueues(conn); err != nil {
+		return nil, err
+	}
+	klog.Infof("Resized the I/O queues of %s from %d to %d (%s)", nqn, report.Before, report.After, report.Method)
+
+	return report, nil
+}
+
+// connectionIoQueues returns the largest I/O queue count of the controllers of a connection
+func (n *NodeServer) connectionIoQueues(conn *nodeConnection) (int, error) {
+	controllers, err := connectionControllers(n.Driver.nvme, conn.nqn, conn.hostNqn)
+	if err != nil {
+		return 0, err
+	}
+
+	queues := 0
+	for _, controller := range controllers {
+		current, err := controllerIoQueues(controller.Name)
+		if err != nil {
+			return 0, err
+		}
+		if current > queues {
+			queues = current
+		}
+	}
+
+	return queues, nil
+}
+
+// reconnectWithQueues connects every endpoint of the connection again with the
+// queue count, then removes the old controllers, or the new ones if any fails
+// to connect. The persisted connectors are updated, so that later reconnects
+// keep the queue count.
+func (n *NodeServer) reconnectWithQueues(conn *nodeConnection, old []NvmeController, queues int) error {
+	if !nativeMultipath() {
+		return fmt.Errorf("native NVMe multipath is disabled, reconnecting would remove the devices of %s", conn.nqn)
+	}
+
+	stagingPath := ""
+	for path := range conn.stagingPaths {
+		stagingPath = path
+		break
+	}
+	connector, err := GetConnectorFromFile(connectorFilePath(stagingPath))
+	if err != nil {
+		return fmt.Errorf("failed to read connector of %s: %v", stagingPath, err)
+	}
+	opts := n.Driver.connectOptions()
+	conn.secrets.applyTo(connector)
+	// The new controllers connect to the same addresses as the old ones
+	connector.ConnectArgs = append(withConnectOption(connector.ConnectArgs, "nr_io_queues", strconv.Itoa(queues)), "duplicate_connect")
+
+	client := n.Driver.nvme
+	existing := map[string]struct{}{}
+	for _, controller := range old {
+		existing[controller.Name] = struct{}{}
+	}
+	added := func() []NvmeController {
+		controllers, _ := connectionControllers(client, conn.nqn, conn.hostNqn)
+		fresh := []NvmeController{}
+		for _, controller := range controllers {
+			if _, exists := existing[controller.Name]; !exists {
+				fresh = append(fresh, controller)
+			}
+		}
+		return fresh
+	}
+	rollback := func() {
+		for _, controller := range added() {
+			if err := client.DeleteController(controller.Name, opts.Timeout); err != nil {
+				klog.Errorf("Failed to remove controller %s of %s after a failed resize: %v", controller.Name, conn.nqn, err)
+			}
+		}
+	}
+
+	for _, endpoint := range connector.TargetEndpoints {
+		ip, port, err := splitEndpoint(strings.TrimSpace(endpoint))
+		if err != nil {
+			rollback()
+			return err
+		}
+		nvmeLog.V(4).Infof("Connecting %s://%s again with %d I/O queues", conn.transport, endpoint, queues)
+		err = _connect(connector.connectArgString(ip, port), opts.Retries, opts.RetryInterval, opts.Timeout, time.Time{}, func() {})
+		if err != nil {
+			rollback()
+			return fmt.Errorf("failed to connect %s with %d I/O queues: %v", endpoint, queues, err)
+		}
+	}
+
+	fresh := added()
+	if err := n.waitControllersLive(conn.nqn, fresh); err != nil {
+		rollback()
+		return err
+	}
+	for _, controller := range old {
+		if err := client.DeleteController(controller.Name, opts.Timeout); err != nil {
+			return fmt.Errorf("failed to remove controller %s of %s: %v", controller.Name, conn.nqn, err)
+		}
+		nvmeLog.V(4).Infof("Removed controller %s of %s, replaced by %d controller(s)", controller.Name, conn.nqn, len(fresh))
+	}
+
+	for path := range conn.stagingPaths {
+		if err := updateConnectorQueues(path, queues); err != nil {
+			klog.Warningf("Failed to record the I/O queues of %s at %s: %v", conn.nqn, path, err)
+		}
+	}
+
+	return nil
+}
+
+// updateConnectorQueues records the I/O queue count in the connector of a staging path
+func updateConnectorQueues(stagingPath string, queues int) error {
+	filePath := connectorFilePath(stagingPath)
+	connector, err := GetConnectorFromFile(filePath)
+	if err != nil {
+		return err
+	}
+	connector.ConnectArgs = withConnectOption(connector.ConnectArgs, "nr_io_queues", strconv.Itoa(queues))
+
+	return persistConnectorFile(connector, filePath)
+}
+
+// waitControllersLive waits for the new controllers of a resize to be live
+func (n *NodeServer) waitControllersLive(nqn string, controllers []NvmeController) error {
+	deadline := time.Now().Add(queueResizeLiveWait)
+	for _, controller := range controllers {
+		for controllerState(n.Driver.nvme, controller.Name) != nvmeControllerLive {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("controller %s of %s is not live after %v", controller.Name, nqn, queueResizeLiveWait)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+
+	return nil
+}
+
+// controllerState returns the state of a controller, unknown if it is gone
+func controllerState(client NvmeClient, name string) string {
+	controllers, err := client.ListSubsystems()
+	if err != nil {
+		return "unknown"
+	}
+	for _, controller := range controllers {
+		if controller.Name == name {
+			return controller.State
+		}
+	}
+
+	return "unknown"
+}
+
+// queuesHandler resizes, on POST, the I/O queues of the connection of the nqn
+// query parameter, optionally restricted to hostNqn, to queues. A resize
+// answers 409 unless the node is cordoned.
+func (d *driver) queuesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.nodeServer == nil {
+		http.Error(w, "not running as node", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	nqn := query.Get("nqn")
+	if !isValidNQN(nqn) {
+		http.Error(w, fmt.Sprintf("invalid nqn %q", nqn), http.StatusBadRequest)
+		return
+	}
+	queues, err := strconv.Atoi(query.Get("queues"))
+	if err != nil || queues < 1 {
+		http.Error(w, fmt.Sprintf("invalid queues %q, expected a positive integer", query.Get("queues")), http.StatusBadRequest)
+		return
+	}
+
+	report, err := d.nodeServer.resizeQueues(nqn, query.Get("hostNqn"), queues)
+	switch {
+	case errors.Is(err, errQueueResizeNotConnected):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errQueueResizeMaintenance):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		klog.Errorf("Failed to resize the I/O queues of %s: %v", nqn, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, report)
+}
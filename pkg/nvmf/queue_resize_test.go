@@ -0,0 +1,194 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPlanQueueResize(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     int
+		requested   int
+		maintenance bool
+		want        string
+		wantErr     error
+	}{
+		{name: "same count", current: 4, requested: 4, want: queueResizeUnchanged},
+		{name: "same count under maintenance", current: 4, requested: 4, maintenance: true, want: queueResizeUnchanged},
+		{name: "more queues under maintenance", current: 4, requested: 8, maintenance: true, want: queueResizeReconnect},
+		{name: "fewer queues under maintenance", current: 8, requested: 2, maintenance: true, want: queueResizeReconnect},
+		{name: "more queues outside maintenance", current: 4, requested: 8, wantErr: errQueueResizeMaintenance},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := planQueueResize(test.current, test.requested, test.maintenance)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("planQueueResize error = %v, want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("planQueueResize = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// withFakeQueueSysfs keeps the queue counts of the controllers and the
+// multipath parameter in a temporary directory, and connects the controllers
+// of the fabrics device writes through client, failing with connectErr
+func withFakeQueueSysfs(t *testing.T, client *fakeNvmeClient, multipath string, connectErr error) func(controller string, ioQueues int) {
+	t.Helper()
+	dir := t.TempDir()
+	setQueues := func(controller string, ioQueues int) {
+		if err := os.MkdirAll(filepath.Join(dir, controller), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, controller, "queue_count"), []byte(strconv.Itoa(ioQueues+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "multipath"), []byte(multipath), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	savedDir, savedParam, savedConnect := sysfsNvmeDir, nvmeMultipathParam, fabricsConnect
+	sysfsNvmeDir, nvmeMultipathParam = dir, filepath.Join(dir, "multipath")
+	fabricsConnect = func(argStr string) (string, error) {
+		if connectErr != nil {
+			return "", connectErr
+		}
+		args := map[string]string{}
+		for _, arg := range strings.Split(argStr, ",") {
+			key, value, _ := strings.Cut(arg, "=")
+			args[key] = value
+		}
+		queues, _ := strconv.Atoi(args["nr_io_queues"])
+
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		name := fmt.Sprintf("nvme%d", len(client.controllers)+10)
+		client.controllers = append(client.controllers, NvmeController{Name: name, SubsysNqn: args["nqn"], HostNqn: args["hostnqn"], State: nvmeControllerLive})
+		setQueues(name, queues)
+		return "instance=10,cntlid=1", nil
+	}
+	t.Cleanup(func() { sysfsNvmeDir, nvmeMultipathParam, fabricsConnect = savedDir, savedParam, savedConnect })
+
+	return setQueues
+}
+
+func TestResizeQueues(t *testing.T) {
+	const endpoint = "192.0.2.10:4420"
+
+	tests := []struct {
+		name       string
+		queues     int
+		cordoned   bool
+		multipath  string
+		connectErr error
+		wantErr    error // errAny for any error
+		wantMethod string
+		wantAfter  int
+		// wantQueues are the I/O queues recorded in the connector
+		wantQueues string
+	}{
+		{name: "node not cordoned", queues: 8, multipath: "Y", wantErr: errQueueResizeMaintenance},
+		{name: "unchanged count", queues: 4, cordoned: true, multipath: "Y", wantMethod: queueResizeUnchanged, wantAfter: 4},
+		{name: "reconnect with more queues", queues: 8, cordoned: true, multipath: "Y", wantMethod: queueResizeReconnect, wantAfter: 8, wantQueues: "8"},
+		{name: "native multipath disabled", queues: 8, cordoned: true, multipath: "N", wantErr: errAny},
+		{name: "new controller fails to connect", queues: 8, cordoned: true, multipath: "Y", connectErr: fmt.Errorf("write arg failed: invalid argument"), wantErr: errAny},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			setQueues := withFakeQueueSysfs(t, client, test.multipath, test.connectErr)
+			n := newTestNodeServer(client)
+			if test.cordoned {
+				if err := n.cordon.set(true); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A staged connection of 4 I/O queues
+			if _, err := client.Connect(&Connector{TargetNqn: testVolumeNqn, HostNqn: testNodeHostNqn}); err != nil {
+				t.Fatal(err)
+			}
+			setQueues("nvme0", 4)
+			stagingPath := stagingVolumePath(t.TempDir(), testVolumeNqn)
+			if err := os.MkdirAll(filepath.Dir(stagingPath), 0750); err != nil {
+				t.Fatal(err)
+			}
+			connector := &Connector{TargetNqn: testVolumeNqn, HostNqn: testNodeHostNqn, Transport: "tcp", TargetEndpoints: []string{endpoint}}
+			if err := persistConnectorFile(connector, connectorFilePath(stagingPath)); err != nil {
+				t.Fatal(err)
+			}
+			n.connections[connectionLockKey(testVolumeNqn)] = &nodeConnection{
+				nqn:          testVolumeNqn,
+				hostNqn:      testNodeHostNqn,
+				stagingPaths: map[string]struct{}{stagingPath: {}},
+				transport:    "tcp",
+				endpoints:    []string{endpoint},
+			}
+
+			report, err := n.resizeQueues(testVolumeNqn, "", test.queues)
+			switch {
+			case test.wantErr == errAny && err == nil, test.wantErr != errAny && !errors.Is(err, test.wantErr):
+				t.Fatalf("resizeQueues error = %v, want %v", err, test.wantErr)
+			}
+
+			controllers, _ := client.ListSubsystems()
+			if err != nil {
+				// The connection is left as it was
+				if len(controllers) != 1 || controllers[0].Name != "nvme0" {
+					t.Errorf("controllers after a failed resize = %v, want nvme0 alone", controllers)
+				}
+			} else {
+				if report.Method != test.wantMethod || report.Before != 4 || report.After != test.wantAfter {
+					t.Errorf("report = %+v, want %s from 4 to %d", report, test.wantMethod, test.wantAfter)
+				}
+				if len(controllers) != 1 {
+					t.Errorf("controllers after the resize = %v, want a single one", controllers)
+				}
+			}
+
+			recorded, err := GetConnectorFromFile(connectorFilePath(stagingPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			queues := ""
+			for _, arg := range recorded.ConnectArgs {
+				if strings.HasPrefix(arg, "nr_io_queues=") {
+					queues = strings.TrimPrefix(arg, "nr_io_queues=")
+				}
+			}
+			if queues != test.wantQueues {
+				t.Errorf("connector records nr_io_queues=%q, want %q", queues, test.wantQueues)
+			}
+		})
+	}
+}
+
+// errAny stands for any error in the expected errors of a table
+var errAny = errors.New("any error")
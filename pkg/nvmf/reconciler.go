@@ -0,0 +1,287 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// minReconcileInterval leaves the provisioner time to record a created volume
+// in its PV, since a drifted allocation is only corrected when two consecutive
+// cycles observe it
+const minReconcileInterval = time.Minute
+
+// reconcileStats are the counters of the reconcile cycles
+type reconcileStats struct {
+	Cycles           int64
+	LastCorrections  int
+	TotalCorrections int64
+}
+
+// reconciler periodically cross-checks the registry allocations against the
+// PersistentVolumes recording them. PVs missing from the registry are adopted
+// again, registry allocations without a PV are reclaimed and the QoS limits of
+// the allocations are applied again. Discovery with the
+// default discovery configuration refreshes the fabric state beforehand.
+type reconciler struct {
+	registry *DeviceRegistry
+	interval time.Duration
+
+	// Drift observed by the previous cycle, by volume name. Allocations are
+	// only corrected when observed twice, so that an allocation whose PV is
+	// being created or deleted is left alone.
+	suspectedOrphans  map[string]string
+	suspectedPhantoms map[string]string
+
+	mutex sync.Mutex
+	stats reconcileStats
+}
+
+func newReconciler(registry *DeviceRegistry, interval time.Duration) *reconciler {
+	return &reconciler{
+		registry:          registry,
+		interval:          interval,
+		suspectedOrphans:  map[string]string{},
+		suspectedPhantoms: map[string]string{},
+	}
+}
+
+// run reconciles every interval
+func (rc *reconciler) run() {
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), rc.interval)
+		corrections, err := rc.reconcileOnce(ctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("Reconcile: cycle failed: %v", err)
+		}
+
+		rc.mutex.Lock()
+		rc.stats.Cycles++
+		rc.stats.LastCorrections = corrections
+		rc.stats.TotalCorrections += int64(corrections)
+		rc.mutex.Unlock()
+	}
+}
+
+// reconcileOnce runs one cycle and returns the number of corrections. The
+// registry lock is taken per item, so allocations proceed during the cycle.
+func (rc *reconciler) reconcileOnce(ctx context.Context) (int, error) {
+	r := rc.registry
+	if !r.InitialSyncDone() {
+		return 0, nil
+	}
+
+	params, err := r.Driver.parseVolumeParams(r.Driver.withDefaults(map[string]string{}))
+	if err != nil {
+		klog.Warningf("Reconcile: invalid default parameters, reconciling known devices only: %v", err)
+	} else if params.TargetAddr != "" {
+		if err := r.DiscoverDevices(ctx, params); err != nil {
+			klog.Warningf("Reconcile: discovery failed, reconciling known devices only: %v", err)
+		}
+	}
+	r.checkFreeDevices()
+
+	list, err := r.Driver.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PersistentVolumes: %v", err)
+	}
+
+	// PVs being released still have their allocation, but are not adopted again
+	recorded := map[string]*corev1.PersistentVolume{}
+	adoptable := map[string]*corev1.PersistentVolume{}
+	for i := range list.Items {
+		pv := &list.Items[i]
+		if !r.isDriverPV(pv) {
+			continue
+		}
+		recorded[pv.Name] = pv
+		if pv.DeletionTimestamp == nil && pv.Status.Phase != corev1.VolumeReleased && pv.Status.Phase != corev1.VolumeFailed {
+			adoptable[pv.Name] = pv
+		}
+	}
+
+	r.pruneAllocations(ctx, recorded)
+
+	corrections := 0
+	allocations := r.allocations()
+
+	orphans := map[string]string{}
+	for name, pv := range adoptable {
+		volumeID := registryVolumeID(pv.Spec.CSI.VolumeHandle)
+		if id, exists := allocations[name]; exists {
+			if id != volumeID {
+				klog.Errorf("Reconcile: volume %s is allocated device %s but its PV records %s, leaving it for manual repair", name, id, volumeID)
+			}
+			continue
+		}
+		if rc.suspectedOrphans[name] == volumeID && rc.adopt(ctx, pv) {
+			corrections++
+			continue
+		}
+		orphans[name] = volumeID
+	}
+
+	phantoms := map[string]string{}
+	for name, id := range allocations {
+		if _, exists := recorded[name]; exists {
+			continue
+		}
+		if rc.suspectedPhantoms[name] == id && rc.reclaimPhantom(ctx, name, id) {
+			corrections++
+			continue
+		}
+		phantoms[name] = id
+	}
+
+	rc.suspectedOrphans = orphans
+	rc.suspectedPhantoms = phantoms
+
+	r.reapplyQoS(ctx)
+
+	registryLog.V(4).Infof("Reconcile: %d correction(s), %d orphaned record(s) and %d phantom allocation(s) pending confirmation",
+		corrections, len(orphans), len(phantoms))
+	return corrections, nil
+}
+
+// adopt restores the allocation of a PV missing from the registry. It is
+// skipped if an operation on the volume is in progress.
+func (rc *reconciler) adopt(ctx context.Context, pv *corev1.PersistentVolume) bool {
+	volumeLocks := rc.registry.Driver.volumeLocks
+	volumeID := registryVolumeID(pv.Spec.CSI.VolumeHandle)
+	if !volumeLocks.TryAcquire(pv.Name) {
+		return false
+	}
+	defer volumeLocks.Release(pv.Name)
+	if !volumeLocks.TryAcquire(volumeID) {
+		return false
+	}
+	defer volumeLocks.Release(volumeID)
+
+	return rc.registry.adoptRecord(ctx, pv)
+}
+
+// reclaimPhantom releases a registry allocation no PV records. It is skipped
+// if an operation on the volume is in progress.
+func (rc *reconciler) reclaimPhantom(ctx context.Context, name, id string) bool {
+	volumeLocks := rc.registry.Driver.volumeLocks
+	if !volumeLocks.TryAcquire(name) {
+		return false
+	}
+	defer volumeLocks.Release(name)
+	if !volumeLocks.TryAcquire(id) {
+		return false
+	}
+	defer volumeLocks.Release(id)
+
+	if current, exists := rc.registry.allocations()[name]; !exists || current != id {
+		return false
+	}
+
+	klog.Warningf("Reconcile: volume %s is allocated device %s but has no PV, reclaiming the device", name, id)
+	if err := rc.registry.ReclaimDevice(ctx, id); err != nil {
+		klog.Errorf("Reconcile: failed to reclaim device %s of phantom volume %s: %v", id, name, err)
+		return false
+	}
+	return true
+}
+
+// writeMetrics writes the reconcile counters in the Prometheus text format
+func (rc *reconciler) writeMetrics(w io.Writer) {
+	rc.mutex.Lock()
+	stats := rc.stats
+	rc.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP csi_nvmf_reconcile_cycles_total Reconcile cycles run\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_reconcile_cycles_total counter\n")
+	fmt.Fprintf(w, "csi_nvmf_reconcile_cycles_total %d\n", stats.Cycles)
+	fmt.Fprintf(w, "# HELP csi_nvmf_reconcile_corrections Corrections made by the last reconcile cycle\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_reconcile_corrections gauge\n")
+	fmt.Fprintf(w, "csi_nvmf_reconcile_corrections %d\n", stats.LastCorrections)
+	fmt.Fprintf(w, "# HELP csi_nvmf_reconcile_corrections_total Corrections made by all reconcile cycles\n")
+	fmt.Fprintf(w, "# TYPE csi_nvmf_reconcile_corrections_total counter\n")
+	fmt.Fprintf(w, "csi_nvmf_reconcile_corrections_total %d\n", stats.TotalCorrections)
+}
+
+// allocations returns a copy of the volume name to volume ID mapping
+func (r *DeviceRegistry) allocations() map[string]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	allocations := make(map[string]string, len(r.volumeToNQN))
+	for name, id := range r.volumeToNQN {
+		allocations[name] = id
+	}
+	return allocations
+}
+
+// adoptRecord restores the allocation recorded in a PV, onto its registered
+// free device or as a stale allocation if the device is unknown. A device
+// allocated or quarantined for another volume is left alone.
+func (r *DeviceRegistry) adoptRecord(ctx context.Context, pv *corev1.PersistentVolume) bool {
+	attributes := r.Driver.pvAttributes(ctx, pv)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name, id := pv.Name, registryVolumeID(pv.Spec.CSI.VolumeHandle)
+	if _, exists := r.volumeToNQN[name]; exists {
+		return false
+	}
+	if _, exists := r.quarantined[name]; exists {
+		return false
+	}
+
+	restored := volumeInfoFromPV(pv, attributes)
+	device, exists := r.devices[id]
+	switch {
+	case !exists:
+		r.devices[id] = restored
+	case device.IsAllocated || device.isQuarantined():
+		klog.Errorf("Reconcile: PV %s records device %s, which backs volume %s, leaving it for manual repair", name, id, device.VolName)
+		return false
+	case device.warming:
+		klog.Warningf("Reconcile: PV %s records device %s, which the warm pool is inspecting, retrying next cycle", name, id)
+		return false
+	default:
+		delete(r.availableNQNs, id)
+		device.VolName = name
+		device.IsAllocated = true
+		device.UsedBytes = restored.UsedBytes
+		device.SkipWipe = restored.SkipWipe
+		device.AffinityKey = restored.AffinityKey
+		device.AntiAffinityKey = restored.AntiAffinityKey
+		if device.Capacity == 0 {
+			device.Capacity = restored.Capacity
+		}
+	}
+	r.volumeToNQN[name] = id
+
+	klog.Warningf("Reconcile: adopted volume %s recorded in its PV but missing from the registry, device %s", name, id)
+	return true
+}
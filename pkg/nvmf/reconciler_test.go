@@ -0,0 +1,150 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReconcileDrift(t *testing.T) {
+	ctx := context.Background()
+	c, kubeClient := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2, maintenanceNqn3)
+	r := c.deviceRegistry
+
+	// pv-live is allocated and recorded in its PV, pv-phantom is allocated
+	// but has no PV
+	live, err := c.CreateVolume(ctx, createRequest("pv-live", map[string]string{paramPinnedNqn: testVolumeNqn}))
+	if err != nil {
+		t.Fatalf("CreateVolume(pv-live): %v", err)
+	}
+	if _, err := kubeClient.CoreV1().PersistentVolumes().Create(ctx,
+		driverPV("pv-live", live.GetVolume().GetVolumeId(), live.GetVolume().GetVolumeContext()), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create(pv-live): %v", err)
+	}
+	if _, err := c.CreateVolume(ctx, createRequest("pv-phantom", map[string]string{paramPinnedNqn: maintenanceNqn3})); err != nil {
+		t.Fatalf("CreateVolume(pv-phantom): %v", err)
+	}
+
+	// pv-orphan records a free device, missing from the registry, and
+	// pv-released records an unknown device but is being released
+	orphan := driverPV("pv-orphan", maintenanceNqn2, map[string]string{paramType: "tcp"})
+	released := driverPV("pv-released", "nqn.2024-01.io.example:volume-9", map[string]string{paramType: "tcp"})
+	released.Status.Phase = corev1.VolumeReleased
+	for _, pv := range []*corev1.PersistentVolume{orphan, released} {
+		if _, err := kubeClient.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("Create(%s): %v", pv.Name, err)
+		}
+	}
+
+	rc := newReconciler(r, time.Minute)
+	wantAllocations := func(cycle string, want map[string]string) {
+		t.Helper()
+		got := r.allocations()
+		if len(got) != len(want) {
+			t.Errorf("%s: allocations %v, want %v", cycle, got, want)
+		}
+		for name, id := range want {
+			if got[name] != id {
+				t.Errorf("%s: volume %s allocated %q, want %q", cycle, name, got[name], id)
+			}
+		}
+	}
+
+	// The first cycle only suspects the drift
+	if corrections, err := rc.reconcileOnce(ctx); err != nil || corrections != 0 {
+		t.Fatalf("first reconcileOnce = %d, %v, want 0 corrections", corrections, err)
+	}
+	wantAllocations("first cycle", map[string]string{"pv-live": testVolumeNqn, "pv-phantom": maintenanceNqn3})
+
+	// The second cycle confirms it: the orphan is adopted onto its device and
+	// the device of the phantom returns to the pool
+	if corrections, err := rc.reconcileOnce(ctx); err != nil || corrections != 2 {
+		t.Fatalf("second reconcileOnce = %d, %v, want 2 corrections", corrections, err)
+	}
+	wantAllocations("second cycle", map[string]string{"pv-live": testVolumeNqn, "pv-orphan": maintenanceNqn2})
+	if device, exists := r.GetDeviceByNQN(maintenanceNqn2); !exists || !device.IsAllocated || device.VolName != "pv-orphan" {
+		t.Errorf("device of pv-orphan = %+v, want it allocated to pv-orphan", device)
+	}
+	if device, exists := r.GetDeviceByNQN(maintenanceNqn3); !exists || device.IsAllocated || device.VolName != "" {
+		t.Errorf("device of pv-phantom = %+v, want it free", device)
+	}
+	if device, _ := r.GetDeviceByNQN(testVolumeNqn); device == nil || device.VolName != "pv-live" {
+		t.Errorf("device of pv-live = %+v, want it allocated to pv-live", device)
+	}
+
+	// Once reconciled, nothing drifts
+	if corrections, err := rc.reconcileOnce(ctx); err != nil || corrections != 0 {
+		t.Fatalf("third reconcileOnce = %d, %v, want 0 corrections", corrections, err)
+	}
+	if len(rc.suspectedOrphans) != 0 || len(rc.suspectedPhantoms) != 0 {
+		t.Errorf("suspected orphans %v and phantoms %v once reconciled, want none", rc.suspectedOrphans, rc.suspectedPhantoms)
+	}
+}
+
+func TestReconcileDriftResolvedBeforeConfirmation(t *testing.T) {
+	ctx := context.Background()
+	c, kubeClient := newTestControllerServer(t, newFakeBackend())
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	resp, err := c.CreateVolume(ctx, createRequest("pv-a", nil))
+	if err != nil {
+		t.Fatalf("CreateVolume: %v", err)
+	}
+
+	// The provisioner records the volume in its PV between the two cycles,
+	// so the allocation is never reclaimed
+	rc := newReconciler(c.deviceRegistry, time.Minute)
+	if corrections, err := rc.reconcileOnce(ctx); err != nil || corrections != 0 {
+		t.Fatalf("first reconcileOnce = %d, %v, want 0 corrections", corrections, err)
+	}
+	if _, err := kubeClient.CoreV1().PersistentVolumes().Create(ctx,
+		driverPV("pv-a", resp.GetVolume().GetVolumeId(), resp.GetVolume().GetVolumeContext()), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create(pv-a): %v", err)
+	}
+	if corrections, err := rc.reconcileOnce(ctx); err != nil || corrections != 0 {
+		t.Fatalf("second reconcileOnce = %d, %v, want 0 corrections", corrections, err)
+	}
+	if got := c.deviceRegistry.allocations()["pv-a"]; got != testVolumeNqn {
+		t.Errorf("pv-a allocated %q, want %q", got, testVolumeNqn)
+	}
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	rc := newReconciler(nil, time.Minute)
+	rc.stats = reconcileStats{Cycles: 3, LastCorrections: 2, TotalCorrections: 5}
+
+	var out bytes.Buffer
+	rc.writeMetrics(&out)
+	for _, want := range []string{
+		"csi_nvmf_reconcile_cycles_total 3\n",
+		"csi_nvmf_reconcile_corrections 2\n",
+		"csi_nvmf_reconcile_corrections_total 5\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics %q do not contain %q", out.String(), want)
+		}
+	}
+}
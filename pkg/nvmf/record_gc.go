@@ -0,0 +1,179 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// DefaultRecordGCInterval is the default interval between collections of the
+// records of deleted volumes
+const DefaultRecordGCInterval = time.Hour
+
+// recordGCTimeout bounds a collection
+const recordGCTimeout = 5 * time.Minute
+
+// deletedAt returns when the volume of the record was deleted. Records written
+// before it was recorded are dated from their expiry.
+func (record *quarantineRecord) deletedAt(reclaimRetention time.Duration) time.Time {
+	if !record.DeletedAt.IsZero() {
+		return record.DeletedAt
+	}
+	return record.Expiry.Add(-reclaimRetention)
+}
+
+// isSuperseded reports whether the quarantine record of device id no longer
+// backs the quarantine of the device in the registry, e.g. because the device
+// was allocated again after a failed removal of the record. Caller must hold
+// the mutex.
+func (r *DeviceRegistry) isSuperseded(id string, record *quarantineRecord) bool {
+	device, exists := r.devices[id]
+	if !exists || !device.isQuarantined() {
+		return true
+	}
+	return r.quarantined[record.VolumeName] != id
+}
+
+// runRecordGC collects the records of deleted volumes every interval
+func (r *DeviceRegistry) runRecordGC(retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), recordGCTimeout)
+		r.collectRecords(ctx, retention, time.Now())
+		cancel()
+	}
+}
+
+// collectRecords removes the records of volumes deleted longer than retention
+// ago, which initial syncs would otherwise read and skip forever: the
+// quarantine records that no longer back a quarantined device, and the
+// allocation tombstones. Records of quarantined devices are kept until the
+// device is reclaimed, so that it is still wiped after a restart. The records
+// are stored through the API server, which compacts the revision history of
+// etcd itself, in files or in a bolt database without history.
+func (r *DeviceRegistry) collectRecords(ctx context.Context, retention time.Duration, now time.Time) {
+	r.collectQuarantineRecords(ctx, retention, now)
+	r.collectAllocationTombstones(ctx, retention, now)
+}
+
+func (r *DeviceRegistry) collectQuarantineRecords(ctx context.Context, retention time.Duration, now time.Time) {
+	records, err := r.Driver.metadata.List(ctx, metadataKindQuarantine)
+	if err != nil {
+		klog.Warningf("Record GC: failed to list quarantine records: %v", err)
+		return
+	}
+
+	removed, kept := 0, 0
+	for id, data := range records {
+		record := &quarantineRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			klog.Warningf("Record GC: ignoring malformed quarantine record of %s: %v", id, err)
+			continue
+		}
+		if now.Sub(record.deletedAt(r.Driver.reclaimRetention)) < retention {
+			kept++
+			continue
+		}
+
+		if r.collectRecord(ctx, id, record) {
+			removed++
+		} else {
+			kept++
+		}
+	}
+
+	registryLog.V(4).Infof("Record GC: removed %d quarantine record(s) older than %v, kept %d", removed, retention, kept)
+}
+
+func (r *DeviceRegistry) collectAllocationTombstones(ctx context.Context, retention time.Duration, now time.Time) {
+	records, err := r.Driver.metadata.List(ctx, metadataKindAllocation)
+	if err != nil {
+		klog.Warningf("Record GC: failed to list allocation records: %v", err)
+		return
+	}
+
+	removed, kept := 0, 0
+	for name, data := range records {
+		deletedAt, deleted := tombstoneDeletedAt(data)
+		if !deleted {
+			continue
+		}
+		if now.Sub(deletedAt) < retention {
+			kept++
+			continue
+		}
+
+		if r.collectTombstone(ctx, name, retention, now) {
+			removed++
+		} else {
+			kept++
+		}
+	}
+
+	registryLog.V(4).Infof("Record GC: removed %d allocation tombstone(s) older than %v, kept %d", removed, retention, kept)
+}
+
+// collectTombstone removes the allocation tombstone of a volume unless the
+// volume was allocated again. The registry lock is held, so that the record is
+// not replaced by a new allocation meanwhile.
+func (r *DeviceRegistry) collectTombstone(ctx context.Context, volumeName string, retention time.Duration, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record := &allocationRecord{}
+	found, err := r.Driver.metadata.Get(ctx, metadataKindAllocation, volumeName, record)
+	if err != nil {
+		klog.Warningf("Record GC: failed to read allocation record of %s: %v", volumeName, err)
+		return false
+	}
+	if !found || record.DeletedAt == nil || now.Sub(*record.DeletedAt) < retention {
+		return false
+	}
+	if err := r.Driver.metadata.Delete(ctx, metadataKindAllocation, volumeName); err != nil {
+		klog.Warningf("Record GC: failed to remove allocation tombstone of %s: %v", volumeName, err)
+		return false
+	}
+
+	registryLog.V(4).Infof("Record GC: removed allocation tombstone of volume %s released at %s", volumeName, record.DeletedAt.Format(time.RFC3339))
+	return true
+}
+
+// collectRecord removes a quarantine record unless it backs a quarantined
+// device. The registry lock is held, so that the device is not quarantined
+// again meanwhile.
+func (r *DeviceRegistry) collectRecord(ctx context.Context, id string, record *quarantineRecord) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.isSuperseded(id, record) {
+		return false
+	}
+	if err := r.Driver.metadata.Delete(ctx, metadataKindQuarantine, id); err != nil {
+		klog.Warningf("Record GC: failed to remove quarantine record of %s: %v", id, err)
+		return false
+	}
+
+	klog.Infof("Record GC: removed quarantine record of device %s of volume %s deleted at %s",
+		id, record.VolumeName, record.deletedAt(r.Driver.reclaimRetention).Format(time.RFC3339))
+	return true
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestCollectRecords(t *testing.T) {
+	const retention = 24 * time.Hour
+	now := time.Now()
+	old, recent := now.Add(-2*retention), now.Add(-retention/2)
+	quarantinedID := formatVolumeID(testVolumeNqn, 1)
+
+	tests := []struct {
+		name        string
+		kind        string
+		record      interface{}
+		quarantined bool // the record backs a quarantined device
+		wantKept    bool
+	}{
+		{
+			name:   "old allocation tombstone",
+			kind:   metadataKindAllocation,
+			record: &allocationRecord{VolumeName: "pv-1", DeletedAt: &old},
+		},
+		{
+			name:     "recent allocation tombstone",
+			kind:     metadataKindAllocation,
+			record:   &allocationRecord{VolumeName: "pv-1", DeletedAt: &recent},
+			wantKept: true,
+		},
+		{
+			name:     "allocation record of an allocated volume",
+			kind:     metadataKindAllocation,
+			record:   &allocationRecord{VolumeName: "pv-1", VolumeID: testVolumeNqn},
+			wantKept: true,
+		},
+		{
+			name:   "old superseded quarantine record",
+			kind:   metadataKindQuarantine,
+			record: &quarantineRecord{VolumeID: quarantinedID, VolumeName: "pv-1", DeletedAt: old},
+		},
+		{
+			name:     "recent superseded quarantine record",
+			kind:     metadataKindQuarantine,
+			record:   &quarantineRecord{VolumeID: quarantinedID, VolumeName: "pv-1", DeletedAt: recent},
+			wantKept: true,
+		},
+		{
+			name:        "old quarantine record of a quarantined device",
+			kind:        metadataKindQuarantine,
+			record:      &quarantineRecord{VolumeID: quarantinedID, VolumeName: "pv-1", DeletedAt: old},
+			quarantined: true,
+			wantKept:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			r := c.deviceRegistry
+			key := "pv-1"
+			if test.kind == metadataKindQuarantine {
+				key = quarantinedID
+			}
+			if err := c.Driver.metadata.Put(ctx, test.kind, key, test.record); err != nil {
+				t.Fatal(err)
+			}
+			if test.quarantined {
+				r.devices[quarantinedID] = &VolumeInfo{
+					nvmfDiskInfo:     &nvmfDiskInfo{Nqn: testVolumeNqn, Nsid: 1, VolName: "pv-1"},
+					QuarantinedUntil: now.Add(time.Hour),
+				}
+				r.quarantined["pv-1"] = quarantinedID
+			}
+
+			r.collectRecords(ctx, retention, now)
+
+			found, err := c.Driver.metadata.Get(ctx, test.kind, key, &struct{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != test.wantKept {
+				t.Errorf("%s record kept = %t, want %t", test.kind, found, test.wantKept)
+			}
+		})
+	}
+}
+
+func TestReleaseTombstonesAllocation(t *testing.T) {
+	tests := []struct {
+		name          string
+		retention     time.Duration
+		wantTombstone bool
+	}{
+		{name: "record GC disabled", retention: 0},
+		{name: "record GC enabled", retention: time.Hour, wantTombstone: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			c.Driver.recordRetention = test.retention
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()}); err != nil {
+				t.Fatalf("DeleteVolume: %v", err)
+			}
+
+			record := &allocationRecord{}
+			found, err := c.Driver.metadata.Get(ctx, metadataKindAllocation, "pv-1", record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tombstone := found && record.DeletedAt != nil; tombstone != test.wantTombstone || found != test.wantTombstone {
+				t.Errorf("allocation record found %t (tombstone %t), want a tombstone %t", found, tombstone, test.wantTombstone)
+			}
+
+			// A restarted controller skips the tombstone and allocates the device again
+			restarted := &ControllerServer{Driver: c.Driver, deviceRegistry: NewDeviceRegistry(c.Driver)}
+			if err := restarted.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, exists := restarted.deviceRegistry.volumeToNQN["pv-1"]; exists {
+				t.Error("initial sync restored the allocation of the deleted volume")
+			}
+			if _, err := restarted.CreateVolume(ctx, createRequest("pv-2", nil)); err != nil {
+				t.Errorf("CreateVolume after the restart: %v", err)
+			}
+		})
+	}
+}
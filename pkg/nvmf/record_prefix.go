@@ -0,0 +1,116 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// recordMigrationTimeout bounds the migration of the records at startup
+const recordMigrationTimeout = 5 * time.Minute
+
+// recordKinds are the kinds of records kept in the record store
+var recordKinds = []string{metadataKindAllocation, metadataKindSnapshot, metadataKindQuarantine, metadataKindMaintenance}
+
+// validateRecordPrefix checks a key prefix of the record store. The empty
+// prefix is that of the records stored before prefixes existed.
+func validateRecordPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	if len(prefix) < 2 || !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("key prefix %q must start and end with /", prefix)
+	}
+
+	return nil
+}
+
+// unprefixedKey returns the record key of a stored key in the namespace of
+// prefix, false if the stored key belongs to another namespace. Record keys
+// never contain a slash, so nested prefixes do not see each other's records,
+// and stored keys without a leading slash belong to the empty prefix.
+func unprefixedKey(prefix, stored string) (string, bool) {
+	if !strings.HasPrefix(stored, prefix) {
+		return "", false
+	}
+	key := strings.TrimPrefix(stored, prefix)
+
+	return key, !strings.Contains(key, "/")
+}
+
+// unprefixedRecords returns the records of a listing in the namespace of
+// prefix, indexed by record key
+func unprefixedRecords(prefix string, stored map[string][]byte) map[string][]byte {
+	records := make(map[string][]byte, len(stored))
+	for storedKey, record := range stored {
+		if key, ok := unprefixedKey(prefix, storedKey); ok {
+			records[key] = record
+		}
+	}
+
+	return records
+}
+
+// migrateRecords moves every record of from to to, e.g. the records stored
+// without a prefix to the configured prefix. A record already present in to
+// is kept and the one of from left in place, so that a migration never
+// overwrites newer records and can be repeated.
+func migrateRecords(ctx context.Context, from, to recordStore) error {
+	moved, kept := 0, 0
+	for _, kind := range recordKinds {
+		records, err := from.List(ctx, kind)
+		if err != nil {
+			return err
+		}
+		for key, record := range records {
+			var existing json.RawMessage
+			if exists, err := to.Get(ctx, kind, key, &existing); err != nil {
+				return err
+			} else if exists {
+				klog.Warningf("Record migration: %s record %s exists under both prefixes, keeping the new one", kind, key)
+				kept++
+				continue
+			}
+
+			if err := to.Put(ctx, kind, key, json.RawMessage(record)); err != nil {
+				return err
+			}
+			if err := from.Delete(ctx, kind, key); err != nil {
+				return err
+			}
+			moved++
+		}
+	}
+
+	klog.Infof("Record migration: moved %d record(s), kept %d conflicting record(s) in place", moved, kept)
+	return nil
+}
+
+// migrateLegacyRecords moves the records stored without a prefix under the
+// configured prefix. Only the leader calls it, before the initial sync.
+func (c *ControllerServer) migrateLegacyRecords(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, recordMigrationTimeout)
+	defer cancel()
+
+	return migrateRecords(ctx, c.Driver.legacyMetadata, c.Driver.metadata)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type prefixTestRecord struct {
+	Owner string `json:"owner"`
+}
+
+func TestPrefixedRecordStoresAreIsolated(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes [2]string
+	}{
+		{name: "two prefixes", prefixes: [2]string{"/cluster-a/", "/cluster-b/"}},
+		{name: "prefix and no prefix", prefixes: [2]string{"/cluster-a/", ""}},
+		{name: "nested prefixes", prefixes: [2]string{"/csi/", "/csi/cluster-b/"}},
+	}
+
+	for persistence, newStores := range recordStoreBackends {
+		for _, test := range tests {
+			t.Run(persistence+"/"+test.name, func(t *testing.T) {
+				ctx := context.Background()
+				stores := newStores(t, test.prefixes[0], test.prefixes[1])
+				for i, store := range stores {
+					if err := store.Put(ctx, metadataKindAllocation, "pv-1", prefixTestRecord{Owner: test.prefixes[i]}); err != nil {
+						t.Fatalf("Put under %q: %v", test.prefixes[i], err)
+					}
+				}
+
+				for i, store := range stores {
+					record := prefixTestRecord{}
+					if found, err := store.Get(ctx, metadataKindAllocation, "pv-1", &record); err != nil || !found {
+						t.Fatalf("Get under %q = %v, %v", test.prefixes[i], found, err)
+					}
+					if record.Owner != test.prefixes[i] {
+						t.Errorf("record under %q belongs to %q", test.prefixes[i], record.Owner)
+					}
+					records, err := store.List(ctx, metadataKindAllocation)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(records) != 1 {
+						t.Errorf("List under %q = %d record(s), want 1", test.prefixes[i], len(records))
+					}
+				}
+
+				// Deleting under one prefix keeps the record of the other
+				if err := stores[0].Delete(ctx, metadataKindAllocation, "pv-1"); err != nil {
+					t.Fatal(err)
+				}
+				if found, err := stores[1].Get(ctx, metadataKindAllocation, "pv-1", &prefixTestRecord{}); err != nil || !found {
+					t.Errorf("record under %q after deleting under %q = %v, %v", test.prefixes[1], test.prefixes[0], found, err)
+				}
+			})
+		}
+	}
+}
+
+func TestMigrateRecords(t *testing.T) {
+	tests := []struct {
+		name      string
+		legacy    map[string]string // owner by kind of the records without prefix
+		prefixed  map[string]string // owner by kind of the records already under the prefix
+		wantOwner map[string]string
+		wantLeft  int
+	}{
+		{name: "nothing to migrate", wantOwner: map[string]string{}},
+		{
+			name: "every kind is moved",
+			legacy: map[string]string{
+				metadataKindAllocation:  "legacy",
+				metadataKindSnapshot:    "legacy",
+				metadataKindQuarantine:  "legacy",
+				metadataKindMaintenance: "legacy",
+			},
+			wantOwner: map[string]string{
+				metadataKindAllocation:  "legacy",
+				metadataKindSnapshot:    "legacy",
+				metadataKindQuarantine:  "legacy",
+				metadataKindMaintenance: "legacy",
+			},
+		},
+		{
+			name:      "conflicting record is kept",
+			legacy:    map[string]string{metadataKindAllocation: "legacy", metadataKindMaintenance: "legacy"},
+			prefixed:  map[string]string{metadataKindAllocation: "prefixed"},
+			wantOwner: map[string]string{metadataKindAllocation: "prefixed", metadataKindMaintenance: "legacy"},
+			wantLeft:  1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := fake.NewSimpleClientset()
+			legacy := newMetadataStore(client, "kube-system", DefaultDriverName, "")
+			prefixed := newMetadataStore(client, "kube-system", DefaultDriverName, "/cluster-a/")
+			for kind, owner := range test.legacy {
+				if err := legacy.Put(ctx, kind, "key-1", prefixTestRecord{Owner: owner}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for kind, owner := range test.prefixed {
+				if err := prefixed.Put(ctx, kind, "key-1", prefixTestRecord{Owner: owner}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Migrating twice is the same as once
+			for i := 0; i < 2; i++ {
+				if err := migrateRecords(ctx, legacy, prefixed); err != nil {
+					t.Fatalf("migrateRecords: %v", err)
+				}
+			}
+
+			left := 0
+			for _, kind := range recordKinds {
+				record := prefixTestRecord{}
+				found, err := prefixed.Get(ctx, kind, "key-1", &record)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, migrated := test.wantOwner[kind]; found != migrated || record.Owner != want {
+					t.Errorf("%s record under the prefix = %v, %q, want %v, %q", kind, found, record.Owner, migrated, want)
+				}
+				records, err := legacy.List(ctx, kind)
+				if err != nil {
+					t.Fatal(err)
+				}
+				left += len(records)
+			}
+			if left != test.wantLeft {
+				t.Errorf("records left without prefix = %d, want %d", left, test.wantLeft)
+			}
+		})
+	}
+}
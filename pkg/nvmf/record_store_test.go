@@ -0,0 +1,246 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// recordStoreBackends return stores sharing one persistence, one per prefix,
+// for each persistence of the driver
+var recordStoreBackends = map[string]func(t *testing.T, prefixes ...string) []recordStore{
+	PersistenceKubernetes: func(t *testing.T, prefixes ...string) []recordStore {
+		client := fake.NewSimpleClientset()
+		stores := []recordStore{}
+		for _, prefix := range prefixes {
+			stores = append(stores, newMetadataStore(client, "kube-system", DefaultDriverName, prefix))
+		}
+		return stores
+	},
+	PersistenceFile: func(t *testing.T, prefixes ...string) []recordStore {
+		dir := t.TempDir()
+		stores := []recordStore{}
+		for _, prefix := range prefixes {
+			store, err := newFileStore(dir, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores = append(stores, store)
+		}
+		return stores
+	},
+	PersistenceBolt: func(t *testing.T, prefixes ...string) []recordStore {
+		path := filepath.Join(t.TempDir(), "records.db")
+		stores := []recordStore{}
+		for _, prefix := range prefixes {
+			store, err := newBoltStore(path, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores = append(stores, store)
+		}
+		t.Cleanup(func() {
+			boltDatabases.mutex.Lock()
+			defer boltDatabases.mutex.Unlock()
+			boltDatabases.byPath[filepath.Clean(path)].Close()
+			delete(boltDatabases.byPath, filepath.Clean(path))
+		})
+		return stores
+	},
+}
+
+type conformanceRecord struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// nextRecordEvent returns the next event of events, failing the test if none
+// arrives in time
+func nextRecordEvent(t *testing.T, events <-chan recordEvent) recordEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("watch closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no record event")
+	}
+	return recordEvent{}
+}
+
+func TestRecordStoreConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, store recordStore)
+	}{
+		{
+			name: "get of a missing record",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				found, err := store.Get(ctx, metadataKindAllocation, "missing", &conformanceRecord{})
+				if err != nil || found {
+					t.Errorf("Get = %v, %v, want not found", found, err)
+				}
+			},
+		},
+		{
+			name: "put then get",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				want := conformanceRecord{Name: "pv-1", Count: 1}
+				if err := store.Put(ctx, metadataKindAllocation, "nqn.2024-01.io.example:volume-1", want); err != nil {
+					t.Fatal(err)
+				}
+				got := conformanceRecord{}
+				if found, err := store.Get(ctx, metadataKindAllocation, "nqn.2024-01.io.example:volume-1", &got); err != nil || !found {
+					t.Fatalf("Get = %v, %v", found, err)
+				}
+				if got != want {
+					t.Errorf("Get = %+v, want %+v", got, want)
+				}
+			},
+		},
+		{
+			name: "put replaces",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				for count := 1; count <= 2; count++ {
+					if err := store.Put(ctx, metadataKindSnapshot, "snap-1", conformanceRecord{Name: "snap-1", Count: count}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				got := conformanceRecord{}
+				if found, err := store.Get(ctx, metadataKindSnapshot, "snap-1", &got); err != nil || !found || got.Count != 2 {
+					t.Errorf("Get = %+v, %v, %v, want the second put", got, found, err)
+				}
+			},
+		},
+		{
+			name: "delete is idempotent",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				if err := store.Put(ctx, metadataKindQuarantine, "device-1", conformanceRecord{Name: "device-1"}); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 2; i++ {
+					if err := store.Delete(ctx, metadataKindQuarantine, "device-1"); err != nil {
+						t.Fatalf("Delete %d: %v", i, err)
+					}
+				}
+				if found, err := store.Get(ctx, metadataKindQuarantine, "device-1", &conformanceRecord{}); err != nil || found {
+					t.Errorf("Get after Delete = %v, %v, want not found", found, err)
+				}
+			},
+		},
+		{
+			name: "list returns the records of one kind",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				for _, key := range []string{"pv-1", "pv-2"} {
+					if err := store.Put(ctx, metadataKindAllocation, key, conformanceRecord{Name: key}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := store.Put(ctx, metadataKindMaintenance, "pv-3", conformanceRecord{Name: "pv-3"}); err != nil {
+					t.Fatal(err)
+				}
+
+				records, err := store.List(ctx, metadataKindAllocation)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := map[string]string{}
+				for key, data := range records {
+					got[key] = string(data)
+				}
+				want := map[string]string{"pv-1": `{"name":"pv-1","count":0}`, "pv-2": `{"name":"pv-2","count":0}`}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("List = %v, want %v", got, want)
+				}
+			},
+		},
+		{
+			name: "list of an empty kind",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				records, err := store.List(ctx, metadataKindSnapshot)
+				if err != nil || len(records) != 0 {
+					t.Errorf("List = %v, %v, want no record", records, err)
+				}
+			},
+		},
+		{
+			name: "watch sees puts and deletes of its kind",
+			run: func(t *testing.T, ctx context.Context, store recordStore) {
+				events, err := store.Watch(ctx, metadataKindAllocation)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Put(ctx, metadataKindSnapshot, "snap-1", conformanceRecord{Name: "snap-1"}); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Put(ctx, metadataKindAllocation, "pv-1", conformanceRecord{Name: "pv-1", Count: 1}); err != nil {
+					t.Fatal(err)
+				}
+				if err := store.Delete(ctx, metadataKindAllocation, "pv-1"); err != nil {
+					t.Fatal(err)
+				}
+
+				if event := nextRecordEvent(t, events); event.Key != "pv-1" || string(event.Record) != `{"name":"pv-1","count":1}` {
+					t.Errorf("first event = %s %q, want the put of pv-1", event.Key, event.Record)
+				}
+				if event := nextRecordEvent(t, events); event.Key != "pv-1" || event.Record != nil {
+					t.Errorf("second event = %s %q, want the delete of pv-1", event.Key, event.Record)
+				}
+			},
+		},
+	}
+
+	for persistence, newStores := range recordStoreBackends {
+		for _, test := range tests {
+			t.Run(persistence+"/"+test.name, func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				test.run(t, ctx, newStores(t, "/cluster-a/")[0])
+			})
+		}
+	}
+}
+
+func TestRecordStoreWatchEndsWithContext(t *testing.T) {
+	for persistence, newStores := range recordStoreBackends {
+		t.Run(persistence, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			events, err := newStores(t, "")[0].Watch(ctx, metadataKindAllocation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cancel()
+
+			select {
+			case _, ok := <-events:
+				if ok {
+					t.Error("event after the watch ended")
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("watch not closed once its context is done")
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+)
+
+// recordWatchBuffer is the number of record events buffered per watcher
+// before the writes of the store wait for the watcher
+const recordWatchBuffer = 64
+
+// recordEvent is a change of a record of a record store
+type recordEvent struct {
+	Key string
+	// Record is the raw JSON of the record, nil if it was deleted
+	Record []byte
+}
+
+// recordWatcher receives the events of the records of one kind and prefix
+type recordWatcher struct {
+	kind   string
+	prefix string
+	events chan recordEvent
+	done   <-chan struct{}
+}
+
+// recordWatchers fans the changes of the records of a local store out to its
+// watchers. The stores of a directory or database share their watchers, so
+// that a watcher sees the changes made through any of them.
+type recordWatchers struct {
+	mutex    sync.Mutex
+	watchers map[*recordWatcher]struct{}
+}
+
+// localRecordWatchers are the watchers of the local stores, by path
+var localRecordWatchers = struct {
+	mutex  sync.Mutex
+	byPath map[string]*recordWatchers
+}{byPath: map[string]*recordWatchers{}}
+
+// recordWatchersOf returns the watchers of the local store at path
+func recordWatchersOf(path string) *recordWatchers {
+	localRecordWatchers.mutex.Lock()
+	defer localRecordWatchers.mutex.Unlock()
+
+	path = filepath.Clean(path)
+	watchers, exists := localRecordWatchers.byPath[path]
+	if !exists {
+		watchers = &recordWatchers{watchers: map[*recordWatcher]struct{}{}}
+		localRecordWatchers.byPath[path] = watchers
+	}
+	return watchers
+}
+
+// watch returns the events of the records of kind stored under prefix until
+// ctx is done, when the channel is closed
+func (w *recordWatchers) watch(ctx context.Context, kind, prefix string) <-chan recordEvent {
+	watcher := &recordWatcher{
+		kind:   kind,
+		prefix: prefix,
+		events: make(chan recordEvent, recordWatchBuffer),
+		done:   ctx.Done(),
+	}
+
+	w.mutex.Lock()
+	w.watchers[watcher] = struct{}{}
+	w.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mutex.Lock()
+		delete(w.watchers, watcher)
+		close(watcher.events)
+		w.mutex.Unlock()
+	}()
+
+	return watcher.events
+}
+
+// notify sends the change of the record stored under the prefixed key stored
+// to the watchers of its kind and prefix, nil record if it was deleted. It
+// waits for the watchers whose buffer is full.
+func (w *recordWatchers) notify(kind, stored string, record []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for watcher := range w.watchers {
+		if watcher.kind != kind {
+			continue
+		}
+		key, matches := unprefixedKey(watcher.prefix, stored)
+		if !matches {
+			continue
+		}
+		select {
+		case watcher.events <- recordEvent{Key: key, Record: record}:
+		case <-watcher.done:
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// registryBackupVersion is the version of the registry backup format
+const registryBackupVersion = 1
+
+// maxRegistryBackupBytes bounds the size of a backup accepted by a restore
+const maxRegistryBackupBytes = 64 << 20
+
+// registryBackup is a consistent copy of the allocations and quarantines of the
+// registry, including those recorded only in PVs, and of the snapshot records,
+// to recover from the loss of the Kubernetes API state
+type registryBackup struct {
+	Version     int                        `json:"version"`
+	Driver      string                     `json:"driver"`
+	CreatedAt   time.Time                  `json:"createdAt"`
+	Allocations []allocationRecord         `json:"allocations"`
+	Quarantines []quarantineRecord         `json:"quarantines"`
+	Snapshots   map[string]json.RawMessage `json:"snapshots,omitempty"`
+}
+
+// restoreReport is the outcome of a restore, by "<kind>/<key>" of the entries
+type restoreReport struct {
+	Restored  []string          `json:"restored"`
+	Unchanged []string          `json:"unchanged"`
+	Conflicts map[string]string `json:"conflicts,omitempty"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+// ExportBackup returns a backup of the registry, taken under the registry
+// lock so that no allocation is half recorded
+func (r *DeviceRegistry) ExportBackup(ctx context.Context) (*registryBackup, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if !r.initialSyncDone {
+		return nil, fmt.Errorf("the registry is not synced yet")
+	}
+
+	backup := &registryBackup{
+		Version:     registryBackupVersion,
+		Driver:      r.Driver.name,
+		CreatedAt:   time.Now().UTC(),
+		Allocations: []allocationRecord{},
+		Quarantines: []quarantineRecord{},
+	}
+	for id, device := range r.devices {
+		switch {
+		case device.isQuarantined():
+			backup.Quarantines = append(backup.Quarantines, quarantineRecord{
+				VolumeID:    id,
+				VolumeName:  device.VolName,
+				Transport:   device.Transport,
+				Endpoints:   device.Endpoints,
+				Capacity:    device.Capacity,
+				UsedBytes:   device.UsedBytes,
+				VolumeBytes: device.VolumeBytes,
+				SkipWipe:    device.SkipWipe,
+				Expiry:      device.QuarantinedUntil,
+			})
+		case device.IsAllocated:
+			backup.Allocations = append(backup.Allocations, allocationRecord{
+				VolumeID:        id,
+				VolumeName:      device.VolName,
+				Transport:       device.Transport,
+				Endpoints:       device.Endpoints,
+				Capacity:        device.Capacity,
+				UsedBytes:       device.UsedBytes,
+				VolumeBytes:     device.VolumeBytes,
+				SkipWipe:        device.SkipWipe,
+				AffinityKey:     device.AffinityKey,
+				AntiAffinityKey: device.AntiAffinityKey,
+				QoS:             recordedQoS(device.QoS),
+				AllowedHosts:    device.AllowedHosts,
+				Dynamic:         device.Dynamic,
+				Labels:          device.Labels,
+			})
+		}
+	}
+	sort.Slice(backup.Allocations, func(i, j int) bool {
+		return backup.Allocations[i].VolumeName < backup.Allocations[j].VolumeName
+	})
+	sort.Slice(backup.Quarantines, func(i, j int) bool {
+		return backup.Quarantines[i].VolumeID < backup.Quarantines[j].VolumeID
+	})
+
+	snapshots, err := r.Driver.metadata.List(ctx, metadataKindSnapshot)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to list snapshot records: %v", ErrEtcdUnavailable, err)
+	}
+	backup.Snapshots = make(map[string]json.RawMessage, len(snapshots))
+	for id, data := range snapshots {
+		backup.Snapshots[id] = data
+	}
+
+	klog.Infof("Exported %d allocation(s), %d quarantine(s) and %d snapshot record(s)", len(backup.Allocations), len(backup.Quarantines), len(backup.Snapshots))
+	return backup, nil
+}
+
+// RestoreBackup loads the entries of a backup the live state lacks, recording
+// them before the registry is updated. An entry the live state holds
+// differently, e.g. a device allocated to another volume since the backup, is
+// a conflict and is left as it is.
+func (r *DeviceRegistry) RestoreBackup(ctx context.Context, backup *registryBackup) (*restoreReport, error) {
+	if backup.Version != registryBackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d, expected %d", backup.Version, registryBackupVersion)
+	}
+	if backup.Driver != r.Driver.name {
+		return nil, fmt.Errorf("backup of driver %s cannot be restored into driver %s", backup.Driver, r.Driver.name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.initialSyncDone {
+		return nil, fmt.Errorf("the registry is not synced yet")
+	}
+
+	report := &restoreReport{
+		Restored:  []string{},
+		Unchanged: []string{},
+		Conflicts: map[string]string{},
+		Failed:    map[string]string{},
+	}
+	for i := range backup.Allocations {
+		r.restoreBackupAllocation(ctx, &backup.Allocations[i], report)
+	}
+	for i := range backup.Quarantines {
+		r.restoreBackupQuarantine(ctx, &backup.Quarantines[i], report)
+	}
+	for id, data := range backup.Snapshots {
+		r.restoreBackupSnapshot(ctx, id, data, report)
+	}
+
+	klog.Infof("Restored %d backup entries, %d unchanged, %d conflicting, %d failed",
+		len(report.Restored), len(report.Unchanged), len(report.Conflicts), len(report.Failed))
+	return report, nil
+}
+
+// backupConflict returns why the live state holding the device or the volume
+// differently conflicts with a backup entry, or an empty string
+func (r *DeviceRegistry) backupConflict(volumeID, volumeName string) string {
+	if id, exists := r.volumeToNQN[volumeName]; exists {
+		return fmt.Sprintf("volume %s is allocated device %s", volumeName, id)
+	}
+	if id, exists := r.quarantined[volumeName]; exists {
+		return fmt.Sprintf("volume %s is deleted, device %s is quarantined", volumeName, id)
+	}
+	if device, exists := r.devices[volumeID]; exists && (device.IsAllocated || device.isQuarantined()) {
+		return fmt.Sprintf("device %s is held by volume %s", volumeID, device.VolName)
+	}
+	if device, exists := r.devices[volumeID]; exists && device.warming {
+		return fmt.Sprintf("device %s is being inspected by the warm pool", volumeID)
+	}
+
+	return ""
+}
+
+// restoreBackupAllocation restores an allocation of a backup. Caller must hold the mutex.
+func (r *DeviceRegistry) restoreBackupAllocation(ctx context.Context, record *allocationRecord, report *restoreReport) {
+	entry := metadataKindAllocation + "/" + record.VolumeName
+	if id, exists := r.volumeToNQN[record.VolumeName]; exists && id == record.VolumeID {
+		report.Unchanged = append(report.Unchanged, entry)
+		return
+	}
+	if conflict := r.backupConflict(record.VolumeID, record.VolumeName); conflict != "" {
+		report.Conflicts[entry] = conflict
+		return
+	}
+
+	if err := r.Driver.metadata.Put(ctx, metadataKindAllocation, record.VolumeName, record); err != nil {
+		report.Failed[entry] = fmt.Sprintf("%v: %v", ErrEtcdUnavailable, err)
+		return
+	}
+
+	if device, exists := r.devices[record.VolumeID]; exists {
+		// Keep the transport and endpoints of the discovered device
+		delete(r.availableNQNs, record.VolumeID)
+		device.VolName = record.VolumeName
+		device.IsAllocated = true
+		device.UsedBytes = record.UsedBytes
+		device.VolumeBytes = record.VolumeBytes
+		device.SkipWipe = record.SkipWipe
+		device.AffinityKey = record.AffinityKey
+		device.AntiAffinityKey = record.AntiAffinityKey
+		device.QoS = record.qos()
+		device.AllowedHosts = record.AllowedHosts
+		device.Dynamic = record.Dynamic
+		// The allocated device keeps the labels it was created with, those
+		// of backups predating labels are left to the current rules
+		if record.Labels != nil {
+			device.Labels = record.Labels
+		}
+	} else {
+		r.devices[record.VolumeID] = record.volumeInfo()
+	}
+	r.volumeToNQN[record.VolumeName] = record.VolumeID
+	report.Restored = append(report.Restored, entry)
+}
+
+// restoreBackupQuarantine restores a quarantine of a backup. An expired
+// quarantine is released by the reclaim loop. Caller must hold the mutex.
+func (r *DeviceRegistry) restoreBackupQuarantine(ctx context.Context, record *quarantineRecord, report *restoreReport) {
+	entry := metadataKindQuarantine + "/" + record.VolumeID
+	if id, exists := r.quarantined[record.VolumeName]; exists && id == record.VolumeID {
+		report.Unchanged = append(report.Unchanged, entry)
+		return
+	}
+	if conflict := r.backupConflict(record.VolumeID, record.VolumeName); conflict != "" {
+		report.Conflicts[entry] = conflict
+		return
+	}
+
+	if err := r.Driver.metadata.Put(ctx, metadataKindQuarantine, record.VolumeID, record); err != nil {
+		report.Failed[entry] = fmt.Sprintf("%v: %v", ErrEtcdUnavailable, err)
+		return
+	}
+
+	if device, exists := r.devices[record.VolumeID]; exists {
+		delete(r.availableNQNs, record.VolumeID)
+		device.VolName = record.VolumeName
+		device.UsedBytes = record.UsedBytes
+		device.VolumeBytes = record.VolumeBytes
+		device.SkipWipe = record.SkipWipe
+		device.QuarantinedUntil = record.Expiry
+	} else {
+		r.devices[record.VolumeID] = record.volumeInfo(record.VolumeID)
+	}
+	r.quarantined[record.VolumeName] = record.VolumeID
+	report.Restored = append(report.Restored, entry)
+}
+
+// restoreBackupSnapshot restores a snapshot record of a backup
+func (r *DeviceRegistry) restoreBackupSnapshot(ctx context.Context, id string, data json.RawMessage, report *restoreReport) {
+	entry := metadataKindSnapshot + "/" + id
+
+	var backedUp, live interface{}
+	if err := json.Unmarshal(data, &backedUp); err != nil {
+		report.Failed[entry] = fmt.Sprintf("malformed record: %v", err)
+		return
+	}
+	exists, err := r.Driver.metadata.Get(ctx, metadataKindSnapshot, id, &live)
+	if err != nil {
+		report.Failed[entry] = fmt.Sprintf("%v: %v", ErrEtcdUnavailable, err)
+		return
+	}
+	if exists {
+		if reflect.DeepEqual(backedUp, live) {
+			report.Unchanged = append(report.Unchanged, entry)
+		} else {
+			report.Conflicts[entry] = fmt.Sprintf("snapshot %s is recorded differently", id)
+		}
+		return
+	}
+
+	if err := r.Driver.metadata.Put(ctx, metadataKindSnapshot, id, data); err != nil {
+		report.Failed[entry] = fmt.Sprintf("%v: %v", ErrEtcdUnavailable, err)
+		return
+	}
+	report.Restored = append(report.Restored, entry)
+}
+
+// backupHandler exports the registry on GET and restores a backup on POST.
+// A restore with conflicts answers 409, one with failures 500.
+func (d *driver) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if d.controllerServer == nil {
+		http.Error(w, "not running as controller", http.StatusNotFound)
+		return
+	}
+	if d.leaderElection != nil && !d.leaderElection.isLeader() {
+		http.Error(w, "not the leader controller replica", http.StatusServiceUnavailable)
+		return
+	}
+	registry := d.controllerServer.deviceRegistry
+	if !registry.SyncStatus().InitialSyncDone {
+		http.Error(w, "the registry is not synced yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		backup, err := registry.ExportBackup(r.Context())
+		if err != nil {
+			klog.Errorf("Failed to export the registry: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "nvmf-registry-"+backup.CreatedAt.Format("20060102T150405Z")+".json"))
+		writeJSON(w, backup)
+	case http.MethodPost:
+		backup := &registryBackup{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegistryBackupBytes)).Decode(backup); err != nil {
+			http.Error(w, fmt.Sprintf("malformed backup: %v", err), http.StatusBadRequest)
+			return
+		}
+		report, err := registry.RestoreBackup(r.Context(), backup)
+		if err != nil {
+			klog.Errorf("Failed to restore the registry: %v", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case len(report.Failed) > 0:
+			w.WriteHeader(http.StatusInternalServerError)
+		case len(report.Conflicts) > 0:
+			w.WriteHeader(http.StatusConflict)
+		}
+		writeJSON(w, report)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,391 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	backupNqn2 = "nqn.2024-01.io.example:volume-2"
+	backupNqn3 = "nqn.2024-01.io.example:volume-3"
+)
+
+// newBackupServer returns a controller of three devices, labelled by the media
+// of the array
+func newBackupServer(t *testing.T, media string) *ControllerServer {
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.reclaimRetention = time.Hour
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, backupNqn2, backupNqn3)
+	c.deviceRegistry.labeler = &deviceLabeler{rules: []labelRule{
+		{pattern: "192.0.2.10:4420", labels: map[string]string{"media": media}},
+	}}
+	return c
+}
+
+// createPinned creates a volume on the device of the NQN
+func createPinned(t *testing.T, c *ControllerServer, name, nqn string) {
+	t.Helper()
+	if _, err := c.CreateVolume(context.Background(), createRequest(name, map[string]string{paramPinnedNqn: nqn, paramAffinityKey: "db"})); err != nil {
+		t.Fatalf("CreateVolume(%s): %v", name, err)
+	}
+}
+
+// putSnapshot records a snapshot of pv-1 of the size
+func putSnapshot(t *testing.T, c *ControllerServer, size int64) {
+	t.Helper()
+	record := &snapshotRecord{SnapshotID: "snap-1", Name: "snapshot-1", SourceVolumeID: testVolumeNqn, SizeBytes: size, ReadyToUse: true}
+	if err := c.Driver.metadata.Put(context.Background(), metadataKindSnapshot, "snap-1", record); err != nil {
+		t.Fatalf("Put(snapshot): %v", err)
+	}
+}
+
+// exportedBackup returns a backup of the controller holding pv-1 on the test
+// device, deleted pv-2 quarantined on the second device and a snapshot, as
+// read back from the file a restore is given
+func exportedBackup(t *testing.T, c *ControllerServer) *registryBackup {
+	t.Helper()
+	ctx := context.Background()
+	createPinned(t, c, "pv-1", testVolumeNqn)
+	createPinned(t, c, "pv-2", backupNqn2)
+	if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: backupNqn2}); err != nil {
+		t.Fatalf("DeleteVolume(pv-2): %v", err)
+	}
+	putSnapshot(t, c, 1<<30)
+
+	backup, err := c.deviceRegistry.ExportBackup(ctx)
+	if err != nil {
+		t.Fatalf("ExportBackup: %v", err)
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	decoded := &registryBackup{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return decoded
+}
+
+// storedAllocation returns the allocation record of the volume
+func storedAllocation(t *testing.T, c *ControllerServer, name string) *allocationRecord {
+	t.Helper()
+	record := &allocationRecord{}
+	exists, err := c.Driver.metadata.Get(context.Background(), metadataKindAllocation, name, record)
+	if err != nil || !exists {
+		t.Fatalf("Get(allocation %s) = %v, %v", name, exists, err)
+	}
+	return record
+}
+
+// storedQuarantine returns the quarantine record of the device, without the
+// deletion date a backup does not carry
+func storedQuarantine(t *testing.T, c *ControllerServer, id string) *quarantineRecord {
+	t.Helper()
+	record := &quarantineRecord{}
+	exists, err := c.Driver.metadata.Get(context.Background(), metadataKindQuarantine, id, record)
+	if err != nil || !exists {
+		t.Fatalf("Get(quarantine %s) = %v, %v", id, exists, err)
+	}
+	record.DeletedAt = time.Time{}
+	return record
+}
+
+func TestExportBackup(t *testing.T) {
+	source := newBackupServer(t, "nvme-ssd")
+	backup := exportedBackup(t, source)
+
+	if backup.Version != registryBackupVersion || backup.Driver != source.Driver.name {
+		t.Errorf("backup version %d of driver %s, want %d of %s", backup.Version, backup.Driver, registryBackupVersion, source.Driver.name)
+	}
+	if len(backup.Allocations) != 1 || !reflect.DeepEqual(&backup.Allocations[0], storedAllocation(t, source, "pv-1")) {
+		t.Errorf("backup allocations = %+v, want the record of pv-1 %+v", backup.Allocations, storedAllocation(t, source, "pv-1"))
+	}
+	if len(backup.Quarantines) != 1 || !reflect.DeepEqual(&backup.Quarantines[0], storedQuarantine(t, source, backupNqn2)) {
+		t.Errorf("backup quarantines = %+v, want the record of pv-2 %+v", backup.Quarantines, storedQuarantine(t, source, backupNqn2))
+	}
+	if _, exists := backup.Snapshots["snap-1"]; len(backup.Snapshots) != 1 || !exists {
+		t.Errorf("backup snapshots = %v, want snap-1", backup.Snapshots)
+	}
+
+	// A registry not synced yet has nothing consistent to export
+	unsynced := newBackupServer(t, "nvme-ssd")
+	if _, err := unsynced.deviceRegistry.ExportBackup(context.Background()); err == nil {
+		t.Error("ExportBackup of an unsynced registry succeeded")
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	const (
+		allocationEntry = metadataKindAllocation + "/pv-1"
+		quarantineEntry = metadataKindQuarantine + "/" + backupNqn2
+		snapshotEntry   = metadataKindSnapshot + "/snap-1"
+	)
+
+	tests := []struct {
+		name string
+		// same restores into the exported controller instead of one that lost
+		// its state
+		same bool
+		// live sets up the state of the controller restored into
+		live          func(t *testing.T, c *ControllerServer)
+		failingStore  bool
+		wantRestored  []string
+		wantUnchanged []string
+		wantConflicts []string
+		wantFailed    []string
+	}{
+		{
+			name:         "lost state",
+			wantRestored: []string{allocationEntry, quarantineEntry, snapshotEntry},
+		},
+		{
+			name:          "same state",
+			same:          true,
+			wantUnchanged: []string{allocationEntry, quarantineEntry, snapshotEntry},
+		},
+		{
+			name:          "device allocated to another volume",
+			live:          func(t *testing.T, c *ControllerServer) { createPinned(t, c, "pv-3", testVolumeNqn) },
+			wantRestored:  []string{quarantineEntry, snapshotEntry},
+			wantConflicts: []string{allocationEntry},
+		},
+		{
+			name:          "volume allocated another device",
+			live:          func(t *testing.T, c *ControllerServer) { createPinned(t, c, "pv-1", backupNqn3) },
+			wantRestored:  []string{quarantineEntry, snapshotEntry},
+			wantConflicts: []string{allocationEntry},
+		},
+		{
+			name:          "quarantined device allocated again",
+			live:          func(t *testing.T, c *ControllerServer) { createPinned(t, c, "pv-3", backupNqn2) },
+			wantRestored:  []string{allocationEntry, snapshotEntry},
+			wantConflicts: []string{quarantineEntry},
+		},
+		{
+			name:          "snapshot recorded differently",
+			live:          func(t *testing.T, c *ControllerServer) { putSnapshot(t, c, 2<<30) },
+			wantRestored:  []string{allocationEntry, quarantineEntry},
+			wantConflicts: []string{snapshotEntry},
+		},
+		{
+			name:         "store unavailable",
+			failingStore: true,
+			wantFailed:   []string{allocationEntry, quarantineEntry, snapshotEntry},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			source := newBackupServer(t, "nvme-ssd")
+			backup := exportedBackup(t, source)
+
+			// The rules changed since the backup, the restored allocation keeps
+			// the labels it was created with
+			c := source
+			if !test.same {
+				c = newBackupServer(t, "qlc")
+			}
+			r := c.deviceRegistry
+			if err := r.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			if err := r.DiscoverDevices(ctx, &VolumeParams{Transport: "tcp", TargetAddr: "192.0.2.10", TargetPort: "4420"}); err != nil {
+				t.Fatalf("DiscoverDevices: %v", err)
+			}
+			if test.live != nil {
+				test.live(t, c)
+			}
+			if test.failingStore {
+				c.Driver.metadata = failingStore{c.Driver.metadata}
+			}
+
+			report, err := r.RestoreBackup(ctx, backup)
+			if err != nil {
+				t.Fatalf("RestoreBackup: %v", err)
+			}
+			for _, check := range []struct {
+				kind string
+				got  []string
+				want []string
+			}{
+				{kind: "restored", got: report.Restored, want: test.wantRestored},
+				{kind: "unchanged", got: report.Unchanged, want: test.wantUnchanged},
+				{kind: "conflicting", got: entryKeys(report.Conflicts), want: test.wantConflicts},
+				{kind: "failed", got: entryKeys(report.Failed), want: test.wantFailed},
+			} {
+				sort.Strings(check.got)
+				sort.Strings(check.want)
+				if len(check.got) != 0 || len(check.want) != 0 {
+					if !reflect.DeepEqual(check.got, check.want) {
+						t.Errorf("%s entries = %v, want %v", check.kind, check.got, check.want)
+					}
+				}
+			}
+
+			restored := map[string]bool{}
+			for _, entry := range report.Restored {
+				restored[entry] = true
+			}
+			if restored[allocationEntry] {
+				device := r.devices[testVolumeNqn]
+				if r.volumeToNQN["pv-1"] != testVolumeNqn || !device.IsAllocated || device.Labels["media"] != "nvme-ssd" {
+					t.Errorf("restored device of pv-1 = %+v, want allocated with the media nvme-ssd", device)
+				}
+				if _, free := r.availableNQNs[testVolumeNqn]; free {
+					t.Error("restored device of pv-1 is still in the pool")
+				}
+				if got, want := storedAllocation(t, c, "pv-1"), storedAllocation(t, source, "pv-1"); !reflect.DeepEqual(got, want) {
+					t.Errorf("restored allocation record = %+v, want %+v", got, want)
+				}
+			}
+			if restored[quarantineEntry] {
+				if r.quarantined["pv-2"] != backupNqn2 || !r.devices[backupNqn2].isQuarantined() {
+					t.Errorf("quarantine of pv-2 was not restored: %v", r.quarantined)
+				}
+				if _, free := r.availableNQNs[backupNqn2]; free {
+					t.Error("restored quarantined device is still in the pool")
+				}
+				if got, want := storedQuarantine(t, c, backupNqn2), storedQuarantine(t, source, backupNqn2); !reflect.DeepEqual(got, want) {
+					t.Errorf("restored quarantine record = %+v, want %+v", got, want)
+				}
+			}
+			if test.failingStore {
+				if _, exists := r.volumeToNQN["pv-1"]; exists {
+					t.Error("registry holds pv-1 whose record failed to be restored")
+				}
+				if _, exists := r.quarantined["pv-2"]; exists {
+					t.Error("registry holds the quarantine whose record failed to be restored")
+				}
+			}
+		})
+	}
+}
+
+// entryKeys returns the entries of a report map
+func entryKeys(entries map[string]string) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestRestoreBackupRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(backup *registryBackup)
+	}{
+		{name: "unsupported version", modify: func(backup *registryBackup) { backup.Version = registryBackupVersion + 1 }},
+		{name: "other driver", modify: func(backup *registryBackup) { backup.Driver = "other.csi.example.com" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			backup := exportedBackup(t, newBackupServer(t, "nvme-ssd"))
+			test.modify(backup)
+
+			c := newBackupServer(t, "nvme-ssd")
+			if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+				t.Fatalf("EnsureInitialSync: %v", err)
+			}
+			if _, err := c.deviceRegistry.RestoreBackup(ctx, backup); err == nil {
+				t.Fatal("RestoreBackup succeeded, want an error")
+			}
+			if len(c.deviceRegistry.volumeToNQN) != 0 {
+				t.Errorf("rejected backup restored allocations %v", c.deviceRegistry.volumeToNQN)
+			}
+		})
+	}
+}
+
+func TestBackupHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// body is the restored backup, the exported one if empty
+		body string
+		// live allocates the device of pv-1 to another volume
+		live     bool
+		notSync  bool
+		notCtrl  bool
+		want     int
+		wantBody string
+	}{
+		{name: "export", method: http.MethodGet, want: http.StatusOK, wantBody: `"volumeName":"pv-1"`},
+		{name: "restore", method: http.MethodPost, want: http.StatusOK, wantBody: `"restored":[`},
+		{name: "restore with conflicts", method: http.MethodPost, live: true, want: http.StatusConflict, wantBody: "device " + testVolumeNqn + " is held by volume pv-3"},
+		{name: "malformed backup", method: http.MethodPost, body: "{", want: http.StatusBadRequest},
+		{name: "unsupported version", method: http.MethodPost, body: `{"version":2}`, want: http.StatusUnprocessableEntity},
+		{name: "other method", method: http.MethodDelete, want: http.StatusMethodNotAllowed},
+		{name: "not synced", method: http.MethodGet, notSync: true, want: http.StatusServiceUnavailable},
+		{name: "not a controller", method: http.MethodGet, notCtrl: true, want: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			body := []byte(test.body)
+			if test.body == "" {
+				var err error
+				if body, err = json.Marshal(exportedBackup(t, newBackupServer(t, "nvme-ssd"))); err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+			}
+
+			c := newBackupServer(t, "nvme-ssd")
+			if test.method == http.MethodGet && !test.notSync {
+				createPinned(t, c, "pv-1", testVolumeNqn)
+			}
+			if test.live {
+				createPinned(t, c, "pv-3", testVolumeNqn)
+			}
+			if !test.notSync {
+				if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+					t.Fatalf("EnsureInitialSync: %v", err)
+				}
+			}
+			c.Driver.controllerServer = c
+			if test.notCtrl {
+				c.Driver.controllerServer = nil
+			}
+
+			w := httptest.NewRecorder()
+			c.Driver.backupHandler(w, httptest.NewRequest(test.method, "/backup", bytes.NewReader(body)))
+			if w.Code != test.want {
+				t.Fatalf("/backup status = %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+			if !bytes.Contains(w.Body.Bytes(), []byte(test.wantBody)) {
+				t.Errorf("/backup body = %s, want it to contain %s", w.Body, test.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxDeadlineMarginFraction caps the margin at a fraction of the time left to
+// a request, so that short deadlines keep most of their time
+const maxDeadlineMarginFraction = 4
+
+// deadlineMargin returns the margin taken off a request with remaining time
+func deadlineMargin(margin, remaining time.Duration) time.Duration {
+	if limit := remaining / maxDeadlineMarginFraction; margin > limit {
+		return limit
+	}
+	return margin
+}
+
+// deadlineInterceptor moves the deadline of each request margin earlier, so
+// that discovery, registry and metadata writes and nvme-cli invocations bound
+// by the request context end, and the driver returns DeadlineExceeded, before
+// the CO abandons the call mid-operation. Requests without a deadline keep the
+// configured operation timeouts only.
+func deadlineInterceptor(margin time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, status.Errorf(codes.DeadlineExceeded, "%s received after its deadline", info.FullMethod)
+		}
+
+		ctx, cancel := context.WithDeadline(ctx, deadline.Add(-deadlineMargin(margin, remaining)))
+		defer cancel()
+
+		return handler(ctx, req)
+	}
+}
+
+// requestConnectOptions returns the connect options of a request, whose
+// connects, retries and device waits end by the deadline of ctx
+func (d *driver) requestConnectOptions(ctx context.Context) connectOptions {
+	opts := d.connectOptions()
+	if deadline, ok := ctx.Deadline(); ok {
+		opts.Deadline = deadline
+	}
+	return opts
+}
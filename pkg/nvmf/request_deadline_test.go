@@ -0,0 +1,182 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeadlineMargin(t *testing.T) {
+	tests := []struct {
+		name      string
+		margin    time.Duration
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{name: "long deadline", margin: 2 * time.Second, remaining: time.Minute, want: 2 * time.Second},
+		{name: "at the cap", margin: 2 * time.Second, remaining: 8 * time.Second, want: 2 * time.Second},
+		{name: "short deadline", margin: 2 * time.Second, remaining: 4 * time.Second, want: time.Second},
+		{name: "no margin", remaining: time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := deadlineMargin(test.margin, test.remaining); got != test.want {
+				t.Errorf("deadlineMargin(%v, %v) = %v, want %v", test.margin, test.remaining, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeadlineInterceptor(t *testing.T) {
+	const margin = 2 * time.Second
+
+	tests := []struct {
+		name string
+		// timeout is the time left to the request, 0 for no deadline
+		timeout time.Duration
+		// wantLeft is the time left to the handler, 0 for no deadline
+		wantLeft time.Duration
+		want     codes.Code
+	}{
+		{name: "no deadline"},
+		{name: "long deadline", timeout: time.Minute, wantLeft: time.Minute - margin},
+		{name: "short deadline", timeout: 4 * time.Second, wantLeft: 3 * time.Second},
+		{name: "expired deadline", timeout: -time.Second, want: codes.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeout)
+				defer cancel()
+			}
+
+			handled := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				handled = true
+				deadline, ok := ctx.Deadline()
+				if ok != (test.wantLeft != 0) {
+					t.Fatalf("handler deadline set = %t, want %t", ok, test.wantLeft != 0)
+				}
+				// Allow for the time the test took to get there
+				if left := time.Until(deadline); ok && (left > test.wantLeft || left < test.wantLeft-time.Second) {
+					t.Errorf("handler has %v left, want %v", left, test.wantLeft)
+				}
+				return nil, nil
+			}
+
+			info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+			_, err := deadlineInterceptor(margin)(ctx, nil, info, handler)
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("code = %v, want %v: %v", got, test.want, err)
+			}
+			if handled != (test.want == codes.OK) {
+				t.Errorf("handled = %t, want %t", handled, test.want == codes.OK)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeBeforeDeadline(t *testing.T) {
+	const (
+		timeout = time.Second
+		margin  = 300 * time.Millisecond
+	)
+
+	tests := []struct {
+		name          string
+		discoverDelay time.Duration
+		want          codes.Code
+	}{
+		{name: "discovery within the deadline", discoverDelay: 50 * time.Millisecond},
+		{name: "discovery beyond the deadline", discoverDelay: 10 * time.Second, want: codes.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discoverDelay = test.discoverDelay
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+			_, err := deadlineInterceptor(margin)(ctx, createRequest("pv-1", nil), info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return c.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+			})
+			elapsed := time.Since(start)
+
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("CreateVolume code = %v, want %v: %v", got, test.want, err)
+			}
+			// The driver answers before the caller gives up on the request
+			if elapsed >= timeout {
+				t.Errorf("CreateVolume returned after %v, want before the deadline of %v", elapsed, timeout)
+			}
+			_, allocated := c.deviceRegistry.volumeToNQN["pv-1"]
+			if allocated != (test.want == codes.OK) {
+				t.Errorf("pv-1 allocated = %t, want %t", allocated, test.want == codes.OK)
+			}
+		})
+	}
+}
+
+func TestRequestConnectOptions(t *testing.T) {
+	d := &driver{nvmeCliTimeout: time.Minute}
+	deadline := time.Now().Add(time.Second)
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want time.Time
+	}{
+		{name: "no deadline", ctx: context.Background()},
+		{name: "deadline", ctx: deadlineContext(t, deadline), want: deadline},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := d.requestConnectOptions(test.ctx)
+			if !opts.Deadline.Equal(test.want) {
+				t.Errorf("connect deadline = %v, want %v", opts.Deadline, test.want)
+			}
+			connector := getNvmfConnector(&nvmfDiskInfo{Nqn: testVolumeNqn}, testNodeHostNqn, opts)
+			if !connector.Deadline.Equal(test.want) || connector.Timeout != time.Minute {
+				t.Errorf("connector deadline %v and timeout %v, want %v and the configured timeout", connector.Deadline, connector.Timeout, test.want)
+			}
+		})
+	}
+}
+
+// deadlineContext returns a context of the deadline, cancelled at the end of the test
+func deadlineContext(t *testing.T, deadline time.Time) context.Context {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// selfTestHostNqn is the host NQN the self-test connects with, unless the
+// backend grants another one
+const selfTestHostNqn = "nqn.2014-08.org.nvmexpress:csi-nvmf-selftest"
+
+// selfTestTimeout bounds a self-test run, its teardown is bounded separately
+const selfTestTimeout = 2 * time.Minute
+
+// selfTestBlockSize is the size of the block written and read back at the
+// start of the test namespace, aligned for direct I/O
+const selfTestBlockSize = 4096
+
+// Results of a self-test step
+const (
+	selfTestPassed  = "passed"
+	selfTestFailed  = "failed"
+	selfTestSkipped = "skipped"
+)
+
+// selfTestStep is the outcome of one step of a self-test
+type selfTestStep struct {
+	Name     string `json:"name"`
+	Result   string `json:"result"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// selfTestReport is the body of the /selftest endpoint
+type selfTestReport struct {
+	Passed   bool           `json:"passed"`
+	Nqn      string         `json:"nqn"`
+	Steps    []selfTestStep `json:"steps"`
+	Duration string         `json:"duration"`
+}
+
+// selfTest runs the steps of a self-test and the teardown of the resources
+// they set up, in reverse order, whether or not a step failed
+type selfTest struct {
+	report   *selfTestReport
+	teardown []selfTestUndo
+}
+
+type selfTestUndo struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// run runs a step and reports whether it passed. fn returns errSelfTestSkipped
+// if the step does not apply.
+func (t *selfTest) run(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	step := selfTestStep{Name: name, Result: selfTestPassed, Duration: time.Since(start).String()}
+	switch {
+	case err == errSelfTestSkipped:
+		step.Result = selfTestSkipped
+	case err != nil:
+		step.Result, step.Error = selfTestFailed, err.Error()
+		t.report.Passed = false
+	}
+	t.report.Steps = append(t.report.Steps, step)
+
+	return err == nil || err == errSelfTestSkipped
+}
+
+// undo registers the teardown of a resource set up by a passed step
+func (t *selfTest) undo(name string, fn func(ctx context.Context) error) {
+	t.teardown = append(t.teardown, selfTestUndo{name: name, fn: fn})
+}
+
+// finish runs the teardown with a context of its own, so that resources are
+// released even if the request was cancelled
+func (t *selfTest) finish() {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	for i := len(t.teardown) - 1; i >= 0; i-- {
+		undo := t.teardown[i]
+		t.run(undo.name, func() error { return undo.fn(ctx) })
+	}
+}
+
+// errSelfTestSkipped is returned by steps that do not apply
+var errSelfTestSkipped = errors.New("skipped")
+
+// runSelfTest allocates the test device, grants this node access to it,
+// connects it, writes and reads back a block, then disconnects, revokes and
+// releases it. The test device is overwritten, so it must be dedicated to the
+// self-test.
+func (c *ControllerServer) runSelfTest(ctx context.Context, testNqn string) *selfTestReport {
+	start := time.Now()
+	t := &selfTest{report: &selfTestReport{Passed: true, Nqn: testNqn}}
+	defer func() { t.report.Duration = time.Since(start).String() }()
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	volumeName := "selftest-" + strconv.FormatInt(start.UnixNano(), 36)
+	if !c.Driver.volumeLocks.TryAcquire(testNqn) {
+		t.run("lock", func() error { return fmt.Errorf("test device %s is in use, e.g. by another self-test", testNqn) })
+		return t.report
+	}
+	defer c.Driver.volumeLocks.Release(testNqn)
+	defer t.finish()
+
+	klog.Infof("Running self-test of volume %s on device %s", volumeName, testNqn)
+	var device *VolumeInfo
+	if !t.run("allocate", func() (err error) {
+		device, err = c.allocateSelfTestDevice(ctx, volumeName, testNqn)
+		return err
+	}) {
+		return t.report
+	}
+	t.undo("release", func(ctx context.Context) error { return c.deviceRegistry.ReleaseDevice(testNqn) })
+
+	hostNqn := selfTestHostNqn
+	if !t.run("grant", func() error {
+		granter, ok := c.Driver.granter()
+		if !ok {
+			return errSelfTestSkipped
+		}
+		publishContext, err := c.grantNodeAccess(ctx, granter, testNqn, c.Driver.nodeId)
+		if err != nil {
+			return err
+		}
+		if granted := publishContext[publishContextHostNqn]; granted != "" {
+			hostNqn = granted
+		}
+		t.undo("revoke", func(ctx context.Context) error {
+			return c.revokeNodeAccess(ctx, granter, testNqn, c.Driver.nodeId)
+		})
+		return nil
+	}) {
+		return t.report
+	}
+
+	var devicePath string
+	if !t.run("connect", func() (err error) {
+		connector := getNvmfConnector(device.nvmfDiskInfo, hostNqn, c.Driver.requestConnectOptions(ctx))
+		devicePath, err = AttachDisk(c.Driver.nvme, testNqn, connector)
+		return err
+	}) {
+		// A failed connect may leave controllers behind
+		t.undo("disconnect", func(ctx context.Context) error {
+			return c.Driver.nvme.Disconnect(device.Nqn, hostNqn, c.Driver.nvmeCliTimeout)
+		})
+		return t.report
+	}
+	t.undo("disconnect", func(ctx context.Context) error {
+		return DetachDisk(c.Driver.nvme, device.Nqn, hostNqn, c.Driver.nvmeCliTimeout)
+	})
+
+	t.run("write-read", func() error { return verifyDeviceIO(devicePath) })
+	return t.report
+}
+
+// allocateSelfTestDevice discovers the devices of the default parameters and
+// allocates the test device to the self-test volume
+func (c *ControllerServer) allocateSelfTestDevice(ctx context.Context, volumeName, testNqn string) (*VolumeInfo, error) {
+	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		return nil, err
+	}
+
+	params, err := c.Driver.parseVolumeParams(c.Driver.withDefaults(map[string]string{}))
+	if err != nil {
+		return nil, err
+	}
+	if params.TargetAddr != "" {
+		if err := c.deviceRegistry.DiscoverDevices(ctx, params); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.deviceRegistry.AllocateDevice(ctx, &AllocationRequest{VolumeName: volumeName, PinnedID: testNqn})
+}
+
+// verifyDeviceIO writes and reads back a block of the connected test device,
+// replaced in tests
+var verifyDeviceIO = verifyBlockIO
+
+// verifyBlockIO writes a random block at the start of the device and reads it
+// back, bypassing the page cache
+func verifyBlockIO(devicePath string) error {
+	file, err := os.OpenFile(devicePath, os.O_RDWR|syscall.O_DIRECT|syscall.O_SYNC, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Direct I/O requires an aligned buffer, which an anonymous mapping is
+	buf, err := syscall.Mmap(-1, 0, selfTestBlockSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return fmt.Errorf("failed to allocate I/O buffer: %v", err)
+	}
+	defer syscall.Munmap(buf)
+
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	pattern := append([]byte(nil), buf...)
+	if _, err := file.WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("failed to write %s: %v", devicePath, err)
+	}
+
+	for i := range buf {
+		buf[i] = 0
+	}
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("failed to read %s: %v", devicePath, err)
+	}
+	if !bytes.Equal(buf, pattern) {
+		return fmt.Errorf("block read back from %s differs from the block written", devicePath)
+	}
+
+	return nil
+}
+
+// selfTestHandler runs a self-test on POST and reports its steps. The status
+// is 200 if it passed and 500 otherwise.
+func (d *driver) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.controllerServer == nil {
+		http.Error(w, "not running as controller", http.StatusNotFound)
+		return
+	}
+	if d.leaderElection != nil && !d.leaderElection.isLeader() {
+		http.Error(w, "not the leader controller replica", http.StatusServiceUnavailable)
+		return
+	}
+
+	report := d.controllerServer.runSelfTest(r.Context(), d.selfTestNqn)
+	if report.Passed {
+		klog.Infof("Self-test of %s passed in %s", report.Nqn, report.Duration)
+	} else {
+		klog.Errorf("Self-test of %s failed: %+v", report.Nqn, report.Steps)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	writeJSON(w, report)
+}
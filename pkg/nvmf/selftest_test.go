@@ -0,0 +1,256 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// withFakeDeviceIO replaces the block I/O of the self-test by fn
+func withFakeDeviceIO(t *testing.T, fn func(devicePath string) error) {
+	t.Helper()
+	saved := verifyDeviceIO
+	verifyDeviceIO = fn
+	t.Cleanup(func() { verifyDeviceIO = saved })
+}
+
+// newSelfTestServer returns a controller server whose default parameters
+// discover testVolumeNqn
+func newSelfTestServer(t *testing.T, backend Backend) *ControllerServer {
+	t.Helper()
+	c, _ := newTestControllerServer(t, backend)
+	c.Driver.defaultParameters = map[string]string{paramAddr: "192.0.2.10", paramPort: "4420", paramType: "tcp"}
+	c.Driver.selfTestNqn = testVolumeNqn
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+	return c
+}
+
+// selfTestSteps returns the steps of a report as name:result
+func selfTestSteps(report *selfTestReport) []string {
+	steps := []string{}
+	for _, step := range report.Steps {
+		steps = append(steps, step.Name+":"+step.Result)
+	}
+	return steps
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name  string
+		grant bool
+		// allocated allocates the test device to a volume beforehand
+		allocated bool
+		// locked holds the lock of the test device, as a running self-test does
+		locked         bool
+		connectErrs    []error
+		disconnectErrs []error
+		revokeErrs     []error
+		ioErr          error
+		// cancel cancels the request during the block I/O
+		cancel     bool
+		wantPassed bool
+		wantSteps  []string
+		// wantConnected is whether the test device is left connected
+		wantConnected bool
+	}{
+		{
+			name:       "passed without grants",
+			wantPassed: true,
+			wantSteps:  []string{"allocate:passed", "grant:skipped", "connect:passed", "write-read:passed", "disconnect:passed", "release:passed"},
+		},
+		{
+			name:       "passed with grants",
+			grant:      true,
+			wantPassed: true,
+			wantSteps:  []string{"allocate:passed", "grant:passed", "connect:passed", "write-read:passed", "disconnect:passed", "revoke:passed", "release:passed"},
+		},
+		{
+			name:      "block I/O failure",
+			grant:     true,
+			ioErr:     errors.New("block read back differs"),
+			wantSteps: []string{"allocate:passed", "grant:passed", "connect:passed", "write-read:failed", "disconnect:passed", "revoke:passed", "release:passed"},
+		},
+		{
+			name:        "connect failure",
+			grant:       true,
+			connectErrs: []error{errors.New("connection refused")},
+			wantSteps:   []string{"allocate:passed", "grant:passed", "connect:failed", "disconnect:passed", "revoke:passed", "release:passed"},
+		},
+		{
+			name:           "disconnect failure",
+			grant:          true,
+			disconnectErrs: []error{errors.New("device busy")},
+			wantSteps:      []string{"allocate:passed", "grant:passed", "connect:passed", "write-read:passed", "disconnect:failed", "revoke:passed", "release:passed"},
+			wantConnected:  true,
+		},
+		{
+			name:       "revoke failure",
+			grant:      true,
+			revokeErrs: []error{errors.New("array unreachable")},
+			wantSteps:  []string{"allocate:passed", "grant:passed", "connect:passed", "write-read:passed", "disconnect:passed", "revoke:failed", "release:passed"},
+		},
+		{
+			name:       "request cancelled",
+			grant:      true,
+			cancel:     true,
+			wantPassed: true,
+			wantSteps:  []string{"allocate:passed", "grant:passed", "connect:passed", "write-read:passed", "disconnect:passed", "revoke:passed", "release:passed"},
+		},
+		{
+			name:      "test device allocated to a volume",
+			allocated: true,
+			wantSteps: []string{"allocate:failed"},
+		},
+		{
+			name:      "test device in use",
+			locked:    true,
+			wantSteps: []string{"lock:failed"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			backend := newFakeBackend()
+			if test.grant {
+				backend = newFakeBackend(BackendCapabilityGrant)
+			}
+			backend.revokeErrs = test.revokeErrs
+			c := newSelfTestServer(t, backend)
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.connectErrs = test.connectErrs
+			client.disconnectErrs = test.disconnectErrs
+			r := c.deviceRegistry
+
+			var ioPaths []string
+			withFakeDeviceIO(t, func(devicePath string) error {
+				ioPaths = append(ioPaths, devicePath)
+				if test.cancel {
+					cancel()
+				}
+				return test.ioErr
+			})
+			if test.allocated {
+				if _, err := c.CreateVolume(ctx, createRequest("pv-1", nil)); err != nil {
+					t.Fatalf("CreateVolume: %v", err)
+				}
+			}
+			if test.locked {
+				c.Driver.volumeLocks.Acquire(testVolumeNqn)
+			}
+
+			report := c.runSelfTest(ctx, testVolumeNqn)
+			if report.Passed != test.wantPassed {
+				t.Errorf("self-test passed = %t, want %t: %+v", report.Passed, test.wantPassed, report.Steps)
+			}
+			if steps := selfTestSteps(report); !reflect.DeepEqual(steps, test.wantSteps) {
+				t.Errorf("self-test steps = %v, want %v", steps, test.wantSteps)
+			}
+			for _, step := range report.Steps {
+				if (step.Result == selfTestFailed) != (step.Error != "") || step.Duration == "" {
+					t.Errorf("self-test step %+v, want a duration and an error if it failed", step)
+				}
+			}
+			if test.locked {
+				return
+			}
+
+			// The I/O was made on the connected device
+			if len(ioPaths) > 0 && (len(client.connects) != 1 || ioPaths[0] != "/dev/nvme0n1") {
+				t.Errorf("block I/O on %v after connects %+v, want on the connected device", ioPaths, client.connects)
+			}
+			if connected := len(client.controllers) > 0; connected != test.wantConnected {
+				t.Errorf("test device connected = %t, want %t: %+v", connected, test.wantConnected, client.controllers)
+			}
+			if len(backend.grants) != len(backend.revocations) {
+				t.Errorf("grants %v, revocations %v, want each grant revoked", backend.grants, backend.revocations)
+			}
+			if !c.Driver.volumeLocks.TryAcquire(testVolumeNqn) {
+				t.Error("lock of the test device is held after the self-test")
+			}
+			c.Driver.volumeLocks.Release(testVolumeNqn)
+
+			// The test device is released, in memory and in the store, unless
+			// it was allocated to a volume before
+			if _, free := r.availableNQNs[testVolumeNqn]; free == test.allocated {
+				t.Errorf("test device free = %t, want %t", free, !test.allocated)
+			}
+			records, err := c.Driver.metadata.List(ctx, metadataKindAllocation)
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			wantRecords := 0
+			if test.allocated {
+				wantRecords = 1
+			}
+			if len(records) != wantRecords {
+				t.Errorf("allocation records = %d, want %d", len(records), wantRecords)
+			}
+		})
+	}
+}
+
+func TestSelfTestHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// node runs the handler on a driver without controller server
+		node       bool
+		ioErr      error
+		want       int
+		wantPassed bool
+	}{
+		{name: "passed", method: http.MethodPost, want: http.StatusOK, wantPassed: true},
+		{name: "failed", method: http.MethodPost, ioErr: errors.New("block read back differs"), want: http.StatusInternalServerError},
+		{name: "GET", method: http.MethodGet, want: http.StatusMethodNotAllowed},
+		{name: "not a controller", method: http.MethodPost, node: true, want: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newSelfTestServer(t, newFakeBackend())
+			if !test.node {
+				c.Driver.controllerServer = c
+			}
+			withFakeDeviceIO(t, func(string) error { return test.ioErr })
+
+			w := httptest.NewRecorder()
+			c.Driver.selfTestHandler(w, httptest.NewRequest(test.method, "/selftest", nil))
+			if w.Code != test.want {
+				t.Fatalf("/selftest status = %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+			if test.want != http.StatusOK && test.want != http.StatusInternalServerError {
+				return
+			}
+			report := &selfTestReport{}
+			if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+				t.Fatalf("/selftest body %s: %v", w.Body, err)
+			}
+			if report.Passed != test.wantPassed || report.Nqn != testVolumeNqn || report.Duration == "" {
+				t.Errorf("/selftest report = %+v, want passed %t of %s", report, test.wantPassed, testVolumeNqn)
+			}
+		})
+	}
+}
@@ -39,14 +39,18 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+// NewNonBlockingGRPCServer returns a server running interceptors after logging each call
+func NewNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{interceptors: interceptors}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
 	wg     sync.WaitGroup
+	mutex  sync.Mutex // protects server, which is created by serve
 	server *grpc.Server
+
+	interceptors []grpc.UnaryServerInterceptor
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -59,14 +63,26 @@ func (s *nonBlockingGRPCServer) Wait() {
 }
 
 func (s *nonBlockingGRPCServer) Stop() {
-	s.server.GracefulStop()
+	if server := s.grpcServer(); server != nil {
+		server.GracefulStop()
+	}
 }
 
 func (s *nonBlockingGRPCServer) ForceStop() {
-	s.server.Stop()
+	if server := s.grpcServer(); server != nil {
+		server.Stop()
+	}
+}
+
+func (s *nonBlockingGRPCServer) grpcServer() *grpc.Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.server
 }
 
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	// Wait returns once a stop ends Serve, so that a drained driver exits
+	defer s.wg.Done()
 
 	proto, addr, err := utils.ParseEndpoint(endpoint)
 	if err != nil {
@@ -86,10 +102,12 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{logGRPC}, s.interceptors...)...),
 	}
 	server := grpc.NewServer(opts...)
+	s.mutex.Lock()
 	s.server = server
+	s.mutex.Unlock()
 
 	if ids != nil {
 		csi.RegisterIdentityServer(server, ids)
@@ -0,0 +1,81 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// snapshotRecord is the persisted metadata of a snapshot
+type snapshotRecord struct {
+	SnapshotID     string    `json:"snapshotId"`
+	Name           string    `json:"name"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	SizeBytes      int64     `json:"sizeBytes"`
+	ReadyToUse     bool      `json:"readyToUse"`
+	CreationTime   time.Time `json:"creationTime"`
+}
+
+// snapshotIDFromName derives a stable snapshot ID from the CSI snapshot name,
+// so that a retried CreateSnapshot resolves to the same snapshot
+func snapshotIDFromName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "snap-" + hex.EncodeToString(sum[:])[:32]
+}
+
+func (s *snapshotRecord) toCSI() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     s.SnapshotID,
+		SourceVolumeId: s.SourceVolumeID,
+		SizeBytes:      s.SizeBytes,
+		ReadyToUse:     s.ReadyToUse,
+		CreationTime:   timestamppb.New(s.CreationTime),
+	}
+}
+
+// listSnapshotRecords returns all persisted snapshots sorted by snapshot ID
+func listSnapshotRecords(ctx context.Context, store recordStore) ([]*snapshotRecord, error) {
+	raw, err := store.List(ctx, metadataKindSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*snapshotRecord, 0, len(raw))
+	for key, data := range raw {
+		record := &snapshotRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			klog.Warningf("Skipping undecodable snapshot record %s: %v", key, err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].SnapshotID < records[j].SnapshotID
+	})
+
+	return records, nil
+}
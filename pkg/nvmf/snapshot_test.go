@@ -0,0 +1,293 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newSnapshotServer returns a controller of a snapshotting backend, whose
+// target exports two subsystems
+func newSnapshotServer(t *testing.T) (*ControllerServer, *fakeBackend) {
+	t.Helper()
+	backend := newFakeBackend(BackendCapabilitySnapshot)
+	backend.snapshotSize = 1 << 30
+	c, _ := newTestControllerServer(t, backend)
+	client := c.Driver.nvme.(*fakeNvmeClient)
+	client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn, maintenanceNqn2)
+	return c, backend
+}
+
+// createSnapshotVolume creates the volume name, of a namespace of the
+// subsystems if namespaces is set, and returns its volume ID
+func createSnapshotVolume(t *testing.T, c *ControllerServer, name, namespaces string) string {
+	t.Helper()
+	extra := map[string]string{}
+	if namespaces != "" {
+		extra[paramNamespaces] = namespaces
+	}
+	resp, err := c.CreateVolume(context.Background(), createRequest(name, extra))
+	if err != nil {
+		t.Fatalf("CreateVolume(%s): %v", name, err)
+	}
+	return resp.GetVolume().GetVolumeId()
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces string
+		want       namespaceRef
+	}{
+		{name: "volume of a subsystem", want: namespaceRef{nqn: testVolumeNqn}},
+		{name: "volume of a namespace", namespaces: "1", want: namespaceRef{nqn: testVolumeNqn, nsid: 1}},
+		{name: "volume of another namespace", namespaces: "2", want: namespaceRef{nqn: testVolumeNqn, nsid: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, backend := newSnapshotServer(t)
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+			volumeID := createSnapshotVolume(t, c, "pv-a", test.namespaces)
+
+			req := &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: volumeID}
+			resp, err := c.CreateSnapshot(ctx, req)
+			if err != nil {
+				t.Fatalf("CreateSnapshot: %v", err)
+			}
+			snapshot := resp.GetSnapshot()
+			if snapshot.GetSourceVolumeId() != volumeID || snapshot.GetSizeBytes() != 1<<30 || !snapshot.GetReadyToUse() {
+				t.Errorf("CreateSnapshot = %+v, want a ready snapshot of 1Gi of %s", snapshot, volumeID)
+			}
+
+			// The backend is given the subsystem and the namespace apart, not
+			// the volume ID
+			if got := backend.snapshots[snapshot.GetSnapshotId()]; got != test.want {
+				t.Errorf("backend snapshotted %+v, want %+v", got, test.want)
+			}
+
+			// A retried request returns the same snapshot without taking another
+			retried, err := c.CreateSnapshot(ctx, req)
+			if err != nil || retried.GetSnapshot().GetSnapshotId() != snapshot.GetSnapshotId() {
+				t.Errorf("retried CreateSnapshot = %+v, %v, want snapshot %s", retried.GetSnapshot(), err, snapshot.GetSnapshotId())
+			}
+			if len(backend.snapshots) != 1 {
+				t.Errorf("backend snapshots = %v, want one", backend.snapshots)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotInvalidRequests(t *testing.T) {
+	ctx := context.Background()
+	c, backend := newSnapshotServer(t)
+	volumeID := createSnapshotVolume(t, c, "pv-a", "")
+	otherID := createSnapshotVolume(t, c, "pv-b", "")
+	if _, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: volumeID}); err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  *csi.CreateSnapshotRequest
+		want codes.Code
+	}{
+		{name: "missing name", req: &csi.CreateSnapshotRequest{SourceVolumeId: volumeID}, want: codes.InvalidArgument},
+		{name: "missing source", req: &csi.CreateSnapshotRequest{Name: "snapshot-b"}, want: codes.InvalidArgument},
+		{name: "source not an NQN", req: &csi.CreateSnapshotRequest{Name: "snapshot-b", SourceVolumeId: "volume-1"}, want: codes.InvalidArgument},
+		{name: "source not allocated", req: &csi.CreateSnapshotRequest{Name: "snapshot-b", SourceVolumeId: "nqn.2024-01.io.example:volume-9"}, want: codes.NotFound},
+		{name: "name taken by another source", req: &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: otherID}, want: codes.AlreadyExists},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := c.CreateSnapshot(ctx, test.req); status.Code(err) != test.want {
+				t.Errorf("CreateSnapshot code = %v, want %v: %v", status.Code(err), test.want, err)
+			}
+		})
+	}
+	if len(backend.snapshots) != 1 {
+		t.Errorf("backend snapshots = %v, want the first only", backend.snapshots)
+	}
+}
+
+func TestSnapshotLifecycle(t *testing.T) {
+	tests := []struct {
+		name string
+		// force deletes volumes regardless of their snapshots
+		force bool
+	}{
+		{name: "deletion refused while snapshots exist"},
+		{name: "deletion forced", force: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, backend := newSnapshotServer(t)
+			c.Driver.forceDeleteWithSnapshots = test.force
+			volumeID := createSnapshotVolume(t, c, "pv-a", "")
+
+			snapshotIDs := []string{}
+			for _, name := range []string{"snapshot-a", "snapshot-b"} {
+				resp, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: volumeID})
+				if err != nil {
+					t.Fatalf("CreateSnapshot(%s): %v", name, err)
+				}
+				snapshotIDs = append(snapshotIDs, resp.GetSnapshot().GetSnapshotId())
+			}
+			listed := func() []string {
+				t.Helper()
+				resp, err := c.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+				if err != nil {
+					t.Fatalf("ListSnapshots: %v", err)
+				}
+				ids := []string{}
+				for _, entry := range resp.GetEntries() {
+					ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+				}
+				return ids
+			}
+			want := append([]string{}, snapshotIDs...)
+			if want[0] > want[1] {
+				want[0], want[1] = want[1], want[0]
+			}
+			if got := listed(); !reflect.DeepEqual(got, want) {
+				t.Errorf("ListSnapshots = %v, want %v", got, want)
+			}
+
+			// The volume is kept while its snapshots exist, unless forced
+			_, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			allocated := func() bool {
+				device, exists := c.deviceRegistry.GetDeviceByNQN(registryVolumeID(volumeID))
+				return exists && device.IsAllocated
+			}
+			if test.force {
+				if err != nil || allocated() {
+					t.Fatalf("forced DeleteVolume = %v, allocated %v, want the device released", err, allocated())
+				}
+				return
+			}
+			if status.Code(err) != codes.FailedPrecondition {
+				t.Fatalf("DeleteVolume with snapshots code = %v, want FailedPrecondition: %v", status.Code(err), err)
+			}
+			if !allocated() {
+				t.Errorf("device of a volume with snapshots released")
+			}
+
+			for _, snapshotID := range snapshotIDs {
+				if _, err := c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID}); err != nil {
+					t.Fatalf("DeleteSnapshot(%s): %v", snapshotID, err)
+				}
+			}
+			if got := listed(); len(got) != 0 {
+				t.Errorf("ListSnapshots after the deletions = %v, want none", got)
+			}
+			if !reflect.DeepEqual(backend.deletedSnapshots, snapshotIDs) || len(backend.snapshots) != 0 {
+				t.Errorf("backend deleted snapshots %v, keeping %v, want %v deleted", backend.deletedSnapshots, backend.snapshots, snapshotIDs)
+			}
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+				t.Errorf("DeleteVolume without snapshots: %v", err)
+			}
+		})
+	}
+}
+
+func TestListSnapshotsFilters(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newSnapshotServer(t)
+	volumeA := createSnapshotVolume(t, c, "pv-a", "")
+	volumeB := createSnapshotVolume(t, c, "pv-b", "")
+	snapshotIDs := map[string]string{}
+	for name, source := range map[string]string{"snapshot-a1": volumeA, "snapshot-a2": volumeA, "snapshot-b1": volumeB} {
+		resp, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: source})
+		if err != nil {
+			t.Fatalf("CreateSnapshot(%s): %v", name, err)
+		}
+		snapshotIDs[name] = resp.GetSnapshot().GetSnapshotId()
+	}
+
+	tests := []struct {
+		name string
+		req  *csi.ListSnapshotsRequest
+		// want are the names of the snapshots listed
+		want []string
+	}{
+		{name: "no filter", req: &csi.ListSnapshotsRequest{}, want: []string{"snapshot-a1", "snapshot-a2", "snapshot-b1"}},
+		{name: "by source", req: &csi.ListSnapshotsRequest{SourceVolumeId: volumeA}, want: []string{"snapshot-a1", "snapshot-a2"}},
+		{name: "by other source", req: &csi.ListSnapshotsRequest{SourceVolumeId: volumeB}, want: []string{"snapshot-b1"}},
+		{name: "by source without snapshots", req: &csi.ListSnapshotsRequest{SourceVolumeId: "nqn.2024-01.io.example:volume-9"}},
+		{name: "by snapshot ID", req: &csi.ListSnapshotsRequest{SnapshotId: snapshotIDs["snapshot-a2"]}, want: []string{"snapshot-a2"}},
+		{name: "by unknown snapshot ID", req: &csi.ListSnapshotsRequest{SnapshotId: snapshotIDFromName("snapshot-c1")}},
+		{name: "by snapshot ID and its source", req: &csi.ListSnapshotsRequest{SnapshotId: snapshotIDs["snapshot-b1"], SourceVolumeId: volumeB}, want: []string{"snapshot-b1"}},
+		{name: "by snapshot ID and another source", req: &csi.ListSnapshotsRequest{SnapshotId: snapshotIDs["snapshot-b1"], SourceVolumeId: volumeA}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := c.ListSnapshots(ctx, test.req)
+			if err != nil {
+				t.Fatalf("ListSnapshots: %v", err)
+			}
+			got := map[string]bool{}
+			for _, entry := range resp.GetEntries() {
+				got[entry.GetSnapshot().GetSnapshotId()] = true
+			}
+			want := map[string]bool{}
+			for _, name := range test.want {
+				want[snapshotIDs[name]] = true
+			}
+			if len(resp.GetEntries()) != len(test.want) || !reflect.DeepEqual(got, want) {
+				t.Errorf("ListSnapshots = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDeleteSnapshotIdempotent(t *testing.T) {
+	ctx := context.Background()
+	c, backend := newSnapshotServer(t)
+	volumeID := createSnapshotVolume(t, c, "pv-a", "")
+	resp, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snapshot-a", SourceVolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("CreateSnapshot: %v", err)
+	}
+	snapshotID := resp.GetSnapshot().GetSnapshotId()
+
+	// A snapshot that never existed, or that is already deleted, is deleted
+	// without the backend
+	for _, id := range []string{snapshotIDFromName("snapshot-b"), snapshotID, snapshotID} {
+		if _, err := c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: id}); err != nil {
+			t.Errorf("DeleteSnapshot(%s): %v", id, err)
+		}
+	}
+	if want := []string{snapshotID}; !reflect.DeepEqual(backend.deletedSnapshots, want) {
+		t.Errorf("backend deleted snapshots %v, want %v", backend.deletedSnapshots, want)
+	}
+
+	if _, err := c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("DeleteSnapshot without an ID code = %v, want InvalidArgument: %v", status.Code(err), err)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
+	"k8s.io/klog/v2"
+)
+
+// Staging layout. A volume staged at the staging target path of the kubelet
+// has an entry named after its volume ID, i.e. "<staging target path>/<nqn>"
+// for a whole subsystem or "<staging target path>/<nqn>#<nsid>" for one
+// namespace of a shared subsystem:
+//   - a directory the filesystem is mounted on in filesystem mode
+//   - a file the device is bind mounted on in block mode
+//
+// Next to the entry, "<entry>.json" holds the connector the volume was
+// connected with, used to disconnect it and to count staged volumes. An entry
+// without a connector file is the leftover of an interrupted stage.
+
+// stagingVolumePath returns the staging entry of a volume
+func stagingVolumePath(stagingTargetPath, volumeID string) string {
+	return filepath.Join(stagingTargetPath, volumeID)
+}
+
+// connectorFilePath returns the connector file of a staging entry
+func connectorFilePath(stagingPath string) string {
+	return stagingPath + ".json"
+}
+
+// removeStagingPath removes an unmounted staging entry. It is never removed
+// recursively, so a staging entry still holding data is left in place.
+func removeStagingPath(stagingPath string) {
+	if err := os.Remove(stagingPath); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove staging path %s: %v", stagingPath, err)
+	}
+}
+
+// cleanupFailedStage removes what a failed stage left behind: the mount and
+// the connector file, and the staging entry itself if the stage created it. A
+// staging entry that existed before, i.e. of a volume already staged, is kept.
+func cleanupFailedStage(stagingPath string, created bool) {
+	if !created {
+		return
+	}
+
+	klog.V(4).Infof("Cleaning up staging path %s of a failed stage", stagingPath)
+	if err := UnmountVolume(stagingPath, getNVMfDiskUnMounter()); err != nil {
+		klog.Errorf("Failed to unmount staging path %s of a failed stage: %v", stagingPath, err)
+		return
+	}
+	removeConnectorFile(stagingPath)
+	removeStagingPath(stagingPath)
+}
+
+// stagingPathExists reports whether the staging entry or its connector file exists
+func stagingPathExists(stagingPath string) bool {
+	return utils.IsFileExisting(stagingPath) || utils.IsFileExisting(connectorFilePath(stagingPath))
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// withFailingTool puts an executable named tool failing at once first in the PATH
+func withFailingTool(t *testing.T, tool string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestFailedStageCleanup(t *testing.T) {
+	tests := []struct {
+		name string
+		// deviceNqn is the subsystem the connected device belongs to
+		deviceNqn string
+		// staged is whether the volume was staged before the failed stage
+		staged bool
+		want   codes.Code
+	}{
+		// The identity check fails after the connect, before the mount
+		{name: "wrong device", deviceNqn: "nqn.2024-01.io.example:volume-2", want: codes.Internal},
+		// Detecting the filesystem fails once the staging directory is created
+		{name: "mount failure", deviceNqn: testVolumeNqn, want: codes.Unavailable},
+		{name: "failed restage", deviceNqn: testVolumeNqn, staged: true, want: codes.Unavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFailingTool(t, "blkid")
+			devicePath := withFakeBlockDevice(t, map[string]string{"device/subsysnqn": test.deviceNqn, "nsid": "1"})
+			withFakeSubsystemUUID(t, map[string]string{testVolumeNqn: ""})
+			// The subsystem is connected already, so that the stage resolves
+			// the device through namespaceDevicePath
+			client := newFakeNvmeClient()
+			client.controllers = []NvmeController{{Name: "nvme0", SubsysNqn: testVolumeNqn, HostNqn: testNodeHostNqn, State: nvmeControllerLive}}
+			saved := namespaceDevicePath
+			namespaceDevicePath = func(nqn string, nsid uint32) (string, error) {
+				return devicePath, nil
+			}
+			t.Cleanup(func() { namespaceDevicePath = saved })
+			n := newTestNodeServer(client)
+			dir := t.TempDir()
+			stagingPath := stagingVolumePath(dir, testVolumeNqn)
+			if test.staged {
+				if err := os.Mkdir(stagingPath, 0750); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(connectorFilePath(stagingPath), []byte("{}"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := n.NodeStageVolume(context.Background(), stageRequest(testVolumeNqn, dir))
+			if got := status.Code(err); got != test.want {
+				t.Fatalf("NodeStageVolume code = %v, want %v: %v", got, test.want, err)
+			}
+
+			for _, path := range []string{stagingPath, connectorFilePath(stagingPath), connectorFilePath(stagingPath) + ".tmp"} {
+				_, err := os.Stat(path)
+				if exists := err == nil; exists != (test.staged && path != connectorFilePath(stagingPath)+".tmp") {
+					t.Errorf("%s exists = %v after the failed stage, want %v", path, exists, !exists)
+				}
+			}
+			if client.connectCount() != 0 || client.disconnectCount() != 0 {
+				t.Errorf("connects = %d, disconnects = %d, want the existing connection reused and kept", client.connectCount(), client.disconnectCount())
+			}
+			if len(n.connections) != 0 {
+				t.Errorf("failed stage left %d connection reference(s)", len(n.connections))
+			}
+		})
+	}
+}
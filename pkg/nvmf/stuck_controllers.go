@@ -0,0 +1,123 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// stuckControllerStates are the sysfs states of controllers that are not
+// recovering on their own, e.g. left behind by a target that went away uncleanly
+var stuckControllerStates = map[string]struct{}{
+	"deleting":         {},
+	"deleting (no IO)": {},
+	"dead":             {},
+}
+
+// Bounds of the wait for force-removed controllers to disappear
+const (
+	stuckControllerRemovalTimeout  = 10 * time.Second
+	stuckControllerRemovalInterval = 500 * time.Millisecond
+)
+
+// stuckControllers returns the controllers of nqn in a stuck state and whether
+// nqn also has controllers that are not stuck
+func stuckControllers(client NvmeClient, nqn string) (stuck []string, healthy bool) {
+	controllers, err := client.ListSubsystems()
+	if err != nil {
+		return nil, false
+	}
+
+	for _, controller := range controllers {
+		if controller.SubsysNqn != nqn {
+			continue
+		}
+		if _, isStuck := stuckControllerStates[controller.State]; isStuck {
+			stuck = append(stuck, controller.Name)
+		} else {
+			healthy = true
+		}
+	}
+
+	return stuck, healthy
+}
+
+// findUsableController returns the first controller of the subsystem nqn that
+// is not stuck, restricted to controllers connected with hostNqn unless it is
+// empty. A stuck controller has no usable namespace to reuse.
+func findUsableController(client NvmeClient, nqn, hostNqn string) (NvmeController, bool) {
+	controllers, err := client.ListSubsystems()
+	if err != nil {
+		return NvmeController{}, false
+	}
+
+	for _, controller := range controllers {
+		if controller.SubsysNqn != nqn || hostNqn != "" && controller.HostNqn != hostNqn {
+			continue
+		}
+		if _, isStuck := stuckControllerStates[controller.State]; !isStuck {
+			return controller, true
+		}
+	}
+
+	return NvmeController{}, false
+}
+
+// recoverStuckControllers force-removes the stuck controllers of nqn so that a
+// fresh connect does not collide with them. When every controller of nqn is
+// stuck the subsystem is disconnected through nvme-cli first, otherwise only
+// the stuck controllers are deleted, leaving the connections of other volumes
+// intact. It waits a bounded time for the controllers to disappear and makes a
+// single attempt, the following connect reports any remaining failure.
+func (n *NodeServer) recoverStuckControllers(nqn string) {
+	client := n.Driver.nvme
+	timeout := n.Driver.nvmeCliTimeout
+
+	stuck, healthy := stuckControllers(client, nqn)
+	if len(stuck) == 0 {
+		return
+	}
+	klog.Warningf("Subsystem %s has stuck controller(s) %v, forcing their removal before connecting", nqn, stuck)
+
+	if !healthy {
+		if err := client.DisconnectAll(context.Background(), nqn, timeout); err != nil {
+			klog.Warningf("Failed to disconnect %s through nvme-cli, deleting its controllers: %v", nqn, err)
+		}
+	}
+	for _, controller := range stuck {
+		if err := client.DeleteController(controller, timeout); err != nil {
+			klog.Warningf("Failed to delete stuck controller %s of %s: %v", controller, nqn, err)
+		}
+	}
+
+	deadline := time.Now().Add(stuckControllerRemovalTimeout)
+	for {
+		remaining, _ := stuckControllers(client, nqn)
+		if len(remaining) == 0 {
+			klog.Infof("Removed stuck controller(s) %v of %s", stuck, nqn)
+			return
+		}
+		if time.Now().After(deadline) {
+			klog.Errorf("Stuck controller(s) %v of %s still present after %v, connecting anyway", remaining, nqn, stuckControllerRemovalTimeout)
+			return
+		}
+		time.Sleep(stuckControllerRemovalInterval)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRecoverStuckControllers(t *testing.T) {
+	const otherNqn = "nqn.2024-01.io.example:volume-2"
+
+	tests := []struct {
+		name        string
+		controllers []NvmeController
+		// pinned stages with the host NQN of the node only
+		pinned         bool
+		disconnectErrs []error
+		// wantDisconnects are the subsystems disconnected through nvme-cli
+		wantDisconnects []string
+		wantDeletes     []string
+		wantConnects    int
+	}{
+		{
+			name:        "healthy connection",
+			controllers: []NvmeController{{Name: "nvme9", SubsysNqn: testVolumeNqn, State: nvmeControllerLive}},
+		},
+		{
+			name:        "healthy connection next to a stuck one",
+			controllers: []NvmeController{{Name: "nvme8", SubsysNqn: testVolumeNqn, State: "deleting"}, {Name: "nvme9", SubsysNqn: testVolumeNqn, State: nvmeControllerLive}},
+		},
+		{
+			name:            "stuck controller",
+			controllers:     []NvmeController{{Name: "nvme9", SubsysNqn: testVolumeNqn, State: "deleting"}},
+			wantDisconnects: []string{testVolumeNqn},
+			wantDeletes:     []string{"nvme9"},
+			wantConnects:    1,
+		},
+		{
+			name:            "dead controller whose disconnect fails",
+			controllers:     []NvmeController{{Name: "nvme9", SubsysNqn: testVolumeNqn, State: "dead"}},
+			disconnectErrs:  []error{errors.New("nvme disconnect timed out")},
+			wantDisconnects: []string{testVolumeNqn},
+			wantDeletes:     []string{"nvme9"},
+			wantConnects:    1,
+		},
+		{
+			name: "stuck controller next to the connection of another host NQN",
+			controllers: []NvmeController{
+				{Name: "nvme8", SubsysNqn: testVolumeNqn, HostNqn: "nqn.2024-01.io.example:other-host", State: nvmeControllerLive},
+				{Name: "nvme9", SubsysNqn: testVolumeNqn, HostNqn: testNodeHostNqn, State: "deleting (no IO)"},
+			},
+			pinned:       true,
+			wantDeletes:  []string{"nvme9"},
+			wantConnects: 1,
+		},
+		{
+			name:         "stuck controller of another subsystem",
+			controllers:  []NvmeController{{Name: "nvme9", SubsysNqn: otherNqn, State: "deleting"}},
+			wantConnects: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeNvmeClient()
+			client.controllers = test.controllers
+			client.disconnectErrs = test.disconnectErrs
+			withFakeNamespaces(t, client)
+			n := newTestNodeServer(client)
+			info := &nvmfDiskInfo{Nqn: testVolumeNqn, Transport: "tcp", Endpoints: []string{"192.0.2.10:4420"}}
+
+			// Stage two namespaces of the subsystem, the second one reusing
+			// the connection of the first one
+			for _, nsid := range []uint32{1, 2} {
+				volumeID := formatVolumeID(testVolumeNqn, nsid)
+				connector := getNvmfConnector(info, testNodeHostNqn, n.Driver.connectOptions())
+				connector.Nsid = nsid
+				if _, _, err := n.connectStage(volumeID, stagingVolumePath(t.TempDir(), volumeID), connector, test.pinned, authSecrets{}); err != nil {
+					t.Fatalf("connectStage(%s): %v", volumeID, err)
+				}
+			}
+
+			if !reflect.DeepEqual(client.disconnects, test.wantDisconnects) {
+				t.Errorf("disconnects = %v, want %v", client.disconnects, test.wantDisconnects)
+			}
+			if !reflect.DeepEqual(client.deletes, test.wantDeletes) {
+				t.Errorf("deleted controllers = %v, want %v", client.deletes, test.wantDeletes)
+			}
+			if got := client.connectCount(); got != test.wantConnects {
+				t.Errorf("connects = %d, want %d", got, test.wantConnects)
+			}
+			remaining := map[string]bool{}
+			for _, controller := range client.controllers {
+				remaining[controller.Name] = true
+			}
+			for _, controller := range test.controllers {
+				if controller.SubsysNqn == otherNqn || controller.State == nvmeControllerLive {
+					if !remaining[controller.Name] {
+						t.Errorf("controller %s was removed, want it kept", controller.Name)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// otlpProtocolProtobuf is the only OTLP protocol of the exporter
+const otlpProtocolProtobuf = "http/protobuf"
+
+// traceScope is the instrumentation scope of the spans of the driver
+const traceScope = "github.com/kubernetes-csi/csi-driver-nvmf"
+
+// Attributes of the RPC spans
+const (
+	traceAttrRequestID = "csi.request_id"
+	traceAttrRPCMethod = "rpc.method"
+)
+
+// activeTracer starts the spans of the driver, nil unless tracing is enabled
+var activeTracer trace.Tracer
+
+// tracePropagator reads the span of a caller from the W3C traceparent header
+var tracePropagator = propagation.TraceContext{}
+
+// newTracerProvider returns a provider exporting spans in batches to an
+// OTLP/HTTP collector, configured by the standard OTEL_* environment variables
+func newTracerProvider(ctx context.Context, defaultServiceName string) (*sdktrace.TracerProvider, error) {
+	protocol := otelEnv("PROTOCOL")
+	if protocol != "" && protocol != otlpProtocolProtobuf {
+		return nil, fmt.Errorf("OTLP protocol %s is not supported, only %s", protocol, otlpProtocolProtobuf)
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the OTLP exporter: %v", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the driver name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource attributes: %v", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// otelEnv returns the traces-specific OTLP exporter variable, or the generic
+// one if unset, e.g. OTEL_EXPORTER_OTLP_TRACES_HEADERS then OTEL_EXPORTER_OTLP_HEADERS
+func otelEnv(name string) string {
+	if value := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); value != "" {
+		return value
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+// setTracerProvider makes the spans of the driver start through provider
+func setTracerProvider(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	activeTracer = provider.Tracer(traceScope)
+}
+
+// traceSpan is a timed operation of a trace. A nil span, returned while
+// tracing is disabled, ignores every call.
+type traceSpan struct {
+	span trace.Span
+}
+
+// startSpan starts a span named name, child of the span of ctx if any, and
+// returns the context carrying it. attributes are key, value pairs.
+func startSpan(ctx context.Context, name string, attributes ...string) (context.Context, *traceSpan) {
+	return startSpanOfKind(ctx, name, trace.SpanKindInternal, attributes...)
+}
+
+func startSpanOfKind(ctx context.Context, name string, kind trace.SpanKind, attributes ...string) (context.Context, *traceSpan) {
+	t := activeTracer
+	if t == nil {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	pairs := make([]attribute.KeyValue, 0, len(attributes)/2)
+	for i := 0; i+1 < len(attributes); i += 2 {
+		pairs = append(pairs, attribute.String(attributes[i], attributes[i+1]))
+	}
+	ctx, span := t.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(pairs...))
+
+	return ctx, &traceSpan{span: span}
+}
+
+// setAttribute records an attribute of the span
+func (s *traceSpan) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// end ends the span, with an error status if err is set, and queues it for export
+func (s *traceSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.span.SetStatus(otelcodes.Error, err.Error())
+	} else {
+		s.span.SetStatus(otelcodes.Ok, "")
+	}
+	s.span.End()
+}
+
+// metadataCarrier reads the propagated trace headers of gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// tracingInterceptor traces each RPC in a server span, child of the span of
+// the caller if it propagated one, with the request ID of logGRPC
+func tracingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = tracePropagator.Extract(ctx, metadataCarrier(md))
+	}
+
+	ctx, span := startSpanOfKind(ctx, info.FullMethod, trace.SpanKindServer, traceAttrRPCMethod, info.FullMethod)
+	span.setAttribute(traceAttrRequestID, requestIDFrom(ctx))
+	resp, err := handler(ctx, req)
+	span.end(err)
+
+	return resp, err
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// withInMemoryTracing records the spans of the driver in memory for the test
+func withInMemoryTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	saved := activeTracer
+	activeTracer = provider.Tracer(traceScope)
+	t.Cleanup(func() {
+		activeTracer = saved
+		provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+func TestCreateVolumeSpans(t *testing.T) {
+	const (
+		method      = "/csi.v1.Controller/CreateVolume"
+		traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	)
+
+	tests := []struct {
+		name        string
+		exported    []string
+		traceparent string
+		wantStatus  otelcodes.Code
+		// wantChildren are the spans under each span, by name
+		wantChildren map[string][]string
+	}{
+		{
+			name:       "allocated volume",
+			exported:   []string{testVolumeNqn},
+			wantStatus: otelcodes.Ok,
+			wantChildren: map[string][]string{
+				method:           {"AllocateDevice", "DiscoverDevices"},
+				"AllocateDevice": {"etcd.put"},
+			},
+		},
+		{
+			name:        "caller propagated its span",
+			exported:    []string{testVolumeNqn},
+			traceparent: traceparent,
+			wantStatus:  otelcodes.Ok,
+			wantChildren: map[string][]string{
+				method:           {"AllocateDevice", "DiscoverDevices"},
+				"AllocateDevice": {"etcd.put"},
+			},
+		},
+		{
+			name:       "no device left",
+			wantStatus: otelcodes.Error,
+			wantChildren: map[string][]string{
+				method: {"AllocateDevice", "DiscoverDevices"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exporter := withInMemoryTracing(t)
+			c, kubeClient := newTestControllerServer(t, newFakeBackend())
+			c.Driver.metadata = newMetadataStore(kubeClient, "kube-system", DefaultDriverName, "")
+			client := c.Driver.nvme.(*fakeNvmeClient)
+			client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", test.exported...)
+			if err := c.deviceRegistry.EnsureInitialSync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			if test.traceparent != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("traceparent", test.traceparent))
+			}
+			tracingInterceptor(ctx, createRequest("pv-1", nil), &grpc.UnaryServerInfo{FullMethod: method},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return c.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+				})
+
+			spans := exporter.GetSpans()
+			byID := map[trace.SpanID]tracetest.SpanStub{}
+			var root *tracetest.SpanStub
+			for i, span := range spans {
+				byID[span.SpanContext.SpanID()] = span
+				if span.Name == method {
+					root = &spans[i]
+				}
+			}
+			if root == nil {
+				t.Fatalf("no span of %s among %d span(s)", method, len(spans))
+			}
+			if root.SpanKind != trace.SpanKindServer || root.Status.Code != test.wantStatus {
+				t.Errorf("%s span kind %v status %v, want server span with status %v", method, root.SpanKind, root.Status.Code, test.wantStatus)
+			}
+			if test.traceparent != "" {
+				if got := root.Parent.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" || !root.Parent.IsRemote() {
+					t.Errorf("%s span parent trace %s (remote %t), want the propagated trace", method, got, root.Parent.IsRemote())
+				}
+			} else if root.Parent.IsValid() {
+				t.Errorf("%s span has parent %v, want a root span", method, root.Parent.SpanID())
+			}
+
+			children := map[string][]string{}
+			for _, span := range spans {
+				if span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+					t.Errorf("span %s is not in the trace of the RPC", span.Name)
+				}
+				if parent, exists := byID[span.Parent.SpanID()]; exists {
+					children[parent.Name] = append(children[parent.Name], span.Name)
+				}
+			}
+			for name := range children {
+				sort.Strings(children[name])
+			}
+			for parent, want := range test.wantChildren {
+				if got := children[parent]; !reflect.DeepEqual(got, want) {
+					t.Errorf("children of %s = %v, want %v", parent, got, want)
+				}
+			}
+		})
+	}
+}
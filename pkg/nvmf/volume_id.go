@@ -0,0 +1,96 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Formats of the volume IDs returned by CreateVolume
+const (
+	VolumeIDFormatNQN    = "nqn"    // The subsystem NQN, followed by "#<nsid>" for a namespace
+	VolumeIDFormatOpaque = "opaque" // An encoding of the NQN, the NSID and the transport
+)
+
+// opaqueVolumeIDPrefix marks opaque volume IDs and versions their encoding. A
+// valid NQN starts with "nqn.", so it is never mistaken for an opaque ID.
+const opaqueVolumeIDPrefix = "nvmf1-"
+
+// volumeIDFields are the fields encoded in an opaque volume ID
+type volumeIDFields struct {
+	Nqn       string `json:"n"`
+	Nsid      uint32 `json:"s,omitempty"`
+	Transport string `json:"t,omitempty"`
+}
+
+// encodeVolumeID returns the opaque volume ID of the fields
+func encodeVolumeID(fields volumeIDFields) string {
+	data, _ := json.Marshal(fields)
+	return opaqueVolumeIDPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeVolumeID returns the fields of a volume ID of either format. A volume
+// ID without the opaque prefix is the NQN format of volumes created before
+// opaque IDs, which carries no transport.
+func decodeVolumeID(volumeID string) (volumeIDFields, error) {
+	if !strings.HasPrefix(volumeID, opaqueVolumeIDPrefix) {
+		nqn, nsid := splitVolumeID(volumeID)
+		return volumeIDFields{Nqn: nqn, Nsid: nsid}, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(volumeID, opaqueVolumeIDPrefix))
+	if err != nil {
+		return volumeIDFields{}, fmt.Errorf("malformed volume ID %s: %v", volumeID, err)
+	}
+	fields := volumeIDFields{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return volumeIDFields{}, fmt.Errorf("malformed volume ID %s: %v", volumeID, err)
+	}
+	if fields.Nqn == "" {
+		return volumeIDFields{}, fmt.Errorf("malformed volume ID %s: no NQN", volumeID)
+	}
+
+	return fields, nil
+}
+
+// registryVolumeID returns the ID the registry, the locks and the records key
+// a volume by, the NQN format of formatVolumeID, for a volume ID of either
+// format. A malformed opaque ID is returned unchanged and fails validation.
+func registryVolumeID(volumeID string) string {
+	if !strings.HasPrefix(volumeID, opaqueVolumeIDPrefix) {
+		return volumeID
+	}
+
+	fields, err := decodeVolumeID(volumeID)
+	if err != nil {
+		return volumeID
+	}
+
+	return formatVolumeID(fields.Nqn, fields.Nsid)
+}
+
+// externalVolumeID returns the volume ID of the disk in the configured format
+func (d *driver) externalVolumeID(disk *nvmfDiskInfo) string {
+	if d.volumeIDFormat != VolumeIDFormatOpaque {
+		return disk.volumeID()
+	}
+
+	return encodeVolumeID(volumeIDFields{Nqn: disk.Nqn, Nsid: disk.Nsid, Transport: disk.Transport})
+}
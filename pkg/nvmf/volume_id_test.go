@@ -0,0 +1,208 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields volumeIDFields
+	}{
+		{name: "whole subsystem", fields: volumeIDFields{Nqn: testVolumeNqn}},
+		{name: "namespace", fields: volumeIDFields{Nqn: testVolumeNqn, Nsid: 5}},
+		{name: "transport", fields: volumeIDFields{Nqn: testVolumeNqn, Nsid: 1, Transport: "rdma"}},
+		{name: "NQN with separators", fields: volumeIDFields{Nqn: "nqn.2014-08.org.nvmexpress:uuid:3b6a1e1c-2f4b-4c4d-9a3f-1a2b3c4d5e6f#x", Nsid: 2, Transport: "tcp"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volumeID := encodeVolumeID(test.fields)
+			if !strings.HasPrefix(volumeID, opaqueVolumeIDPrefix) || strings.Contains(volumeID, test.fields.Nqn) {
+				t.Errorf("encodeVolumeID(%+v) = %s, want an opaque ID", test.fields, volumeID)
+			}
+			if strings.ContainsAny(volumeID, "/+=#") {
+				t.Errorf("encodeVolumeID(%+v) = %s, want no character reserved in paths or volume IDs", test.fields, volumeID)
+			}
+
+			got, err := decodeVolumeID(volumeID)
+			if err != nil {
+				t.Fatalf("decodeVolumeID(%s): %v", volumeID, err)
+			}
+			if got != test.fields {
+				t.Errorf("decodeVolumeID(encodeVolumeID(%+v)) = %+v", test.fields, got)
+			}
+			nqn, nsid := parseVolumeID(volumeID)
+			if nqn != test.fields.Nqn || nsid != test.fields.Nsid {
+				t.Errorf("parseVolumeID(%s) = %s, %d, want %s, %d", volumeID, nqn, nsid, test.fields.Nqn, test.fields.Nsid)
+			}
+			if want := formatVolumeID(test.fields.Nqn, test.fields.Nsid); registryVolumeID(volumeID) != want {
+				t.Errorf("registryVolumeID(%s) = %s, want %s", volumeID, registryVolumeID(volumeID), want)
+			}
+		})
+	}
+}
+
+func TestDecodeVolumeID(t *testing.T) {
+	tests := []struct {
+		name     string
+		volumeID string
+		want     volumeIDFields
+		wantErr  bool
+	}{
+		{name: "bare NQN", volumeID: testVolumeNqn, want: volumeIDFields{Nqn: testVolumeNqn}},
+		{name: "NQN and namespace", volumeID: testVolumeNqn + "#3", want: volumeIDFields{Nqn: testVolumeNqn, Nsid: 3}},
+		{name: "not base64", volumeID: opaqueVolumeIDPrefix + "!!!", wantErr: true},
+		{name: "not JSON", volumeID: opaqueVolumeIDPrefix + base64.RawURLEncoding.EncodeToString([]byte("nqn")), wantErr: true},
+		{name: "no NQN", volumeID: opaqueVolumeIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(`{"s":1}`)), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeVolumeID(test.volumeID)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodeVolumeID(%s) = %v, want error %v", test.volumeID, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("decodeVolumeID(%s) = %+v, want %+v", test.volumeID, got, test.want)
+			}
+			// A malformed ID is kept as is, and rejected as an invalid NQN
+			if test.wantErr && registryVolumeID(test.volumeID) != test.volumeID {
+				t.Errorf("registryVolumeID(%s) = %s, want it unchanged", test.volumeID, registryVolumeID(test.volumeID))
+			}
+		})
+	}
+}
+
+func TestGetNVMfDiskInfoTransport(t *testing.T) {
+	tests := []struct {
+		name      string
+		volumeID  string
+		transport string
+		want      string
+		wantErr   bool
+	}{
+		{name: "from the volume context", volumeID: testVolumeNqn, transport: "tcp", want: "tcp"},
+		{name: "from the opaque ID", volumeID: encodeVolumeID(volumeIDFields{Nqn: testVolumeNqn, Transport: "rdma"}), want: "rdma"},
+		{name: "volume context wins", volumeID: encodeVolumeID(volumeIDFields{Nqn: testVolumeNqn, Transport: "rdma"}), transport: "tcp", want: "tcp"},
+		{name: "nowhere", volumeID: testVolumeNqn, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := &VolumeParams{Transport: test.transport, Endpoints: []string{"192.0.2.10:4420"}}
+			info, err := getNVMfDiskInfo(test.volumeID, params)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("getNVMfDiskInfo = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && (info.Transport != test.want || info.Nqn != testVolumeNqn) {
+				t.Errorf("getNVMfDiskInfo = %s over %s, want %s over %s", info.Nqn, info.Transport, testVolumeNqn, test.want)
+			}
+		})
+	}
+}
+
+func TestVolumeIDFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		// legacy restores a volume created with a bare NQN ID before the restart
+		legacy     bool
+		wantOpaque bool
+	}{
+		{name: "NQN format", format: VolumeIDFormatNQN},
+		{name: "opaque format", format: VolumeIDFormatOpaque, wantOpaque: true},
+		{name: "NQN volume after switching to the opaque format", format: VolumeIDFormatOpaque, legacy: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			newServer := func(format string) *ControllerServer {
+				c, _ := newTestControllerServer(t, newFakeBackend())
+				c.Driver.volumeIDFormat = format
+				client := c.Driver.nvme.(*fakeNvmeClient)
+				client.discovery["192.0.2.10:4420"] = discoveryPage("192.0.2.10", "4420", testVolumeNqn)
+				return c
+			}
+
+			c := newServer(test.format)
+			if test.legacy {
+				c = newServer(VolumeIDFormatNQN)
+			}
+			resp, err := c.CreateVolume(ctx, createRequest("pv-1", nil))
+			if err != nil {
+				t.Fatalf("CreateVolume: %v", err)
+			}
+			volumeID := resp.GetVolume().GetVolumeId()
+			if test.legacy {
+				restarted := newServer(test.format)
+				restarted.Driver.metadata = c.Driver.metadata
+				if err := restarted.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+					t.Fatalf("EnsureInitialSync: %v", err)
+				}
+				c = restarted
+			}
+			if opaque := strings.HasPrefix(volumeID, opaqueVolumeIDPrefix); opaque != test.wantOpaque {
+				t.Fatalf("volume ID %s opaque = %t, want %t", volumeID, opaque, test.wantOpaque)
+			}
+
+			// Every RPC accepts the ID CreateVolume returned
+			if _, err := c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId: volumeID, NodeId: "node-1", VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				VolumeContext: resp.GetVolume().GetVolumeContext(),
+			}); err != nil {
+				t.Errorf("ControllerPublishVolume(%s): %v", volumeID, err)
+			}
+			if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: "node-1"}); err != nil {
+				t.Errorf("ControllerUnpublishVolume(%s): %v", volumeID, err)
+			}
+			validated, err := c.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volumeID,
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			})
+			if err != nil || validated.GetConfirmed() == nil {
+				t.Errorf("ValidateVolumeCapabilities(%s) = %v, %v, want confirmed", volumeID, validated, err)
+			}
+			if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+				t.Fatalf("DeleteVolume(%s): %v", volumeID, err)
+			}
+			if device := c.deviceRegistry.devices[testVolumeNqn]; device != nil && device.IsAllocated {
+				t.Errorf("device of %s is still allocated after DeleteVolume", volumeID)
+			}
+		})
+	}
+}
+
+func TestMalformedOpaqueVolumeID(t *testing.T) {
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	c.Driver.volumeIDFormat = VolumeIDFormatOpaque
+
+	_, err := c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: opaqueVolumeIDPrefix + "!!!"})
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("DeleteVolume of a malformed ID code = %v, want %v: %v", got, codes.InvalidArgument, err)
+	}
+}
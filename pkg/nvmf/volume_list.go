@@ -0,0 +1,325 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// Allocation statuses the /volumes admin endpoint filters on
+const (
+	volumeStatusAllocated   = "allocated"   // Backing a volume, published or not
+	volumeStatusPublished   = "published"   // Allocated and published to at least one node
+	volumeStatusUnpublished = "unpublished" // Allocated and published to no node
+	volumeStatusStale       = "stale"       // Allocated but not found by discovery since restored
+	volumeStatusQuarantined = "quarantined" // Held for a deleted volume until its retention expires
+)
+
+// volumeFilter selects the volumes listed by the /volumes admin endpoint.
+// Empty fields match every volume. The StorageClass and the parameters are
+// those recorded in the PV of the volume.
+type volumeFilter struct {
+	Status       string
+	Transport    string
+	StorageClass string
+	Parameters   map[string]string
+}
+
+// parseVolumeFilter reads the filter from the query, e.g.
+// ?status=published&transport=tcp&storageClass=gold&parameter=fsType=xfs
+func parseVolumeFilter(query url.Values) (*volumeFilter, error) {
+	filter := &volumeFilter{
+		Status:       query.Get("status"),
+		Transport:    query.Get("transport"),
+		StorageClass: query.Get("storageClass"),
+		Parameters:   map[string]string{},
+	}
+	switch filter.Status {
+	case "", volumeStatusAllocated, volumeStatusPublished, volumeStatusUnpublished, volumeStatusStale, volumeStatusQuarantined:
+	default:
+		return nil, fmt.Errorf("unknown status %q, expected one of %s", filter.Status, strings.Join([]string{
+			volumeStatusAllocated, volumeStatusPublished, volumeStatusUnpublished, volumeStatusStale, volumeStatusQuarantined,
+		}, ", "))
+	}
+	for _, parameter := range query["parameter"] {
+		key, value, found := strings.Cut(parameter, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("parameter filter must be <key>=<value>, got: %q", parameter)
+		}
+		filter.Parameters[key] = value
+	}
+
+	return filter, nil
+}
+
+// needsPVs reports whether the filter matches on the PVs of the volumes
+func (f *volumeFilter) needsPVs() bool {
+	return f.StorageClass != "" || len(f.Parameters) > 0
+}
+
+// matches reports whether the volume passes the filter
+func (f *volumeFilter) matches(volume *VolumeEntry) bool {
+	switch f.Status {
+	case "":
+	case volumeStatusAllocated:
+		if !volume.Allocated {
+			return false
+		}
+	case volumeStatusPublished, volumeStatusUnpublished:
+		if !volume.Allocated || (len(volume.PublishedNodes) > 0) != (f.Status == volumeStatusPublished) {
+			return false
+		}
+	case volumeStatusStale:
+		if !volume.Allocated || !volume.Stale {
+			return false
+		}
+	case volumeStatusQuarantined:
+		if volume.Allocated {
+			return false
+		}
+	}
+	if f.Transport != "" && volume.Transport != f.Transport {
+		return false
+	}
+	if f.StorageClass != "" && volume.StorageClass != f.StorageClass {
+		return false
+	}
+	for key, value := range f.Parameters {
+		if actual, exists := volume.Parameters[key]; !exists || actual != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// VolumeEntry is a point-in-time view of a volume of the registry
+type VolumeEntry struct {
+	VolumeID       string            `json:"volumeId"`
+	VolumeName     string            `json:"volumeName"`
+	Nqn            string            `json:"nqn"`
+	Nsid           uint32            `json:"nsid,omitempty"`
+	Status         string            `json:"status"`
+	Allocated      bool              `json:"allocated"`
+	Stale          bool              `json:"stale"`
+	Transport      string            `json:"transport"`
+	Endpoints      []string          `json:"endpoints"`
+	CapacityBytes  int64             `json:"capacityBytes"`
+	UsedBytes      int64             `json:"usedBytes"`
+	PublishedNodes []string          `json:"publishedNodes"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	QoS            *BackendQoS       `json:"qos,omitempty"`
+	AffinityKey    string            `json:"affinityKey,omitempty"`
+
+	// StorageClass and Parameters are read from the PV, empty without one
+	StorageClass string            `json:"storageClass,omitempty"`
+	Parameters   map[string]string `json:"parameters,omitempty"`
+}
+
+// VolumeEntries returns the allocated and quarantined volumes sorted by name
+func (r *DeviceRegistry) VolumeEntries() []*VolumeEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	entries := make([]*VolumeEntry, 0, len(r.volumeToNQN)+len(r.quarantined))
+	for _, device := range r.devices {
+		if !device.IsAllocated && !device.isQuarantined() {
+			continue
+		}
+		entry := &VolumeEntry{
+			VolumeID:       r.Driver.externalVolumeID(device.nvmfDiskInfo),
+			VolumeName:     device.VolName,
+			Nqn:            device.Nqn,
+			Nsid:           device.Nsid,
+			Status:         volumeStatusQuarantined,
+			Allocated:      device.IsAllocated,
+			Stale:          device.IsStale,
+			Transport:      device.Transport,
+			Endpoints:      append([]string{}, device.Endpoints...),
+			CapacityBytes:  device.VolumeBytes,
+			UsedBytes:      device.UsedBytes,
+			PublishedNodes: make([]string, 0, len(device.PublishedNodes)),
+			AffinityKey:    device.AffinityKey,
+		}
+		if device.VolumeHandle != "" {
+			entry.VolumeID = device.VolumeHandle
+		}
+		if entry.CapacityBytes == 0 {
+			entry.CapacityBytes = device.Capacity
+		}
+		if device.IsAllocated {
+			entry.Status = volumeStatusUnpublished
+		}
+		for node := range device.PublishedNodes {
+			entry.PublishedNodes = append(entry.PublishedNodes, node)
+		}
+		sort.Strings(entry.PublishedNodes)
+		if len(entry.PublishedNodes) > 0 {
+			entry.Status = volumeStatusPublished
+		}
+		if device.IsAllocated && device.IsStale {
+			entry.Status = volumeStatusStale
+		}
+		if len(device.Labels) > 0 {
+			entry.Labels = make(map[string]string, len(device.Labels))
+			for key, value := range device.Labels {
+				entry.Labels[key] = value
+			}
+		}
+		if !device.QoS.isZero() {
+			qos := device.QoS
+			entry.QoS = &qos
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].VolumeName < entries[j].VolumeName
+	})
+
+	return entries
+}
+
+// addPVMetadata completes the entries with the StorageClass and the volume
+// context recorded in the PVs provisioned by the driver
+func (r *DeviceRegistry) addPVMetadata(ctx context.Context, entries []*VolumeEntry) error {
+	list, err := r.Driver.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PersistentVolumes: %v", err)
+	}
+
+	byName := make(map[string]*VolumeEntry, len(entries))
+	for _, entry := range entries {
+		byName[entry.VolumeName] = entry
+	}
+	for i := range list.Items {
+		pv := &list.Items[i]
+		entry, exists := byName[pv.Name]
+		if !exists || !r.isDriverPV(pv) {
+			continue
+		}
+		entry.StorageClass = pv.Spec.StorageClassName
+		entry.Parameters = make(map[string]string, len(pv.Spec.CSI.VolumeAttributes))
+		for key, value := range pv.Spec.CSI.VolumeAttributes {
+			entry.Parameters[key] = value
+		}
+	}
+
+	return nil
+}
+
+// volumesHandler lists the volumes of the registry passing the filter of the
+// query. Filters on the StorageClass or the parameters answer 503 when the PVs
+// cannot be listed, other listings then omit the PV metadata.
+func (d *driver) volumesHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseVolumeFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	registry := d.controllerServer.deviceRegistry
+	entries := registry.VolumeEntries()
+	if err := registry.addPVMetadata(r.Context(), entries); err != nil {
+		if filter.needsPVs() {
+			klog.Errorf("Cannot filter volumes on their PVs: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		klog.Warningf("Listing volumes without PV metadata: %v", err)
+	}
+
+	filtered := make([]*VolumeEntry, 0, len(entries))
+	for _, entry := range entries {
+		if filter.matches(entry) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	writeJSON(w, filtered)
+}
+
+// ListVolumes lists the allocated volumes. The CSI request carries no filter,
+// filtered listings are served by the /volumes admin endpoint.
+func (c *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := c.deviceRegistry.EnsureInitialSync(ctx); err != nil {
+		return nil, registryStatus(err)
+	}
+	// The published nodes are lost on restart, listing none would report the
+	// volumes detached
+	if err := c.deviceRegistry.ensurePublishedNodes(ctx); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to restore the published nodes: %v", err)
+	}
+
+	allocated := make([]*VolumeEntry, 0)
+	for _, entry := range c.deviceRegistry.VolumeEntries() {
+		if entry.Allocated {
+			allocated = append(allocated, entry)
+		}
+	}
+
+	// The starting token is the index of the first entry to return
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		start, err = strconv.Atoi(token)
+		if err != nil || start < 0 || start > len(allocated) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token: %s", token)
+		}
+	}
+
+	end := len(allocated)
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, entry := range allocated[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      entry.VolumeID,
+				CapacityBytes: entry.CapacityBytes,
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: entry.PublishedNodes,
+				VolumeCondition:  c.health.VolumeCondition(ctx, registryVolumeID(entry.VolumeID)),
+			},
+		})
+	}
+
+	nextToken := ""
+	if end < len(allocated) {
+		nextToken = strconv.Itoa(end)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
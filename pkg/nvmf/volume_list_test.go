@@ -0,0 +1,104 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestListVolumesAfterRestart(t *testing.T) {
+	opaqueHandle := encodeVolumeID(volumeIDFields{Nqn: testVolumeNqn, Nsid: 1, Transport: "tcp"})
+	attributes := map[string]string{paramType: "tcp"}
+
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		listErr   error
+		wantCode  codes.Code
+		wantID    string
+		wantNodes []string
+	}{
+		{
+			name:      "published volume",
+			objects:   []runtime.Object{driverPV("pv-1", testVolumeNqn, attributes), attachment("pv-1", "worker-1", true), csiNode("worker-1", "node-1")},
+			wantID:    testVolumeNqn,
+			wantNodes: []string{"node-1"},
+		},
+		{
+			name:      "handle of another format",
+			objects:   []runtime.Object{driverPV("pv-1", opaqueHandle, attributes), attachment("pv-1", "worker-1", true), csiNode("worker-1", "node-1")},
+			wantID:    opaqueHandle,
+			wantNodes: []string{"node-1"},
+		},
+		{
+			name:      "node without CSINode",
+			objects:   []runtime.Object{driverPV("pv-1", testVolumeNqn, attributes), attachment("pv-1", "worker-1", true)},
+			wantID:    testVolumeNqn,
+			wantNodes: []string{"worker-1"},
+		},
+		{
+			name:      "detaching volume",
+			objects:   []runtime.Object{driverPV("pv-1", testVolumeNqn, attributes), attachment("pv-1", "worker-1", false), csiNode("worker-1", "node-1")},
+			wantID:    testVolumeNqn,
+			wantNodes: []string{},
+		},
+		{
+			name:     "attachments cannot be listed",
+			objects:  []runtime.Object{driverPV("pv-1", testVolumeNqn, attributes)},
+			listErr:  errors.New("apiserver unavailable"),
+			wantCode: codes.Unavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, kubeClient := newTestControllerServer(t, &noneBackend{}, test.objects...)
+			if test.listErr != nil {
+				kubeClient.PrependReactor("list", "volumeattachments", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, test.listErr
+				})
+			}
+
+			resp, err := c.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+			if got := status.Code(err); got != test.wantCode {
+				t.Fatalf("ListVolumes code = %v, want %v: %v", got, test.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if len(resp.Entries) != 1 {
+				t.Fatalf("ListVolumes returned %d entries, want 1", len(resp.Entries))
+			}
+			entry := resp.Entries[0]
+			if entry.Volume.VolumeId != test.wantID {
+				t.Errorf("VolumeId = %q, want %q", entry.Volume.VolumeId, test.wantID)
+			}
+			if !reflect.DeepEqual(entry.Status.PublishedNodeIds, test.wantNodes) {
+				t.Errorf("PublishedNodeIds = %v, want %v", entry.Status.PublishedNodeIds, test.wantNodes)
+			}
+		})
+	}
+}
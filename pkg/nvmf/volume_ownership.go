@@ -0,0 +1,107 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// paramFsGroupChangePolicy selects when group ownership is applied. The kubelet
+// does not pass the pod's fsGroupChangePolicy to CSI drivers, so it is set in
+// the StorageClass instead.
+const paramFsGroupChangePolicy = "fsGroupChangePolicy"
+
+// Values of paramFsGroupChangePolicy, named after the pod security context field
+const (
+	fsGroupChangeAlways         = "Always"
+	fsGroupChangeOnRootMismatch = "OnRootMismatch" // default, avoids walking large filesystems on every mount
+)
+
+// Permission bits granted to the volume mount group, as applied by the kubelet for fsGroup
+const (
+	rwGroupMask os.FileMode = 0660
+	roGroupMask os.FileMode = 0440
+	dirExecMask os.FileMode = 0110
+)
+
+// setVolumeOwnership makes the files under dir group-owned by gid and accessible
+// to the group. Directories get the setgid bit so that new files inherit the group.
+// With the OnRootMismatch policy nothing is changed if the root already matches.
+func setVolumeOwnership(dir string, gid int, policy string, readOnly bool) error {
+	mask := rwGroupMask
+	if readOnly {
+		mask = roGroupMask
+	}
+
+	switch policy {
+	case "", fsGroupChangeOnRootMismatch:
+		if ownershipMatches(dir, gid, mask) {
+			klog.V(4).Infof("Volume ownership of %s already matches group %d, skipping", dir, gid)
+			return nil
+		}
+	case fsGroupChangeAlways:
+	default:
+		return fmt.Errorf("unsupported %s: %s", paramFsGroupChangePolicy, policy)
+	}
+
+	klog.Infof("Applying group %d ownership to volume at %s", gid, dir)
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := os.Lchown(path, -1, gid); err != nil {
+			return fmt.Errorf("failed to change group of %s: %v", path, err)
+		}
+
+		// Permissions of symlinks cannot be changed
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		mode := info.Mode() | mask
+		if info.IsDir() {
+			mode |= os.ModeSetgid | dirExecMask
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to change mode of %s: %v", path, err)
+		}
+
+		return nil
+	})
+}
+
+// ownershipMatches reports whether the root of a volume already carries the group and permissions
+func ownershipMatches(dir string, gid int, mask os.FileMode) bool {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	requiredMode := mask | dirExecMask | os.ModeSetgid
+	return int(stat.Gid) == gid && info.Mode()&requiredMode == requiredMode
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeGetCapabilitiesVolumeMountGroup(t *testing.T) {
+	n := newTestNodeServer(newFakeNvmeClient())
+	resp, err := n.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetCapabilities: %v", err)
+	}
+
+	// The kubelet leaves the fsGroup ownership to the driver only if advertised
+	for _, capability := range resp.GetCapabilities() {
+		if capability.GetRpc().GetType() == csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP {
+			return
+		}
+	}
+	t.Errorf("NodeGetCapabilities = %v, want VOLUME_MOUNT_GROUP", resp.GetCapabilities())
+}
+
+// fileOwnership returns the group and mode of path
+func fileOwnership(t *testing.T, path string) (int, os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	return int(info.Sys().(*syscall.Stat_t).Gid), info.Mode()
+}
+
+func TestNodePublishVolumeMountGroup(t *testing.T) {
+	// Only root can give files a group it is not a member of
+	gid := os.Getgid()
+	if os.Geteuid() == 0 {
+		gid = 4242
+	}
+
+	tests := []struct {
+		name     string
+		policy   string
+		readonly bool
+		block    bool
+		// rootMatches gives the root of the volume the group and permissions
+		// before the publish
+		rootMatches bool
+		// group is the volume mount group, gid if empty
+		group string
+		// wantFileMode is the mode of the file of the volume, unchanged if 0
+		wantFileMode os.FileMode
+		want         codes.Code
+	}{
+		{name: "writable", wantFileMode: 0660},
+		{name: "readonly", readonly: true, wantFileMode: 0640},
+		{name: "root already matching", rootMatches: true},
+		{name: "root already matching, always applied", policy: fsGroupChangeAlways, rootMatches: true, wantFileMode: 0660},
+		{name: "root mismatching", policy: fsGroupChangeOnRootMismatch, wantFileMode: 0660},
+		{name: "block volume", block: true},
+		{name: "invalid group", group: "staff", want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withFakeMounter(t)
+			n := newTestNodeServer(newFakeNvmeClient())
+			stage := stageRequest(testVolumeNqn, t.TempDir())
+			if test.policy != "" {
+				stage.VolumeContext[paramFsGroupChangePolicy] = test.policy
+			}
+
+			// The staged filesystem holds a file in a directory
+			stagingPath := stagingVolumePath(stage.StagingTargetPath, testVolumeNqn)
+			filePath := filepath.Join(stagingPath, "data", "file")
+			if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			if err := os.WriteFile(filePath, nil, 0600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if err := os.Chmod(stagingPath, 0700); err != nil {
+				t.Fatalf("Chmod: %v", err)
+			}
+			if test.rootMatches {
+				if err := setVolumeOwnership(stagingPath, gid, fsGroupChangeAlways, false); err != nil {
+					t.Fatalf("setVolumeOwnership: %v", err)
+				}
+				if err := os.Chmod(filePath, 0600); err != nil {
+					t.Fatalf("Chmod: %v", err)
+				}
+			}
+
+			group := test.group
+			if group == "" {
+				group = strconv.Itoa(gid)
+			}
+			capability := mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			capability.GetMount().VolumeMountGroup = group
+			if test.block {
+				// Block volumes have no filesystem to give the group to
+				capability = blockCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+			}
+			_, err := n.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          testVolumeNqn,
+				StagingTargetPath: stage.StagingTargetPath,
+				TargetPath:        filepath.Join(t.TempDir(), "pod-a"),
+				VolumeCapability:  capability,
+				VolumeContext:     stage.VolumeContext,
+				Readonly:          test.readonly,
+			})
+			if status.Code(err) != test.want {
+				t.Fatalf("NodePublishVolume code = %v, want %v: %v", status.Code(err), test.want, err)
+			}
+
+			// The group is applied to the whole volume, directories getting the
+			// setgid bit so that new files inherit it
+			fileGid, fileMode := fileOwnership(t, filePath)
+			if test.wantFileMode == 0 {
+				if fileMode.Perm() != 0600 {
+					t.Errorf("mode of the unchanged file = %v, want 0600", fileMode)
+				}
+				return
+			}
+			if fileGid != gid || fileMode.Perm() != test.wantFileMode {
+				t.Errorf("file group %d mode %v, want group %d mode %v", fileGid, fileMode, gid, test.wantFileMode)
+			}
+			for _, dir := range []string{stagingPath, filepath.Dir(filePath)} {
+				dirGid, dirMode := fileOwnership(t, dir)
+				if dirGid != gid || dirMode&os.ModeSetgid == 0 || dirMode.Perm()&0070 != test.wantFileMode.Perm()&0070|0010 {
+					t.Errorf("directory %s group %d mode %v, want group %d, setgid and group permissions of %v", dir, dirGid, dirMode, gid, test.wantFileMode)
+				}
+			}
+		})
+	}
+}
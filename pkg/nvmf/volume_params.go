@@ -0,0 +1,380 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// knownParams are the StorageClass parameters and volume context keys of the driver
+var knownParams = map[string]struct{}{
+	paramAddr:                    {},
+	paramPort:                    {},
+	paramType:                    {},
+	paramEndpoint:                {},
+	paramEndpointPriority:        {},
+	paramNamespaces:              {},
+	paramAllocationGranularity:   {},
+	paramReserveHeadroomPercent:  {},
+	paramCapacityOverheadPercent: {},
+	paramFsType:                  {},
+	paramMkfsOptions:             {},
+	paramFsGroupChangePolicy:     {},
+	paramFsckOnStage:             {},
+	paramKeepAliveTmo:            {},
+	paramCtrlLossTmo:             {},
+	paramReconnectDelay:          {},
+	paramNrIoQueues:              {},
+	paramHostNqn:                 {},
+	paramDryRun:                  {},
+	paramSkipWipe:                {},
+	paramAffinityKey:             {},
+	paramAntiAffinityKey:         {},
+	paramStrict:                  {},
+	paramPinnedNqn:               {},
+	paramMaxIops:                 {},
+	paramMaxBandwidthMBps:        {},
+	paramBurstIops:               {},
+	paramQoSRequired:             {},
+	paramAllowedHostNqns:         {},
+	paramProvisioningMode:        {},
+	volumeContextUsedBytes:       {},
+	volumeContextDeviceCapacity:  {},
+	volumeContextSealed:          {},
+}
+
+// knownParamPrefixes are the prefixes of the volume context keys of the driver
+var knownParamPrefixes = []string{volumeContextLabelPrefix}
+
+// reservedParamPrefixes are the prefixes of the keys the external provisioner
+// and the kubelet add to the parameters and the volume context, e.g. the PVC
+// name or the pod info
+var reservedParamPrefixes = []string{"csi.storage.k8s.io/", "storage.kubernetes.io/"}
+
+// VolumeParams are the validated StorageClass parameters of a volume, or the
+// volume context recorded from them
+type VolumeParams struct {
+	// Discovery of the devices, TargetAddr and TargetPort may be comma-separated lists
+	TargetAddr string
+	TargetPort string
+	Transport  string
+	Namespaces []uint32
+
+	// Endpoints of the allocated device, recorded in the volume context, in
+	// the order the node connects them
+	Endpoints []string
+	// EndpointPriorities are recorded with the endpoints in the volume context
+	EndpointPriorities []endpointPriority
+
+	AllocationGranularity int64
+	// ReserveHeadroomPercent overrides the driver default, nil if unset
+	ReserveHeadroomPercent *int
+	// CapacityOverheadPercent is the share of the raw device capacity that is
+	// not usable by the volume once formatted
+	CapacityOverheadPercent int
+
+	FsType              string
+	MkfsOptions         []string
+	FsGroupChangePolicy string
+	// FsckOnStage overrides the driver default, nil if unset
+	FsckOnStage *bool
+
+	// ConnectArgs are the connect tuning options, e.g. "keep_alive_tmo=5"
+	ConnectArgs []string
+	HostNqn     string
+
+	DryRun    bool
+	SkipWipe  bool
+	Placement placementHints
+	// PinnedNqn is the volume ID of the pre-existing device to bind, empty to select one
+	PinnedNqn string
+
+	// QoS are the I/O limits applied by the backend, QoSRequired fails volumes
+	// whose backend cannot apply them
+	QoS         BackendQoS
+	QoSRequired bool
+
+	// AllowedHosts are the sorted host NQNs the subsystem of the volume allows,
+	// managed by backends with the host-acl capability
+	AllowedHosts []string
+
+	// ProvisioningMode selects a pre-created device or has the backend create
+	// a namespace for the volume
+	ProvisioningMode string
+
+	// The PVC of the request, if the provisioner passes it
+	PVCName      string
+	PVCNamespace string
+}
+
+// ParseVolumeParams validates and normalizes parameters. A malformed value or
+// an unknown key is rejected with InvalidArgument.
+func ParseVolumeParams(params map[string]string) (*VolumeParams, error) {
+	if unknown := unknownParams(params); len(unknown) > 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown parameter(s): %s", strings.Join(unknown, ", "))
+	}
+
+	values := make(map[string]string, len(params))
+	for key, value := range params {
+		values[key] = strings.TrimSpace(value)
+	}
+
+	p := &VolumeParams{
+		TargetAddr:          values[paramAddr],
+		TargetPort:          values[paramPort],
+		Transport:           strings.ToLower(values[paramType]),
+		FsType:              values[paramFsType],
+		MkfsOptions:         strings.Fields(values[paramMkfsOptions]),
+		FsGroupChangePolicy: values[paramFsGroupChangePolicy],
+		HostNqn:             values[paramHostNqn],
+		PinnedNqn:           values[paramPinnedNqn],
+		PVCName:             values[paramPVCName],
+		PVCNamespace:        values[paramPVCNamespace],
+	}
+
+	if p.Transport != "" && p.Transport != "tcp" && p.Transport != "rdma" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s must be tcp or rdma, got: %q", paramType, values[paramType])
+	}
+	var err error
+	if value := values[paramEndpoint]; value != "" {
+		entries := []string{}
+		for _, endpoint := range strings.Split(value, ",") {
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				entries = append(entries, endpoint)
+			}
+		}
+		if p.Endpoints, err = sortEndpoints(entries); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", paramEndpoint, err)
+		}
+		for _, endpoint := range p.Endpoints {
+			if _, _, err := splitEndpoint(endpoint); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", paramEndpoint, err)
+			}
+		}
+	}
+	if p.TargetAddr != "" {
+		for _, addr := range targetAddrs(p.TargetAddr) {
+			if err := validateTargetAddr(addr); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", paramAddr, err)
+			}
+		}
+	}
+	if p.TargetPort != "" {
+		for _, port := range strings.Split(p.TargetPort, ",") {
+			if err := validateTargetPort(strings.TrimSpace(port)); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", paramPort, err)
+			}
+		}
+	}
+	if p.EndpointPriorities, err = parseEndpointPriorities(values[paramEndpointPriority]); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", paramEndpointPriority, err)
+	}
+
+	if p.Namespaces, err = parseNamespaceIDs(values[paramNamespaces]); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %v", paramNamespaces, err)
+	}
+	if p.AllocationGranularity, err = parseAllocationGranularity(values); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if value, exists := values[paramReserveHeadroomPercent]; exists {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent >= 100 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s must be an integer between 0 and 99, got: %q", paramReserveHeadroomPercent, value)
+		}
+		p.ReserveHeadroomPercent = &percent
+	}
+	if value, exists := values[paramCapacityOverheadPercent]; exists {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent >= 100 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s must be an integer between 0 and 99, got: %q", paramCapacityOverheadPercent, value)
+		}
+		p.CapacityOverheadPercent = percent
+	}
+
+	if !isSupportedFsType(p.FsType) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s: %s", paramFsType, p.FsType)
+	}
+	switch p.FsGroupChangePolicy {
+	case "", fsGroupChangeAlways, fsGroupChangeOnRootMismatch:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "%s must be %s or %s, got: %q",
+			paramFsGroupChangePolicy, fsGroupChangeAlways, fsGroupChangeOnRootMismatch, p.FsGroupChangePolicy)
+	}
+
+	if value, exists := values[paramFsckOnStage]; exists {
+		fsck, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s", paramFsckOnStage, value)
+		}
+		p.FsckOnStage = &fsck
+	}
+
+	if p.ConnectArgs, err = parseConnectTuning(values); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p.HostNqn != "" && !isValidNQN(p.HostNqn) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s is not a valid NQN", paramHostNqn, p.HostNqn)
+	}
+
+	if p.PinnedNqn != "" && !isValidVolumeNQN(p.PinnedNqn) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s is not a valid NQN", paramPinnedNqn, p.PinnedNqn)
+	}
+
+	if p.DryRun, err = parseBoolParam(values, paramDryRun); err != nil {
+		return nil, err
+	}
+	if p.SkipWipe, err = parseBoolParam(values, paramSkipWipe); err != nil {
+		return nil, err
+	}
+	if p.Placement, err = parsePlacementHints(values); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p.QoS, err = parseQoS(values); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p.QoSRequired, err = parseBoolParam(values, paramQoSRequired); err != nil {
+		return nil, err
+	}
+	if p.AllowedHosts, err = parseAllowedHosts(values[paramAllowedHostNqns]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p.ProvisioningMode, err = parseProvisioningMode(p, values[paramProvisioningMode]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return p, nil
+}
+
+// parseVolumeParams parses parameters, dropping unknown keys with a warning
+// unless the driver is configured to reject them
+func (d *driver) parseVolumeParams(params map[string]string) (*VolumeParams, error) {
+	if d.strictParameters {
+		return ParseVolumeParams(params)
+	}
+
+	unknown := unknownParams(params)
+	if len(unknown) == 0 {
+		return ParseVolumeParams(params)
+	}
+	klog.Warningf("Ignoring unknown parameter(s): %s", strings.Join(unknown, ", "))
+
+	known := make(map[string]string, len(params))
+	for key, value := range params {
+		known[key] = value
+	}
+	for _, key := range unknown {
+		delete(known, key)
+	}
+
+	return ParseVolumeParams(known)
+}
+
+// unknownParams returns the sorted keys of params the driver does not know
+func unknownParams(params map[string]string) []string {
+	unknown := []string{}
+	for key := range params {
+		if _, exists := knownParams[key]; exists || hasParamPrefix(key, knownParamPrefixes) || hasParamPrefix(key, reservedParamPrefixes) {
+			continue
+		}
+		unknown = append(unknown, key)
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+func hasParamPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBoolParam parses an optional boolean parameter, which defaults to false
+func parseBoolParam(values map[string]string, key string) (bool, error) {
+	value, exists := values[key]
+	if !exists {
+		return false, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid %s: %s", key, value)
+	}
+
+	return parsed, nil
+}
+
+// reserveHeadroomPercent returns the headroom override, or defaultPercent if unset
+func (p *VolumeParams) reserveHeadroomPercent(defaultPercent int) int {
+	if p.ReserveHeadroomPercent == nil {
+		return defaultPercent
+	}
+	return *p.ReserveHeadroomPercent
+}
+
+// headroomPercent returns the headroom of the parameters, or the driver
+// default. Headroom is reserved from the probed capacity of the devices, so it
+// requires the capacity probe, without which it would never be enforced.
+func (d *driver) headroomPercent(params *VolumeParams) (int, error) {
+	percent := params.reserveHeadroomPercent(d.reserveHeadroomPercent)
+	if percent > 0 && !d.probeDeviceCapacity {
+		return 0, status.Errorf(codes.InvalidArgument, "%s requires the device capacity probe, enabled by --probe-device-capacity", paramReserveHeadroomPercent)
+	}
+	return percent, nil
+}
+
+// volumeContext returns the parameters the node server needs, to be recorded
+// in the volume context of a volume
+func (p *VolumeParams) volumeContext() map[string]string {
+	volumeContext := map[string]string{}
+	for key, value := range map[string]string{
+		paramFsType:              p.FsType,
+		paramMkfsOptions:         strings.Join(p.MkfsOptions, " "),
+		paramFsGroupChangePolicy: p.FsGroupChangePolicy,
+		paramHostNqn:             p.HostNqn,
+		paramAffinityKey:         p.Placement.AffinityKey,
+		paramAntiAffinityKey:     p.Placement.AntiAffinityKey,
+		paramAllowedHostNqns:     strings.Join(p.AllowedHosts, ","),
+	} {
+		if value != "" {
+			volumeContext[key] = value
+		}
+	}
+	for key, value := range connectTuningValues(p.ConnectArgs) {
+		volumeContext[key] = value
+	}
+	for key, value := range qosValues(p.QoS) {
+		volumeContext[key] = value
+	}
+	if p.FsckOnStage != nil {
+		volumeContext[paramFsckOnStage] = strconv.FormatBool(*p.FsckOnStage)
+	}
+	if p.ProvisioningMode == provisioningModeDynamic {
+		volumeContext[paramProvisioningMode] = p.ProvisioningMode
+	}
+
+	return volumeContext
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseVolumeParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		// check verifies the parsed parameters
+		check func(t *testing.T, p *VolumeParams)
+		// wantErr is a part of the message of the expected InvalidArgument error
+		wantErr string
+	}{
+		{
+			name:   "empty",
+			params: map[string]string{},
+			check: func(t *testing.T, p *VolumeParams) {
+				if p.TargetAddr != "" || p.Transport != "" || p.FsckOnStage != nil || p.ReserveHeadroomPercent != nil {
+					t.Errorf("parsed %+v, want no value set", p)
+				}
+			},
+		},
+		{
+			name:   "partial",
+			params: map[string]string{paramAddr: "192.0.2.10"},
+			check: func(t *testing.T, p *VolumeParams) {
+				if p.TargetAddr != "192.0.2.10" || p.TargetPort != "" || p.Transport != "" {
+					t.Errorf("parsed %+v, want only the address", p)
+				}
+			},
+		},
+		{
+			name: "valid",
+			params: map[string]string{
+				paramAddr:                   "192.0.2.10,192.0.2.11",
+				paramPort:                   "4420",
+				paramType:                   " TCP ",
+				paramFsType:                 "xfs",
+				paramMkfsOptions:            "-m  crc=1",
+				paramFsckOnStage:            "true",
+				paramReserveHeadroomPercent: "10",
+				paramKeepAliveTmo:           "5",
+				paramDryRun:                 "true",
+				paramPVCName:                "data",
+			},
+			check: func(t *testing.T, p *VolumeParams) {
+				if p.TargetAddr != "192.0.2.10,192.0.2.11" || p.TargetPort != "4420" || p.Transport != "tcp" {
+					t.Errorf("parsed target %s:%s (%s), want 192.0.2.10,192.0.2.11:4420 (tcp)", p.TargetAddr, p.TargetPort, p.Transport)
+				}
+				if p.FsType != "xfs" || !reflect.DeepEqual(p.MkfsOptions, []string{"-m", "crc=1"}) {
+					t.Errorf("parsed filesystem %s %v, want xfs [-m crc=1]", p.FsType, p.MkfsOptions)
+				}
+				if p.FsckOnStage == nil || !*p.FsckOnStage || p.reserveHeadroomPercent(0) != 10 {
+					t.Errorf("parsed fsck %v and headroom %d, want true and 10", p.FsckOnStage, p.reserveHeadroomPercent(0))
+				}
+				if !reflect.DeepEqual(p.ConnectArgs, []string{"keep_alive_tmo=5"}) {
+					t.Errorf("parsed connect options %v, want [keep_alive_tmo=5]", p.ConnectArgs)
+				}
+				if !p.DryRun || p.PVCName != "data" {
+					t.Errorf("parsed dry run %v and PVC %q, want true and data", p.DryRun, p.PVCName)
+				}
+			},
+		},
+		{name: "unknown key", params: map[string]string{paramAddr: "192.0.2.10", "targetAddr": "192.0.2.10"}, wantErr: "unknown parameter(s): targetAddr"},
+		{name: "unsupported transport", params: map[string]string{paramType: "fc"}, wantErr: paramType},
+		{name: "invalid port", params: map[string]string{paramPort: "4420,70000"}, wantErr: paramPort},
+		{name: "invalid address", params: map[string]string{paramAddr: "192.0.2.10,not an address"}, wantErr: paramAddr},
+		{name: "headroom out of range", params: map[string]string{paramReserveHeadroomPercent: "100"}, wantErr: paramReserveHeadroomPercent},
+		{name: "unsupported fsType", params: map[string]string{paramFsType: "ntfs"}, wantErr: paramFsType},
+		{name: "malformed fsck", params: map[string]string{paramFsckOnStage: "sometimes"}, wantErr: paramFsckOnStage},
+		{name: "malformed tuning", params: map[string]string{paramKeepAliveTmo: "five"}, wantErr: paramKeepAliveTmo},
+		{name: "invalid host NQN", params: map[string]string{paramHostNqn: "host-1"}, wantErr: paramHostNqn},
+		{name: "malformed dry run", params: map[string]string{paramDryRun: "maybe"}, wantErr: paramDryRun},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := ParseVolumeParams(test.params)
+			if test.wantErr != "" {
+				if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseVolumeParams(%v) = %v, want InvalidArgument naming %q", test.params, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVolumeParams(%v): %v", test.params, err)
+			}
+			test.check(t, p)
+		})
+	}
+}
+
+func TestDriverParseVolumeParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		params  map[string]string
+		wantErr bool
+	}{
+		{name: "unknown key ignored", params: map[string]string{paramAddr: "192.0.2.10", "custom": "value"}},
+		{name: "unknown key rejected in strict mode", strict: true, params: map[string]string{paramAddr: "192.0.2.10", "custom": "value"}, wantErr: true},
+		{name: "reserved keys in strict mode", strict: true, params: map[string]string{paramAddr: "192.0.2.10", "csi.storage.k8s.io/pv/name": "pv-1", "storage.kubernetes.io/csiProvisionerIdentity": "id"}},
+		{name: "malformed known key ignoring unknown ones", params: map[string]string{paramType: "fc", "custom": "value"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &driver{strictParameters: test.strict}
+			p, err := d.parseVolumeParams(test.params)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseVolumeParams(%v) error = %v, want error %v", test.params, err, test.wantErr)
+			}
+			if err == nil && p.TargetAddr != "192.0.2.10" {
+				t.Errorf("parsed address %q, want 192.0.2.10", p.TargetAddr)
+			}
+		})
+	}
+}
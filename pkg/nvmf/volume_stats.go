@@ -0,0 +1,159 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+)
+
+// nvmeControllerLive is the sysfs state of a healthy NVMe controller
+const nvmeControllerLive = "live"
+
+// getVolumeUsage returns the usage of a published volume. Filesystem volumes
+// report bytes and inodes, block volumes report only the device capacity.
+func getVolumeUsage(volumePath string) ([]*csi.VolumeUsage, error) {
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		capacity, err := getBlockDeviceSize(volumePath)
+		if err != nil {
+			return nil, err
+		}
+		return []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: capacity,
+			},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return nil, fmt.Errorf("statfs %s failed: %v", volumePath, err)
+	}
+
+	blockSize := int64(statfs.Bsize)
+	totalBytes := int64(statfs.Blocks) * blockSize
+	availableBytes := int64(statfs.Bavail) * blockSize
+	usedBytes := (int64(statfs.Blocks) - int64(statfs.Bfree)) * blockSize
+
+	totalInodes := int64(statfs.Files)
+	freeInodes := int64(statfs.Ffree)
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     totalBytes,
+			Available: availableBytes,
+			Used:      usedBytes,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     totalInodes,
+			Available: freeInodes,
+			Used:      totalInodes - freeInodes,
+		},
+	}, nil
+}
+
+// getBlockDeviceSize returns the size in bytes of the block device at the path
+func getBlockDeviceSize(devicePath string) (int64, error) {
+	file, err := os.Open(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s: %v", devicePath, err)
+	}
+
+	return size, nil
+}
+
+// getVolumeCondition checks the NVMe controller and namespace device backing the volume
+func getVolumeCondition(client NvmeClient, volumeID string) *csi.VolumeCondition {
+	nqn, nsid := parseVolumeID(volumeID)
+	controller, found := findController(client, nqn, "")
+	if !found {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("no NVMe controller connected for %s", nqn),
+		}
+	}
+
+	if controller.State != nvmeControllerLive {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("NVMe controller %s is in state %q", controller.Name, controller.State),
+		}
+	}
+
+	if devicePaths, err := client.ListNamespaces(controller.Name, nsid); err != nil || len(devicePaths) == 0 {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("namespace device of NVMe controller %s has disappeared", controller.Name),
+		}
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
+}
+
+// getControllerState reads the sysfs state of an NVMe controller (e.g. live, connecting, deleting)
+func getControllerState(controller string) string {
+	data, err := os.ReadFile(filepath.Join(SYS_NVMF, controller, "state"))
+	if err != nil {
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// namespaceDevicePaths returns the existing /dev paths of namespace nsid of the
+// controller, or of all its namespaces if nsid is 0
+func namespaceDevicePaths(controller string, nsid uint32) []string {
+	devicePaths := []string{}
+	for _, ns := range namespaceDirs(controller, nsid) {
+		// With native multipath the controller path (nvme2c2n1) is exposed
+		// through the head device (nvme2n1)
+		name := filepath.Base(ns)
+		if c, n := strings.Index(name, "c"), strings.LastIndex(name, "n"); c > 0 && n > c {
+			name = name[:c] + name[n:]
+		}
+
+		devicePath := filepath.Join("/dev", name)
+		if _, err := os.Stat(devicePath); err == nil {
+			devicePaths = append(devicePaths, devicePath)
+		}
+	}
+
+	return devicePaths
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+// warmPoolHostNqn is the host NQN the controller connects with to format free
+// devices. Targets restricting hosts must allow it.
+const warmPoolHostNqn = "nqn.2014-08.org.nvmexpress:csi-nvmf:warm-pool"
+
+// requestedFsType returns the filesystem a volume is staged with, resolved as
+// the node does, empty if a capability accesses the volume as a block device
+func requestedFsType(caps []*csi.VolumeCapability, params *VolumeParams) string {
+	fsType := ""
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return ""
+		}
+		if t := c.GetMount().GetFsType(); t != "" {
+			fsType = t
+		}
+	}
+	if fsType == "" {
+		fsType = params.FsType
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	return fsType
+}
+
+// formatCompatible reports whether the volume of the request can be staged on
+// the device. A device holding a filesystem is not staged as another, and a
+// pre-formatted device suits mount volumes of its filesystem that need no
+// extra mkfs arguments, and block volumes, which ignore its filesystem.
+func (v *VolumeInfo) formatCompatible(req *AllocationRequest) bool {
+	if v.Prewarmed {
+		return req.FsType == "" || (req.FsType == v.FsType && len(req.MkfsOptions) == 0)
+	}
+
+	return v.FsType == "" || req.FsType == "" || req.FsType == v.FsType
+}
+
+// placeFormattedDevice places the request among the candidates whose filesystem
+// suits it, preferring the devices the warm pool formatted for it, so that
+// staging skips mkfs, unless the request has placement hints. Block volumes
+// fall back to pre-formatted devices once no other device suits them. A
+// pinned request is placed as requested. Caller must hold the mutex.
+func (r *DeviceRegistry) placeFormattedDevice(candidates []*VolumeInfo, req *AllocationRequest) (*VolumeInfo, error) {
+	if req.PinnedID != "" {
+		return r.placeDevice(candidates, req)
+	}
+
+	compatible := make([]*VolumeInfo, 0, len(candidates))
+	warm := []*VolumeInfo{}
+	fallback := []*VolumeInfo{}
+	for _, device := range candidates {
+		if !device.formatCompatible(req) {
+			registryLog.V(4).Infof("Device %s skipped: it holds a %s filesystem, requested %q", device.volumeID(), device.FsType, req.FsType)
+			continue
+		}
+		if device.Prewarmed && req.FsType == "" {
+			fallback = append(fallback, device)
+			continue
+		}
+		compatible = append(compatible, device)
+		if device.Prewarmed {
+			warm = append(warm, device)
+		}
+	}
+
+	if len(warm) > 0 && !req.Placement.isSet() {
+		if device, err := selectDevice(warm, req); err == nil {
+			registryLog.V(4).Infof("Device %s is pre-formatted as %s for volume %s", device.volumeID(), device.FsType, req.VolumeName)
+			return device, nil
+		}
+	}
+
+	device, err := r.placeDevice(compatible, req)
+	if err != nil && len(fallback) > 0 {
+		if device, fallbackErr := r.placeDevice(fallback, req); fallbackErr == nil {
+			registryLog.V(4).Infof("Device %s pre-formatted as %s backs block volume %s, no blank device suits it", device.volumeID(), device.FsType, req.VolumeName)
+			return device, nil
+		}
+	}
+
+	return device, err
+}
+
+// warmPool keeps free devices formatted with a filesystem, so that staging
+// their volumes skips mkfs. The devices are inspected and formatted one at a
+// time out of the pool, so that they are never allocated meanwhile, and
+// allocated devices are never touched. Only blank devices are formatted, and
+// at most half of the free devices, so that mount volumes of other
+// filesystems still find blank devices.
+type warmPool struct {
+	registry *DeviceRegistry
+	size     int
+	fsType   string
+	interval time.Duration
+}
+
+func newWarmPool(registry *DeviceRegistry, size int, fsType string, interval time.Duration) *warmPool {
+	return &warmPool{
+		registry: registry,
+		size:     size,
+		fsType:   fsType,
+		interval: interval,
+	}
+}
+
+// run refills the pool every interval
+func (wp *warmPool) run() {
+	ticker := time.NewTicker(wp.interval)
+	defer ticker.Stop()
+
+	for {
+		wp.refill()
+		<-ticker.C
+	}
+}
+
+// refill inspects the free devices not inspected since their last allocation
+// until size of them are pre-formatted. A device that fails is retried by the
+// next refill.
+func (wp *warmPool) refill() {
+	// A device a node claimed is not free, whether or not it was allocated
+	if wp.registry.Driver.ephemeralVolumes {
+		ctx, cancel := context.WithTimeout(context.Background(), allocationRecordTimeout)
+		wp.registry.refreshEphemeralClaims(ctx)
+		cancel()
+	}
+
+	failed := map[string]struct{}{}
+	formatted := 0
+	for {
+		id, diskInfo := wp.registry.reserveForWarming(wp.size, failed)
+		if diskInfo == nil {
+			break
+		}
+
+		fsType, prewarmed, err := wp.prepare(id, diskInfo)
+		if err != nil {
+			klog.Warningf("Warm pool: failed to prepare device %s: %v", id, err)
+			failed[id] = struct{}{}
+		} else if prewarmed {
+			formatted++
+		}
+		wp.registry.finishWarming(id, fsType, prewarmed, err)
+	}
+
+	registryLog.V(4).Infof("Warm pool: formatted %d device(s) as %s, %d failed", formatted, wp.fsType, len(failed))
+}
+
+// prepare connects the device and formats it unless it holds a filesystem. It
+// returns the filesystem of the device and whether it formatted it. A subsystem
+// connected on this host is left alone.
+func (wp *warmPool) prepare(id string, diskInfo *nvmfDiskInfo) (string, bool, error) {
+	driver := wp.registry.Driver
+	client := driver.nvme
+
+	if _, exists := findController(client, diskInfo.Nqn, ""); exists {
+		registryLog.V(4).Infof("Warm pool: subsystem %s of device %s is connected on this host, leaving it", diskInfo.Nqn, id)
+		return "", false, nil
+	}
+
+	connector := getNvmfConnector(diskInfo, warmPoolHostNqn, driver.connectOptions())
+	devicePath, err := client.Connect(connector)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to connect: %v", err)
+	}
+	defer func() {
+		if err := client.Disconnect(diskInfo.Nqn, warmPoolHostNqn, driver.nvmeCliTimeout); err != nil {
+			klog.Errorf("Failed to disconnect warm pool connection of %s: %v", diskInfo.Nqn, err)
+		}
+	}()
+
+	if err := verifyNamespaceIdentity(devicePath, diskInfo.Nqn, diskInfo.Nsid); err != nil {
+		return "", false, err
+	}
+
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+	existingFormat, err := mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to detect filesystem: %v", err)
+	}
+	if existingFormat != "" {
+		registryLog.V(4).Infof("Warm pool: device %s already holds a %s filesystem", id, existingFormat)
+		return existingFormat, false, nil
+	}
+
+	if err := formatDevice(devicePath, wp.fsType, nil, mounter.Exec); err != nil {
+		return "", false, err
+	}
+	klog.Infof("Warm pool: formatted free device %s as %s", id, wp.fsType)
+
+	return wp.fsType, true, nil
+}
+
+// reserveForWarming takes the next free device to inspect out of the pool,
+// unless size free devices, or half of them, are pre-formatted. Devices in
+// skip are not taken. It returns a copy of the disk info of the device, nil if
+// there is none.
+func (r *DeviceRegistry) reserveForWarming(size int, skip map[string]struct{}) (string, *nvmfDiskInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	free, warm := 0, 0
+	next := ""
+	for id := range r.availableNQNs {
+		device := r.devices[id]
+		if r.inMaintenance(device.nvmfDiskInfo) {
+			continue
+		}
+		free++
+		if device.Prewarmed {
+			warm++
+			continue
+		}
+		if _, skipped := skip[id]; skipped || device.Inspected {
+			continue
+		}
+		if next == "" || id < next {
+			next = id
+		}
+	}
+	if warm >= size || 2*(warm+1) > free || next == "" {
+		return "", nil
+	}
+
+	device := r.devices[next]
+	delete(r.availableNQNs, next)
+	device.warming = true
+
+	diskInfo := *device.nvmfDiskInfo
+	return next, &diskInfo
+}
+
+// finishWarming records the filesystem of a device the warm pool inspected,
+// unless it failed, and returns the device to the pool. A device the device
+// filter denied meanwhile is dropped from the registry.
+func (r *DeviceRegistry) finishWarming(id, fsType string, prewarmed bool, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	device, exists := r.devices[id]
+	if !exists || !device.warming {
+		return
+	}
+	device.warming = false
+	if err == nil {
+		device.FsType = fsType
+		device.Prewarmed = prewarmed
+		device.Inspected = true
+	}
+
+	switch {
+	case device.IsAllocated || device.isQuarantined():
+		klog.Errorf("Warm pool: device %s was allocated while being inspected", id)
+	case device.IsExcluded || device.IsStale:
+		klog.Infof("Device %s is excluded by the device filter, removing from registry", id)
+		delete(r.devices, id)
+		r.recordRemoval(id)
+	default:
+		r.availableNQNs[id] = struct{}{}
+	}
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+)
+
+// warmTestDevice returns a free device of the warm pool tests
+func warmTestDevice(name, fsType string, prewarmed, inspected bool) *VolumeInfo {
+	return &VolumeInfo{
+		nvmfDiskInfo: &nvmfDiskInfo{Nqn: "nqn.2024-01.io.example:" + name, Transport: "tcp"},
+		FsType:       fsType,
+		Prewarmed:    prewarmed,
+		Inspected:    inspected,
+	}
+}
+
+func TestPlaceFormattedDevice(t *testing.T) {
+	blank := warmTestDevice("blank", "", false, true)
+	warm := warmTestDevice("warm", "ext4", true, true)
+	xfs := warmTestDevice("xfs", "xfs", false, true)
+
+	tests := []struct {
+		name       string
+		candidates []*VolumeInfo
+		req        AllocationRequest
+		want       *VolumeInfo
+	}{
+		{
+			name:       "mount volume of the pool filesystem prefers a warm device",
+			candidates: []*VolumeInfo{blank, warm},
+			req:        AllocationRequest{FsType: "ext4"},
+			want:       warm,
+		},
+		{
+			name:       "mount volume with mkfs options skips warm devices",
+			candidates: []*VolumeInfo{warm, blank},
+			req:        AllocationRequest{FsType: "ext4", MkfsOptions: []string{"-b", "4096"}},
+			want:       blank,
+		},
+		{
+			name:       "mount volume of another filesystem skips warm devices",
+			candidates: []*VolumeInfo{warm, blank},
+			req:        AllocationRequest{FsType: "xfs"},
+			want:       blank,
+		},
+		{
+			name:       "mount volume of another filesystem takes a device holding it",
+			candidates: []*VolumeInfo{warm, xfs},
+			req:        AllocationRequest{FsType: "xfs"},
+			want:       xfs,
+		},
+		{
+			name:       "mount volume of another filesystem with only warm devices",
+			candidates: []*VolumeInfo{warm},
+			req:        AllocationRequest{FsType: "xfs"},
+		},
+		{
+			name:       "block volume prefers a blank device",
+			candidates: []*VolumeInfo{warm, blank},
+			req:        AllocationRequest{},
+			want:       blank,
+		},
+		{
+			name:       "block volume falls back to a warm device",
+			candidates: []*VolumeInfo{warm},
+			req:        AllocationRequest{},
+			want:       warm,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			req := test.req
+			req.VolumeName = "pv-1"
+
+			device, err := c.deviceRegistry.placeFormattedDevice(test.candidates, &req)
+			if test.want == nil {
+				if !errors.Is(err, ErrNoSuitableDevice) {
+					t.Fatalf("placeFormattedDevice = %v, %v, want no suitable device", device, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("placeFormattedDevice: %v", err)
+			}
+			if device != test.want {
+				t.Errorf("placeFormattedDevice = %s, want %s", device.volumeID(), test.want.volumeID())
+			}
+		})
+	}
+}
+
+func TestReserveForWarming(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices map[string]*VolumeInfo
+		size    int
+		skip    []string
+		want    string
+	}{
+		{
+			name: "takes the first blank device",
+			devices: map[string]*VolumeInfo{
+				"b": warmTestDevice("b", "", false, false),
+				"a": warmTestDevice("a", "", false, false),
+			},
+			size: 1,
+			want: "a",
+		},
+		{
+			name: "pool is full",
+			devices: map[string]*VolumeInfo{
+				"a": warmTestDevice("a", "ext4", true, true),
+				"b": warmTestDevice("b", "", false, false),
+				"c": warmTestDevice("c", "", false, false),
+			},
+			size: 1,
+		},
+		{
+			name: "keeps half of the free devices blank",
+			devices: map[string]*VolumeInfo{
+				"a": warmTestDevice("a", "ext4", true, true),
+				"b": warmTestDevice("b", "", false, false),
+				"c": warmTestDevice("c", "", false, false),
+			},
+			size: 3,
+		},
+		{
+			name: "half of the free devices is not reached",
+			devices: map[string]*VolumeInfo{
+				"a": warmTestDevice("a", "ext4", true, true),
+				"b": warmTestDevice("b", "", false, true),
+				"c": warmTestDevice("c", "", false, false),
+				"d": warmTestDevice("d", "", false, false),
+			},
+			size: 3,
+			want: "c",
+		},
+		{
+			name: "single free device is left blank",
+			devices: map[string]*VolumeInfo{
+				"a": warmTestDevice("a", "", false, false),
+			},
+			size: 1,
+		},
+		{
+			name: "inspected and skipped devices are not taken",
+			devices: map[string]*VolumeInfo{
+				"a": warmTestDevice("a", "xfs", false, true),
+				"b": warmTestDevice("b", "", false, false),
+				"c": warmTestDevice("c", "", false, false),
+				"d": warmTestDevice("d", "", false, false),
+			},
+			size: 2,
+			skip: []string{"b"},
+			want: "c",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestControllerServer(t, newFakeBackend())
+			r := c.deviceRegistry
+			for id, device := range test.devices {
+				r.devices[id] = device
+				r.availableNQNs[id] = struct{}{}
+			}
+			// An allocated device is never taken, nor counted as free
+			allocated := warmTestDevice("allocated", "", false, false)
+			allocated.IsAllocated = true
+			r.devices["allocated"] = allocated
+
+			skip := map[string]struct{}{}
+			for _, id := range test.skip {
+				skip[id] = struct{}{}
+			}
+			id, diskInfo := r.reserveForWarming(test.size, skip)
+			if id != test.want {
+				t.Fatalf("reserveForWarming = %q, want %q", id, test.want)
+			}
+			if id == "" {
+				if diskInfo != nil {
+					t.Errorf("reserveForWarming returned the disk info of no device")
+				}
+				return
+			}
+			if _, available := r.availableNQNs[id]; available || !r.devices[id].warming {
+				t.Errorf("device %s being warmed is still in the pool", id)
+			}
+
+			// The device is back in the pool once inspected
+			r.finishWarming(id, "ext4", true, nil)
+			device := r.devices[id]
+			if _, available := r.availableNQNs[id]; !available || device.warming || !device.Prewarmed || !device.Inspected {
+				t.Errorf("warmed device %s = %+v, want a pre-formatted device in the pool", id, device)
+			}
+		})
+	}
+}
+
+func TestFinishWarmingFailure(t *testing.T) {
+	c, _ := newTestControllerServer(t, newFakeBackend())
+	r := c.deviceRegistry
+	for _, id := range []string{"a", "b"} {
+		r.devices[id] = warmTestDevice(id, "", false, false)
+		r.availableNQNs[id] = struct{}{}
+	}
+
+	id, _ := r.reserveForWarming(1, map[string]struct{}{})
+	r.finishWarming(id, "", false, fmt.Errorf("connect failed"))
+	device := r.devices[id]
+	if _, available := r.availableNQNs[id]; !available || device.Inspected || device.Prewarmed {
+		t.Errorf("device %s that failed to warm = %+v, want it back in the pool uninspected", id, device)
+	}
+}
+
+// blkidAction returns a command reporting fsType as the filesystem of the
+// device, none if empty
+func blkidAction(fsType string) testingexec.FakeCommandAction {
+	return func(cmd string, args ...string) exec.Cmd {
+		fake := &testingexec.FakeCmd{}
+		if fsType == "" {
+			// blkid exits with 2 when the device holds no signature
+			fake.CombinedOutputScript = []testingexec.FakeAction{func() ([]byte, []byte, error) {
+				return nil, nil, &testingexec.FakeExitError{Status: 2}
+			}}
+		} else {
+			fake.CombinedOutputScript = []testingexec.FakeAction{func() ([]byte, []byte, error) {
+				return []byte("DEVNAME=/dev/nvme0n1\nTYPE=" + fsType + "\n"), nil, nil
+			}}
+		}
+		return testingexec.InitFakeCmd(fake, cmd, args...)
+	}
+}
+
+// recordAction returns a command succeeding and recording its command line
+func recordAction(commands *[]string) testingexec.FakeCommandAction {
+	return func(cmd string, args ...string) exec.Cmd {
+		*commands = append(*commands, strings.Join(append([]string{cmd}, args...), " "))
+		fake := &testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{func() ([]byte, []byte, error) { return nil, nil, nil }},
+		}
+		return testingexec.InitFakeCmd(fake, cmd, args...)
+	}
+}
+
+func TestMountFilesystemSkipsMkfsOfWarmDevice(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		fsType   string
+		wantMkfs bool
+		wantErr  bool
+	}{
+		{name: "pre-formatted device", existing: "ext4", fsType: "ext4"},
+		{name: "blank device", fsType: "ext4", wantMkfs: true},
+		{name: "device of another filesystem", existing: "xfs", fsType: "ext4", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The mounter detects the filesystem again and checks it before mounting
+			commands := []string{}
+			actions := []testingexec.FakeCommandAction{blkidAction(test.existing)}
+			if test.wantMkfs {
+				actions = append(actions, recordAction(&commands), blkidAction(test.fsType), recordAction(&commands))
+			} else if !test.wantErr {
+				actions = append(actions, blkidAction(test.existing), recordAction(&commands))
+			}
+			executor := &testingexec.FakeExec{CommandScript: actions, ExactOrder: true}
+			mounter := mount.NewFakeMounter(nil)
+			nm := &nvmfDiskMounter{
+				fsType:     test.fsType,
+				mounter:    &mount.SafeFormatAndMount{Interface: mounter, Exec: executor},
+				exec:       executor,
+				targetPath: t.TempDir(),
+			}
+
+			err := mountFilesystem("/dev/nvme0n1", nm)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("mountFilesystem error = %v, want error %v", err, test.wantErr)
+			}
+			ranMkfs := false
+			for _, command := range commands {
+				ranMkfs = ranMkfs || strings.HasPrefix(command, "mkfs.")
+			}
+			if ranMkfs != test.wantMkfs {
+				t.Errorf("mkfs ran = %v (%v), want %v", ranMkfs, commands, test.wantMkfs)
+			}
+			if executor.CommandCalls != len(actions) {
+				t.Errorf("commands run = %d, want %d", executor.CommandCalls, len(actions))
+			}
+			if mounted := len(mounter.GetLog()) > 0; mounted == test.wantErr {
+				t.Errorf("mounted = %v, want %v", mounted, !test.wantErr)
+			}
+		})
+	}
+}
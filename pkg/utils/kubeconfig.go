@@ -17,8 +17,13 @@ limitations under the License.
 package utils
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -26,24 +31,152 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// K8sClientOptions override how the driver connects to the API server, which
+// keeps the records of the driver in etcd
+type K8sClientOptions struct {
+	Endpoints []string // API server URLs, the first reachable one is used
+	CAFile    string   // CA bundle verifying the API server certificate
+	CertFile  string   // Client certificate
+	KeyFile   string   // Key of the client certificate
+	Username  string   // Basic authentication
+	Password  string
+}
+
+// endpointProbeTimeout bounds the version request probing each endpoint
+const endpointProbeTimeout = 10 * time.Second
+
+// Validate checks that the options are complete and that their certificates
+// load, so that a misconfiguration fails at startup rather than falling back
+// to an unauthenticated connection
+func (o K8sClientOptions) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	if o.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile); err != nil {
+			return fmt.Errorf("invalid client certificate %s or key %s: %v", o.CertFile, o.KeyFile, err)
+		}
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA file %s holds no PEM certificate", o.CAFile)
+		}
+	}
+	if (o.Username == "") != (o.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+
+	secured := o.CAFile != "" || o.CertFile != "" || o.Username != ""
+	for _, endpoint := range o.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return fmt.Errorf("invalid API server endpoint %q, expected http(s)://host[:port]", endpoint)
+		}
+		if secured && u.Scheme != "https" {
+			return fmt.Errorf("API server endpoint %s must use https with TLS or basic authentication options", endpoint)
+		}
+	}
+
+	return nil
+}
+
+// applyTo replaces the TLS and authentication settings of config with the
+// options that are set
+func (o K8sClientOptions) applyTo(config *rest.Config) {
+	if o.CAFile != "" {
+		config.TLSClientConfig.Insecure = false
+		config.TLSClientConfig.CAFile = o.CAFile
+		config.TLSClientConfig.CAData = nil
+	}
+	if o.CertFile != "" {
+		config.TLSClientConfig.CertFile = o.CertFile
+		config.TLSClientConfig.CertData = nil
+		config.TLSClientConfig.KeyFile = o.KeyFile
+		config.TLSClientConfig.KeyData = nil
+	}
+	if o.Username != "" {
+		// The API client rejects basic authentication along with a token
+		config.Username = o.Username
+		config.Password = o.Password
+		config.BearerToken = ""
+		config.BearerTokenFile = ""
+	}
+}
+
+// RestConfig returns the client configuration of the first reachable endpoint,
+// or, without endpoints, the discovered configuration with the options applied
+func (o K8sClientOptions) RestConfig() (*rest.Config, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(o.Endpoints) == 0 {
+		restConfig, err := discoverRestConfig()
+		if err != nil {
+			return nil, err
+		}
+		o.applyTo(restConfig)
+		return restConfig, nil
+	}
+
+	errs := []string{}
+	for _, endpoint := range o.Endpoints {
+		restConfig := &rest.Config{Host: endpoint}
+		o.applyTo(restConfig)
+
+		probeConfig := rest.CopyConfig(restConfig)
+		probeConfig.Timeout = endpointProbeTimeout
+		client, err := kubernetes.NewForConfig(probeConfig)
+		if err == nil {
+			_, err = client.Discovery().ServerVersion()
+		}
+		if err != nil {
+			klog.Warningf("API server endpoint %s is not reachable: %v", endpoint, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", endpoint, err))
+			continue
+		}
+
+		klog.Infof("Using API server endpoint %s", endpoint)
+		return restConfig, nil
+	}
+
+	return nil, fmt.Errorf("no API server endpoint is reachable: %s", strings.Join(errs, "; "))
+}
+
+// NewK8sClient returns a Kubernetes clientset connecting with the options
+func NewK8sClient(opts K8sClientOptions) (kubernetes.Interface, error) {
+	restConfig, err := opts.RestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
 // GetK8sClient returns a Kubernetes clientset using the appropriate configuration
 func GetK8sClient() (kubernetes.Interface, error) {
-	var restConfig *rest.Config
-	var err error
+	return NewK8sClient(K8sClientOptions{})
+}
 
+// discoverRestConfig returns the client configuration of KUBECONFIG, the
+// default kubeconfig or the in-cluster configuration, in that order
+func discoverRestConfig() (*rest.Config, error) {
 	// Try KUBECONFIG environment variable first
 	kubeconfig := os.Getenv("KUBECONFIG")
 	if kubeconfig != "" {
 		klog.Infof("Attempting to create k8s client from KUBECONFIG: %s", kubeconfig)
+		var err error
 		for _, kConf := range strings.Split(kubeconfig, ":") {
-			restConfig, err = clientcmd.BuildConfigFromFlags("", kConf)
-			if err == nil {
-				clientset, err := kubernetes.NewForConfig(restConfig)
-				if err == nil {
-					klog.Infof("Created k8s client from KUBECONFIG: %s", kConf)
-					return clientset, nil
-				}
+			restConfig, buildErr := clientcmd.BuildConfigFromFlags("", kConf)
+			if buildErr == nil {
+				klog.Infof("Created k8s client from KUBECONFIG: %s", kConf)
+				return restConfig, nil
 			}
+			err = buildErr
 		}
 		klog.Warningf("Failed to create k8s client from KUBECONFIG: %v", err)
 	}
@@ -54,13 +187,10 @@ func GetK8sClient() (kubernetes.Interface, error) {
 	if err == nil {
 		defaultKubeConfig := strings.Join([]string{home, ".kube", "config"}, "/")
 		if _, err := os.Stat(defaultKubeConfig); err == nil {
-			restConfig, err = clientcmd.BuildConfigFromFlags("", defaultKubeConfig)
+			restConfig, err := clientcmd.BuildConfigFromFlags("", defaultKubeConfig)
 			if err == nil {
-				clientset, err := kubernetes.NewForConfig(restConfig)
-				if err == nil {
-					klog.Infof("Created k8s client from default kubeconfig: %s", defaultKubeConfig)
-					return clientset, nil
-				}
+				klog.Infof("Created k8s client from default kubeconfig: %s", defaultKubeConfig)
+				return restConfig, nil
 			}
 			klog.Warningf("Failed to create k8s client from default kubeconfig: %v", err)
 		}
@@ -68,16 +198,11 @@ func GetK8sClient() (kubernetes.Interface, error) {
 
 	// Finally, try in-cluster config
 	klog.Info("Attempting to create k8s client using in-cluster config")
-	restConfig, err = rest.InClusterConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	clientset, err := kubernetes.NewForConfig(restConfig)
+	restConfig, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, err
 	}
 
 	klog.Info("Created k8s client using in-cluster config")
-	return clientset, nil
+	return restConfig, nil
 }
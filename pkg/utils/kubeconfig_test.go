@@ -0,0 +1,192 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCredentials are the PEM files of a client certificate and of a CA
+type testCredentials struct {
+	caFile, certFile, keyFile string
+}
+
+// writeTestFile writes data to name in dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestCredentials writes a self-signed client certificate, its key, and
+// the certificate of server as the CA
+func newTestCredentials(t *testing.T, server *httptest.Server) testCredentials {
+	t.Helper()
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "csi-nvmf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := testCredentials{
+		certFile: writeTestFile(t, dir, "client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})),
+		keyFile:  writeTestFile(t, dir, "client.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+	if server != nil {
+		creds.caFile = writeTestFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	}
+	return creds
+}
+
+func TestK8sClientOptionsValidate(t *testing.T) {
+	creds := newTestCredentials(t, nil)
+	dir := t.TempDir()
+	notPEM := writeTestFile(t, dir, "not-pem", []byte("not a certificate"))
+
+	tests := []struct {
+		name    string
+		opts    K8sClientOptions
+		wantErr bool
+	}{
+		{name: "no options"},
+		{name: "client certificate", opts: K8sClientOptions{CertFile: creds.certFile, KeyFile: creds.keyFile}},
+		{name: "CA", opts: K8sClientOptions{CAFile: creds.certFile}},
+		{name: "basic authentication", opts: K8sClientOptions{Username: "csi", Password: "secret"}},
+		{name: "endpoints", opts: K8sClientOptions{Endpoints: []string{"https://192.0.2.1:6443", "https://192.0.2.2:6443"}, CAFile: creds.certFile}},
+		{name: "plain endpoint without security", opts: K8sClientOptions{Endpoints: []string{"http://192.0.2.1:8080"}}},
+		{name: "certificate without key", opts: K8sClientOptions{CertFile: creds.certFile}, wantErr: true},
+		{name: "key without certificate", opts: K8sClientOptions{KeyFile: creds.keyFile}, wantErr: true},
+		{name: "mismatched certificate and key", opts: K8sClientOptions{CertFile: creds.certFile, KeyFile: notPEM}, wantErr: true},
+		{name: "missing CA", opts: K8sClientOptions{CAFile: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "CA without certificate", opts: K8sClientOptions{CAFile: notPEM}, wantErr: true},
+		{name: "username without password", opts: K8sClientOptions{Username: "csi"}, wantErr: true},
+		{name: "password without username", opts: K8sClientOptions{Password: "secret"}, wantErr: true},
+		{name: "invalid endpoint", opts: K8sClientOptions{Endpoints: []string{"192.0.2.1:6443"}}, wantErr: true},
+		{name: "plain endpoint with basic authentication", opts: K8sClientOptions{Endpoints: []string{"http://192.0.2.1:8080"}, Username: "csi", Password: "secret"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.opts.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRestConfig(t *testing.T) {
+	// The API server requires a client certificate and basic authentication
+	var gotUser, gotPassword string
+	var gotCerts int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPassword, _ = r.BasicAuth()
+		gotCerts = len(r.TLS.PeerCertificates)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"major": "1", "minor": "28", "gitVersion": "v1.28.0"}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	creds := newTestCredentials(t, server)
+
+	// unreachable refuses connections
+	unreachable := httptest.NewTLSServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		noCA      bool
+		wantHost  string
+		wantErr   bool
+	}{
+		{name: "single endpoint", endpoints: []string{server.URL}, wantHost: server.URL},
+		{name: "first endpoint unreachable", endpoints: []string{unreachable.URL, server.URL}, wantHost: server.URL},
+		{name: "no endpoint reachable", endpoints: []string{unreachable.URL}, wantErr: true},
+		{name: "untrusted API server", endpoints: []string{server.URL}, noCA: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotUser, gotPassword, gotCerts = "", "", 0
+			opts := K8sClientOptions{
+				Endpoints: test.endpoints,
+				CAFile:    creds.caFile,
+				CertFile:  creds.certFile,
+				KeyFile:   creds.keyFile,
+				Username:  "csi",
+				Password:  "secret",
+			}
+			if test.noCA {
+				opts.CAFile = ""
+			}
+
+			config, err := opts.RestConfig()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("RestConfig() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if config.Host != test.wantHost {
+				t.Errorf("host = %s, want %s", config.Host, test.wantHost)
+			}
+			tlsConfig := config.TLSClientConfig
+			if tlsConfig.Insecure || tlsConfig.CAFile != creds.caFile || tlsConfig.CertFile != creds.certFile || tlsConfig.KeyFile != creds.keyFile {
+				t.Errorf("TLS settings = %+v, want the CA and client certificate of the options", tlsConfig)
+			}
+			if config.Username != "csi" || config.Password != "secret" || config.BearerToken != "" {
+				t.Errorf("authentication = %s/%s (token %q), want the basic authentication of the options", config.Username, config.Password, config.BearerToken)
+			}
+			if gotCerts != 1 || gotUser != "csi" || gotPassword != "secret" {
+				t.Errorf("API server saw %d client certificate(s) and user %q/%q, want the options", gotCerts, gotUser, gotPassword)
+			}
+		})
+	}
+}
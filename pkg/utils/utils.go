@@ -18,11 +18,13 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"k8s.io/apimachinery/pkg/util/sets"
 )
@@ -30,12 +32,15 @@ import (
 type VolumeLocks struct {
 	locks sets.String //nolint:staticcheck
 	mux   sync.Mutex
+	cond  *sync.Cond // signaled when a lock is released
 }
 
 func NewVolumeLocks() *VolumeLocks {
-	return &VolumeLocks{
+	vl := &VolumeLocks{
 		locks: sets.NewString(),
 	}
+	vl.cond = sync.NewCond(&vl.mux)
+	return vl
 }
 
 // IsFileExisting check file exist in volume driver
@@ -61,10 +66,64 @@ func (vl *VolumeLocks) TryAcquire(volumeID string) bool {
 	return true
 }
 
+// Acquire blocks until the lock of volumeID is free, then takes it
+func (vl *VolumeLocks) Acquire(volumeID string) {
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+	for vl.locks.Has(volumeID) {
+		vl.cond.Wait()
+	}
+	vl.locks.Insert(volumeID)
+}
+
+// AcquireWithTimeout waits up to timeout for the lock of volumeID to be free,
+// then takes it. It gives up early when ctx is done and returns the error of
+// ctx or of the timeout.
+func (vl *VolumeLocks) AcquireWithTimeout(ctx context.Context, volumeID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Wake the waiters so that this one notices ctx is done
+	go func() {
+		<-ctx.Done()
+		vl.mux.Lock()
+		vl.cond.Broadcast()
+		vl.mux.Unlock()
+	}()
+
+	vl.mux.Lock()
+	defer vl.mux.Unlock()
+	for vl.locks.Has(volumeID) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		vl.cond.Wait()
+	}
+	vl.locks.Insert(volumeID)
+	return nil
+}
+
 func (vl *VolumeLocks) Release(volumeID string) {
 	vl.mux.Lock()
 	defer vl.mux.Unlock()
 	vl.locks.Delete(volumeID)
+	vl.cond.Broadcast()
+}
+
+// WaitForIdle waits until no lock is held or the timeout expires.
+// It returns the IDs that are still locked when the timeout expires.
+func (vl *VolumeLocks) WaitForIdle(timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		vl.mux.Lock()
+		held := vl.locks.List()
+		vl.mux.Unlock()
+
+		if len(held) == 0 || time.Now().After(deadline) {
+			return held
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
 func ParseEndpoint(ep string) (string, string, error) {
@@ -0,0 +1,73 @@
+/*
+Copyright 2025 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireWithTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		held        bool
+		releaseIn   time.Duration
+		cancelIn    time.Duration
+		timeout     time.Duration
+		wantErr     error
+		wantMinWait time.Duration
+	}{
+		{name: "free lock", timeout: time.Second},
+		{name: "released while waiting", held: true, releaseIn: 100 * time.Millisecond, timeout: time.Second, wantMinWait: 100 * time.Millisecond},
+		{name: "held past the timeout", held: true, timeout: 100 * time.Millisecond, wantErr: context.DeadlineExceeded, wantMinWait: 100 * time.Millisecond},
+		{name: "cancelled while waiting", held: true, cancelIn: 100 * time.Millisecond, timeout: time.Second, wantErr: context.Canceled, wantMinWait: 100 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vl := NewVolumeLocks()
+			if test.held {
+				vl.Acquire("vol-1")
+			}
+			if test.releaseIn > 0 {
+				time.AfterFunc(test.releaseIn, func() { vl.Release("vol-1") })
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelIn > 0 {
+				time.AfterFunc(test.cancelIn, cancel)
+			}
+
+			start := time.Now()
+			err := vl.AcquireWithTimeout(ctx, "vol-1", test.timeout)
+			elapsed := time.Since(start)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("AcquireWithTimeout = %v, want %v", err, test.wantErr)
+			}
+			if elapsed < test.wantMinWait || elapsed > test.timeout+500*time.Millisecond {
+				t.Errorf("AcquireWithTimeout returned after %v, want between %v and the timeout of %v", elapsed, test.wantMinWait, test.timeout)
+			}
+
+			// Either the waiter or the first holder keeps the lock
+			if vl.TryAcquire("vol-1") {
+				t.Error("TryAcquire after AcquireWithTimeout succeeded, want the lock held")
+			}
+		})
+	}
+}